@@ -0,0 +1,283 @@
+// agent.go -- run and manage the key agent
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// sigtool agent start|add|list|remove ...
+func agent(args []string) {
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s agent --help'", os.Args[0])
+	}
+
+	switch args[0] {
+	case "start", "s":
+		agentStart(args[1:])
+	case "add", "a":
+		agentAdd(args[1:])
+	case "list", "l":
+		agentList(args[1:])
+	case "remove", "rm", "r":
+		agentRemove(args[1:])
+	case "proxy":
+		agentProxy(args[1:])
+	case "-h", "--help", "help":
+		agentUsage()
+		os.Exit(0)
+	default:
+		die("unknown agent command %s. Try '%s agent --help'", args[0], os.Args[0])
+	}
+}
+
+func agentUsage() {
+	fmt.Printf(`%s agent: Hold unlocked private keys for a session.
+
+Usage: %s agent start [options]
+       %s agent add [options] key [key ...]
+       %s agent list
+       %s agent remove FP|--all
+       %s agent proxy [options]
+
+'start' runs the agent in the foreground; it listens on the socket
+$SIGTOOL_AUTH_SOCK (or sigtool-agent.sock in $XDG_RUNTIME_DIR, or
+sigtool-UID/agent.sock in the temporary directory). Only the user can
+connect to it; clients refuse a socket that others can use. 'add'
+decrypts the private keys (asking for their passphrases once) and hands
+them to the agent. Commands that take a private key then use the key
+with fingerprint FP held by the agent when given 'agent:FP' (or just
+'agent:' if the agent holds a single key):
+
+    %s sign -k agent: file.tar.gz
+    %s decrypt agent:SHA256:... file.enc
+
+A key held by the agent of a signing server is used over ssh as
+'ssh://[user@]host[:port]/FP': sigtool runs '%s agent proxy' on the
+server (the command can be changed with $SIGTOOL_REMOTE and ssh with
+$SIGTOOL_SSH); the proxy passes signing and decryption requests to the
+agent on the server but never adds or removes keys:
+
+    %s sign -k ssh://signer.example.com app.tar.gz
+
+Keys added with '--confirm' are only used after the program given to
+'start --confirm-program' (default $SIGTOOL_CONFIRM) exits successfully;
+it is called with a message describing the request.
+
+Use '%s agent CMD --help' for the options of each command.
+`, Z, Z, Z, Z, Z, Z, Z, Z, Z, Z, Z)
+}
+
+func agentStart(args []string) {
+	fs := flag.NewFlagSet("agent start", flag.ExitOnError)
+
+	var help bool
+	var sock, confirm string
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&sock, "socket", "a", sign.AgentSocket(), "Listen on the unix socket `S`")
+	fs.StringVarP(&confirm, "confirm-program", "", os.Getenv("SIGTOOL_CONFIRM"), "Ask program `P` to confirm the use of keys added with --confirm")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		agentUsage()
+		fmt.Printf("\nOptions for 'start':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if _, err := os.Stat(sock); err == nil {
+		if _, err := sign.NewAgentClient(sock).List(); err == nil {
+			die("agent: an agent is already listening on %s", sock)
+		}
+		os.Remove(sock)
+	}
+
+	// only we can connect to the socket
+	ln, err := sign.ListenAgent(sock)
+	if err != nil {
+		die("%s", err)
+	}
+
+	a := sign.NewAgent()
+	a.Confirm = func(pk *sign.PublicKey, op string) bool {
+		if len(confirm) == 0 {
+			warn("agent: no --confirm-program to confirm %s with %s", op, pk.Fingerprint())
+			return false
+		}
+
+		msg := fmt.Sprintf("Allow %s with key %s %s?", op, pk.Fingerprint(), pk.Comment)
+		return exec.Command(confirm, msg).Run() == nil
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		ln.Close()
+	}()
+
+	fmt.Printf("SIGTOOL_AUTH_SOCK=%s; export SIGTOOL_AUTH_SOCK;\n", sock)
+	err = a.Serve(ln)
+	os.Remove(sock)
+	if _, ok := err.(*net.OpError); !ok && err != nil {
+		die("agent: %s", err)
+	}
+}
+
+func agentAdd(args []string) {
+	fs := flag.NewFlagSet("agent add", flag.ExitOnError)
+
+	var help, nopw, confirm bool
+	var envpw string
+	var ttl time.Duration
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.DurationVarP(&ttl, "lifetime", "t", 0, "Drop the keys after duration `D` (e.g., 8h) [never]")
+	fs.BoolVarP(&confirm, "confirm", "c", false, "Confirm each use of the keys")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private keys")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		agentUsage()
+		fmt.Printf("\nOptions for 'add':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s agent add --help'", os.Args[0])
+	}
+
+	c := sign.NewAgentClient(sign.AgentSocket())
+	for _, fn := range args {
+		prompt := fmt.Sprintf("Enter passphrase for %s", fn)
+		sk, err := sign.ParseIdentity(fn, askpassFunc(nopw, envpw, prompt, false))
+		if err == nil {
+			err = c.Add(sk, ttl, confirm)
+		}
+		audit("agent-add", sk, fn, "", "", err)
+		if err != nil {
+			die("%s: %s", fn, err)
+		}
+		fmt.Printf("Added %s %s\n", sk.PublicKey().Fingerprint(), fn)
+	}
+}
+
+func agentList(args []string) {
+	keys, err := sign.NewAgentClient(sign.AgentSocket()).List()
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(keys) == 0 {
+		fmt.Printf("The agent has no keys.\n")
+		return
+	}
+
+	for _, k := range keys {
+		var s string
+		if !k.Expires.IsZero() {
+			s += fmt.Sprintf(" (until %s)", k.Expires.Local().Format(time.RFC3339))
+		}
+		if k.Confirm {
+			s += " (confirm)"
+		}
+		fmt.Printf("%s %s%s\n", k.PublicKey.Fingerprint(), k.PublicKey.Comment, s)
+	}
+}
+
+// relay the agent protocol on stdin and stdout to the agent; run by
+// remote clients over ssh
+func agentProxy(args []string) {
+	fs := flag.NewFlagSet("agent proxy", flag.ExitOnError)
+
+	var help bool
+	var sock string
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&sock, "socket", "a", sign.AgentSocket(), "Use the agent at the unix socket `S`")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		agentUsage()
+		fmt.Printf("\nOptions for 'proxy':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if err := sign.ProxyAgent(os.Stdin, os.Stdout, sign.NewAgentClient(sock)); err != nil {
+		die("%s", err)
+	}
+}
+
+func agentRemove(args []string) {
+	fs := flag.NewFlagSet("agent remove", flag.ExitOnError)
+
+	var help, all bool
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&all, "all", "", false, "Remove all keys")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		agentUsage()
+		fmt.Printf("\nOptions for 'remove':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 && !all {
+		die("Insufficient args. Try '%s agent remove --help'", os.Args[0])
+	}
+
+	c := sign.NewAgentClient(sign.AgentSocket())
+	if all {
+		args = []string{""}
+	}
+
+	for _, fp := range args {
+		if err := c.Remove(fp); err != nil {
+			die("%s", err)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+// archive.go -- create, list and extract encrypted archives
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// sigtool archive create|list|extract ...
+func archive(args []string) {
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s archive --help'", os.Args[0])
+	}
+
+	switch args[0] {
+	case "create", "c":
+		archiveCreate(args[1:])
+	case "list", "l":
+		archiveList(args[1:])
+	case "extract", "x":
+		archiveExtract(args[1:])
+	case "-h", "--help", "help":
+		archiveUsage()
+		os.Exit(0)
+	default:
+		die("unknown archive command %s. Try '%s archive --help'", args[0], os.Args[0])
+	}
+}
+
+func archiveUsage() {
+	fmt.Printf(`%s archive: Encrypted archives of several files.
+
+Usage: %s archive create [options] -o OUT -r to [-r to ...] file|dir [...]
+       %s archive list [options] key archive
+       %s archive extract [options] key archive [member ...]
+
+'create' encrypts the files and directories (and everything below them)
+into a single archive for the recipients TO; TO is any recipient accepted
+by 'encrypt'. Symlinks are archived as symlinks unless --follow-symlinks
+is used; a file with several hard links is stored once.
+
+'list' shows the members of an archive; 'extract' writes the named
+members (all by default) below the current directory. Only the parts of
+the archive that hold the index and the requested members are decrypted.
+
+Use '%s archive CMD --help' for the options of each command.
+`, Z, Z, Z, Z, Z)
+}
+
+func archiveCreate(args []string) {
+	fs := flag.NewFlagSet("archive create", flag.ExitOnError)
+
+	var help, nopw bool
+	var outfile, keyfile, envpw string
+	var blksize uint64
+	var recips stringList
+	var meta archiveMeta
+	var follow, preserve bool
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the archive to file `F`")
+	fs.VarP(&recips, "recipient", "r", "Encrypt to the public key `TO` (may be repeated)")
+	fs.StringVarP(&keyfile, "sign", "s", "", "Sign using private key `S`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
+	fs.SizeVarP(&blksize, "block-size", "B", 0, "Use `S` as the encryption block size [auto]")
+	fs.BoolVarP(&follow, "follow-symlinks", "L", false, "Archive what symlinks point to instead of the symlinks")
+	fs.BoolVarP(&preserve, "preserve-symlinks", "P", false, "Archive symlinks as symlinks [default]")
+	meta.flags(fs, "Store")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		archiveUsage()
+		fmt.Printf("\nOptions for 'create':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 || len(recips) < 1 {
+		die("Insufficient args. Try '%s archive create --help'", os.Args[0])
+	}
+	if len(outfile) == 0 {
+		die("archive create: missing output file (-o)")
+	}
+	if follow && preserve {
+		die("archive create: --follow-symlinks and --preserve-symlinks are exclusive")
+	}
+
+	var sk *sign.PrivateKey
+	var err error
+
+	if len(keyfile) > 0 {
+		sk, err = sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+		if err != nil {
+			audit("encrypt", nil, keyfile, "", outfile, err)
+			die("%s", err)
+		}
+	}
+
+	files, total := archiveFiles(args, &meta, follow)
+	if blksize == 0 {
+		blksize = sign.AutoChunkSize(total)
+	}
+
+	en, err := sign.NewEncryptor(sk, blksize)
+	if err != nil {
+		die("%s", err)
+	}
+
+	for _, fn := range recips {
+		pk, err := sign.ParseRecipient(fn)
+		if err != nil {
+			die("%s", err)
+		}
+		if err = en.AddRecipient(pk); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if err = applyPolicy(en); err != nil {
+		die("%s", err)
+	}
+
+	outf := mustOpen(outfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	defer outf.Close()
+
+	err = en.EncryptArchive(files, outf)
+	if sk != nil {
+		audit("encrypt", sk, keyfile, "", outfile, err)
+	}
+	if err != nil {
+		os.Remove(outfile)
+		die("%s", err)
+	}
+}
+
+// POSIX ACLs are stored in these extended attributes
+const _ACLPrefix = "system.posix_acl_"
+
+// metadata stored in and restored from archives
+type archiveMeta struct {
+	xattrs bool
+	acls   bool
+	owner  bool
+}
+
+func (o *archiveMeta) flags(fs *flag.FlagSet, verb string) {
+	fs.BoolVarP(&o.xattrs, "xattrs", "", false, verb+" extended attributes")
+	fs.BoolVarP(&o.acls, "acls", "", false, verb+" POSIX ACLs")
+	fs.BoolVarP(&o.owner, "owner", "", false, verb+" the owner and group (restoring needs root)")
+}
+
+// identity of a file: device and inode
+type fileKey struct {
+	dev, ino uint64
+}
+
+// archiveWalker collects the members of a new archive
+type archiveWalker struct {
+	meta   *archiveMeta
+	follow bool
+
+	files []sign.ArchiveFile
+	total int64
+
+	// directories already visited and the first name of each file
+	// with several links
+	dirs  map[fileKey]bool
+	links map[fileKey]string
+}
+
+// collect the directories, regular files and symlinks named by 'args' and
+// below the named directories; return them and the total size of the
+// files. If 'follow' is true, symlinks are replaced by what they point to.
+func archiveFiles(args []string, meta *archiveMeta, follow bool) ([]sign.ArchiveFile, int64) {
+	w := &archiveWalker{
+		meta:   meta,
+		follow: follow,
+		dirs:   make(map[fileKey]bool),
+		links:  make(map[fileKey]string),
+	}
+
+	for _, fn := range args {
+		fi, err := os.Lstat(fn)
+		if err == nil {
+			err = w.walk(fn, fi)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+	}
+	return w.files, w.total
+}
+
+func (w *archiveWalker) walk(fn string, fi os.FileInfo) error {
+	nm := filepath.ToSlash(filepath.Clean(fn))
+	for len(nm) > 0 && nm[0] == '/' {
+		nm = nm[1:]
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 && w.follow {
+		st, err := os.Stat(fn)
+		if err != nil {
+			warn("%s: skipping; dangling symlink", fn)
+			return nil
+		}
+		fi = st
+	}
+
+	f := sign.ArchiveFile{
+		ArchiveMember: sign.ArchiveMember{
+			Name:    nm,
+			Mode:    uint32(fi.Mode() & (os.ModeDir | os.ModeSymlink | os.ModePerm)),
+			ModTime: fi.ModTime().Unix(),
+		},
+	}
+
+	key, nlink, haveID := fileID(fi)
+
+	switch {
+	case fi.IsDir():
+		// following symlinks can lead back to a directory already seen
+		if haveID {
+			if w.dirs[key] {
+				warn("%s: skipping; directory already archived (symlink loop?)", fn)
+				return nil
+			}
+			w.dirs[key] = true
+		}
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		t, err := os.Readlink(fn)
+		if err != nil {
+			return err
+		}
+		f.Link = t
+
+	case fi.Mode().IsRegular():
+		// with --follow-symlinks, several links can lead to any file
+		if haveID && (nlink > 1 || w.follow) {
+			if first, ok := w.links[key]; ok {
+				f.Link = first
+				break
+			}
+			w.links[key] = nm
+		}
+
+		f.Size = fi.Size()
+		f.Open = func() (io.ReadCloser, error) {
+			return os.Open(fn)
+		}
+		w.total += fi.Size()
+
+	default:
+		warn("%s: skipping; not a regular file", fn)
+		return nil
+	}
+
+	if len(nm) > 0 && nm != "." {
+		if err := w.meta.get(fn, fi, &f.ArchiveMember); err != nil {
+			return err
+		}
+		w.files = append(w.files, f)
+	}
+
+	if !fi.IsDir() {
+		return nil
+	}
+
+	ents, err := ioutil.ReadDir(fn)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if err := w.walk(filepath.Join(fn, e.Name()), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill in the ownership and extended attributes of a new member
+func (o *archiveMeta) get(fn string, fi os.FileInfo, m *sign.ArchiveMember) error {
+	if o.owner {
+		m.Uid, m.Gid, m.HasOwner = fileOwner(fi)
+	}
+
+	// extended attributes of symlinks are not supported
+	if (o.xattrs || o.acls) && fi.Mode()&os.ModeSymlink == 0 {
+		x, err := getXattrs(fn, o.xattrs, o.acls)
+		if err != nil {
+			return err
+		}
+		m.Xattrs = x
+	}
+	return nil
+}
+
+// restore the ownership, mode and extended attributes of an extracted
+// member; it is not an error to be unable to change the owner unless we
+// are root.
+func (o *archiveMeta) restore(fn string, m *sign.ArchiveMember) error {
+	if o.owner && m.HasOwner {
+		if err := os.Lchown(fn, int(m.Uid), int(m.Gid)); err != nil && os.Geteuid() == 0 {
+			return err
+		}
+	}
+
+	// the rest would change the target of a symlink
+	if m.IsSymlink() {
+		return nil
+	}
+
+	// chown clears the setuid bits and ACLs change the group bits; so the
+	// mode is set after the former and before the latter.
+	if o.owner || o.acls {
+		if err := os.Chmod(fn, os.FileMode(m.Mode)&os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	if o.xattrs || o.acls {
+		x := make(map[string][]byte)
+		for k, v := range m.Xattrs {
+			if acl := strings.HasPrefix(k, _ACLPrefix); (acl && o.acls) || (!acl && o.xattrs) {
+				x[k] = v
+			}
+		}
+		if err := setXattrs(fn, x); err != nil {
+			return err
+		}
+	}
+
+	t := time.Unix(m.ModTime, 0)
+	return os.Chtimes(fn, t, t)
+}
+
+// options and the archive reader common to 'list' and 'extract'
+func openArchive(cmd string, args []string, setup func(fs *flag.FlagSet)) (*sign.ArchiveReader, []string) {
+	fs := flag.NewFlagSet("archive "+cmd, flag.ExitOnError)
+
+	var help, nopw bool
+	var envpw, pubkey string
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
+	fs.StringVarP(&pubkey, "verify-sender", "v", "", "Verify that the sender matches public key in `F`")
+	if setup != nil {
+		setup(fs)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		archiveUsage()
+		fmt.Printf("\nOptions for '%s':\n", cmd)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s archive %s --help'", os.Args[0], cmd)
+	}
+
+	keyfile, infile := args[0], args[1]
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+	if err != nil {
+		audit("decrypt", nil, keyfile, infile, "", err)
+		die("%s", err)
+	}
+
+	var pk *sign.PublicKey
+	if len(pubkey) > 0 {
+		if pk, err = sign.ParseRecipient(pubkey); err != nil {
+			die("%s", err)
+		}
+	}
+
+	fd := mustOpen(infile, os.O_RDONLY)
+	st, err := fd.Stat()
+	if err != nil {
+		die("can't stat %s: %s", infile, err)
+	}
+
+	d, err := sign.NewDecryptor(fd)
+	if err != nil {
+		die("%s: %s", infile, err)
+	}
+
+	err = d.SetPrivateKey(sk, pk)
+	audit("decrypt", sk, keyfile, infile, "", err)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if pk == nil && d.AuthenticatedSender() {
+		warn("%s: Missing sender Public Key; can't authenticate sender ..", infile)
+	}
+
+	a, err := d.NewArchiveReader(fd, st.Size())
+	if err != nil {
+		die("%s: %s", infile, err)
+	}
+	return a, args[2:]
+}
+
+func archiveList(args []string) {
+	var long bool
+
+	a, _ := openArchive("list", args, func(fs *flag.FlagSet) {
+		fs.BoolVarP(&long, "long", "l", false, "Show the mode, size and modification time of each member")
+	})
+
+	for _, m := range a.Members {
+		if !long {
+			fmt.Println(m.Name)
+			continue
+		}
+
+		var link string
+		switch {
+		case m.IsSymlink():
+			link = " -> " + m.Link
+		case m.IsHardlink():
+			link = " link to " + m.Link
+		}
+
+		t := time.Unix(m.ModTime, 0).Format("2006-01-02 15:04")
+		fmt.Printf("%s %12d %s %s%s\n", os.FileMode(m.Mode), m.Size, t, m.Name, link)
+	}
+}
+
+func archiveExtract(args []string) {
+	var dir string
+	var stdout bool
+	var meta archiveMeta
+
+	a, names := openArchive("extract", args, func(fs *flag.FlagSet) {
+		fs.StringVarP(&dir, "directory", "C", ".", "Extract the members below directory `D`")
+		fs.BoolVarP(&stdout, "stdout", "O", false, "Write the members to STDOUT")
+		meta.flags(fs, "Restore")
+	})
+
+	if meta.owner && os.Geteuid() != 0 {
+		warn("not running as root; can't restore the owner of extracted files")
+	}
+
+	if len(names) == 0 {
+		for _, m := range a.Members {
+			names = append(names, m.Name)
+		}
+	}
+
+	// directories are restored last; so that extracting their contents
+	// doesn't change their mtime (or fail on read-only directories).
+	// Symlinks are created after all the files; so that no file is
+	// written through a symlink from the archive.
+	var dirs, symlinks []*sign.ArchiveMember
+
+	// extracted files that hard links can refer to
+	done := make(map[string]string)
+
+	for _, nm := range names {
+		m, err := a.Member(nm)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if stdout {
+			if err = a.Extract(nm, os.Stdout); err != nil {
+				die("%s", err)
+			}
+			continue
+		}
+
+		fn := filepath.Join(dir, filepath.FromSlash(m.Name))
+		if err = prepareOutput(dir, fn); err != nil {
+			die("%s", err)
+		}
+
+		switch {
+		case m.IsDir():
+			if err = os.MkdirAll(fn, os.FileMode(m.Mode)&os.ModePerm|0700); err != nil {
+				die("%s", err)
+			}
+			dirs = append(dirs, m)
+			continue
+
+		case m.IsSymlink():
+			symlinks = append(symlinks, m)
+			continue
+		}
+
+		if err = os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			die("%s", err)
+		}
+
+		if t, ok := done[m.Link]; ok && m.IsHardlink() {
+			os.Remove(fn)
+			if err = os.Link(t, fn); err != nil {
+				die("%s", err)
+			}
+			continue
+		}
+
+		fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(m.Mode)&os.ModePerm)
+		if err != nil {
+			die("%s", err)
+		}
+
+		err = a.Extract(nm, fd)
+		if e := fd.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(fn)
+			die("%s", err)
+		}
+
+		if err = meta.restore(fn, m); err != nil {
+			warn("%s", err)
+		}
+		done[m.Name] = fn
+	}
+
+	for _, m := range symlinks {
+		fn := filepath.Join(dir, filepath.FromSlash(m.Name))
+		if err := prepareOutput(dir, fn); err != nil {
+			die("%s", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			die("%s", err)
+		}
+
+		os.Remove(fn)
+		if err := os.Symlink(m.Link, fn); err != nil {
+			die("%s", err)
+		}
+		if err := meta.restore(fn, m); err != nil {
+			warn("%s", err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		m := dirs[i]
+		fn := filepath.Join(dir, filepath.FromSlash(m.Name))
+		if err := meta.restore(fn, m); err != nil {
+			warn("%s", err)
+		}
+	}
+}
+
+// refuse to extract 'fn' through a symlink below 'dir'; remove 'fn' if it
+// is a symlink.
+func prepareOutput(dir, fn string) error {
+	rel, err := filepath.Rel(dir, fn)
+	if err != nil {
+		return err
+	}
+
+	p := dir
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, c := range parts {
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if i == len(parts)-1 {
+				return os.Remove(p)
+			}
+			return fmt.Errorf("%s: won't extract through the symlink %s", fn, p)
+		}
+	}
+	return nil
+}
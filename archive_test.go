@@ -0,0 +1,172 @@
+// archive_test.go -- tests for the members of 'archive create'
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// encrypt 'files' into an archive and return it with a decryptor for it
+func encryptArchive(t *testing.T, files []sign.ArchiveFile) (*sign.Decryptor, []byte) {
+	assert := newAsserter(t)
+
+	kp, err := sign.NewKeypair()
+	assert(err == nil, "keygen fail: %s", err)
+
+	en, err := sign.NewEncryptor(nil, 4096)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = en.AddRecipient(&kp.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	var buf bytes.Buffer
+	err = en.EncryptArchive(files, sign.NopWriteCloser(&buf))
+	assert(err == nil, "encrypt archive: %s", err)
+
+	d, err := sign.NewDecryptor(bytes.NewReader(buf.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&kp.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+	return d, buf.Bytes()
+}
+
+// encrypt 'files' into an archive and open it again
+func archiveRoundTrip(t *testing.T, files []sign.ArchiveFile) *sign.ArchiveReader {
+	assert := newAsserter(t)
+
+	d, b := encryptArchive(t, files)
+	a, err := d.NewArchiveReader(bytes.NewReader(b), int64(len(b)))
+	assert(err == nil, "archive reader: %s", err)
+	return a
+}
+
+func TestArchiveMeta(t *testing.T) {
+	assert := newAsserter(t)
+
+	src := filepath.Join(tempdir(t), "a.txt")
+	err := ioutil.WriteFile(src, []byte("hello, world\n"), 0600)
+	assert(err == nil, "write: %s", err)
+	err = os.Chmod(src, 0751)
+	assert(err == nil, "chmod: %s", err)
+
+	if err = setXattrs(src, map[string][]byte{"user.sigtool": []byte("test")}); err != nil {
+		t.Skipf("no user extended attributes: %s", err)
+	}
+
+	// root can give the file to someone else
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 4321, 4322
+		err = os.Lchown(src, uid, gid)
+		assert(err == nil, "chown: %s", err)
+	}
+
+	meta := &archiveMeta{xattrs: true, owner: true}
+	files, _ := archiveFiles([]string{src}, meta, false)
+	assert(len(files) == 1, "exp 1 member, saw %d", len(files))
+
+	a := archiveRoundTrip(t, files)
+	m := &a.Members[0]
+	assert(m.HasOwner && int(m.Uid) == uid && int(m.Gid) == gid, "member owner %d:%d", m.Uid, m.Gid)
+	assert(string(m.Xattrs["user.sigtool"]) == "test", "member xattrs %v", m.Xattrs)
+
+	// extract with the default mode and restore the rest
+	dst := filepath.Join(tempdir(t), "a.txt")
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0600)
+	assert(err == nil, "create: %s", err)
+	err = a.Extract(m.Name, fd)
+	assert(err == nil, "extract: %s", err)
+	fd.Close()
+
+	err = meta.restore(dst, m)
+	assert(err == nil, "restore: %s", err)
+
+	fi, err := os.Lstat(dst)
+	assert(err == nil, "stat: %s", err)
+	assert(fi.Mode().Perm() == 0751, "mode %s", fi.Mode())
+
+	if u, g, ok := fileOwner(fi); ok {
+		assert(int(u) == uid && int(g) == gid, "owner %d:%d; exp %d:%d", u, g, uid, gid)
+	}
+
+	x, err := getXattrs(dst, true, false)
+	assert(err == nil, "xattrs: %s", err)
+	assert(string(x["user.sigtool"]) == "test", "xattrs %v", x)
+
+	b, err := ioutil.ReadFile(dst)
+	assert(err == nil && string(b) == "hello, world\n", "content %q", b)
+}
+
+func TestArchiveLinks(t *testing.T) {
+	assert := newAsserter(t)
+
+	dn := tempdir(t)
+	top := filepath.Join(dn, "top")
+	err := os.MkdirAll(filepath.Join(top, "sub"), 0700)
+	assert(err == nil, "mkdir: %s", err)
+
+	a := filepath.Join(top, "a")
+	err = ioutil.WriteFile(a, []byte("linked"), 0600)
+	assert(err == nil, "write: %s", err)
+
+	if err = os.Link(a, filepath.Join(top, "sub", "b")); err != nil {
+		t.Skipf("no hard links: %s", err)
+	}
+	if err = os.Symlink("..", filepath.Join(top, "sub", "loop")); err != nil {
+		t.Skipf("no symlinks: %s", err)
+	}
+
+	names := func(files []sign.ArchiveFile) map[string]*sign.ArchiveMember {
+		m := make(map[string]*sign.ArchiveMember)
+		for i := range files {
+			f := &files[i].ArchiveMember
+			nm, err := filepath.Rel(dn, "/"+f.Name)
+			assert(err == nil, "%s: %s", f.Name, err)
+			m[filepath.ToSlash(nm)] = f
+		}
+		return m
+	}
+
+	// the loop is stored as a symlink; the second link to 'a' refers to
+	// the first
+	meta := &archiveMeta{}
+	files, total := archiveFiles([]string{top}, meta, false)
+	m := names(files)
+	assert(len(m) == 5, "exp 5 members, saw %d: %v", len(m), m)
+	assert(total == 6, "total size %d", total)
+	assert(m["top/sub/loop"].IsSymlink() && m["top/sub/loop"].Link == "..", "loop: %+v", m["top/sub/loop"])
+	assert(!m["top/a"].IsHardlink() && m["top/a"].Size == 6, "a: %+v", m["top/a"])
+	assert(m["top/sub/b"].IsHardlink() && m["top/sub/b"].Link == files[1].Name, "b: %+v", m["top/sub/b"])
+
+	ar := archiveRoundTrip(t, files)
+	assert(len(ar.Members) == 5, "archive has %d members", len(ar.Members))
+
+	var buf bytes.Buffer
+	err = ar.Extract(m["top/sub/b"].Name, &buf)
+	assert(err == nil, "extract link: %s", err)
+	assert(buf.String() == "linked", "link content %q", buf.String())
+
+	// following the loop visits 'top' once; 'a' is still stored once
+	files, total = archiveFiles([]string{top}, meta, true)
+	m = names(files)
+	assert(len(m) == 4, "exp 4 members, saw %d: %v", len(m), m)
+	assert(total == 6, "total size %d", total)
+	assert(m["top/sub/loop"] == nil, "loop archived: %+v", m["top/sub/loop"])
+	assert(m["top/sub/b"].IsHardlink(), "b: %+v", m["top/sub/b"])
+}
@@ -0,0 +1,145 @@
+// attest.go -- in-toto attestations of files in Sigstore bundles
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'attest' command
+func attest(args []string) {
+	var help, nopw, force bool
+	var keyfile, envpw, outfile, ptype, pfile, comment string
+
+	fs := flag.NewFlagSet("attest", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&keyfile, "sign", "s", "", "Sign the attestation with private key `K`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.StringVarP(&ptype, "predicate-type", "t", sign.PredicateSigtool, "Use the predicate type URI `T`")
+	fs.StringVarP(&pfile, "predicate", "p", "", "Read the JSON predicate from file `F`")
+	fs.StringVarP(&comment, "comment", "c", "", "Record the comment `C` in the default predicate")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the bundle to file `F` [FILE.sigstore.json]")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file without asking")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s attest: Sign in-toto attestations of files.
+
+Usage: %s attest -s key [options] file [file...]
+
+Write an in-toto statement about FILEs (named by their SHA256) signed by
+KEY in a Sigstore bundle -- the format of GitHub's artifact attestations
+and of 'cosign attest-blob --bundle'. The predicate is read from F with
+'--predicate' (e.g., SLSA provenance with '-t %s');
+without it, the predicate records the signer, the time and the comment.
+
+The bundle holds no certificate or transparency log entry: verify it
+with the signer's public key using 'verify PUBKEY FILE.sigstore.json FILE'
+or a Sigstore verifier that accepts a public key. 'gh attestation verify'
+only trusts bundles with certificates issued by GitHub or Sigstore.
+
+Options:
+`, Z, Z, sign.PredicateSLSAProvenance)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(keyfile) == 0 {
+		die("attest needs a private key (--sign)")
+	}
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s attest --help'", Z)
+	}
+
+	if len(outfile) == 0 {
+		if len(args) > 1 {
+			die("attest needs an output file (-o) for several files")
+		}
+		outfile = args[0] + ".sigstore.json"
+	}
+
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+	if err != nil {
+		audit("sign", nil, keyfile, args[0], outfile, err)
+		die("%s", err)
+	}
+
+	var pred []byte
+	switch {
+	case len(pfile) > 0:
+		if len(comment) > 0 {
+			die("--comment can't be used with --predicate")
+		}
+		if pred, err = ioutil.ReadFile(pfile); err != nil {
+			die("%s", err)
+		}
+	case ptype != sign.PredicateSigtool:
+		die("--predicate-type %s needs a predicate (--predicate)", ptype)
+	default:
+		p := struct {
+			Signer    string `json:"signer"`
+			Timestamp string `json:"timestamp"`
+			Comment   string `json:"comment,omitempty"`
+		}{sk.PublicKey().Fingerprint(), time.Now().UTC().Format(time.RFC3339), comment}
+		pred, _ = json.Marshal(&p)
+	}
+
+	st, err := sign.NewStatement(ptype, pred)
+	if err != nil {
+		die("%s", err)
+	}
+
+	for _, fn := range args {
+		if outfile != "-" && samePath(fn, outfile) {
+			die("won't write the attestation over %s", fn)
+		}
+
+		fd, err := os.Open(fn)
+		if err != nil {
+			die("%s", err)
+		}
+		err = st.AddSubject(path.Base(fn), fd)
+		fd.Close()
+		if err != nil {
+			die("%s", err)
+		}
+	}
+
+	b, err := sk.Attest(st)
+	audit("sign", sk, keyfile, args[0], outfile, err)
+	if err != nil {
+		die("%s", err)
+	}
+
+	writeOutput(outfile, force, func(wr io.Writer) error {
+		_, err := wr.Write(b)
+		return err
+	})
+}
@@ -0,0 +1,139 @@
+// audit.go -- audit log of private key operations
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// auditRecord is one line in the audit log. Each record describes an
+// operation that used (or tried to use) a private key.
+type auditRecord struct {
+	Time    string `json:"time"`
+	Op      string `json:"op"`
+	User    string `json:"user"`
+	Host    string `json:"host"`
+	Pid     int    `json:"pid"`
+	Pkhash  string `json:"pkhash,omitempty"`
+	KeyFile string `json:"keyfile,omitempty"`
+	Input   string `json:"input,omitempty"`
+	Output  string `json:"output,omitempty"`
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLog writes audit records to a file or to syslog
+type auditLog struct {
+	sync.Mutex
+	wr io.WriteCloser
+}
+
+// the audit log; nil if auditing is disabled
+var auditor *auditLog
+
+// openAudit opens the audit destination 'dest'. It is either a file
+// name (records are appended as JSON lines) or "syslog".
+func openAudit(dest string) (*auditLog, error) {
+	var wr io.WriteCloser
+	var err error
+
+	if dest == "syslog" {
+		wr, err = openSyslog()
+	} else {
+		wr, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("audit: can't open %s: %s", dest, err)
+	}
+
+	return &auditLog{wr: wr}, nil
+}
+
+// audit records the outcome of operation 'op' that used the private key
+// 'sk' read from 'keyfile'. The record is silently dropped if auditing is
+// disabled.
+func audit(op string, sk *sign.PrivateKey, keyfile, input, output string, err error) {
+	if auditor == nil {
+		return
+	}
+
+	r := &auditRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Op:      op,
+		Pid:     os.Getpid(),
+		KeyFile: keyfile,
+		Input:   input,
+		Output:  output,
+		Result:  "ok",
+	}
+
+	if u, err := user.Current(); err == nil {
+		r.User = u.Username
+	}
+	if h, err := os.Hostname(); err == nil {
+		r.Host = h
+	}
+	if sk != nil {
+		r.Pkhash = fmt.Sprintf("%x", sk.PublicKey().Hash())
+	}
+	if err != nil {
+		r.Result = "fail"
+		r.Error = strings.TrimSpace(err.Error())
+	}
+
+	if err := auditor.write(r); err != nil {
+		warn("%s", err)
+	}
+}
+
+func (a *auditLog) write(r *auditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+	b = append(b, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err = fullwrite(a.wr, b); err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	return a.wr.Close()
+}
+
+// write all of 'b' to 'wr'
+func fullwrite(wr io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := wr.Write(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// audit_nosyslog.go -- platforms without syslog
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows || plan9 || js || wasip1
+// +build windows plan9 js wasip1
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func openSyslog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,73 @@
+// audit_test.go -- tests for the audit log
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+func TestAudit(t *testing.T) {
+	assert := newAsserter(t)
+
+	kp, err := sign.NewKeypair()
+	assert(err == nil, "keygen fail: %s", err)
+
+	// nothing is written when auditing is disabled
+	audit("sign", &kp.Sec, "a.key", "in", "out", nil)
+
+	fn := filepath.Join(tempdir(t), "audit.log")
+	auditor, err = openAudit(fn)
+	assert(err == nil, "open audit: %s", err)
+	defer func() {
+		auditor.Close()
+		auditor = nil
+	}()
+
+	audit("sign", &kp.Sec, "a.key", "in.txt", "in.txt.sig", nil)
+	audit("decrypt", nil, "b.key", "x.enc", "x", fmt.Errorf("wrong key\n"))
+
+	fi, err := os.Stat(fn)
+	assert(err == nil, "stat: %s", err)
+	assert(fi.Mode().Perm() == 0600, "audit log mode %s", fi.Mode())
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "read: %s", err)
+
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	assert(len(lines) == 2, "exp 2 records, saw %d", len(lines))
+
+	var r [2]auditRecord
+	for i := range r {
+		err = json.Unmarshal(lines[i], &r[i])
+		assert(err == nil, "record %d: %s", i, err)
+		assert(r[i].Pid == os.Getpid(), "record %d: pid %d", i, r[i].Pid)
+		assert(len(r[i].Time) > 0, "record %d: no time", i)
+	}
+
+	pkh := fmt.Sprintf("%x", kp.Pub.Hash())
+	assert(r[0].Op == "sign" && r[0].Pkhash == pkh, "record 0: %+v", r[0])
+	assert(r[0].KeyFile == "a.key" && r[0].Input == "in.txt" && r[0].Output == "in.txt.sig", "record 0: %+v", r[0])
+	assert(r[0].Result == "ok" && r[0].Error == "", "record 0: %+v", r[0])
+
+	assert(r[1].Op == "decrypt" && r[1].Pkhash == "" && r[1].KeyFile == "b.key", "record 1: %+v", r[1])
+	assert(r[1].Result == "fail" && r[1].Error == "wrong key", "record 1: %+v", r[1])
+}
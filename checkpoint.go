@@ -0,0 +1,149 @@
+// checkpoint.go -- resume an interrupted encryption
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// plaintext bytes between checkpoints
+const _CheckpointBytes = 64 * 1048576
+
+// load the checkpoint in 'fn'; nil if there isn't one
+func loadCheckpoint(fn string) *sign.EncryptCheckpoint {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		die("can't read checkpoint: %s", err)
+	}
+
+	cp, err := sign.ParseEncryptCheckpoint(b)
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+	return cp
+}
+
+// checkpoint the encryption to 'outf' in 'fn' every _CheckpointBytes
+func setCheckpoint(en *sign.Encryptor, fn string, outf *os.File) {
+	every := uint64(_CheckpointBytes / en.ChunkSize)
+	if every == 0 {
+		every = 1
+	}
+
+	err := en.SetCheckpoint(every, func(c *sign.EncryptCheckpoint) error {
+		return saveCheckpoint(fn, outf, c)
+	})
+	if err != nil {
+		die("%s", err)
+	}
+}
+
+// save the checkpoint once the output it describes is on disk
+func saveCheckpoint(fn string, outf *os.File, c *sign.EncryptCheckpoint) error {
+	if err := outf.Sync(); err != nil {
+		return err
+	}
+
+	b, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", fn)
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fd.Write(b); err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// resume the encryption of checkpoint 'cp' in 'fn': the input 'inf' is
+// already at cp.Input; the chunks of 'outfile' written after cp.Output
+// are kept if they match the input and the rest is appended to.
+func resumeEncrypt(cp *sign.EncryptCheckpoint, fn string, inf *os.File, outfile string, lim *sign.RateLimiter) {
+	outf := mustOpen(outfile, os.O_RDWR)
+	defer outf.Close()
+
+	if err := cp.Verify(outf); err != nil {
+		die("%s: %s", outfile, err)
+	}
+
+	st, err := outf.Stat()
+	if err != nil {
+		die("%s: %s", outfile, err)
+	}
+	if st.Size() < cp.Output {
+		die("%s: shorter than the checkpoint (%d < %d bytes)", outfile, st.Size(), cp.Output)
+	}
+
+	if _, err = outf.Seek(cp.Output, io.SeekStart); err != nil {
+		die("%s: %s", outfile, err)
+	}
+
+	en, err := sign.ResumeEncryptor(cp)
+	if err != nil {
+		die("%s", err)
+	}
+
+	in, out, done, err := en.SkipWritten(inf, outf)
+	if err != nil {
+		die("%s: %s", outfile, err)
+	}
+	if err = outf.Truncate(cp.Output + out); err != nil {
+		die("%s: %s", outfile, err)
+	}
+	if done {
+		os.Remove(fn)
+		return
+	}
+
+	if _, err = outf.Seek(cp.Output+out, io.SeekStart); err != nil {
+		die("%s: %s", outfile, err)
+	}
+	if _, err = inf.Seek(cp.Input+in, io.SeekStart); err != nil {
+		die("%s: %s", inf.Name(), err)
+	}
+	setCheckpoint(en, fn, outf)
+
+	var wr io.WriteCloser = outf
+	if lim != nil {
+		wr = lim.WriteCloser(wr)
+	}
+
+	if err = en.Encrypt(fileReader(inf, false), wr); err != nil {
+		die("%s", err)
+	}
+	os.Remove(fn)
+}
@@ -14,13 +14,14 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
 	"github.com/opencoff/sigtool/sign"
 )
@@ -35,46 +36,101 @@ func encrypt(args []string) {
 
 	var outfile string
 	var keyfile string
-	var envpw string
-	var nopw bool
-	var blksize uint64
+	var envpw, suffix string
+	var nopw, reclog, sparse, force, repin, each, direct, hints, cdc bool
+	var blksize, rate uint64
+	var manifest, context, knownfile, ciph, rcptfile, ckpt, cdcName, prev, appendKey string
 
 	fs.StringVarP(&outfile, "outfile", "o", "", "Write the output to file `F`")
 	fs.StringVarP(&keyfile, "sign", "s", "", "Sign using private key `S`")
+	fs.StringVarP(&manifest, "manifest", "m", "", "Write a signed manifest of the chunk hashes to `F` (needs --sign)")
+	fs.BoolVarP(&reclog, "log", "L", false, "Write an append-only log: encrypt and write each input line as it arrives")
+	fs.StringVarP(&appendKey, "append", "", "", "Append to the closed log OUTFILE as the recipient with private key `K` (needs --log)")
+	fs.BoolVarP(&sparse, "sparse", "S", false, "Record the holes of a sparse input file instead of encrypting them")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
 	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
-	fs.SizeVarP(&blksize, "block-size", "B", 128*1024, "Use `S` as the encryption block size")
+	fs.SizeVarP(&blksize, "block-size", "B", 0, "Use `S` as the encryption block size [auto]")
+	fs.StringVarP(&context, "context", "", "", "Bind the encrypted file to the application context `C`")
+	fs.StringVarP(&suffix, "suffix", "", "", "Write the output to INFILE with suffix `S` appended [.enc on a terminal]")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file without asking")
+	fs.StringVarP(&knownfile, "known-recipients", "K", knownRecipientsPath(), "Pin the keys of named recipients in file `F` (empty to disable)")
+	fs.BoolVarP(&repin, "repin", "", false, "Replace the pinned keys of recipients whose key has changed")
+	fs.BoolVarP(&each, "each", "", false, "Write a separate file for each recipient, named OUTFILE.NAME")
+	fs.SizeVarP(&rate, "limit-rate", "", 0, "Write at most `S` bytes per second [no limit]")
+	fs.BoolVarP(&direct, "direct", "", false, "Use direct I/O for the input and output files, bypassing the page cache")
+	fs.StringVarP(&ciph, "cipher", "", "auto", "Encrypt with cipher `C`: auto, aes-256-gcm or chacha20-poly1305")
+	fs.StringVarP(&rcptfile, "recipients-file", "R", "", "Also encrypt to the recipients in file `F`, one per line")
+	fs.BoolVarP(&hints, "hints", "", false, "Add hints so that each recipient finds its wrapped key without trying them all")
+	fs.BoolVarP(&cdc, "cdc", "", false, "Cut content defined chunks with a convergence key, so that backup stores can deduplicate them (needs --sign)")
+	fs.StringVarP(&cdcName, "cdc-name", "", "", "Derive the convergence key of --cdc from name `N` [absolute path of INFILE]")
+	fs.StringVarP(&prev, "previous", "", "", "Copy the unchanged chunks of the previous encryption `F` of the input (needs --cdc)")
+	fs.StringVarP(&ckpt, "checkpoint", "", "", "Save the progress in `F` to resume an interrupted encryption; resume if F exists")
 
 	err := fs.Parse(args)
 	if err != nil {
 		die("%s", err)
 	}
 
-	var pws, infile string
+	var infile string
 	var sk *sign.PrivateKey
 
+	if len(manifest) > 0 && len(keyfile) == 0 {
+		die("--manifest needs the sender's private key (--sign)")
+	}
+	if len(manifest) > 0 && reclog {
+		die("--manifest can't be used with --log")
+	}
+	if sparse && (reclog || len(manifest) > 0) {
+		die("--sparse can't be used with --log or --manifest")
+	}
+	if each && (reclog || len(manifest) > 0) {
+		die("--each can't be used with --log or --manifest")
+	}
+	if direct && (reclog || sparse) {
+		die("--direct can't be used with --log or --sparse")
+	}
+	if reclog && ciph != "auto" && ciph != sign.CipherAESGCM {
+		die("--log always uses %s", sign.CipherAESGCM)
+	}
+	if len(rcptfile) > 0 && (reclog || each) {
+		die("--recipients-file can't be used with --log or --each")
+	}
+	if len(appendKey) > 0 && !reclog {
+		die("--append needs --log")
+	}
+
 	if len(keyfile) > 0 {
-		sk, err = sign.ReadPrivateKey(keyfile, func() ([]byte, error) {
-			if nopw {
-				return nil, nil
-			}
-			if len(envpw) > 0 {
-				pws = os.Getenv(envpw)
-			} else {
-				pws, err = utils.Askpass("Enter passphrase for private key", false)
-				if err != nil {
-					die("%s", err)
-				}
-			}
-			return []byte(pws), nil
-		})
+		sk, err = sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
 		if err != nil {
+			audit("encrypt", nil, keyfile, "", outfile, err)
 			die("%s", err)
 		}
 	}
 
+	// the recipients may all be in the recipients file
+	nargs := 2
+	if len(rcptfile) > 0 {
+		nargs = 1
+	}
+
+	// an appended log has its recipients in the log header
+	if len(appendKey) > 0 {
+		nargs = 1
+	}
+
+	// a resumed encryption has its recipients in the output header
+	var cp *sign.EncryptCheckpoint
+	if len(ckpt) > 0 {
+		if reclog || sparse || each || direct || len(manifest) > 0 {
+			die("--checkpoint can't be used with --log, --sparse, --each, --direct or --manifest")
+		}
+		if cp = loadCheckpoint(ckpt); cp != nil {
+			nargs = 1
+		}
+	}
+
 	args = fs.Args()
-	if len(args) < 2 {
+	if len(args) < nargs {
 		die("Insufficient args. Try '%s --help'", os.Args[0])
 	}
 
@@ -82,13 +138,28 @@ func encrypt(args []string) {
 	var outfd io.WriteCloser = os.Stdout
 	var inf *os.File
 
-	if len(args) > 1 {
+	if len(args) >= nargs {
 		infile = args[len(args)-1]
 		if infile != "-" {
-			inf := mustOpen(infile, os.O_RDONLY)
+			inf = mustOpen(infile, os.O_RDONLY)
 			defer inf.Close()
 
 			infd = inf
+
+			// pick a block size to suit the input if the user didn't
+			if st, err := inf.Stat(); err == nil && blksize == 0 && !reclog && st.Mode().IsRegular() {
+				blksize = sign.AutoChunkSize(st.Size())
+			}
+
+			if cp != nil {
+				if _, err := inf.Seek(cp.Input, io.SeekStart); err != nil {
+					die("%s: %s", infile, err)
+				}
+			}
+
+			if !reclog && !sparse && cp == nil {
+				infd = fileReader(inf, direct)
+			}
 		}
 	}
 
@@ -101,7 +172,7 @@ func encrypt(args []string) {
 	authkeys := fmt.Sprintf("%s/.ssh/authorized_keys", home)
 	authdata, err := ioutil.ReadFile(authkeys)
 	if err != nil {
-		if err != os.ErrNotExist {
+		if !os.IsNotExist(err) {
 			die("can't open %s: %s", authkeys, err)
 		}
 	}
@@ -113,50 +184,125 @@ func encrypt(args []string) {
 		keymap[pk.Comment] = pk
 	}
 
-	if len(outfile) > 0 && outfile != "-" {
-		if inf != nil {
-			ost, err := os.Stat(outfile)
-			if err != nil {
-				die("can't stat %s: %s", outfile, err)
-			}
+	if len(outfile) == 0 {
+		outfile = cryptOutput(infile, suffix, false)
+		if each && len(outfile) == 0 && inf != nil {
+			outfile = infile + encSuffix
+		}
+	}
 
-			ist, err := inf.Stat()
-			if err != nil {
-				die("can't stat %s: %s", infile, err)
-			}
+	var prevf *os.File
+	if len(prev) > 0 {
+		if each || reclog {
+			die("--previous can't be used with --each or --log")
+		}
+		prevf = mustOpen(prev, os.O_RDONLY)
+		defer prevf.Close()
+	}
 
-			if os.SameFile(ist, ost) {
-				die("won't create output file: same as input file!")
-			}
+	if len(ckpt) > 0 && (inf == nil || len(outfile) == 0 || outfile == "-") {
+		die("--checkpoint needs an input and an output file")
+	}
+
+	if cp != nil {
+		var lim *sign.RateLimiter
+		if rate > 0 {
+			lim = sign.NewRateLimiter(rate)
+		}
+		resumeEncrypt(cp, ckpt, inf, outfile, lim)
+		return
+	}
+
+	if len(appendKey) > 0 {
+		if len(outfile) == 0 || outfile == "-" {
+			die("--append needs the log file (-o)")
+		}
+		if inf != nil && sameFile(inf, outfile) {
+			die("won't append to the log: same as input file!")
 		}
 
+		ask := askpassFunc(nopw, envpw, "Enter passphrase for private key", false)
+		if err = appendLog(appendKey, ask, infd, outfile); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	if each {
+		if len(outfile) == 0 || outfile == "-" {
+			die("--each needs an output file name (-o)")
+		}
+	} else if len(outfile) > 0 && outfile != "-" {
+		if inf != nil && sameFile(inf, outfile) {
+			die("won't create output file: same as input file!")
+		}
+		if prevf != nil && sameFile(prevf, outfile) {
+			die("won't create output file: same as the previous encryption!")
+		}
+
+		confirmOverwrite(outfile, force)
 		outf := mustOpen(outfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 		defer outf.Close()
 
 		outfd = outf
 	}
+	outplain, _ := outfd.(*os.File)
 
 	en, err := sign.NewEncryptor(sk, blksize)
 	if err != nil {
 		die("%s", err)
 	}
 
+	if err = en.SetContext(context); err != nil {
+		die("%s", err)
+	}
+
+	if err = en.SetCipher(ciph); err != nil {
+		die("%s", err)
+	}
+
+	if hints {
+		if err = en.EnableRecipientHints(); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if cdc || len(cdcName) > 0 {
+		if len(cdcName) == 0 {
+			if inf == nil {
+				die("--cdc needs --cdc-name when reading STDIN")
+			}
+			if cdcName, err = filepath.Abs(infile); err != nil {
+				die("%s", err)
+			}
+		}
+		if err = en.EnableCDC(cdcName); err != nil {
+			die("%s", err)
+		}
+	}
+
+	known := openKnownRecipients(knownfile, repin)
+
+	var names []string
 	errs := 0
 	for i := 0; i < len(args)-1; i++ {
 		var err error
 		var pk *sign.PublicKey
 
 		fn := args[i]
-		if strings.Index(fn, "@") > 0 {
+		if isSSHUser(fn) {
 			var ok bool
 			pk, ok = keymap[fn]
 			if !ok {
-				warn("can't find user %s in %s", fn, authkeys)
-				errs += 1
-				continue
+				// not a local user; the domain may publish the key
+				if pk, err = dnsRecipient(fn, known); err != nil {
+					warn("can't find user %s in %s: %s", fn, authkeys, err)
+					errs += 1
+					continue
+				}
 			}
 		} else {
-			pk, err = sign.ReadPublicKey(fn)
+			pk, err = sign.ParseRecipient(fn)
 			if err != nil {
 				warn("%s", err)
 				errs += 1
@@ -164,20 +310,248 @@ func encrypt(args []string) {
 			}
 		}
 
+		if err = known.check(fn, pk); err != nil {
+			warn("%s", err)
+			errs += 1
+			continue
+		}
+
 		err = en.AddRecipient(pk)
 		if err != nil {
 			die("%s", err)
 		}
+		names = append(names, eachName(fn, i))
 	}
 
 	if errs > 0 {
 		die("Too many errors!")
 	}
+	known.save()
+
+	if len(rcptfile) > 0 {
+		fd := mustOpen(rcptfile, os.O_RDONLY)
+		defer fd.Close()
+
+		if err = en.StreamRecipients(recipientLines(fd, rcptfile)); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if err = applyPolicy(en); err != nil {
+		die("%s", err)
+	}
+
+	if len(manifest) > 0 {
+		if err = en.EnableChunkManifest(); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if sparse {
+		if err = en.EnableSparse(); err != nil {
+			die("%s", err)
+		}
+	}
 
-	err = en.Encrypt(infd, outfd)
+	if len(ckpt) > 0 {
+		setCheckpoint(en, ckpt, outplain)
+	}
+
+	// the size of each output, if known, to reserve its disk space
+	var outsize int64 = -1
+	if inf != nil && !reclog && !sparse && len(rcptfile) == 0 {
+		if st, err := inf.Stat(); err == nil && st.Mode().IsRegular() {
+			nkeys := len(en.Keys)
+			if each {
+				nkeys -= len(names) - 1
+			}
+			outsize = en.EncryptedSize(st.Size(), nkeys)
+		}
+	}
+
+	if !each && outsize > 0 {
+		reserveOutput(outfd, outfile, outsize)
+	}
+
+	var lim *sign.RateLimiter
+	if rate > 0 {
+		lim = sign.NewRateLimiter(rate)
+	}
+
+	// direct I/O or io_uring and the rate limit of an output file
+	wrap := func(wr io.WriteCloser) io.WriteCloser {
+		// a checkpoint must only count the output that was written
+		if fd, ok := wr.(*os.File); ok && !reclog && len(ckpt) == 0 {
+			wr = fileWriter(fd, direct)
+		}
+		if lim != nil {
+			wr = lim.WriteCloser(wr)
+		}
+		return wr
+	}
+
+	if !each && len(outfile) > 0 && outfile != "-" {
+		outfd = wrap(outfd)
+	} else if lim != nil {
+		outfd = lim.WriteCloser(outfd)
+	}
+
+	if each {
+		err = encryptEach(en, infd, inf, outfile, names, force, outsize, wrap)
+	} else if reclog {
+		err = encryptLog(en, infd, outfd)
+	} else if prevf != nil {
+		_, err = en.EncryptDelta(infd, prevf, outfd)
+	} else {
+		err = en.Encrypt(infd, outfd)
+	}
+	if sk != nil {
+		audit("encrypt", sk, keyfile, infile, outfile, err)
+	}
 	if err != nil {
 		die("%s", err)
 	}
+	if len(ckpt) > 0 {
+		os.Remove(ckpt)
+	}
+
+	if len(manifest) > 0 {
+		m := en.ChunkManifest()
+		if err = m.Sign(sk); err != nil {
+			die("%s", err)
+		}
+		if err = m.SerializeFile(manifest, ""); err != nil {
+			die("%s", err)
+		}
+	}
+}
+
+// encrypt 'rd' to a separate file 'outfile.NAME' of 'size' bytes (if
+// known) for each recipient; each file is written through 'wrap'.
+func encryptEach(en *sign.Encryptor, rd io.Reader, inf *os.File, outfile string, names []string, force bool, size int64, wrap func(io.WriteCloser) io.WriteCloser) error {
+	seen := make(map[string]bool)
+	for _, nm := range names {
+		if seen[nm] {
+			die("--each: two recipients are named %s", nm)
+		}
+		seen[nm] = true
+	}
+
+	wrs := make([]io.WriteCloser, len(names))
+	for i, nm := range names {
+		fn := outfile + "." + nm
+		if inf != nil && sameFile(inf, fn) {
+			die("won't create output file %s: same as input file!", fn)
+		}
+
+		confirmOverwrite(fn, force)
+		fd := mustOpen(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		defer fd.Close()
+
+		if size > 0 {
+			reserveOutput(fd, fn, size)
+		}
+
+		wrs[i] = wrap(fd)
+	}
+	return en.EncryptEach(rd, wrs)
+}
+
+// name of the i'th recipient 'fn' in the output file names of --each: the
+// name of a key file without its .pub suffix or a 'user@host'
+func eachName(fn string, i int) string {
+	if isSSHUser(fn) {
+		return fn
+	}
+
+	if st, err := os.Stat(fn); err == nil && st.Mode().IsRegular() {
+		return strings.TrimSuffix(filepath.Base(fn), ".pub")
+	}
+	return fmt.Sprintf("%d", i+1)
+}
+
+// the recipients in 'fd', one per line, parsed as the header is written;
+// blank lines and '#' comments are skipped
+func recipientLines(fd io.Reader, fn string) func() (*sign.PublicKey, error) {
+	sc := bufio.NewScanner(fd)
+	sc.Buffer(make([]byte, 4096), 65536)
+
+	line := 0
+	return func() (*sign.PublicKey, error) {
+		for sc.Scan() {
+			line++
+			s := strings.TrimSpace(sc.Text())
+			if len(s) == 0 || s[0] == '#' {
+				continue
+			}
+
+			pk, err := sign.ParseRecipient(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", fn, line, err)
+			}
+			return pk, nil
+		}
+
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		return nil, io.EOF
+	}
+}
+
+// the reader of the input file 'fd': with 'direct', direct I/O; else
+// io_uring if sigtool is built with it.
+func fileReader(fd *os.File, direct bool) io.Reader {
+	if !direct {
+		return newRingReader(fd)
+	}
+
+	if st, err := fd.Stat(); err != nil || !st.Mode().IsRegular() {
+		return fd
+	}
+
+	r, err := newDirectReader(fd)
+	if err != nil {
+		die("%s", err)
+	}
+	return r
+}
+
+// the writer of the output file 'fd' (see fileReader()); it must be
+// closed to write all of the output.
+func fileWriter(fd *os.File, direct bool) io.WriteCloser {
+	if !direct {
+		return newRingWriter(fd)
+	}
+
+	if st, err := fd.Stat(); err != nil || !st.Mode().IsRegular() {
+		return fd
+	}
+
+	w, err := newDirectWriter(fd)
+	if err != nil {
+		os.Remove(fd.Name())
+		die("%s", err)
+	}
+	return w
+}
+
+// reserve the disk space of the output 'wr' of 'size' bytes, if it is a
+// file; a full disk fails now rather than part way through.
+func reserveOutput(wr io.Writer, fn string, size int64) {
+	fd, ok := wr.(*os.File)
+	if !ok {
+		return
+	}
+
+	if st, err := fd.Stat(); err != nil || !st.Mode().IsRegular() {
+		return
+	}
+
+	if err := preallocate(fd, size); err != nil {
+		os.Remove(fn)
+		die("can't reserve %d bytes for %s: %s", size, fn, err)
+	}
 }
 
 type nullWriter struct{}
@@ -192,6 +566,42 @@ func (w *nullWriter) Close() error {
 
 var _ io.WriteCloser = &nullWriter{}
 
+// lazyFile creates the output file on the first write; with --strict a
+// failed decryption leaves an existing output file untouched.
+type lazyFile struct {
+	name string
+	fd   *os.File
+}
+
+func (l *lazyFile) open() error {
+	if l.fd == nil {
+		fd, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		l.fd = fd
+	}
+	return nil
+}
+
+func (l *lazyFile) Write(p []byte) (int, error) {
+	if err := l.open(); err != nil {
+		return 0, err
+	}
+	return l.fd.Write(p)
+}
+
+func (l *lazyFile) Close() error {
+	if l.fd != nil {
+		return l.fd.Close()
+	}
+	return nil
+}
+
+// plaintext held in memory by decrypt --strict before it spools to a
+// temporary file
+const _StrictMemory = 16 * 1048576
+
 // sigtool decrypt a.key [file] [-o output]
 func decrypt(args []string) {
 	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
@@ -199,16 +609,30 @@ func decrypt(args []string) {
 		decryptUsage(fs)
 	}
 
-	var envpw string
+	var envpw, suffix string
 	var outfile string
 	var pubkey string
-	var nopw, test bool
+	var nopw, test, verifyOnly, strict, reclog, force, direct bool
+	var maxmem, rate uint64
+	var spoolDir string
+	var manifest, context string
 
 	fs.StringVarP(&outfile, "outfile", "o", "", "Write the output to file `F`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
 	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
 	fs.StringVarP(&pubkey, "verify-sender", "v", "", "Verify that the sender matches public key in `F`")
 	fs.BoolVarP(&test, "test", "t", false, "Test the encrypted file against the given key without writing to output")
+	fs.BoolVarP(&verifyOnly, "verify-only", "", false, "Authenticate every chunk (and the sender with -v), discard the plaintext and report the result")
+	fs.SizeVarP(&maxmem, "max-memory", "M", 0, "Refuse files that need more than `S` bytes of buffer memory [no limit]")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't write any output until the whole file is authenticated")
+	fs.StringVarP(&spoolDir, "spool-dir", "", "", "With --strict, use directory `D` for the encrypted temporary file [$TMPDIR]")
+	fs.StringVarP(&manifest, "manifest", "m", "", "Check each chunk against the signed manifest `F` (needs --verify-sender)")
+	fs.BoolVarP(&reclog, "log", "L", false, "Decrypt an append-only log written by 'encrypt --log'")
+	fs.StringVarP(&context, "context", "", "", "Decrypt a file encrypted with the application context `C`")
+	fs.StringVarP(&suffix, "suffix", "", "", "Write the output to INFILE without suffix `S` [.enc on a terminal]")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file without asking")
+	fs.SizeVarP(&rate, "limit-rate", "", 0, "Read at most `S` bytes per second [no limit]")
+	fs.BoolVarP(&direct, "direct", "", false, "Use direct I/O for the input and output files, bypassing the page cache")
 
 	err := fs.Parse(args)
 	if err != nil {
@@ -220,36 +644,34 @@ func decrypt(args []string) {
 		die("Insufficient args. Try '%s --help'", os.Args[0])
 	}
 
+	if verifyOnly {
+		if len(outfile) > 0 || strict {
+			die("--verify-only doesn't write any output; it can't be used with -o or --strict")
+		}
+		test = true
+	}
+
+	if direct && (strict || reclog) {
+		die("--direct can't be used with --strict or --log")
+	}
+
 	var infd io.Reader = os.Stdin
 	var outfd io.Writer = os.Stdout
 	var inf *os.File
-	var infile string
+	var infile, tmpfile string
+	var openOut bool
 
 	keyfile := args[0]
-	sk, err := sign.ReadPrivateKey(keyfile, func() ([]byte, error) {
-		var pws string
-		if nopw {
-			return nil, nil
-		}
-
-		if len(envpw) > 0 {
-			pws = os.Getenv(envpw)
-		} else {
-			pws, err = utils.Askpass("Enter passphrase for private key", false)
-			if err != nil {
-				die("%s", err)
-			}
-		}
-		return []byte(pws), nil
-	})
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
 	if err != nil {
+		audit("decrypt", nil, keyfile, "", outfile, err)
 		die("%s", err)
 	}
 
 	var pk *sign.PublicKey
 
 	if len(pubkey) > 0 {
-		pk, err = sign.ReadPublicKey(pubkey)
+		pk, err = sign.ParseRecipient(pubkey)
 		if err != nil {
 			die("%s", err)
 		}
@@ -258,43 +680,72 @@ func decrypt(args []string) {
 	if len(args) > 1 {
 		infile = args[1]
 		if infile != "-" {
-			inf := mustOpen(infile, os.O_RDONLY)
+			inf = mustOpen(infile, os.O_RDONLY)
 			defer inf.Close()
 
 			infd = inf
+			if !reclog {
+				infd = fileReader(inf, direct)
+			}
 		}
 	}
 
+	if !test && len(outfile) == 0 {
+		outfile = cryptOutput(infile, suffix, true)
+	}
+
 	if test {
 		outfd = &nullWriter{}
 	} else if len(outfile) > 0 && outfile != "-" {
-		if inf != nil {
-			ost, err := os.Stat(outfile)
-			if err != nil {
-				die("can't stat %s: %s", outfile, err)
-			}
-			ist, err := inf.Stat()
-			if err != nil {
-				die("can't stat %s: %s", infile, err)
-			}
-			if os.SameFile(ist, ost) {
-				die("won't create output file: same as input file!")
-			}
+		if inf != nil && sameFile(inf, outfile) {
+			die("won't create output file: same as input file!")
 		}
 
-		outf := mustOpen(outfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
-		defer outf.Close()
+		confirmOverwrite(outfile, force)
 
-		outfd = outf
+		if strict {
+			outf := &lazyFile{name: outfile}
+			defer outf.Close()
+
+			outfd = outf
+		} else {
+			// opened once the header is read
+			openOut = true
+		}
+	}
+
+	if len(manifest) > 0 {
+		if pk == nil {
+			die("--manifest needs the sender's public key (--verify-sender)")
+		}
+
+		m, err := sign.ReadChunkManifest(manifest)
+		if err != nil {
+			die("%s", err)
+		}
+		if err = m.Verify(pk); err != nil {
+			die("%s: %s", manifest, err)
+		}
+		infd = m.NewReader(infd)
+	}
+
+	if rate > 0 {
+		infd = sign.NewRateLimiter(rate).Reader(infd)
 	}
 
+	sign.SetDecryptMemoryLimit(maxmem)
 	d, err := sign.NewDecryptor(infd)
 	if err != nil {
 		die("%s", err)
 	}
 
+	if err = d.SetContext(context); err != nil {
+		die("%s", err)
+	}
+
 	err = d.SetPrivateKey(sk, pk)
 	if err != nil {
+		audit("decrypt", sk, keyfile, infile, outfile, err)
 		die("%s", err)
 	}
 
@@ -306,12 +757,89 @@ func decrypt(args []string) {
 		warn("%s: Missing sender Public Key; can't authenticate sender ..", fn)
 	}
 
-	err = d.Decrypt(outfd)
+	// reordered or spliced content defined chunks are only found at the
+	// end of the file; so they're decrypted to a temporary file that is
+	// renamed to the output once all of it is authenticated.
+	outname := outfile
+	if openOut {
+		st, err := os.Stat(outfile)
+		if d.Chunking == "cdc" && (os.IsNotExist(err) || err == nil && st.Mode().IsRegular()) {
+			outf, err := ioutil.TempFile(filepath.Dir(outfile), ".sigtool-")
+			if err != nil {
+				die("can't create a temporary file for %s: %s", outfile, err)
+			}
+			defer outf.Close()
+
+			tmpfile = outf.Name()
+			outname = tmpfile
+			outfd = outf
+		} else {
+			outf := mustOpen(outfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			defer outf.Close()
+
+			outfd = outf
+		}
+	}
+
+	if !reclog && !test && inf != nil {
+		if st, err := inf.Stat(); err == nil && st.Mode().IsRegular() {
+			if n, err := sign.DecryptedSize(d, st.Size()); err == nil && n > 0 {
+				reserveOutput(outfd, outname, n)
+			}
+		}
+	}
+
+	// the output file must be closed to write all of it
+	var outc io.Closer
+	if fd, ok := outfd.(*os.File); ok && fd != os.Stdout && !reclog {
+		wr := fileWriter(fd, direct)
+		outfd, outc = wr, wr
+	}
+
+	var size int64
+	if reclog {
+		err = decryptLog(d, outfd)
+	} else if test {
+		size, err = d.Verify()
+	} else if strict {
+		opt := &sign.SpoolOptions{
+			MaxMemory: _StrictMemory,
+			TempDir:   spoolDir,
+		}
+		err = d.DecryptStrict(outfd, opt)
+		if lf, ok := outfd.(*lazyFile); ok && err == nil {
+			// create the output even if the plaintext is empty
+			err = lf.open()
+		}
+	} else {
+		err = d.Decrypt(outfd)
+		if outc != nil && err == nil {
+			err = outc.Close()
+		}
+		if len(tmpfile) > 0 && err == nil {
+			err = os.Rename(tmpfile, outfile)
+		}
+	}
+	audit("decrypt", sk, keyfile, infile, outfile, err)
 	if err != nil {
+		if len(tmpfile) > 0 {
+			os.Remove(tmpfile)
+		}
 		die("%s", err)
 	}
 
-	if test {
+	if verifyOnly {
+		fn := infile
+		if len(fn) == 0 || fn == "-" {
+			fn = "<stdin>"
+		}
+
+		sender := "sender not authenticated"
+		if pk != nil {
+			sender = "sender verified"
+		}
+		fmt.Printf("%s: OK (%d bytes; %s)\n", fn, size, sender)
+	} else if test {
 		warn("Enc file OK")
 	}
 }
@@ -322,11 +850,77 @@ func encryptUsage(fs *flag.FlagSet) {
 Usage: %s encrypt [options] to [to ...] infile|-
 
 Where TO is the public key of the recipient and INFILE is an input file.
+TO is a public key file, a 'user@host' in ~/.ssh/authorized_keys, an
+OpenSSH public key line, an age recipient, a raw key in hex or base64 or
+a URI of a registered recipient scheme (e.g., 'kmip://host/UID').
+A 'user@domain' that isn't in authorized_keys is looked up in the DNS
+zone of the domain; a key that isn't authenticated by DNSSEC must be
+pinned already or its fingerprint confirmed on the terminal
+($SIGTOOL_DNS_SERVER names the resolver to use).
 If the input file is '-' then %s reads from STDIN. Unless '-o' is used,
-%s writes the encrypted output to STDOUT.
+%s writes the encrypted output to STDOUT; if STDOUT is a terminal (or
+with --suffix), the output is INFILE.enc (INFILE with suffix S).
+
+An existing output file is only overwritten after asking on a terminal
+(or with --force). The disk space of an output file whose size is known
+in advance is reserved before encryption starts; a full disk fails early.
+
+The first time a recipient is named (a key file, a 'user@host' or a URI),
+the fingerprint of its key is pinned in the known recipients file; later,
+a different key under that name is refused. If the key was replaced on
+purpose, use --repin.
+
+With --recipients-file, the input is also encrypted to the recipients in
+file F, one per line (in any of the forms above; blank lines and '#'
+comments are skipped). They are read and written to the header one at a
+time, so a file can be encrypted to many thousands of recipients; such
+files are written in format version 3, which older versions of %s
+can't decrypt. These recipients aren't pinned.
+
+A recipient normally tries to unwrap every key in the header to find its
+own; with --hints, each key of an X25519 recipient carries a short hint
+that only that recipient can compute, and it unwraps just that one. Use
+it for files with many recipients; it adds 10 bytes per recipient.
+
+With --each, the input is encrypted in one pass to a separate file for
+each recipient, OUTFILE.NAME, where NAME is the name of the key file
+without its .pub suffix, the 'user@host' or the position of the
+recipient. No file has more than one recipient (besides escrow keys), so
+no one learns who else received the data.
+
+With --checkpoint, the progress of the encryption of an input file is
+saved in file F (every 64 MB, after the output is synced). If %s is
+interrupted, the same command resumes where the checkpoint left off;
+the recipients are already in the output and aren't needed again. The
+output written after the checkpoint is kept if it matches the input;
+if the input changed, the encryption isn't resumed. F holds the file
+key: keep it as safe as the input. It is removed when the encryption
+finishes.
+
+With --log and --append, the lines of the input are appended to the
+existing log OUTFILE, which must have been closed; K is the private key
+of one of its recipients, whose keys aren't needed. The log isn't
+rewritten: the records follow its end and it is closed again.
+
+With --cdc, the chunks of the input are cut where its content (not its
+offset) says so and encrypted with a convergence key derived from the
+sender key and the absolute path of INFILE (or --cdc-name); encrypting
+a changed file again gives the same chunks for its unchanged regions, so
+a backup store can deduplicate them. Anyone with two such files can tell
+which chunks they share. Older versions of %s can't decrypt them.
+With --previous, the unchanged chunks are copied from the previous
+encryption F of the input instead of being encrypted again.
+
+The cipher of the encrypted data is AES-256-GCM if the CPU has AES
+instructions and ChaCha20-Poly1305 otherwise; --cipher picks one. The
+choice is recorded in the file and decrypt uses it.
+
+The escrow keys of the encryption policy ($SIGTOOL_POLICY or
+/etc/sigtool/policy.yml) are added to every file and recorded as such in
+its header; if they can't be added, nothing is encrypted.
 
 Options:
-`, Z, Z, Z, Z)
+`, Z, Z, Z, Z, Z, Z, Z)
 
 	fs.PrintDefaults()
 	os.Exit(0)
@@ -338,8 +932,26 @@ func decryptUsage(fs *flag.FlagSet) {
 Usage: %s decrypt [options] key [infile]
 
 Where KEY is the private key to be used for decryption and INFILE is
-the encrypted input file. If INFILE is not provided, %s reads
-from STDIN. Unless '-o' is used, %s writes the decrypted output to STDOUT.
+the encrypted input file. KEY is a private key file, an age identity, a
+raw key in hex or base64, a URI of a registered identity scheme or
+'passphrase:SALT' for keys made with 'generate --derive'. If
+INFILE is not provided, %s reads from STDIN. Unless '-o' is used, %s
+writes the decrypted output to STDOUT; if STDOUT is a terminal (or with
+--suffix), the output is INFILE without its .enc suffix (suffix S).
+An existing output file is only overwritten after asking on a terminal
+(or with --force).
+The disk space of the output file is reserved before decryption starts;
+a full disk fails early.
+
+Decryption normally writes each chunk as soon as it is authenticated; a
+truncated or tampered file leaves partial output behind. With --strict
+nothing is written until the whole file is authenticated: the plaintext
+is held in memory (up to 16MB) and then in a temporary file encrypted with
+an ephemeral key.
+
+A file encrypted with --cdc is decrypted to a temporary file next to the
+output, which is renamed to it once the last chunk authenticates: its
+reordered or spliced chunks are only found at the end of the file.
 
 Options:
 `, Z, Z, Z, Z)
@@ -348,6 +960,105 @@ Options:
 	os.Exit(0)
 }
 
+// encrypt each line of 'rd' as a record of an append-only log; lines
+// longer than the chunk size are split across records.
+func encryptLog(en *sign.Encryptor, rd io.Reader, wr io.WriteCloser) error {
+	lw, err := en.NewLogWriter(wr)
+	if err != nil {
+		return err
+	}
+	return writeLog(lw, rd, en.ChunkSize)
+}
+
+// append each line of 'rd' to the closed log 'fn'; it is reopened with
+// the private key in 'keyfile' of one of its recipients.
+func appendLog(keyfile string, ask func() ([]byte, error), rd io.Reader, fn string) error {
+	sk, err := sign.ParseIdentity(keyfile, ask)
+	if err != nil {
+		return err
+	}
+
+	fd := mustOpen(fn, os.O_RDWR)
+	defer fd.Close()
+
+	d, err := sign.NewDecryptor(fd)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fn, err)
+	}
+
+	if err = d.SetPrivateKey(sk, nil); err != nil {
+		return fmt.Errorf("%s: %s", fn, err)
+	}
+
+	// the records are written after the end of the log that was read
+	lw, err := d.NewLogAppender(fd)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fn, err)
+	}
+	return writeLog(lw, rd, d.ChunkSize)
+}
+
+// append each line of 'rd' to the log 'lw' and close it; lines longer
+// than 'chunkSize' are split across records.
+func writeLog(lw *sign.LogWriter, rd io.Reader, chunkSize uint32) error {
+	br := bufio.NewReaderSize(rd, int(chunkSize))
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if err := lw.Append(line); err != nil {
+				return err
+			}
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return lw.Close()
+		default:
+			return fmt.Errorf("encrypt: I/O read error: %s", err)
+		}
+	}
+}
+
+// write the records of an append-only log to 'wr'
+func decryptLog(d *sign.Decryptor, wr io.Writer) error {
+	lr, err := d.NewLogReader()
+	if err != nil {
+		return err
+	}
+
+	for {
+		rec, err := lr.Next()
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+
+		if _, err := wr.Write(rec); err != nil {
+			return fmt.Errorf("decrypt: %s", err)
+		}
+	}
+}
+
+// return true if 'fn' names a user in authorized_keys
+func isSSHUser(fn string) bool {
+	return strings.Index(fn, "@") > 0 && !strings.ContainsAny(fn, " \t") && !strings.Contains(fn, "://")
+}
+
+// true if the file 'fn' exists and is the open file 'fd'
+func sameFile(fd *os.File, fn string) bool {
+	ost, err := os.Stat(fn)
+	if err != nil {
+		return false
+	}
+
+	ist, err := fd.Stat()
+	return err == nil && os.SameFile(ist, ost)
+}
+
 func mustOpen(fn string, flag int) *os.File {
 	fdk, err := os.OpenFile(fn, flag, 0600)
 	if err != nil {
@@ -0,0 +1,131 @@
+// directio.go -- direct I/O that bypasses the page cache
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	// alignment of the buffers, offsets and sizes of direct I/O
+	_DirectAlign = 4096
+
+	// size of each direct I/O request
+	_DirectBuf = 1048576
+)
+
+// a buffer of 'n' bytes aligned for direct I/O
+func alignedBuf(n int) []byte {
+	b := make([]byte, n+_DirectAlign)
+	off := int(uintptr(unsafe.Pointer(&b[0])) & (_DirectAlign - 1))
+	if off != 0 {
+		off = _DirectAlign - off
+	}
+	return b[off : off+n]
+}
+
+// directReader reads a file from its start with direct I/O
+type directReader struct {
+	fd   *os.File
+	buf  []byte
+	r, w int
+	err  error
+}
+
+func newDirectReader(fd *os.File) (*directReader, error) {
+	if err := setDirect(fd, true); err != nil {
+		return nil, err
+	}
+
+	r := &directReader{
+		fd:  fd,
+		buf: alignedBuf(_DirectBuf),
+	}
+	return r, nil
+}
+
+func (r *directReader) Read(b []byte) (int, error) {
+	if r.r == r.w {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		// only the last read of the file can be short
+		n, err := io.ReadFull(r.fd, r.buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		r.r, r.w, r.err = 0, n, err
+		if n == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf[r.r:r.w])
+	r.r += n
+	return n, nil
+}
+
+// directWriter writes a file from its start with direct I/O; the last
+// partial block is written without it when the writer is closed.
+type directWriter struct {
+	fd  *os.File
+	buf []byte
+	n   int
+}
+
+func newDirectWriter(fd *os.File) (*directWriter, error) {
+	if err := setDirect(fd, true); err != nil {
+		return nil, err
+	}
+
+	w := &directWriter{
+		fd:  fd,
+		buf: alignedBuf(_DirectBuf),
+	}
+	return w, nil
+}
+
+func (w *directWriter) Write(b []byte) (int, error) {
+	var z int
+	for len(b) > 0 {
+		n := copy(w.buf[w.n:], b)
+		w.n += n
+		z += n
+		b = b[n:]
+
+		if w.n == len(w.buf) {
+			if _, err := w.fd.Write(w.buf); err != nil {
+				return z, err
+			}
+			w.n = 0
+		}
+	}
+	return z, nil
+}
+
+func (w *directWriter) Close() error {
+	if w.n > 0 {
+		if err := setDirect(w.fd, false); err != nil {
+			return err
+		}
+		if _, err := w.fd.Write(w.buf[:w.n]); err != nil {
+			return err
+		}
+		w.n = 0
+	}
+	return w.fd.Close()
+}
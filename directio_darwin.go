@@ -0,0 +1,37 @@
+// directio_darwin.go -- direct I/O with F_NOCACHE on macOS
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// turn the page cache off or on for the open file 'fd'; F_NOCACHE has no
+// alignment needs, so the last block is written with it too.
+func setDirect(fd *os.File, on bool) error {
+	if !on {
+		return nil
+	}
+
+	_, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_NOCACHE, 1)
+	if e != 0 {
+		return fmt.Errorf("%s: direct I/O: %s", fd.Name(), e)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// directio_linux.go -- direct I/O with O_DIRECT on Linux
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// turn O_DIRECT on or off for the open file 'fd'
+func setDirect(fd *os.File, on bool) error {
+	fl, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_GETFL, 0)
+	if e != 0 {
+		return fmt.Errorf("%s: direct I/O: %s", fd.Name(), e)
+	}
+
+	if on {
+		fl |= syscall.O_DIRECT
+	} else {
+		fl &^= syscall.O_DIRECT
+	}
+
+	_, _, e = syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_SETFL, fl)
+	if e != 0 {
+		return fmt.Errorf("%s: direct I/O: %s", fd.Name(), e)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// directio_other.go -- platforms without direct I/O
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func setDirect(fd *os.File, on bool) error {
+	if on {
+		return fmt.Errorf("direct I/O is not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// dns.go -- recipients published in DNS
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// look up the key of 'addr' in DNS. A key that DNSSEC doesn't vouch for
+// must already be pinned in 'known' or its fingerprint confirmed by the
+// user.
+func dnsRecipient(addr string, known *knownRecipients) (*sign.PublicKey, error) {
+	pk, secure, err := sign.LookupRecipient(addr, os.Getenv("SIGTOOL_DNS_SERVER"))
+	if err != nil {
+		return nil, err
+	}
+
+	if secure || known.pinned(addr) {
+		return pk, nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("%s: key %s in DNS isn't authenticated by DNSSEC; verify and pin it with a terminal",
+			addr, pk.Fingerprint())
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: the key of %s in DNS isn't authenticated by DNSSEC.\nIts fingerprint is:\n  %s\n  %s\nIs this the key of %s? [y/N] ",
+		Z, addr, pk.Fingerprint(), pk.FingerprintWords(), addr)
+	ans, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(ans)) {
+	case "y", "yes":
+		return pk, nil
+	}
+	return nil, fmt.Errorf("%s: key in DNS not confirmed", addr)
+}
+
+// print the zone file line that publishes 'pk' as the key of 'addr'
+func printDNSRecord(addr string, pk *sign.PublicKey) {
+	name, err := sign.DNSRecordName(addr)
+	if err != nil {
+		die("%s", err)
+	}
+
+	// a TXT string is at most 255 bytes
+	var strs []string
+	for s := pk.DNSRecord(); len(s) > 0; {
+		p := s
+		if len(p) > 255 {
+			p = p[:255]
+		}
+		strs = append(strs, fmt.Sprintf("%q", p))
+		s = s[len(p):]
+	}
+	fmt.Printf("%s. IN TXT %s\n", name, strings.Join(strs, " "))
+}
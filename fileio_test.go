@@ -0,0 +1,124 @@
+// fileio_test.go -- tests for the file readers and writers of encrypt
+// and decrypt
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// encrypt random data to a file with the writer 'wr' makes of it and
+// decrypt it with the reader 'rd' makes of it; 'setup' is called on the
+// new output file. It returns the name of the encrypted file.
+func fileRoundTrip(t *testing.T, setup func(fd *os.File, size int64), wr func(fd *os.File) io.WriteCloser, rd func(fd *os.File) io.Reader) string {
+	assert := newAsserter(t)
+
+	buf := make([]byte, 5*1048576+1234)
+	_, err := io.ReadFull(rand.Reader, buf)
+	assert(err == nil, "rand: %s", err)
+
+	kp, err := sign.NewKeypair()
+	assert(err == nil, "keygen fail: %s", err)
+
+	en, err := sign.NewEncryptor(nil, 65536)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = en.AddRecipient(&kp.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	fn := filepath.Join(tempdir(t), "out.enc")
+	fd, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	assert(err == nil, "create: %s", err)
+	if setup != nil {
+		setup(fd, en.EncryptedSize(int64(len(buf)), 1))
+	}
+
+	err = en.Encrypt(bytes.NewReader(buf), wr(fd))
+	assert(err == nil, "encrypt: %s", err)
+
+	fd, err = os.Open(fn)
+	assert(err == nil, "open: %s", err)
+	defer fd.Close()
+
+	d, err := sign.NewDecryptor(rd(fd))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&kp.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	var out bytes.Buffer
+	err = d.Decrypt(&out)
+	assert(err == nil, "decrypt: %s", err)
+	assert(bytes.Equal(out.Bytes(), buf), "decrypt: plaintext mismatch")
+	return fn
+}
+
+func TestPreallocate(t *testing.T) {
+	assert := newAsserter(t)
+
+	var reserved int64
+	fn := fileRoundTrip(t, func(fd *os.File, size int64) {
+		err := preallocate(fd, size)
+		assert(err == nil, "preallocate %d: %s", size, err)
+
+		// the space is reserved; the size doesn't change
+		st, err := fd.Stat()
+		assert(err == nil, "stat: %s", err)
+		assert(st.Size() == 0, "preallocated file has size %d", st.Size())
+		reserved = size
+	}, func(fd *os.File) io.WriteCloser {
+		return fd
+	}, func(fd *os.File) io.Reader {
+		return fd
+	})
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "stat: %s", err)
+	assert(st.Size() == reserved, "encrypted size %d; reserved %d", st.Size(), reserved)
+}
+
+func TestDirectIO(t *testing.T) {
+	assert := newAsserter(t)
+
+	// the file system of the temporary directory may not do direct I/O
+	probe, err := os.Create(filepath.Join(tempdir(t), "probe"))
+	assert(err == nil, "create: %s", err)
+	pw, err := newDirectWriter(probe)
+	if err == nil {
+		_, err = pw.Write(make([]byte, _DirectBuf))
+	}
+	probe.Close()
+	if err != nil {
+		t.Skipf("no direct I/O: %s", err)
+	}
+
+	fileRoundTrip(t, nil, func(fd *os.File) io.WriteCloser {
+		w, err := newDirectWriter(fd)
+		assert(err == nil, "direct writer: %s", err)
+		return w
+	}, func(fd *os.File) io.Reader {
+		r, err := newDirectReader(fd)
+		assert(err == nil, "direct reader: %s", err)
+		return r
+	})
+}
+
+func TestRingIO(t *testing.T) {
+	fileRoundTrip(t, nil, newRingWriter, newRingReader)
+}
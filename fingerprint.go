@@ -0,0 +1,100 @@
+// fingerprint.go -- show key fingerprints for humans
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'fingerprint' command
+func fingerprint(args []string) {
+	var help bool
+	var format string
+
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&format, "format", "f", "all", "Show the fingerprint as `F`: sha256, hex, words, art or all")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s fingerprint: Show the fingerprint of public keys.
+
+Usage: %s fingerprint [options] pubkey [pubkey...]
+
+Show the SHA256 fingerprint of each public key as base64 (as shown by
+'ssh-keygen -l'), hex, a list of words to read aloud (the PGP word list)
+and OpenSSH randomart. Compare them to make sure two people or devices
+have the same key.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	show := map[string]func(pk *sign.PublicKey) string{
+		"sha256": func(pk *sign.PublicKey) string { return pk.Fingerprint() },
+		"hex":    func(pk *sign.PublicKey) string { return pk.FingerprintHex() },
+		"words":  func(pk *sign.PublicKey) string { return pk.FingerprintWords() },
+		"art":    func(pk *sign.PublicKey) string { return strings.TrimSuffix(pk.Randomart(), "\n") },
+	}
+
+	format = strings.ToLower(format)
+	if _, ok := show[format]; !ok && format != "all" {
+		die("unknown fingerprint format %s", format)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s fingerprint --help'", Z)
+	}
+
+	for i, fn := range args {
+		pk, err := sign.ReadPublicKey(fn)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if format != "all" {
+			if len(args) > 1 {
+				sep := " "
+				if format == "art" {
+					sep = "\n"
+				}
+				fmt.Printf("%s:%s", fn, sep)
+			}
+			fmt.Println(show[format](pk))
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(strings.TrimSpace(fn + ": " + pk.Comment))
+		fmt.Printf("  sha256: %s\n", pk.Fingerprint())
+		fmt.Printf("  hex:    %s\n", pk.FingerprintHex())
+		fmt.Printf("  words:  %s\n", pk.FingerprintWords())
+		fmt.Printf("%s", pk.Randomart())
+	}
+}
@@ -0,0 +1,691 @@
+// fuse_linux.go -- a read-only FUSE server of an fs.FS
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+// This file speaks just enough of the FUSE protocol (7.31) on /dev/fuse
+// to serve a read-only fs.FS: lookups, attributes, reading files and
+// directories. root mounts the filesystem with mount(2); everyone else
+// does it with the setuid fusermount3 (or fusermount) helper, which
+// passes back the /dev/fuse descriptor over a socket.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_FuseMajor = 7
+	_FuseMinor = 31
+
+	_FuseRootID   = 1
+	_FuseMaxWrite = 131072
+	_FuseBufSize  = _FuseMaxWrite + 4096
+
+	// the contents never change
+	_FuseValid = 3600
+
+	_FuseOpenKeepCache = 1 << 1
+
+	_FuseLookup      = 1
+	_FuseForget      = 2
+	_FuseGetattr     = 3
+	_FuseOpen        = 14
+	_FuseRead        = 15
+	_FuseStatfs      = 17
+	_FuseRelease     = 18
+	_FuseFlush       = 25
+	_FuseInit        = 26
+	_FuseOpendir     = 27
+	_FuseReaddir     = 28
+	_FuseReleasedir  = 29
+	_FuseInterrupt   = 36
+	_FuseDestroy     = 38
+	_FuseBatchForget = 42
+)
+
+// struct fuse_in_header
+type fuseInHeader struct {
+	len     uint32
+	opcode  uint32
+	unique  uint64
+	nodeid  uint64
+	uid     uint32
+	gid     uint32
+	pid     uint32
+	extlen  uint16
+	padding uint16
+}
+
+// struct fuse_out_header
+type fuseOutHeader struct {
+	len    uint32
+	error  int32
+	unique uint64
+}
+
+// struct fuse_attr
+type fuseAttr struct {
+	ino       uint64
+	size      uint64
+	blocks    uint64
+	atime     uint64
+	mtime     uint64
+	ctime     uint64
+	atimensec uint32
+	mtimensec uint32
+	ctimensec uint32
+	mode      uint32
+	nlink     uint32
+	uid       uint32
+	gid       uint32
+	rdev      uint32
+	blksize   uint32
+	flags     uint32
+}
+
+// struct fuse_entry_out
+type fuseEntryOut struct {
+	nodeid         uint64
+	generation     uint64
+	entryValid     uint64
+	attrValid      uint64
+	entryValidNsec uint32
+	attrValidNsec  uint32
+	attr           fuseAttr
+}
+
+// struct fuse_attr_out
+type fuseAttrOut struct {
+	attrValid     uint64
+	attrValidNsec uint32
+	dummy         uint32
+	attr          fuseAttr
+}
+
+// struct fuse_init_in (the fields we need)
+type fuseInitIn struct {
+	major        uint32
+	minor        uint32
+	maxReadahead uint32
+	flags        uint32
+}
+
+// struct fuse_init_out
+type fuseInitOut struct {
+	major               uint32
+	minor               uint32
+	maxReadahead        uint32
+	flags               uint32
+	maxBackground       uint16
+	congestionThreshold uint16
+	maxWrite            uint32
+	timeGran            uint32
+	maxPages            uint16
+	mapAlignment        uint16
+	flags2              uint32
+	maxStackDepth       uint32
+	unused              [6]uint32
+}
+
+// struct fuse_open_in
+type fuseOpenIn struct {
+	flags     uint32
+	openFlags uint32
+}
+
+// struct fuse_open_out
+type fuseOpenOut struct {
+	fh        uint64
+	openFlags uint32
+	backingID uint32
+}
+
+// struct fuse_read_in; also the request of READDIR
+type fuseReadIn struct {
+	fh        uint64
+	offset    uint64
+	size      uint32
+	readFlags uint32
+	lockOwner uint64
+	flags     uint32
+	padding   uint32
+}
+
+// struct fuse_release_in (the fields we need)
+type fuseReleaseIn struct {
+	fh    uint64
+	flags uint32
+}
+
+// struct fuse_dirent without the name
+type fuseDirent struct {
+	ino     uint64
+	off     uint64
+	namelen uint32
+	typ     uint32
+}
+
+// struct fuse_statfs_out
+type fuseStatfsOut struct {
+	blocks  uint64
+	bfree   uint64
+	bavail  uint64
+	files   uint64
+	ffree   uint64
+	bsize   uint32
+	namelen uint32
+	frsize  uint32
+	padding uint32
+	spare   [6]uint32
+}
+
+// an open file or directory
+type fuseHandle struct {
+	f    fs.File
+	dir  string
+	ents []fs.DirEntry
+}
+
+// the state of a mounted fs.FS
+type fuseServer struct {
+	fsys fs.FS
+	fd   int
+
+	// node ids are assigned as names are looked up; they are never
+	// forgotten
+	ids   map[string]uint64
+	paths []string
+
+	handles map[uint64]*fuseHandle
+	nextFh  uint64
+
+	uid, gid uint32
+
+	in, out []byte
+}
+
+// serve 'fsys' read-only at the directory 'mnt' until it is unmounted;
+// 'src' names the filesystem in the mount table.
+func serveFUSE(fsys fs.FS, src, mnt string) error {
+	fd, unmount, err := fuseMount(src, mnt)
+	if err != nil {
+		return fmt.Errorf("mount: %s: %s", mnt, err)
+	}
+	defer syscall.Close(fd)
+
+	s := &fuseServer{
+		fsys:    fsys,
+		fd:      fd,
+		ids:     map[string]uint64{".": _FuseRootID},
+		paths:   []string{"", "."},
+		handles: make(map[uint64]*fuseHandle),
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		in:      make([]byte, _FuseBufSize),
+		out:     make([]byte, _FuseBufSize),
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		if err := unmount(); err != nil {
+			warn("can't unmount %s: %s", mnt, err)
+			os.Exit(1)
+		}
+	}()
+
+	warn("mounted %s at %s", src, mnt)
+	return s.serve()
+}
+
+// answer requests until the filesystem is unmounted
+func (s *fuseServer) serve() error {
+	for {
+		n, err := syscall.Read(s.fd, s.in)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+			continue
+		case syscall.ENODEV:
+			return nil
+		default:
+			return fmt.Errorf("mount: read /dev/fuse: %s", err)
+		}
+
+		hsz := int(unsafe.Sizeof(fuseInHeader{}))
+		if n < hsz {
+			return fmt.Errorf("mount: short request of %d bytes", n)
+		}
+
+		h := (*fuseInHeader)(unsafe.Pointer(&s.in[0]))
+		body := s.in[hsz:n]
+		if h.opcode == _FuseDestroy {
+			s.reply(h.unique, 0, 0)
+			return nil
+		}
+		s.handle(h, body)
+	}
+}
+
+// handle one request
+func (s *fuseServer) handle(h *fuseInHeader, body []byte) {
+	var n int
+	var errno syscall.Errno
+
+	switch h.opcode {
+	case _FuseForget, _FuseBatchForget, _FuseInterrupt:
+		// these don't have replies
+		return
+
+	case _FuseInit:
+		n, errno = s.init(body)
+
+	case _FuseLookup:
+		n, errno = s.lookup(h.nodeid, cstring(body))
+
+	case _FuseGetattr:
+		n, errno = s.getattr(h.nodeid)
+
+	case _FuseOpen, _FuseOpendir:
+		n, errno = s.open(h.nodeid, body, h.opcode == _FuseOpendir)
+
+	case _FuseRead:
+		n, errno = s.read(body)
+
+	case _FuseReaddir:
+		n, errno = s.readdir(body)
+
+	case _FuseRelease, _FuseReleasedir:
+		r := (*fuseReleaseIn)(unsafe.Pointer(&body[0]))
+		if hd, ok := s.handles[r.fh]; ok {
+			if hd.f != nil {
+				hd.f.Close()
+			}
+			delete(s.handles, r.fh)
+		}
+
+	case _FuseFlush:
+
+	case _FuseStatfs:
+		o := (*fuseStatfsOut)(s.outArg())
+		*o = fuseStatfsOut{bsize: 4096, frsize: 4096, namelen: 255}
+		n = int(unsafe.Sizeof(*o))
+
+	default:
+		errno = syscall.ENOSYS
+	}
+
+	s.reply(h.unique, n, errno)
+}
+
+func (s *fuseServer) init(body []byte) (int, syscall.Errno) {
+	in := (*fuseInitIn)(unsafe.Pointer(&body[0]))
+	if in.major < _FuseMajor {
+		return 0, syscall.EPROTO
+	}
+
+	o := (*fuseInitOut)(s.outArg())
+	*o = fuseInitOut{
+		major:        _FuseMajor,
+		minor:        _FuseMinor,
+		maxReadahead: in.maxReadahead,
+		maxWrite:     _FuseMaxWrite,
+	}
+	if o.maxReadahead > _FuseMaxWrite {
+		o.maxReadahead = _FuseMaxWrite
+	}
+	return int(unsafe.Sizeof(*o)), 0
+}
+
+func (s *fuseServer) lookup(parent uint64, name string) (int, syscall.Errno) {
+	dir, errno := s.path(parent)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	nm := path.Join(dir, name)
+	fi, err := fs.Stat(s.fsys, nm)
+	if err != nil {
+		return 0, fuseErrno(err)
+	}
+
+	o := (*fuseEntryOut)(s.outArg())
+	*o = fuseEntryOut{
+		nodeid:     s.id(nm),
+		entryValid: _FuseValid,
+		attrValid:  _FuseValid,
+	}
+	s.attr(&o.attr, o.nodeid, fi)
+	return int(unsafe.Sizeof(*o)), 0
+}
+
+func (s *fuseServer) getattr(id uint64) (int, syscall.Errno) {
+	nm, errno := s.path(id)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	fi, err := fs.Stat(s.fsys, nm)
+	if err != nil {
+		return 0, fuseErrno(err)
+	}
+
+	o := (*fuseAttrOut)(s.outArg())
+	*o = fuseAttrOut{attrValid: _FuseValid}
+	s.attr(&o.attr, id, fi)
+	return int(unsafe.Sizeof(*o)), 0
+}
+
+func (s *fuseServer) open(id uint64, body []byte, dir bool) (int, syscall.Errno) {
+	nm, errno := s.path(id)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	in := (*fuseOpenIn)(unsafe.Pointer(&body[0]))
+	if in.flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return 0, syscall.EROFS
+	}
+
+	hd := &fuseHandle{dir: nm}
+	if dir {
+		ents, err := fs.ReadDir(s.fsys, nm)
+		if err != nil {
+			return 0, fuseErrno(err)
+		}
+		hd.ents = ents
+	} else {
+		f, err := s.fsys.Open(nm)
+		if err != nil {
+			return 0, fuseErrno(err)
+		}
+		if _, ok := f.(io.ReaderAt); !ok {
+			f.Close()
+			return 0, syscall.EIO
+		}
+		hd.f = f
+	}
+
+	s.nextFh++
+	s.handles[s.nextFh] = hd
+
+	o := (*fuseOpenOut)(s.outArg())
+	*o = fuseOpenOut{fh: s.nextFh, openFlags: _FuseOpenKeepCache}
+	return int(unsafe.Sizeof(*o)), 0
+}
+
+func (s *fuseServer) read(body []byte) (int, syscall.Errno) {
+	in := (*fuseReadIn)(unsafe.Pointer(&body[0]))
+	hd, ok := s.handles[in.fh]
+	if !ok || hd.f == nil {
+		return 0, syscall.EBADF
+	}
+
+	buf := s.out[unsafe.Sizeof(fuseOutHeader{}):]
+	if int(in.size) < len(buf) {
+		buf = buf[:in.size]
+	}
+
+	n, err := hd.f.(io.ReaderAt).ReadAt(buf, int64(in.offset))
+	if err != nil && err != io.EOF {
+		warn("%s: %s", hd.dir, err)
+		return 0, syscall.EIO
+	}
+	return n, 0
+}
+
+// fill the reply with the entries of the directory after the offset
+func (s *fuseServer) readdir(body []byte) (int, syscall.Errno) {
+	in := (*fuseReadIn)(unsafe.Pointer(&body[0]))
+	hd, ok := s.handles[in.fh]
+	if !ok || hd.f != nil {
+		return 0, syscall.EBADF
+	}
+
+	buf := s.out[unsafe.Sizeof(fuseOutHeader{}):]
+	if int(in.size) < len(buf) {
+		buf = buf[:in.size]
+	}
+
+	dsz := int(unsafe.Sizeof(fuseDirent{}))
+	var n int
+	for i := in.offset; i < uint64(len(hd.ents)); i++ {
+		e := hd.ents[i]
+		nm := e.Name()
+		sz := (dsz + len(nm) + 7) &^ 7
+		if n+sz > len(buf) {
+			break
+		}
+
+		typ := uint32(syscall.DT_REG)
+		if e.IsDir() {
+			typ = syscall.DT_DIR
+		}
+
+		d := (*fuseDirent)(unsafe.Pointer(&buf[n]))
+		*d = fuseDirent{
+			ino:     s.id(path.Join(hd.dir, nm)),
+			off:     i + 1,
+			namelen: uint32(len(nm)),
+			typ:     typ,
+		}
+		z := copy(buf[n+dsz:], nm)
+		for j := n + dsz + z; j < n+sz; j++ {
+			buf[j] = 0
+		}
+		n += sz
+	}
+	return n, 0
+}
+
+// fill in the attributes of node 'id' from 'fi'; everything belongs to
+// the user who mounted the filesystem.
+func (s *fuseServer) attr(a *fuseAttr, id uint64, fi fs.FileInfo) {
+	t := fi.ModTime()
+	mode := uint32(fi.Mode().Perm())
+	nlink := uint32(1)
+	if fi.IsDir() {
+		mode |= syscall.S_IFDIR
+		nlink = 2
+	} else {
+		mode |= syscall.S_IFREG
+	}
+
+	*a = fuseAttr{
+		ino:       id,
+		size:      uint64(fi.Size()),
+		blocks:    uint64(fi.Size()+511) / 512,
+		atime:     uint64(t.Unix()),
+		mtime:     uint64(t.Unix()),
+		ctime:     uint64(t.Unix()),
+		atimensec: uint32(t.Nanosecond()),
+		mtimensec: uint32(t.Nanosecond()),
+		ctimensec: uint32(t.Nanosecond()),
+		mode:      mode,
+		nlink:     nlink,
+		uid:       s.uid,
+		gid:       s.gid,
+		blksize:   4096,
+	}
+}
+
+// return the node id of the name 'nm'
+func (s *fuseServer) id(nm string) uint64 {
+	if id, ok := s.ids[nm]; ok {
+		return id
+	}
+
+	id := uint64(len(s.paths))
+	s.ids[nm] = id
+	s.paths = append(s.paths, nm)
+	return id
+}
+
+// return the name of node 'id'
+func (s *fuseServer) path(id uint64) (string, syscall.Errno) {
+	if id == 0 || id >= uint64(len(s.paths)) {
+		return "", syscall.ENOENT
+	}
+	return s.paths[id], 0
+}
+
+// the argument of the reply
+func (s *fuseServer) outArg() unsafe.Pointer {
+	return unsafe.Pointer(&s.out[unsafe.Sizeof(fuseOutHeader{})])
+}
+
+// send the reply with 'n' bytes of argument (none on error)
+func (s *fuseServer) reply(unique uint64, n int, errno syscall.Errno) {
+	if errno != 0 {
+		n = 0
+	}
+
+	hsz := int(unsafe.Sizeof(fuseOutHeader{}))
+	h := (*fuseOutHeader)(unsafe.Pointer(&s.out[0]))
+	*h = fuseOutHeader{
+		len:    uint32(hsz + n),
+		error:  -int32(errno),
+		unique: unique,
+	}
+
+	// ENOENT: the request was interrupted
+	if _, err := syscall.Write(s.fd, s.out[:hsz+n]); err != nil && err != syscall.ENOENT {
+		warn("mount: write /dev/fuse: %s", err)
+	}
+}
+
+// the errno of an fs error
+func fuseErrno(err error) syscall.Errno {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	}
+	return syscall.EIO
+}
+
+// the NUL terminated string at the start of 'b'
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// mount a FUSE filesystem at 'mnt' and return the /dev/fuse descriptor
+// and a function that unmounts it.
+func fuseMount(src, mnt string) (int, func() error, error) {
+	st, err := os.Stat(mnt)
+	if err != nil {
+		return -1, nil, err
+	}
+	if !st.IsDir() {
+		return -1, nil, fmt.Errorf("not a directory")
+	}
+
+	// the options are separated by commas
+	fsname := strings.Replace(filepath.Base(src), ",", "_", -1)
+
+	if os.Geteuid() == 0 {
+		fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, nil, err
+		}
+
+		opt := fmt.Sprintf("fd=%d,rootmode=%o,user_id=0,group_id=0,default_permissions", fd, syscall.S_IFDIR)
+		err = syscall.Mount(fsname, mnt, "fuse.sigtool", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, opt)
+		if err != nil {
+			syscall.Close(fd)
+			return -1, nil, err
+		}
+
+		unmount := func() error {
+			return syscall.Unmount(mnt, syscall.MNT_DETACH)
+		}
+		return fd, unmount, nil
+	}
+
+	return fusermount(fsname, mnt)
+}
+
+// mount with the fusermount helper; it sends the /dev/fuse descriptor
+// over the socket named by _FUSE_COMMFD.
+func fusermount(fsname, mnt string) (int, func() error, error) {
+	prog, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if prog, err = exec.LookPath("fusermount"); err != nil {
+			return -1, nil, fmt.Errorf("can't find fusermount3 or fusermount (is FUSE installed?)")
+		}
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	ours := os.NewFile(uintptr(fds[0]), "fusermount")
+	theirs := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer ours.Close()
+
+	opt := fmt.Sprintf("ro,nosuid,nodev,default_permissions,fsname=%s,subtype=sigtool", fsname)
+	cmd := exec.Command(prog, "-o", opt, "--", mnt)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	theirs.Close()
+	if err != nil {
+		return -1, nil, fmt.Errorf("%s: %s", prog, err)
+	}
+
+	var b [4]byte
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(fds[0], b[:], oob, 0)
+	if err != nil {
+		return -1, nil, fmt.Errorf("%s: %s", prog, err)
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return -1, nil, fmt.Errorf("%s didn't send the /dev/fuse descriptor", prog)
+	}
+
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) != 1 {
+		return -1, nil, fmt.Errorf("%s didn't send the /dev/fuse descriptor", prog)
+	}
+
+	unmount := func() error {
+		return exec.Command(prog, "-u", "-z", "--", mnt).Run()
+	}
+	return rights[0], unmount, nil
+}
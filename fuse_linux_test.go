@@ -0,0 +1,265 @@
+// fuse_linux_test.go -- tests for the request handlers of 'mount'
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// a fuseServer for an encrypted archive that never talks to the kernel
+func newTestFuse(t *testing.T, data map[string][]byte) *fuseServer {
+	assert := newAsserter(t)
+
+	files := []sign.ArchiveFile{
+		{ArchiveMember: sign.ArchiveMember{Name: "dir", Mode: uint32(os.ModeDir | 0750), ModTime: 1000}},
+	}
+
+	names := make([]string, 0, len(data))
+	for nm := range data {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	for _, nm := range names {
+		b := data[nm]
+		files = append(files, sign.ArchiveFile{
+			ArchiveMember: sign.ArchiveMember{
+				Name:    nm,
+				Size:    int64(len(b)),
+				Mode:    0640,
+				ModTime: 2000,
+			},
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			},
+		})
+	}
+
+	d, b := encryptArchive(t, files)
+	efs, err := d.NewFS(bytes.NewReader(b), int64(len(b)), "test")
+	assert(err == nil, "archive fs: %s", err)
+
+	return &fuseServer{
+		fsys:    efs,
+		fd:      -1,
+		ids:     map[string]uint64{".": _FuseRootID},
+		paths:   []string{"", "."},
+		handles: make(map[uint64]*fuseHandle),
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		in:      make([]byte, _FuseBufSize),
+		out:     make([]byte, _FuseBufSize),
+	}
+}
+
+// the body of an OPEN request
+func fuseOpenReq(flags uint32) []byte {
+	b := make([]byte, unsafe.Sizeof(fuseOpenIn{}))
+	*(*fuseOpenIn)(unsafe.Pointer(&b[0])) = fuseOpenIn{flags: flags}
+	return b
+}
+
+// the body of a READ or READDIR request
+func fuseReadReq(fh, off uint64, size uint32) []byte {
+	b := make([]byte, unsafe.Sizeof(fuseReadIn{}))
+	*(*fuseReadIn)(unsafe.Pointer(&b[0])) = fuseReadIn{fh: fh, offset: off, size: size}
+	return b
+}
+
+// look 'name' up in 'parent' and return its node
+func fuseLookup(t *testing.T, s *fuseServer, parent uint64, name string) *fuseEntryOut {
+	n, errno := s.lookup(parent, name)
+	if errno != 0 {
+		t.Fatalf("lookup %s: %s", name, errno)
+	}
+	if n != int(unsafe.Sizeof(fuseEntryOut{})) {
+		t.Fatalf("lookup %s: reply of %d bytes", name, n)
+	}
+	o := *(*fuseEntryOut)(s.outArg())
+	return &o
+}
+
+// open node 'id' and return its handle
+func fuseOpen(t *testing.T, s *fuseServer, id uint64, dir bool) uint64 {
+	_, errno := s.open(id, fuseOpenReq(syscall.O_RDONLY), dir)
+	if errno != 0 {
+		t.Fatalf("open %d: %s", id, errno)
+	}
+	return (*fuseOpenOut)(s.outArg()).fh
+}
+
+func TestFuseLookup(t *testing.T) {
+	assert := newAsserter(t)
+
+	s := newTestFuse(t, map[string][]byte{
+		"dir/a.txt": []byte("hello, world\n"),
+	})
+
+	e := fuseLookup(t, s, _FuseRootID, "dir")
+	assert(e.attr.mode == syscall.S_IFDIR|0750, "dir mode %o", e.attr.mode)
+	assert(e.attr.nlink == 2, "dir nlink %d", e.attr.nlink)
+	dir := e.nodeid
+
+	e = fuseLookup(t, s, dir, "a.txt")
+	assert(e.nodeid != dir && e.attr.ino == e.nodeid, "file node %d, ino %d", e.nodeid, e.attr.ino)
+	assert(e.attr.size == 13, "file size %d", e.attr.size)
+	assert(e.attr.mode == syscall.S_IFREG|0640, "file mode %o", e.attr.mode)
+	assert(e.attr.mtime == 2000, "file mtime %d", e.attr.mtime)
+	assert(e.attr.uid == s.uid && e.attr.gid == s.gid, "file owner %d:%d", e.attr.uid, e.attr.gid)
+
+	// the same name is the same node
+	f := fuseLookup(t, s, dir, "a.txt")
+	assert(f.nodeid == e.nodeid, "second lookup: node %d, exp %d", f.nodeid, e.nodeid)
+
+	n, errno := s.getattr(e.nodeid)
+	assert(errno == 0, "getattr: %s", errno)
+	assert(n == int(unsafe.Sizeof(fuseAttrOut{})), "getattr: reply of %d bytes", n)
+	a := (*fuseAttrOut)(s.outArg())
+	assert(a.attr.size == 13 && a.attr.ino == e.nodeid, "getattr: size %d, ino %d", a.attr.size, a.attr.ino)
+
+	_, errno = s.lookup(dir, "b.txt")
+	assert(errno == syscall.ENOENT, "lookup of a missing name: %s", errno)
+
+	_, errno = s.lookup(1000, "a.txt")
+	assert(errno == syscall.ENOENT, "lookup in an unknown node: %s", errno)
+
+	_, errno = s.getattr(1000)
+	assert(errno == syscall.ENOENT, "getattr of an unknown node: %s", errno)
+}
+
+func TestFuseRead(t *testing.T) {
+	assert := newAsserter(t)
+
+	big := make([]byte, 3*_FuseMaxWrite+17)
+	_, err := io.ReadFull(rand.Reader, big)
+	assert(err == nil, "rand: %s", err)
+
+	s := newTestFuse(t, map[string][]byte{
+		"dir/a.txt": []byte("hello, world\n"),
+		"dir/big":   big,
+	})
+
+	dir := fuseLookup(t, s, _FuseRootID, "dir").nodeid
+	id := fuseLookup(t, s, dir, "big").nodeid
+	fh := fuseOpen(t, s, id, false)
+
+	// read the file in pieces that don't line up with the chunks
+	hsz := unsafe.Sizeof(fuseOutHeader{})
+	var got []byte
+	for off := 0; ; {
+		n, errno := s.read(fuseReadReq(fh, uint64(off), 10000))
+		assert(errno == 0, "read at %d: %s", off, errno)
+		if n == 0 {
+			break
+		}
+		got = append(got, s.out[hsz:int(hsz)+n]...)
+		off += n
+	}
+	assert(bytes.Equal(got, big), "read: content mismatch; got %d bytes, exp %d", len(got), len(big))
+
+	// a read past the end is empty
+	n, errno := s.read(fuseReadReq(fh, uint64(len(big)+100), 4096))
+	assert(errno == 0 && n == 0, "read past EOF: %d bytes, %s", n, errno)
+
+	_, errno = s.read(fuseReadReq(fh+100, 0, 4096))
+	assert(errno == syscall.EBADF, "read of an unknown handle: %s", errno)
+
+	// the filesystem is read-only
+	_, errno = s.open(id, fuseOpenReq(syscall.O_WRONLY), false)
+	assert(errno == syscall.EROFS, "open for write: %s", errno)
+
+	// release forgets the handle and replies through the fd
+	pr, pw, err := os.Pipe()
+	assert(err == nil, "pipe: %s", err)
+	defer pr.Close()
+	defer pw.Close()
+	s.fd = int(pw.Fd())
+
+	r := make([]byte, unsafe.Sizeof(fuseReleaseIn{}))
+	*(*fuseReleaseIn)(unsafe.Pointer(&r[0])) = fuseReleaseIn{fh: fh}
+	s.handle(&fuseInHeader{opcode: _FuseRelease, unique: 42, nodeid: id}, r)
+	_, ok := s.handles[fh]
+	assert(!ok, "release: handle %d still open", fh)
+
+	rep := make([]byte, hsz)
+	_, err = io.ReadFull(pr, rep)
+	assert(err == nil, "release: reply: %s", err)
+	oh := (*fuseOutHeader)(unsafe.Pointer(&rep[0]))
+	assert(oh.unique == 42 && oh.error == 0 && oh.len == uint32(hsz), "release: reply %+v", *oh)
+}
+
+func TestFuseReaddir(t *testing.T) {
+	assert := newAsserter(t)
+
+	data := map[string][]byte{
+		"dir/a.txt": []byte("a"),
+		"dir/b.txt": []byte("bb"),
+		"dir/c":     []byte("ccc"),
+	}
+	s := newTestFuse(t, data)
+
+	dir := fuseLookup(t, s, _FuseRootID, "dir").nodeid
+	fh := fuseOpen(t, s, dir, true)
+
+	// a buffer of one entry at a time makes readdir resume at the offset
+	hsz := int(unsafe.Sizeof(fuseOutHeader{}))
+	dsz := int(unsafe.Sizeof(fuseDirent{}))
+	var names []string
+	var off uint64
+	for {
+		n, errno := s.readdir(fuseReadReq(fh, off, 40))
+		assert(errno == 0, "readdir at %d: %s", off, errno)
+		if n == 0 {
+			break
+		}
+		assert(n%8 == 0, "readdir: reply of %d bytes isn't aligned", n)
+
+		// lookup below reuses the reply buffer
+		for b := append([]byte(nil), s.out[hsz:hsz+n]...); len(b) > 0; {
+			d := (*fuseDirent)(unsafe.Pointer(&b[0]))
+			nm := string(b[dsz : dsz+int(d.namelen)])
+			assert(d.typ == syscall.DT_REG, "%s: type %d", nm, d.typ)
+			assert(d.ino == fuseLookup(t, s, dir, nm).nodeid, "%s: ino %d doesn't match lookup", nm, d.ino)
+			names = append(names, nm)
+			off = d.off
+			b = b[(dsz+int(d.namelen)+7)&^7:]
+		}
+	}
+
+	exp := []string{"a.txt", "b.txt", "c"}
+	assert(len(names) == len(exp), "readdir: saw %v, exp %v", names, exp)
+	for i := range exp {
+		assert(names[i] == exp[i], "readdir: saw %v, exp %v", names, exp)
+	}
+
+	// a directory handle can't be read and a file handle can't be listed
+	_, errno := s.read(fuseReadReq(fh, 0, 4096))
+	assert(errno == syscall.EBADF, "read of a directory: %s", errno)
+
+	id := fuseLookup(t, s, dir, "c").nodeid
+	_, errno = s.readdir(fuseReadReq(fuseOpen(t, s, id, false), 0, 4096))
+	assert(errno == syscall.EBADF, "readdir of a file: %s", errno)
+}
@@ -0,0 +1,27 @@
+// fuse_other.go -- mount where there's no FUSE server
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// serveFUSE needs the Linux FUSE protocol
+func serveFUSE(fsys fs.FS, src, mnt string) error {
+	return fmt.Errorf("mount: not supported on this platform; it needs Linux and FUSE")
+}
@@ -0,0 +1,97 @@
+// genbatch.go -- generate many keypairs at once
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// generate 'count' keypairs in 'outdir' and write their manifest
+func genBatch(count int, outdir, prefix, format string, ku sign.KeyUsage, exp time.Time, comment string, force bool, getpw func() ([]byte, error)) {
+	if count < 1 {
+		die("generate: --count must be at least 1")
+	}
+	if len(outdir) == 0 {
+		die("generate: --count needs an output directory (--out-dir)")
+	}
+
+	var write func(*os.File, []sign.ManifestEntry) error
+	switch format {
+	case "csv":
+		write = func(fd *os.File, m []sign.ManifestEntry) error { return sign.WriteManifestCSV(fd, m) }
+	case "json":
+		write = func(fd *os.File, m []sign.ManifestEntry) error { return sign.WriteManifestJSON(fd, m) }
+	default:
+		die("generate: unknown manifest format %q", format)
+	}
+
+	if err := os.MkdirAll(outdir, 0700); err != nil {
+		die("%s", err)
+	}
+
+	mf := path.Join(outdir, "manifest."+format)
+	if !force {
+		if _, err := os.Stat(mf); err == nil {
+			die("%s exists. Won't overwrite!", mf)
+		}
+		for i := 1; i <= count; i++ {
+			bn := path.Join(outdir, fmt.Sprintf("%s-%0*d", prefix, len(fmt.Sprint(count)), i))
+			if exists(bn) {
+				die("Public/Private key files (%s.key, %s.pub) exist. Won't overwrite!", bn, bn)
+			}
+		}
+	}
+
+	// ask for the passphrase just once
+	var pw []byte
+	var pwerr error
+	var asked bool
+	once := func() ([]byte, error) {
+		if !asked {
+			pw, pwerr = getpw()
+			asked = true
+		}
+		return pw, pwerr
+	}
+
+	if _, err := once(); err != nil {
+		die("%s", err)
+	}
+
+	m, err := sign.GenerateKeypairs(outdir, prefix, count, ku, exp, comment, once)
+	for _, e := range m {
+		bn := path.Join(outdir, e.Name)
+		audit("generate", nil, bn+".key", "", bn+".pub", nil)
+	}
+	if err != nil {
+		audit("generate", nil, outdir, "", "", err)
+		die("%s", err)
+	}
+
+	fd, err := os.OpenFile(mf, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		die("%s", err)
+	}
+	if err = write(fd, m); err == nil {
+		err = fd.Close()
+	}
+	if err != nil {
+		die("%s: %s", mf, err)
+	}
+}
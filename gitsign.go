@@ -0,0 +1,256 @@
+// gitsign.go -- git signing helper
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// git signs commits and tags with SSH keys by running 'gpg.ssh.program'
+// (ssh-keygen by default) with the arguments below:
+//
+//    -Y sign -n NS -f KEY [-U] FILE..
+//    -Y check-novalidate -n NS -s SIG              < message
+//    -Y find-principals -f ALLOWED -s SIG [-O verify-time=T]
+//    -Y verify -n NS -f ALLOWED -I PRINCIPAL -s SIG [-O verify-time=T] < message
+//
+// 'sigtool git-sign' implements this subset of ssh-keygen(1) using
+// sigtool or OpenSSH Ed25519 keys. Since git doesn't allow arguments in
+// 'gpg.ssh.program', sigtool behaves as 'sigtool git-sign' when invoked
+// via a link named 'sigtool-git-sign'.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// name of the link that invokes git-sign directly
+const gitSignLink = "sigtool-git-sign"
+
+func gitSign(args []string) {
+	var help, agent, quiet, pubkey bool
+	var op, ns, keyfile, principal, sigfile string
+	var opts stringList
+
+	fs := flag.NewFlagSet("git-sign", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&op, "op", "Y", "", "Operation `OP`: sign, check-novalidate, find-principals, verify")
+	fs.StringVarP(&ns, "namespace", "n", "", "Signature namespace `NS`")
+	fs.StringVarP(&keyfile, "file", "f", "", "Private key or allowed signers file `F`")
+	fs.StringVarP(&principal, "principal", "I", "", "Signer identity `P`")
+	fs.StringVarP(&sigfile, "signature", "s", "", "Signature file `S`")
+	fs.VarP(&opts, "option", "O", "Option `O` (e.g., verify-time=YYYYMMDDHHMMSS)")
+	fs.BoolVarP(&agent, "agent", "U", false, "Use the key agent (not supported)")
+	fs.BoolVarP(&quiet, "quiet", "q", false, "Be quiet")
+	fs.BoolVarP(&pubkey, "pubkey", "y", false, "Print the public key of F in OpenSSH format (for allowed_signers)")
+
+	fs.Parse(args)
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s git-sign -Y op [options] [file..]
+
+Sign and verify git commits and tags with Ed25519 keys. This implements the
+subset of 'ssh-keygen -Y' that git uses for SSH signatures; configure git
+with:
+
+    ln -s $(which %s) ~/bin/%s
+    git config gpg.format ssh
+    git config gpg.ssh.program %s
+    git config user.signingkey /path/to/key
+
+Verifying signatures needs an allowed signers file ('gpg.ssh.allowedSignersFile');
+'%s git-sign -y -f KEY.pub' prints the public key in the format it expects.
+
+Options:
+`, Z, Z, gitSignLink, gitSignLink, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if pubkey {
+		pk, err := sign.ReadPublicKey(keyfile)
+		if err != nil {
+			die("%s", err)
+		}
+		fmt.Println(pk.SSHAuthorizedKey())
+		return
+	}
+
+	vtime := time.Now()
+	for _, o := range opts {
+		if strings.HasPrefix(o, "verify-time=") {
+			t, err := sign.ParseSSHTime(strings.TrimPrefix(o, "verify-time="))
+			if err != nil {
+				die("%s", err)
+			}
+			vtime = t
+		}
+	}
+
+	switch op {
+	case "sign":
+		if agent {
+			die("git-sign: signing via the key agent is not supported")
+		}
+		gitSignFiles(keyfile, ns, fs.Args())
+
+	case "check-novalidate":
+		sig := readSSHSig(sigfile)
+		if err := sig.Verify(os.Stdin, ns); err != nil {
+			die("%s", err)
+		}
+		fmt.Printf("Good %q signature with ED25519 key %s\n", ns, sig.PublicKey.SSHFingerprint())
+
+	case "find-principals":
+		sig := readSSHSig(sigfile)
+		as := readAllowed(keyfile)
+		p := sign.FindPrincipals(as, sig.PublicKey, vtime)
+		if len(p) == 0 {
+			die("No principal matched.")
+		}
+		for _, s := range p {
+			fmt.Println(s)
+		}
+
+	case "verify":
+		sig := readSSHSig(sigfile)
+		as := readAllowed(keyfile)
+		if len(principal) == 0 {
+			die("git-sign: missing signer identity (-I)")
+		}
+
+		var ok bool
+		for _, a := range as {
+			if a.Allows(sig.PublicKey, principal, ns, vtime) {
+				ok = true
+				break
+			}
+		}
+
+		fp := sig.PublicKey.SSHFingerprint()
+		if !ok {
+			die("Signature verification failed: key %s is not an allowed signer for %q", fp, principal)
+		}
+
+		if err := sig.Verify(os.Stdin, ns); err != nil {
+			die("Signature verification failed: %s", err)
+		}
+		fmt.Printf("Good %q signature for %s with ED25519 key %s\n", ns, principal, fp)
+
+	case "":
+		die("git-sign: missing operation (-Y). Try '%s git-sign -h' ..", Z)
+
+	default:
+		die("git-sign: unsupported operation %q", op)
+	}
+}
+
+// sign each file in 'files' and write the signature to FILE.sig
+func gitSignFiles(keyfile, ns string, files []string) {
+	if len(keyfile) == 0 || len(ns) == 0 {
+		die("git-sign: sign needs a key (-f) and a namespace (-n)")
+	}
+
+	if len(files) == 0 {
+		die("git-sign: no files to sign")
+	}
+
+	kn := gitPrivateKeyFile(keyfile)
+	sk, err := gitReadPrivateKey(kn)
+	if err != nil {
+		audit("git-sign", nil, kn, files[0], "", err)
+		die("%s", err)
+	}
+
+	for _, fn := range files {
+		outf := fn + ".sig"
+
+		var sig []byte
+		var fd *os.File
+
+		fd, err = os.Open(fn)
+		if err == nil {
+			sig, err = sk.SSHSign(fd, ns)
+			fd.Close()
+		}
+		if err == nil {
+			err = ioutil.WriteFile(outf, sig, 0644)
+		}
+
+		audit("git-sign", sk, kn, fn, outf, err)
+		if err != nil {
+			die("%s", err)
+		}
+	}
+}
+
+// git's user.signingkey may be the public key; find its private key
+func gitPrivateKeyFile(fn string) string {
+	if !strings.HasSuffix(fn, ".pub") {
+		return fn
+	}
+
+	bn := strings.TrimSuffix(fn, ".pub")
+	for _, kn := range []string{bn + ".key", bn} {
+		if st, err := os.Stat(kn); err == nil && st.Mode().IsRegular() {
+			return kn
+		}
+	}
+	die("git-sign: can't find the private key for %s", fn)
+	return ""
+}
+
+// read a private key without a passphrase; if that fails ask for one.
+func gitReadPrivateKey(fn string) (*sign.PrivateKey, error) {
+	sk, err := sign.ReadPrivateKey(fn, askpassFunc(true, "", "", false))
+	if err == nil {
+		return sk, nil
+	}
+
+	prompt := fmt.Sprintf("Enter passphrase for %s", fn)
+	return sign.ReadPrivateKey(fn, askpassFunc(false, "", prompt, false))
+}
+
+func readSSHSig(fn string) *sign.SSHSignature {
+	if len(fn) == 0 {
+		die("git-sign: missing signature file (-s)")
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	sig, err := sign.ParseSSHSignature(bytes.TrimSpace(b))
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+	return sig
+}
+
+func readAllowed(fn string) []*sign.AllowedSigner {
+	if len(fn) == 0 {
+		die("git-sign: missing allowed signers file (-f)")
+	}
+
+	as, err := sign.ReadAllowedSigners(fn)
+	if err != nil {
+		die("%s", err)
+	}
+	return as
+}
@@ -4,9 +4,11 @@ go 1.13
 
 require (
 	github.com/dchest/bcrypt_pbkdf v0.0.0-20150205184540-83f37f9c154a
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/gogo/protobuf v1.3.1
 	github.com/opencoff/go-utils v0.4.1
 	github.com/opencoff/pflag v0.5.0
 	golang.org/x/crypto v0.0.0-20200109152110-61a87790db17
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 	gopkg.in/yaml.v2 v2.2.7
 )
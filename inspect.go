@@ -0,0 +1,259 @@
+// inspect.go -- show the metadata of sigtool files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+	"unicode"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'inspect' command
+func inspect(args []string) {
+	var help, nopw bool
+	var keyfile, envpw string
+
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&keyfile, "key", "k", "", "Unwrap the file key with private key `K` to show if the sender signed it")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s inspect: Show the metadata of encrypted files and signatures.
+
+Usage: %s inspect [options] file [file..]
+
+FILE is an encrypted file, a signature, a clear signed text or a file with
+an embedded signature. Nothing is decrypted or verified.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s inspect --help'", Z)
+	}
+
+	var sk *sign.PrivateKey
+	if len(keyfile) > 0 {
+		prompt := fmt.Sprintf("Enter passphrase for %s", keyfile)
+		sk, err = sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, prompt, false))
+		if err != nil {
+			die("%s", err)
+		}
+	}
+
+	for i, fn := range args {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("file:          %s\n", fn)
+		if err := inspectFile(fn, sk); err != nil {
+			die("%s: %s", fn, err)
+		}
+	}
+}
+
+func inspectFile(fn string, sk *sign.PrivateKey) error {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var magic [7]byte
+	n, _ := fd.Read(magic[:])
+	if string(magic[:n]) == "SigTool" {
+		return inspectEncrypted(fd, sk)
+	}
+
+	// everything else is small enough to read in full; embedded
+	// signatures are read from the end of the file.
+	if e, err := sign.OpenEmbedded(fn); err == nil {
+		fmt.Printf("type:          embedded signature\n")
+		fmt.Printf("content:       %d bytes\n", e.Size)
+		printSigs(e.Sigs)
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	b = bytes.TrimSpace(b)
+	switch {
+	case bytes.HasPrefix(b, []byte("-----BEGIN SSH SIGNATURE-----")):
+		s, err := sign.ParseSSHSignature(b)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("type:          OpenSSH signature\n")
+		fmt.Printf("namespace:     %s\n", s.Namespace)
+		fmt.Printf("hash:          %s\n", s.HashAlgo)
+		fmt.Printf("key:           %s\n", s.PublicKey.SSHFingerprint())
+
+	case bytes.HasPrefix(b, []byte("-----BEGIN SIGTOOL SIGNED MESSAGE-----")):
+		c, err := sign.ParseClearSigned(b)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("type:          clear signed text\n")
+		fmt.Printf("content:       %d bytes\n", len(c.Text))
+		printSigs(c.Sigs)
+
+	default:
+		sigs, err := sign.MakeSignatures(b)
+		if err != nil {
+			return fmt.Errorf("not a sigtool file")
+		}
+		fmt.Printf("type:          signature\n")
+		printSigs(sigs)
+	}
+	return nil
+}
+
+func inspectEncrypted(fd *os.File, sk *sign.PrivateKey) error {
+	if _, err := fd.Seek(0, 0); err != nil {
+		return err
+	}
+
+	h, err := sign.ParseHeader(fd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("type:          encrypted file\n")
+	fmt.Printf("version:       %d\n", h.Version)
+	fmt.Printf("cipher:        %s\n", h.Cipher)
+	fmt.Printf("chunk size:    %d\n", h.ChunkSize)
+	fmt.Printf("chunking:      %s\n", h.Chunking)
+	fmt.Printf("header size:   %d\n", h.Size)
+
+	// the size of content defined chunks is only known by decrypting them
+	if st, err := fd.Stat(); err == nil && st.Mode().IsRegular() && h.Chunking == "fixed" {
+		sz, err := h.DecryptedSize(st.Size())
+		if err != nil {
+			return err
+		}
+
+		blk := int64(h.ChunkSize)
+		nchunks := sz / blk
+		if nchunks == 0 || sz%blk != 0 {
+			nchunks++
+		}
+		fmt.Printf("plaintext:     %d bytes\n", sz)
+		fmt.Printf("chunks:        %d\n", nchunks)
+	}
+
+	fmt.Printf("recipients:    %d\n", len(h.Recipients))
+	for i, w := range h.Recipients {
+		var escrow string
+		if len(w.Escrow) > 0 {
+			escrow = fmt.Sprintf(" (escrow %s)", w.Escrow)
+		}
+
+		switch {
+		case len(w.Type) == 0 && len(w.Args) > 0:
+			fmt.Printf("  [%d] x25519 (hint)%s\n", i, escrow)
+		case len(w.Type) == 0:
+			fmt.Printf("  [%d] x25519%s\n", i, escrow)
+		case len(w.Args) > 0:
+			fmt.Printf("  [%d] %s %s%s\n", i, w.Type, hint(w.Args), escrow)
+		default:
+			fmt.Printf("  [%d] %s%s\n", i, w.Type, escrow)
+		}
+	}
+
+	if len(h.Rewrapped) > 0 {
+		fmt.Printf("rewrapped:     %d\n", len(h.Rewrapped))
+		for i, xpk := range h.Rewrapped {
+			fmt.Printf("  [%d] x25519 %s\n", i, base64.StdEncoding.EncodeToString(xpk))
+		}
+	}
+
+	sender := "unknown (use -k to unwrap the file key)"
+	if sk != nil {
+		if _, err := fd.Seek(0, 0); err != nil {
+			return err
+		}
+
+		d, err := sign.NewDecryptor(fd)
+		if err != nil {
+			return err
+		}
+
+		if err := d.SetPrivateKey(sk, nil); err != nil {
+			return err
+		}
+
+		sender = "not signed"
+		if d.AuthenticatedSender() {
+			sender = "signed"
+		}
+	}
+	fmt.Printf("sender:        %s\n", sender)
+	return nil
+}
+
+func printSigs(sigs []*sign.Signature) {
+	fmt.Printf("signatures:    %d\n", len(sigs))
+	for i, sig := range sigs {
+		fmt.Printf("  [%d] pkhash %x\n", i, sig.PKHash())
+		if sig.PublicKey != nil {
+			fmt.Printf("      key %s\n", sig.PublicKey.Fingerprint())
+		}
+		if len(sig.Comment) > 0 {
+			fmt.Printf("      comment %q (untrusted)\n", sig.Comment)
+		}
+
+		a := sig.Attrs
+		if a == nil {
+			continue
+		}
+
+		fmt.Printf("      signed at %s\n", a.Time.Local().Format(time.RFC1123))
+		fmt.Printf("      file %s, %d bytes, %s\n", a.Filename, a.Size, a.HashAlgo)
+		if len(a.Comment) > 0 {
+			fmt.Printf("      signed comment %q\n", a.Comment)
+		}
+	}
+}
+
+// print a recipient hint as text if it is printable
+func hint(b []byte) string {
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return fmt.Sprintf("%x", b)
+		}
+	}
+	return fmt.Sprintf("%q", b)
+}
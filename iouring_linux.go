@@ -0,0 +1,484 @@
+// iouring_linux.go -- io_uring read-ahead and write-behind for files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux && iouring
+// +build linux,iouring
+
+// With the 'iouring' build tag, encrypt and decrypt keep several reads of
+// the input file and writes of the output file in flight with io_uring
+// while they encrypt or decrypt the current chunk. Kernels without
+// io_uring (or older than 5.6) fall back to plain reads and writes.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_SysIoUringSetup = 425
+	_SysIoUringEnter = 426
+
+	_IoRingOffSqRing = 0
+	_IoRingOffCqRing = 0x8000000
+	_IoRingOffSqes   = 0x10000000
+
+	_IoRingEnterGetEvents = 1
+	_IoRingFeatRwCurPos   = 1 << 3
+
+	_IoRingOpRead  = 22
+	_IoRingOpWrite = 23
+
+	// requests in flight and the size of each
+	_RingDepth   = 4
+	_RingBufSize = 1048576
+)
+
+// struct io_uring_params
+type ringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+
+	sqOff struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+// struct io_uring_sqe
+type ringSqe struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	pad      [3]uint64
+}
+
+// struct io_uring_cqe
+type ringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// an io_uring with its submission and completion queues
+type ring struct {
+	fd int
+
+	sqMem, cqMem, sqeMem []byte
+
+	sqTail, sqMask *uint32
+	sqArray        *[_RingDepth * 2]uint32
+	sqes           *[_RingDepth * 2]ringSqe
+
+	cqHead, cqTail, cqMask *uint32
+	cqes                   unsafe.Pointer
+}
+
+func newRing() (*ring, error) {
+	var p ringParams
+
+	fd, _, e := syscall.Syscall(_SysIoUringSetup, _RingDepth*2, uintptr(unsafe.Pointer(&p)), 0)
+	if e != 0 {
+		return nil, fmt.Errorf("io_uring: %s", e)
+	}
+
+	r := &ring{fd: int(fd)}
+	if p.features&_IoRingFeatRwCurPos == 0 || p.sqEntries != _RingDepth*2 {
+		r.close()
+		return nil, fmt.Errorf("io_uring: kernel too old")
+	}
+
+	var err error
+	mmap := func(off int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+
+		var b []byte
+		b, err = syscall.Mmap(r.fd, off, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+		return b
+	}
+
+	r.sqMem = mmap(_IoRingOffSqRing, p.sqOff.array+p.sqEntries*4)
+	r.cqMem = mmap(_IoRingOffCqRing, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(ringCqe{})))
+	r.sqeMem = mmap(_IoRingOffSqes, p.sqEntries*uint32(unsafe.Sizeof(ringSqe{})))
+	if err != nil {
+		r.close()
+		return nil, fmt.Errorf("io_uring: %s", err)
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.ringMask]))
+	r.sqArray = (*[_RingDepth * 2]uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.array]))
+	r.sqes = (*[_RingDepth * 2]ringSqe)(unsafe.Pointer(&r.sqeMem[0]))
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.ringMask]))
+	r.cqes = unsafe.Pointer(&r.cqMem[p.cqOff.cqes])
+	return r, nil
+}
+
+// submit a read or write of 'buf' at offset 'off' of 'fd'
+func (r *ring) submit(op uint8, fd *os.File, buf []byte, off int64, data uint64) error {
+	tail := atomic.LoadUint32(r.sqTail)
+	i := tail & *r.sqMask
+
+	r.sqes[i] = ringSqe{
+		opcode:   op,
+		fd:       int32(fd.Fd()),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: data,
+	}
+	r.sqArray[i] = i
+	atomic.StoreUint32(r.sqTail, tail+1)
+
+	return r.enter(1, 0, 0)
+}
+
+// wait for the next completion
+func (r *ring) wait() (uint64, int32, error) {
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		if head != atomic.LoadUint32(r.cqTail) {
+			c := (*ringCqe)(unsafe.Pointer(uintptr(r.cqes) + uintptr(head&*r.cqMask)*unsafe.Sizeof(ringCqe{})))
+			data, res := c.userData, c.res
+			atomic.StoreUint32(r.cqHead, head+1)
+			return data, res, nil
+		}
+
+		if err := r.enter(0, 1, _IoRingEnterGetEvents); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+func (r *ring) enter(submit, complete, flags uintptr) error {
+	for {
+		_, _, e := syscall.Syscall6(_SysIoUringEnter, uintptr(r.fd), submit, complete, flags, 0, 0)
+		switch e {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		}
+		return fmt.Errorf("io_uring: %s", e)
+	}
+}
+
+func (r *ring) close() {
+	for _, b := range [][]byte{r.sqMem, r.cqMem, r.sqeMem} {
+		if b != nil {
+			syscall.Munmap(b)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// a buffer of a request
+type ringSlot struct {
+	buf  []byte
+	off  int64
+	n    int
+	busy bool
+	err  error
+}
+
+// ringReader reads a file ahead of its consumer
+type ringReader struct {
+	r     *ring
+	fd    *os.File
+	size  int64
+	off   int64
+	slots [_RingDepth]ringSlot
+
+	// slot being consumed and the position in it
+	cur, pos int
+	err      error
+}
+
+// read the regular file 'fd' with io_uring if the kernel supports it
+func newRingReader(fd *os.File) io.Reader {
+	st, err := fd.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return fd
+	}
+
+	off, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fd
+	}
+
+	r, err := newRing()
+	if err != nil {
+		return fd
+	}
+
+	rr := &ringReader{
+		r:    r,
+		fd:   fd,
+		size: st.Size(),
+		off:  off,
+	}
+
+	for i := range rr.slots {
+		rr.slots[i].buf = make([]byte, _RingBufSize)
+		if err = rr.next(i); err != nil {
+			rr.err = err
+			break
+		}
+	}
+	return rr
+}
+
+// submit the next read of the file in slot 'i'
+func (rr *ringReader) next(i int) error {
+	s := &rr.slots[i]
+	n := rr.size - rr.off
+	if n <= 0 {
+		s.n = 0
+		return nil
+	}
+	if n > int64(len(s.buf)) {
+		n = int64(len(s.buf))
+	}
+
+	s.off, s.n, s.busy = rr.off, int(n), true
+	rr.off += n
+	return rr.r.submit(_IoRingOpRead, rr.fd, s.buf[:n], s.off, uint64(i))
+}
+
+func (rr *ringReader) Read(b []byte) (int, error) {
+	if rr.err != nil {
+		return 0, rr.err
+	}
+
+	s := &rr.slots[rr.cur]
+	for s.busy {
+		if err := rr.reap(); err != nil {
+			rr.err = err
+			return 0, err
+		}
+	}
+
+	if s.err != nil {
+		rr.err = s.err
+		return 0, s.err
+	}
+
+	if s.n == 0 {
+		rr.close()
+		rr.err = io.EOF
+		return 0, io.EOF
+	}
+
+	n := copy(b, s.buf[rr.pos:s.n])
+	rr.pos += n
+	if rr.pos == s.n {
+		if err := rr.next(rr.cur); err != nil {
+			rr.err = err
+			return n, nil
+		}
+		rr.cur = (rr.cur + 1) % _RingDepth
+		rr.pos = 0
+	}
+	return n, nil
+}
+
+// wait for a read to complete; finish short reads synchronously
+func (rr *ringReader) reap() error {
+	i, res, err := rr.r.wait()
+	if err != nil {
+		return err
+	}
+
+	s := &rr.slots[i]
+	s.busy = false
+	switch {
+	case res < 0:
+		s.err = fmt.Errorf("%s: %s", rr.fd.Name(), syscall.Errno(-res))
+	case int(res) < s.n:
+		m, err := rr.fd.ReadAt(s.buf[res:s.n], s.off+int64(res))
+		if err != nil && err != io.EOF {
+			s.err = err
+		}
+		s.n = int(res) + m
+	}
+	return nil
+}
+
+// release the ring after the last read
+func (rr *ringReader) close() {
+	if rr.r != nil {
+		rr.r.close()
+		rr.r = nil
+	}
+}
+
+// ringWriter writes a file behind its producer
+type ringWriter struct {
+	r     *ring
+	fd    *os.File
+	off   int64
+	slots [_RingDepth]ringSlot
+
+	// slot being filled
+	cur int
+	err error
+}
+
+// write the regular file 'fd' with io_uring if the kernel supports it
+func newRingWriter(fd *os.File) io.WriteCloser {
+	st, err := fd.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return fd
+	}
+
+	off, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fd
+	}
+
+	r, err := newRing()
+	if err != nil {
+		return fd
+	}
+
+	w := &ringWriter{
+		r:   r,
+		fd:  fd,
+		off: off,
+	}
+	for i := range w.slots {
+		w.slots[i].buf = make([]byte, _RingBufSize)
+	}
+	return w
+}
+
+func (w *ringWriter) Write(b []byte) (int, error) {
+	var z int
+	for len(b) > 0 {
+		if w.err != nil {
+			return z, w.err
+		}
+
+		s := &w.slots[w.cur]
+		for s.busy {
+			if err := w.reap(); err != nil {
+				w.err = err
+				return z, err
+			}
+		}
+
+		n := copy(s.buf[s.n:], b)
+		s.n += n
+		z += n
+		b = b[n:]
+
+		if s.n == len(s.buf) {
+			w.flush()
+		}
+	}
+	return z, nil
+}
+
+// submit the write of the current slot and move to the next one
+func (w *ringWriter) flush() {
+	s := &w.slots[w.cur]
+	s.off, s.busy = w.off, true
+	w.off += int64(s.n)
+
+	if err := w.r.submit(_IoRingOpWrite, w.fd, s.buf[:s.n], s.off, uint64(w.cur)); err != nil {
+		s.busy = false
+		w.err = err
+		return
+	}
+	w.cur = (w.cur + 1) % _RingDepth
+}
+
+// wait for a write to complete; finish short writes synchronously
+func (w *ringWriter) reap() error {
+	i, res, err := w.r.wait()
+	if err != nil {
+		return err
+	}
+
+	s := &w.slots[i]
+	s.busy = false
+	switch {
+	case res < 0:
+		w.err = fmt.Errorf("%s: %s", w.fd.Name(), syscall.Errno(-res))
+	case int(res) < s.n:
+		if _, err := w.fd.WriteAt(s.buf[res:s.n], s.off+int64(res)); err != nil {
+			w.err = err
+		}
+	}
+	s.n = 0
+	return nil
+}
+
+// write the last partial slot and wait for all writes
+func (w *ringWriter) Close() error {
+	if w.r == nil {
+		return w.err
+	}
+
+	if w.err == nil && w.slots[w.cur].n > 0 {
+		w.flush()
+	}
+
+	for i := range w.slots {
+		for w.slots[i].busy {
+			if err := w.reap(); err != nil {
+				// the kernel may still use the buffers; keep them
+				return err
+			}
+		}
+	}
+
+	w.r.close()
+	w.r = nil
+	if w.err != nil {
+		return w.err
+	}
+
+	// the writes don't move the file offset
+	if _, err := w.fd.Seek(w.off, io.SeekStart); err != nil {
+		return err
+	}
+	return w.fd.Close()
+}
@@ -0,0 +1,45 @@
+// iouring_linux_test.go -- tests for the io_uring reader and writer
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux && iouring
+// +build linux,iouring
+
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestIoUring(t *testing.T) {
+	assert := newAsserter(t)
+
+	r, err := newRing()
+	if err != nil {
+		t.Skipf("no io_uring: %s", err)
+	}
+	r.close()
+
+	fileRoundTrip(t, nil, func(fd *os.File) io.WriteCloser {
+		w := newRingWriter(fd)
+		_, ok := w.(*ringWriter)
+		assert(ok, "writer doesn't use io_uring")
+		return w
+	}, func(fd *os.File) io.Reader {
+		rd := newRingReader(fd)
+		_, ok := rd.(*ringReader)
+		assert(ok, "reader doesn't use io_uring")
+		return rd
+	})
+}
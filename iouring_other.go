@@ -0,0 +1,31 @@
+// iouring_other.go -- builds without io_uring
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux || !iouring
+// +build !linux !iouring
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// files are read and written directly without the 'iouring' build tag
+func newRingReader(fd *os.File) io.Reader {
+	return fd
+}
+
+func newRingWriter(fd *os.File) io.WriteCloser {
+	return fd
+}
@@ -0,0 +1,183 @@
+// key.go -- show keys in other forms
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'key' command
+func key(args []string) {
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s key --help'", Z)
+	}
+
+	switch args[0] {
+	case "qr":
+		keyQR(args[1:])
+	case "compare":
+		keyCompare(args[1:])
+	case "-h", "--help", "help":
+		keyUsage()
+		os.Exit(0)
+	default:
+		die("unknown key command %s. Try '%s key --help'", args[0], Z)
+	}
+}
+
+func keyUsage() {
+	fmt.Printf(`%s key: Show keys in other forms.
+
+Usage: %s key qr [options] pubkey
+       %s key compare [options] their.pub mine.pub
+
+'qr' shows the public key PUBKEY (or with --fingerprint, just its
+fingerprint) as a QR code on the terminal or writes it to a PNG image.
+Scan it with a phone to compare keys between devices; a key in a QR code
+image is read back with '%s import --qr'.
+
+'compare' shows a short authentication string (SAS) derived from both
+keys. After exchanging public keys, each party runs it with the key they
+received and their own key and reads the number to the other, e.g., over
+the phone. The numbers are the same only if neither key was swapped in
+transit. On a terminal, it asks whether the numbers match and fails if
+they don't.
+`, Z, Z, Z, Z)
+}
+
+// show a public key as a QR code
+func keyQR(args []string) {
+	var help, fp bool
+	var outfile string
+	var scale int
+
+	fs := flag.NewFlagSet("key qr", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&fp, "fingerprint", "f", false, "Encode just the fingerprint of the key")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the QR code as a PNG image to `F`")
+	fs.IntVarP(&scale, "scale", "s", 8, "Use `N` pixels per module of the PNG image")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		keyUsage()
+		fmt.Printf("\nOptions:\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s key --help'", Z)
+	}
+
+	pk, err := sign.ReadPublicKey(args[0])
+	if err != nil {
+		die("%s", err)
+	}
+
+	var b []byte
+	if fp {
+		b = []byte(pk.Fingerprint())
+	} else if b, err = pk.Marshal(pk.Comment); err != nil {
+		die("%s", err)
+	}
+
+	q, err := sign.EncodeQR(b)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(outfile) == 0 {
+		fmt.Print(q.ANSI())
+		fmt.Printf("%s %s\n", pk.Fingerprint(), pk.Comment)
+		return
+	}
+
+	writeOutput(outfile, false, func(wr io.Writer) error {
+		return q.WritePNG(wr, scale)
+	})
+}
+
+// show the short authentication string of two public keys
+func keyCompare(args []string) {
+	var help, batch bool
+
+	fs := flag.NewFlagSet("key compare", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&batch, "batch", "b", false, "Only show the SAS; don't ask if it matches")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		keyUsage()
+		fmt.Printf("\nOptions:\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s key --help'", Z)
+	}
+
+	theirs, err := sign.ReadPublicKey(args[0])
+	if err != nil {
+		die("%s", err)
+	}
+
+	mine, err := sign.ReadPublicKey(args[1])
+	if err != nil {
+		die("%s", err)
+	}
+
+	if theirs.MatchPin(mine.Fingerprint()) {
+		die("%s and %s are the same key", args[0], args[1])
+	}
+
+	sas := sign.SAS(theirs, mine)
+	if batch || !isTerminal(os.Stdin) {
+		fmt.Println(sas)
+		return
+	}
+
+	fmt.Printf("theirs: %s %s\n", theirs.Fingerprint(), theirs.Comment)
+	fmt.Printf("mine:   %s %s\n\n", mine.Fingerprint(), mine.Comment)
+	fmt.Printf("    %s\n\n", sas)
+	fmt.Printf("Read the number to the other party and listen to theirs.\n")
+	fmt.Printf("Do both numbers match? [y/N] ")
+
+	ans, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(ans)) {
+	case "y", "yes":
+		fmt.Printf("%s is the key of the other party\n", args[0])
+		return
+	}
+	die("SAS mismatch: %s may not be the key of the other party", args[0])
+}
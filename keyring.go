@@ -0,0 +1,240 @@
+// keyring.go -- export and import signed bundles of public keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// sigtool keyring export|import ...
+func keyring(args []string) {
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s keyring --help'", os.Args[0])
+	}
+
+	switch args[0] {
+	case "export", "e":
+		keyringExport(args[1:])
+	case "import", "i":
+		keyringImport(args[1:])
+	case "-h", "--help", "help":
+		keyringUsage()
+		os.Exit(0)
+	default:
+		die("unknown keyring command %s. Try '%s keyring --help'", args[0], os.Args[0])
+	}
+}
+
+func keyringUsage() {
+	fmt.Printf(`%s keyring: Signed bundles of public keys.
+
+Usage: %s keyring export [options] -s key [-o bundle] [alias=]pubkey [...]
+       %s keyring import [options] -p pubkey|-P FP bundle
+
+'export' writes the public keys, each with an alias, to a single bundle
+signed by the private key KEY. The alias of a key defaults to the name of
+its file without the '.pub' suffix; with '-d DIR' every '*.pub' file in
+DIR is exported. 'import' verifies the signature of the bundle with the
+exporter's public key (or its fingerprint) and writes each key to the
+file 'ALIAS.pub' in the current directory (or DIR).
+
+Use '%s keyring CMD --help' for the options of each command.
+`, Z, Z, Z, Z)
+}
+
+func keyringExport(args []string) {
+	fs := flag.NewFlagSet("keyring export", flag.ExitOnError)
+
+	var help, nopw bool
+	var outfile, keyfile, envpw, dir, comment string
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the bundle to file `F`")
+	fs.StringVarP(&keyfile, "sign", "s", "", "Sign using private key `S`")
+	fs.StringVarP(&dir, "dir", "d", "", "Export every public key in directory `D`")
+	fs.StringVarP(&comment, "comment", "c", "", "Use `C` as the comment of the bundle")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		keyringUsage()
+		fmt.Printf("\nOptions for 'export':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(keyfile) == 0 {
+		die("keyring export: missing signing key (-s)")
+	}
+
+	if len(dir) > 0 {
+		names, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+		if err != nil {
+			die("keyring export: %s", err)
+		}
+		sort.Strings(names)
+		args = append(args, names...)
+	}
+
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s keyring export --help'", os.Args[0])
+	}
+
+	kr := sign.NewKeyring()
+	for _, a := range args {
+		alias, fn := keyAlias(a)
+		pk, err := sign.ReadPublicKey(fn)
+		if err != nil {
+			die("%s: %s", fn, err)
+		}
+
+		if err = kr.Add(alias, pk); err != nil {
+			die("%s: %s", fn, err)
+		}
+	}
+
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+	if err != nil {
+		audit("keyring", nil, keyfile, "", outfile, err)
+		die("%s", err)
+	}
+
+	err = kr.Sign(sk)
+	audit("keyring", sk, keyfile, "", outfile, err)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(outfile) > 0 {
+		if err = kr.SerializeFile(outfile, comment); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	b, err := kr.Serialize(comment)
+	if err != nil {
+		die("%s", err)
+	}
+	os.Stdout.Write(b)
+}
+
+// split "alias=file" into its parts; the alias of a plain file name is
+// its name without the ".pub" suffix
+func keyAlias(s string) (string, string) {
+	if i := strings.Index(s, "="); i > 0 {
+		return s[:i], s[i+1:]
+	}
+
+	return strings.TrimSuffix(filepath.Base(s), ".pub"), s
+}
+
+func keyringImport(args []string) {
+	fs := flag.NewFlagSet("keyring import", flag.ExitOnError)
+
+	var help, force bool
+	var dir string
+	var pubkeys, pins stringList
+
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.VarP(&pubkeys, "pubkey", "p", "Trust bundles signed by public key `K` (can be repeated)")
+	fs.VarP(&pins, "pin", "P", "Trust bundles signed by the key with fingerprint `FP` (can be repeated)")
+	fs.StringVarP(&dir, "dir", "d", ".", "Write the public keys to directory `D`")
+	fs.BoolVarP(&force, "overwrite", "", false, "Overwrite existing public keys with a different key")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		keyringUsage()
+		fmt.Printf("\nOptions for 'import':\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s keyring import --help'", os.Args[0])
+	}
+	if len(pubkeys) == 0 && len(pins) == 0 {
+		die("keyring import: need the exporter's public key (-p) or fingerprint (-P)")
+	}
+
+	fn := args[0]
+	kr, err := sign.ReadKeyring(fn)
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	var trusted []*sign.PublicKey
+	for _, pf := range pubkeys {
+		pk, err := sign.ReadPublicKey(pf)
+		if err != nil {
+			die("%s: %s", pf, err)
+		}
+		trusted = append(trusted, pk)
+	}
+	trusted = append(trusted, sign.PinnedKeys([]*sign.Signature{kr.Signature}, pins)...)
+
+	err = fmt.Errorf("keyring: not signed by a trusted key")
+	for _, pk := range trusted {
+		if err = kr.Verify(pk); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		die("%s", err)
+	}
+
+	// check every key before writing any of them
+	for _, e := range kr.Entries {
+		pf := filepath.Join(dir, e.Alias+".pub")
+		if _, err := os.Stat(pf); err != nil || force {
+			continue
+		}
+
+		pk, err := sign.ReadPublicKey(pf)
+		if err != nil || !bytes.Equal(pk.Pk, e.Key.Pk) {
+			die("%s: exists with a different key; use --overwrite to replace it", pf)
+		}
+	}
+
+	for _, e := range kr.Entries {
+		pf := filepath.Join(dir, e.Alias+".pub")
+		if err = e.Key.Serialize(pf, e.Key.Comment); err != nil {
+			die("%s: %s", pf, err)
+		}
+		fmt.Printf("%s: %s\n", e.Alias, e.Key.Fingerprint())
+	}
+}
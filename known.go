@@ -0,0 +1,120 @@
+// known.go -- pin the keys of named recipients of encrypt
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// default known recipients: $SIGTOOL_KNOWN_RECIPIENTS or
+// ~/.sigtool/known_recipients.yml
+func knownRecipientsPath() string {
+	if fn := os.Getenv("SIGTOOL_KNOWN_RECIPIENTS"); len(fn) > 0 {
+		return fn
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sigtool", "known_recipients.yml")
+}
+
+// the name under which the key of recipient 'r' is pinned: key files by
+// their absolute path, users and URIs as given. Inline keys name
+// themselves and aren't pinned.
+func recipientName(r string) string {
+	switch {
+	case isSSHUser(r), strings.Contains(r, "://"):
+		return r
+	}
+
+	if st, err := os.Stat(r); err == nil && st.Mode().IsRegular() {
+		if fn, err := filepath.Abs(r); err == nil {
+			return fn
+		}
+	}
+	return ""
+}
+
+// known recipients of encrypt
+type knownRecipients struct {
+	fn    string
+	db    *sign.KnownRecipients
+	repin bool
+	dirty bool
+}
+
+// open the known recipients in 'fn'; they are nil (and nothing is pinned)
+// if 'fn' is empty. With 'repin', changed keys replace the pinned keys.
+func openKnownRecipients(fn string, repin bool) *knownRecipients {
+	if len(fn) == 0 {
+		return nil
+	}
+
+	db, err := sign.ReadKnownRecipients(fn)
+	if err != nil {
+		die("%s", err)
+	}
+	return &knownRecipients{fn: fn, db: db, repin: repin}
+}
+
+// check the key 'pk' of the recipient 'r' against its pinned key; a new
+// recipient is pinned
+func (k *knownRecipients) check(r string, pk *sign.PublicKey) error {
+	name := recipientName(r)
+	if k == nil || len(name) == 0 {
+		return nil
+	}
+
+	if k.repin {
+		if k.db.Pin(name, pk) {
+			k.dirty = true
+		}
+		return nil
+	}
+
+	added, err := k.db.Check(name, pk)
+	if added {
+		k.dirty = true
+	}
+	return err
+}
+
+// true if the recipient 'r' has a pinned key
+func (k *knownRecipients) pinned(r string) bool {
+	name := recipientName(r)
+	return k != nil && len(name) > 0 && k.db.Lookup(name) != nil
+}
+
+// write the newly pinned recipients; like ssh, a failure is only a
+// warning
+func (k *knownRecipients) save() {
+	if k == nil || !k.dirty {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.fn), 0700); err != nil {
+		warn("can't pin recipients: %s", err)
+		return
+	}
+
+	if err := k.db.SerializeFile(k.fn); err != nil {
+		warn("can't pin recipients: %s", err)
+	}
+}
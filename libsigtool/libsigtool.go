@@ -0,0 +1,321 @@
+// libsigtool.go -- C API of sigtool
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build go1.17
+// +build go1.17
+
+// libsigtool is the sign package as a C shared library so that programs
+// in other languages use the same key, signature and encrypted file
+// formats. Build it with:
+//
+//	go build -buildmode=c-shared -o libsigtool.so ./libsigtool
+//
+// The functions (see libsigtool.h) return 0 on success and -1 on failure;
+// '*err' (if 'err' isn't NULL) is then set to a description of the
+// error. Keys are the contents of sigtool key files or any key accepted
+// by the sigtool command (OpenSSH keys, raw keys ..); 'pw' is the
+// passphrase of the private key (NULL if it has none). Buffers returned
+// in '*out' and error strings must be released with sigtool_free().
+//
+//	int sigtool_keygen(char *comment, char *pw,
+//	                   uint8_t **sk, size_t *sklen,
+//	                   uint8_t **pk, size_t *pklen, char **err);
+//	int sigtool_sign(uint8_t *sk, size_t sklen, char *pw,
+//	                 uint8_t *msg, size_t msglen,
+//	                 uint8_t **sig, size_t *siglen, char **err);
+//	int sigtool_verify(uint8_t *pk, size_t pklen,
+//	                   uint8_t *sig, size_t siglen,
+//	                   uint8_t *msg, size_t msglen, char **err);
+//	int sigtool_encrypt(uint8_t *sk, size_t sklen, char *pw,
+//	                    uint8_t **to, size_t *tolen, size_t nto,
+//	                    uint8_t *in, size_t inlen,
+//	                    uint8_t **out, size_t *outlen, char **err);
+//	int sigtool_decrypt(uint8_t *sk, size_t sklen, char *pw,
+//	                    uint8_t *sender, size_t senderlen,
+//	                    uint8_t *in, size_t inlen,
+//	                    uint8_t **out, size_t *outlen, char **err);
+//	void sigtool_free(void *p);
+//
+// sigtool_encrypt() authenticates the sender if 'sk' isn't NULL;
+// sigtool_decrypt() verifies the sender if 'sender' isn't NULL.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"unsafe"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+func main() {}
+
+//export sigtool_keygen
+func sigtool_keygen(comment, pw *C.char, sk **C.uint8_t, sklen *C.size_t, pk **C.uint8_t, pklen *C.size_t, cerr **C.char) C.int {
+	kp, err := sign.NewKeypair()
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	var cmt string
+	if comment != nil {
+		cmt = C.GoString(comment)
+	}
+
+	skb, err := kp.Sec.Marshal(cmt, goPassword(pw))
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	pkb, err := kp.Pub.Marshal(cmt)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	setBytes(sk, sklen, skb)
+	setBytes(pk, pklen, pkb)
+	return 0
+}
+
+//export sigtool_sign
+func sigtool_sign(sk *C.uint8_t, sklen C.size_t, pw *C.char, msg *C.uint8_t, msglen C.size_t, sig **C.uint8_t, siglen *C.size_t, cerr **C.char) C.int {
+	key, err := privateKey(sk, sklen, pw)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	m, err := goBytes(msg, msglen)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	ck, err := sign.ReaderChecksum(bytes.NewReader(m))
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	s, err := key.SignMessage(ck, "")
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	b, err := s.Serialize("")
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	setBytes(sig, siglen, b)
+	return 0
+}
+
+//export sigtool_verify
+func sigtool_verify(pk *C.uint8_t, pklen C.size_t, sig *C.uint8_t, siglen C.size_t, msg *C.uint8_t, msglen C.size_t, cerr **C.char) C.int {
+	key, err := publicKey(pk, pklen)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	sb, err := goBytes(sig, siglen)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	sigs, err := sign.ParseSignature(sb)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	m, err := goBytes(msg, msglen)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	ck, err := sign.ReaderChecksum(bytes.NewReader(m))
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	if _, err = sign.VerifyMessageResult(ck, sigs, []*sign.PublicKey{key}, 1); err != nil {
+		return fail(cerr, err)
+	}
+	return 0
+}
+
+//export sigtool_encrypt
+func sigtool_encrypt(sk *C.uint8_t, sklen C.size_t, pw *C.char, to **C.uint8_t, tolen *C.size_t, nto C.size_t, in *C.uint8_t, inlen C.size_t, out **C.uint8_t, outlen *C.size_t, cerr **C.char) C.int {
+	var key *sign.PrivateKey
+	var err error
+
+	if sk != nil {
+		if key, err = privateKey(sk, sklen, pw); err != nil {
+			return fail(cerr, err)
+		}
+	}
+
+	if nto == 0 || to == nil || tolen == nil {
+		return fail(cerr, fmt.Errorf("encrypt: no recipients"))
+	}
+
+	en, err := sign.NewEncryptor(key, 0)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	n := int(nto)
+	tos := unsafe.Slice(to, n)
+	lens := unsafe.Slice(tolen, n)
+	for i := range tos {
+		pk, err := publicKey(tos[i], lens[i])
+		if err == nil {
+			err = en.AddRecipient(pk)
+		}
+		if err != nil {
+			return fail(cerr, fmt.Errorf("recipient %d: %s", i, err))
+		}
+	}
+
+	b, err := goBytes(in, inlen)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	var buf bytes.Buffer
+	if err = en.Encrypt(bytes.NewReader(b), sign.NopWriteCloser(&buf)); err != nil {
+		return fail(cerr, err)
+	}
+
+	setBytes(out, outlen, buf.Bytes())
+	return 0
+}
+
+//export sigtool_decrypt
+func sigtool_decrypt(sk *C.uint8_t, sklen C.size_t, pw *C.char, sender *C.uint8_t, senderlen C.size_t, in *C.uint8_t, inlen C.size_t, out **C.uint8_t, outlen *C.size_t, cerr **C.char) C.int {
+	key, err := privateKey(sk, sklen, pw)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	var spk *sign.PublicKey
+	if sender != nil {
+		if spk, err = publicKey(sender, senderlen); err != nil {
+			return fail(cerr, err)
+		}
+	}
+
+	b, err := goBytes(in, inlen)
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	d, err := sign.NewDecryptor(bytes.NewReader(b))
+	if err != nil {
+		return fail(cerr, err)
+	}
+
+	if err = d.SetPrivateKey(key, spk); err != nil {
+		return fail(cerr, err)
+	}
+
+	var buf bytes.Buffer
+	if err = d.Decrypt(&buf); err != nil {
+		return fail(cerr, err)
+	}
+
+	setBytes(out, outlen, buf.Bytes())
+	return 0
+}
+
+//export sigtool_free
+func sigtool_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// parse the private key in the C buffer 'b'
+func privateKey(b *C.uint8_t, n C.size_t, pw *C.char) (*sign.PrivateKey, error) {
+	kb, err := goBytes(b, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kb) == 0 {
+		return nil, fmt.Errorf("no private key")
+	}
+
+	// a sigtool private key that doesn't decrypt is an error
+	pwb := goPassword(pw)
+	sk, err := sign.MakePrivateKey(kb, pwb)
+	if err == nil || bytes.Contains(kb, []byte("esk:")) {
+		return sk, err
+	}
+
+	return sign.ParseIdentity(string(kb), func() ([]byte, error) {
+		return pwb, nil
+	})
+}
+
+// parse the public key in the C buffer 'b'
+func publicKey(b *C.uint8_t, n C.size_t) (*sign.PublicKey, error) {
+	kb, err := goBytes(b, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kb) == 0 {
+		return nil, fmt.Errorf("no public key")
+	}
+
+	if pk, err := sign.MakePublicKey(kb); err == nil {
+		return pk, nil
+	}
+	return sign.ParseRecipient(string(kb))
+}
+
+// copy the C buffer 'b' of 'n' bytes
+func goBytes(b *C.uint8_t, n C.size_t) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	if b == nil || n > math.MaxInt32 {
+		return nil, fmt.Errorf("invalid buffer of %d bytes", n)
+	}
+	return C.GoBytes(unsafe.Pointer(b), C.int(n)), nil
+}
+
+func goPassword(pw *C.char) []byte {
+	if pw == nil {
+		return nil
+	}
+	return []byte(C.GoString(pw))
+}
+
+// return a copy of 'b' in C memory
+func setBytes(p **C.uint8_t, n *C.size_t, b []byte) {
+	*p = (*C.uint8_t)(C.CBytes(b))
+	*n = C.size_t(len(b))
+}
+
+// set '*cerr' to the error 'err' and return -1
+func fail(cerr **C.char, err error) C.int {
+	if cerr != nil {
+		*cerr = C.CString(err.Error())
+	}
+	return -1
+}
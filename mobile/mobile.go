@@ -0,0 +1,300 @@
+// mobile.go -- sign package facade for gomobile
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package mobile is a facade of the sign package for Android and iOS apps
+// built with gomobile:
+//
+//	gomobile bind -target=android -o sigtool.aar ./mobile
+//	gomobile bind -target=ios -o Sigtool.xcframework ./mobile
+//
+// It only uses types that gomobile can bind: keys, signatures and
+// encrypted data are []byte in the formats of the sigtool command and
+// files are named by their path. Keys are the contents of sigtool key
+// files or any other key accepted by sigtool (OpenSSH keys, raw keys ..).
+// An empty password is used for private keys without one.
+package mobile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Keypair is a new keypair in the formats of sigtool key files
+type Keypair struct {
+	PrivateKey  []byte
+	PublicKey   []byte
+	Fingerprint string
+}
+
+// GenerateKeypair makes a new Ed25519 keypair; the private key is
+// encrypted with 'password'.
+func GenerateKeypair(comment, password string) (*Keypair, error) {
+	kp, err := sign.NewKeypair()
+	if err != nil {
+		return nil, err
+	}
+
+	sk, err := kp.Sec.Marshal(comment, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := kp.Pub.Marshal(comment)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keypair{
+		PrivateKey:  sk,
+		PublicKey:   pk,
+		Fingerprint: kp.Pub.Fingerprint(),
+	}
+	return k, nil
+}
+
+// Fingerprint returns the fingerprint ("SHA256:..") of the public key 'pk'
+func Fingerprint(pk []byte) (string, error) {
+	k, err := publicKey(pk)
+	if err != nil {
+		return "", err
+	}
+	return k.Fingerprint(), nil
+}
+
+// Sign the message 'msg' with the private key 'sk'
+func Sign(sk []byte, password string, msg []byte) ([]byte, error) {
+	k, err := privateKey(sk, password)
+	if err != nil {
+		return nil, err
+	}
+
+	ck, err := sign.ReaderChecksum(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := k.SignMessage(ck, "")
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize("")
+}
+
+// Verify returns nil if 'sig' is a valid signature of the message 'msg' by
+// the public key 'pk'
+func Verify(pk, sig, msg []byte) error {
+	k, sigs, err := verifyArgs(pk, sig)
+	if err != nil {
+		return err
+	}
+
+	ck, err := sign.ReaderChecksum(bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+
+	_, err = sign.VerifyMessageResult(ck, sigs, []*sign.PublicKey{k}, 1)
+	return err
+}
+
+// VerifyFile returns nil if 'sig' is a valid signature of the file 'path'
+// by the public key 'pk'
+func VerifyFile(pk, sig []byte, path string) error {
+	k, sigs, err := verifyArgs(pk, sig)
+	if err != nil {
+		return err
+	}
+
+	_, err = sign.VerifyFileResult(path, sigs, []*sign.PublicKey{k}, 1)
+	return err
+}
+
+// Decrypt the encrypted data 'data' with the private key 'sk'; if
+// 'sender' (a public key) isn't empty, the data must be from the sender.
+func Decrypt(sk []byte, password string, sender, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := decrypt(sk, password, sender, bytes.NewReader(data), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptFile decrypts the file 'in' to the file 'out' with the private
+// key 'sk'; if 'sender' isn't empty, the file must be from the sender.
+// 'out' is removed if decryption fails.
+func DecryptFile(sk []byte, password string, sender []byte, in, out string) error {
+	fd, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	wr, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = decrypt(sk, password, sender, fd, wr)
+	if cerr := wr.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
+
+// Encryptor encrypts data to one or more recipients
+type Encryptor struct {
+	e *sign.Encryptor
+}
+
+// NewEncryptor makes an encryptor; the sender is authenticated with the
+// private key 'sk' unless it is empty.
+func NewEncryptor(sk []byte, password string) (*Encryptor, error) {
+	var k *sign.PrivateKey
+	var err error
+
+	if len(sk) > 0 {
+		if k, err = privateKey(sk, password); err != nil {
+			return nil, err
+		}
+	}
+
+	e, err := sign.NewEncryptor(k, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Encryptor{e: e}, nil
+}
+
+// AddRecipient adds the public key 'pk' as a recipient
+func (e *Encryptor) AddRecipient(pk []byte) error {
+	k, err := publicKey(pk)
+	if err != nil {
+		return err
+	}
+	return e.e.AddRecipient(k)
+}
+
+// Encrypt the data 'data'; an encryptor encrypts only once.
+func (e *Encryptor) Encrypt(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := e.e.Encrypt(bytes.NewReader(data), sign.NopWriteCloser(&buf)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncryptFile encrypts the file 'in' to the file 'out'; an encryptor
+// encrypts only once. 'out' is removed if encryption fails.
+func (e *Encryptor) EncryptFile(in, out string) error {
+	fd, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	wr, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt() closes 'wr'
+	if err = e.e.Encrypt(fd, wr); err != nil {
+		wr.Close()
+		os.Remove(out)
+	}
+	return err
+}
+
+// decrypt 'rd' to 'wr'
+func decrypt(sk []byte, password string, sender []byte, rd io.Reader, wr io.Writer) error {
+	k, err := privateKey(sk, password)
+	if err != nil {
+		return err
+	}
+
+	var spk *sign.PublicKey
+	if len(sender) > 0 {
+		if spk, err = publicKey(sender); err != nil {
+			return err
+		}
+	}
+
+	d, err := sign.NewDecryptor(rd)
+	if err != nil {
+		return err
+	}
+
+	if err = d.SetPrivateKey(k, spk); err != nil {
+		return err
+	}
+
+	// a file without a sender can't come from 'sender'
+	if spk != nil && !d.AuthenticatedSender() {
+		return fmt.Errorf("decrypt: the sender isn't authenticated")
+	}
+	return d.Decrypt(wr)
+}
+
+// parse the public key and signatures of a verification
+func verifyArgs(pk, sig []byte) (*sign.PublicKey, []*sign.Signature, error) {
+	k, err := publicKey(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sigs, err := sign.ParseSignature(sig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, sigs, nil
+}
+
+// parse the private key 'b'; a sigtool private key that doesn't decrypt
+// is an error
+func privateKey(b []byte, password string) (*sign.PrivateKey, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("no private key")
+	}
+
+	pw := []byte(password)
+	sk, err := sign.MakePrivateKey(b, pw)
+	if err == nil || bytes.Contains(b, []byte("esk:")) {
+		return sk, err
+	}
+
+	return sign.ParseIdentity(string(b), func() ([]byte, error) {
+		return pw, nil
+	})
+}
+
+// parse the public key 'b'
+func publicKey(b []byte) (*sign.PublicKey, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("no public key")
+	}
+
+	if pk, err := sign.MakePublicKey(b); err == nil {
+		return pk, nil
+	}
+	return sign.ParseRecipient(string(b))
+}
@@ -0,0 +1,119 @@
+// mount.go -- mount an encrypted file or archive read-only
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'mount' command
+func mount(args []string) {
+	var help, nopw bool
+	var envpw, pubkey, name string
+
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
+	fs.StringVarP(&pubkey, "verify-sender", "v", "", "Verify that the sender matches public key in `F`")
+	fs.StringVarP(&name, "name", "n", "", "Show a file that isn't an archive as `N` [FILE without .enc]")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s mount: Mount an encrypted file or archive read-only.
+
+Usage: %s mount [options] key file.enc mountpoint
+
+Decrypt FILE.ENC with KEY and show its plaintext -- the members of an
+archive or else the single decrypted file -- as a read-only filesystem at
+MOUNTPOINT. Chunks are decrypted as they are read: large encrypted
+backups can be inspected without extracting them. Symlinks in an archive
+look like what they point to.
+
+mount runs until the filesystem is unmounted (e.g., with 'fusermount -u
+MOUNTPOINT') or it is interrupted. It needs FUSE and only runs on Linux;
+files encrypted with --sparse can't be mounted.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) != 3 {
+		die("Insufficient args. Try '%s mount --help'", Z)
+	}
+
+	keyfile, infile, mnt := args[0], args[1], args[2]
+	if len(name) == 0 {
+		name = strings.TrimSuffix(filepath.Base(infile), encSuffix)
+	}
+
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+	if err != nil {
+		audit("decrypt", nil, keyfile, infile, mnt, err)
+		die("%s", err)
+	}
+
+	var pk *sign.PublicKey
+	if len(pubkey) > 0 {
+		if pk, err = sign.ParseRecipient(pubkey); err != nil {
+			die("%s", err)
+		}
+	}
+
+	fd := mustOpen(infile, os.O_RDONLY)
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		die("can't stat %s: %s", infile, err)
+	}
+
+	d, err := sign.NewDecryptor(fd)
+	if err != nil {
+		die("%s: %s", infile, err)
+	}
+
+	err = d.SetPrivateKey(sk, pk)
+	audit("decrypt", sk, keyfile, infile, mnt, err)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if pk == nil && d.AuthenticatedSender() {
+		warn("%s: Missing sender Public Key; can't authenticate sender ..", infile)
+	}
+
+	efs, err := d.NewFS(fd, st.Size(), name)
+	if err != nil {
+		die("%s: %s", infile, err)
+	}
+
+	if err = serveFUSE(efs, infile, mnt); err != nil {
+		die("%s", err)
+	}
+}
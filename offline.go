@@ -0,0 +1,138 @@
+// offline.go -- signing with an air-gapped signer
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// write a request to sign the file 'fn' to 'outf'
+func offlineRequest(fn, outf string, attrs bool, comment, ucomment string, force bool) {
+	r, err := sign.NewSigningRequest(fn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	r.Attrs = attrs
+	r.TrustedComment = comment
+	r.Comment = ucomment
+
+	b, err := r.Serialize()
+	if err != nil {
+		die("%s", err)
+	}
+
+	writeOutput(outf, force, func(wr io.Writer) error {
+		_, err := wr.Write(b)
+		return err
+	})
+}
+
+// verify the signatures in 'resp' made from a signing request of the file
+// 'fn' and write them to 'outf'; with 'embed', 'outf' is 'fn' with the
+// signatures embedded.
+func offlineResponse(resp, fn, outf string, embed, rtime bool, rtfile string, force bool) {
+	sigs, err := sign.ReadSignatures(resp)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if err = sign.VerifyResponse(fn, sigs); err != nil {
+		die("%s", err)
+	}
+
+	if rtime {
+		if err = timestamp(sigs, rtfile); err != nil {
+			die("%s", err)
+		}
+	}
+
+	var sigo []byte
+	if len(sigs) == 1 {
+		sigo, err = sigs[0].Serialize("")
+	} else {
+		sigo, err = sign.SerializeSignatures(sigs, sigs[0].Comment)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+
+	// the response is already in place unless it is timestamped
+	if !embed && samePath(resp, outf) {
+		if !rtime {
+			return
+		}
+		force = true
+	}
+
+	writeOutput(outf, force, func(wr io.Writer) error {
+		if !embed {
+			_, err := wr.Write(sigo)
+			return err
+		}
+
+		fd, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		if _, err = io.Copy(wr, fd); err != nil {
+			return err
+		}
+		return sign.WriteEmbeddedSignature(wr, sigo)
+	})
+}
+
+// write the output file 'outf' with 'write'; a partial file is removed
+func writeOutput(outf string, force bool, write func(wr io.Writer) error) {
+	if outf == "-" {
+		if err := write(os.Stdout); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	confirmOverwrite(outf, force)
+	fd, err := os.OpenFile(outf, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		die("can't create output file %s: %s", outf, err)
+	}
+
+	if err = write(fd); err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+	if err != nil {
+		os.Remove(outf)
+		die("can't write %s: %s", outf, err)
+	}
+}
+
+// true if 'a' and 'b' are the same file
+func samePath(a, b string) bool {
+	ast, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bst, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ast, bst)
+}
@@ -0,0 +1,86 @@
+// outname.go -- default output names and overwrite prompts
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// default suffix of encrypted files
+const encSuffix = ".enc"
+
+// isTerminal returns true if 'fd' is a terminal
+func isTerminal(fd *os.File) bool {
+	return terminal.IsTerminal(int(fd.Fd()))
+}
+
+// cryptOutput returns the output file of encrypt or decrypt of 'infile'
+// when -o isn't given: "" (stdout) unless the input is a named file and
+// the output would go to a terminal or a suffix was given. Encryption
+// appends 'suffix' (.enc by default) and decryption removes it.
+func cryptOutput(infile, suffix string, decrypt bool) string {
+	if len(suffix) == 0 && isTerminal(os.Stdout) {
+		suffix = encSuffix
+	}
+
+	fn, err := outputName(infile, suffix, decrypt)
+	if err != nil {
+		die("%s", err)
+	}
+	return fn
+}
+
+// outputName returns the output file of 'infile' with 'suffix' added (or
+// removed if 'decrypt'); "" if there's no input file or suffix.
+func outputName(infile, suffix string, decrypt bool) (string, error) {
+	if len(infile) == 0 || infile == "-" || len(suffix) == 0 {
+		return "", nil
+	}
+
+	if !decrypt {
+		return infile + suffix, nil
+	}
+
+	// the output can't be the input or its directory
+	if !strings.HasSuffix(infile, suffix) || filepath.Base(infile) == suffix {
+		return "", fmt.Errorf("can't name the output of %s (no %s suffix); use -o", infile, suffix)
+	}
+	return strings.TrimSuffix(infile, suffix), nil
+}
+
+// confirmOverwrite asks before an existing output file 'fn' is
+// overwritten; it only asks on a terminal and not with 'force'.
+func confirmOverwrite(fn string, force bool) {
+	if force || fn == "-" || !isTerminal(os.Stdin) {
+		return
+	}
+
+	if st, err := os.Stat(fn); err != nil || !st.Mode().IsRegular() {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: overwrite %s? [y/N] ", Z, fn)
+	ans, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(ans)) {
+	case "y", "yes":
+		return
+	}
+	die("not overwriting %s", fn)
+}
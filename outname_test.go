@@ -0,0 +1,63 @@
+// outname_test.go -- tests for the default output file names
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestOutputName(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		in      string
+		suffix  string
+		decrypt bool
+		out     string
+		fail    bool
+	}{
+		// no input file or no suffix: stdout
+		{"", ".enc", false, "", false},
+		{"-", ".enc", true, "", false},
+		{"a.txt", "", false, "", false},
+		{"a.txt.enc", "", true, "", false},
+
+		{"a.txt", ".enc", false, "a.txt.enc", false},
+		{"dir/a.txt", ".enc", false, "dir/a.txt.enc", false},
+		{"a.txt.enc", ".enc", false, "a.txt.enc.enc", false},
+		{"a.txt", ".age", false, "a.txt.age", false},
+
+		{"a.txt.enc", ".enc", true, "a.txt", false},
+		{"dir/a.txt.enc", ".enc", true, "dir/a.txt", false},
+		{"a.enc.enc", ".enc", true, "a.enc", false},
+		{"a.txt.age", ".age", true, "a.txt", false},
+
+		// the suffix must be there and leave a name
+		{"a.txt", ".enc", true, "", true},
+		{"a.txt.enc", ".age", true, "", true},
+		{"a.encx", ".enc", true, "", true},
+		{".enc", ".enc", true, "", true},
+		{"dir/.enc", ".enc", true, "", true},
+	}
+
+	for i, tc := range tests {
+		out, err := outputName(tc.in, tc.suffix, tc.decrypt)
+		if tc.fail {
+			assert(err != nil, "%d: %s (%s, decrypt %v): exp error, saw %q", i, tc.in, tc.suffix, tc.decrypt, out)
+			continue
+		}
+		assert(err == nil, "%d: %s: %s", i, tc.in, err)
+		assert(out == tc.out, "%d: %s (%s, decrypt %v): exp %q, saw %q", i, tc.in, tc.suffix, tc.decrypt, tc.out, out)
+	}
+}
@@ -0,0 +1,29 @@
+// owner_other.go -- platforms without Unix file ownership and identity
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows || plan9 || js || wasip1
+// +build windows plan9 js wasip1
+
+package main
+
+import (
+	"os"
+)
+
+func fileOwner(fi os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
+
+func fileID(fi os.FileInfo) (fileKey, uint64, bool) {
+	return fileKey{}, 0, false
+}
@@ -0,0 +1,216 @@
+// pemkey.go -- convert keys to and from the single file PEM format
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'export' command
+func exportKey(args []string) {
+	var help, public, force bool
+	var outfile, dns string
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the PEM key to file `F` [FILE-PREFIX.pem]")
+	fs.BoolVarP(&public, "public", "p", false, "Export only the public key")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file if it exists")
+	fs.StringVarP(&dns, "dns", "", "", "Print the DNS record that publishes the public key as that of `A` (user@domain)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s export: Convert a keypair to a single PEM file.
+
+Usage: %s export [options] file-prefix
+
+Read the public key FILE-PREFIX.pub and private key FILE-PREFIX.key and
+write both to the single PEM file FILE-PREFIX.pem. The private key isn't
+decrypted and keeps its passphrase. With --public, only the public key is
+exported; share that file and not the one with the private key.
+
+PEM key files can be used wherever a key file is expected; use 'import'
+to convert them back.
+
+With --dns, the TXT record that publishes the public key as the key of
+A (user@domain) is printed in zone file format instead; add it to the
+zone of the domain (signed with DNSSEC) so that 'encrypt' can find it.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s export --help'", Z)
+	}
+
+	bn := args[0]
+	if len(dns) > 0 {
+		pk, err := sign.ReadPublicKey(bn + ".pub")
+		if err != nil {
+			die("%s", err)
+		}
+		printDNSRecord(dns, pk)
+		return
+	}
+
+	pub, err := ioutil.ReadFile(bn + ".pub")
+	if err != nil {
+		die("%s", err)
+	}
+
+	var key []byte
+	if !public {
+		if key, err = ioutil.ReadFile(bn + ".key"); err != nil {
+			die("%s (use --public to export only the public key)", err)
+		}
+	}
+
+	out, err := sign.ExportPEM(pub, key)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if outfile == "-" {
+		os.Stdout.Write(out)
+		return
+	}
+
+	if len(outfile) == 0 {
+		outfile = bn + ".pem"
+	}
+
+	mode := os.FileMode(0600)
+	if public {
+		mode = 0644
+	}
+	writeKeyFile(outfile, out, mode, force)
+}
+
+// Run the 'import' command
+func importKey(args []string) {
+	var help, force, qr bool
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the key files if they exist")
+	fs.BoolVarP(&qr, "qr", "", false, "Read the public key from the QR code in the image file PEM-FILE")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s import: Convert a PEM key file to a keypair.
+
+Usage: %s import [options] pem-file file-prefix
+
+Write the public key of PEM-FILE to FILE-PREFIX.pub and its private key,
+if any, to FILE-PREFIX.key. The private key isn't decrypted and keeps its
+passphrase.
+
+With --qr, PEM-FILE is an image (PNG, JPEG or GIF) of a QR code made by
+'%s key qr'; its public key is written to FILE-PREFIX.pub.
+
+Options:
+`, Z, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s import --help'", Z)
+	}
+
+	var pub, key []byte
+	if qr {
+		pub = importQR(args[0])
+	} else {
+		b, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			die("%s", err)
+		}
+
+		if pub, key, err = sign.ImportPEM(b); err != nil {
+			die("%s: %s", args[0], err)
+		}
+	}
+
+	bn := args[1]
+	if pub == nil {
+		die("%s: has no public key", args[0])
+	}
+
+	if exists(bn) && !force {
+		die("Public/Private key files (%s.key, %s.pub) exist. Won't overwrite!", bn, bn)
+	}
+
+	writeKeyFile(bn+".pub", pub, 0644, true)
+	if key != nil {
+		writeKeyFile(bn+".key", key, 0600, true)
+	}
+}
+
+// write the key file 'fn' unless it exists and 'force' isn't set
+func writeKeyFile(fn string, b []byte, mode os.FileMode, force bool) {
+	if _, err := os.Stat(fn); err == nil && !force {
+		die("%s exists. Won't overwrite!", fn)
+	}
+
+	if err := ioutil.WriteFile(fn, b, mode); err != nil {
+		die("%s", err)
+	}
+
+	// an existing file keeps its permissions
+	if err := os.Chmod(fn, mode); err != nil {
+		die("%s", err)
+	}
+}
+
+// the public key in the QR code image 'fn'
+func importQR(fn string) []byte {
+	b, err := sign.ReadQR(fn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if s := string(b); strings.HasPrefix(s, "SHA256:") {
+		die("%s: has the fingerprint %s, not a key", fn, s)
+	}
+
+	pk, err := sign.MakePublicKey(b)
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	fmt.Printf("%s: %s %s\n", fn, pk.Fingerprint(), pk.Comment)
+	return b
+}
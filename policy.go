@@ -0,0 +1,39 @@
+// policy.go -- apply the encryption policy
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"os"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// encryption policy: $SIGTOOL_POLICY or /etc/sigtool/policy.yml
+func policyPath() string {
+	if fn := os.Getenv("SIGTOOL_POLICY"); len(fn) > 0 {
+		return fn
+	}
+	return "/etc/sigtool/policy.yml"
+}
+
+// add the escrow recipients of the policy to 'en'; a policy that can't be
+// read or applied is an error: nothing is encrypted without its escrow
+// keys.
+func applyPolicy(en *sign.Encryptor) error {
+	p, err := sign.ReadPolicy(policyPath())
+	if err != nil {
+		return err
+	}
+	return p.Apply(en)
+}
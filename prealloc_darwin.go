@@ -0,0 +1,54 @@
+// prealloc_darwin.go -- reserve disk space for output files on macOS
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// reserve 'size' bytes of disk space for 'fd' without changing its size;
+// file systems that can't preallocate are not an error.
+func preallocate(fd *os.File, size int64) error {
+	// contiguous space if possible, else any
+	st := syscall.Fstore_t{
+		Flags:   syscall.F_ALLOCATECONTIG | syscall.F_ALLOCATEALL,
+		Posmode: syscall.F_PEOFPOSMODE,
+		Length:  size,
+	}
+
+	err := fcntlStore(fd, &st)
+	if err == syscall.ENOSPC {
+		st.Flags = syscall.F_ALLOCATEALL
+		err = fcntlStore(fd, &st)
+	}
+
+	switch err {
+	case syscall.ENOTSUP, syscall.EINVAL:
+		return nil
+	}
+	return err
+}
+
+func fcntlStore(fd *os.File, st *syscall.Fstore_t) error {
+	_, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(st)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
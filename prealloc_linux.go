@@ -0,0 +1,36 @@
+// prealloc_linux.go -- reserve disk space for output files on Linux
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE
+const _FallocKeepSize = 1
+
+// reserve 'size' bytes of disk space for 'fd' without changing its size;
+// file systems that can't preallocate are not an error.
+func preallocate(fd *os.File, size int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), _FallocKeepSize, 0, size)
+	switch err {
+	case syscall.EOPNOTSUPP, syscall.ENOSYS, syscall.EINVAL:
+		return nil
+	}
+	return err
+}
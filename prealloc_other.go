@@ -0,0 +1,26 @@
+// prealloc_other.go -- platforms that can't reserve disk space
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"os"
+)
+
+// output files are not preallocated on these platforms
+func preallocate(fd *os.File, size int64) error {
+	return nil
+}
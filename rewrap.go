@@ -0,0 +1,218 @@
+// rewrap.go -- move encrypted files to a new recipient key
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'rewrap' command
+func rewrap(args []string) {
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s rewrap --help'", Z)
+	}
+
+	switch args[0] {
+	case "token":
+		rewrapToken(args[1:])
+	case "apply":
+		rewrapApply(args[1:])
+	case "-h", "--help", "help":
+		rewrapUsage()
+		os.Exit(0)
+	default:
+		die("unknown rewrap command %s. Try '%s rewrap --help'", args[0], Z)
+	}
+}
+
+func rewrapUsage() {
+	fmt.Printf(`%s rewrap: Move encrypted files to a new recipient key.
+
+Usage: %s rewrap token [options] old-key new-key
+       %s rewrap apply [options] token file [file...]
+
+'token' makes a rewrap token from the private keys OLD-KEY and NEW-KEY.
+With the token, 'apply' moves the files encrypted to OLD-KEY to NEW-KEY
+without decrypting them or their file keys; it can run where the files
+are stored. Files rewrapped before are moved again by the next token.
+
+The token is a secret: with it, either private key can decrypt the files
+of the other. OLD-KEY still decrypts the files; retire it once all of its
+files are rewrapped.
+`, Z, Z, Z)
+}
+
+// make a rewrap token
+func rewrapToken(args []string) {
+	var help, nopw bool
+	var outfile, comment, envpw string
+
+	fs := flag.NewFlagSet("rewrap token", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the token to file `F`")
+	fs.StringVarP(&comment, "comment", "c", "", "Use `C` as the comment of the token")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for the passphrases of the private keys")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E` for both keys")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		rewrapUsage()
+		fmt.Printf("\nOptions:\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s rewrap --help'", Z)
+	}
+
+	var sks [2]*sign.PrivateKey
+	for i, what := range []string{"old", "new"} {
+		fn := args[i]
+		prompt := fmt.Sprintf("Enter passphrase for %s key %s", what, fn)
+		sks[i], err = sign.ParseIdentity(fn, askpassFunc(nopw, envpw, prompt, false))
+		if err != nil {
+			audit("rewrap", nil, fn, "", outfile, err)
+			die("%s", err)
+		}
+	}
+
+	tok, err := sign.NewRewrapToken(sks[0], sks[1])
+	for i := range sks {
+		audit("rewrap", sks[i], args[i], "", outfile, err)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(comment) == 0 {
+		comment = fmt.Sprintf("rewrap %s to %s", args[0], args[1])
+	}
+
+	if len(outfile) > 0 {
+		if err = tok.SerializeFile(outfile, comment); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	b, err := tok.Serialize(comment)
+	if err != nil {
+		die("%s", err)
+	}
+	os.Stdout.Write(b)
+}
+
+// rewrap files with a token
+func rewrapApply(args []string) {
+	var help bool
+	var outfile string
+
+	fs := flag.NewFlagSet("rewrap apply", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the rewrapped file to `F` instead of replacing it (one file only)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		rewrapUsage()
+		fmt.Printf("\nOptions:\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s rewrap --help'", Z)
+	}
+
+	tok, err := sign.ReadRewrapToken(args[0])
+	if err != nil {
+		die("%s", err)
+	}
+
+	files := args[1:]
+	if len(outfile) > 0 && len(files) > 1 {
+		die("rewrap: --outfile needs a single file")
+	}
+
+	errs := 0
+	for _, fn := range files {
+		out := fn
+		if len(outfile) > 0 {
+			out = outfile
+		}
+
+		if err := rewrapFile(tok, fn, out); err != nil {
+			warn("%s: %s", fn, err)
+			errs++
+		}
+	}
+
+	if errs > 0 {
+		die("rewrap: %d of %d files failed", errs, len(files))
+	}
+}
+
+// rewrap the file 'fn' to 'outf'; the file is replaced only if it is
+// rewrapped.
+func rewrapFile(tok *sign.RewrapToken, fn, outf string) error {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	rewrite := func(wr io.Writer) error {
+		return tok.Rewrap(fd, wr)
+	}
+
+	if outf == "-" {
+		return rewrite(os.Stdout)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", outf)
+	wfd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("can't create output file %s: %s", tmp, err)
+	}
+
+	err = rewrite(wfd)
+	if err == nil {
+		err = wfd.Sync()
+	}
+	wfd.Close()
+	if err == nil {
+		err = os.Rename(tmp, outf)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+// rotate.go -- key rotation statements
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'rotate' command
+func rotate(args []string) {
+	var help, nopw bool
+	var outfile, comment, envpw string
+
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&outfile, "outfile", "o", "", "Write the rotation statement to file `F`")
+	fs.StringVarP(&comment, "comment", "c", "", "Use `C` as the comment of the statement")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for the passphrases of the private keys")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E` for both keys")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s rotate: Make a key rotation statement.
+
+Usage: %s rotate [options] old-key new-key
+
+Write a statement, signed by both the OLD-KEY and NEW-KEY private keys,
+that NEW-KEY replaces OLD-KEY. Verifiers that trust or have pinned the
+old key accept signatures by the new key when given the statement (see
+'verify --rotation'). Unless '-o' is used, the statement is written to
+STDOUT.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s rotate --help'", Z)
+	}
+
+	var sks [2]*sign.PrivateKey
+	for i, what := range []string{"old", "new"} {
+		fn := args[i]
+		prompt := fmt.Sprintf("Enter passphrase for %s key %s", what, fn)
+		sks[i], err = sign.ParseIdentity(fn, askpassFunc(nopw, envpw, prompt, false))
+		if err != nil {
+			audit("rotate", nil, fn, "", outfile, err)
+			die("%s", err)
+		}
+	}
+
+	r, err := sign.NewRotation(sks[0], sks[1])
+	for i := range sks {
+		audit("rotate", sks[i], args[i], "", outfile, err)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(comment) == 0 {
+		comment = fmt.Sprintf("%s replaces %s", r.New.Fingerprint(), r.Old.Fingerprint())
+	}
+
+	if len(outfile) > 0 {
+		if err = r.SerializeFile(outfile, comment); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	b, err := r.Serialize(comment)
+	if err != nil {
+		die("%s", err)
+	}
+	os.Stdout.Write(b)
+}
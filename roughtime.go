@@ -0,0 +1,87 @@
+// roughtime.go -- Roughtime timestamps of signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Roughtime servers: $SIGTOOL_ROUGHTIME or ~/.sigtool/roughtime.json
+func roughtimePath() string {
+	if fn := os.Getenv("SIGTOOL_ROUGHTIME"); len(fn) > 0 {
+		return fn
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sigtool", "roughtime.json")
+}
+
+// get a Roughtime timestamp for each signature from the servers in 'fn'
+func timestamp(sigs []*sign.Signature, fn string) error {
+	srvs, err := sign.ReadRoughtimeServers(fn)
+	if err != nil {
+		return fmt.Errorf("roughtime: %s", err)
+	}
+
+	for _, sig := range sigs {
+		if _, err := sig.Timestamp(srvs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify the Roughtime timestamps of the signatures in 'res' with the
+// servers in 'fn'; return a note on each timestamp. A timestamp that
+// doesn't verify is an error; one that can't be checked is a warning.
+func verifyTimestamps(res []*sign.VerifyResult, fn string) (map[*sign.Signature]string, error) {
+	var srvs []*sign.RoughtimeServer
+	var rerr error
+
+	notes := make(map[*sign.Signature]string)
+	for _, r := range res {
+		sig := r.Signature
+		if sig.Roughtime == nil {
+			continue
+		}
+
+		if srvs == nil && rerr == nil {
+			srvs, rerr = sign.ReadRoughtimeServers(fn)
+		}
+		if rerr != nil {
+			notes[sig] = fmt.Sprintf("warning: %x: can't verify roughtime timestamp: %s", r.Signer.Hash(), rerr)
+			continue
+		}
+
+		ts, err := sig.VerifyRoughtime(srvs)
+		switch {
+		case err == sign.ErrRoughtimeUntrusted:
+			notes[sig] = fmt.Sprintf("warning: %x: roughtime timestamp by untrusted server %s", r.Signer.Hash(), sig.Roughtime.Server)
+		case err != nil:
+			return nil, fmt.Errorf("%x: %s", r.Signer.Hash(), err)
+		default:
+			notes[sig] = fmt.Sprintf("roughtime: signature existed at %s (+/- %s) per server %s",
+				ts.Midpoint.Local().Format(time.RFC1123), ts.Radius, ts.Server)
+		}
+	}
+	return notes, nil
+}
@@ -0,0 +1,80 @@
+// selftest.go -- run the built-in known answer tests
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'selftest' command
+func selftest(args []string) {
+	var help, quiet bool
+
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.BoolVarP(&quiet, "quiet", "q", false, "Only report failures")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s selftest: Run the built-in known answer tests.
+
+Usage: %s selftest [options]
+
+Runs the known answer tests for the key derivation functions, key wrap,
+chunk cipher and signatures. The exit status is non-zero if any of them
+fail. In FIPS mode the tests of algorithms that are not approved are
+skipped. The tests can also be run before every command with the global
+option --selftest.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if !runSelfTest(!quiet) {
+		os.Exit(1)
+	}
+}
+
+// run the known answer tests; print the results if 'verbose' and the
+// failures always. Return true if all tests passed.
+func runSelfTest(verbose bool) bool {
+	res, err := sign.SelfTest()
+	for _, r := range res {
+		switch {
+		case r.Err != nil:
+			warn("selftest: %s: FAIL: %s", r.Name, r.Err)
+		case r.Skipped && verbose:
+			fmt.Printf("%s: skipped (not FIPS approved)\n", r.Name)
+		case verbose:
+			fmt.Printf("%s: ok\n", r.Name)
+		}
+	}
+
+	if err != nil {
+		warn("%s", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,378 @@
+// serve.go -- signing daemon with an HTTP API
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// largest signature accepted by /v1/verify
+const _MaxSigSize = 1048576
+
+// signing daemon state
+type server struct {
+	sk      *sign.PrivateKey
+	keyfile string
+	token   []byte
+	dbfile  string
+}
+
+// Run the 'serve' command
+func serve(args []string) {
+	var help, nopw bool
+	var keyfile, listen, tokfile, certfile, tlskey, envpw, dbfile string
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&keyfile, "key", "k", "", "Sign and encrypt with private key `K`")
+	fs.StringVarP(&listen, "listen", "l", "127.0.0.1:8421", "Listen on `A` (host:port or unix:/path)")
+	fs.StringVarP(&tokfile, "token-file", "T", "", "Read the API token from file `F` [$SIGTOOL_SERVE_TOKEN]")
+	fs.StringVarP(&certfile, "tls-cert", "", "", "Serve HTTPS with the certificate in file `F`")
+	fs.StringVarP(&tlskey, "tls-key", "", "", "Serve HTTPS with the TLS private key in file `F`")
+	fs.StringVarP(&dbfile, "trust-db", "D", trustDBPath(), "Verify with and encrypt to the signers in the trust database `F`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+
+	if err := fs.Parse(args); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s serve: Sign, verify and encrypt for clients over HTTP.
+
+Usage: %s serve [options] -k key
+
+Keep the private key KEY on this host and use it on behalf of clients
+that present the API token (as 'Authorization: Bearer TOKEN'):
+
+  GET  /v1/key      the public key
+  POST /v1/sign     sign the request body; or the checksum
+                    SHA512(content || uint64_be(size)) given in
+                    base64 as '?checksum=B64'
+  POST /v1/verify   verify a multipart form with the parts 'signature'
+                    and 'file'; the signers trusted for the name of the
+                    file part in the trust database and KEY are trusted
+  POST /v1/encrypt  encrypt the request body to the recipients
+                    '?to=NAME' (signers in the trust database, age or
+                    OpenSSH keys), authenticated by KEY
+
+Each use of the private key is recorded in the audit log (see
+'--audit-log'). A TCP address other than a loopback address needs
+'--tls-cert' and '--tls-key'; a unix socket is only open to its owner.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if len(keyfile) == 0 {
+		die("serve: missing private key (-k)")
+	}
+
+	if (len(certfile) > 0) != (len(tlskey) > 0) {
+		die("serve: --tls-cert and --tls-key must be used together")
+	}
+
+	// the token mustn't cross the network in cleartext
+	if !strings.HasPrefix(listen, "unix:") && len(certfile) == 0 && !isLoopback(listen) {
+		die("serve: listening on %s needs --tls-cert and --tls-key", listen)
+	}
+
+	tok := os.Getenv("SIGTOOL_SERVE_TOKEN")
+	if len(tokfile) > 0 {
+		b, err := ioutil.ReadFile(tokfile)
+		if err != nil {
+			die("%s", err)
+		}
+		tok = string(b)
+	}
+
+	tok = strings.TrimSpace(tok)
+	if len(tok) < 16 {
+		die("serve: need an API token of at least 16 characters (--token-file)")
+	}
+
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+	if err != nil {
+		audit("serve", nil, keyfile, "", "", err)
+		die("%s", err)
+	}
+
+	s := &server{
+		sk:      sk,
+		keyfile: keyfile,
+		token:   []byte(tok),
+		dbfile:  dbfile,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/key", s.auth("GET", s.key))
+	mux.HandleFunc("/v1/sign", s.auth("POST", s.sign))
+	mux.HandleFunc("/v1/verify", s.auth("POST", s.verify))
+	mux.HandleFunc("/v1/encrypt", s.auth("POST", s.encrypt))
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	var ln net.Listener
+	if strings.HasPrefix(listen, "unix:") {
+		addr := strings.TrimPrefix(listen, "unix:")
+		os.Remove(addr)
+		ln, err = listenUnix(addr)
+	} else {
+		ln, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+
+	warn("serving on %s with key %s", listen, sk.PublicKey().Fingerprint())
+	if len(certfile) > 0 {
+		err = srv.ServeTLS(ln, certfile, tlskey)
+	} else {
+		err = srv.Serve(ln)
+	}
+	die("%s", err)
+}
+
+// check the method and API token of every request
+func (s *server) auth(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		tok := strings.TrimPrefix(auth, "Bearer ")
+		if len(tok) == len(auth) || subtle.ConstantTimeCompare([]byte(tok), s.token) != 1 {
+			warn("%s: %s %s: bad token", r.RemoteAddr, r.Method, r.URL.Path)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// true if the TCP address 'addr' is on the loopback interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// GET /v1/key
+func (s *server) key(w http.ResponseWriter, r *http.Request) {
+	pk := s.sk.PublicKey()
+	b, err := pk.Marshal(pk.Comment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(b)
+}
+
+// POST /v1/sign
+func (s *server) sign(w http.ResponseWriter, r *http.Request) {
+	var ck []byte
+	var err error
+
+	if c := r.URL.Query().Get("checksum"); len(c) > 0 {
+		ck, err = base64.StdEncoding.DecodeString(c)
+		if err != nil || len(ck) != 64 {
+			http.Error(w, "invalid checksum", http.StatusBadRequest)
+			return
+		}
+	} else if ck, err = sign.ReaderChecksum(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sig, err := s.sk.SignMessage(ck, "")
+	audit("sign", s.sk, s.keyfile, r.RemoteAddr, "", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := sig.Serialize(r.URL.Query().Get("comment"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(b)
+}
+
+// result of /v1/verify
+type verifyReply struct {
+	Verified bool     `json:"verified"`
+	Signers  []string `json:"signers,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// POST /v1/verify
+func (s *server) verify(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sigs []*sign.Signature
+	var ck []byte
+	var name string
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch p.FormName() {
+		case "signature":
+			b, err := ioutil.ReadAll(io.LimitReader(p, _MaxSigSize))
+			if err == nil {
+				sigs, err = sign.MakeSignatures(b)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("signature: %s", err), http.StatusBadRequest)
+				return
+			}
+		case "file":
+			name = p.FileName()
+			if ck, err = sign.ReaderChecksum(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if sigs == nil || ck == nil {
+		http.Error(w, "need the parts 'signature' and 'file'", http.StatusBadRequest)
+		return
+	}
+
+	pks := []*sign.PublicKey{s.sk.PublicKey()}
+	if db, err := sign.ReadTrustDB(s.dbfile); err == nil {
+		pks = append(pks, db.TrustedKeys(name)...)
+	} else {
+		warn("%s", err)
+	}
+
+	var v verifyReply
+
+	res, err := sign.VerifyMessageResult(ck, sigs, pks, 1)
+	for _, pk := range sign.Signers(res) {
+		v.Signers = append(v.Signers, strings.TrimSpace(pk.Fingerprint()+" "+pk.Comment))
+	}
+
+	v.Verified = err == nil
+	if err != nil {
+		v.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&v)
+}
+
+// POST /v1/encrypt?to=R
+func (s *server) encrypt(w http.ResponseWriter, r *http.Request) {
+	to := r.URL.Query()["to"]
+	if len(to) == 0 {
+		http.Error(w, "no recipients", http.StatusBadRequest)
+		return
+	}
+
+	en, err := sign.NewEncryptor(s.sk, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	db, err := sign.ReadTrustDB(s.dbfile)
+	if err != nil {
+		warn("%s", err)
+		db = &sign.TrustDB{}
+	}
+
+	for _, t := range to {
+		pk, err := serveRecipient(db, t)
+		if err == nil {
+			err = en.AddRecipient(pk)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err = applyPolicy(en); err != nil {
+		warn("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	err = en.Encrypt(r.Body, sign.NopWriteCloser(w))
+	audit("encrypt", s.sk, s.keyfile, r.RemoteAddr, strings.Join(to, ","), err)
+	if err != nil {
+		// the status is already sent; drop the connection so that the
+		// client doesn't see a truncated file as complete
+		warn("%s: encrypt: %s", r.RemoteAddr, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// recipients of /v1/encrypt are never read from files on the server
+func serveRecipient(db *sign.TrustDB, s string) (*sign.PublicKey, error) {
+	if t := db.Lookup(s); t != nil {
+		return t.Key, nil
+	}
+
+	if strings.HasPrefix(s, "age1") || strings.HasPrefix(s, "ssh-ed25519 ") {
+		return sign.ParseRecipient(s)
+	}
+	return nil, fmt.Errorf("unknown recipient %q", s)
+}
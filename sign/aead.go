@@ -0,0 +1,115 @@
+// aead.go -- the AEAD of the encrypted chunks
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The chunks of an encrypted file are sealed with AES-256-GCM or
+// ChaCha20-Poly1305. AES-GCM is fast only with hardware support
+// (AES-NI and PCLMULQDQ on x86, the AES and PMULL extensions on arm64);
+// without it ChaCha20-Poly1305 is faster and doesn't leak through cache
+// timing. Unless the caller picks one, the Encryptor picks the cipher
+// for the CPU it runs on and records the choice in the header. Files
+// encrypted with AES-GCM leave the header field empty and are readable by
+// older versions.
+
+package sign
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+const (
+	// CipherAESGCM is AES-256-GCM with a 128-bit nonce
+	CipherAESGCM = "aes-256-gcm"
+
+	// CipherChaCha20 is ChaCha20-Poly1305 (RFC 8439)
+	CipherChaCha20 = "chacha20-poly1305"
+)
+
+// AutoCipher returns the chunk cipher best suited to this CPU: AES-256-GCM
+// if it has AES and carry-less multiply instructions and ChaCha20-Poly1305
+// otherwise. It is always AES-256-GCM in FIPS mode.
+func AutoCipher() string {
+	if FIPSMode() || hasAESGCM() {
+		return CipherAESGCM
+	}
+	return CipherChaCha20
+}
+
+func hasAESGCM() bool {
+	switch {
+	case cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ:
+		return true
+	case cpu.ARM64.HasAES && cpu.ARM64.HasPMULL:
+		return true
+	case cpu.S390X.HasAES && cpu.S390X.HasAESGCM:
+		return true
+	}
+	return false
+}
+
+// SetCipher sets the cipher of the encrypted chunks to 'name' (one of
+// CipherAESGCM or CipherChaCha20); "auto" or the empty string uses
+// AutoCipher(). It must be called before encryption starts.
+func (e *Encryptor) SetCipher(name string) error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't set the cipher after encryption has started")
+	}
+
+	switch name {
+	case "", "auto":
+		name = AutoCipher()
+	case CipherAESGCM:
+	case CipherChaCha20:
+		if err := fipsRefuse(CipherChaCha20); err != nil {
+			return fmt.Errorf("encrypt: %s", err)
+		}
+	default:
+		return fmt.Errorf("encrypt: unknown cipher %s", name)
+	}
+
+	e.cipher = name
+	return nil
+}
+
+// the name of the chunk cipher recorded in the header; AES-256-GCM is
+// recorded as the empty string
+func headerCipher(name string) string {
+	if name == CipherAESGCM {
+		return ""
+	}
+	return name
+}
+
+// make the AEAD for the chunks of a file with cipher 'name' (as recorded
+// in the header) and data key 'key'
+func chunkAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case "", CipherAESGCM:
+		aes, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCMWithNonceSize(aes, _AEADNonceLen)
+
+	case CipherChaCha20:
+		if err := fipsRefuse(CipherChaCha20); err != nil {
+			return nil, err
+		}
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unknown cipher %q", name)
+}
@@ -0,0 +1,657 @@
+// agent.go -- key agent holding unlocked private keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The agent keeps decrypted private keys in memory and uses them on
+// behalf of its clients (in the manner of ssh-agent); the keys never leave
+// the agent. Clients talk to it over a unix socket: each request and reply
+// is one JSON object. The operations are:
+//
+//    add     add a private key with an optional lifetime and confirmation
+//    list    list the public keys
+//    remove  remove a key (or all keys)
+//    sign    make an Ed25519 signature of a message
+//    x25519  compute the X25519 shared secrets of each encryption key
+//            of a private key with a peer's public key (to unwrap file
+//            keys)
+//
+// ParseIdentity() accepts "agent:FP" (or just "agent:" if the agent holds
+// a single key) for a key held by the agent at AgentSocket().
+//
+// Other programs on the host can use the agent's keys without access to
+// the key files:
+//
+//    c, err := sign.DialAgent()
+//    sig, err := c.Sign("SHA256:...", ck, "")
+//    d, err := sign.NewDecryptor(rd)
+//    err = c.Unwrap("SHA256:...", d, nil)
+
+package sign
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// ParseIdentity() prefix of a key held by the agent: "agent:FP"
+const AgentIdentityPrefix = "agent:"
+
+// request to the agent
+type agentRequest struct {
+	Op      string `json:"op"`
+	Key     string `json:"key,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Sk      []byte `json:"sk,omitempty"`
+	Xsk     []byte `json:"xsk,omitempty"`
+	Pub     string `json:"pub,omitempty"`
+	TTL     int64  `json:"ttl,omitempty"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+// reply of the agent
+type agentReply struct {
+	Error string          `json:"error,omitempty"`
+	Data  [][]byte        `json:"data,omitempty"`
+	Keys  []*agentKeyInfo `json:"keys,omitempty"`
+}
+
+// a key in the reply to "list"
+type agentKeyInfo struct {
+	Pub     string `json:"pub"`
+	Expires string `json:"expires,omitempty"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+// AgentSocket returns the path of the agent socket: $SIGTOOL_AUTH_SOCK,
+// sigtool-agent.sock in $XDG_RUNTIME_DIR or agent.sock in the directory
+// sigtool-UID of the temporary directory.
+func AgentSocket() string {
+	if s := os.Getenv("SIGTOOL_AUTH_SOCK"); len(s) > 0 {
+		return s
+	}
+	if d := os.Getenv("XDG_RUNTIME_DIR"); len(d) > 0 {
+		return filepath.Join(d, "sigtool-agent.sock")
+	}
+	return filepath.Join(agentTempDir(), "agent.sock")
+}
+
+// our directory for the agent socket in the temporary directory
+func agentTempDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sigtool-%d", os.Getuid()))
+}
+
+// ListenAgent listens on the unix socket 'path' for the clients of an
+// agent; the socket is created with mode 0600. The directory of the
+// default socket in the temporary directory is created with mode 0700;
+// it is refused if it isn't ours.
+func ListenAgent(path string) (net.Listener, error) {
+	if dir := filepath.Dir(path); dir == agentTempDir() {
+		if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+		if err := checkPrivate(dir, os.ModeDir); err != nil {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+	}
+
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("agent: %s", err)
+	}
+	return ln, nil
+}
+
+// Agent holds private keys and answers the requests of clients
+type Agent struct {
+	// Confirm is called before each use of a key added with
+	// confirmation; the use is refused unless it returns true.
+	Confirm func(pk *PublicKey, op string) bool
+
+	sync.Mutex
+	keys []*agentKey
+}
+
+// a key held by the agent
+type agentKey struct {
+	sk      *PrivateKey
+	expires time.Time
+	confirm bool
+}
+
+// NewAgent makes an agent without any keys
+func NewAgent() *Agent {
+	return &Agent{}
+}
+
+// Serve the clients connecting to 'ln' until it is closed
+func (a *Agent) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go a.serveConn(c)
+	}
+}
+
+// answer the requests of one client
+func (a *Agent) serveConn(c net.Conn) {
+	defer c.Close()
+
+	dec := json.NewDecoder(c)
+	enc := json.NewEncoder(c)
+	for {
+		var req agentRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				debug(nil, "agent: bad request", "err", err)
+			}
+			return
+		}
+
+		r, err := a.handle(&req)
+		if err != nil {
+			r = &agentReply{Error: err.Error()}
+		}
+
+		debug(nil, "agent: request", "op", req.Op, "key", req.Key, "err", err)
+		if err = enc.Encode(r); err != nil {
+			return
+		}
+	}
+}
+
+func (a *Agent) handle(req *agentRequest) (*agentReply, error) {
+	switch req.Op {
+	case "add":
+		return &agentReply{}, a.add(req)
+	case "list":
+		return a.list(), nil
+	case "remove":
+		return &agentReply{}, a.remove(req.Key)
+	case "sign", "x25519":
+		return a.use(req)
+	default:
+		return nil, fmt.Errorf("agent: unknown request %q", req.Op)
+	}
+}
+
+// add a key
+func (a *Agent) add(req *agentRequest) error {
+	sk, err := PrivateKeyFromBytes(req.Sk)
+	if err != nil {
+		return fmt.Errorf("agent: %s", err)
+	}
+
+	pk, err := MakePublicKey([]byte(req.Pub))
+	if err != nil {
+		return fmt.Errorf("agent: %s", err)
+	}
+
+	if !bytes.Equal(pk.Pk, sk.pk.Pk) {
+		return fmt.Errorf("agent: public key doesn't match the private key")
+	}
+
+	if req.Xsk != nil {
+		xpk, err := x25519Public(req.Xsk)
+		if err != nil || !bytes.Equal(xpk, pk.xpk) {
+			return fmt.Errorf("agent: X25519 key doesn't match the public key")
+		}
+		sk.xsk = req.Xsk
+	}
+
+	sk.pk = pk
+	sk.Usage = pk.Usage
+
+	k := &agentKey{
+		sk:      sk,
+		confirm: req.Confirm,
+	}
+	if req.TTL > 0 {
+		k.expires = time.Now().Add(time.Duration(req.TTL) * time.Second)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.expire()
+	fp := pk.Fingerprint()
+	for i, o := range a.keys {
+		if o.sk.pk.MatchPin(fp) {
+			o.wipe()
+			a.keys[i] = k
+			return nil
+		}
+	}
+	a.keys = append(a.keys, k)
+	return nil
+}
+
+// list the keys
+func (a *Agent) list() *agentReply {
+	a.Lock()
+	defer a.Unlock()
+
+	a.expire()
+	r := &agentReply{}
+	for _, k := range a.keys {
+		pub, err := k.sk.pk.Marshal(k.sk.pk.Comment)
+		if err != nil {
+			continue
+		}
+
+		ki := &agentKeyInfo{
+			Pub:     string(pub),
+			Confirm: k.confirm,
+		}
+		if !k.expires.IsZero() {
+			ki.Expires = k.expires.UTC().Format(time.RFC3339)
+		}
+		r.Keys = append(r.Keys, ki)
+	}
+	return r
+}
+
+// remove the key with fingerprint 'fp'; all keys if 'fp' is empty
+func (a *Agent) remove(fp string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	keys := a.keys[:0]
+	for _, k := range a.keys {
+		if len(fp) == 0 || k.sk.pk.MatchPin(fp) {
+			k.wipe()
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	if len(fp) > 0 && len(keys) == len(a.keys) {
+		return fmt.Errorf("agent: no key %s", fp)
+	}
+	a.keys = keys
+	return nil
+}
+
+// sign or compute shared secrets with a key
+func (a *Agent) use(req *agentRequest) (*agentReply, error) {
+	a.Lock()
+	a.expire()
+	var k *agentKey
+	for _, x := range a.keys {
+		if x.sk.pk.MatchPin(req.Key) {
+			k = x
+		}
+	}
+	a.Unlock()
+
+	if k == nil {
+		return nil, fmt.Errorf("agent: no key %s", req.Key)
+	}
+
+	if k.confirm && (a.Confirm == nil || !a.Confirm(k.sk.pk, req.Op)) {
+		return nil, fmt.Errorf("agent: use of key %s not confirmed", req.Key)
+	}
+
+	// the key may have been removed while waiting for the confirmation
+	a.Lock()
+	defer a.Unlock()
+	if !a.holds(k) {
+		return nil, fmt.Errorf("agent: no key %s", req.Key)
+	}
+
+	r := &agentReply{}
+	switch req.Op {
+	case "sign":
+		if err := k.sk.checkUsage(UsageSign); err != nil {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+
+		sig, err := k.sk.ed25519Sign(req.Data)
+		if err != nil {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+		r.Data = [][]byte{sig}
+
+	case "x25519":
+		if err := k.sk.checkUsage(UsageEncrypt); err != nil {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+
+		for _, xsk := range k.sk.encryptionKeys() {
+			s, err := x25519(xsk, req.Data)
+			if err != nil {
+				return nil, fmt.Errorf("agent: %s", err)
+			}
+			r.Data = append(r.Data, s)
+		}
+	}
+	return r, nil
+}
+
+// true if 'k' is still held; must be called with the lock held
+func (a *Agent) holds(k *agentKey) bool {
+	for _, x := range a.keys {
+		if x == k {
+			return true
+		}
+	}
+	return false
+}
+
+// drop the expired keys; must be called with the lock held
+func (a *Agent) expire() {
+	now := time.Now()
+	keys := a.keys[:0]
+	for _, k := range a.keys {
+		if !k.expires.IsZero() && now.After(k.expires) {
+			k.wipe()
+			continue
+		}
+		keys = append(keys, k)
+	}
+	a.keys = keys
+}
+
+// clear the private key material
+func (k *agentKey) wipe() {
+	for _, b := range [][]byte{k.sk.Sk, k.sk.xsk, k.sk.ck} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
+
+// AgentClient talks to the agent listening on a unix socket
+type AgentClient struct {
+	// Timeout of each request; zero means no timeout. Requests for keys
+	// that need confirmation wait for the user.
+	Timeout time.Duration
+
+	path string
+
+	// connection to a remote agent; nil for the agent at 'path'
+	pipe *agentPipe
+
+	// shared secrets of the last x25519 request; a file has one sender
+	// key for all of its wrapped keys
+	sync.Mutex
+	fp     string
+	peer   []byte
+	shared [][]byte
+}
+
+// AgentKey is a key held by the agent
+type AgentKey struct {
+	PublicKey *PublicKey
+
+	// Time the agent drops the key; zero if it doesn't
+	Expires time.Time
+
+	// Every use of the key must be confirmed
+	Confirm bool
+}
+
+// NewAgentClient makes a client of the agent at the socket 'path'
+func NewAgentClient(path string) *AgentClient {
+	return &AgentClient{path: path}
+}
+
+// DialAgent makes a client of the agent at AgentSocket() and checks that
+// the agent is running.
+func DialAgent() (*AgentClient, error) {
+	c := NewAgentClient(AgentSocket())
+	if _, err := c.call(&agentRequest{Op: "list"}); err != nil {
+		return nil, fmt.Errorf("%s (is $SIGTOOL_AUTH_SOCK set?)", err)
+	}
+	return c, nil
+}
+
+// send a request to the agent and return its reply
+func (c *AgentClient) call(req *agentRequest) (*agentReply, error) {
+	var r *agentReply
+	var err error
+
+	if c.pipe != nil {
+		r, err = c.pipe.call(req, c.Timeout)
+	} else {
+		r, err = c.dial(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Error) > 0 {
+		return nil, fmt.Errorf("%s", r.Error)
+	}
+	return r, nil
+}
+
+// send a request to the agent at the socket and return its reply; the
+// socket must be ours and closed to others, else another user could
+// pose as the agent and collect our keys.
+func (c *AgentClient) dial(req *agentRequest) (*agentReply, error) {
+	if err := checkPrivate(c.path, os.ModeSocket); err != nil {
+		return nil, fmt.Errorf("agent: %s", err)
+	}
+
+	conn, err := net.Dial("unix", c.path)
+	if err != nil {
+		return nil, fmt.Errorf("agent: %s", err)
+	}
+	defer conn.Close()
+
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("agent: %s", err)
+	}
+
+	var r agentReply
+	if err = json.NewDecoder(conn).Decode(&r); err != nil {
+		return nil, fmt.Errorf("agent: %s", err)
+	}
+	return &r, nil
+}
+
+// Close the connection to a remote agent
+func (c *AgentClient) Close() error {
+	if c.pipe != nil {
+		return c.pipe.close()
+	}
+	return nil
+}
+
+// Add the private key 'sk' to the agent; it is dropped after 'ttl' (if
+// non-zero) and each use must be confirmed if 'confirm' is true.
+func (c *AgentClient) Add(sk *PrivateKey, ttl time.Duration, confirm bool) error {
+	if sk.Sk == nil {
+		return fmt.Errorf("agent: only Ed25519 private keys can be added")
+	}
+
+	pub, err := sk.pk.Marshal(sk.pk.Comment)
+	if err != nil {
+		return fmt.Errorf("agent: %s", err)
+	}
+
+	req := &agentRequest{
+		Op:      "add",
+		Sk:      sk.Sk,
+		Xsk:     sk.xsk,
+		Pub:     string(pub),
+		TTL:     int64(ttl / time.Second),
+		Confirm: confirm,
+	}
+
+	_, err = c.call(req)
+	return err
+}
+
+// List the keys held by the agent
+func (c *AgentClient) List() ([]*AgentKey, error) {
+	r, err := c.call(&agentRequest{Op: "list"})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*AgentKey, 0, len(r.Keys))
+	for _, ki := range r.Keys {
+		pk, err := MakePublicKey([]byte(ki.Pub))
+		if err != nil {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+
+		k := &AgentKey{
+			PublicKey: pk,
+			Confirm:   ki.Confirm,
+		}
+		if len(ki.Expires) > 0 {
+			if k.Expires, err = time.Parse(time.RFC3339, ki.Expires); err != nil {
+				return nil, fmt.Errorf("agent: invalid time %q", ki.Expires)
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Remove the key with fingerprint 'fp' from the agent; all keys are
+// removed if 'fp' is empty.
+func (c *AgentClient) Remove(fp string) error {
+	_, err := c.call(&agentRequest{Op: "remove", Key: fp})
+	return err
+}
+
+// PrivateKey returns a private key whose operations are done by the agent
+// with its key with fingerprint 'fp'; 'fp' may be empty if the agent
+// holds a single key.
+func (c *AgentClient) PrivateKey(fp string) (*PrivateKey, error) {
+	keys, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var pk *PublicKey
+	for _, k := range keys {
+		if len(fp) == 0 || k.PublicKey.MatchPin(fp) {
+			if pk != nil {
+				return nil, fmt.Errorf("agent: holds several keys; use %sFP", AgentIdentityPrefix)
+			}
+			pk = k.PublicKey
+		}
+	}
+
+	if pk == nil {
+		return nil, fmt.Errorf("agent: no key %s", fp)
+	}
+
+	sk := &PrivateKey{
+		Usage: pk.Usage,
+		pk:    pk,
+		agent: c,
+	}
+	return sk, nil
+}
+
+// Sign the checksum 'ck' (see SignMessage()) with the key with
+// fingerprint 'fp' held by the agent
+func (c *AgentClient) Sign(fp string, ck []byte, comment string) (*Signature, error) {
+	sk, err := c.PrivateKey(fp)
+	if err != nil {
+		return nil, err
+	}
+	return sk.SignMessage(ck, comment)
+}
+
+// Unwrap the file key of the decryptor 'd' with the key with fingerprint
+// 'fp' held by the agent; the sender is validated if 'senderPk' is not
+// nil. 'd' can then decrypt the file.
+func (c *AgentClient) Unwrap(fp string, d *Decryptor, senderPk *PublicKey) error {
+	sk, err := c.PrivateKey(fp)
+	if err != nil {
+		return err
+	}
+	return d.SetPrivateKey(sk, senderPk)
+}
+
+// sign 'm' with the key 'pk'
+func (c *AgentClient) sign(pk *PublicKey, m []byte) ([]byte, error) {
+	r, err := c.call(&agentRequest{Op: "sign", Key: pk.Fingerprint(), Data: m})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Data) != 1 {
+		return nil, fmt.Errorf("agent: malformed reply")
+	}
+	return r.Data[0], nil
+}
+
+// shared secrets of the encryption keys of 'pk' and 'peer'
+func (c *AgentClient) x25519(pk *PublicKey, peer []byte) ([][]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	fp := pk.Fingerprint()
+	if c.shared != nil && c.fp == fp && bytes.Equal(c.peer, peer) {
+		return c.shared, nil
+	}
+
+	r, err := c.call(&agentRequest{Op: "x25519", Key: fp, Data: peer})
+	if err != nil {
+		return nil, err
+	}
+
+	c.fp = fp
+	c.peer = append([]byte{}, peer...)
+	c.shared = r.Data
+	return r.Data, nil
+}
+
+// parse an agent identity "agent:FP"
+func parseAgentIdentity(s string) (*PrivateKey, error) {
+	fp := strings.TrimPrefix(s, AgentIdentityPrefix)
+	return NewAgentClient(AgentSocket()).PrivateKey(fp)
+}
+
+// unwrap the key in 'w' with the shared secrets computed by the agent
+func (d *Decryptor) unwrapAgent(w *pb.WrappedKey, sk *PrivateKey) ([]byte, error) {
+	shared, err := sk.agent.x25519(sk.pk, d.Pk)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap: %s", err)
+	}
+
+	for _, s := range shared {
+		kek, err := d.wrapKEK(s)
+		if err != nil {
+			return nil, err
+		}
+
+		dkey, err := d.unwrapShared(w, kek, sk.pk)
+		if dkey != nil || err != nil {
+			return dkey, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,365 @@
+// allowed.go -- OpenSSH allowed_signers files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An allowed_signers file (see ssh-keygen(1)) lists the keys trusted to
+// make signatures; each line is:
+//
+//    principals [options] keytype base64-key [comment]
+//
+// principals is a comma separated list of patterns; the supported options
+// are 'namespaces', 'valid-after', 'valid-before' and 'cert-authority'.
+// Only ed25519 keys are used; lines with other key types and certificate
+// authorities are ignored.
+
+package sign
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// AllowedSigner is one entry of an allowed_signers file
+type AllowedSigner struct {
+	// Principal patterns of this signer
+	Principals []string
+
+	// Namespaces in which the key is trusted; empty means all namespaces
+	Namespaces []string
+
+	// The key is trusted only in the time interval [ValidAfter, ValidBefore)
+	// when these are set.
+	ValidAfter  time.Time
+	ValidBefore time.Time
+
+	// Trusted public key
+	PublicKey *PublicKey
+}
+
+// ReadAllowedSigners reads an allowed_signers file
+func ReadAllowedSigners(fn string) ([]*AllowedSigner, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	as, err := ParseAllowedSigners(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return as, nil
+}
+
+// ParseAllowedSigners parses the contents of an allowed_signers file
+func ParseAllowedSigners(in []byte) ([]*AllowedSigner, error) {
+	var as []*AllowedSigner
+
+	for n, line := range bytes.Split(in, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		a, err := parseAllowedSigner(line)
+		if err != nil {
+			return nil, fmt.Errorf("allowed signers: line %d: %s", n+1, err)
+		}
+		if a != nil {
+			as = append(as, a)
+		}
+	}
+	return as, nil
+}
+
+// parse one line; returns nil for lines we don't support
+func parseAllowedSigner(line []byte) (*AllowedSigner, error) {
+	princ, rest := nextField(line)
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("missing public key")
+	}
+
+	a := &AllowedSigner{
+		Principals: strings.Split(unquote(string(princ)), ","),
+	}
+
+	// the optional options field; a key type never has an '='
+	opts, after := nextField(rest)
+	if !isKeyType(string(opts)) {
+		ca, err := a.parseOptions(string(opts))
+		if err != nil {
+			return nil, err
+		}
+		if ca {
+			return nil, nil
+		}
+		rest = after
+	}
+
+	keytype, rest := nextField(rest)
+	key, comment := nextField(rest)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("missing public key")
+	}
+
+	if string(keytype) != "ssh-ed25519" {
+		if !isKeyType(string(keytype)) {
+			return nil, fmt.Errorf("unknown key type %q", keytype)
+		}
+		return nil, nil
+	}
+
+	pk, err := parseEncPubKey(key, string(comment))
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, fmt.Errorf("key is not an ed25519 key")
+	}
+
+	a.PublicKey = pk
+	return a, nil
+}
+
+// parse the options field; return true if this is a cert-authority
+func (a *AllowedSigner) parseOptions(opts string) (bool, error) {
+	var ca bool
+
+	for _, o := range splitOptions(opts) {
+		var k, v string
+		if i := strings.IndexByte(o, '='); i > 0 {
+			k, v = strings.ToLower(o[:i]), unquote(o[i+1:])
+		} else {
+			k = strings.ToLower(o)
+		}
+
+		var err error
+		switch k {
+		case "cert-authority":
+			ca = true
+		case "namespaces":
+			a.Namespaces = strings.Split(v, ",")
+		case "valid-after":
+			a.ValidAfter, err = ParseSSHTime(v)
+		case "valid-before":
+			a.ValidBefore, err = ParseSSHTime(v)
+		default:
+			err = fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return ca, nil
+}
+
+// MatchPrincipal returns true if 'p' matches the principals of 'a'
+func (a *AllowedSigner) MatchPrincipal(p string) bool {
+	return matchPatternList(p, a.Principals)
+}
+
+// Allows returns true if 'a' trusts the key 'pk' to sign for principal 'p'
+// in namespace 'ns' at time 't'.
+func (a *AllowedSigner) Allows(pk *PublicKey, p, ns string, t time.Time) bool {
+	if !bytes.Equal(a.PublicKey.Pk, pk.Pk) {
+		return false
+	}
+
+	if !a.validAt(t) || !a.MatchPrincipal(p) {
+		return false
+	}
+
+	if len(a.Namespaces) == 0 {
+		return true
+	}
+	return matchPatternList(ns, a.Namespaces)
+}
+
+func (a *AllowedSigner) validAt(t time.Time) bool {
+	if !a.ValidAfter.IsZero() && t.Before(a.ValidAfter) {
+		return false
+	}
+	if !a.ValidBefore.IsZero() && !t.Before(a.ValidBefore) {
+		return false
+	}
+	return true
+}
+
+// TrustedKeys returns the keys in 'as' that are trusted to sign for
+// principal 'p' in namespace 'ns' at time 't'. An empty principal matches
+// every entry. Keys without a comment are labeled with their principals.
+func TrustedKeys(as []*AllowedSigner, p, ns string, t time.Time) []*PublicKey {
+	var pks []*PublicKey
+	for _, a := range as {
+		if len(p) == 0 {
+			if !a.allowsAny(ns, t) {
+				continue
+			}
+		} else if !a.Allows(a.PublicKey, p, ns, t) {
+			continue
+		}
+
+		pk := *a.PublicKey
+		if len(pk.Comment) == 0 {
+			pk.Comment = strings.Join(a.Principals, ",")
+		}
+		pks = append(pks, &pk)
+	}
+	return pks
+}
+
+// return true if 'a' is valid in namespace 'ns' at time 't' for some
+// principal
+func (a *AllowedSigner) allowsAny(ns string, t time.Time) bool {
+	if !a.validAt(t) {
+		return false
+	}
+	return len(a.Namespaces) == 0 || matchPatternList(ns, a.Namespaces)
+}
+
+// FindPrincipals returns the principals of all entries in 'as' that trust
+// key 'pk' at time 't'.
+func FindPrincipals(as []*AllowedSigner, pk *PublicKey, t time.Time) []string {
+	var p []string
+	for _, a := range as {
+		if bytes.Equal(a.PublicKey.Pk, pk.Pk) && a.validAt(t) {
+			p = append(p, strings.Join(a.Principals, ","))
+		}
+	}
+	return p
+}
+
+// ParseSSHTime parses a time in the format used by ssh-keygen(1):
+// YYYYMMDD[HHMM[SS]] in local time or UTC if suffixed with 'Z'.
+func ParseSSHTime(s string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+		loc = time.UTC
+		s = s[:len(s)-1]
+	}
+
+	var layout string
+	switch len(s) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+
+	t, err := time.ParseInLocation(layout, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+// match 's' against a comma separated list of patterns with optional
+// negation ('!'); a negated match always fails.
+func matchPatternList(s string, pats []string) bool {
+	var ok bool
+	for _, p := range pats {
+		if strings.HasPrefix(p, "!") {
+			if matchPattern(s, p[1:]) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(s, p) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// match 's' against the wildcard pattern 'p' ('*' and '?')
+func matchPattern(s, p string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], p[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != p[0] {
+				return false
+			}
+		}
+		s, p = s[1:], p[1:]
+	}
+	return len(s) == 0
+}
+
+// return the next white space separated field (honoring double quotes)
+// and the remainder
+func nextField(in []byte) ([]byte, []byte) {
+	in = bytes.TrimLeft(in, " \t")
+
+	var quoted bool
+	for i, c := range in {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '\t'):
+			return in[:i], bytes.TrimLeft(in[i:], " \t")
+		}
+	}
+	return in, nil
+}
+
+// split the options field at commas outside quotes
+func splitOptions(s string) []string {
+	var v []string
+	var quoted bool
+
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				v = append(v, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(v, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func isKeyType(s string) bool {
+	for _, p := range []string{"ssh-", "ecdsa-", "sk-", "rsa-"} {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,602 @@
+// archive.go -- encrypted archive of several named files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An archive is an ordinary encrypted file whose plaintext is an index
+// followed by the contents of each member:
+//
+//    "SIGARCH2" || uint32_be(len(index)) || index || data..
+//
+//    index  = uint32_be(n) || member * n
+//    member = uint16_be(len(name)) || name || uint64_be(size) ||
+//             uint32_be(mode) || int64_be(mtime) || uint8(flags) ||
+//             [uint32_be(uid) || uint32_be(gid)] ||
+//             [uint16_be(len(link)) || link] ||
+//             uint16_be(nxattr) || xattr * nxattr
+//    xattr  = uint16_be(len(name)) || name || uint32_be(len(value)) || value
+//
+// The uid and gid are only present if bit 0 of flags is set and the link
+// if bit 1 is set. Mode has the os.FileMode bits; the link of a symlink is
+// its target and that of any other member makes it a hard link to an
+// earlier file. Directories, symlinks and hard links have no data.
+// Archives written before
+// ownership and extended attributes were added have the magic "SIGARCH1",
+// only the permission bits in mode and end each member after the mtime.
+//
+// The members are stored in the order of the index; so the plaintext
+// offset of every member is known once the index is read. Since each
+// chunk is encrypted with its own nonce, an ArchiveReader decrypts only
+// the chunks that hold the index and the requested member.
+
+package sign
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	_ArchiveMagic    = "SIGARCH2"
+	_ArchiveMagicV1  = "SIGARCH1"
+	_ArchiveHdrLen   = len(_ArchiveMagic) + 4
+	_maxArchiveIndex = 64 * 1048576
+
+	_ArchiveOwner = 1 << 0
+	_ArchiveLink  = 1 << 1
+)
+
+// ArchiveMember describes a file or directory in an encrypted archive
+type ArchiveMember struct {
+	// Name is a relative path with '/' as the separator
+	Name string
+
+	Size    int64
+	Mode    uint32 // os.FileMode bits
+	ModTime int64  // seconds since the Unix epoch
+
+	// Owner and group; only valid if HasOwner is true
+	HasOwner bool
+	Uid      uint32
+	Gid      uint32
+
+	// Extended attributes (POSIX ACLs are the system.posix_acl_* attributes)
+	Xattrs map[string][]byte
+
+	// Target of a symlink or the name of the earlier member that a hard
+	// link refers to
+	Link string
+
+	// offset of the data in the plaintext
+	off int64
+}
+
+// IsDir returns true if the member is a directory
+func (m *ArchiveMember) IsDir() bool {
+	return os.FileMode(m.Mode).IsDir()
+}
+
+// IsSymlink returns true if the member is a symbolic link
+func (m *ArchiveMember) IsSymlink() bool {
+	return os.FileMode(m.Mode)&os.ModeSymlink != 0
+}
+
+// IsHardlink returns true if the member is a hard link to an earlier file
+func (m *ArchiveMember) IsHardlink() bool {
+	return len(m.Link) > 0 && !m.IsSymlink()
+}
+
+// return true if the member has data in the archive
+func (m *ArchiveMember) hasData() bool {
+	return !m.IsDir() && len(m.Link) == 0
+}
+
+// check a member against the members before it
+func (m *ArchiveMember) check(prev map[string]*ArchiveMember) error {
+	if err := validMemberName(m.Name); err != nil {
+		return err
+	}
+	if prev[m.Name] != nil {
+		return fmt.Errorf("duplicate member %s", m.Name)
+	}
+	if m.Size < 0 || (!m.hasData() && m.Size != 0) {
+		return fmt.Errorf("%s: invalid size %d", m.Name, m.Size)
+	}
+
+	switch {
+	case m.IsSymlink():
+		if len(m.Link) == 0 || len(m.Link) > 65535 || strings.ContainsRune(m.Link, 0) {
+			return fmt.Errorf("%s: invalid symlink target", m.Name)
+		}
+	case m.IsHardlink():
+		t := prev[m.Link]
+		if m.IsDir() || t == nil || !t.hasData() {
+			return fmt.Errorf("%s: hard link to %s is not a link to an earlier file", m.Name, m.Link)
+		}
+	}
+
+	if len(m.Xattrs) > 65535 {
+		return fmt.Errorf("%s: too many extended attributes", m.Name)
+	}
+	for k, v := range m.Xattrs {
+		if len(k) == 0 || len(k) > 65535 || int64(len(v)) > 1<<32-1 {
+			return fmt.Errorf("%s: invalid extended attribute %q", m.Name, k)
+		}
+	}
+	return nil
+}
+
+// ArchiveFile is a file to be added to an archive. Open is called when
+// its contents are needed; it must return exactly Size bytes. Directories
+// have no contents.
+type ArchiveFile struct {
+	ArchiveMember
+
+	Open func() (io.ReadCloser, error)
+}
+
+// EncryptArchive encrypts 'files' as an archive and writes it to 'wr'
+func (e *Encryptor) EncryptArchive(files []ArchiveFile, wr io.WriteCloser) error {
+	seen := make(map[string]*ArchiveMember)
+	for i := range files {
+		f := &files[i]
+		if err := f.check(seen); err != nil {
+			return fmt.Errorf("encrypt: archive: %s", err)
+		}
+		if f.Open == nil && f.hasData() {
+			return fmt.Errorf("encrypt: archive: %s: no way to open it", f.Name)
+		}
+		seen[f.Name] = &f.ArchiveMember
+	}
+
+	rd := &archiveStream{
+		files: files,
+		hdr:   marshalArchiveIndex(files),
+		cur:   -1,
+	}
+	defer rd.close()
+
+	info(e.log, "encrypt: archive", "members", len(files), "index", len(rd.hdr))
+	return e.Encrypt(rd, wr)
+}
+
+func marshalArchiveIndex(files []ArchiveFile) []byte {
+	var b [8]byte
+
+	idx := make([]byte, _ArchiveHdrLen+4)
+	binary.BigEndian.PutUint32(idx[_ArchiveHdrLen:], uint32(len(files)))
+	for i := range files {
+		f := &files[i]
+
+		binary.BigEndian.PutUint16(b[:2], uint16(len(f.Name)))
+		idx = append(idx, b[:2]...)
+		idx = append(idx, f.Name...)
+
+		binary.BigEndian.PutUint64(b[:], uint64(f.Size))
+		idx = append(idx, b[:]...)
+		binary.BigEndian.PutUint32(b[:4], f.Mode)
+		idx = append(idx, b[:4]...)
+		binary.BigEndian.PutUint64(b[:], uint64(f.ModTime))
+		idx = append(idx, b[:]...)
+
+		var flags uint8
+		if f.HasOwner {
+			flags |= _ArchiveOwner
+		}
+		if len(f.Link) > 0 {
+			flags |= _ArchiveLink
+		}
+		idx = append(idx, flags)
+
+		if f.HasOwner {
+			binary.BigEndian.PutUint32(b[:4], f.Uid)
+			binary.BigEndian.PutUint32(b[4:], f.Gid)
+			idx = append(idx, b[:]...)
+		}
+		if len(f.Link) > 0 {
+			binary.BigEndian.PutUint16(b[:2], uint16(len(f.Link)))
+			idx = append(idx, b[:2]...)
+			idx = append(idx, f.Link...)
+		}
+
+		// sorted; so that the same tree gives the same index
+		keys := make([]string, 0, len(f.Xattrs))
+		for k := range f.Xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		binary.BigEndian.PutUint16(b[:2], uint16(len(keys)))
+		idx = append(idx, b[:2]...)
+		for _, k := range keys {
+			v := f.Xattrs[k]
+			binary.BigEndian.PutUint16(b[:2], uint16(len(k)))
+			idx = append(idx, b[:2]...)
+			idx = append(idx, k...)
+			binary.BigEndian.PutUint32(b[:4], uint32(len(v)))
+			idx = append(idx, b[:4]...)
+			idx = append(idx, v...)
+		}
+	}
+
+	copy(idx, _ArchiveMagic)
+	binary.BigEndian.PutUint32(idx[len(_ArchiveMagic):], uint32(len(idx)-_ArchiveHdrLen))
+	return idx
+}
+
+// archiveStream is the plaintext of an archive: the index followed by the
+// contents of each file, opened one at a time.
+type archiveStream struct {
+	files []ArchiveFile
+	hdr   []byte
+	cur   int
+	fd    io.ReadCloser
+	left  int64
+}
+
+func (s *archiveStream) Read(b []byte) (int, error) {
+	if len(s.hdr) > 0 {
+		n := copy(b, s.hdr)
+		s.hdr = s.hdr[n:]
+		return n, nil
+	}
+
+	for s.left == 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > s.left {
+		b = b[:s.left]
+	}
+
+	n, err := s.fd.Read(b)
+	s.left -= int64(n)
+	if err == io.EOF {
+		if s.left > 0 {
+			return n, fmt.Errorf("archive: %s: file is shorter than %d bytes", s.files[s.cur].Name, s.files[s.cur].Size)
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// finish the current file and open the next one
+func (s *archiveStream) next() error {
+	if s.fd != nil {
+		// the file must not have grown
+		var x [1]byte
+		if n, _ := io.ReadFull(s.fd, x[:]); n > 0 {
+			return fmt.Errorf("archive: %s: file is longer than %d bytes", s.files[s.cur].Name, s.files[s.cur].Size)
+		}
+		s.close()
+	}
+
+	s.cur++
+	if s.cur >= len(s.files) {
+		return io.EOF
+	}
+
+	f := &s.files[s.cur]
+	if !f.hasData() {
+		return nil
+	}
+
+	fd, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("archive: %s: %s", f.Name, err)
+	}
+
+	s.fd = fd
+	s.left = f.Size
+	return nil
+}
+
+func (s *archiveStream) close() {
+	if s.fd != nil {
+		s.fd.Close()
+		s.fd = nil
+	}
+}
+
+// ArchiveReader reads the members of an encrypted archive
+type ArchiveReader struct {
+	// Members of the archive in the order they are stored
+	Members []ArchiveMember
+
+	d    *Decryptor
+	ra   io.ReaderAt
+	size int64 // plaintext size
+	last int64
+
+	// the most recently decrypted chunk
+	cur  int64
+	data []byte
+}
+
+// NewArchiveReader reads the index of the archive 'ra' of 'size' bytes.
+// The private key must have been set with SetPrivateKey(); only the chunks
+// holding the index are decrypted.
+func (d *Decryptor) NewArchiveReader(ra io.ReaderAt, size int64) (*ArchiveReader, error) {
+	if d.key == nil {
+		return nil, fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
+	}
+
+	if d.stream || d.eof {
+		return nil, fmt.Errorf("decrypt: can't read an archive after using Decrypt() or streaming I/O")
+	}
+
+	psize, err := decryptedSize(d.hdrlen, d.ChunkSize, d.Chunking, size)
+	if err != nil {
+		return nil, err
+	}
+	if psize < int64(_ArchiveHdrLen) {
+		return nil, fmt.Errorf("decrypt: not an archive")
+	}
+
+	d.stream = true
+	a := &ArchiveReader{
+		d:    d,
+		ra:   ra,
+		size: psize,
+		last: (psize - 1) / int64(d.ChunkSize),
+		cur:  -1,
+	}
+
+	if err := a.readIndex(); err != nil {
+		return nil, err
+	}
+
+	info(d.log, "decrypt: archive", "members", len(a.Members))
+	return a, nil
+}
+
+// Member returns the member called 'name'
+func (a *ArchiveReader) Member(name string) (*ArchiveMember, error) {
+	for i := range a.Members {
+		m := &a.Members[i]
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("decrypt: archive: no member %s", name)
+}
+
+// Open returns a reader for the contents of member 'name'; the contents of
+// a hard link are those of the file it refers to.
+func (a *ArchiveReader) Open(name string) (io.Reader, error) {
+	m, err := a.Member(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.IsHardlink() {
+		if m, err = a.Member(m.Link); err != nil {
+			return nil, err
+		}
+	}
+	return io.NewSectionReader(&archivePlaintext{a}, m.off, m.Size), nil
+}
+
+// Extract decrypts member 'name' and writes it to 'wr'
+func (a *ArchiveReader) Extract(name string, wr io.Writer) error {
+	rd, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(wr, rd); err != nil {
+		return fmt.Errorf("decrypt: archive: %s: %s", name, err)
+	}
+	return nil
+}
+
+func (a *ArchiveReader) readIndex() error {
+	var hdr [_ArchiveHdrLen]byte
+
+	if err := a.readAt(hdr[:], 0); err != nil {
+		return err
+	}
+
+	var v1 bool
+	switch string(hdr[:len(_ArchiveMagic)]) {
+	case _ArchiveMagic:
+	case _ArchiveMagicV1:
+		v1 = true
+	default:
+		return fmt.Errorf("decrypt: not an archive")
+	}
+
+	n := int64(binary.BigEndian.Uint32(hdr[len(_ArchiveMagic):]))
+	if n < 4 || n > _maxArchiveIndex || n > a.size-int64(_ArchiveHdrLen) {
+		return fmt.Errorf("decrypt: archive: invalid index size %d", n)
+	}
+
+	b := make([]byte, n)
+	if err := a.readAt(b, int64(_ArchiveHdrLen)); err != nil {
+		return err
+	}
+
+	off := int64(_ArchiveHdrLen) + n
+	errIdx := fmt.Errorf("decrypt: archive: index corrupted")
+	idx := &indexDecoder{b: b}
+
+	nm := idx.u32()
+	seen := make(map[string]*ArchiveMember)
+	for i := uint32(0); i < nm && !idx.bad; i++ {
+		m := ArchiveMember{
+			Name:    string(idx.bytes(int(idx.u16()))),
+			Size:    int64(idx.u64()),
+			Mode:    idx.u32(),
+			ModTime: int64(idx.u64()),
+			off:     off,
+		}
+
+		if !v1 {
+			flags := idx.u8()
+			if flags&_ArchiveOwner != 0 {
+				m.HasOwner = true
+				m.Uid = idx.u32()
+				m.Gid = idx.u32()
+			}
+			if flags&_ArchiveLink != 0 {
+				m.Link = string(idx.bytes(int(idx.u16())))
+			}
+
+			nx := int(idx.u16())
+			if nx > 0 {
+				m.Xattrs = make(map[string][]byte, nx)
+			}
+			for j := 0; j < nx && !idx.bad; j++ {
+				k := string(idx.bytes(int(idx.u16())))
+				m.Xattrs[k] = idx.bytes(int(idx.u32()))
+			}
+		}
+
+		if idx.bad || m.check(seen) != nil || m.Size > a.size-off {
+			return errIdx
+		}
+
+		off += m.Size
+		a.Members = append(a.Members, m)
+		seen[m.Name] = &m
+	}
+
+	if idx.bad || len(idx.b) != 0 || off != a.size {
+		return errIdx
+	}
+	return nil
+}
+
+// indexDecoder reads the fields of the archive index; reading past the
+// end sets 'bad'.
+type indexDecoder struct {
+	b   []byte
+	bad bool
+}
+
+func (x *indexDecoder) bytes(n int) []byte {
+	if x.bad || n > len(x.b) {
+		x.bad = true
+		return nil
+	}
+
+	v := x.b[:n:n]
+	x.b = x.b[n:]
+	return v
+}
+
+func (x *indexDecoder) u8() uint8 {
+	if b := x.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (x *indexDecoder) u16() uint16 {
+	if b := x.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (x *indexDecoder) u32() uint32 {
+	if b := x.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (x *indexDecoder) u64() uint64 {
+	if b := x.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// read len(b) bytes of plaintext at offset 'off'
+func (a *ArchiveReader) readAt(b []byte, off int64) error {
+	for len(b) > 0 {
+		i := off / int64(a.d.ChunkSize)
+		if err := a.chunk(i); err != nil {
+			return err
+		}
+
+		n := copy(b, a.data[off-i*int64(a.d.ChunkSize):])
+		b = b[n:]
+		off += int64(n)
+	}
+	return nil
+}
+
+// decrypt chunk 'i' unless it is the current one
+func (a *ArchiveReader) chunk(i int64) error {
+	if i == a.cur {
+		return nil
+	}
+
+	p, err := a.d.chunkAt(a.ra, i, a.last, a.d.buf)
+	if err != nil {
+		a.cur = -1
+		return err
+	}
+
+	a.cur = i
+	a.data = p
+	return nil
+}
+
+// archivePlaintext is the io.ReaderAt for the members' section readers
+type archivePlaintext struct {
+	a *ArchiveReader
+}
+
+func (p *archivePlaintext) ReadAt(b []byte, off int64) (int, error) {
+	a := p.a
+	if off >= a.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if int64(len(b)) > a.size-off {
+		b = b[:a.size-off]
+		err = io.EOF
+	}
+
+	if e := a.readAt(b, off); e != nil {
+		return 0, e
+	}
+	return len(b), err
+}
+
+// member names are relative paths that stay below the extraction directory
+func validMemberName(nm string) error {
+	switch {
+	case len(nm) == 0 || len(nm) > 65535:
+		return fmt.Errorf("invalid member name length %d", len(nm))
+	case strings.ContainsRune(nm, 0) || strings.Contains(nm, "\\"):
+		return fmt.Errorf("invalid member name %q", nm)
+	case path.IsAbs(nm) || path.Clean(nm) != nm:
+		return fmt.Errorf("member name %q is not a clean relative path", nm)
+	case nm == "." || nm == ".." || strings.HasPrefix(nm, "../"):
+		return fmt.Errorf("member name %q is outside the archive", nm)
+	}
+	return nil
+}
+
+var _ io.Reader = &archiveStream{}
+var _ io.ReaderAt = &archivePlaintext{}
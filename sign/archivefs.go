@@ -0,0 +1,428 @@
+// archivefs.go -- a read-only fs.FS of encrypted content
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An EncryptedFS serves the members of an encrypted archive (or a single
+// encrypted file) through io/fs; http.FS(), template.ParseFS() and
+// fs.WalkDir() work on it without extracting anything to disk. Each open
+// file decrypts the chunks it reads into its own buffer; the FS itself
+// only uses a ChunkReader and is safe for concurrent use.
+//
+// Directories that hold members but aren't members themselves are made
+// up. A symlink is followed if its target is a member and left out
+// otherwise; it looks like its target (as with os.Stat) to the FS users.
+// Hard links read the contents of the file they refer to.
+
+package sign
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// maximum number of symlinks followed by Open
+const _maxFSLinks = 40
+
+// EncryptedFS is a read-only fs.FS of decrypted members
+type EncryptedFS struct {
+	c     *ChunkReader
+	nodes map[string]*fsNode
+}
+
+// a file or directory of the FS
+type fsNode struct {
+	m    *ArchiveMember
+	data *ArchiveMember // member with the contents (hard links)
+	kids []string       // sorted names of the entries of a directory
+}
+
+var _ fs.ReadDirFS = &EncryptedFS{}
+
+// NewArchiveFS returns an fs.FS of the members of the encrypted archive
+// 'ra' of 'size' bytes. The private key must have been set with
+// SetPrivateKey().
+func (d *Decryptor) NewArchiveFS(ra io.ReaderAt, size int64) (*EncryptedFS, error) {
+	a, err := d.NewArchiveReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ChunkReader{
+		d:    d,
+		ra:   ra,
+		size: a.size,
+		last: a.last,
+	}
+	return newEncryptedFS(c, a.Members)
+}
+
+// NewFileFS returns an fs.FS that has just the encrypted file 'ra' of
+// 'size' bytes; its plaintext is the file 'name'.
+func (d *Decryptor) NewFileFS(ra io.ReaderAt, size int64, name string) (*EncryptedFS, error) {
+	c, err := d.NewChunkReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	return fileFS(c, name)
+}
+
+// NewFS returns an fs.FS of the members of 'ra' if it is an encrypted
+// archive; otherwise the FS has just the decrypted file 'name'.
+func (d *Decryptor) NewFS(ra io.ReaderAt, size int64, name string) (*EncryptedFS, error) {
+	c, err := d.NewChunkReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.size >= int64(_ArchiveHdrLen) {
+		var magic [len(_ArchiveMagic)]byte
+		if _, err := c.ReadAt(magic[:], 0); err != nil {
+			return nil, err
+		}
+
+		switch string(magic[:]) {
+		case _ArchiveMagic, _ArchiveMagicV1:
+			a := &ArchiveReader{
+				d:    d,
+				ra:   ra,
+				size: c.size,
+				last: c.last,
+				cur:  -1,
+			}
+			if err := a.readIndex(); err != nil {
+				return nil, err
+			}
+			return newEncryptedFS(c, a.Members)
+		}
+	}
+
+	return fileFS(c, name)
+}
+
+// an FS with the plaintext of 'c' as the file 'name'
+func fileFS(c *ChunkReader, name string) (*EncryptedFS, error) {
+	if err := validMemberName(name); err != nil {
+		return nil, fmt.Errorf("decrypt: %s", err)
+	}
+
+	m := ArchiveMember{
+		Name:    name,
+		Size:    c.size,
+		Mode:    0444,
+		ModTime: time.Now().Unix(),
+	}
+	return newEncryptedFS(c, []ArchiveMember{m})
+}
+
+func newEncryptedFS(c *ChunkReader, members []ArchiveMember) (*EncryptedFS, error) {
+	e := &EncryptedFS{
+		c: c,
+		nodes: map[string]*fsNode{
+			".": {m: &ArchiveMember{Name: ".", Mode: uint32(fs.ModeDir | 0555)}},
+		},
+	}
+
+	for i := range members {
+		m := &members[i]
+		n := &fsNode{m: m, data: m}
+		if m.IsHardlink() {
+			n.data = e.nodes[m.Link].m
+		}
+
+		if p := e.nodes[m.Name]; p != nil {
+			// a directory made up for an earlier member
+			if !m.IsDir() {
+				return nil, fmt.Errorf("decrypt: archive: %s is a file and a directory", m.Name)
+			}
+			p.m = m
+			continue
+		}
+		if err := e.add(m.Name, n); err != nil {
+			return nil, err
+		}
+	}
+
+	// drop the symlinks that point outside the archive
+	var dangling []string
+	for nm, n := range e.nodes {
+		if !n.m.IsSymlink() {
+			continue
+		}
+		if _, err := e.lookup("open", nm); err != nil {
+			dangling = append(dangling, nm)
+		}
+	}
+	for _, nm := range dangling {
+		e.remove(nm)
+	}
+
+	for _, n := range e.nodes {
+		sort.Strings(n.kids)
+	}
+	return e, nil
+}
+
+// remove the node 'name' from its directory
+func (e *EncryptedFS) remove(name string) {
+	p := e.nodes[path.Dir(name)]
+	base := path.Base(name)
+	for i, k := range p.kids {
+		if k == base {
+			p.kids = append(p.kids[:i], p.kids[i+1:]...)
+			break
+		}
+	}
+	delete(e.nodes, name)
+}
+
+// add node 'n' called 'name' and any missing parent directories
+func (e *EncryptedFS) add(name string, n *fsNode) error {
+	e.nodes[name] = n
+	for {
+		dir := path.Dir(name)
+		if p := e.nodes[dir]; p != nil {
+			if !p.m.IsDir() {
+				return fmt.Errorf("decrypt: archive: %s is a file and a directory", dir)
+			}
+			p.kids = append(p.kids, path.Base(name))
+			return nil
+		}
+
+		p := &fsNode{m: &ArchiveMember{Name: dir, Mode: uint32(fs.ModeDir | 0555)}}
+		p.kids = append(p.kids, path.Base(name))
+		e.nodes[dir] = p
+		name = dir
+	}
+}
+
+// find the node of 'name', following symlinks
+func (e *EncryptedFS) lookup(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	nm := name
+	for i := 0; i < _maxFSLinks; i++ {
+		n := e.nodes[nm]
+		if n == nil {
+			break
+		}
+		if !n.m.IsSymlink() {
+			return n, nil
+		}
+
+		nm = path.Join(path.Dir(nm), n.m.Link)
+		if !fs.ValidPath(nm) {
+			break
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// Open opens the file or directory 'name'
+func (e *EncryptedFS) Open(name string) (fs.File, error) {
+	n, err := e.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := n.info(path.Base(name))
+	if n.m.IsDir() {
+		return &fsDir{e: e, n: n, fi: fi}, nil
+	}
+
+	f := &fsFile{
+		n:  n,
+		fi: fi,
+		p:  &fsPlaintext{c: e.c, cur: -1},
+	}
+	f.rd = io.NewSectionReader(f.p, n.data.off, n.data.Size)
+	return f, nil
+}
+
+// ReadDir returns the sorted entries of the directory 'name'
+func (e *EncryptedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := e.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.m.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	return e.entries(n), nil
+}
+
+func (e *EncryptedFS) entries(n *fsNode) []fs.DirEntry {
+	dir := n.m.Name
+	des := make([]fs.DirEntry, 0, len(n.kids))
+	for _, k := range n.kids {
+		kn, _ := e.lookup("readdir", path.Join(dir, k))
+		des = append(des, fs.FileInfoToDirEntry(kn.info(k)))
+	}
+	return des
+}
+
+// fs.FileInfo of a node called 'name'
+type fsInfo struct {
+	n    *fsNode
+	name string
+}
+
+func (n *fsNode) info(name string) fs.FileInfo {
+	return &fsInfo{n, name}
+}
+
+func (i *fsInfo) Name() string {
+	return i.name
+}
+
+func (i *fsInfo) Size() int64 {
+	if i.n.data != nil {
+		return i.n.data.Size
+	}
+	return 0
+}
+
+func (i *fsInfo) Mode() fs.FileMode {
+	return fs.FileMode(i.n.m.Mode)
+}
+
+func (i *fsInfo) ModTime() time.Time {
+	return time.Unix(i.n.m.ModTime, 0)
+}
+
+func (i *fsInfo) IsDir() bool {
+	return i.n.m.IsDir()
+}
+
+// Sys returns the *ArchiveMember
+func (i *fsInfo) Sys() interface{} {
+	return i.n.m
+}
+
+// an open file; it can seek and read at any offset
+type fsFile struct {
+	n  *fsNode
+	fi fs.FileInfo
+	p  *fsPlaintext
+	rd *io.SectionReader
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *fsFile) Read(b []byte) (int, error) {
+	return f.rd.Read(b)
+}
+
+func (f *fsFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.rd.ReadAt(b, off)
+}
+
+func (f *fsFile) Seek(off int64, whence int) (int64, error) {
+	return f.rd.Seek(off, whence)
+}
+
+func (f *fsFile) Close() error {
+	f.p.data = nil
+	return nil
+}
+
+// an open directory
+type fsDir struct {
+	e    *EncryptedFS
+	n    *fsNode
+	fi   fs.FileInfo
+	ents []fs.DirEntry
+	off  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *fsDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.n.m.Name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next 'n' entries of the directory (all if n <= 0)
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.ents == nil {
+		d.ents = d.e.entries(d.n)
+	}
+
+	rest := d.ents[d.off:]
+	if n <= 0 {
+		d.off = len(d.ents)
+		return rest, nil
+	}
+
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+// the plaintext of an open file; it keeps the last decrypted chunk
+type fsPlaintext struct {
+	c    *ChunkReader
+	cur  int64
+	buf  []byte
+	data []byte
+}
+
+func (p *fsPlaintext) ReadAt(b []byte, off int64) (int, error) {
+	c := p.c
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if int64(len(b)) > c.size-off {
+		b = b[:c.size-off]
+		err = io.EOF
+	}
+
+	sz := int64(c.d.ChunkSize)
+	var n int
+	for n < len(b) {
+		i := off / sz
+		if i != p.cur || p.data == nil {
+			d, e := c.ChunkAt(i, p.buf)
+			if e != nil {
+				p.cur = -1
+				return n, e
+			}
+			p.buf = d[:cap(d)]
+			p.data = d
+			p.cur = i
+		}
+
+		z := copy(b[n:], p.data[off-i*sz:])
+		n += z
+		off += int64(z)
+	}
+	return n, err
+}
@@ -0,0 +1,295 @@
+// attest.go -- in-toto attestations in Sigstore bundles
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An attestation is an in-toto statement about one or more artifacts
+// (the subjects, named by their SHA256) signed in a DSSE envelope and
+// wrapped in a Sigstore bundle -- the JSON format of GitHub's artifact
+// attestations and of 'cosign attest-blob --bundle':
+//
+//    {
+//      "mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+//      "verificationMaterial": { "publicKey": { "hint": "..." } },
+//      "dsseEnvelope": {
+//        "payload": base64(statement),
+//        "payloadType": "application/vnd.in-toto+json",
+//        "signatures": [ { "sig": base64(signature) } ]
+//      }
+//    }
+//
+// The Ed25519 signature is of the DSSE pre-authentication encoding of
+// the payload. The bundle names the key by a hint (the base64 SHA256 of
+// its PKIX encoding); it has no certificate or transparency log entry and
+// so must be verified with the signer's public key.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	Ed "crypto/ed25519"
+)
+
+const (
+	_InTotoStatement   = "https://in-toto.io/Statement/v1"
+	_InTotoPayloadType = "application/vnd.in-toto+json"
+	_SigstoreBundle    = "application/vnd.dev.sigstore.bundle.v0.3+json"
+
+	_SigstoreBundlePrefix = "application/vnd.dev.sigstore.bundle"
+
+	// PredicateSLSAProvenance is the predicate type of SLSA build provenance
+	PredicateSLSAProvenance = "https://slsa.dev/provenance/v1"
+
+	// PredicateSigtool is the predicate type of attestations that only
+	// record when and by whom the subjects were signed
+	PredicateSigtool = "https://github.com/opencoff/sigtool/attestation/v1"
+)
+
+// Statement is an in-toto statement
+type Statement struct {
+	Type          string          `json:"_type"`
+	Subject       []Subject       `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate,omitempty"`
+}
+
+// Subject is an artifact of a statement
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Attestation is a parsed Sigstore bundle
+type Attestation struct {
+	// The signed statement
+	Statement *Statement
+
+	// Hint of the signing key
+	KeyHint string
+
+	payload []byte
+	sig     []byte
+}
+
+type sigstoreBundle struct {
+	MediaType            string `json:"mediaType"`
+	VerificationMaterial struct {
+		PublicKey *sigstoreKey `json:"publicKey,omitempty"`
+	} `json:"verificationMaterial"`
+	DSSEEnvelope *dsseEnvelope `json:"dsseEnvelope,omitempty"`
+}
+
+type sigstoreKey struct {
+	Hint string `json:"hint"`
+}
+
+type dsseEnvelope struct {
+	Payload     string          `json:"payload"`
+	PayloadType string          `json:"payloadType"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	Sig   string `json:"sig"`
+	KeyID string `json:"keyid,omitempty"`
+}
+
+// NewStatement makes a statement without subjects. The predicate 'pred'
+// is JSON; it is an empty object if nil.
+func NewStatement(predType string, pred []byte) (*Statement, error) {
+	if len(predType) == 0 {
+		return nil, fmt.Errorf("attest: empty predicate type")
+	}
+
+	if pred == nil {
+		pred = []byte("{}")
+	}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(pred, &v); err != nil {
+		return nil, fmt.Errorf("attest: predicate isn't a JSON object: %s", err)
+	}
+
+	st := &Statement{
+		Type:          _InTotoStatement,
+		PredicateType: predType,
+		Predicate:     json.RawMessage(pred),
+	}
+	return st, nil
+}
+
+// AddSubject adds the artifact 'name' with contents 'rd' to the statement
+func (st *Statement) AddSubject(name string, rd io.Reader) error {
+	h := sha256.New()
+	if _, err := hashReader(h, rd); err != nil {
+		return fmt.Errorf("attest: %s: %s", name, err)
+	}
+
+	s := Subject{
+		Name:   name,
+		Digest: map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))},
+	}
+	st.Subject = append(st.Subject, s)
+	return nil
+}
+
+// Attest signs the statement 'st' and returns the Sigstore bundle
+func (sk *PrivateKey) Attest(st *Statement) ([]byte, error) {
+	if len(st.Subject) == 0 {
+		return nil, fmt.Errorf("attest: statement has no subjects")
+	}
+
+	if err := sk.checkUsage(UsageSign); err != nil {
+		return nil, fmt.Errorf("attest: %s", err)
+	}
+
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, fmt.Errorf("attest: %s", err)
+	}
+
+	sig, err := sk.ed25519Sign(dssePAE(_InTotoPayloadType, payload))
+	if err != nil {
+		return nil, fmt.Errorf("attest: can't sign: %s", err)
+	}
+
+	var b sigstoreBundle
+
+	b.MediaType = _SigstoreBundle
+	b.VerificationMaterial.PublicKey = &sigstoreKey{sk.pk.sigstoreHint()}
+	b.DSSEEnvelope = &dsseEnvelope{
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		PayloadType: _InTotoPayloadType,
+		Signatures: []dsseSignature{
+			{Sig: base64.StdEncoding.EncodeToString(sig)},
+		},
+	}
+
+	out, err := json.MarshalIndent(&b, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("attest: %s", err)
+	}
+	return append(out, '\n'), nil
+}
+
+// IsAttestation returns true if 'b' looks like a Sigstore bundle
+func IsAttestation(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return bytes.HasPrefix(b, []byte("{")) && bytes.Contains(b, []byte(_SigstoreBundlePrefix))
+}
+
+// ParseAttestation parses a Sigstore bundle with a DSSE envelope of an
+// in-toto statement.
+func ParseAttestation(b []byte) (*Attestation, error) {
+	var sb sigstoreBundle
+
+	if err := json.Unmarshal(b, &sb); err != nil {
+		return nil, fmt.Errorf("attest: %s", err)
+	}
+
+	env := sb.DSSEEnvelope
+	switch {
+	case !strings.HasPrefix(sb.MediaType, _SigstoreBundlePrefix):
+		return nil, fmt.Errorf("attest: not a Sigstore bundle")
+	case env == nil:
+		return nil, fmt.Errorf("attest: bundle has no DSSE envelope")
+	case env.PayloadType != _InTotoPayloadType:
+		return nil, fmt.Errorf("attest: unsupported payload type %q", env.PayloadType)
+	case len(env.Signatures) != 1:
+		return nil, fmt.Errorf("attest: exp 1 signature, saw %d", len(env.Signatures))
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("attest: payload: %s", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+	if err != nil || len(sig) != Ed.SignatureSize {
+		return nil, fmt.Errorf("attest: malformed signature")
+	}
+
+	var st Statement
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return nil, fmt.Errorf("attest: statement: %s", err)
+	}
+	if st.Type != _InTotoStatement && st.Type != "https://in-toto.io/Statement/v0.1" {
+		return nil, fmt.Errorf("attest: unsupported statement type %q", st.Type)
+	}
+
+	a := &Attestation{
+		Statement: &st,
+		payload:   payload,
+		sig:       sig,
+	}
+	if sb.VerificationMaterial.PublicKey != nil {
+		a.KeyHint = sb.VerificationMaterial.PublicKey.Hint
+	}
+	return a, nil
+}
+
+// Verify the signature of the attestation with the trusted keys 'pks' and
+// return the key that made it.
+func (a *Attestation) Verify(pks []*PublicKey) (*PublicKey, error) {
+	m := dssePAE(_InTotoPayloadType, a.payload)
+	for _, pk := range pks {
+		if Ed.Verify(Ed.PublicKey(pk.Pk), m, a.sig) {
+			return pk, nil
+		}
+	}
+	return nil, fmt.Errorf("attest: signature verification failed")
+}
+
+// CheckSubject returns nil if the contents of 'rd' are one of the
+// subjects of the attestation.
+func (a *Attestation) CheckSubject(rd io.Reader) error {
+	h := sha256.New()
+	if _, err := hashReader(h, rd); err != nil {
+		return fmt.Errorf("attest: %s", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	for _, s := range a.Statement.Subject {
+		if d, ok := s.Digest["sha256"]; ok && subtle.ConstantTimeCompare([]byte(d), []byte(sum)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("attest: file isn't a subject of the attestation")
+}
+
+// the key hint of a Sigstore bundle: base64 SHA256 of the PKIX key
+func (pk *PublicKey) sigstoreHint() string {
+	der, err := x509.MarshalPKIXPublicKey(Ed.PublicKey(pk.Pk))
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// DSSE pre-authentication encoding
+func dssePAE(typ string, payload []byte) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "DSSEv1 %d %s %d ", len(typ), typ, len(payload))
+	b.Write(payload)
+	return b.Bytes()
+}
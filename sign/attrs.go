@@ -0,0 +1,178 @@
+// attrs.go -- authenticated attributes of signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"path/filepath"
+	"time"
+)
+
+// Attributes describe the signed content. When a signature carries
+// attributes, they are covered by the signature along with the content
+// checksum; any modification of the attributes invalidates the signature.
+type Attributes struct {
+	// Name of the signed file (without its directory)
+	Filename string
+
+	// Size of the signed content in bytes
+	Size int64
+
+	// Hash algorithm used to calculate the content checksum: "sha512"
+	// or "blake3"
+	HashAlgo string
+
+	// Time at which the signature was made
+	Time time.Time
+
+	// Free form comment supplied by the signer
+	Comment string
+}
+
+// serialized representation of signature attributes
+type serializedAttrs struct {
+	Filename string `yaml:"filename,omitempty" json:"filename,omitempty"`
+	Size     int64  `yaml:"size" json:"size"`
+	HashAlgo string `yaml:"hash" json:"hash"`
+	Time     string `yaml:"time" json:"time"`
+	Comment  string `yaml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+const (
+	_AttrPrefix = "sigtool signed attributes v1"
+
+	// content hashes; BLAKE3 hashes large files on all CPUs
+	hashSHA512 = "sha512"
+	hashBLAKE3 = "blake3"
+)
+
+// return a new content hash of algorithm 'algo'
+func contentHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case hashSHA512:
+		return sha512.New(), nil
+	case hashBLAKE3:
+		return NewBlake3(), nil
+	}
+	return nil, fmt.Errorf("unsupported signature hash algorithm %q", algo)
+}
+
+// the hash algorithm of the content checksum signed by 'sig'
+func sigHashAlgo(sig *Signature) string {
+	if sig.Attrs != nil && len(sig.Attrs.HashAlgo) > 0 {
+		return sig.Attrs.HashAlgo
+	}
+	return hashSHA512
+}
+
+// Sign the file 'fn' and embed the attributes 'a' in the signature. The
+// filename and time are filled in if they are not already set; the size
+// always describes 'fn'. The content is hashed with a.HashAlgo (SHA512 if
+// it is empty).
+func (sk *PrivateKey) SignFileWithAttrs(fn string, a *Attributes) (*Signature, error) {
+	algo := a.HashAlgo
+	if len(algo) == 0 {
+		algo = hashSHA512
+	}
+
+	h, err := contentHash(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	ck, sz, err := fileCksum(fn, h)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := *a
+	if len(attrs.Filename) == 0 {
+		attrs.Filename = filepath.Base(fn)
+	}
+	if attrs.Time.IsZero() {
+		attrs.Time = time.Now()
+	}
+	attrs.Size = sz
+	attrs.HashAlgo = algo
+
+	return sk.SignMessageWithAttrs(ck, &attrs)
+}
+
+// Sign a prehashed message 'ck' along with the attributes 'a'.
+func (sk *PrivateKey) SignMessageWithAttrs(ck []byte, a *Attributes) (*Signature, error) {
+	attrs := *a
+	attrs.Time = attrs.Time.UTC().Truncate(time.Second)
+	if len(attrs.HashAlgo) == 0 {
+		attrs.HashAlgo = hashSHA512
+	}
+	return sk.signMessage(ck, &attrs)
+}
+
+// marshal the attributes in a canonical form for signing
+func (a *Attributes) marshal() []byte {
+	var b bytes.Buffer
+	var n [8]byte
+
+	str := func(s string) {
+		binary.BigEndian.PutUint32(n[:4], uint32(len(s)))
+		b.Write(n[:4])
+		b.WriteString(s)
+	}
+	num := func(v int64) {
+		binary.BigEndian.PutUint64(n[:], uint64(v))
+		b.Write(n[:])
+	}
+
+	b.WriteString(_AttrPrefix)
+	str(a.Filename)
+	num(a.Size)
+	str(a.HashAlgo)
+	num(a.Time.Unix())
+	str(a.Comment)
+	return b.Bytes()
+}
+
+func (a *Attributes) serialize() *serializedAttrs {
+	return &serializedAttrs{
+		Filename: a.Filename,
+		Size:     a.Size,
+		HashAlgo: a.HashAlgo,
+		Time:     a.Time.UTC().Format(time.RFC3339),
+		Comment:  a.Comment,
+	}
+}
+
+func (sa *serializedAttrs) decode() (*Attributes, error) {
+	t, err := time.Parse(time.RFC3339, sa.Time)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse signature time <%s>: %s", sa.Time, err)
+	}
+
+	if _, err := contentHash(sa.HashAlgo); err != nil {
+		return nil, err
+	}
+
+	a := &Attributes{
+		Filename: sa.Filename,
+		Size:     sa.Size,
+		HashAlgo: sa.HashAlgo,
+		Time:     t.UTC(),
+		Comment:  sa.Comment,
+	}
+	return a, nil
+}
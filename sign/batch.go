@@ -0,0 +1,105 @@
+// batch.go -- generate many keypairs at once
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+)
+
+// ManifestEntry describes one keypair made by GenerateKeypairs()
+type ManifestEntry struct {
+	// Basename of the key files (NAME.pub, NAME.key)
+	Name string `json:"name"`
+
+	// Fingerprint of the public key
+	Fingerprint string `json:"fingerprint"`
+
+	// Hash of the public key (as in signatures)
+	PKHash string `json:"pkhash"`
+
+	// Public key (base64)
+	PublicKey string `json:"pk"`
+}
+
+// GenerateKeypairs generates 'n' keypairs with usage 'u' and writes them
+// to the directory 'dir' as PREFIX-N.pub and PREFIX-N.key; N is zero
+// padded to the width of 'n'. The public keys expire at 'exp' unless it
+// is zero. 'comment' is the comment of each key; if empty, the key name
+// is used. getpw is called to get the passphrase of each private key (the
+// default prompter is asked if nil). It returns the manifest of the
+// generated keys.
+func GenerateKeypairs(dir, prefix string, n int, u KeyUsage, exp time.Time, comment string, getpw func() ([]byte, error)) ([]ManifestEntry, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("generate: invalid key count %d", n)
+	}
+
+	width := len(strconv.Itoa(n))
+	m := make([]ManifestEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		name := fmt.Sprintf("%s-%0*d", prefix, width, i)
+
+		kp, err := NewKeypair()
+		if err != nil {
+			return m, err
+		}
+		kp.SetUsage(u)
+		kp.SetExpiry(exp)
+
+		c := comment
+		if len(c) == 0 {
+			c = name
+		}
+
+		if err = kp.Serialize(path.Join(dir, name), c, getpw); err != nil {
+			return m, err
+		}
+
+		pk := &kp.Pub
+		m = append(m, ManifestEntry{
+			Name:        name,
+			Fingerprint: pk.Fingerprint(),
+			PKHash:      fmt.Sprintf("%x", pk.hash),
+			PublicKey:   base64.StdEncoding.EncodeToString(pk.Pk),
+		})
+	}
+	return m, nil
+}
+
+// WriteManifestCSV writes the manifest 'm' as CSV with a header row
+func WriteManifestCSV(w io.Writer, m []ManifestEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "fingerprint", "pkhash", "pk"})
+	for _, e := range m {
+		cw.Write([]string{e.Name, e.Fingerprint, e.PKHash, e.PublicKey})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteManifestJSON writes the manifest 'm' as a JSON array
+func WriteManifestJSON(w io.Writer, m []ManifestEntry) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,145 @@
+// bech32.go -- bech32 encoding (BIP 173) for age keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// age encodes its X25519 keys in bech32 without the 90 character limit
+// of BIP 173; this is a minimal implementation of just that.
+
+package sign
+
+import (
+	"fmt"
+	"strings"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Gen = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(v []byte) uint32 {
+	chk := uint32(1)
+	for _, c := range v {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(c)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= bech32Gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	v := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]>>5)
+	}
+	v = append(v, 0)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]&31)
+	}
+	return v
+}
+
+// regroup 'data' from 'from' bits per byte to 'to' bits per byte
+func bech32Convert(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	var out []byte
+
+	max := uint32(1)<<to - 1
+	for _, b := range data {
+		if uint32(b)>>from != 0 {
+			return nil, fmt.Errorf("invalid data range")
+		}
+		acc = acc<<from | uint32(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&max))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&max))
+		}
+	} else if bits >= from || acc<<(to-bits)&max != 0 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return out, nil
+}
+
+// bech32Encode encodes 'data' with the human readable part 'hrp'
+func bech32Encode(hrp string, data []byte) (string, error) {
+	v, err := bech32Convert(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	hrp = strings.ToLower(hrp)
+	w := append(bech32HRPExpand(hrp), v...)
+	w = append(w, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(w) ^ 1
+
+	var s strings.Builder
+	s.WriteString(hrp)
+	s.WriteByte('1')
+	for _, c := range v {
+		s.WriteByte(bech32Charset[c])
+	}
+	for i := 0; i < 6; i++ {
+		s.WriteByte(bech32Charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return s.String(), nil
+}
+
+// bech32Decode decodes 's' and returns the human readable part (in lower
+// case) and the data.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, fmt.Errorf("bech32: mixed case")
+	}
+	s = strings.ToLower(s)
+
+	i := strings.LastIndexByte(s, '1')
+	if i < 1 || i+7 > len(s) {
+		return "", nil, fmt.Errorf("bech32: bad separator")
+	}
+
+	hrp := s[:i]
+	for j := 0; j < len(hrp); j++ {
+		if hrp[j] < 33 || hrp[j] > 126 {
+			return "", nil, fmt.Errorf("bech32: bad character in prefix")
+		}
+	}
+
+	v := make([]byte, 0, len(s)-i-1)
+	for j := i + 1; j < len(s); j++ {
+		c := strings.IndexByte(bech32Charset, s[j])
+		if c < 0 {
+			return "", nil, fmt.Errorf("bech32: bad character %q", s[j])
+		}
+		v = append(v, byte(c))
+	}
+
+	if bech32Polymod(append(bech32HRPExpand(hrp), v...)) != 1 {
+		return "", nil, fmt.Errorf("bech32: bad checksum")
+	}
+
+	data, err := bech32Convert(v[:len(v)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, fmt.Errorf("bech32: %s", err)
+	}
+	return hrp, data, nil
+}
@@ -0,0 +1,372 @@
+// blake3.go -- BLAKE3 hash
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A portable implementation of the BLAKE3 hash with a 256-bit output
+// (the unkeyed hash mode of the BLAKE3 specification). It follows the
+// reference implementation: the input is split into 1KB chunks and the
+// chaining values of the chunks are merged in a binary tree. Large writes
+// are split into subtrees of 1MB that are hashed on all CPUs.
+
+package sign
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	_Blake3BlockLen = 64
+	_Blake3ChunkLen = 1024
+
+	// chunks in a subtree hashed by one CPU and the smallest write
+	// that is hashed in parallel
+	_Blake3Subtree     = 1024
+	_Blake3ParallelMin = 4 * _Blake3Subtree * _Blake3ChunkLen
+
+	_Blake3ChunkStart = 1 << 0
+	_Blake3ChunkEnd   = 1 << 1
+	_Blake3Parent     = 1 << 2
+	_Blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// message word schedule of each round: the permutation applied in advance
+var blake3Sched = [7][16]uint8{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8},
+	{3, 4, 10, 12, 13, 2, 7, 14, 6, 5, 9, 0, 11, 15, 8, 1},
+	{10, 7, 12, 9, 14, 3, 13, 15, 4, 0, 11, 2, 5, 8, 1, 6},
+	{12, 13, 9, 11, 15, 10, 14, 8, 7, 2, 5, 3, 0, 1, 6, 4},
+	{9, 14, 11, 5, 8, 12, 15, 1, 13, 3, 0, 10, 2, 6, 4, 7},
+	{11, 15, 5, 0, 1, 9, 8, 6, 14, 10, 2, 12, 3, 4, 7, 13},
+}
+
+// the compression function; returns the full 16 word state
+func blake3Compress(cv *[8]uint32, m *[16]uint32, counter uint64, blen, flags uint32) [16]uint32 {
+	v0, v1, v2, v3 := cv[0], cv[1], cv[2], cv[3]
+	v4, v5, v6, v7 := cv[4], cv[5], cv[6], cv[7]
+	v8, v9, v10, v11 := blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3]
+	v12, v13, v14, v15 := uint32(counter), uint32(counter>>32), blen, flags
+
+	for i := range blake3Sched {
+		s := &blake3Sched[i]
+
+		// columns, then diagonals
+		v0 += v4 + m[s[0]]
+		v12 = bits.RotateLeft32(v12^v0, -16)
+		v8 += v12
+		v4 = bits.RotateLeft32(v4^v8, -12)
+		v0 += v4 + m[s[1]]
+		v12 = bits.RotateLeft32(v12^v0, -8)
+		v8 += v12
+		v4 = bits.RotateLeft32(v4^v8, -7)
+		v1 += v5 + m[s[2]]
+		v13 = bits.RotateLeft32(v13^v1, -16)
+		v9 += v13
+		v5 = bits.RotateLeft32(v5^v9, -12)
+		v1 += v5 + m[s[3]]
+		v13 = bits.RotateLeft32(v13^v1, -8)
+		v9 += v13
+		v5 = bits.RotateLeft32(v5^v9, -7)
+		v2 += v6 + m[s[4]]
+		v14 = bits.RotateLeft32(v14^v2, -16)
+		v10 += v14
+		v6 = bits.RotateLeft32(v6^v10, -12)
+		v2 += v6 + m[s[5]]
+		v14 = bits.RotateLeft32(v14^v2, -8)
+		v10 += v14
+		v6 = bits.RotateLeft32(v6^v10, -7)
+		v3 += v7 + m[s[6]]
+		v15 = bits.RotateLeft32(v15^v3, -16)
+		v11 += v15
+		v7 = bits.RotateLeft32(v7^v11, -12)
+		v3 += v7 + m[s[7]]
+		v15 = bits.RotateLeft32(v15^v3, -8)
+		v11 += v15
+		v7 = bits.RotateLeft32(v7^v11, -7)
+
+		v0 += v5 + m[s[8]]
+		v15 = bits.RotateLeft32(v15^v0, -16)
+		v10 += v15
+		v5 = bits.RotateLeft32(v5^v10, -12)
+		v0 += v5 + m[s[9]]
+		v15 = bits.RotateLeft32(v15^v0, -8)
+		v10 += v15
+		v5 = bits.RotateLeft32(v5^v10, -7)
+		v1 += v6 + m[s[10]]
+		v12 = bits.RotateLeft32(v12^v1, -16)
+		v11 += v12
+		v6 = bits.RotateLeft32(v6^v11, -12)
+		v1 += v6 + m[s[11]]
+		v12 = bits.RotateLeft32(v12^v1, -8)
+		v11 += v12
+		v6 = bits.RotateLeft32(v6^v11, -7)
+		v2 += v7 + m[s[12]]
+		v13 = bits.RotateLeft32(v13^v2, -16)
+		v8 += v13
+		v7 = bits.RotateLeft32(v7^v8, -12)
+		v2 += v7 + m[s[13]]
+		v13 = bits.RotateLeft32(v13^v2, -8)
+		v8 += v13
+		v7 = bits.RotateLeft32(v7^v8, -7)
+		v3 += v4 + m[s[14]]
+		v14 = bits.RotateLeft32(v14^v3, -16)
+		v9 += v14
+		v4 = bits.RotateLeft32(v4^v9, -12)
+		v3 += v4 + m[s[15]]
+		v14 = bits.RotateLeft32(v14^v3, -8)
+		v9 += v14
+		v4 = bits.RotateLeft32(v4^v9, -7)
+	}
+
+	return [16]uint32{
+		v0 ^ v8, v1 ^ v9, v2 ^ v10, v3 ^ v11,
+		v4 ^ v12, v5 ^ v13, v6 ^ v14, v7 ^ v15,
+		v8 ^ cv[0], v9 ^ cv[1], v10 ^ cv[2], v11 ^ cv[3],
+		v12 ^ cv[4], v13 ^ cv[5], v14 ^ cv[6], v15 ^ cv[7],
+	}
+}
+
+// the inputs of a compression whose output is not yet known to be the
+// root
+type blake3Output struct {
+	cv      [8]uint32
+	m       [16]uint32
+	counter uint64
+	blen    uint32
+	flags   uint32
+}
+
+func (o *blake3Output) chain() [8]uint32 {
+	var cv [8]uint32
+	s := blake3Compress(&o.cv, &o.m, o.counter, o.blen, o.flags)
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func (o *blake3Output) root(b []byte) []byte {
+	var d [32]byte
+
+	s := blake3Compress(&o.cv, &o.m, 0, o.blen, o.flags|_Blake3Root)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(d[i*4:], s[i])
+	}
+	return append(b, d[:]...)
+}
+
+func blake3Parent(l, r [8]uint32) blake3Output {
+	o := blake3Output{
+		cv:    blake3IV,
+		blen:  _Blake3BlockLen,
+		flags: _Blake3Parent,
+	}
+	copy(o.m[:8], l[:])
+	copy(o.m[8:], r[:])
+	return o
+}
+
+// state of the chunk being hashed
+type blake3Chunk struct {
+	cv      [8]uint32
+	counter uint64
+	block   [_Blake3BlockLen]byte
+	blen    int
+	nblocks int
+}
+
+func (c *blake3Chunk) reset(counter uint64) {
+	*c = blake3Chunk{cv: blake3IV, counter: counter}
+}
+
+func (c *blake3Chunk) len() int {
+	return c.nblocks*_Blake3BlockLen + c.blen
+}
+
+func (c *blake3Chunk) flags() uint32 {
+	if c.nblocks == 0 {
+		return _Blake3ChunkStart
+	}
+	return 0
+}
+
+func (c *blake3Chunk) words() [16]uint32 {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(c.block[i*4:])
+	}
+	return m
+}
+
+func (c *blake3Chunk) update(b []byte) {
+	for len(b) > 0 {
+		// the last block of a chunk is compressed by output()
+		if c.blen == _Blake3BlockLen {
+			m := c.words()
+			s := blake3Compress(&c.cv, &m, c.counter, _Blake3BlockLen, c.flags())
+			copy(c.cv[:], s[:8])
+			c.nblocks++
+			c.block = [_Blake3BlockLen]byte{}
+			c.blen = 0
+		}
+
+		n := copy(c.block[c.blen:], b)
+		c.blen += n
+		b = b[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	return blake3Output{
+		cv:      c.cv,
+		m:       c.words(),
+		counter: c.counter,
+		blen:    uint32(c.blen),
+		flags:   c.flags() | _Blake3ChunkEnd,
+	}
+}
+
+type blake3 struct {
+	chunk blake3Chunk
+
+	// chaining values of the complete subtrees
+	stack [][8]uint32
+}
+
+// NewBlake3 returns a hash.Hash computing the 256-bit BLAKE3 hash
+func NewBlake3() hash.Hash {
+	h := &blake3{}
+	h.Reset()
+	return h
+}
+
+func (h *blake3) Reset() {
+	h.chunk.reset(0)
+	h.stack = h.stack[:0]
+}
+
+func (h *blake3) Size() int      { return 32 }
+func (h *blake3) BlockSize() int { return _Blake3BlockLen }
+
+func (h *blake3) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		// a full chunk is only finished when more input arrives; the
+		// last chunk is the root if it is the only one
+		if h.chunk.len() == _Blake3ChunkLen {
+			o := h.chunk.output()
+			h.push(o.chain(), h.chunk.counter+1, 1)
+			h.chunk.reset(h.chunk.counter + 1)
+		}
+
+		// the last byte is kept back for the same reason
+		if len(b) > _Blake3ParallelMin && h.chunk.len() == 0 && h.chunk.counter%_Blake3Subtree == 0 {
+			m := h.subtrees(b[:len(b)-1])
+			b = b[m:]
+			continue
+		}
+
+		m := _Blake3ChunkLen - h.chunk.len()
+		if m > len(b) {
+			m = len(b)
+		}
+		h.chunk.update(b[:m])
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// push the chaining value of a subtree of 'size' chunks that ends at chunk
+// 'end' and merge the subtrees it completes
+func (h *blake3) push(cv [8]uint32, end, size uint64) {
+	for t := end / size; t&1 == 0; t >>= 1 {
+		top := len(h.stack) - 1
+		p := blake3Parent(h.stack[top], cv)
+		cv = p.chain()
+		h.stack = h.stack[:top]
+	}
+	h.stack = append(h.stack, cv)
+}
+
+// hash the whole subtrees of 'b' on all CPUs and return the number of
+// bytes hashed; the chunk state must be empty and at a subtree boundary.
+func (h *blake3) subtrees(b []byte) int {
+	const size = _Blake3Subtree * _Blake3ChunkLen
+
+	n := len(b) / size
+	cvs := make([][8]uint32, n)
+	start := h.chunk.counter
+
+	var wg sync.WaitGroup
+	var next int64 = -1
+
+	ncpu := runtime.NumCPU()
+	if ncpu > n {
+		ncpu = n
+	}
+
+	wg.Add(ncpu)
+	for i := 0; i < ncpu; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				j := int(atomic.AddInt64(&next, 1))
+				if j >= n {
+					return
+				}
+				cvs[j] = blake3Tree(b[j*size:(j+1)*size], start+uint64(j*_Blake3Subtree))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j, cv := range cvs {
+		h.push(cv, start+uint64((j+1)*_Blake3Subtree), _Blake3Subtree)
+	}
+	h.chunk.reset(start + uint64(n*_Blake3Subtree))
+	return n * size
+}
+
+// chaining value of the subtree of whole chunks 'b' (a power of two)
+// starting at chunk 'counter'
+func blake3Tree(b []byte, counter uint64) [8]uint32 {
+	if len(b) == _Blake3ChunkLen {
+		var c blake3Chunk
+
+		c.reset(counter)
+		c.update(b)
+		o := c.output()
+		return o.chain()
+	}
+
+	half := len(b) / 2
+	l := blake3Tree(b[:half], counter)
+	r := blake3Tree(b[half:], counter+uint64(half/_Blake3ChunkLen))
+	p := blake3Parent(l, r)
+	return p.chain()
+}
+
+func (h *blake3) Sum(b []byte) []byte {
+	o := h.chunk.output()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = blake3Parent(h.stack[i], o.chain())
+	}
+	return o.root(b)
+}
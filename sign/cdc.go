@@ -0,0 +1,292 @@
+// cdc.go -- content defined chunks for deduplication
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A file with content defined chunks ("cdc" in the chunking field of the
+// header) cuts the plaintext where a gear hash of the last bytes matches
+// a mask, so an insert or a delete only changes the chunks around it.
+// Each chunk is between ChunkSize/16 and ChunkSize bytes.
+//
+// The file key is a convergence key derived from the sender's private
+// key and a name for the file; every encryption of the file with the
+// same name has the same key. The gear table, the chunk key and the
+// nonce key are derived from it; the chunks don't depend on the header:
+//
+//    uint32_be  length of the plaintext
+//    byte[]     nonce: HMAC-SHA256(nonce key, length || plaintext),
+//               cut to the nonce size of the cipher
+//    byte[]     AEAD(chunk key, nonce, plaintext, length)
+//
+// so the same plaintext chunk is the same ciphertext in every file with
+// that key. The last chunk is empty and marked EOF; it is sealed with the
+// data key of the header and its additional data has the SHA256 of all
+// the chunks before it. Truncated, reordered or spliced chunks fail to
+// decrypt; but each chunk authenticates on its own, so they are only
+// found at the last chunk, after the others were decrypted.
+
+package sign
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+const (
+	// the chunking of the header for content defined chunks
+	_ChunkingCDC = "cdc"
+
+	// smallest chunk size for content defined chunks
+	_MinCDCChunkSize = 4096
+
+	_KdfCDCKey   = "sigtool cdc convergence key"
+	_KdfCDCChunk = "sigtool cdc chunk key"
+	_KdfCDCNonce = "sigtool cdc nonce key"
+	_KdfCDCGear  = "sigtool cdc gear table"
+)
+
+// content defined chunks of a file
+type cdcChunks struct {
+	gear     [256]uint64
+	min, max int
+	mask     uint64
+
+	ae       cipher.AEAD
+	nonceKey []byte
+
+	// SHA256 of the chunks so far; for the last chunk
+	sum hash.Hash
+
+	// chunks of the previous encryption (see delta.go)
+	old *oldChunks
+}
+
+// EnableCDC cuts the input into content defined chunks and encrypts them
+// with a convergence key derived from the sender's private key and
+// 'name'; the sender key given to NewEncryptor() must be a local key.
+// Unchanged regions of a file encrypted again with the same name give
+// identical ciphertext chunks, which a backup store can deduplicate; but
+// anyone who sees two such files learns which chunks they share. It must
+// be called before any recipients are added; it can't be used with
+// EncryptTo(), EncryptEach(), sessions, logs, chunk manifests, sparse
+// files or checkpoints.
+func (e *Encryptor) EnableCDC(name string) error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't enable content defined chunks after encryption has started")
+	}
+
+	switch {
+	case len(e.Keys) > 0:
+		return fmt.Errorf("encrypt: content defined chunks must be enabled before adding recipients")
+	case e.sk == nil || len(e.sk.Sk) == 0:
+		return fmt.Errorf("encrypt: content defined chunks need a local sender key")
+	case len(name) == 0:
+		return fmt.Errorf("encrypt: content defined chunks need a file name")
+	case e.ChunkSize < _MinCDCChunkSize:
+		return fmt.Errorf("encrypt: content defined chunks need a chunk size of at least %d", _MinCDCChunkSize)
+	case e.manifest != nil || e.sparse || e.useSession || e.ckptFn != nil:
+		return fmt.Errorf("encrypt: content defined chunks can't be used with a chunk manifest, sparse files, sessions or checkpoints")
+	}
+
+	key, err := hkdfKey(make([]byte, 32), e.sk.Sk[:32], nil, _KdfCDCKey, name)
+	if err != nil {
+		return fmt.Errorf("encrypt: %s", err)
+	}
+
+	wSig, err := signFileKey(e.sk, key, e.Salt)
+	if err != nil {
+		return err
+	}
+
+	e.key = key
+	e.SenderSign = wSig
+	e.Chunking = _ChunkingCDC
+	e.cdc = &cdcChunks{}
+	return nil
+}
+
+// derive the keys of the chunks from the file key 'key'
+func (c *cdcChunks) init(key []byte, ctx, name string, chunkSize uint32) error {
+	ck, err := hkdfKey(make([]byte, 32), key, nil, _KdfCDCChunk, ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.ae, err = chunkAEAD(name, ck); err != nil {
+		return err
+	}
+
+	if c.nonceKey, err = hkdfKey(make([]byte, 32), key, nil, _KdfCDCNonce, ctx); err != nil {
+		return err
+	}
+
+	var g [256 * 8]byte
+	if _, err = hkdfKey(g[:], key, nil, _KdfCDCGear, ctx); err != nil {
+		return err
+	}
+	for i := range c.gear {
+		c.gear[i] = binary.BigEndian.Uint64(g[i*8:])
+	}
+
+	// the mask is on the high bits of the hash: they depend on the last
+	// 64 bytes
+	nb := uint(bits.Len32(chunkSize/4) - 1)
+	c.max = int(chunkSize)
+	c.min = c.max / 16
+	c.mask = ((uint64(1) << nb) - 1) << (64 - nb)
+	c.sum = sha256.New()
+	return nil
+}
+
+// the length of the first chunk of 'b'
+func (c *cdcChunks) cut(b []byte) int {
+	n := len(b)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+
+	var h uint64
+	for i := c.min; i < n; i++ {
+		h = (h << 1) + c.gear[b[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// encrypt the input stream 'rd' as content defined chunks
+func (e *Encryptor) encryptCDC(rd io.Reader, wr io.WriteCloser) error {
+	buf := make([]byte, e.cdc.max)
+
+	var n int
+	for {
+		m, err := io.ReadFull(rd, buf[n:])
+		n += m
+
+		switch err {
+		case nil:
+			k, err := e.writeCDC(buf[:n], wr, false)
+			if err != nil {
+				return err
+			}
+			n = copy(buf, buf[k:n])
+
+		case io.EOF, io.ErrClosedPipe, io.ErrUnexpectedEOF:
+			if _, err = e.writeCDC(buf[:n], wr, true); err != nil {
+				return err
+			}
+			return wr.Close()
+
+		default:
+			return fmt.Errorf("encrypt: I/O read error: %s", err)
+		}
+	}
+}
+
+// encrypt the first chunk of 'buf'; or all of it and the last chunk if
+// 'eof'. Returns the bytes encrypted.
+func (e *Encryptor) writeCDC(buf []byte, wr io.Writer, eof bool) (int, error) {
+	var done int
+	for len(buf) > 0 {
+		k := e.cdc.cut(buf)
+		if err := e.sealCDC(buf[:k], wr); err != nil {
+			return done, err
+		}
+		done += k
+		buf = buf[k:]
+
+		if !eof {
+			return done, nil
+		}
+	}
+
+	if eof {
+		if err := e.encrypt(nil, wr, e.nextChunk, true); err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// encrypt one content defined chunk
+func (e *Encryptor) sealCDC(p []byte, wr io.Writer) error {
+	c := e.cdc
+	if e.nextChunk >= maxChunk(e.version) {
+		return ErrTooManyChunks
+	}
+
+	binary.BigEndian.PutUint32(e.buf[:4], uint32(len(p)))
+	ad := e.buf[:4]
+
+	var nb [sha256.Size]byte
+	m := hmac.New(sha256.New, c.nonceKey)
+	m.Write(ad)
+	m.Write(p)
+	nonce := m.Sum(nb[:0])[:c.ae.NonceSize()]
+
+	// an unchanged chunk is copied from the previous encryption
+	z := 4 + len(nonce) + len(p) + c.ae.Overhead()
+	var reused bool
+	if c.old != nil {
+		var err error
+		if reused, err = c.old.copy(e.buf, nonce, z); err != nil {
+			return err
+		}
+	}
+
+	if !reused {
+		n := 4 + copy(e.buf[4:], nonce)
+		c.ae.Seal(e.buf[n:n], nonce, p, ad)
+	}
+
+	if err := fullwrite(e.buf[:z], wr); err != nil {
+		return fmt.Errorf("encrypt: %s", err)
+	}
+
+	c.sum.Write(e.buf[:z])
+	e.written += int64(z)
+	e.nextChunk++
+	return nil
+}
+
+// decrypt content defined chunk 'i' whose length word is in 'b'
+func (d *Decryptor) openCDC(b []byte, m uint32, i uint64) ([]byte, error) {
+	c := d.cdc
+	if m == 0 {
+		return nil, fmt.Errorf("decrypt: block %d: zero-sized chunk without EOF", i)
+	}
+
+	ns := c.ae.NonceSize()
+	z := ns + int(m) + c.ae.Overhead()
+	if _, err := io.ReadFull(d.rd, d.buf[:z]); err != nil {
+		return nil, fmt.Errorf("decrypt: premature EOF while reading block %d: %s", i, err)
+	}
+
+	c.sum.Write(b[:4])
+	c.sum.Write(d.buf[:z])
+
+	p, err := c.ae.Open(d.buf[ns:ns], d.buf[:ns], d.buf[ns:z], b[:4])
+	if err != nil {
+		debug(d.log, "decrypt: chunk authentication failed", "chunk", i)
+		return nil, fmt.Errorf("decrypt: can't decrypt chunk %d: %s", i, err)
+	}
+	return p, nil
+}
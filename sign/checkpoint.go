@@ -0,0 +1,275 @@
+// checkpoint.go -- resume an interrupted encryption
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A checkpoint is the state of an Encryptor after a whole number of
+// chunks: the chunk index, the input consumed and the output written,
+// and what's needed to seal the next chunk (the file key, header checksum,
+// salt and cipher). Encryption is resumed by reading the input from
+// Input and appending to the output after Output.
+//
+// The chunks written after the checkpoint are not sealed again: the
+// nonce of a chunk depends only on its index, so sealing a different
+// plaintext at the same index would reuse the nonce of a chunk that may
+// have been copied already. SkipWritten() keeps the chunks that match
+// the input and refuses to resume if one doesn't.
+//
+// The marshaled checkpoint is JSON:
+//
+//    {
+//      "version": 2, "cipher": "..", "context": "..", "chunksize": N,
+//      "salt": "base64", "key": "base64", "hdrsum": "base64",
+//      "chunks": N, "input": N, "output": N
+//    }
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// EncryptCheckpoint is the state of an interrupted encryption. It holds
+// the file encryption key: it must be kept as safely as the plaintext.
+type EncryptCheckpoint struct {
+	// number of chunks written
+	Chunks uint64
+
+	// bytes of plaintext encrypted
+	Input int64
+
+	// bytes of ciphertext written, including the header
+	Output int64
+
+	st checkpointState
+}
+
+type checkpointState struct {
+	Version   uint8  `json:"version"`
+	Cipher    string `json:"cipher"`
+	Context   string `json:"context,omitempty"`
+	ChunkSize uint32 `json:"chunksize"`
+	Salt      []byte `json:"salt"`
+	Key       []byte `json:"key"`
+	Hdrsum    []byte `json:"hdrsum"`
+	Chunks    uint64 `json:"chunks"`
+	Input     int64  `json:"input"`
+	Output    int64  `json:"output"`
+}
+
+// SetCheckpoint makes the Encryptor call 'fn' with a checkpoint after
+// every 'every' chunks; an error from 'fn' stops the encryption. The
+// output must be synced before the checkpoint is saved. It can't be used
+// with a chunk manifest, sparse files or content defined chunks; it can
+// be set on an Encryptor from ResumeEncryptor().
+func (e *Encryptor) SetCheckpoint(every uint64, fn func(c *EncryptCheckpoint) error) error {
+	switch {
+	case e.stream:
+		return fmt.Errorf("encrypt: can't set a checkpoint after encryption has started")
+	case every == 0:
+		return fmt.Errorf("encrypt: checkpoint interval can't be zero")
+	case e.manifest != nil:
+		return fmt.Errorf("encrypt: checkpoints can't be used with a chunk manifest")
+	case e.sparse:
+		return fmt.Errorf("encrypt: checkpoints can't be used with sparse files")
+	case e.cdc != nil:
+		return fmt.Errorf("encrypt: checkpoints can't be used with content defined chunks")
+	}
+
+	e.ckptEvery = every
+	e.ckptFn = fn
+	return nil
+}
+
+// ResumeEncryptor returns an Encryptor that continues the encryption of
+// checkpoint 'c'; its Encrypt() or stream writer must be given the input
+// from c.Input and write the output after the first c.Output bytes. If
+// output was written after the checkpoint, SkipWritten() must be called
+// first.
+func ResumeEncryptor(c *EncryptCheckpoint) (*Encryptor, error) {
+	st := &c.st
+	if err := st.valid(); err != nil {
+		return nil, err
+	}
+
+	e := &Encryptor{
+		key:       st.Key,
+		cipher:    st.Cipher,
+		hdrsum:    st.Hdrsum,
+		version:   st.Version,
+		context:   st.Context,
+		nextChunk: st.Chunks,
+		written:   st.Output,
+	}
+
+	e.ChunkSize = st.ChunkSize
+	e.Salt = st.Salt
+	e.Cipher = headerCipher(st.Cipher)
+	if err := e.startChunks(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SkipWritten compares the output 'old' written after the checkpoint
+// with the encryption of the input 'rd' from the checkpoint on; it must
+// be called before Encrypt(). It returns the input and output bytes of
+// the chunks that are kept and true if the last chunk was written
+// already. The output must be cut after the kept chunks and the
+// encryption continued with the input after them. A chunk of 'old'
+// that doesn't match the input is an error.
+func (e *Encryptor) SkipWritten(rd io.Reader, old io.Reader) (in, out int64, done bool, err error) {
+	if e.stream {
+		return 0, 0, false, fmt.Errorf("encrypt: can't skip chunks after encryption has started")
+	}
+
+	chunk := int(e.ChunkSize)
+	buf := make([]byte, chunk+1)
+	obuf := make([]byte, len(e.buf))
+
+	var n int
+	for {
+		m, err := io.ReadFull(rd, buf[n:])
+		n += m
+
+		eof := false
+		switch err {
+		case nil:
+			n = chunk
+		case io.EOF, io.ErrUnexpectedEOF:
+			eof = true
+		default:
+			return 0, 0, false, fmt.Errorf("encrypt: I/O read error: %s", err)
+		}
+
+		z := uint32(n)
+		if eof {
+			z |= _EOF
+		}
+
+		c := e.seal(buf[:n], e.nextChunk, z)
+		m, err = io.ReadFull(old, obuf[:len(c)])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, 0, false, fmt.Errorf("encrypt: I/O read error: %s", err)
+		}
+
+		// a partial chunk must be a prefix of the one sealed again
+		if !bytes.Equal(c[:m], obuf[:m]) {
+			return 0, 0, false, fmt.Errorf("encrypt: chunk %d: the input changed since the checkpoint", e.nextChunk)
+		}
+		if m < len(c) {
+			return in, out, false, nil
+		}
+
+		in += int64(n)
+		out += int64(m)
+		e.written += int64(m)
+		if eof {
+			return in, out, true, nil
+		}
+
+		e.nextChunk++
+		buf[0] = buf[chunk]
+		n = 1
+	}
+}
+
+// Marshal encodes the checkpoint as JSON
+func (c *EncryptCheckpoint) Marshal() ([]byte, error) {
+	return json.Marshal(&c.st)
+}
+
+// ParseEncryptCheckpoint decodes a checkpoint made by Marshal()
+func ParseEncryptCheckpoint(b []byte) (*EncryptCheckpoint, error) {
+	c := &EncryptCheckpoint{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c.st); err != nil {
+		return nil, fmt.Errorf("checkpoint: %s", err)
+	}
+	if err := c.st.valid(); err != nil {
+		return nil, err
+	}
+
+	c.Chunks = c.st.Chunks
+	c.Input = c.st.Input
+	c.Output = c.st.Output
+	return c, nil
+}
+
+// Verify checks that 'rd' begins with the header of the checkpointed
+// file; the header is read but not the rest of the file.
+func (c *EncryptCheckpoint) Verify(rd io.Reader) error {
+	d, err := NewDecryptor(rd)
+	if err != nil {
+		return fmt.Errorf("checkpoint: %s", err)
+	}
+
+	if d.hdrHash != nil {
+		if err = d.readRecipients(func(int, *pb.WrappedKey) error { return nil }); err != nil {
+			return fmt.Errorf("checkpoint: %s", err)
+		}
+	}
+
+	if subtle.ConstantTimeCompare(d.hdrsum, c.st.Hdrsum) == 0 {
+		return fmt.Errorf("checkpoint: not the header of the checkpointed file")
+	}
+	return nil
+}
+
+// checkpoint of the chunks written so far
+func (e *Encryptor) checkpoint() *EncryptCheckpoint {
+	input := int64(e.nextChunk) * int64(e.ChunkSize)
+	return &EncryptCheckpoint{
+		Chunks: e.nextChunk,
+		Input:  input,
+		Output: e.written,
+		st: checkpointState{
+			Version:   e.version,
+			Cipher:    e.cipher,
+			Context:   e.context,
+			ChunkSize: e.ChunkSize,
+			Salt:      e.Salt,
+			Key:       e.key,
+			Hdrsum:    e.hdrsum,
+			Chunks:    e.nextChunk,
+			Input:     input,
+			Output:    e.written,
+		},
+	}
+}
+
+func (st *checkpointState) valid() error {
+	switch {
+	case st.Version != _Version && st.Version != _Version3:
+		return fmt.Errorf("checkpoint: unsupported version %d", st.Version)
+	case st.ChunkSize == 0 || st.ChunkSize > maxChunkSize:
+		return fmt.Errorf("checkpoint: invalid chunk size %d", st.ChunkSize)
+	case len(st.Salt) != _AEADNonceLen:
+		return fmt.Errorf("checkpoint: invalid salt")
+	case len(st.Key) != 32:
+		return fmt.Errorf("checkpoint: invalid key")
+	case len(st.Hdrsum) != sha256.Size:
+		return fmt.Errorf("checkpoint: invalid header checksum")
+	case st.Chunks > maxChunk(st.Version):
+		return fmt.Errorf("checkpoint: invalid chunk index %d", st.Chunks)
+	case st.Input != int64(st.Chunks)*int64(st.ChunkSize) || st.Output <= 0:
+		return fmt.Errorf("checkpoint: invalid offsets")
+	}
+	return nil
+}
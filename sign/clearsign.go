@@ -0,0 +1,209 @@
+// clearsign.go -- clear signed text
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A clear signed text keeps the original text readable and appends an
+// armored signature block:
+//
+//    -----BEGIN SIGTOOL SIGNED MESSAGE-----
+//    text ..
+//    -----BEGIN SIGTOOL SIGNATURE-----
+//    YAML signature
+//    -----END SIGTOOL SIGNATURE-----
+//
+// Text lines starting with '-' are escaped by prefixing them with "- ".
+// The signature covers the canonical form of the text: line endings are
+// normalized to '\n' and trailing white space on each line is removed.
+// This lets the text survive mail transports and editors that alter
+// white space.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	_ClearBegin    = "-----BEGIN SIGTOOL SIGNED MESSAGE-----"
+	_ClearSigBegin = "-----BEGIN SIGTOOL SIGNATURE-----"
+	_ClearSigEnd   = "-----END SIGTOOL SIGNATURE-----"
+)
+
+// ClearSigned is a parsed clear signed text
+type ClearSigned struct {
+	// Text in its canonical form (what is signed)
+	Text []byte
+
+	// Signatures of the text
+	Sigs []*Signature
+}
+
+// ClearSign signs the text 'txt' and returns the clear signed text. If
+// 'attrs' is non-nil, the signature carries signed attributes. 'comment'
+// is the untrusted comment of the signature.
+func (sk *PrivateKey) ClearSign(txt []byte, attrs *Attributes, comment string) ([]byte, error) {
+	lines := textLines(txt)
+	canon := canonText(lines)
+	ck := textCksum(canon)
+
+	var sig *Signature
+	var err error
+
+	if attrs != nil {
+		a := *attrs
+		a.Size = int64(len(canon))
+		a.HashAlgo = hashSHA512
+		sig, err = sk.SignMessageWithAttrs(ck, &a)
+	} else {
+		sig, err = sk.signMessage(ck, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sb, err := sig.Serialize(comment)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString(_ClearBegin + "\n")
+	for _, l := range lines {
+		if len(l) > 0 && l[0] == '-' {
+			b.WriteString("- ")
+		}
+		b.Write(l)
+		b.WriteByte('\n')
+	}
+	b.WriteString(_ClearSigBegin + "\n")
+	b.Write(sb)
+	if len(sb) > 0 && sb[len(sb)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	b.WriteString(_ClearSigEnd + "\n")
+	return b.Bytes(), nil
+}
+
+// ParseClearSigned parses the clear signed text in 'b'
+func ParseClearSigned(b []byte) (*ClearSigned, error) {
+	lines := textLines(b)
+
+	// skip any leading blank lines
+	i := 0
+	for i < len(lines) && len(lines[i]) == 0 {
+		i++
+	}
+
+	if i == len(lines) || string(lines[i]) != _ClearBegin {
+		return nil, fmt.Errorf("clearsign: missing '%s'", _ClearBegin)
+	}
+
+	var txt [][]byte
+	for i++; i < len(lines); i++ {
+		l := lines[i]
+		if string(l) == _ClearSigBegin {
+			break
+		}
+
+		if len(l) > 0 && l[0] == '-' {
+			if !bytes.HasPrefix(l, []byte("- ")) {
+				return nil, fmt.Errorf("clearsign: line %d: bad escaped line", i+1)
+			}
+			l = l[2:]
+		}
+		txt = append(txt, l)
+	}
+
+	if i == len(lines) {
+		return nil, fmt.Errorf("clearsign: missing '%s'", _ClearSigBegin)
+	}
+
+	var sb bytes.Buffer
+	for i++; i < len(lines); i++ {
+		l := lines[i]
+		if string(l) == _ClearSigEnd {
+			break
+		}
+		sb.Write(l)
+		sb.WriteByte('\n')
+	}
+
+	if i == len(lines) {
+		return nil, fmt.Errorf("clearsign: missing '%s'", _ClearSigEnd)
+	}
+
+	sigs, err := MakeSignatures(sb.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("clearsign: %s", err)
+	}
+
+	c := &ClearSigned{
+		Text: canonText(txt),
+		Sigs: sigs,
+	}
+	return c, nil
+}
+
+// Verify the signatures of the clear signed text against a set of
+// trusted public keys 'pks'; at least 'k' of them must have signed. See
+// VerifyFileThreshold().
+func (c *ClearSigned) Verify(pks []*PublicKey, k int) ([]*PublicKey, error) {
+	r, err := c.VerifyResult(pks, k)
+	return Signers(r), err
+}
+
+// VerifyResult is like Verify() but returns the details of each signature
+// that verified.
+func (c *ClearSigned) VerifyResult(pks []*PublicKey, k int) ([]*VerifyResult, error) {
+	sigs := sizeMatch(c.Sigs, int64(len(c.Text)))
+	return VerifyMessageResult(textCksum(c.Text), sigs, pks, k)
+}
+
+// split text into lines without the line endings and trailing white space
+func textLines(b []byte) [][]byte {
+	lines := bytes.Split(b, []byte("\n"))
+
+	// a trailing newline doesn't start a new line
+	if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+		lines = lines[:n-1]
+	}
+
+	for i, l := range lines {
+		lines[i] = bytes.TrimRight(l, " \t\r")
+	}
+	return lines
+}
+
+// canonical form of the text: each line terminated by '\n'
+func canonText(lines [][]byte) []byte {
+	var b bytes.Buffer
+	for _, l := range lines {
+		b.Write(l)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// checksum of the canonical text; calculated the same way as fileCksum()
+func textCksum(b []byte) []byte {
+	var n [8]byte
+
+	h := sha512.New()
+	h.Write(b)
+	binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+	h.Write(n[:])
+	return h.Sum(nil)
+}
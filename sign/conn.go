@@ -0,0 +1,343 @@
+// conn.go -- authenticated and encrypted connections
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// SecureConn() runs a handshake over a connection between two parties
+// that know each other's public keys; both ends run the same handshake.
+// Each end sends a hello:
+//
+//    byte[8]   "SIGCONN1"
+//    byte[32]  ephemeral X25519 public key
+//    byte[32]  Ed25519 public key
+//
+// and checks that the peer's hello names the expected key. With the two
+// hellos in the order of their ephemeral keys (A before B):
+//
+//    T = SHA256("sigtool v2 conn" || 0x00 || hello(A) || hello(B))
+//    K = HKDF-SHA256(X25519(e, E'), T, "sigtool v2 conn keys" || 0x00)
+//
+// A sends with the first 32 bytes of K and B with the last 32. The first
+// record each end sends is its Ed25519 signature of
+//
+//    "sigtool v2 conn auth" || 0x00 || T || own ephemeral public key
+//
+// and the connection is used once the peer's signature verifies. The
+// keys are ephemeral: recorded traffic stays secret even if the private
+// keys are later stolen.
+//
+// A record is:
+//
+//    uint32_be  length of the ciphertext
+//    byte[]     AES-256-GCM ciphertext of at most 16384 bytes of data
+//
+// where the nonce is the big endian count of the records sent before it
+// in that direction and the additional data is the length. An empty
+// record ends the stream; a stream that ends without it was truncated.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	Ed "crypto/ed25519"
+)
+
+const (
+	_ConnMagic     = "SIGCONN1"
+	_ConnHelloLen  = len(_ConnMagic) + 32 + Ed.PublicKeySize
+	_ConnRecordLen = 16384
+
+	_ConnTranscript = "sigtool v2 conn"
+	_KdfConnKeys    = "sigtool v2 conn keys"
+	_ConnAuth       = "sigtool v2 conn auth"
+)
+
+// secureConn is a net.Conn of records
+type secureConn struct {
+	net.Conn
+
+	rmu    sync.Mutex
+	rd     cipher.AEAD
+	rseq   uint64
+	rbuf   []byte
+	unread []byte
+	rerr   error
+
+	wmu  sync.Mutex
+	wr   cipher.AEAD
+	wseq uint64
+	wbuf []byte
+	werr error
+}
+
+// SecureConn runs the handshake with the peer 'pk' over 'conn' using the
+// private key 'sk' and returns a connection that encrypts and
+// authenticates everything sent over it. Both ends must call it. The
+// caller's deadlines on 'conn' bound the handshake; 'conn' isn't closed
+// if the handshake fails.
+func SecureConn(conn net.Conn, sk *PrivateKey, pk *PublicKey) (net.Conn, error) {
+	if err := fipsRefuse("X25519"); err != nil {
+		return nil, fmt.Errorf("conn: %s", err)
+	}
+
+	if err := sk.checkUsage(UsageSign); err != nil {
+		return nil, fmt.Errorf("conn: %s", err)
+	}
+
+	if !sk.canSign() || len(sk.pk.Pk) != Ed.PublicKeySize {
+		return nil, fmt.Errorf("conn: private key can't sign")
+	}
+	if len(pk.Pk) != Ed.PublicKeySize {
+		return nil, fmt.Errorf("conn: peer key %x has no Ed25519 key", pk.hash)
+	}
+
+	esk, epk, err := newSender()
+	if err != nil {
+		return nil, fmt.Errorf("conn: %s", err)
+	}
+
+	hello := make([]byte, 0, _ConnHelloLen)
+	hello = append(hello, _ConnMagic...)
+	hello = append(hello, epk...)
+	hello = append(hello, sk.pk.Pk...)
+
+	var peer [_ConnHelloLen]byte
+	if err := exchange(func() error {
+		_, err := conn.Write(hello)
+		return err
+	}, func() error {
+		_, err := io.ReadFull(conn, peer[:])
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("conn: handshake: %s", err)
+	}
+
+	pepk := peer[len(_ConnMagic) : len(_ConnMagic)+32]
+	switch {
+	case string(peer[:len(_ConnMagic)]) != _ConnMagic:
+		return nil, fmt.Errorf("conn: handshake: peer isn't a sigtool connection")
+	case subtle.ConstantTimeCompare(peer[len(_ConnMagic)+32:], pk.Pk) != 1:
+		return nil, fmt.Errorf("conn: handshake: peer isn't %x", pk.hash)
+	}
+
+	// A is the end with the lower ephemeral key
+	first := bytes.Compare(epk, pepk)
+	if first == 0 {
+		return nil, fmt.Errorf("conn: handshake: peer echoed our hello")
+	}
+
+	h := sha256.New()
+	h.Write([]byte(_ConnTranscript))
+	h.Write([]byte{0})
+	if first < 0 {
+		h.Write(hello)
+		h.Write(peer[:])
+	} else {
+		h.Write(peer[:])
+		h.Write(hello)
+	}
+	th := h.Sum(nil)
+
+	shared, err := x25519(esk, pepk)
+	if err != nil {
+		return nil, fmt.Errorf("conn: handshake: %s", err)
+	}
+
+	keys, err := hkdfKey(make([]byte, 64), shared, th, _KdfConnKeys, "")
+	if err != nil {
+		return nil, fmt.Errorf("conn: handshake: %s", err)
+	}
+
+	wkey, rkey := keys[:32], keys[32:]
+	if first > 0 {
+		wkey, rkey = rkey, wkey
+	}
+
+	c := &secureConn{Conn: conn}
+	if c.rd, err = chunkAEAD(CipherAESGCM, rkey); err != nil {
+		return nil, fmt.Errorf("conn: %s", err)
+	}
+	if c.wr, err = chunkAEAD(CipherAESGCM, wkey); err != nil {
+		return nil, fmt.Errorf("conn: %s", err)
+	}
+	c.rbuf = make([]byte, 4+_ConnRecordLen+c.rd.Overhead())
+	c.wbuf = make([]byte, 4+_ConnRecordLen+c.wr.Overhead())
+
+	sig, err := sk.ed25519Sign(connAuth(th, epk))
+	if err != nil {
+		return nil, fmt.Errorf("conn: handshake: %s", err)
+	}
+
+	var psig []byte
+	if err := exchange(func() error {
+		_, err := c.Write(sig)
+		return err
+	}, func() error {
+		var err error
+		psig, err = c.readRecord()
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("conn: handshake: %s", err)
+	}
+
+	if len(psig) != Ed.SignatureSize || !Ed.Verify(Ed.PublicKey(pk.Pk), connAuth(th, pepk), psig) {
+		return nil, fmt.Errorf("conn: handshake: peer signature verification failed")
+	}
+	return c, nil
+}
+
+// the message signed by the end with the ephemeral key 'epk'
+func connAuth(th, epk []byte) []byte {
+	m := make([]byte, 0, len(_ConnAuth)+1+len(th)+len(epk))
+	m = append(append(m, _ConnAuth...), 0)
+	m = append(append(m, th...), epk...)
+	return m
+}
+
+// run the 'send' and 'recv' steps of the handshake at the same time so
+// that the two ends can't block each other on unbuffered connections.
+func exchange(send, recv func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- send()
+	}()
+
+	err := recv()
+	if serr := <-errc; err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Read implements the io.Reader interface
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.unread) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+
+		p, err := c.readRecord()
+		if err != nil {
+			c.rerr = err
+			return 0, err
+		}
+		if len(p) == 0 {
+			c.rerr = io.EOF
+			return 0, io.EOF
+		}
+		c.unread = p
+	}
+
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// read and open the next record
+func (c *secureConn) readRecord() ([]byte, error) {
+	hdr := c.rbuf[:4]
+	if _, err := io.ReadFull(c.Conn, hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint32(hdr))
+	if n < c.rd.Overhead() || n > _ConnRecordLen+c.rd.Overhead() {
+		return nil, fmt.Errorf("conn: invalid record length %d", n)
+	}
+
+	ct := c.rbuf[4 : 4+n]
+	if _, err := io.ReadFull(c.Conn, ct); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	p, err := c.rd.Open(ct[:0], connNonce(c.rd, c.rseq), ct, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("conn: record %d: %s", c.rseq, err)
+	}
+	c.rseq++
+	return p, nil
+}
+
+// Write implements the io.Writer interface
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+	for len(b) > 0 {
+		p := b
+		if len(p) > _ConnRecordLen {
+			p = p[:_ConnRecordLen]
+		}
+
+		if err := c.writeRecord(p); err != nil {
+			return n, err
+		}
+		n += len(p)
+		b = b[len(p):]
+	}
+	return n, nil
+}
+
+// seal and send 'p' as one record
+func (c *secureConn) writeRecord(p []byte) error {
+	if c.werr != nil {
+		return c.werr
+	}
+
+	hdr := c.wbuf[:4]
+	binary.BigEndian.PutUint32(hdr, uint32(len(p)+c.wr.Overhead()))
+
+	ct := c.wr.Seal(c.wbuf[4:4], connNonce(c.wr, c.wseq), p, hdr)
+	c.wseq++
+	if _, err := c.Conn.Write(c.wbuf[:4+len(ct)]); err != nil {
+		c.werr = err
+		return err
+	}
+	return nil
+}
+
+// Close ends the stream and closes the connection
+func (c *secureConn) Close() error {
+	c.wmu.Lock()
+	if c.werr == nil {
+		c.writeRecord(nil)
+		c.werr = fmt.Errorf("conn: %s", net.ErrClosed)
+	}
+	c.wmu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// the nonce of record 'seq'
+func connNonce(ae cipher.AEAD, seq uint64) []byte {
+	n := make([]byte, ae.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
@@ -0,0 +1,200 @@
+// delta.go -- re-encrypt a changed file reusing its unchanged chunks
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A content defined chunk doesn't depend on its position or the header
+// of its file: its nonce is derived from its plaintext. So the chunks of
+// a new encryption of a changed file that are also in the previous
+// encryption can be copied from it; a chunk is found by its nonce, which
+// is computed anyway. The new file has a new header and last chunk.
+//
+// Fixed size chunks can't be reused: their nonces depend on the chunk
+// number and header, and sealing new data under an old nonce would
+// reuse it.
+
+package sign
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// location of a chunk of the previous file
+type oldChunk struct {
+	off int64
+	n   int
+}
+
+// chunks of the previous file by nonce
+type oldChunks struct {
+	ra     io.ReaderAt
+	chunks map[string]oldChunk
+
+	// ciphertext bytes copied
+	reused int64
+}
+
+// EncryptDelta encrypts 'rd' to 'wr' like Encrypt() and copies every
+// chunk that is unchanged since the previous encryption 'old' of the file
+// instead of encrypting it again. Content defined chunks must be enabled
+// with the same sender key and name (and the same chunk size, cipher and
+// context) as for 'old'; 'old' is authenticated before any of its chunks
+// are used, and it must not change until EncryptDelta returns. Returns the
+// number of ciphertext bytes copied from 'old'.
+func (e *Encryptor) EncryptDelta(rd io.Reader, old io.ReaderAt, wr io.WriteCloser) (int64, error) {
+	if e.cdc == nil {
+		return 0, fmt.Errorf("encrypt: EncryptDelta() needs content defined chunks")
+	}
+	if e.stream || e.started {
+		return 0, fmt.Errorf("encrypt: EncryptDelta() can't be used after encryption has started")
+	}
+
+	if err := e.start(wr); err != nil {
+		return 0, err
+	}
+
+	oc, err := e.indexOld(old)
+	if err != nil {
+		return 0, err
+	}
+
+	e.cdc.old = oc
+	if err = e.encryptCDC(rd, wr); err != nil {
+		return 0, err
+	}
+
+	info(e.log, "encrypt: delta done", "reused", oc.reused, "chunks", len(oc.chunks))
+	return oc.reused, nil
+}
+
+// find the chunks of the previous file 'ra'; its last chunk must
+// authenticate them with our key.
+func (e *Encryptor) indexOld(ra io.ReaderAt) (*oldChunks, error) {
+	rd := bufio.NewReaderSize(io.NewSectionReader(ra, 0, math.MaxInt64), 65536)
+	d, err := NewDecryptor(rd)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: previous file: %s", err)
+	}
+
+	if d.hdrHash != nil {
+		if err = d.readRecipients(func(int, *pb.WrappedKey) error { return nil }); err != nil {
+			return nil, fmt.Errorf("encrypt: previous file: %s", err)
+		}
+	}
+
+	switch {
+	case d.Chunking != _ChunkingCDC:
+		return nil, fmt.Errorf("encrypt: previous file doesn't have content defined chunks")
+	case d.ChunkSize != e.ChunkSize || d.Cipher != e.Cipher:
+		return nil, fmt.Errorf("encrypt: previous file has another chunk size or cipher")
+	}
+
+	c := e.cdc
+	ns := c.ae.NonceSize()
+	ovh := c.ae.Overhead()
+	buf := make([]byte, int(e.ChunkSize)+ns+ovh)
+
+	oc := &oldChunks{
+		ra:     ra,
+		chunks: make(map[string]oldChunk),
+	}
+
+	h := sha256.New()
+	off := int64(d.hdrlen)
+	for i := uint64(0); ; i++ {
+		var b [_ChunkADLen]byte
+		if _, err := io.ReadFull(rd, b[:4]); err != nil {
+			return nil, fmt.Errorf("encrypt: previous file: can't read chunk %d: %s", i, err)
+		}
+
+		m := binary.BigEndian.Uint32(b[:4])
+		if m&_EOF != 0 {
+			if m != _EOF {
+				return nil, fmt.Errorf("encrypt: previous file: last chunk isn't empty")
+			}
+			if err := e.openOldTrailer(d, rd, b[:], i, h.Sum(nil)); err != nil {
+				return nil, err
+			}
+			return oc, nil
+		}
+
+		if m == 0 || m > e.ChunkSize {
+			return nil, fmt.Errorf("encrypt: previous file: chunk %d of %d bytes", i, m)
+		}
+
+		z := ns + int(m) + ovh
+		if _, err := io.ReadFull(rd, buf[:z]); err != nil {
+			return nil, fmt.Errorf("encrypt: previous file: can't read chunk %d: %s", i, err)
+		}
+		h.Write(b[:4])
+		h.Write(buf[:z])
+
+		oc.chunks[string(buf[:ns])] = oldChunk{off, 4 + z}
+		off += int64(4 + z)
+	}
+}
+
+// verify the last chunk of the previous file 'd' whose chunks have the
+// SHA256 'sum'; it's sealed with the data key of its header.
+func (e *Encryptor) openOldTrailer(d *Decryptor, rd io.Reader, b []byte, i uint64, sum []byte) error {
+	key, err := dataKey(d.version, e.key, d.hdrsum, e.context)
+	if err != nil {
+		return fmt.Errorf("encrypt: %s", err)
+	}
+
+	ae, err := chunkAEAD(d.Cipher, key)
+	if err != nil {
+		return fmt.Errorf("encrypt: %s", err)
+	}
+
+	tag := make([]byte, ae.Overhead())
+	if _, err := io.ReadFull(rd, tag); err != nil {
+		return fmt.Errorf("encrypt: previous file: can't read last chunk: %s", err)
+	}
+
+	ad := chunkAD(b, d.version, binary.BigEndian.Uint32(b[:4]), i, d.hdrsum)
+	ad = append(ad, sum...)
+	nonce := makeNonce(d.Salt, ad)[:ae.NonceSize()]
+
+	if _, err = ae.Open(nil, nonce, tag, ad); err != nil {
+		return fmt.Errorf("encrypt: previous file wasn't encrypted with this key")
+	}
+	return nil
+}
+
+// copy the chunk with nonce 'nonce' and 'z' bytes from the previous file
+// to 'buf'; false if there isn't one.
+func (oc *oldChunks) copy(buf, nonce []byte, z int) (bool, error) {
+	loc, ok := oc.chunks[string(nonce)]
+	if !ok || loc.n != z {
+		return false, nil
+	}
+
+	if _, err := oc.ra.ReadAt(buf[:z], loc.off); err != nil {
+		return false, fmt.Errorf("encrypt: previous file: %s", err)
+	}
+
+	// the nonce covers the length and plaintext
+	if subtle.ConstantTimeCompare(buf[4:4+len(nonce)], nonce) == 0 {
+		return false, fmt.Errorf("encrypt: previous file changed")
+	}
+
+	oc.reused += int64(z)
+	return true, nil
+}
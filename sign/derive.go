@@ -0,0 +1,122 @@
+// derive.go -- keys derived from a passphrase
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A derived identity needs no key file: the signing and encryption keys
+// are computed from a passphrase and a salt (e.g., the user's email
+// address) every time they are needed:
+//
+//    M    = Argon2id(passphrase, "sigtool derived identity v1" || salt,
+//                    t=3, m=64MB, p=4, len=32)
+//    seed = HKDF-SHA256(M, "", "sigtool derived ed25519")
+//    xsk  = HKDF-SHA256(M, "", "sigtool derived x25519")
+//
+// seed is the Ed25519 private key; xsk is the native X25519 encryption key
+// certified by it. The same passphrase and salt always yield the same
+// keys; so the passphrase must be a strong one. The salt isn't secret but
+// should be unique to the user.
+
+package sign
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+
+	Ed "crypto/ed25519"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Argon2id parameters of derived identities; memory is in KB
+	_DeriveTime    uint32 = 3
+	_DeriveMemory  uint32 = 64 * 1024
+	_DeriveThreads uint8  = 4
+
+	_DerivePrefix = "sigtool derived identity v1"
+	_DeriveEd     = "sigtool derived ed25519"
+	_DeriveX25519 = "sigtool derived x25519"
+
+	// ParseIdentity() prefix of a derived identity: "passphrase:SALT"
+	DerivedIdentityPrefix = "passphrase:"
+)
+
+// DeriveKeypair computes the keypair of the passphrase 'pw' and 'salt'
+func DeriveKeypair(pw, salt []byte) (*Keypair, error) {
+	if err := fipsRefuse("Argon2id"); err != nil {
+		return nil, fmt.Errorf("derive key: %s", err)
+	}
+
+	if len(pw) == 0 {
+		return nil, fmt.Errorf("derive key: empty passphrase")
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("derive key: empty salt")
+	}
+
+	s := append([]byte(_DerivePrefix), salt...)
+	m := argon2.IDKey(pw, s, _DeriveTime, _DeriveMemory, _DeriveThreads, 32)
+
+	seed, err := deriveExpand(m, _DeriveEd)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %s", err)
+	}
+
+	xsk, err := deriveExpand(m, _DeriveX25519)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %s", err)
+	}
+
+	sk, err := PrivateKeyFromBytes(Ed.NewKeyFromSeed(seed))
+	if err != nil {
+		return nil, err
+	}
+
+	kp := &Keypair{
+		Sec: *sk,
+		Pub: *sk.pk,
+	}
+	kp.Sec.pk = &kp.Pub
+
+	if err = kp.Sec.setEncryptionKey(clamp(xsk), nil); err != nil {
+		return nil, fmt.Errorf("derive key: %s", err)
+	}
+
+	debug(nil, "keys: derived keypair", "pkhash", fmt.Sprintf("%x", kp.Pub.hash))
+	return kp, nil
+}
+
+// parse a derived identity "passphrase:SALT"; getpw returns the passphrase
+func parseDerivedIdentity(s string, getpw func() ([]byte, error)) (*PrivateKey, error) {
+	salt := strings.TrimPrefix(s, DerivedIdentityPrefix)
+	pw, err := getpw()
+	if err != nil {
+		return nil, fmt.Errorf("parse identity: %s", err)
+	}
+
+	kp, err := DeriveKeypair(pw, []byte(salt))
+	if err != nil {
+		return nil, err
+	}
+	return &kp.Sec, nil
+}
+
+func deriveExpand(m []byte, info string) ([]byte, error) {
+	k := make([]byte, 32)
+	h := hkdf.New(sha256.New, m, nil, []byte(info))
+	if _, err := io.ReadFull(h, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,425 @@
+// dns.go -- discover recipients in DNS
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An organization publishes the key of 'user@example.com' in its zone
+// as a TXT record named like an OPENPGPKEY record (RFC 7929):
+//
+//    hex(SHA256(user)[:28])._sigtool.example.com
+//
+// with the value
+//
+//    v=sigtool1; k=<base64 Ed25519 key>[; x=<base64 X25519 key>; s=<base64 xsig>]
+//
+// The local part is hashed as given; the domain is case insensitive.
+// Unknown tags are ignored. The answer is only as trustworthy as the
+// path to the zone: a lookup reports it as authenticated if the resolver
+// set the AD bit, i.e. it validated the answer with DNSSEC. That's
+// meaningful only if the resolver is trusted (e.g. on the local host);
+// otherwise the fingerprint of the key must be confirmed out of band.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	_DNSLabel    = "_sigtool"
+	_DNSVersion  = "sigtool1"
+	_DNSResolv   = "/etc/resolv.conf"
+	_DNSTimeout  = 3 * time.Second
+	_DNSAttempts = 2
+
+	_DNSTypeTXT = 16
+	_DNSTypeOPT = 41
+	_DNSClassIN = 1
+
+	// header flags
+	_DNSFlagQR = 1 << 15
+	_DNSFlagTC = 1 << 9
+	_DNSFlagRD = 1 << 8
+	_DNSFlagAD = 1 << 5
+
+	_DNSNXDomain = 3
+)
+
+// DNSRecordName returns the name of the TXT record with the key of the
+// address 'addr' ("user@domain").
+func DNSRecordName(addr string) (string, error) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", fmt.Errorf("dns: %q isn't a user@domain address", addr)
+	}
+
+	user, domain := addr[:i], strings.ToLower(strings.TrimSuffix(addr[i+1:], "."))
+	if !validDomain(domain) {
+		return "", fmt.Errorf("dns: %q isn't a valid domain", domain)
+	}
+
+	h := sha256.Sum256([]byte(user))
+	return fmt.Sprintf("%s.%s.%s", hex.EncodeToString(h[:28]), _DNSLabel, domain), nil
+}
+
+// DNSRecord returns the value of the TXT record that publishes the key
+func (pk *PublicKey) DNSRecord() string {
+	b64 := base64.StdEncoding.EncodeToString
+
+	s := fmt.Sprintf("v=%s; k=%s", _DNSVersion, b64(pk.Pk))
+	if pk.xpk != nil {
+		s += fmt.Sprintf("; x=%s; s=%s", b64(pk.xpk), b64(pk.xsig))
+	}
+	return s
+}
+
+// LookupRecipient looks up the key of the address 'addr' ("user@domain")
+// in DNS; the second return value is true if the resolver authenticated
+// the answer with DNSSEC. 'server' is the resolver ("host" or
+// "host:port"); the resolvers in /etc/resolv.conf are used if it is
+// empty.
+func LookupRecipient(addr, server string) (*PublicKey, bool, error) {
+	name, err := DNSRecordName(addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	servers := []string{server}
+	if len(server) == 0 {
+		servers = systemResolvers()
+	}
+
+	var txts []string
+	var secure bool
+	for _, srv := range servers {
+		if _, _, err := net.SplitHostPort(srv); err != nil {
+			srv = net.JoinHostPort(srv, "53")
+		}
+
+		if txts, secure, err = dnsQueryTXT(srv, name); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("dns: %s: %s", addr, err)
+	}
+
+	var pk *PublicKey
+	for _, txt := range txts {
+		k, err := parseDNSRecord(txt)
+		switch {
+		case err != nil:
+			return nil, false, fmt.Errorf("dns: %s: %s", addr, err)
+		case k == nil:
+			continue
+		case pk != nil && !(bytes.Equal(pk.Pk, k.Pk) && bytes.Equal(pk.xpk, k.xpk)):
+			return nil, false, fmt.Errorf("dns: %s: %s has more than one key", addr, name)
+		}
+		pk = k
+	}
+
+	if pk == nil {
+		return nil, false, fmt.Errorf("dns: %s: no sigtool key at %s", addr, name)
+	}
+	pk.Comment = addr
+	return pk, secure, nil
+}
+
+// parse the TXT record 's'; return nil if it isn't a sigtool record
+func parseDNSRecord(s string) (*PublicKey, error) {
+	tags := make(map[string]string)
+	for i, f := range strings.Split(s, ";") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed record %q", s)
+		}
+
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if i == 0 && (k != "v" || v != _DNSVersion) {
+			return nil, nil
+		}
+		tags[k] = v
+	}
+
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	spk := &serializedPubKey{
+		Pk:   tags["k"],
+		Xpk:  tags["x"],
+		Xsig: tags["s"],
+	}
+
+	if len(spk.Pk) == 0 {
+		return nil, fmt.Errorf("record has no key")
+	}
+
+	pk, err := spk.decode()
+	if err != nil {
+		return nil, fmt.Errorf("record: %s", err)
+	}
+	return pk, nil
+}
+
+// the resolvers in resolv.conf; the local host if there are none
+func systemResolvers() []string {
+	var srv []string
+
+	b, _ := ioutil.ReadFile(_DNSResolv)
+	for _, ln := range strings.Split(string(b), "\n") {
+		f := strings.Fields(ln)
+		if len(f) >= 2 && f[0] == "nameserver" {
+			// drop the zone of link local addresses
+			srv = append(srv, strings.SplitN(f[1], "%", 2)[0])
+		}
+	}
+
+	if len(srv) == 0 {
+		srv = append(srv, "127.0.0.1")
+	}
+	return srv
+}
+
+// ask the resolver 'srv' for the TXT records of 'name'; retry over TCP
+// if the answer is truncated. Return the records and the AD bit.
+func dnsQueryTXT(srv, name string) ([]string, bool, error) {
+	var id [2]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, false, err
+	}
+
+	q, err := dnsQuery(binary.BigEndian.Uint16(id[:]), name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := dnsExchange("udp", srv, q)
+	if err != nil {
+		return nil, false, err
+	}
+
+	txts, secure, err := parseDNSResponse(resp, q)
+	if err == errDNSTruncated {
+		if resp, err = dnsExchange("tcp", srv, q); err != nil {
+			return nil, false, err
+		}
+		txts, secure, err = parseDNSResponse(resp, q)
+	}
+	return txts, secure, err
+}
+
+// send the query 'q' to 'srv' over 'proto' and return the response
+func dnsExchange(proto, srv string, q []byte) ([]byte, error) {
+	var err error
+	for i := 0; i < _DNSAttempts; i++ {
+		var conn net.Conn
+
+		if conn, err = net.DialTimeout(proto, srv, _DNSTimeout); err != nil {
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(_DNSTimeout))
+		var resp []byte
+		if proto == "tcp" {
+			resp, err = dnsTCP(conn, q)
+		} else {
+			resp, err = dnsUDP(conn, q)
+		}
+		conn.Close()
+
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// a UDP exchange; responses to other queries are ignored
+func dnsUDP(conn net.Conn, q []byte) ([]byte, error) {
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && buf[0] == q[0] && buf[1] == q[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// a TCP exchange: messages are preceded by their 16 bit length
+func dnsTCP(conn net.Conn, q []byte) ([]byte, error) {
+	b := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// a recursive query for the TXT records of 'name' that asks for DNSSEC
+// validation
+func dnsQuery(id uint16, name string) ([]byte, error) {
+	q := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(q[0:], id)
+	binary.BigEndian.PutUint16(q[2:], _DNSFlagRD|_DNSFlagAD)
+	binary.BigEndian.PutUint16(q[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(q[10:], 1) // ARCOUNT
+
+	for _, l := range strings.Split(name, ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	q = append(q, 0, 0, _DNSTypeTXT, 0, _DNSClassIN)
+
+	// EDNS0 with a 1232 byte payload and the DO bit
+	q = append(q, 0, 0, _DNSTypeOPT, 0x04, 0xd0, 0, 0, 0x80, 0, 0, 0)
+	return q, nil
+}
+
+var errDNSTruncated = errors.New("truncated response")
+
+// parse the response 'b' to the query 'q'; return the TXT records in the
+// answer (each the concatenation of its strings) and the AD bit.
+func parseDNSResponse(b, q []byte) ([]string, bool, error) {
+	if len(b) < 12 {
+		return nil, false, fmt.Errorf("short response")
+	}
+
+	id := binary.BigEndian.Uint16(b[0:])
+	flags := binary.BigEndian.Uint16(b[2:])
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	an := int(binary.BigEndian.Uint16(b[6:]))
+
+	switch {
+	case id != binary.BigEndian.Uint16(q[0:]) || flags&_DNSFlagQR == 0:
+		return nil, false, fmt.Errorf("response doesn't match the query")
+	case flags&_DNSFlagTC != 0:
+		return nil, false, errDNSTruncated
+	case flags&0xf == _DNSNXDomain:
+		return nil, false, fmt.Errorf("no such name")
+	case flags&0xf != 0:
+		return nil, false, fmt.Errorf("server failure (rcode %d)", flags&0xf)
+	}
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		n, err := skipDNSName(b, off)
+		if err != nil {
+			return nil, false, err
+		}
+		off = n + 4
+	}
+
+	var txts []string
+	for i := 0; i < an; i++ {
+		n, err := skipDNSName(b, off)
+		if err != nil {
+			return nil, false, err
+		}
+		if n+10 > len(b) {
+			return nil, false, fmt.Errorf("malformed answer")
+		}
+
+		typ := binary.BigEndian.Uint16(b[n:])
+		rdlen := int(binary.BigEndian.Uint16(b[n+8:]))
+		off = n + 10 + rdlen
+		if off > len(b) {
+			return nil, false, fmt.Errorf("malformed answer")
+		}
+
+		// CNAMEs and signatures in the answer are skipped
+		if typ != _DNSTypeTXT {
+			continue
+		}
+
+		var s []byte
+		rd := b[n+10 : off]
+		for len(rd) > 0 {
+			l := int(rd[0])
+			if 1+l > len(rd) {
+				return nil, false, fmt.Errorf("malformed TXT record")
+			}
+			s = append(s, rd[1:1+l]...)
+			rd = rd[1+l:]
+		}
+		txts = append(txts, string(s))
+	}
+	return txts, flags&_DNSFlagAD != 0, nil
+}
+
+// return the offset past the name at 'off' in 'b'
+func skipDNSName(b []byte, off int) (int, error) {
+	for off < len(b) {
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// compression pointer; the name ends here
+			return off + 2, nil
+		}
+		off += 1 + l
+	}
+	return 0, fmt.Errorf("malformed name")
+}
+
+// true if 'd' is a plausible domain name with at least two labels
+func validDomain(d string) bool {
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 || len(d) > 253 {
+		return false
+	}
+
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 || strings.ContainsAny(l, " \t@/") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+// each.go -- one pass encryption to a separate file for each recipient
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// EncryptEach encrypts 'rd' in one pass to a separate file for each
+// recipient: 'wrs[i]' is encrypted to the i'th recipient added with
+// AddRecipient() and to the escrow recipients, if any. The files share
+// no keys: each has its own file key and ephemeral key, so a recipient
+// can't learn from its file who else received the data.
+func (e *Encryptor) EncryptEach(rd io.Reader, wrs []io.WriteCloser) error {
+	if e.started || e.stream {
+		return fmt.Errorf("encrypt: EncryptEach() can't be used after encryption has started")
+	}
+	if e.manifest != nil || e.useSession {
+		return fmt.Errorf("encrypt: EncryptEach() can't be used with a chunk manifest or sessions")
+	}
+	if e.nextRecipient != nil {
+		return fmt.Errorf("encrypt: EncryptEach() can't be used with streamed recipients")
+	}
+	if e.cdc != nil {
+		return fmt.Errorf("encrypt: EncryptEach() can't be used with content defined chunks")
+	}
+
+	var recips, escrow []*recipient
+	for _, r := range e.recips {
+		if len(r.escrow) > 0 {
+			escrow = append(escrow, r)
+		} else {
+			recips = append(recips, r)
+		}
+	}
+
+	if len(recips) == 0 {
+		return fmt.Errorf("encrypt: no recipients")
+	}
+	if len(wrs) != len(recips) {
+		return fmt.Errorf("encrypt: %d outputs for %d recipients", len(wrs), len(recips))
+	}
+
+	var holes holeMap
+	if fd, ok := rd.(*os.File); ok && e.sparse {
+		holes = fileHoles(fd)
+		debug(e.log, "encrypt: input holes", "holes", len(holes))
+	}
+
+	encs := make([]*Encryptor, len(recips))
+	for i, r := range recips {
+		f, err := e.single(append([]*recipient{r}, escrow...))
+		if err != nil {
+			return err
+		}
+
+		f.holes = holes
+		if err = f.start(wrs[i]); err != nil {
+			return err
+		}
+		encs[i] = f
+	}
+
+	// encrypt each chunk for every output; see Encrypt()
+	chunk := int(e.ChunkSize)
+	buf := make([]byte, chunk+1)
+
+	var i uint64
+	var n int
+	for {
+		m, err := io.ReadFull(rd, buf[n:])
+		n += m
+
+		switch err {
+		case nil:
+			for j, f := range encs {
+				if err = f.encrypt(buf[:chunk], wrs[j], i, false); err != nil {
+					return err
+				}
+			}
+
+			buf[0] = buf[chunk]
+			n = 1
+			i++
+
+		case io.EOF, io.ErrClosedPipe, io.ErrUnexpectedEOF:
+			for j, f := range encs {
+				if err = f.encrypt(buf[:n], wrs[j], i, true); err != nil {
+					return err
+				}
+				if err = wrs[j].Close(); err != nil {
+					return err
+				}
+			}
+			return nil
+
+		default:
+			return fmt.Errorf("encrypt: I/O read error: %s", err)
+		}
+	}
+}
+
+// make an Encryptor with its own file and ephemeral keys for the
+// recipients 'rs'
+func (e *Encryptor) single(rs []*recipient) (*Encryptor, error) {
+	esk, epk, err := newSender()
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+
+	key, salt, wSig, err := newFileKey(e.sk)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Encryptor{
+		Header: pb.Header{
+			ChunkSize:  e.ChunkSize,
+			Salt:       salt,
+			Pk:         epk,
+			SenderSign: wSig,
+		},
+
+		key:        key,
+		encSK:      esk,
+		sk:         e.sk,
+		sparse:     e.sparse,
+		context:    e.context,
+		needEscrow: e.needEscrow,
+		version:    e.version,
+		cipher:     e.cipher,
+		hints:      e.hints,
+		log:        e.log,
+	}
+
+	// r.dkek is bound to the ephemeral key of 'e'; wrap with f's own key
+	for _, r := range rs {
+		w, err := f.wrapKey(&recipient{pk: r.pk, escrow: r.escrow})
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %s", err)
+		}
+		f.Keys = append(f.Keys, w)
+	}
+	return f, nil
+}
@@ -0,0 +1,254 @@
+// embed.go -- self contained files with embedded signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An embedded-signature file is the original content followed by the
+// serialized signature(s) and a fixed size trailer:
+//
+//    - original content (N bytes)
+//    - serialized signature or signature set (YAML, M bytes)
+//    - M: 8 byte big-endian length of the serialized signature
+//    - Magic: 16 bytes ("sigtool-embedded")
+//
+// Since the signature follows the content, the signed file can be
+// produced in one pass and the content is readable as-is by tools that
+// ignore the trailing data.
+
+package sign
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	_EmbedMagic      = "sigtool-embedded"
+	_EmbedTrailerLen = 8 + len(_EmbedMagic)
+
+	// upper bound on the size of the embedded signature blob
+	_MaxEmbedSigLen = 1048576
+)
+
+// EmbeddedFile describes a file with embedded signatures
+type EmbeddedFile struct {
+	// Signatures found in the file
+	Sigs []*Signature
+
+	// Size of the original content
+	Size int64
+
+	fn string
+
+	// content of a file that can't be read twice (e.g., a pipe)
+	data []byte
+}
+
+// WriteEmbedded writes the content of file 'fn' followed by the serialized
+// signature (or signature set) 'sigblob' to 'wr'.
+func WriteEmbedded(wr io.Writer, fn string, sigblob []byte) error {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("embed: %s", err)
+	}
+	defer fd.Close()
+
+	if _, err = io.Copy(wr, fd); err != nil {
+		return fmt.Errorf("embed: %s", err)
+	}
+	return WriteEmbeddedSignature(wr, sigblob)
+}
+
+// WriteEmbeddedSignature writes the serialized signature (or signature
+// set) 'sigblob' to 'wr' after the content it signs; e.g., when the
+// content is copied to 'wr' while it is signed.
+func WriteEmbeddedSignature(wr io.Writer, sigblob []byte) error {
+	var t [_EmbedTrailerLen]byte
+	binary.BigEndian.PutUint64(t[:8], uint64(len(sigblob)))
+	copy(t[8:], _EmbedMagic)
+
+	if err := fullwrite(sigblob, wr); err != nil {
+		return fmt.Errorf("embed: %s", err)
+	}
+	if err := fullwrite(t[:], wr); err != nil {
+		return fmt.Errorf("embed: %s", err)
+	}
+	return nil
+}
+
+// OpenEmbedded reads the embedded signatures of file 'fn'
+func OpenEmbedded(fn string) (*EmbeddedFile, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("embed: %s", err)
+	}
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("embed: %s", err)
+	}
+
+	// the signatures are at the end of a pipe; read all of it
+	if !st.Mode().IsRegular() {
+		b, err := ioutil.ReadAll(fd)
+		if err != nil {
+			return nil, fmt.Errorf("embed: %s", err)
+		}
+
+		data, blob, ok := splitEmbedded(b)
+		if !ok {
+			return nil, fmt.Errorf("embed: %s: no embedded signature", fn)
+		}
+
+		sigs, err := MakeSignatures(blob)
+		if err != nil {
+			return nil, fmt.Errorf("embed: %s: %s", fn, err)
+		}
+		return &EmbeddedFile{Sigs: sigs, Size: int64(len(data)), fn: fn, data: data}, nil
+	}
+
+	sz := st.Size()
+	if sz < int64(_EmbedTrailerLen) {
+		return nil, fmt.Errorf("embed: %s: no embedded signature", fn)
+	}
+
+	var t [_EmbedTrailerLen]byte
+	if _, err = fd.ReadAt(t[:], sz-int64(_EmbedTrailerLen)); err != nil {
+		return nil, fmt.Errorf("embed: %s: %s", fn, err)
+	}
+
+	if !bytes.Equal(t[8:], []byte(_EmbedMagic)) {
+		return nil, fmt.Errorf("embed: %s: no embedded signature", fn)
+	}
+
+	m := binary.BigEndian.Uint64(t[:8])
+	if m > _MaxEmbedSigLen || int64(m) > sz-int64(_EmbedTrailerLen) {
+		return nil, fmt.Errorf("embed: %s: corrupt signature length %d", fn, m)
+	}
+
+	size := sz - int64(_EmbedTrailerLen) - int64(m)
+	blob := make([]byte, m)
+	if _, err = fd.ReadAt(blob, size); err != nil {
+		return nil, fmt.Errorf("embed: %s: %s", fn, err)
+	}
+
+	sigs, err := MakeSignatures(blob)
+	if err != nil {
+		return nil, fmt.Errorf("embed: %s: %s", fn, err)
+	}
+
+	e := &EmbeddedFile{
+		Sigs: sigs,
+		Size: size,
+		fn:   fn,
+	}
+	return e, nil
+}
+
+// split 'b' into the content and the serialized signatures if it has
+// embedded signatures
+func splitEmbedded(b []byte) ([]byte, []byte, bool) {
+	sz := len(b) - _EmbedTrailerLen
+	if sz < 0 || !bytes.Equal(b[sz+8:], []byte(_EmbedMagic)) {
+		return nil, nil, false
+	}
+
+	m := binary.BigEndian.Uint64(b[sz : sz+8])
+	if m > _MaxEmbedSigLen || m > uint64(sz) {
+		return nil, nil, false
+	}
+
+	n := sz - int(m)
+	return b[:n], b[n:sz], true
+}
+
+// Verify the embedded signatures against a set of trusted public keys
+// 'pks'; at least 'k' of them must have signed. See VerifyFileThreshold().
+func (e *EmbeddedFile) Verify(pks []*PublicKey, k int) ([]*PublicKey, error) {
+	r, err := e.VerifyResult(pks, k)
+	return Signers(r), err
+}
+
+// VerifyResult is like Verify() but returns the details of each signature
+// that verified.
+func (e *EmbeddedFile) VerifyResult(pks []*PublicKey, k int) ([]*VerifyResult, error) {
+	// the content is hashed once with each hash used by the signatures
+	cks := make(map[string][]byte)
+	for _, sig := range e.Sigs {
+		algo := sigHashAlgo(sig)
+		if _, ok := cks[algo]; ok {
+			continue
+		}
+
+		ck, err := e.cksum(algo)
+		if err != nil {
+			return nil, fmt.Errorf("embed: %s", err)
+		}
+		cks[algo] = ck
+	}
+
+	cksum := func(sig *Signature) []byte {
+		return cks[sigHashAlgo(sig)]
+	}
+	return verifyResult(cksum, sizeMatch(e.Sigs, e.Size), pks, k)
+}
+
+// checksum of the original content with hash 'algo'
+func (e *EmbeddedFile) cksum(algo string) ([]byte, error) {
+	h, err := contentHash(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.data != nil {
+		h.Write(e.data)
+	} else {
+		fd, err := os.Open(e.fn)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+
+		if e.Size > 0 {
+			if _, err = mmapReader(fd, 0, e.Size, h); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(e.Size))
+	h.Write(b[:])
+	return h.Sum(nil), nil
+}
+
+// Extract writes the original content to 'wr'
+func (e *EmbeddedFile) Extract(wr io.Writer) error {
+	if e.data != nil {
+		return fullwrite(e.data, wr)
+	}
+
+	fd, err := os.Open(e.fn)
+	if err != nil {
+		return fmt.Errorf("embed: %s", err)
+	}
+	defer fd.Close()
+
+	if _, err = io.Copy(wr, io.LimitReader(fd, e.Size)); err != nil {
+		return fmt.Errorf("embed: %s", err)
+	}
+	return nil
+}
@@ -42,13 +42,20 @@
 // The input data is broken up into "chunks"; each no larger than
 // maxChunkSize. The default block size is "chunkSize". Each block
 // is AEAD encrypted:
-//   AEAD nonce = SHA256(header.salt || block# || block-size)
+//   AEAD nonce = SHA256(header.salt || block-size || block#)
+//
+// The block size and number are the additional data of the AEAD; the
+// block number is 8 bytes in version 2 and 4 bytes in version 1 (which
+// can number at most 2^32 blocks).
 //
 // The encrypted block (includes the AEAD tag) length is written
 // as a big-endian 4-byte prefix. The high-order bit of this length
 // field is set for the last-block (denoting EOF).
 //
 // The encrypted blocks use an opinionated nonce length of 32 (_AEADNonceLen).
+//
+// Version 3 files carry their wrapped keys in a recipient section after
+// the protobuf header (see streamhdr.go).
 
 package sign
 
@@ -61,10 +68,16 @@ import (
 	"crypto/sha512"
 	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
+	"hash"
 	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/opencoff/sigtool/internal/pb"
 )
@@ -72,17 +85,34 @@ import (
 // Encryption chunk size = 4MB
 const (
 	chunkSize    uint32 = 4 * 1048576
+	minChunkSize uint32 = 64 * 1024
 	maxChunkSize uint32 = 16 * 1048576
 	_EOF         uint32 = 1 << 31
+	_Hole        uint32 = 1 << 30
+
+	// AutoChunkSize() aims for roughly this many chunks per file
+	autoChunks = 256
 
 	_Magic        = "SigTool"
 	_MagicLen     = len(_Magic)
 	_AEADNonceLen = 16
+	_AEADTagLen   = 16
 	_FixedHdrLen  = _MagicLen + 1 + 4
 
+	// length prefix + AEAD tag of every encrypted chunk
+	_ChunkOverhead = 4 + _AEADTagLen
+
 	_WrapReceiverNonce = "Receiver Key Nonce"
 	_WrapSenderNonce   = "Sender Sig Nonce"
 	_EncryptNonce      = "Encrypt Nonce"
+
+	// format version of new files and the version with 32-bit chunk
+	// numbers
+	_Version  uint8 = 2
+	_Version1 uint8 = 1
+
+	// format version of files with a streamed recipient section
+	_Version3 uint8 = 3
 )
 
 // Encryptor holds the encryption context
@@ -92,6 +122,9 @@ type Encryptor struct {
 
 	ae cipher.AEAD
 
+	// chunk cipher (see aead.go)
+	cipher string
+
 	// ephemeral key
 	encSK []byte
 
@@ -100,36 +133,119 @@ type Encryptor struct {
 	hdrsum []byte
 	buf    []byte
 	stream bool
+
+	// format version; _Version if 0
+	version uint8
+
+	// application context of the data key (see kdf.go)
+	context string
+
+	// hashes of the written chunks; nil unless enabled
+	manifest *ChunkManifest
+
+	// record holes in the input (see sparse.go)
+	sparse bool
+	holes  holeMap
+
+	// sender and recipients; EncryptTo() wraps a new key for each file
+	sk     *PrivateKey
+	recips []*recipient
+
+	// more recipients, wrapped as the header is written (see streamhdr.go)
+	nextRecipient func() (*PublicKey, error)
+
+	// wrapped session key for EncryptTo() (see session.go)
+	useSession bool
+	session    *session
+
+	// refuse to encrypt without an escrow recipient (see policy.go)
+	needEscrow bool
+
+	// add recipient hints to the wrapped keys (see hints.go)
+	hints bool
+
+	// next chunk index and bytes written; and the checkpoint callback
+	// (see checkpoint.go)
+	nextChunk uint64
+	written   int64
+	ckptEvery uint64
+	ckptFn    func(c *EncryptCheckpoint) error
+
+	// content defined chunks (see cdc.go)
+	cdc *cdcChunks
+
+	log *slog.Logger
+}
+
+// recipient of an Encryptor; the key-encryption AEAD of an X25519
+// recipient is derived once and used for every file key.
+type recipient struct {
+	pk *PublicKey
+
+	// X25519 shared secret with the ephemeral key; the key-wrapping key
+	// of each file is derived from it
+	dkek []byte
+
+	// escrow key id recorded in the header; empty for other recipients
+	escrow string
 }
 
 // Create a new Encryption context for encrypting blocks of size 'blksize'.
 // If 'sk' is not nil, authenticate the sender to each receiver.
 func NewEncryptor(sk *PrivateKey, blksize uint64) (*Encryptor, error) {
-	var blksz uint32
-
-	switch {
-	case blksize == 0:
-		blksz = chunkSize
-	case blksize > uint64(maxChunkSize):
-		blksz = maxChunkSize
-	default:
-		blksz = uint32(blksize)
+	if err := fipsRefuse("X25519"); err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
 	}
 
+	blksz := blockSize(blksize)
+
 	// generate ephemeral Curve25519 keys
 	esk, epk, err := newSender()
 	if err != nil {
 		return nil, fmt.Errorf("encrypt: %s", err)
 	}
 
-	key := make([]byte, 32)
-	salt := make([]byte, _AEADNonceLen)
+	key, salt, wSig, err := newFileKey(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encryptor{
+		Header: pb.Header{
+			ChunkSize:  blksz,
+			Salt:       salt,
+			Pk:         epk,
+			SenderSign: wSig,
+		},
+
+		key:    key,
+		encSK:  esk,
+		sk:     sk,
+		cipher: AutoCipher(),
+	}
+
+	return e, nil
+}
+
+// make a new data-encryption key and salt; if sender has provided their
+// identity to authenticate, we sign the data-enc key and encrypt the
+// signature. At no point will we send the sender's identity.
+func newFileKey(sk *PrivateKey) (key, salt, wSig []byte, err error) {
+	key = make([]byte, 32)
+	salt = make([]byte, _AEADNonceLen)
 
 	randRead(key)
 	randRead(salt)
 
-	// if sender has provided their identity to authenticate, we sign the data-enc key
-	// and encrypt the signature. At no point will we send the sender's identity.
+	wSig, err = signFileKey(sk, key, salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, salt, wSig, nil
+}
+
+// sign the file key 'key' with 'sk' (if not nil) and encrypt the signature
+func signFileKey(sk *PrivateKey, key, salt []byte) ([]byte, error) {
 	var senderSig []byte
 	if sk != nil {
 		sig, err := sk.SignMessage(key, "")
@@ -147,36 +263,233 @@ func NewEncryptor(sk *PrivateKey, blksize uint64) (*Encryptor, error) {
 	if err != nil {
 		return nil, fmt.Errorf("encrypt: %s", err)
 	}
+	return wSig, nil
+}
 
-	e := &Encryptor{
-		Header: pb.Header{
-			ChunkSize:  blksz,
-			Salt:       salt,
-			Pk:         epk,
-			SenderSign: wSig,
-		},
+// AutoChunkSize returns a suitable encryption block size for a plaintext
+// of 'size' bytes. Small inputs get small chunks (less memory, less padding
+// of the last block); very large inputs get large chunks (fewer per-chunk
+// length prefixes and AEAD tags). The result is always a power of two between
+// 64KB and 16MB and can be passed directly to NewEncryptor(). A negative
+// size denotes an unknown length and yields the default chunk size.
+func AutoChunkSize(size int64) uint64 {
+	if size < 0 {
+		return uint64(chunkSize)
+	}
 
-		key:   key,
-		encSK: esk,
+	want := (uint64(size) + autoChunks - 1) / autoChunks
+	blksz := uint64(minChunkSize)
+	for blksz < want && blksz < uint64(maxChunkSize) {
+		blksz <<= 1
 	}
+	return blksz
+}
 
-	return e, nil
+// EncryptedSize returns the exact size of the ciphertext produced by
+// encrypting 'size' bytes of plaintext to 'nrecip' X25519 recipients using
+// a block size of 'blksize' (as given to NewEncryptor()) and the default
+// cipher. The size of keys wrapped by registered recipient schemes isn't
+// known in advance.
+func EncryptedSize(size int64, nrecip int, blksize uint64) int64 {
+	return encryptedSize(size, nrecip, blockSize(blksize), AutoCipher())
+}
+
+// EncryptedSize returns the exact size of the ciphertext produced by 'e'
+// for 'size' bytes of plaintext and 'nrecip' X25519 recipients; or -1
+// for content defined chunks.
+func (e *Encryptor) EncryptedSize(size int64, nrecip int) int64 {
+	if e.cdc != nil {
+		return -1
+	}
+
+	var hints int64
+	if e.hints {
+		hints = int64(nrecip * _RecipientHintOverhead)
+	}
+
+	if e.nextRecipient != nil {
+		hdr := streamedHeaderSize(nrecip, e.ChunkSize, e.cipher)
+		return hints + int64(hdr) + encryptedSize(size, 0, e.ChunkSize, e.cipher) - int64(headerSize(0, e.ChunkSize, e.cipher))
+	}
+	return hints + encryptedSize(size, nrecip, e.ChunkSize, e.cipher)
+}
+
+func encryptedSize(size int64, nrecip int, chunkSize uint32, name string) int64 {
+	blksz := int64(chunkSize)
+
+	// every chunk carries a length prefix and an AEAD tag; the last chunk
+	// is always present (it may be empty) and marks EOF.
+	nchunks := size / blksz
+	if nchunks == 0 || size%blksz != 0 {
+		nchunks++
+	}
+
+	return int64(headerSize(nrecip, chunkSize, name)) + size + (nchunks * _ChunkOverhead)
+}
+
+// DecryptedSize returns the size of the plaintext contained in a
+// ciphertext of 'size' bytes whose header has been parsed by 'd'.
+func DecryptedSize(d *Decryptor, size int64) (int64, error) {
+	return decryptedSize(d.hdrlen, d.ChunkSize, d.Chunking, size)
+}
+
+func decryptedSize(hdrlen int, chunkSize uint32, chunking string, size int64) (int64, error) {
+	if chunking == _ChunkingCDC {
+		return 0, fmt.Errorf("decrypt: size of content defined chunks isn't known")
+	}
+
+	size -= int64(hdrlen)
+	if size < _ChunkOverhead {
+		return 0, fmt.Errorf("decrypt: ciphertext too small")
+	}
+
+	full := int64(chunkSize) + _ChunkOverhead
+	nchunks := size / full
+	if r := size % full; r != 0 {
+		if r < _ChunkOverhead {
+			return 0, fmt.Errorf("decrypt: ciphertext has a partial chunk")
+		}
+		nchunks++
+	}
+
+	return size - (nchunks * _ChunkOverhead), nil
+}
+
+// headerSize returns the size of the header written by an Encryptor with
+// 'nrecip' recipients and chunk cipher 'name'
+func headerSize(nrecip int, blksz uint32, name string) int {
+	var zero [ed25519.SignatureSize + _AEADTagLen]byte
+
+	h := pb.Header{
+		ChunkSize:  blksz,
+		Salt:       zero[:_AEADNonceLen],
+		Pk:         zero[:32],
+		SenderSign: zero[:],
+		Keys:       make([]*pb.WrappedKey, nrecip),
+		Cipher:     headerCipher(name),
+	}
+
+	for i := range h.Keys {
+		h.Keys[i] = &pb.WrappedKey{DKey: zero[:32+_AEADTagLen]}
+	}
+
+	return _FixedHdrLen + h.Size() + sha256.Size
+}
+
+// blockSize normalizes a caller supplied block size
+func blockSize(blksize uint64) uint32 {
+	switch {
+	case blksize == 0:
+		return chunkSize
+	case blksize > uint64(maxChunkSize):
+		return maxChunkSize
+	default:
+		return uint32(blksize)
+	}
 }
 
 // Add a new recipient to this encryption context.
 func (e *Encryptor) AddRecipient(pk *PublicKey) error {
+	return e.addRecipient(&recipient{pk: pk})
+}
+
+// wrap the file key for the recipient 'r'
+func (e *Encryptor) addRecipient(r *recipient) error {
 	if e.started {
 		return fmt.Errorf("encrypt: can't add new recipient after encryption has started")
 	}
 
-	w, err := e.wrapKey(pk)
+	if err := r.pk.checkUsage(UsageEncrypt); err != nil {
+		return fmt.Errorf("encrypt: %s", err)
+	}
+
+	if err := r.pk.checkExpiry("encrypt"); err != nil {
+		return err
+	}
+
+	w, err := e.wrapKey(r)
 	if err == nil {
 		e.Keys = append(e.Keys, w)
+		e.recips = append(e.recips, r)
+		e.session = nil
 	}
 
 	return err
 }
 
+// EncryptTo encrypts 'rd' to 'wr' as a new, independent file for the
+// sender and recipients of this Encryptor: each call makes a new file key
+// and salt, but the ephemeral key and the per-recipient key-encryption
+// keys are reused. The files can thus be linked to each other by the
+// shared ephemeral public key in their headers. The Encryptor's own
+// Encrypt() and streaming I/O are not affected.
+//
+// With EnableSession(), the file keys are derived from one session key
+// that is wrapped for the recipients only once.
+func (e *Encryptor) EncryptTo(rd io.Reader, wr io.WriteCloser) error {
+	if e.manifest != nil {
+		return fmt.Errorf("encrypt: EncryptTo() can't be used with a chunk manifest")
+	}
+	if e.cdc != nil {
+		return fmt.Errorf("encrypt: EncryptTo() can't be used with content defined chunks")
+	}
+	if e.nextRecipient != nil {
+		return fmt.Errorf("encrypt: EncryptTo() can't be used with streamed recipients")
+	}
+
+	var key, salt, wSig []byte
+	var err error
+
+	if e.useSession {
+		if e.session == nil {
+			if e.session, err = e.newSession(); err != nil {
+				return err
+			}
+		}
+		key, salt, wSig, err = e.session.fileKey()
+	} else {
+		key, salt, wSig, err = newFileKey(e.sk)
+	}
+	if err != nil {
+		return err
+	}
+
+	f := &Encryptor{
+		Header: pb.Header{
+			ChunkSize:  e.ChunkSize,
+			Salt:       salt,
+			Pk:         e.Pk,
+			SenderSign: wSig,
+		},
+
+		key:        key,
+		encSK:      e.encSK,
+		sk:         e.sk,
+		sparse:     e.sparse,
+		context:    e.context,
+		needEscrow: e.needEscrow,
+		cipher:     e.cipher,
+		hints:      e.hints,
+		log:        e.log,
+	}
+
+	if e.useSession {
+		f.Session = e.session.salt
+		f.Keys = e.session.keys
+		return f.Encrypt(rd, wr)
+	}
+
+	for _, r := range e.recips {
+		w, err := f.wrapKey(r)
+		if err != nil {
+			return fmt.Errorf("encrypt: %s", err)
+		}
+		f.Keys = append(f.Keys, w)
+	}
+
+	return f.Encrypt(rd, wr)
+}
+
 // Encrypt the input stream 'rd' and write encrypted stream to 'wr'
 func (e *Encryptor) Encrypt(rd io.Reader, wr io.WriteCloser) error {
 	if e.stream {
@@ -190,36 +503,78 @@ func (e *Encryptor) Encrypt(rd io.Reader, wr io.WriteCloser) error {
 		}
 	}
 
-	buf := make([]byte, e.ChunkSize)
+	if e.cdc != nil {
+		return e.encryptCDC(rd, wr)
+	}
 
-	var i uint32
-	var eof bool
-	for !eof {
-		n, err := io.ReadAtLeast(rd, buf, int(e.ChunkSize))
-		if err != nil {
-			switch err {
-			case io.EOF, io.ErrClosedPipe, io.ErrUnexpectedEOF:
-				eof = true
-			default:
-				return fmt.Errorf("encrypt: I/O read error: %s", err)
-			}
-		}
+	if fd, ok := rd.(*os.File); ok && e.sparse {
+		e.holes = fileHoles(fd)
+		debug(e.log, "encrypt: input holes", "holes", len(e.holes))
+	}
 
-		if n >= 0 {
-			err = e.encrypt(buf[:n], wr, i, eof)
+	// We read one byte past the chunk boundary; this tells us if the
+	// current chunk is the last one without having to emit an empty
+	// trailing chunk. The extra byte is carried over to the next chunk.
+	chunk := int(e.ChunkSize)
+	buf := make([]byte, chunk+1)
+
+	i := e.nextChunk
+	var n int
+	for {
+		m, err := io.ReadFull(rd, buf[n:])
+		n += m
+
+		switch err {
+		case nil:
+			err = e.encrypt(buf[:chunk], wr, i, false)
 			if err != nil {
 				return err
 			}
 
+			buf[0] = buf[chunk]
+			n = 1
 			i++
+
+		case io.EOF, io.ErrClosedPipe, io.ErrUnexpectedEOF:
+			err = e.encrypt(buf[:n], wr, i, true)
+			if err != nil {
+				return err
+			}
+			return wr.Close()
+
+		default:
+			return fmt.Errorf("encrypt: I/O read error: %s", err)
 		}
 	}
-
-	return wr.Close()
 }
 
 // Begin the encryption process by writing the header
 func (e *Encryptor) start(wr io.Writer) error {
+	if err := e.checkEscrow(); err != nil {
+		return err
+	}
+
+	e.Cipher = headerCipher(e.cipher)
+	if e.nextRecipient != nil {
+		if len(e.Session) > 0 {
+			return fmt.Errorf("encrypt: streamed recipients can't be used with sessions")
+		}
+
+		sum, err := e.writeStreamedHeader(wr)
+		if err != nil {
+			return err
+		}
+		e.hdrsum = sum
+		return e.startChunks()
+	}
+
+	// the keys were wrapped for the default format version
+	if e.version == _Version1 {
+		if err := e.rewrapKeys(); err != nil {
+			return err
+		}
+	}
+
 	varSize := e.Size()
 
 	buffer := make([]byte, _FixedHdrLen+varSize+sha256.Size)
@@ -229,7 +584,10 @@ func (e *Encryptor) start(wr io.Writer) error {
 
 	// Now assemble the fixed header
 	copy(fixHdr[:], []byte(_Magic))
-	fixHdr[_MagicLen] = 1 // version #
+	if e.version == 0 {
+		e.version = _Version
+	}
+	fixHdr[_MagicLen] = e.version
 	binary.BigEndian.PutUint32(fixHdr[_MagicLen+1:], uint32(varSize))
 
 	// Now marshal the variable portion
@@ -242,6 +600,7 @@ func (e *Encryptor) start(wr io.Writer) error {
 	h := sha256.New()
 	h.Write(buffer[:_FixedHdrLen+varSize])
 	h.Sum(sumHdr[:0])
+	e.hdrsum = sumHdr
 
 	// Finally write it out
 	err = fullwrite(buffer, wr)
@@ -249,19 +608,25 @@ func (e *Encryptor) start(wr io.Writer) error {
 		return fmt.Errorf("encrypt: %s", err)
 	}
 
-	// we mix the header checksum to create the encryption key
-	h = sha256.New()
-	h.Write([]byte(_EncryptNonce))
-	h.Write(e.key)
-	h.Write(sumHdr)
-	key := h.Sum(nil)
+	if e.manifest != nil {
+		e.manifest.addHeader(buffer)
+	}
+	e.written = int64(len(buffer))
 
-	aes, err := aes.NewCipher(key)
+	info(e.log, "encrypt: header written", "recipients", len(e.Keys),
+		"chunksize", e.ChunkSize, "hdrlen", len(buffer))
+	return e.startChunks()
+}
+
+// set up the chunk cipher once the header is written
+func (e *Encryptor) startChunks() error {
+	// we mix the header checksum to create the encryption key
+	key, err := dataKey(e.version, e.key, e.hdrsum, e.context)
 	if err != nil {
 		return fmt.Errorf("encrypt: %s", err)
 	}
 
-	ae, err := cipher.NewGCMWithNonceSize(aes, _AEADNonceLen)
+	ae, err := chunkAEAD(e.Cipher, key)
 	if err != nil {
 		return fmt.Errorf("encrypt: %s", err)
 	}
@@ -269,6 +634,13 @@ func (e *Encryptor) start(wr io.Writer) error {
 	e.buf = make([]byte, e.ChunkSize+4+uint32(ae.Overhead()))
 	e.ae = ae
 
+	if e.cdc != nil {
+		if err = e.cdc.init(e.key, e.context, e.Cipher, e.ChunkSize); err != nil {
+			return fmt.Errorf("encrypt: %s", err)
+		}
+		e.buf = make([]byte, int(e.ChunkSize)+4+e.cdc.ae.NonceSize()+ae.Overhead())
+	}
+
 	e.started = true
 	return nil
 }
@@ -290,40 +662,78 @@ func fullwrite(buf []byte, wr io.Writer) error {
 }
 
 // encrypt exactly _one_ block of data
-// The nonce for the block is: sha256(salt || chunkLen || block#)
+// The nonce for the block is: sha256(salt || chunkLen || block# || hdrsum)
 // This protects the output stream from re-ordering attacks and length
-// modification attacks. The encoded length & block number is used as
-// additional data in the AEAD construction.
-func (e *Encryptor) encrypt(buf []byte, wr io.Writer, i uint32, eof bool) error {
-	var nonceb [32]byte
+// modification attacks. The encoded length, block number & header
+// checksum are used as additional data in the AEAD construction.
+func (e *Encryptor) encrypt(buf []byte, wr io.Writer, i uint64, eof bool) error {
 	var z uint32 = uint32(len(buf))
 
+	if i > maxChunk(e.version) {
+		return ErrTooManyChunks
+	}
+
 	// mark last block
 	if eof {
 		z |= _EOF
 	}
 
-	b := e.buf[:8]
-	binary.BigEndian.PutUint32(b[:4], z)
-	binary.BigEndian.PutUint32(b[4:], i)
-
-	h := sha256.New()
-	h.Write(e.Salt)
-	h.Write(b[:])
-	nonce := h.Sum(nonceb[:0])[:e.ae.NonceSize()]
-
-	cbuf := e.buf[4:]
-	c := e.ae.Seal(cbuf[:0], nonce, buf, b[:])
+	// a chunk of zeros in a hole of the input is only authenticated
+	off := int64(i) * int64(e.ChunkSize)
+	if len(buf) > 0 && e.holes.covers(off, int64(len(buf))) && isZero(buf) {
+		z |= _Hole
+		buf = buf[:0]
+	}
 
 	// total number of bytes written
-	n := len(c) + 4
+	n := len(e.seal(buf, i, z))
 	err := fullwrite(e.buf[:n], wr)
 	if err != nil {
 		return fmt.Errorf("encrypt: %s", err)
 	}
+
+	if e.manifest != nil {
+		e.manifest.addChunk(e.buf[:n])
+	}
+	e.written += int64(n)
+
+	if eof {
+		info(e.log, "encrypt: done", "chunks", i+1)
+		return nil
+	}
+
+	e.nextChunk = i + 1
+	if e.ckptFn != nil && e.nextChunk%e.ckptEvery == 0 {
+		if err = e.ckptFn(e.checkpoint()); err != nil {
+			return fmt.Errorf("encrypt: checkpoint: %s", err)
+		}
+	}
 	return nil
 }
 
+// seal chunk 'i' with length word 'z' into e.buf and return it
+func (e *Encryptor) seal(buf []byte, i uint64, z uint32) []byte {
+	var b [_ChunkADLen]byte
+	var nonceb [32]byte
+
+	ad := chunkAD(b[:], e.version, z, i, e.hdrsum)
+	if e.cdc != nil {
+		ad = e.cdc.sum.Sum(ad)
+	}
+
+	h := sha256.New()
+	h.Write(e.Salt)
+	h.Write(ad)
+	nonce := h.Sum(nonceb[:0])[:e.ae.NonceSize()]
+
+	// the AEAD output must not overlap the additional data; so we
+	// copy the length prefix only after sealing the block.
+	cbuf := e.buf[4:]
+	c := e.ae.Seal(cbuf[:0], nonce, buf, ad)
+	copy(e.buf[:4], b[:4])
+	return e.buf[:len(c)+4]
+}
+
 // Decryptor holds the decryption context
 type Decryptor struct {
 	pb.Header
@@ -332,14 +742,44 @@ type Decryptor struct {
 	rd     io.Reader
 	buf    []byte
 	hdrsum []byte
+	hdrlen int
+
+	// hash of the header of a version 3 file until its recipients are
+	// read; and the number of recipients read (see streamhdr.go)
+	hdrHash hash.Hash
+	nrecip  int
+
+	// rewrap records of a rewrapped file (see rewrap.go)
+	rewraps []*rewrapRecord
+
+	// content defined chunks (see cdc.go)
+	cdc *cdcChunks
+
+	// format version of the file
+	version uint8
+
+	// application context of the data key (see kdf.go)
+	context string
+
+	// limit on the memory for the header and chunk buffers; 0 is no limit
+	memLimit uint64
 
 	// flag set to true if sender signed the key
 	auth bool
 
+	// the last chunk decrypted was a hole
+	hole bool
+
+	log *slog.Logger
+
 	// Decrypted key
 	key    []byte
 	eof    bool
 	stream bool
+
+	// next chunk of ReadChunk(); chunked is set once it is used
+	next    uint64
+	chunked bool
 }
 
 // Create a new decryption context and if 'pk' is given, check that it matches
@@ -352,12 +792,18 @@ func NewDecryptor(rd io.Reader) (*Decryptor, error) {
 		return nil, fmt.Errorf("decrypt: err while reading header: %s", err)
 	}
 
+	// a rewrapped file starts with its rewrap records
+	rewraps, err := readRewraps(rd, b[:])
+	if err != nil {
+		return nil, err
+	}
+
 	if bytes.Compare(b[:_MagicLen], []byte(_Magic)) != 0 {
 		return nil, fmt.Errorf("decrypt: Not a sigtool encrypted file?")
 	}
 
-	if b[_MagicLen] != 1 {
-		return nil, fmt.Errorf("decrypt: Unsupported version %d", b[_MagicLen])
+	if v := b[_MagicLen]; v != _Version && v != _Version1 && v != _Version3 {
+		return nil, fmt.Errorf("decrypt: Unsupported version %d", v)
 	}
 
 	varSize := binary.BigEndian.Uint32(b[_MagicLen+1:])
@@ -370,28 +816,47 @@ func NewDecryptor(rd io.Reader) (*Decryptor, error) {
 		return nil, fmt.Errorf("decrypt: header too small (min 32)")
 	}
 
-	// SHA256 is the trailer part of the file-header
-	varBuf := make([]byte, varSize+sha256.Size)
+	memLimit := atomic.LoadUint64(&decryptMemLimit)
+	if err := checkHeaderMem(memLimit, varSize); err != nil {
+		return nil, err
+	}
+
+	// SHA256 is the trailer part of the file-header; the recipients of
+	// a version 3 file come before it
+	streamed := b[_MagicLen] == _Version3
+	trailer := uint32(sha256.Size)
+	if streamed {
+		trailer = 0
+	}
+	varBuf := make([]byte, varSize+trailer)
 
 	_, err = io.ReadFull(rd, varBuf)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt: err while reading header: %s", err)
 	}
 
-	verify := varBuf[varSize:]
-
 	h := sha256.New()
 	h.Write(b[:])
 	h.Write(varBuf[:varSize])
-	cksum := h.Sum(nil)
 
-	if subtle.ConstantTimeCompare(verify, cksum[:]) == 0 {
-		return nil, fmt.Errorf("decrypt: header corrupted")
+	d := &Decryptor{
+		rd:       rd,
+		hdrlen:   rewrapsLen(rewraps) + _FixedHdrLen + len(varBuf),
+		rewraps:  rewraps,
+		version:  b[_MagicLen],
+		memLimit: memLimit,
 	}
 
-	d := &Decryptor{
-		rd:     rd,
-		hdrsum: cksum,
+	if streamed {
+		d.hdrHash = h
+	} else {
+		verify := varBuf[varSize:]
+		cksum := h.Sum(nil)
+
+		if subtle.ConstantTimeCompare(verify, cksum[:]) == 0 {
+			return nil, fmt.Errorf("decrypt: header corrupted")
+		}
+		d.hdrsum = cksum
 	}
 
 	err = d.Unmarshal(varBuf[:varSize])
@@ -399,25 +864,48 @@ func NewDecryptor(rd io.Reader) (*Decryptor, error) {
 		return nil, fmt.Errorf("decrypt: decode error: %s", err)
 	}
 
-	if d.ChunkSize == 0 || d.ChunkSize >= maxChunkSize {
+	if d.ChunkSize == 0 || d.ChunkSize > maxChunkSize {
 		return nil, fmt.Errorf("decrypt: invalid chunkSize %d", d.ChunkSize)
 	}
 
+	switch d.Chunking {
+	case "":
+	case _ChunkingCDC:
+		if d.version == _Version1 || d.ChunkSize < _MinCDCChunkSize {
+			return nil, fmt.Errorf("decrypt: invalid content defined chunks")
+		}
+	default:
+		return nil, fmt.Errorf("decrypt: unsupported chunking %s", d.Chunking)
+	}
+
+	if err := d.checkMem("header and chunk buffer", d.memNeeded(false)); err != nil {
+		return nil, err
+	}
+
 	if len(d.Salt) != _AEADNonceLen {
 		return nil, fmt.Errorf("decrypt: invalid nonce length %d", len(d.Salt))
 	}
 
-	if len(d.Keys) == 0 {
+	if len(d.Session) > 0 && len(d.Session) != _AEADNonceLen {
+		return nil, fmt.Errorf("decrypt: invalid session salt length %d", len(d.Session))
+	}
+
+	switch {
+	case streamed && len(d.Keys) > 0:
+		return nil, fmt.Errorf("decrypt: wrapped keys outside the recipient section")
+	case !streamed && len(d.Keys) == 0:
 		return nil, fmt.Errorf("decrypt: no wrapped keys")
 	}
 
 	// sanity check on the wrapped keys
 	for i, w := range d.Keys {
-		if len(w.DKey) <= 32 {
-			return nil, fmt.Errorf("decrypt: wrapped key %d: wrong-size encrypted key", i)
+		if err := checkWrappedKey(i, w); err != nil {
+			return nil, err
 		}
 	}
 
+	info(nil, "decrypt: header parsed", "version", b[_MagicLen], "chunksize", d.ChunkSize,
+		"recipients", len(d.Keys), "hdrlen", d.hdrlen)
 	return d, nil
 }
 
@@ -426,53 +914,150 @@ func NewDecryptor(rd io.Reader) (*Decryptor, error) {
 func (d *Decryptor) SetPrivateKey(sk *PrivateKey, senderPk *PublicKey) error {
 	var err error
 	var key []byte
+	var skipHinted, tried bool
+
+	if err = fipsRefuse("X25519"); err != nil {
+		return fmt.Errorf("decrypt: %s", err)
+	}
+
+	if err = sk.checkUsage(UsageEncrypt); err != nil {
+		return fmt.Errorf("decrypt: %s", err)
+	}
+
+	if senderPk != nil {
+		if err = senderPk.checkUsage(UsageSign); err != nil {
+			return fmt.Errorf("decrypt: %s", err)
+		}
+	}
+
+	if d.hdrHash != nil {
+		if key, err = d.unwrapStreamed(sk); err != nil {
+			return err
+		}
+		if key != nil {
+			goto havekey
+		}
+	}
+
+	// with hints, only the slots with our hint are tried
+	key, skipHinted, err = d.unwrapHinted(sk)
+	if err != nil {
+		return fmt.Errorf("decrypt: %s", err)
+	}
+	if key != nil {
+		goto havekey
+	}
+
+	// many slots without hints are tried in parallel
+	key, tried, err = d.unwrapParallel(sk, skipHinted)
+	if err != nil {
+		return fmt.Errorf("decrypt: %s", err)
+	}
+	if key != nil {
+		goto havekey
+	}
 
 	for i, w := range d.Keys {
+		if (tried && len(w.Type) == 0) || (skipHinted && hasHint(w)) {
+			continue
+		}
+
 		key, err = d.unwrapKey(w, sk)
 		if err != nil {
 			return fmt.Errorf("decrypt: can't unwrap key %d: %s", i, err)
 		}
 		if key != nil {
+			info(d.log, "decrypt: recipient matched", "slot", i, "pkhash", fmt.Sprintf("%x", sk.pk.hash))
 			goto havekey
 		}
 	}
 
+	// a key moved here by a rewrap token
+	if key, err = d.unwrapRewrapped(sk); err != nil {
+		return fmt.Errorf("decrypt: can't unwrap rewrapped key: %s", err)
+	}
+	if key != nil {
+		info(d.log, "decrypt: rewrapped recipient matched", "pkhash", fmt.Sprintf("%x", sk.pk.hash))
+		goto havekey
+	}
+
+	info(d.log, "decrypt: no matching recipient", "tried", len(d.Keys)+d.nrecip, "types", d.recipientTypes(),
+		"pkhash", fmt.Sprintf("%x", sk.pk.hash), "native", sk.xsk != nil)
 	return fmt.Errorf("decrypt: wrong key")
 
 havekey:
-	if err := d.verifySender(key, sk, senderPk); err != nil {
+	// the sender signed the session key; the file key is derived from it
+	signed := key
+	if len(d.Session) > 0 {
+		if key, err = sessionFileKey(d.version, key, d.Salt); err != nil {
+			return fmt.Errorf("decrypt: %s", err)
+		}
+	}
+
+	if err := d.verifySender(key, signed, senderPk); err != nil {
 		return fmt.Errorf("decrypt: %s", err)
 	}
 
 	d.key = key
 
 	// we mix the header checksum into the key
-	h := sha256.New()
-	h.Write([]byte(_EncryptNonce))
-	h.Write(d.key)
-	h.Write(d.hdrsum)
-	key = h.Sum(nil)
-
-	aes, err := aes.NewCipher(key)
+	key, err = dataKey(d.version, d.key, d.hdrsum, d.context)
 	if err != nil {
 		return fmt.Errorf("decrypt: %s", err)
 	}
 
-	d.ae, err = cipher.NewGCMWithNonceSize(aes, _AEADNonceLen)
+	d.ae, err = chunkAEAD(d.Cipher, key)
 	if err != nil {
 		return fmt.Errorf("decrypt: %s", err)
 	}
 	d.buf = make([]byte, int(d.ChunkSize)+d.ae.Overhead())
+
+	if d.Chunking == _ChunkingCDC {
+		d.cdc = &cdcChunks{}
+		if err = d.cdc.init(d.key, d.context, d.Cipher, d.ChunkSize); err != nil {
+			return fmt.Errorf("decrypt: %s", err)
+		}
+		d.buf = make([]byte, int(d.ChunkSize)+d.cdc.ae.NonceSize()+d.ae.Overhead())
+	}
+	return nil
+}
+
+// sanity check on the wrapped key 'w'
+func checkWrappedKey(i int, w *pb.WrappedKey) error {
+	if len(w.Type) == 0 && len(w.DKey) <= 32 {
+		return fmt.Errorf("decrypt: wrapped key %d: wrong-size encrypted key", i)
+	}
 	return nil
 }
 
+// the recipient types of the wrapped keys ("x25519" or the scheme name)
+func (d *Decryptor) recipientTypes() string {
+	t := make([]string, len(d.Keys))
+	for i, w := range d.Keys {
+		t[i] = w.Type
+		if len(t[i]) == 0 {
+			t[i] = "x25519"
+		}
+	}
+	return strings.Join(t, ",")
+}
+
 // AuthenticatedSender returns true if the sender authenticated themselves
 // (the data-encryption key is signed).
 func (d *Decryptor) AuthenticatedSender() bool {
 	return d.auth
 }
 
-// Decrypt the file and write to 'wr'
+// Version returns the format version of the encrypted file
+func (d *Decryptor) Version() int {
+	return int(d.version)
+}
+
+// Decrypt the file and write to 'wr'; each chunk is written once it
+// is authenticated. With content defined chunks, reordered or spliced
+// chunks are only detected at the last chunk, after their plaintext is
+// written: the output must not be used until Decrypt returns nil (see
+// DecryptStrict).
 func (d *Decryptor) Decrypt(wr io.Writer) error {
 	if d.key == nil {
 		return fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
@@ -486,14 +1071,16 @@ func (d *Decryptor) Decrypt(wr io.Writer) error {
 		return io.EOF
 	}
 
-	var i uint32
+	out := newSparseOutput(wr)
+
+	var i uint64
 	for i = 0; ; i++ {
 		c, eof, err := d.decrypt(i)
 		if err != nil {
 			return err
 		}
 		if len(c) > 0 {
-			err = fullwrite(c, wr)
+			err = out.write(c, d.hole)
 			if err != nil {
 				return fmt.Errorf("decrypt: %s", err)
 			}
@@ -501,10 +1088,39 @@ func (d *Decryptor) Decrypt(wr io.Writer) error {
 
 		if eof {
 			d.eof = true
+			if err = out.finish(); err != nil {
+				return fmt.Errorf("decrypt: %s", err)
+			}
 			return nil
 		}
 	}
-	return nil
+}
+
+// Verify authenticates every chunk of the file without writing the
+// plaintext anywhere; it returns the size of the plaintext.
+func (d *Decryptor) Verify() (int64, error) {
+	if d.key == nil {
+		return 0, fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
+	}
+
+	if d.stream || d.eof {
+		return 0, fmt.Errorf("decrypt: can't use Verify() after using Decrypt() or streaming I/O")
+	}
+
+	var size int64
+	var i uint64
+	for i = 0; ; i++ {
+		c, eof, err := d.decrypt(i)
+		if err != nil {
+			return size, err
+		}
+
+		size += int64(len(c))
+		if eof {
+			d.eof = true
+			return size, nil
+		}
+	}
 }
 
 // Wrap sender's signature of the encryption key
@@ -529,8 +1145,8 @@ func wrapSenderSig(sig []byte, key, salt []byte) ([]byte, error) {
 }
 
 // unwrap sender's signature using 'key' and extract the signature
-// Optionally, verify the signature using the sender's PK (if provided).
-func (d *Decryptor) verifySender(key []byte, sk *PrivateKey, senderPK *PublicKey) error {
+// Optionally, verify the signature of 'signed' using the sender's PK (if provided).
+func (d *Decryptor) verifySender(key, signed []byte, senderPK *PublicKey) error {
 	aes, err := aes.NewCipher(key)
 	if err != nil {
 		return fmt.Errorf("unwrap: %s", err)
@@ -554,13 +1170,14 @@ func (d *Decryptor) verifySender(key []byte, sk *PrivateKey, senderPK *PublicKey
 	// Did the sender actually sign anything?
 	if subtle.ConstantTimeCompare(zero[:], sig) == 0 {
 		d.auth = true
+		debug(d.log, "decrypt: sender signed the file key", "verify", senderPK != nil)
 
 		if senderPK != nil {
 			ss := &Signature{
 				Sig: sig,
 			}
 
-			ok := senderPK.VerifyMessage(key, ss)
+			ok := senderPK.VerifyMessage(signed, ss)
 			if !ok {
 				return fmt.Errorf("unwrap: sender verification failed")
 			}
@@ -573,14 +1190,35 @@ func (d *Decryptor) verifySender(key []byte, sk *PrivateKey, senderPK *PublicKey
 //  basically, we do two scalarmults:
 //    a) Ephemeral encryption/decryption SK x receiver PK
 //    b) Sender's  SK x receiver PK
-func (e *Encryptor) wrapKey(pk *PublicKey) (*pb.WrappedKey, error) {
-	rxPK := pk.toCurve25519PK()
-	dkek, err := curve25519.X25519(e.encSK, rxPK)
+func (e *Encryptor) wrapKey(r *recipient) (*pb.WrappedKey, error) {
+	pk := r.pk
+	if pk.ext != nil {
+		w, err := e.wrapExt(pk)
+		if err == nil {
+			w.Escrow = r.escrow
+		}
+		return w, err
+	}
+
+	if r.dkek == nil {
+		rxPK, err := pk.toCurve25519PK()
+		if err != nil {
+			return nil, fmt.Errorf("wrap: %s", err)
+		}
+
+		dkek, err := x25519(e.encSK, rxPK)
+		if err != nil {
+			return nil, fmt.Errorf("wrap: %s", err)
+		}
+		r.dkek = dkek
+	}
+
+	kek, err := wrapKEK(e.version, r.dkek, e.Salt, e.context)
 	if err != nil {
 		return nil, fmt.Errorf("wrap: %s", err)
 	}
 
-	aes, err := aes.NewCipher(dkek)
+	aes, err := aes.NewCipher(kek)
 	if err != nil {
 		return nil, fmt.Errorf("wrap: %s", err)
 	}
@@ -597,22 +1235,110 @@ func (e *Encryptor) wrapKey(pk *PublicKey) (*pb.WrappedKey, error) {
 	ekey := make([]byte, tagsize+len(e.key))
 
 	w := &pb.WrappedKey{
-		DKey: ae.Seal(ekey[:0], nonceR, e.key, pk.Pk),
+		DKey:   ae.Seal(ekey[:0], nonceR, e.key, pk.Pk),
+		Escrow: r.escrow,
+	}
+
+	if e.hints {
+		hint, err := recipientHint(kek, e.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("wrap: %s", err)
+		}
+		w.Args = hint
+	}
+
+	return w, nil
+}
+
+// wrap the file key again for the recipients added so far; after a change
+// of the context or for format version 1
+func (e *Encryptor) rewrapKeys() error {
+	for i, r := range e.recips {
+		w, err := e.wrapKey(r)
+		if err != nil {
+			return fmt.Errorf("encrypt: %s", err)
+		}
+		e.Keys[i] = w
+	}
+	return nil
+}
+
+// Wrap the data encryption key for a recipient of a registered scheme
+func (e *Encryptor) wrapExt(pk *PublicKey) (*pb.WrappedKey, error) {
+	dkey, args, err := pk.ext.Wrap(e.key)
+	if err != nil {
+		return nil, fmt.Errorf("wrap: %s: %s", pk.scheme, err)
+	}
+
+	if len(dkey) == 0 {
+		return nil, fmt.Errorf("wrap: %s: empty wrapped key", pk.scheme)
 	}
 
+	w := &pb.WrappedKey{
+		DKey: dkey,
+		Type: pk.scheme,
+		Args: args,
+	}
 	return w, nil
 }
 
 // Unwrap a wrapped key using the receivers Ed25519 secret key 'sk' and
 // senders ephemeral PublicKey
 func (d *Decryptor) unwrapKey(w *pb.WrappedKey, sk *PrivateKey) ([]byte, error) {
-	ourSK := sk.toCurve25519SK()
-	dkek, err := curve25519.X25519(ourSK, d.Pk)
+	if len(w.Type) > 0 || sk.ext != nil {
+		return d.unwrapExt(w, sk)
+	}
+
+	if sk.agent != nil {
+		return d.unwrapAgent(w, sk)
+	}
+
+	pk := sk.PublicKey()
+	for _, ourSK := range sk.encryptionKeys() {
+		dkey, err := d.unwrapWith(w, ourSK, pk)
+		if dkey != nil || err != nil {
+			return dkey, err
+		}
+	}
+	return nil, nil
+}
+
+// Unwrap a key wrapped for a registered scheme; keys of other schemes
+// aren't ours.
+func (d *Decryptor) unwrapExt(w *pb.WrappedKey, sk *PrivateKey) ([]byte, error) {
+	if sk.ext == nil || w.Type != sk.scheme {
+		return nil, nil
+	}
+
+	dkey, err := sk.ext.Unwrap(w.DKey, w.Args)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap: %s: %s", w.Type, err)
+	}
+
+	// 32 == AES-256 key size
+	if dkey != nil && len(dkey) != 32 {
+		return nil, fmt.Errorf("unwrap: %s: incorrect key length %d", w.Type, len(dkey))
+	}
+	return dkey, nil
+}
+
+// unwrap the key in 'w' with the X25519 private key 'ourSK'
+func (d *Decryptor) unwrapWith(w *pb.WrappedKey, ourSK []byte, pk *PublicKey) ([]byte, error) {
+	dkek, err := x25519(ourSK, d.Pk)
 	if err != nil {
 		return nil, fmt.Errorf("unwrap: %s", err)
 	}
 
-	aes, err := aes.NewCipher(dkek)
+	kek, err := d.wrapKEK(dkek)
+	if err != nil {
+		return nil, err
+	}
+	return d.unwrapShared(w, kek, pk)
+}
+
+// unwrap the key in 'w' with the key-wrapping key 'kek' (see wrapKEK())
+func (d *Decryptor) unwrapShared(w *pb.WrappedKey, kek []byte, pk *PublicKey) ([]byte, error) {
+	aes, err := aes.NewCipher(kek)
 	if err != nil {
 		return nil, fmt.Errorf("unwrap: %s", err)
 	}
@@ -630,8 +1356,7 @@ func (d *Decryptor) unwrapKey(w *pb.WrappedKey, sk *PrivateKey) ([]byte, error)
 
 	nonceSize := ae.NonceSize()
 
-	nonceR := makeNonce([]byte(_WrapReceiverNonce), d.Salt)[:nonceSize]
-	pk := sk.PublicKey()
+	nonceR := makeNonce([]byte(_WrapReceiverNonce), d.wrapSalt())[:nonceSize]
 
 	dkey := make([]byte, 32) // decrypted data decryption key
 
@@ -644,57 +1369,98 @@ func (d *Decryptor) unwrapKey(w *pb.WrappedKey, sk *PrivateKey) ([]byte, error)
 	return dkey, nil
 }
 
+// salt of the wrapped-key nonces
+func (d *Decryptor) wrapSalt() []byte {
+	if len(d.Session) > 0 {
+		return d.Session
+	}
+	return d.Salt
+}
+
 // Decrypt exactly one chunk of data
-func (d *Decryptor) decrypt(i uint32) ([]byte, bool, error) {
-	var b [8]byte
+func (d *Decryptor) decrypt(i uint64) ([]byte, bool, error) {
+	var b [_ChunkADLen]byte
 	var nonceb [32]byte
 	var ovh uint32 = uint32(d.ae.Overhead())
 	var p []byte
 
+	if i > maxChunk(d.version) {
+		return nil, false, ErrTooManyChunks
+	}
+
 	n, err := io.ReadFull(d.rd, b[:4])
 	if err != nil || n == 0 {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, false, fmt.Errorf("decrypt: can't read header block %d: %s", i, err)
+		}
 		return nil, false, fmt.Errorf("decrypt: premature EOF while reading header block %d", i)
 	}
 
 	m := binary.BigEndian.Uint32(b[:4])
 	eof := (m & _EOF) > 0
+	d.hole = (m & _Hole) > 0
 
-	m &= (_EOF - 1)
+	m &^= _EOF | _Hole
 
 	// Sanity check - in case of corrupt header
 	switch {
 	case m > uint32(d.ChunkSize):
 		return nil, false, fmt.Errorf("decrypt: chunksize is too large (%d)", m)
 
-	case m == 0:
-		if !eof {
-			return nil, false, fmt.Errorf("decrypt: block %d: zero-sized chunk without EOF", i)
-		}
-		return p, eof, nil
-
-	case m < ovh:
-		return nil, false, fmt.Errorf("decrypt: chunksize is too small (%d)", m)
+	// an empty chunk (of empty input) is authenticated like any other
+	case m == 0 && !eof:
+		return nil, false, fmt.Errorf("decrypt: block %d: zero-sized chunk without EOF", i)
 
 	default:
 	}
 
-	binary.BigEndian.PutUint32(b[4:], i)
+	if d.cdc != nil {
+		switch {
+		case d.hole:
+			return nil, false, fmt.Errorf("decrypt: block %d: hole in content defined chunks", i)
+		case !eof:
+			p, err = d.openCDC(b[:], m, i)
+			return p, false, err
+		case m > 0:
+			return nil, false, fmt.Errorf("decrypt: block %d: last chunk isn't empty", i)
+		}
+	}
+
+	ad := chunkAD(b[:], d.version, binary.BigEndian.Uint32(b[:4]), i, d.hdrsum)
+	if d.cdc != nil {
+		ad = d.cdc.sum.Sum(ad)
+	}
 	h := sha256.New()
 	h.Write(d.Salt)
-	h.Write(b[:])
+	h.Write(ad)
 	nonce := h.Sum(nonceb[:0])[:d.ae.NonceSize()]
 
 	z := m + ovh
+	if d.hole {
+		z = ovh
+	}
 	n, err = io.ReadFull(d.rd, d.buf[:z])
 	if err != nil {
 		return nil, false, fmt.Errorf("decrypt: premature EOF while reading block %d: %s", i, err)
 	}
 
-	p, err = d.ae.Open(d.buf[:0], nonce, d.buf[:n], b[:])
+	p, err = d.ae.Open(d.buf[:0], nonce, d.buf[:n], ad)
 	if err != nil {
+		debug(d.log, "decrypt: chunk authentication failed", "chunk", i)
 		return nil, false, fmt.Errorf("decrypt: can't decrypt chunk %d: %s", i, err)
 	}
 
+	if eof {
+		info(d.log, "decrypt: done", "chunks", i+1)
+	}
+
+	if d.hole {
+		p = d.buf[:m]
+		for j := range p {
+			p[j] = 0
+		}
+	}
+
 	return p[:m], eof, nil
 }
 
@@ -711,11 +1477,41 @@ func newSender() (sk, pk []byte, err error) {
 
 	randRead(csk[:])
 	clamp(csk[:])
-	pk, err = curve25519.X25519(csk[:], curve25519.Basepoint)
+	pk, err = x25519Public(csk[:])
 	sk = csk[:]
 	return
 }
 
+// ErrTooManyChunks is returned when a stream has more chunks than its
+// format version can number
+var ErrTooManyChunks = errors.New("encrypt: too many chunks for the file format")
+
+// largest additional data of a chunk
+const _ChunkADLen = 12 + sha256.Size
+
+// write the additional data of chunk 'i' of length (and flags) 'z' to 'b'
+// and return it; in version 2, it ends with the header checksum 'hdrsum'
+// so that a chunk doesn't decrypt under a modified header.
+func chunkAD(b []byte, version uint8, z uint32, i uint64, hdrsum []byte) []byte {
+	binary.BigEndian.PutUint32(b[:4], z)
+	if version == _Version1 {
+		binary.BigEndian.PutUint32(b[4:8], uint32(i))
+		return b[:8]
+	}
+
+	binary.BigEndian.PutUint64(b[4:12], i)
+	n := copy(b[12:], hdrsum)
+	return b[:12+n]
+}
+
+// the last chunk number of format 'version'
+func maxChunk(version uint8) uint64 {
+	if version == _Version1 {
+		return math.MaxUint32
+	}
+	return math.MaxUint64
+}
+
 func makeNonce(v ...[]byte) []byte {
 	h := sha256.New()
 	for _, x := range v {
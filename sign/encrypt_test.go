@@ -15,11 +15,31 @@ package sign
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/opencoff/sigtool/internal/pb"
+	"golang.org/x/crypto/hkdf"
 )
 
 type Buffer struct {
@@ -76,6 +96,215 @@ func TestEncryptSimple(t *testing.T) {
 	assert(byteEq(b, buf), "decrypt content mismatch")
 }
 
+// version 1 files have 32-bit chunk numbers; version 2 files 64-bit
+func TestChunkCounter(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	buf := randbuf(5000)
+
+	encrypt := func(version uint8) []byte {
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(&receiver.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+		ee.version = version
+
+		wr := Buffer{}
+		err = ee.Encrypt(bytes.NewReader(buf), &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+		return wr.Bytes()
+	}
+
+	decryptor := func(b []byte) *Decryptor {
+		dd, err := NewDecryptor(bytes.NewReader(b))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+		return dd
+	}
+
+	for _, v := range []uint8{0, _Version1, _Version} {
+		dd := decryptor(encrypt(v))
+		want := v
+		if v == 0 {
+			want = _Version
+		}
+		assert(dd.Version() == int(want), "version: exp %d, saw %d", want, dd.Version())
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "v%d decrypt fail: %s", want, err)
+		assert(byteEq(out.Bytes(), buf), "v%d content mismatch", want)
+	}
+
+	// a 32-bit counter would wrap at chunk 2^32
+	var a, b [_ChunkADLen]byte
+	n := uint64(math.MaxUint32) + 1
+	assert(byteEq(chunkAD(a[:], _Version1, 10, 1, nil), chunkAD(b[:], _Version1, 10, 1+n, nil)), "v1 chunk number doesn't wrap")
+	assert(!byteEq(chunkAD(a[:], _Version, 10, 1, nil), chunkAD(b[:], _Version, 10, 1+n, nil)), "v2 chunk number wraps")
+
+	// version 1 streams end there
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+	ee.version = _Version1
+
+	wr := Buffer{}
+	err = ee.start(&wr)
+	assert(err == nil, "start fail: %s", err)
+	err = ee.encrypt(buf[:10], &wr, n-1, false)
+	assert(err == nil, "encrypt of the last chunk fail: %s", err)
+	err = ee.encrypt(buf[:10], &wr, n, false)
+	assert(err == ErrTooManyChunks, "v1 chunk %d: %v", n, err)
+
+	dd := decryptor(encrypt(_Version1))
+	_, _, err = dd.decrypt(n)
+	assert(err == ErrTooManyChunks, "v1 decrypt chunk %d: %v", n, err)
+
+	// but not version 2 streams
+	ee.version = _Version
+	err = ee.encrypt(buf[:10], &wr, n, false)
+	assert(err == nil, "v2 chunk %d fail: %s", n, err)
+	assert(maxChunk(_Version) == math.MaxUint64, "v2 chunk limit")
+}
+
+// empty input is an authenticated empty chunk
+func TestEncryptEmpty(t *testing.T) {
+	assert := newAsserter(t)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "sender keypair gen failed: %s", err)
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(&sender.Sec, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewReader(nil), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	enc := wr.Bytes()
+
+	// the streaming writer makes the same chunk
+	es, err := NewEncryptor(&sender.Sec, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = es.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	swr := Buffer{}
+	w, err := es.NewStreamWriter(&swr)
+	assert(err == nil, "stream writer fail: %s", err)
+	err = w.Close()
+	assert(err == nil, "stream close fail: %s", err)
+	assert(swr.Len() == len(enc), "stream size: exp %d, saw %d", len(enc), swr.Len())
+
+	decrypt := func(b []byte) ([]byte, error) {
+		dd, err := NewDecryptor(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		if err = dd.SetPrivateKey(&receiver.Sec, &sender.Pub); err != nil {
+			return nil, err
+		}
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		return out.Bytes(), err
+	}
+
+	for _, b := range [][]byte{enc, swr.Bytes()} {
+		out, err := decrypt(b)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(len(out) == 0, "decrypted %d bytes of empty input", len(out))
+
+		dd, err := NewDecryptor(bytes.NewReader(b))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&receiver.Sec, &sender.Pub)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+		sz, err := dd.Verify()
+		assert(err == nil, "verify fail: %s", err)
+		assert(sz == 0, "verify size %d", sz)
+
+		dsz, err := DecryptedSize(dd, int64(len(b)))
+		assert(err == nil && dsz == 0, "decrypted size %d: %s", dsz, err)
+	}
+
+	// the empty chunk's tag must be present and intact
+	n := len(enc) - _ChunkOverhead
+	bad := append([]byte{}, enc...)
+	bad[len(bad)-1] ^= 1
+	_, err = decrypt(bad)
+	assert(err != nil, "decrypted a modified empty chunk")
+
+	_, err = decrypt(enc[:len(enc)-1])
+	assert(err != nil, "decrypted a truncated empty chunk")
+
+	_, err = decrypt(enc[:n+4])
+	assert(err != nil, "decrypted an empty chunk without its tag")
+
+	// the content of a non-empty file can't be replaced by an empty chunk
+	ee, err = NewEncryptor(&sender.Sec, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+	wr = Buffer{}
+	err = ee.Encrypt(bytes.NewReader(randbuf(3000)), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	full := wr.Bytes()
+	hdr := len(full) - (3000 + 3*_ChunkOverhead)
+	bad = append([]byte{}, full[:hdr]...)
+	bad = append(bad, enc[n:n+4]...)
+	_, err = decrypt(bad)
+	assert(err != nil, "decrypted content replaced with an empty EOF chunk")
+}
+
+// empty content has a signature like any other
+func TestSignEmpty(t *testing.T) {
+	assert := newAsserter(t)
+
+	kp, err := NewKeypair()
+	assert(err == nil, "keygen fail: %s", err)
+
+	dn := tempdir(t)
+	defer os.RemoveAll(dn)
+
+	fn := dn + "/empty"
+	err = ioutil.WriteFile(fn, nil, 0600)
+	assert(err == nil, "write fail: %s", err)
+
+	ck, err := ReaderChecksum(bytes.NewReader(nil))
+	assert(err == nil, "checksum fail: %s", err)
+	fck, err := FileChecksum(fn)
+	assert(err == nil, "file checksum fail: %s", err)
+	assert(byteEq(ck, fck), "checksums of empty content differ")
+
+	sig, err := kp.Sec.SignFileWithAttrs(fn, &Attributes{})
+	assert(err == nil, "sign fail: %s", err)
+	assert(sig.Attrs.Size == 0, "size %d", sig.Attrs.Size)
+
+	ok, err := kp.Pub.VerifyFile(fn, sig)
+	assert(err == nil && ok, "verify fail: %s", err)
+	assert(kp.Pub.VerifyMessage(ck, sig), "verify message fail")
+
+	sig, err = kp.Sec.SignMessage(ck, "")
+	assert(err == nil, "sign message fail: %s", err)
+	ok, err = kp.Pub.VerifyFile(fn, sig)
+	assert(err == nil && ok, "verify fail: %s", err)
+
+	// a non-empty file doesn't verify
+	err = ioutil.WriteFile(fn, []byte{0}, 0600)
+	assert(err == nil, "write fail: %s", err)
+	ok, _ = kp.Pub.VerifyFile(fn, sig)
+	assert(!ok, "empty signature verified non-empty file")
+}
+
 // test corrupted header or corrupted input
 func TestEncryptCorrupted(t *testing.T) {
 	assert := newAsserter(t)
@@ -313,6 +542,151 @@ func TestStreamIO(t *testing.T) {
 
 }
 
+// auto chunk size must stay within bounds and grow with the input
+func TestAutoChunkSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		size int64
+		exp  uint64
+	}{
+		{-1, uint64(chunkSize)},
+		{0, uint64(minChunkSize)},
+		{1024, uint64(minChunkSize)},
+		{256 * 65536, uint64(minChunkSize)},
+		{256*65536 + 1, 2 * uint64(minChunkSize)},
+		{1 << 30, 4 * 1048576},
+		{1 << 40, uint64(maxChunkSize)},
+	}
+
+	for i, tc := range tests {
+		z := AutoChunkSize(tc.size)
+		assert(z == tc.exp, "%d: size %d: exp %d, saw %d", i, tc.size, tc.exp, z)
+	}
+}
+
+// ciphertext and plaintext sizes must be predictable
+func TestEncryptedSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	var blkSize int = 1024
+	sizes := []int{0, 1, 5, blkSize - 1, blkSize, blkSize + 1, 3 * blkSize, (7 * blkSize) + randmod(blkSize)}
+
+	for _, size := range sizes {
+		buf := make([]byte, size)
+		randRead(buf)
+
+		for _, stream := range []bool{false, true} {
+			ee, err := NewEncryptor(nil, uint64(blkSize))
+			assert(err == nil, "encryptor create fail: %s", err)
+
+			for i := 0; i < 3; i++ {
+				r, err := NewKeypair()
+				assert(err == nil, "can't make receiver key %d: %s", i, err)
+				err = ee.AddRecipient(&r.Pub)
+				assert(err == nil, "can't add recipient %d: %s", i, err)
+			}
+			err = ee.AddRecipient(&receiver.Pub)
+			assert(err == nil, "can't add recipient: %s", err)
+
+			wr := Buffer{}
+			if stream {
+				wio, err := ee.NewStreamWriter(&wr)
+				assert(err == nil, "can't start stream writer: %s", err)
+				_, err = wio.Write(buf)
+				assert(err == nil, "stream write failed: %s", err)
+				err = wio.Close()
+				assert(err == nil, "stream close failed: %s", err)
+			} else {
+				err = ee.Encrypt(bytes.NewReader(buf), &wr)
+				assert(err == nil, "encrypt fail: %s", err)
+			}
+
+			exp := EncryptedSize(int64(size), 4, uint64(blkSize))
+			assert(int64(wr.Len()) == exp, "size %d stream %v: exp enc size %d, saw %d", size, stream, exp, wr.Len())
+
+			encSize := int64(wr.Len())
+			dd, err := NewDecryptor(&wr)
+			assert(err == nil, "decryptor create fail: %s", err)
+
+			dsz, err := DecryptedSize(dd, encSize)
+			assert(err == nil, "size %d: decrypted size: %s", size, err)
+			assert(dsz == int64(size), "size %d: exp dec size %d, saw %d", size, size, dsz)
+
+			err = dd.SetPrivateKey(&receiver.Sec, nil)
+			assert(err == nil, "decryptor can't add SK: %s", err)
+
+			out := Buffer{}
+			err = dd.Decrypt(&out)
+			assert(err == nil, "size %d: decrypt fail: %s", size, err)
+			assert(byteEq(out.Bytes(), buf), "size %d: decrypt content mismatch", size)
+		}
+	}
+}
+
+// debug events must be delivered to the configured loggers
+func TestEncryptLogging(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	var elog, dlog bytes.Buffer
+	opt := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	buf := make([]byte, 5000)
+	randRead(buf)
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	ee.SetLogger(slog.New(slog.NewTextHandler(&elog, opt)))
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewReader(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	s := elog.String()
+	assert(strings.Contains(s, "header written"), "missing header event: %s", s)
+	assert(strings.Contains(s, "chunks=5"), "missing chunk count: %s", s)
+
+	enc := wr.Bytes()
+	dd, err := NewDecryptor(bytes.NewReader(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	dd.SetLogger(slog.New(slog.NewTextHandler(&dlog, opt)))
+
+	err = dd.SetPrivateKey(&receiver.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	err = dd.Decrypt(&Buffer{})
+	assert(err == nil, "decrypt fail: %s", err)
+
+	s = dlog.String()
+	assert(strings.Contains(s, "recipient matched"), "missing recipient event: %s", s)
+	assert(strings.Contains(s, "chunks=5"), "missing chunk count: %s", s)
+
+	// summaries are logged at the info level
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	var ilog bytes.Buffer
+	dd, err = NewDecryptor(bytes.NewReader(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	dd.SetLogger(slog.New(slog.NewTextHandler(&ilog, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	err = dd.SetPrivateKey(&other.Sec, nil)
+	assert(err != nil, "decrypted with the wrong key")
+
+	s = ilog.String()
+	assert(strings.Contains(s, "level=INFO msg=\"decrypt: no matching recipient\""), "missing no-match event: %s", s)
+	assert(strings.Contains(s, "types=x25519"), "missing recipient types: %s", s)
+}
+
 func randint() int {
 	var b [4]byte
 
@@ -329,3 +703,3171 @@ func randint() int {
 func randmod(m int) int {
 	return randint() % m
 }
+
+// new keys have a separate X25519 key; files encrypted to the derived
+// key of the same identity still decrypt.
+func TestEncryptNativeKey(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+	assert(receiver.Pub.HasEncryptionKey(), "no native encryption key")
+
+	xpk := receiver.Pub.EncryptionKey()
+	compat, err := PublicKeyFromBytes(receiver.Pub.Pk)
+	assert(err == nil, "pk from bytes fail: %s", err)
+	assert(!compat.HasEncryptionKey(), "compat key has native encryption key")
+	assert(!byteEq(xpk, compat.EncryptionKey()), "native key same as derived key")
+
+	buf := randbuf(8192)
+	for _, pk := range []*PublicKey{&receiver.Pub, compat} {
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+
+		err = ee.AddRecipient(pk)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		wr := Buffer{}
+		err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+
+		dd, err := NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+	}
+
+	// the X25519 key must be certified by the Ed25519 key
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	err = compat.setEncryptionKey(other.Pub.xpk, other.Pub.xsig)
+	assert(err != nil, "uncertified X25519 key accepted")
+}
+
+// age identities decrypt files encrypted to the matching age recipient
+// Ed25519 public keys are converted to the X25519 keys of their private
+// keys; invalid points are refused
+func TestX25519Conversion(t *testing.T) {
+	assert := newAsserter(t)
+
+	for i := 0; i < 16; i++ {
+		kp, err := NewKeypair()
+		assert(err == nil, "keypair gen failed: %s", err)
+
+		xpk, err := edToX25519(kp.Pub.Pk)
+		assert(err == nil, "conversion fail: %s", err)
+
+		want, err := x25519Public(kp.Sec.toCurve25519SK())
+		assert(err == nil, "x25519 public key fail: %s", err)
+		assert(byteEq(xpk, want), "converted key mismatch")
+	}
+
+	// y = 1 (identity), y = p-1 (order 2), y = p (not canonical) and
+	// y = 2 (not on the curve)
+	pm1, _ := hex.DecodeString("ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f")
+	p, _ := hex.DecodeString("edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f")
+	for _, y := range [][]byte{{1}, pm1, p, {2}} {
+		b := make([]byte, 32)
+		copy(b, y)
+
+		_, err := edToX25519(b)
+		assert(err != nil, "converted invalid key %x", b)
+
+		pk := &PublicKey{Pk: b, hash: pkhash(b)}
+		assert(pk.EncryptionKey() == nil, "encryption key of invalid key %x", b)
+
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(pk)
+		assert(err != nil, "added invalid recipient %x", b)
+	}
+
+	// low-order X25519 keys don't make a shared secret
+	_, err := x25519(randbuf(32), make([]byte, 32))
+	assert(err != nil, "x25519 with a low-order point")
+}
+
+func TestEncryptAgeKey(t *testing.T) {
+	assert := newAsserter(t)
+
+	xsk := randbuf(32)
+	id, err := bech32Encode(_AgeIdentityHRP, xsk)
+	assert(err == nil, "bech32 encode fail: %s", err)
+
+	sk, err := ParseIdentity(strings.ToUpper(id), nil)
+	assert(err == nil, "parse identity fail: %s", err)
+
+	r, err := bech32Encode(_AgeRecipientHRP, sk.pk.xpk)
+	assert(err == nil, "bech32 encode fail: %s", err)
+
+	pk, err := ParseRecipient(r)
+	assert(err == nil, "parse recipient fail: %s", err)
+	assert(byteEq(pk.EncryptionKey(), sk.pk.xpk), "recipient key mismatch")
+
+	_, err = NewEncryptor(sk, 1024)
+	assert(err != nil, "age identity used to sign")
+
+	buf := randbuf(8192)
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(pk)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	dd, err := NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+
+	err = dd.SetPrivateKey(sk, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	out := Buffer{}
+	err = dd.Decrypt(&out)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+}
+
+// a toy recipient scheme: the wrapped key is the file key XOR'd with a
+// fixed pad
+type xorRecipient struct {
+	id string
+}
+
+func (x *xorRecipient) Wrap(key []byte) ([]byte, []byte, error) {
+	w := make([]byte, len(key))
+	for i := range key {
+		w[i] = key[i] ^ 0x5a
+	}
+	return w, []byte(x.id), nil
+}
+
+// unwrap only the keys wrapped for our id
+func (x *xorRecipient) Unwrap(wrapped, args []byte) ([]byte, error) {
+	if string(args) != x.id {
+		return nil, nil
+	}
+	k, _, err := x.Wrap(wrapped)
+	return k, err
+}
+
+func init() {
+	RegisterRecipientScheme("xor", func(uri string) (Recipient, error) {
+		return &xorRecipient{id: strings.TrimPrefix(uri, "xor://")}, nil
+	})
+	RegisterIdentityScheme("xor", func(uri string) (Identity, error) {
+		return &xorRecipient{id: strings.TrimPrefix(uri, "xor://")}, nil
+	})
+}
+
+func TestRecipientScheme(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	xpk, err := ParseRecipient("xor://key-1")
+	assert(err == nil, "parse recipient fail: %s", err)
+
+	_, err = ParseRecipient("nope://key-1")
+	assert(err != nil, "unknown scheme accepted")
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(xpk)
+	assert(err == nil, "can't add recipient: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	buf := randbuf(4096)
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	dd, err := NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(len(dd.Keys) == 2, "exp 2 wrapped keys, saw %d", len(dd.Keys))
+
+	w := dd.Keys[0]
+	assert(w.Type == "xor", "wrong scheme %q", w.Type)
+	assert(string(w.Args) == "key-1", "wrong args %q", w.Args)
+
+	// X25519 recipients skip the keys of other schemes
+	err = dd.SetPrivateKey(&receiver.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	out := Buffer{}
+	err = dd.Decrypt(&out)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+}
+
+func TestIdentityScheme(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	for _, s := range []string{"xor://key-1", "xor://key-2"} {
+		pk, err := ParseRecipient(s)
+		assert(err == nil, "%s: parse recipient fail: %s", s, err)
+
+		err = ee.AddRecipient(pk)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	buf := randbuf(4096)
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	for _, s := range []string{"xor://key-2", "xor://key-1"} {
+		sk, err := ParseIdentity(s, nil)
+		assert(err == nil, "%s: parse identity fail: %s", s, err)
+
+		dd, err := NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(sk, nil)
+		assert(err == nil, "%s: decryptor can't add SK: %s", s, err)
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "%s: decrypt fail: %s", s, err)
+		assert(byteEq(out.Bytes(), buf), "%s: decrypt content mismatch", s)
+	}
+
+	sk, err := ParseIdentity("xor://key-3", nil)
+	assert(err == nil, "parse identity fail: %s", err)
+
+	dd, err := NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+
+	err = dd.SetPrivateKey(sk, nil)
+	assert(err != nil, "decrypted with the wrong identity")
+}
+
+func TestParseHeader(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	xpk, err := ParseRecipient("xor://key-1")
+	assert(err == nil, "parse recipient fail: %s", err)
+
+	ee, err := NewEncryptor(nil, 65536)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	for _, pk := range []*PublicKey{&receiver.Pub, xpk} {
+		err = ee.AddRecipient(pk)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+
+	buf := randbuf(200000)
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	h, err := ParseHeader(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "parse header fail: %s", err)
+	assert(h.Version == 2, "wrong version %d", h.Version)
+	assert(h.ChunkSize == 65536, "wrong chunk size %d", h.ChunkSize)
+	assert(len(h.Recipients) == 2, "exp 2 recipients, saw %d", len(h.Recipients))
+	assert(h.Recipients[0].Type == "", "wrong type %q", h.Recipients[0].Type)
+	assert(h.Recipients[1].Type == "xor", "wrong type %q", h.Recipients[1].Type)
+	assert(string(h.Recipients[1].Args) == "key-1", "wrong args %q", h.Recipients[1].Args)
+
+	sz, err := h.DecryptedSize(int64(wr.Len()))
+	assert(err == nil, "decrypted size fail: %s", err)
+	assert(sz == int64(len(buf)), "decrypted size: exp %d, saw %d", len(buf), sz)
+
+	b := wr.Bytes()
+	b[10] ^= 1
+	_, err = ParseHeader(bytes.NewBuffer(b))
+	assert(err != nil, "corrupt header parsed")
+}
+
+// a modified header with a valid checksum doesn't decrypt the chunks
+func TestHeaderBinding(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+	other, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	for _, pk := range []*PublicKey{&receiver.Pub, &other.Pub} {
+		err = ee.AddRecipient(pk)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+
+	buf := randbuf(5000)
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	// drop the second recipient and fix up the header checksum
+	b := wr.Bytes()
+	vlen := int(binary.BigEndian.Uint32(b[_MagicLen+1:]))
+	rest := b[_FixedHdrLen+vlen+32:]
+
+	var h pb.Header
+	err = h.Unmarshal(b[_FixedHdrLen : _FixedHdrLen+vlen])
+	assert(err == nil, "header unmarshal fail: %s", err)
+	h.Keys = h.Keys[:1]
+
+	vb, err := h.Marshal()
+	assert(err == nil, "header marshal fail: %s", err)
+
+	hdr := append([]byte{}, b[:_FixedHdrLen]...)
+	binary.BigEndian.PutUint32(hdr[_MagicLen+1:], uint32(len(vb)))
+	hdr = append(hdr, vb...)
+	sum := sha256.Sum256(hdr)
+	hdr = append(append(hdr, sum[:]...), rest...)
+
+	dd, err := NewDecryptor(bytes.NewBuffer(hdr))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = dd.SetPrivateKey(&receiver.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	out := Buffer{}
+	err = dd.Decrypt(&out)
+	assert(err != nil, "decrypted chunks under a modified header")
+
+	// the header checksum is part of every chunk's additional data
+	var x, y [_ChunkADLen]byte
+	assert(!byteEq(chunkAD(x[:], _Version, 10, 1, sum[:]), chunkAD(y[:], _Version, 10, 1, randbuf(32))), "v2 AD doesn't bind the header")
+}
+
+func TestDecryptMemoryLimit(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 65536
+	buf := make([]byte, blkSize*2)
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	enc := wr.Bytes()
+
+	// too small for the header
+	SetDecryptMemoryLimit(64)
+	_, err = NewDecryptor(bytes.NewBuffer(enc))
+	assert(err != nil && strings.Contains(err.Error(), "header needs"), "header limit: %v", err)
+
+	// too small for the chunk buffer
+	SetDecryptMemoryLimit(uint64(blkSize))
+	_, err = NewDecryptor(bytes.NewBuffer(enc))
+	assert(err != nil, "decryptor with chunk larger than limit")
+	SetDecryptMemoryLimit(0)
+
+	dd, err := NewDecryptor(bytes.NewBuffer(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+
+	err = dd.SetMemoryLimit(uint64(blkSize))
+	assert(err != nil, "memory limit below the chunk size")
+
+	// enough for Decrypt() but not for the stream reader
+	err = dd.SetMemoryLimit(uint64(blkSize) + 4096)
+	assert(err == nil, "memory limit fail: %s", err)
+
+	err = dd.SetPrivateKey(&receiver.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	_, err = dd.NewStreamReader()
+	assert(err != nil, "stream reader exceeds memory limit")
+
+	wr = Buffer{}
+	err = dd.Decrypt(&wr)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(byteEq(wr.Bytes(), buf), "decrypt data mismatch")
+}
+
+func TestDecryptStrict(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 1024
+	buf := make([]byte, blkSize*10)
+	randRead(buf)
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	enc := wr.Bytes()
+
+	dn := tempdir(t)
+	defer os.RemoveAll(dn)
+
+	decrypt := func(enc []byte, opt *SpoolOptions) ([]byte, error) {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		out := Buffer{}
+		err = dd.DecryptStrict(&out, opt)
+		return out.Bytes(), err
+	}
+
+	// spill over to the temp file
+	out, err := decrypt(enc, &SpoolOptions{MaxMemory: 2000, TempDir: dn})
+	assert(err == nil, "strict decrypt fail: %s", err)
+	assert(byteEq(out, buf), "strict decrypt data mismatch")
+
+	fi, err := ioutil.ReadDir(dn)
+	assert(err == nil && len(fi) == 0, "spool file not removed: %v", err)
+
+	// truncated input
+	out, err = decrypt(enc[:len(enc)-100], &SpoolOptions{TempDir: dn})
+	assert(err != nil, "strict decrypt of truncated file")
+	assert(len(out) == 0, "truncated file released %d bytes", len(out))
+
+	// in memory only
+	_, err = decrypt(enc, &SpoolOptions{MaxMemory: 2000, MemoryOnly: true})
+	assert(err != nil, "memory only decrypt exceeds limit")
+
+	out, err = decrypt(enc, &SpoolOptions{MaxMemory: int64(len(buf)), MemoryOnly: true})
+	assert(err == nil, "memory only decrypt fail: %s", err)
+	assert(byteEq(out, buf), "memory only decrypt data mismatch")
+}
+
+func TestChunkManifest(t *testing.T) {
+	assert := newAsserter(t)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "sender keypair gen failed: %s", err)
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 1024
+	buf := make([]byte, blkSize*5+100)
+	randRead(buf)
+
+	ee, err := NewEncryptor(&sender.Sec, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	err = ee.EnableChunkManifest()
+	assert(err == nil, "enable manifest fail: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	enc := wr.Bytes()
+
+	m := ee.ChunkManifest()
+	assert(len(m.Chunks) == 6, "exp 6 chunks, saw %d", len(m.Chunks))
+	assert(m.Size == int64(len(enc)), "manifest size %d, file size %d", m.Size, len(enc))
+
+	_, err = m.Serialize("")
+	assert(err != nil, "serialized unsigned manifest")
+
+	err = m.Sign(&sender.Sec)
+	assert(err == nil, "manifest sign fail: %s", err)
+
+	b, err := m.Serialize("test")
+	assert(err == nil, "manifest serialize fail: %s", err)
+
+	m, err = MakeChunkManifest(b)
+	assert(err == nil, "manifest parse fail: %s", err)
+	assert(m.Verify(&sender.Pub) == nil, "manifest verify fail")
+	assert(m.Verify(&receiver.Pub) != nil, "manifest verified with wrong key")
+
+	// random access to the chunks
+	assert(m.VerifyHeader(enc[:m.HeaderSize]) == nil, "header verify fail")
+	for i := range m.Chunks {
+		off, n, err := m.ChunkRange(i)
+		assert(err == nil, "chunk %d: range fail: %s", i, err)
+		assert(m.VerifyChunk(i, enc[off:off+n]) == nil, "chunk %d: verify fail", i)
+	}
+
+	// verify while decrypting
+	dd, err := NewDecryptor(m.NewReader(bytes.NewBuffer(enc)))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = dd.SetPrivateKey(&receiver.Sec, &sender.Pub)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	out := Buffer{}
+	err = dd.Decrypt(&out)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(byteEq(out.Bytes(), buf), "decrypt data mismatch")
+
+	// a modified chunk is never returned by the reader
+	bad := append([]byte{}, enc...)
+	off, _, _ := m.ChunkRange(3)
+	bad[off+10] ^= 1
+
+	assert(m.VerifyChunk(3, bad[off:off+int64(blkSize)+_ChunkOverhead]) != nil, "modified chunk verified")
+
+	got, err := ioutil.ReadAll(m.NewReader(bytes.NewBuffer(bad)))
+	assert(err != nil && strings.Contains(err.Error(), "chunk 3"), "exp chunk 3 error, saw %v", err)
+	assert(int64(len(got)) == off, "reader returned %d bytes, exp %d", len(got), off)
+
+	// trailing data
+	_, err = ioutil.ReadAll(m.NewReader(bytes.NewBuffer(append(enc, 0))))
+	assert(err != nil, "trailing data not detected")
+}
+
+func TestRecordLog(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	lw, err := ee.NewLogWriter(&wr)
+	assert(err == nil, "log writer create fail: %s", err)
+
+	hdrlen := wr.Len()
+	recs := make([][]byte, 5)
+	offs := make([]int, 6)
+	for i := range recs {
+		offs[i] = wr.Len()
+		recs[i] = randRead(make([]byte, 10+i*100))
+		err = lw.Append(recs[i])
+		assert(err == nil, "append %d fail: %s", i, err)
+	}
+	offs[5] = wr.Len()
+
+	err = lw.Close()
+	assert(err == nil, "log close fail: %s", err)
+
+	err = lw.Append(recs[0])
+	assert(err != nil, "append after close")
+
+	enc := wr.Bytes()
+
+	// logs have the header of format version 2
+	dd, err := NewDecryptor(bytes.NewBuffer(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(dd.Version() == 2, "log version %d; exp 2", dd.Version())
+
+	// read back the records; return the number read and the final error
+	read := func(enc []byte) (int, error) {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		lr, err := dd.NewLogReader()
+		assert(err == nil, "log reader create fail: %s", err)
+
+		for i := 0; ; i++ {
+			rec, err := lr.Next()
+			if err != nil {
+				return i, err
+			}
+			assert(i < len(recs) && byteEq(rec, recs[i]), "record %d mismatch", i)
+		}
+	}
+
+	n, err := read(enc)
+	assert(err == io.EOF, "log read fail: %s", err)
+	assert(n == 5, "log read %d records; exp 5", n)
+
+	// missing end of log
+	n, err = read(enc[:offs[5]])
+	assert(err == ErrLogTruncated, "truncated log: %v", err)
+	assert(n == 5, "truncated log read %d records", n)
+
+	// partial record
+	n, err = read(enc[:offs[3]+8])
+	assert(err == ErrLogTruncated, "partial record: %v", err)
+	assert(n == 3, "partial record read %d records", n)
+
+	// removed record
+	cut := append([]byte{}, enc[:offs[2]]...)
+	cut = append(cut, enc[offs[3]:]...)
+	n, err = read(cut)
+	assert(err != nil && err != ErrLogTruncated && err != io.EOF, "removed record: %v", err)
+	assert(n == 2, "removed record read %d records", n)
+
+	// swapped records
+	swap := append([]byte{}, enc[:offs[1]]...)
+	swap = append(swap, enc[offs[2]:offs[3]]...)
+	swap = append(swap, enc[offs[1]:offs[2]]...)
+	swap = append(swap, enc[offs[3]:]...)
+	n, err = read(swap)
+	assert(err != nil && err != io.EOF, "swapped records: %v", err)
+	assert(n == 1, "swapped records read %d records", n)
+
+	assert(hdrlen > 0 && hdrlen == offs[0], "header not written at start")
+}
+
+func TestRecordLogAppend(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	recs := make([][]byte, 5)
+	for i := range recs {
+		recs[i] = randRead(make([]byte, 10+i*100))
+	}
+
+	wr := Buffer{}
+	lw, err := ee.NewLogWriter(&wr)
+	assert(err == nil, "log writer create fail: %s", err)
+
+	for _, r := range recs[:2] {
+		err = lw.Append(r)
+		assert(err == nil, "append fail: %s", err)
+	}
+	err = lw.Close()
+	assert(err == nil, "log close fail: %s", err)
+
+	decryptor := func(rd io.Reader) *Decryptor {
+		dd, err := NewDecryptor(rd)
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+		return dd
+	}
+
+	// append 'recs' to the log 'enc'; seekable or not
+	appendLog := func(enc []byte, recs [][]byte, seek bool) ([]byte, error) {
+		var rd io.Reader = bytes.NewBuffer(enc)
+		if seek {
+			rd = bytes.NewReader(enc)
+		}
+
+		wr := Buffer{}
+		lw, err := decryptor(rd).NewLogAppender(&wr)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range recs {
+			err = lw.Append(r)
+			assert(err == nil, "append fail: %s", err)
+		}
+		err = lw.Close()
+		assert(err == nil, "log close fail: %s", err)
+		return append(append([]byte{}, enc...), wr.Bytes()...), nil
+	}
+
+	// read back the records; return the number read and the final error
+	read := func(enc []byte) (int, error) {
+		lr, err := decryptor(bytes.NewBuffer(enc)).NewLogReader()
+		assert(err == nil, "log reader create fail: %s", err)
+
+		for i := 0; ; i++ {
+			rec, err := lr.Next()
+			if err != nil {
+				return i, err
+			}
+			assert(i < len(recs) && byteEq(rec, recs[i]), "record %d mismatch", i)
+		}
+	}
+
+	enc1 := append([]byte{}, wr.Bytes()...)
+	enc2, err := appendLog(enc1, recs[2:4], true)
+	assert(err == nil, "append 1 fail: %s", err)
+	enc3, err := appendLog(enc2, nil, false)
+	assert(err == nil, "append 2 fail: %s", err)
+	enc4, err := appendLog(enc3, recs[4:], false)
+	assert(err == nil, "append 3 fail: %s", err)
+
+	n, err := read(enc4)
+	assert(err == io.EOF, "log read fail: %s", err)
+	assert(n == 5, "log read %d records; exp 5", n)
+
+	// a log cut at an earlier end marker is the log as it was then
+	n, err = read(enc2)
+	assert(err == io.EOF, "log read fail: %s", err)
+	assert(n == 4, "log read %d records; exp 4", n)
+
+	// the last append is cut short
+	n, err = read(enc4[:len(enc4)-4])
+	assert(err == ErrLogTruncated, "truncated log: %v", err)
+	assert(n == 5, "truncated log read %d records", n)
+
+	_, err = appendLog(enc4[:len(enc4)-4], recs[:1], true)
+	assert(err == ErrLogTruncated, "append to truncated log: %v", err)
+
+	// a modified end marker
+	bad := append([]byte{}, enc4...)
+	bad[len(bad)-1] ^= 1
+	_, err = appendLog(bad, recs[:1], true)
+	assert(err != nil && err != ErrLogTruncated, "append to modified log: %v", err)
+
+	// appended records don't belong to another log
+	ee, err = NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	other := Buffer{}
+	lw, err = ee.NewLogWriter(&other)
+	assert(err == nil, "log writer create fail: %s", err)
+	for _, r := range recs[:2] {
+		err = lw.Append(r)
+		assert(err == nil, "append fail: %s", err)
+	}
+	err = lw.Close()
+	assert(err == nil, "log close fail: %s", err)
+
+	spliced := append(other.Bytes(), enc2[len(enc1):]...)
+	n, err = read(spliced)
+	assert(err != nil && err != io.EOF, "spliced log: %v", err)
+	assert(n == 2, "spliced log read %d records", n)
+}
+
+func TestArchive(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 1024
+	names := []string{"a.txt", "dir/b.bin", "empty", "dir/c.bin"}
+	sizes := []int{100, 5000, 0, 3000}
+	data := make(map[string][]byte)
+
+	files := make([]ArchiveFile, len(names))
+	for i, nm := range names {
+		b := randRead(make([]byte, sizes[i]))
+		data[nm] = b
+		files[i] = ArchiveFile{
+			ArchiveMember: ArchiveMember{
+				Name:    nm,
+				Size:    int64(len(b)),
+				Mode:    0644,
+				ModTime: int64(1000 + i),
+			},
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			},
+		}
+	}
+
+	encrypt := func(files []ArchiveFile) ([]byte, error) {
+		ee, err := NewEncryptor(nil, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+
+		err = ee.AddRecipient(&receiver.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		wr := Buffer{}
+		err = ee.EncryptArchive(files, &wr)
+		return wr.Bytes(), err
+	}
+
+	open := func(enc []byte) (*ArchiveReader, error) {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		return dd.NewArchiveReader(bytes.NewReader(enc), int64(len(enc)))
+	}
+
+	enc, err := encrypt(files)
+	assert(err == nil, "archive encrypt fail: %s", err)
+
+	a, err := open(enc)
+	assert(err == nil, "archive open fail: %s", err)
+	assert(len(a.Members) == len(names), "archive has %d members", len(a.Members))
+
+	for i, m := range a.Members {
+		assert(m.Name == names[i], "member %d: name %s", i, m.Name)
+		assert(m.Size == int64(sizes[i]) && m.Mode == 0644 && m.ModTime == int64(1000+i), "member %d: metadata mismatch", i)
+		assert(!m.HasOwner && len(m.Xattrs) == 0, "member %d: unexpected owner or xattrs", i)
+	}
+
+	// directories, ownership and extended attributes
+	dir := ArchiveFile{
+		ArchiveMember: ArchiveMember{
+			Name:     "dir",
+			Mode:     uint32(os.ModeDir | 0750),
+			HasOwner: true,
+			Uid:      1000,
+			Gid:      100,
+			Xattrs: map[string][]byte{
+				"user.comment":            []byte("hello"),
+				"system.posix_acl_access": randRead(make([]byte, 28)),
+				"user.empty":              []byte{},
+			},
+		},
+	}
+	x := files[1]
+	x.HasOwner = true
+	x.Uid = 0
+	x.Gid = 5
+
+	enc2, err := encrypt([]ArchiveFile{dir, x})
+	assert(err == nil, "archive encrypt fail: %s", err)
+
+	a2, err := open(enc2)
+	assert(err == nil, "archive open fail: %s", err)
+	assert(len(a2.Members) == 2, "archive has %d members", len(a2.Members))
+
+	m := &a2.Members[0]
+	assert(m.IsDir() && m.Size == 0 && m.Mode == dir.Mode, "dir member mismatch: %v", m)
+	assert(m.HasOwner && m.Uid == 1000 && m.Gid == 100, "dir owner mismatch")
+	assert(len(m.Xattrs) == 3, "dir xattrs: %d", len(m.Xattrs))
+	for k, v := range dir.Xattrs {
+		assert(byteEq(m.Xattrs[k], v), "xattr %s mismatch", k)
+	}
+
+	m = &a2.Members[1]
+	assert(!m.IsDir() && m.HasOwner && m.Uid == 0 && m.Gid == 5, "file owner mismatch")
+
+	out2 := Buffer{}
+	err = a2.Extract(x.Name, &out2)
+	assert(err == nil && byteEq(out2.Bytes(), data[x.Name]), "extract after dir fail: %v", err)
+
+	dir.Size = 10
+	_, err = encrypt([]ArchiveFile{dir})
+	assert(err != nil, "archived a directory with data")
+
+	// symlinks and hard links
+	sym := ArchiveFile{
+		ArchiveMember: ArchiveMember{
+			Name: "dir/sym",
+			Mode: uint32(os.ModeSymlink | 0777),
+			Link: "../a.txt",
+		},
+	}
+	hard := ArchiveFile{
+		ArchiveMember: ArchiveMember{
+			Name: "dir/hard",
+			Mode: 0644,
+			Link: files[0].Name,
+		},
+	}
+
+	enc2, err = encrypt([]ArchiveFile{files[0], sym, hard})
+	assert(err == nil, "archive encrypt fail: %s", err)
+
+	a2, err = open(enc2)
+	assert(err == nil, "archive open fail: %s", err)
+
+	m = &a2.Members[1]
+	assert(m.IsSymlink() && !m.IsHardlink() && m.Link == sym.Link && m.Size == 0, "symlink mismatch: %v", m)
+
+	m = &a2.Members[2]
+	assert(m.IsHardlink() && !m.IsSymlink() && m.Link == files[0].Name, "hard link mismatch: %v", m)
+
+	out2 = Buffer{}
+	err = a2.Extract(hard.Name, &out2)
+	assert(err == nil && byteEq(out2.Bytes(), data[files[0].Name]), "hard link extract fail: %v", err)
+
+	// a hard link must refer to an earlier file
+	_, err = encrypt([]ArchiveFile{hard, files[0]})
+	assert(err != nil, "archived a hard link before its file")
+
+	hard.Link = sym.Name
+	_, err = encrypt([]ArchiveFile{files[0], sym, hard})
+	assert(err != nil, "archived a hard link to a symlink")
+
+	sym.Link = ""
+	_, err = encrypt([]ArchiveFile{sym})
+	assert(err != nil, "archived a symlink without a target")
+
+	for _, nm := range []string{"dir/c.bin", "a.txt", "empty", "dir/b.bin"} {
+		out := Buffer{}
+		err = a.Extract(nm, &out)
+		assert(err == nil, "extract %s fail: %s", nm, err)
+		assert(byteEq(out.Bytes(), data[nm]), "extract %s data mismatch", nm)
+	}
+
+	_, err = a.Open("nonexistent")
+	assert(err != nil, "opened a missing member")
+
+	// a damaged chunk only affects the members stored in it
+	bad := append([]byte{}, enc...)
+	bad[len(bad)-10] ^= 1
+
+	a, err = open(bad)
+	assert(err == nil, "archive open fail: %s", err)
+
+	out := Buffer{}
+	err = a.Extract("a.txt", &out)
+	assert(err == nil && byteEq(out.Bytes(), data["a.txt"]), "extract from damaged archive fail: %v", err)
+
+	err = a.Extract("dir/c.bin", &out)
+	assert(err != nil, "extract of damaged member")
+
+	// truncated archive
+	_, err = open(enc[:len(enc)-(blkSize+_ChunkOverhead)])
+	assert(err != nil, "opened truncated archive")
+
+	// invalid and duplicate names; files that changed size
+	x = files[0]
+	x.Name = "../x"
+	_, err = encrypt([]ArchiveFile{x})
+	assert(err != nil, "archived invalid name")
+
+	_, err = encrypt([]ArchiveFile{files[0], files[0]})
+	assert(err != nil, "archived duplicate name")
+
+	x = files[1]
+	x.Size++
+	_, err = encrypt([]ArchiveFile{x})
+	assert(err != nil, "archived file shorter than its size")
+
+	x.Size -= 2
+	_, err = encrypt([]ArchiveFile{x})
+	assert(err != nil, "archived file longer than its size")
+}
+
+func TestArchiveFS(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	data := map[string][]byte{
+		"index.html":      randRead(make([]byte, 3000)),
+		"web/css/a.css":   randRead(make([]byte, 5000)),
+		"web/empty":       {},
+		"web/img/big.bin": randRead(make([]byte, 20000)),
+	}
+
+	var files []ArchiveFile
+	for _, nm := range []string{"index.html", "web/css/a.css", "web/empty", "web/img/big.bin"} {
+		b := data[nm]
+		files = append(files, ArchiveFile{
+			ArchiveMember: ArchiveMember{Name: nm, Size: int64(len(b)), Mode: 0644, ModTime: 1000},
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			},
+		})
+	}
+	files = append(files,
+		ArchiveFile{ArchiveMember: ArchiveMember{Name: "web", Mode: uint32(os.ModeDir | 0750), ModTime: 2000}},
+		ArchiveFile{ArchiveMember: ArchiveMember{Name: "web/img/link.bin", Mode: uint32(os.ModeSymlink | 0777), Link: "big.bin"}},
+		ArchiveFile{ArchiveMember: ArchiveMember{Name: "web/hard.css", Mode: 0644, Link: "web/css/a.css"}},
+		ArchiveFile{ArchiveMember: ArchiveMember{Name: "web/out", Mode: uint32(os.ModeSymlink | 0777), Link: "../../etc/passwd"}},
+	)
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	assert(ee.AddRecipient(&receiver.Pub) == nil, "can't add recipient")
+
+	wr := Buffer{}
+	err = ee.EncryptArchive(files, &wr)
+	assert(err == nil, "archive encrypt fail: %s", err)
+	enc := wr.Bytes()
+	ar := enc
+
+	dd, err := NewDecryptor(bytes.NewBuffer(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(dd.SetPrivateKey(&receiver.Sec, nil) == nil, "decryptor can't add SK")
+
+	efs, err := dd.NewArchiveFS(bytes.NewReader(enc), int64(len(enc)))
+	assert(err == nil, "archive fs fail: %s", err)
+
+	err = fstest.TestFS(efs, "index.html", "web/css/a.css", "web/empty", "web/img/big.bin", "web/img/link.bin", "web/hard.css")
+	assert(err == nil, "fstest: %s", err)
+
+	for nm, b := range data {
+		got, err := fs.ReadFile(efs, nm)
+		assert(err == nil && bytes.Equal(got, b), "%s: read fail: %v", nm, err)
+	}
+
+	got, err := fs.ReadFile(efs, "web/img/link.bin")
+	assert(err == nil && bytes.Equal(got, data["web/img/big.bin"]), "symlink read fail: %v", err)
+	got, err = fs.ReadFile(efs, "web/hard.css")
+	assert(err == nil && bytes.Equal(got, data["web/css/a.css"]), "hard link read fail: %v", err)
+
+	_, err = efs.Open("web/out")
+	assert(err != nil, "followed a symlink out of the archive")
+	_, err = efs.Open("../index.html")
+	assert(err != nil, "opened an invalid path")
+
+	st, err := fs.Stat(efs, "web")
+	assert(err == nil && st.IsDir() && st.Mode().Perm() == 0750, "web dir stat: %v %v", st, err)
+	st, err = fs.Stat(efs, "web/img")
+	assert(err == nil && st.IsDir(), "made up dir stat: %v", err)
+
+	// a single encrypted file
+	ee, err = NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	assert(ee.AddRecipient(&receiver.Pub) == nil, "can't add recipient")
+
+	wr = Buffer{}
+	err = ee.Encrypt(bytes.NewReader(data["web/img/big.bin"]), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	enc = wr.Bytes()
+
+	dd, err = NewDecryptor(bytes.NewBuffer(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(dd.SetPrivateKey(&receiver.Sec, nil) == nil, "decryptor can't add SK")
+
+	efs, err = dd.NewFileFS(bytes.NewReader(enc), int64(len(enc)), "data/big.bin")
+	assert(err == nil, "file fs fail: %s", err)
+	assert(fstest.TestFS(efs, "data/big.bin") == nil, "fstest of file fs")
+
+	// NewFS tells archives from files
+	dd, err = NewDecryptor(bytes.NewBuffer(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(dd.SetPrivateKey(&receiver.Sec, nil) == nil, "decryptor can't add SK")
+
+	efs, err = dd.NewFS(bytes.NewReader(enc), int64(len(enc)), "big.bin")
+	assert(err == nil, "fs fail: %s", err)
+	got, err = fs.ReadFile(efs, "big.bin")
+	assert(err == nil && bytes.Equal(got, data["web/img/big.bin"]), "file fs read fail: %v", err)
+
+	enc = ar
+	dd, err = NewDecryptor(bytes.NewBuffer(enc))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(dd.SetPrivateKey(&receiver.Sec, nil) == nil, "decryptor can't add SK")
+
+	efs, err = dd.NewFS(bytes.NewReader(enc), int64(len(enc)), "big.bin")
+	assert(err == nil, "fs fail: %s", err)
+	got, err = fs.ReadFile(efs, "web/css/a.css")
+	assert(err == nil && bytes.Equal(got, data["web/css/a.css"]), "archive fs read fail: %v", err)
+}
+
+func TestSparse(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	dn := tempdir(t)
+	defer os.RemoveAll(dn)
+
+	blkSize := 65536
+	size := int64(blkSize * 64)
+	data := randRead(make([]byte, 100))
+
+	// a file with data at the start, in the middle and at the end
+	fn := dn + "/sparse"
+	fd, err := os.Create(fn)
+	assert(err == nil, "can't create %s: %s", fn, err)
+
+	err = fd.Truncate(size)
+	assert(err == nil, "truncate fail: %s", err)
+	for _, off := range []int64{0, size / 2, size - 100} {
+		_, err = fd.WriteAt(data, off)
+		assert(err == nil, "write fail: %s", err)
+	}
+
+	exp := make([]byte, size)
+	for _, off := range []int64{0, size / 2, size - 100} {
+		copy(exp[off:], data)
+	}
+
+	encrypt := func(rd io.Reader, holes holeMap) []byte {
+		ee, err := NewEncryptor(nil, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+
+		err = ee.AddRecipient(&receiver.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		err = ee.EnableSparse()
+		assert(err == nil, "enable sparse fail: %s", err)
+
+		err = ee.EnableChunkManifest()
+		assert(err != nil, "chunk manifest enabled with sparse files")
+
+		ee.holes = holes
+		wr := Buffer{}
+		err = ee.Encrypt(rd, &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+		return wr.Bytes()
+	}
+
+	decrypt := func(enc []byte, wr io.Writer) {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		err = dd.Decrypt(wr)
+		assert(err == nil, "decrypt fail: %s", err)
+	}
+
+	_, err = fd.Seek(0, io.SeekStart)
+	assert(err == nil, "seek fail: %s", err)
+
+	enc := encrypt(fd, nil)
+	fd.Close()
+	if _SeekData > 0 {
+		assert(int64(len(enc)) < size/4, "holes not recorded: %d bytes", len(enc))
+	}
+
+	// decrypt to memory and to a file that gets holes
+	out := Buffer{}
+	decrypt(enc, &out)
+	assert(byteEq(out.Bytes(), exp), "sparse decrypt data mismatch")
+
+	ofn := dn + "/out"
+	ofd, err := os.Create(ofn)
+	assert(err == nil, "can't create %s: %s", ofn, err)
+
+	decrypt(enc, ofd)
+	ofd.Close()
+
+	got, err := ioutil.ReadFile(ofn)
+	assert(err == nil, "can't read %s: %s", ofn, err)
+	assert(byteEq(got, exp), "sparse file decrypt data mismatch")
+
+	// data in a reported hole is not dropped
+	buf := randRead(make([]byte, blkSize*4))
+	enc = encrypt(bytes.NewBuffer(buf), holeMap{{0, int64(len(buf))}})
+
+	out = Buffer{}
+	decrypt(enc, &out)
+	assert(byteEq(out.Bytes(), buf), "data in a hole lost")
+
+	// an output file that ends in a hole has the full size
+	exp = make([]byte, blkSize*3)
+	copy(exp, data)
+	enc = encrypt(bytes.NewBuffer(exp), holeMap{{0, int64(len(exp))}})
+
+	ofd, err = os.Create(ofn)
+	assert(err == nil, "can't create %s: %s", ofn, err)
+
+	decrypt(enc, ofd)
+	ofd.Close()
+
+	got, err = ioutil.ReadFile(ofn)
+	assert(err == nil, "can't read %s: %s", ofn, err)
+	assert(byteEq(got, exp), "trailing hole data mismatch (%d bytes)", len(got))
+}
+
+func TestDecryptVerify(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 1024
+	buf := randRead(make([]byte, blkSize*5+17))
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	enc := wr.Bytes()
+
+	verify := func(enc []byte) (*Decryptor, int64, error) {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		n, err := dd.Verify()
+		return dd, n, err
+	}
+
+	dd, n, err := verify(enc)
+	assert(err == nil, "verify fail: %s", err)
+	assert(n == int64(len(buf)), "verify size %d; exp %d", n, len(buf))
+
+	err = dd.Decrypt(&Buffer{})
+	assert(err != nil, "decrypt after verify")
+
+	bad := append([]byte{}, enc...)
+	bad[len(bad)-blkSize] ^= 1
+	_, _, err = verify(bad)
+	assert(err != nil, "verify of corrupted file")
+
+	_, _, err = verify(enc[:len(enc)-100])
+	assert(err != nil, "verify of truncated file")
+}
+
+func TestEncryptTo(t *testing.T) {
+	assert := newAsserter(t)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "sender keypair gen failed: %s", err)
+
+	r1, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	r2, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(&sender.Sec, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&r1.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+	err = ee.AddRecipient(&r2.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	var bufs, encs [][]byte
+	for i := 0; i < 4; i++ {
+		buf := randRead(make([]byte, 100+i*1000))
+		wr := Buffer{}
+		err = ee.EncryptTo(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "encrypt %d fail: %s", i, err)
+
+		bufs = append(bufs, buf)
+		encs = append(encs, wr.Bytes())
+	}
+
+	// the Encryptor itself is still usable
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(bufs[0]), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	encs = append(encs, wr.Bytes())
+	bufs = append(bufs, bufs[0])
+
+	salts := make(map[string]bool)
+	for i, enc := range encs {
+		for _, r := range []*Keypair{r1, r2} {
+			dd, err := NewDecryptor(bytes.NewBuffer(enc))
+			assert(err == nil, "decryptor create fail: %s", err)
+
+			err = dd.SetPrivateKey(&r.Sec, &sender.Pub)
+			assert(err == nil, "file %d: decryptor can't add SK: %s", i, err)
+
+			out := Buffer{}
+			err = dd.Decrypt(&out)
+			assert(err == nil, "file %d: decrypt fail: %s", i, err)
+			assert(byteEq(out.Bytes(), bufs[i]), "file %d: data mismatch", i)
+			assert(dd.AuthenticatedSender(), "file %d: sender not authenticated", i)
+
+			salts[string(dd.Salt)] = true
+		}
+	}
+	assert(len(salts) == len(encs), "files share salts: %d unique of %d", len(salts), len(encs))
+}
+
+func TestEncryptSession(t *testing.T) {
+	assert := newAsserter(t)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "sender keypair gen failed: %s", err)
+
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	r1, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	r2, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(&sender.Sec, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+
+	err = ee.AddRecipient(&r1.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+	err = ee.AddRecipient(&r2.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	err = ee.EnableSession()
+	assert(err == nil, "can't enable session: %s", err)
+
+	var bufs, encs [][]byte
+	for i := 0; i < 4; i++ {
+		buf := randRead(make([]byte, 100+i*1000))
+		wr := Buffer{}
+		err = ee.EncryptTo(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "encrypt %d fail: %s", i, err)
+
+		bufs = append(bufs, buf)
+		encs = append(encs, wr.Bytes())
+	}
+
+	var first *Decryptor
+	salts := make(map[string]bool)
+	for i, enc := range encs {
+		for _, r := range []*Keypair{r1, r2} {
+			dd, err := NewDecryptor(bytes.NewBuffer(enc))
+			assert(err == nil, "decryptor create fail: %s", err)
+			assert(len(dd.Session) > 0, "file %d: no session salt", i)
+
+			err = dd.SetPrivateKey(&r.Sec, &sender.Pub)
+			assert(err == nil, "file %d: decryptor can't add SK: %s", i, err)
+
+			out := Buffer{}
+			err = dd.Decrypt(&out)
+			assert(err == nil, "file %d: decrypt fail: %s", i, err)
+			assert(byteEq(out.Bytes(), bufs[i]), "file %d: data mismatch", i)
+			assert(dd.AuthenticatedSender(), "file %d: sender not authenticated", i)
+
+			if first == nil {
+				first = dd
+			}
+
+			// the session key is wrapped once for the whole batch
+			assert(byteEq(dd.Session, first.Session), "file %d: session salt differs", i)
+			for j := range dd.Keys {
+				assert(byteEq(dd.Keys[j].DKey, first.Keys[j].DKey), "file %d: wrapped key %d differs", i, j)
+			}
+
+			salts[string(dd.Salt)] = true
+		}
+	}
+	assert(len(salts) == len(encs), "files share salts: %d unique of %d", len(salts), len(encs))
+
+	// wrong sender
+	dd, err := NewDecryptor(bytes.NewBuffer(encs[1]))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = dd.SetPrivateKey(&r1.Sec, &other.Pub)
+	assert(err != nil, "decrypt with wrong sender passed")
+
+	// a new recipient starts a new session
+	r3, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+	err = ee.AddRecipient(&r3.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.EncryptTo(bytes.NewBuffer(bufs[0]), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	dd, err = NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+	assert(!byteEq(dd.Session, first.Session), "session not renewed")
+
+	err = dd.SetPrivateKey(&r3.Sec, &sender.Pub)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	out := Buffer{}
+	err = dd.Decrypt(&out)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(byteEq(out.Bytes(), bufs[0]), "data mismatch")
+}
+
+func TestEncryptContext(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	encrypt := func(ctx string, session bool) []byte {
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(&receiver.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+		err = ee.SetContext(ctx)
+		assert(err == nil, "set context fail: %s", err)
+
+		wr := Buffer{}
+		if session {
+			err = ee.EnableSession()
+			assert(err == nil, "can't enable session: %s", err)
+			err = ee.EncryptTo(bytes.NewBuffer(randbuf(3000)), &wr)
+		} else {
+			err = ee.Encrypt(bytes.NewBuffer(randbuf(3000)), &wr)
+		}
+		assert(err == nil, "encrypt fail: %s", err)
+
+		err = ee.SetContext("late")
+		if !session {
+			assert(err != nil, "set context after encryption")
+		}
+		return wr.Bytes()
+	}
+
+	decrypt := func(enc []byte, ctx string) error {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetContext(ctx)
+		assert(err == nil, "set context fail: %s", err)
+
+		// the key-wrapping key depends on the context
+		if err = dd.SetPrivateKey(&receiver.Sec, nil); err != nil {
+			return err
+		}
+		assert(dd.SetContext(ctx) != nil, "set context after SetPrivateKey()")
+
+		out := Buffer{}
+		return dd.Decrypt(&out)
+	}
+
+	for _, session := range []bool{false, true} {
+		enc := encrypt("app-a", session)
+		assert(decrypt(enc, "app-a") == nil, "session %v: decrypt with the same context fail", session)
+		assert(decrypt(enc, "app-b") != nil, "session %v: decrypted with another context", session)
+		assert(decrypt(enc, "") != nil, "session %v: decrypted without a context", session)
+
+		enc = encrypt("", session)
+		assert(decrypt(enc, "") == nil, "session %v: decrypt without a context fail", session)
+		assert(decrypt(enc, "app-a") != nil, "session %v: decrypted with a context", session)
+	}
+
+	// the keys of each version and context are distinct
+	key := randbuf(32)
+	sum := randbuf(32)
+	keys := make(map[string]bool)
+	for _, v := range []uint8{_Version1, _Version} {
+		for _, ctx := range []string{"", "app-a", "app-b"} {
+			k, err := dataKey(v, key, sum, ctx)
+			assert(err == nil, "data key fail: %s", err)
+			keys[string(k)] = true
+		}
+	}
+	assert(len(keys) == 6, "exp 6 distinct data keys, saw %d", len(keys))
+}
+
+// the v2 keys are derived with these labels; changing one breaks every
+// existing file
+func TestKdfLabels(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	derive := func(secret, salt []byte, info string, n int) []byte {
+		out := make([]byte, n)
+		_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out)
+		assert(err == nil, "hkdf fail: %s", err)
+		return out
+	}
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.EnableRecipientHints()
+	assert(err == nil, "can't enable hints: %s", err)
+	err = ee.SetContext("app")
+	assert(err == nil, "set context fail: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(randbuf(3000)), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	assert(ee.version == _Version, "exp version %d, saw %d", _Version, ee.version)
+
+	dkek, err := x25519(receiver.Sec.encryptionKeys()[0], ee.Pk)
+	assert(err == nil, "x25519 fail: %s", err)
+
+	salt := ee.Salt
+	kek := derive(dkek, salt, "sigtool v2 wrap key\x00app", 32)
+	w := ee.Keys[0]
+	assert(byteEq(w.Args, derive(kek, salt, "sigtool v2 recipient hint\x00", 8)), "recipient hint label")
+
+	blk, err := aes.NewCipher(kek)
+	assert(err == nil, "aes fail: %s", err)
+	ae, err := cipher.NewGCM(blk)
+	assert(err == nil, "gcm fail: %s", err)
+
+	nonce := makeNonce([]byte(_WrapReceiverNonce), salt)[:ae.NonceSize()]
+	key, err := ae.Open(nil, nonce, w.DKey, receiver.Pub.Pk)
+	assert(err == nil, "wrap key label: %s", err)
+	assert(byteEq(key, ee.key), "unwrapped key mismatch")
+
+	dk, err := dataKey(_Version, key, ee.hdrsum, "app")
+	assert(err == nil, "data key fail: %s", err)
+	assert(byteEq(dk, derive(key, ee.hdrsum, "sigtool v2 data key\x00app", 32)), "data key label")
+
+	// version 1 wraps with the X25519 shared secret
+	k1, err := wrapKEK(_Version1, dkek, salt, "app")
+	assert(err == nil && byteEq(k1, dkek), "v1 key-wrapping key")
+}
+
+// decrypt ranges of a file from many goroutines
+func TestChunkReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 1024
+	buf := randbuf(uint(blkSize*20 + blkSize/2))
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&receiver.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	enc := wr.Bytes()
+
+	reader := func(enc []byte) (*ChunkReader, error) {
+		dd, err := NewDecryptor(bytes.NewReader(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		c, err := dd.NewChunkReader(bytes.NewReader(enc), int64(len(enc)))
+		if err == nil {
+			assert(dd.Decrypt(&Buffer{}) != nil, "decrypt after chunk reader")
+		}
+		return c, err
+	}
+
+	c, err := reader(enc)
+	assert(err == nil, "chunk reader fail: %s", err)
+	assert(c.Size() == int64(len(buf)), "size: exp %d, saw %d", len(buf), c.Size())
+	assert(c.Chunks() == 21, "exp 21 chunks, saw %d", c.Chunks())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				off := randmod(len(buf))
+				n := randmod(3 * blkSize)
+				out := make([]byte, n)
+
+				m, err := c.ReadAt(out, int64(off))
+				want := buf[off:]
+				if len(want) > n {
+					want = want[:n]
+				}
+
+				switch {
+				case m != len(want):
+					errs <- fmt.Errorf("goroutine %d: read %d of %d bytes at %d: %v", g, m, len(want), off, err)
+				case err != nil && (err != io.EOF || len(want) == n):
+					errs <- fmt.Errorf("goroutine %d: read at %d: %s", g, off, err)
+				case !byteEq(out[:m], want):
+					errs <- fmt.Errorf("goroutine %d: data mismatch at %d", g, off)
+				default:
+					continue
+				}
+				return
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert(false, "%s", err)
+	}
+
+	p, err := c.ChunkAt(20, nil)
+	assert(err == nil, "chunk 20 fail: %s", err)
+	assert(byteEq(p, buf[20*blkSize:]), "chunk 20 mismatch")
+	_, err = c.ChunkAt(21, nil)
+	assert(err != nil, "read chunk past the end")
+
+	// a modified chunk fails alone
+	full := blkSize + _ChunkOverhead
+	hdrlen := len(enc) - 20*full - (blkSize/2 + _ChunkOverhead)
+	bad := append([]byte{}, enc...)
+	bad[hdrlen+18*full+10] ^= 1
+	c, err = reader(bad)
+	assert(err == nil, "chunk reader fail: %s", err)
+	_, err = c.ChunkAt(0, nil)
+	assert(err == nil, "chunk 0 fail: %s", err)
+	_, err = c.ChunkAt(18, nil)
+	assert(err != nil, "modified chunk decrypted")
+
+	// a truncated file has no last chunk
+	c, err = reader(enc[:len(enc)-(blkSize/2+_ChunkOverhead)])
+	assert(err == nil, "chunk reader fail: %s", err)
+	_, err = c.ChunkAt(c.Chunks()-1, nil)
+	assert(err != nil, "truncated file decrypted")
+}
+
+func TestReadChunk(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	blkSize := 1024
+	encrypt := func(buf []byte) []byte {
+		ee, err := NewEncryptor(nil, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(&receiver.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		wr := Buffer{}
+		err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+		return wr.Bytes()
+	}
+
+	decryptor := func(enc []byte) *Decryptor {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+		return dd
+	}
+
+	for _, size := range []int{0, 100, blkSize, 5*blkSize + blkSize/2} {
+		buf := randbuf(uint(size))
+		enc := encrypt(buf)
+
+		dd := decryptor(enc)
+		var out []byte
+		var n int
+		for {
+			p, last, err := dd.ReadChunk()
+			assert(err == nil, "size %d: chunk %d fail: %s", size, n, err)
+			assert(len(p) <= blkSize, "size %d: chunk %d too large: %d", size, n, len(p))
+			assert(last || len(p) == blkSize, "size %d: short chunk %d", size, n)
+
+			out = append(out, p...)
+			n++
+			if last {
+				break
+			}
+		}
+		assert(byteEq(out, buf), "size %d: content mismatch", size)
+		want := (size + blkSize - 1) / blkSize
+		if want == 0 {
+			want = 1
+		}
+		assert(n == want, "size %d: exp %d chunks, saw %d", size, want, n)
+
+		_, _, err = dd.ReadChunk()
+		assert(err == io.EOF, "size %d: exp EOF, saw %v", size, err)
+		assert(dd.Decrypt(&Buffer{}) != nil, "size %d: decrypt after ReadChunk()", size)
+	}
+
+	// can't mix with the stream reader
+	enc := encrypt(randbuf(3000))
+	dd := decryptor(enc)
+	_, err = dd.NewStreamReader()
+	assert(err == nil, "stream reader fail: %s", err)
+	_, _, err = dd.ReadChunk()
+	assert(err != nil, "ReadChunk() after the stream reader")
+
+	// a modified chunk isn't returned
+	enc[len(enc)-10] ^= 1
+	dd = decryptor(enc)
+	_, _, err = dd.ReadChunk()
+	assert(err == nil, "chunk 0 fail: %s", err)
+	_, _, err = dd.ReadChunk()
+	assert(err == nil, "chunk 1 fail: %s", err)
+	_, _, err = dd.ReadChunk()
+	assert(err != nil, "modified chunk returned")
+}
+
+// rewrap tokens move the wrapped keys of files to a new recipient key
+func TestRewrap(t *testing.T) {
+	assert := newAsserter(t)
+
+	var kp [4]*Keypair
+	for i := range kp {
+		k, err := NewKeypair()
+		assert(err == nil, "keypair gen failed: %s", err)
+		kp[i] = k
+	}
+	a, b, c, other := kp[0], kp[1], kp[2], kp[3]
+
+	buf := randbuf(5000)
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	for _, k := range []*Keypair{a, other} {
+		err = ee.AddRecipient(&k.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	enc := wr.Bytes()
+
+	decrypt := func(enc []byte, k *Keypair) error {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		sz, err := DecryptedSize(dd, int64(len(enc)))
+		assert(err == nil && sz == int64(len(buf)), "decrypted size: %d, %v", sz, err)
+
+		if err = dd.SetPrivateKey(&k.Sec, nil); err != nil {
+			return err
+		}
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+		return nil
+	}
+
+	rewrap := func(tok *RewrapToken, enc []byte) []byte {
+		wr := Buffer{}
+		err := tok.Rewrap(bytes.NewBuffer(enc), &wr)
+		assert(err == nil, "rewrap fail: %s", err)
+		return wr.Bytes()
+	}
+
+	_, err = NewRewrapToken(&a.Sec, &a.Sec)
+	assert(err != nil, "token to the same key")
+
+	ab, err := NewRewrapToken(&a.Sec, &b.Sec)
+	assert(err == nil, "token fail: %s", err)
+
+	// the token survives serialization
+	s, err := ab.Serialize("a to b")
+	assert(err == nil, "serialize fail: %s", err)
+	ab2, err := MakeRewrapToken(s)
+	assert(err == nil, "parse fail: %s", err)
+
+	renc := rewrap(ab, enc)
+	assert(byteEq(renc, rewrap(ab2, enc)), "parsed token rewraps differently")
+	assert(byteEq(renc[len(renc)-len(enc):], enc), "original file changed")
+
+	for _, k := range []*Keypair{a, b, other} {
+		assert(decrypt(renc, k) == nil, "rewrapped file doesn't decrypt")
+	}
+	assert(decrypt(renc, c) != nil, "rewrapped file decrypted with the wrong key")
+
+	// rewrapping is idempotent
+	assert(byteEq(rewrap(ab, renc), renc), "second rewrap changed the file")
+
+	// and chains: the records of b move to c
+	bc, err := NewRewrapToken(&b.Sec, &c.Sec)
+	assert(err == nil, "token fail: %s", err)
+	renc = rewrap(bc, renc)
+	assert(decrypt(renc, c) == nil, "chained rewrap doesn't decrypt")
+	assert(decrypt(renc, b) != nil, "moved record still decrypts")
+	assert(decrypt(renc, a) == nil, "original key doesn't decrypt")
+
+	h, err := ParseHeader(bytes.NewBuffer(renc))
+	assert(err == nil, "header fail: %s", err)
+	assert(len(h.Rewrapped) == 1 && byteEq(h.Rewrapped[0], c.Pub.EncryptionKey()), "rewrapped keys: %x", h.Rewrapped)
+
+	// a modified record doesn't unwrap
+	bad := append([]byte{}, renc...)
+	bad[_FixedHdrLen+_RewrapRecordLen-1] ^= 1
+	assert(decrypt(bad, c) != nil, "modified record decrypted")
+	assert(decrypt(bad, a) == nil, "original key doesn't decrypt")
+}
+
+// age identities aren't clamped; their tokens must be made with the
+// scalars that X25519 uses
+func TestRewrapAgeKey(t *testing.T) {
+	assert := newAsserter(t)
+
+	ageKey := func() *PrivateKey {
+		xsk := randbuf(32)
+		xsk[0] |= 7
+		xsk[31] |= 0x80
+		id, err := bech32Encode(_AgeIdentityHRP, xsk)
+		assert(err == nil, "bech32 encode fail: %s", err)
+
+		sk, err := ParseIdentity(id, nil)
+		assert(err == nil, "parse identity fail: %s", err)
+		return sk
+	}
+
+	kp, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	buf := randbuf(3000)
+	for i := 0; i < 4; i++ {
+		from, to := ageKey(), ageKey()
+		switch i {
+		case 2:
+			from = &kp.Sec
+		case 3:
+			to = &kp.Sec
+		}
+
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(from.PublicKey())
+		assert(err == nil, "can't add recipient: %s", err)
+
+		wr := Buffer{}
+		err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+
+		tok, err := NewRewrapToken(from, to)
+		assert(err == nil, "token fail: %s", err)
+
+		renc := Buffer{}
+		err = tok.Rewrap(bytes.NewBuffer(wr.Bytes()), &renc)
+		assert(err == nil, "rewrap fail: %s", err)
+
+		dd, err := NewDecryptor(bytes.NewBuffer(renc.Bytes()))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(to, nil)
+		assert(err == nil, "%d: rewrapped file doesn't decrypt: %s", i, err)
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+	}
+}
+
+// the escrow keys of a policy are recipients of every file
+func TestEscrowPolicy(t *testing.T) {
+	assert := newAsserter(t)
+
+	user, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	escrow, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	dn := tempdir(t)
+	defer os.RemoveAll(dn)
+
+	err = escrow.Pub.Serialize(dn+"/escrow.pub", "")
+	assert(err == nil, "serialize fail: %s", err)
+
+	// relative keys are relative to the policy file
+	fn := dn + "/policy.yml"
+	err = ioutil.WriteFile(fn, []byte("escrow:\n  - name: recovery\n    key: escrow.pub\n"), 0644)
+	assert(err == nil, "write fail: %s", err)
+
+	p, err := ReadPolicy(fn)
+	assert(err == nil, "read policy fail: %s", err)
+	assert(len(p.Escrow) == 1 && p.Escrow[0].Name == "recovery", "escrow keys: %v", p.Escrow)
+
+	buf := randbuf(3000)
+	encrypt := func(p *Policy) ([]byte, error) {
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(&user.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		if err = p.Apply(ee); err != nil {
+			return nil, err
+		}
+
+		wr := Buffer{}
+		err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+		return wr.Bytes(), err
+	}
+
+	enc, err := encrypt(p)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	h, err := ParseHeader(bytes.NewBuffer(enc))
+	assert(err == nil, "header fail: %s", err)
+	assert(len(h.Recipients) == 2, "recipients: %d", len(h.Recipients))
+	assert(len(h.Recipients[0].Escrow) == 0, "user key recorded as escrow")
+	assert(h.Recipients[1].Escrow == escrow.Pub.Fingerprint(), "escrow: %q", h.Recipients[1].Escrow)
+
+	for _, k := range []*Keypair{user, escrow} {
+		dd, err := NewDecryptor(bytes.NewBuffer(enc))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&k.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+	}
+
+	// no escrow key, no encryption
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&user.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+	ee.RequireEscrow()
+	err = ee.Encrypt(bytes.NewBuffer(buf), &Buffer{})
+	assert(err != nil, "encrypted without an escrow recipient")
+
+	// the escrow key is in every file of a session
+	err = ee.AddEscrowRecipient(&escrow.Pub)
+	assert(err == nil, "can't add escrow: %s", err)
+	err = ee.EnableSession()
+	assert(err == nil, "session fail: %s", err)
+	wr := Buffer{}
+	err = ee.EncryptTo(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	h, err = ParseHeader(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil && h.Recipients[1].Escrow == escrow.Pub.Fingerprint(), "session escrow: %v", err)
+
+	// a missing policy is empty; a bad one is an error
+	p, err = ReadPolicy(dn + "/none.yml")
+	assert(err == nil && len(p.Escrow) == 0, "missing policy: %v", err)
+	_, err = encrypt(p)
+	assert(err == nil, "encrypt with empty policy fail: %s", err)
+
+	for _, s := range []string{
+		"escrow:\n  - name: x\n    key: nonexistent.pub\n",
+		"escrow:\n  - name: x\n",
+		"escrows:\n  - key: x\n",
+	} {
+		_, err = MakePolicy([]byte(s))
+		assert(err != nil, "bad policy accepted: %q", s)
+	}
+}
+
+func TestEncryptEach(t *testing.T) {
+	assert := newAsserter(t)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "sender keypair gen failed: %s", err)
+
+	var rs []*Keypair
+	for i := 0; i < 3; i++ {
+		r, err := NewKeypair()
+		assert(err == nil, "receiver keypair gen failed: %s", err)
+		rs = append(rs, r)
+	}
+	escrow, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(&sender.Sec, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	for _, r := range rs {
+		err = ee.AddRecipient(&r.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+	err = ee.AddEscrowRecipient(&escrow.Pub)
+	assert(err == nil, "can't add escrow: %s", err)
+
+	err = ee.EncryptEach(bytes.NewBuffer(nil), []io.WriteCloser{&Buffer{}})
+	assert(err != nil, "encrypted to too few outputs")
+
+	buf := randbuf(5000)
+	wrs := make([]io.WriteCloser, len(rs))
+	outs := make([]*Buffer, len(rs))
+	for i := range wrs {
+		outs[i] = &Buffer{}
+		wrs[i] = outs[i]
+	}
+	err = ee.EncryptEach(bytes.NewBuffer(buf), wrs)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	epks := make(map[string]bool)
+	for i, out := range outs {
+		enc := out.Bytes()
+		h, err := ParseHeader(bytes.NewBuffer(enc))
+		assert(err == nil, "file %d: header fail: %s", i, err)
+		assert(len(h.Recipients) == 2 && len(h.Recipients[1].Escrow) > 0, "file %d: recipients %d", i, len(h.Recipients))
+
+		for j, r := range append(rs, escrow) {
+			dd, err := NewDecryptor(bytes.NewBuffer(enc))
+			assert(err == nil, "decryptor create fail: %s", err)
+			epks[string(dd.Pk)] = true
+
+			err = dd.SetPrivateKey(&r.Sec, &sender.Pub)
+			if j != i && r != escrow {
+				assert(err != nil, "file %d: decrypted by recipient %d", i, j)
+				continue
+			}
+			assert(err == nil, "file %d: decryptor can't add SK: %s", i, err)
+
+			wr := Buffer{}
+			err = dd.Decrypt(&wr)
+			assert(err == nil, "file %d: decrypt fail: %s", i, err)
+			assert(byteEq(wr.Bytes(), buf), "file %d: data mismatch", i)
+			assert(dd.AuthenticatedSender(), "file %d: sender not authenticated", i)
+		}
+	}
+	assert(len(epks) == len(outs), "files share ephemeral keys")
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := newAsserter(t)
+
+	// one second's worth passes at once; the rest at the rate
+	buf := randbuf(150000)
+	l := NewRateLimiter(100000)
+
+	start := time.Now()
+	wr := l.WriteCloser(&Buffer{})
+	for i := 0; i < len(buf); i += 10000 {
+		_, err := wr.Write(buf[i : i+10000])
+		assert(err == nil, "write fail: %s", err)
+	}
+	d := time.Since(start)
+	assert(d > 400*time.Millisecond && d < 2*time.Second, "write of 150000 bytes at 100000/s took %s", d)
+
+	// readers share the limit of the writers
+	start = time.Now()
+	out, err := ioutil.ReadAll(l.Reader(bytes.NewBuffer(buf[:50000])))
+	assert(err == nil && byteEq(out, buf[:50000]), "read fail: %v", err)
+	d = time.Since(start)
+	assert(d > 400*time.Millisecond, "read of 50000 bytes at 100000/s took %s", d)
+}
+
+func TestEncryptCipher(t *testing.T) {
+	assert := newAsserter(t)
+
+	receiver, err := NewKeypair()
+	assert(err == nil, "receiver keypair gen failed: %s", err)
+
+	buf := randbuf(5000)
+	for _, name := range []string{CipherAESGCM, CipherChaCha20} {
+		ee, err := NewEncryptor(nil, 1024)
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.SetCipher(name)
+		assert(err == nil, "can't set cipher %s: %s", name, err)
+		err = ee.AddRecipient(&receiver.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		wr := Buffer{}
+		err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "%s: encrypt fail: %s", name, err)
+
+		b := wr.Bytes()
+		assert(int64(len(b)) == ee.EncryptedSize(int64(len(buf)), 1), "%s: wrong size %d", name, len(b))
+
+		h, err := ParseHeader(bytes.NewBuffer(b))
+		assert(err == nil, "%s: header parse fail: %s", name, err)
+		assert(h.Cipher == name, "%s: header has cipher %s", name, h.Cipher)
+
+		// AES-GCM files are readable by older versions
+		vlen := int(binary.BigEndian.Uint32(b[_MagicLen+1:]))
+		var ph pb.Header
+		err = ph.Unmarshal(b[_FixedHdrLen : _FixedHdrLen+vlen])
+		assert(err == nil, "header unmarshal fail: %s", err)
+		assert((name == CipherAESGCM) == (len(ph.Cipher) == 0), "%s: header cipher %q", name, ph.Cipher)
+
+		dd, err := NewDecryptor(bytes.NewBuffer(b))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		out := Buffer{}
+		err = dd.Decrypt(&out)
+		assert(err == nil, "%s: decrypt fail: %s", name, err)
+		assert(byteEq(out.Bytes(), buf), "%s: decrypt mismatch", name)
+
+		// switching the cipher in the header breaks its checksum
+		ph.Cipher = CipherChaCha20
+		if name == CipherChaCha20 {
+			ph.Cipher = ""
+		}
+		vb, err := ph.Marshal()
+		assert(err == nil, "header marshal fail: %s", err)
+
+		hdr := append([]byte{}, b[:_FixedHdrLen]...)
+		binary.BigEndian.PutUint32(hdr[_MagicLen+1:], uint32(len(vb)))
+		hdr = append(hdr, vb...)
+		sum := sha256.Sum256(hdr)
+		hdr = append(append(hdr, sum[:]...), b[_FixedHdrLen+vlen+32:]...)
+
+		dd, err = NewDecryptor(bytes.NewBuffer(hdr))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = dd.SetPrivateKey(&receiver.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+		err = dd.Decrypt(&Buffer{})
+		assert(err != nil, "%s: decrypted with a switched cipher", name)
+	}
+
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	assert(ee.cipher == AutoCipher(), "default cipher %s isn't %s", ee.cipher, AutoCipher())
+	err = ee.SetCipher("des")
+	assert(err != nil, "set an unknown cipher")
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	assert := newAsserter(t)
+
+	srvKey, err := NewKeypair()
+	assert(err == nil, "server keypair gen failed: %s", err)
+	cliKey, err := NewKeypair()
+	assert(err == nil, "client keypair gen failed: %s", err)
+
+	srv := &HTTPConfig{
+		Identity:   &srvKey.Sec,
+		Sender:     &cliKey.Pub,
+		Recipients: []*PublicKey{&cliKey.Pub},
+		ChunkSize:  1024,
+	}
+	cli := &HTTPConfig{
+		Identity:   &cliKey.Sec,
+		Sender:     &srvKey.Pub,
+		Recipients: []*PublicKey{&srvKey.Pub},
+		ChunkSize:  1024,
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(b)
+		}
+	})
+	ts := httptest.NewServer(srv.Handler(h))
+	defer ts.Close()
+
+	hc := &http.Client{Transport: cli.RoundTripper(nil)}
+
+	body := randRead(make([]byte, 10000))
+	resp, err := hc.Post(ts.URL+"/echo", "application/octet-stream", bytes.NewReader(body))
+	assert(err == nil, "post: %s", err)
+	got, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert(err == nil, "read: %s", err)
+	assert(resp.StatusCode == http.StatusOK, "status %d", resp.StatusCode)
+	assert(bytes.Equal(got, body), "echo mismatch")
+
+	resp, err = hc.Get(ts.URL + "/empty")
+	assert(err == nil, "get: %s", err)
+	resp.Body.Close()
+	assert(resp.StatusCode == http.StatusNoContent, "status %d", resp.StatusCode)
+
+	// the body on the wire is encrypted
+	resp, err = http.Get(ts.URL + "/echo")
+	assert(err == nil, "get: %s", err)
+	got, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert(err == nil, "read: %s", err)
+	assert(resp.Header.Get("Content-Encoding") == HTTPContentEncoding, "response isn't encrypted")
+
+	d, err := NewDecryptor(bytes.NewBuffer(got))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&cliKey.Sec, &srvKey.Pub)
+	assert(err == nil, "response not for the client: %s", err)
+
+	// the server refuses bodies that aren't encrypted ...
+	resp, err = http.Post(ts.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	assert(err == nil, "post: %s", err)
+	resp.Body.Close()
+	assert(resp.StatusCode == http.StatusBadRequest, "plain body: status %d", resp.StatusCode)
+
+	// ... and bodies from others
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	oc := &HTTPConfig{
+		Identity:   &other.Sec,
+		Recipients: []*PublicKey{&srvKey.Pub},
+	}
+	hc = &http.Client{Transport: oc.RoundTripper(nil)}
+	resp, err = hc.Post(ts.URL+"/echo", "application/octet-stream", bytes.NewReader(body))
+	assert(err == nil, "post: %s", err)
+	resp.Body.Close()
+	assert(resp.StatusCode == http.StatusBadRequest, "wrong sender: status %d", resp.StatusCode)
+}
+
+func TestSecureConn(t *testing.T) {
+	assert := newAsserter(t)
+
+	a, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	b, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	x, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	// run the handshake on both ends of a pipe
+	pair := func(ska *PrivateKey, pkb *PublicKey, skb *PrivateKey, pka *PublicKey) (net.Conn, net.Conn, error, error) {
+		ca, cb := net.Pipe()
+
+		var sb net.Conn
+		var errb error
+		done := make(chan bool)
+		go func() {
+			sb, errb = SecureConn(cb, skb, pka)
+			if errb != nil {
+				cb.Close()
+			}
+			close(done)
+		}()
+
+		sa, erra := SecureConn(ca, ska, pkb)
+		if erra != nil {
+			ca.Close()
+		}
+		<-done
+		return sa, sb, erra, errb
+	}
+
+	sa, sb, erra, errb := pair(&a.Sec, &b.Pub, &b.Sec, &a.Pub)
+	assert(erra == nil && errb == nil, "handshake: %v, %v", erra, errb)
+
+	// both ways at once
+	msg := randRead(make([]byte, 100000))
+	reply := randRead(make([]byte, 40000))
+	go sa.Write(msg)
+	go sb.Write(reply)
+
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(sb, got)
+	assert(err == nil && bytes.Equal(got, msg), "message mismatch: %v", err)
+
+	got = make([]byte, len(reply))
+	_, err = io.ReadFull(sa, got)
+	assert(err == nil && bytes.Equal(got, reply), "reply mismatch: %v", err)
+
+	go sa.Close()
+	got, err = ioutil.ReadAll(sb)
+	assert(err == nil && len(got) == 0, "read after close: %v", err)
+	sb.Close()
+
+	// wrong peer keys
+	_, _, erra, errb = pair(&a.Sec, &x.Pub, &b.Sec, &a.Pub)
+	assert(erra != nil && errb != nil, "handshake with the wrong key: %v, %v", erra, errb)
+
+	_, _, erra, errb = pair(&x.Sec, &b.Pub, &b.Sec, &a.Pub)
+	assert(erra != nil && errb != nil, "handshake with an impostor: %v, %v", erra, errb)
+
+	// truncated streams are noticed
+	sa, sb, erra, errb = pair(&a.Sec, &b.Pub, &b.Sec, &a.Pub)
+	assert(erra == nil && errb == nil, "handshake: %v, %v", erra, errb)
+	go func() {
+		sa.Write(msg[:1000])
+		sa.(*secureConn).Conn.Close()
+	}()
+	_, err = ioutil.ReadAll(sb)
+	assert(err == io.ErrUnexpectedEOF, "truncated stream: %v", err)
+}
+
+func TestNoise(t *testing.T) {
+	assert := newAsserter(t)
+
+	a, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	b, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	x, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	// the messages of a handshake with payloads
+	for _, proto := range []string{NoiseXX, NoiseIK} {
+		hi, err := NewNoiseHandshake(proto, true, &a.Sec, &b.Pub, []byte("prologue"))
+		assert(err == nil, "%s: initiator: %s", proto, err)
+		hr, err := NewNoiseHandshake(proto, false, &b.Sec, nil, []byte("prologue"))
+		assert(err == nil, "%s: responder: %s", proto, err)
+
+		from, to := hi, hr
+		for i := 0; !hi.Complete(); i++ {
+			pl := []byte(fmt.Sprintf("payload %d", i))
+			msg, err := from.WriteMessage(pl)
+			assert(err == nil, "%s: write %d: %s", proto, i, err)
+			got, err := to.ReadMessage(msg)
+			assert(err == nil, "%s: read %d: %s", proto, i, err)
+			assert(bytes.Equal(got, pl), "%s: payload %d mismatch", proto, i)
+			from, to = to, from
+		}
+		assert(hr.Complete(), "%s: responder not complete", proto)
+		assert(bytes.Equal(hi.HandshakeHash(), hr.HandshakeHash()), "%s: handshake hash mismatch", proto)
+
+		xa, _ := a.Pub.toCurve25519PK()
+		assert(bytes.Equal(hr.PeerStatic(), xa), "%s: wrong initiator static", proto)
+
+		is, ir, err := hi.Split()
+		assert(err == nil, "%s: split: %s", proto, err)
+		rs, rr, err := hr.Split()
+		assert(err == nil, "%s: split: %s", proto, err)
+
+		ct, err := is.Encrypt(nil, nil, []byte("hello"))
+		assert(err == nil, "%s: encrypt: %s", proto, err)
+		pt, err := rr.Decrypt(nil, nil, ct)
+		assert(err == nil && string(pt) == "hello", "%s: decrypt: %v", proto, err)
+
+		ct, _ = rs.Encrypt(nil, nil, []byte("world"))
+		ct[0] ^= 1
+		_, err = ir.Decrypt(nil, nil, ct)
+		assert(err != nil, "%s: decrypted a modified message", proto)
+
+		// a different prologue fails
+		hi, _ = NewNoiseHandshake(proto, true, &a.Sec, &b.Pub, []byte("one"))
+		hr, _ = NewNoiseHandshake(proto, false, &b.Sec, nil, []byte("two"))
+		msg, _ := hi.WriteMessage(nil)
+		_, err = hr.ReadMessage(msg)
+		if err == nil {
+			msg, _ = hr.WriteMessage(nil)
+			_, err = hi.ReadMessage(msg)
+		}
+		assert(err != nil, "%s: handshake with different prologues", proto)
+	}
+
+	_, err = NewNoiseHandshake(NoiseIK, true, &a.Sec, nil, nil)
+	assert(err != nil, "IK initiator without the responder's key")
+
+	// run NoiseConn on both ends of a pipe
+	pair := func(proto string, ska *PrivateKey, pkb *PublicKey, skb *PrivateKey, pka *PublicKey) (net.Conn, net.Conn, error, error) {
+		ca, cb := net.Pipe()
+
+		var sb net.Conn
+		var errb error
+		done := make(chan bool)
+		go func() {
+			sb, errb = NoiseConn(cb, proto, false, skb, pka)
+			if errb != nil {
+				cb.Close()
+			}
+			close(done)
+		}()
+
+		sa, erra := NoiseConn(ca, proto, true, ska, pkb)
+		if erra != nil {
+			ca.Close()
+		}
+		<-done
+		return sa, sb, erra, errb
+	}
+
+	for _, proto := range []string{NoiseXX, NoiseIK} {
+		sa, sb, erra, errb := pair(proto, &a.Sec, &b.Pub, &b.Sec, &a.Pub)
+		assert(erra == nil && errb == nil, "%s: handshake: %v, %v", proto, erra, errb)
+
+		msg := randRead(make([]byte, 200000))
+		go func() {
+			sa.Write(msg)
+			sa.Close()
+		}()
+
+		got, err := ioutil.ReadAll(sb)
+		assert(err == nil && bytes.Equal(got, msg), "%s: message mismatch: %v", proto, err)
+		sb.Close()
+
+		_, _, erra, errb = pair(proto, &a.Sec, &b.Pub, &b.Sec, &x.Pub)
+		assert(erra != nil || errb != nil, "%s: handshake with the wrong initiator", proto)
+	}
+}
+
+func TestDNSRecipient(t *testing.T) {
+	assert := newAsserter(t)
+
+	kp, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	pk := &kp.Pub
+
+	name, err := DNSRecordName("alice@Example.COM.")
+	assert(err == nil, "record name: %s", err)
+	h := sha256.Sum256([]byte("alice"))
+	assert(name == hex.EncodeToString(h[:28])+"._sigtool.example.com", "record name: %s", name)
+
+	for _, a := range []string{"alice", "@example.com", "alice@", "alice@localhost", "alice@a..b"} {
+		_, err = DNSRecordName(a)
+		assert(err != nil, "%s: bad address accepted", a)
+	}
+
+	// a resolver that answers for 'name' and nothing else
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert(err == nil, "listen: %s", err)
+	defer conn.Close()
+
+	// the answers change during the test
+	var mu sync.Mutex
+	var ad uint16 = 1 << 5
+	txts := []string{"v=spf1 -all", pk.DNSRecord()}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			q := buf[:n]
+			qend := 12
+			for q[qend] != 0 {
+				qend += 1 + int(q[qend])
+			}
+			qend += 5
+			qname := strings.ToLower(dnsName(q[12:]))
+
+			mu.Lock()
+			resp := append([]byte{}, q[:qend]...)
+			binary.BigEndian.PutUint16(resp[2:], 1<<15|1<<8|1<<7|ad)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			if qname != name {
+				resp[3] |= 3
+			} else {
+				binary.BigEndian.PutUint16(resp[6:], uint16(len(txts)))
+				for _, s := range txts {
+					// split in 60 byte strings
+					var rd []byte
+					for len(s) > 0 {
+						p := s
+						if len(p) > 60 {
+							p = p[:60]
+						}
+						rd = append(append(rd, byte(len(p))), p...)
+						s = s[len(p):]
+					}
+					resp = append(resp, 0xc0, 12, 0, 16, 0, 1, 0, 0, 1, 0, byte(len(rd)>>8), byte(len(rd)))
+					resp = append(resp, rd...)
+				}
+			}
+			mu.Unlock()
+			conn.WriteTo(resp, from)
+		}
+	}()
+
+	srv := conn.LocalAddr().String()
+	xpk, secure, err := LookupRecipient("alice@example.com", srv)
+	assert(err == nil, "lookup: %s", err)
+	assert(secure, "lookup: AD bit lost")
+	assert(bytes.Equal(xpk.Pk, pk.Pk) && bytes.Equal(xpk.xpk, pk.xpk), "lookup: wrong key")
+	assert(xpk.Comment == "alice@example.com", "lookup: comment %q", xpk.Comment)
+
+	mu.Lock()
+	ad = 0
+	mu.Unlock()
+	_, secure, err = LookupRecipient("alice@EXAMPLE.com", srv)
+	assert(err == nil, "lookup: %s", err)
+	assert(!secure, "lookup: unauthenticated answer is secure")
+
+	_, _, err = LookupRecipient("bob@example.com", srv)
+	assert(err != nil, "lookup: found a missing user")
+
+	// two different keys are ambiguous
+	kp2, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	mu.Lock()
+	txts = append(txts, kp2.Pub.DNSRecord())
+	mu.Unlock()
+	_, _, err = LookupRecipient("alice@example.com", srv)
+	assert(err != nil, "lookup: ambiguous keys accepted")
+
+	// a forged X25519 key is refused
+	bad := strings.Replace(pk.DNSRecord(), "; s=", "; s=AAAA", 1)
+	_, err = parseDNSRecord(bad)
+	assert(err != nil, "bad xsig accepted")
+}
+
+// the dotted form of the DNS name in 'b'
+func dnsName(b []byte) string {
+	var l []string
+	for b[0] != 0 {
+		l = append(l, string(b[1:1+b[0]]))
+		b = b[1+b[0]:]
+	}
+	return strings.Join(l, ".")
+}
+
+func TestStreamRecipients(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 1024
+	buf := make([]byte, 5*blkSize+17)
+	randRead(buf)
+
+	added, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	const nrecip = 300
+	keys := make([]*Keypair, nrecip)
+	for i := range keys {
+		keys[i], err = NewKeypair()
+		assert(err == nil, "keypair gen failed: %s", err)
+	}
+
+	encrypt := func(stream bool) []byte {
+		ee, err := NewEncryptor(nil, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+
+		err = ee.AddRecipient(&added.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		i := 0
+		err = ee.StreamRecipients(func() (*PublicKey, error) {
+			if i == len(keys) {
+				return nil, io.EOF
+			}
+			i++
+			return &keys[i-1].Pub, nil
+		})
+		assert(err == nil, "stream recipients: %s", err)
+
+		err = ee.EncryptTo(bytes.NewBuffer(buf), &Buffer{})
+		assert(err != nil, "EncryptTo with streamed recipients")
+
+		wr := Buffer{}
+		if stream {
+			w, err := ee.NewStreamWriter(&wr)
+			assert(err == nil, "stream writer: %s", err)
+			_, err = w.Write(buf)
+			assert(err == nil, "stream write: %s", err)
+			assert(w.Close() == nil, "stream close")
+		} else {
+			err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+			assert(err == nil, "encrypt fail: %s", err)
+		}
+
+		b := wr.Bytes()
+		exp := ee.EncryptedSize(int64(len(buf)), nrecip+1)
+		assert(int64(len(b)) == exp, "encrypted size: exp %d, saw %d", exp, len(b))
+		return b
+	}
+
+	decrypt := func(ct []byte, sk *PrivateKey) ([]byte, error) {
+		d, err := NewDecryptor(bytes.NewBuffer(ct))
+		if err != nil {
+			return nil, err
+		}
+		if err = d.SetPrivateKey(sk, nil); err != nil {
+			return nil, err
+		}
+
+		wr := Buffer{}
+		err = d.Decrypt(&wr)
+		return wr.Bytes(), err
+	}
+
+	for _, stream := range []bool{false, true} {
+		ct := encrypt(stream)
+		assert(ct[_MagicLen] == _Version3, "version %d", ct[_MagicLen])
+
+		for _, sk := range []*PrivateKey{&added.Sec, &keys[0].Sec, &keys[nrecip/2].Sec, &keys[nrecip-1].Sec} {
+			pt, err := decrypt(ct, sk)
+			assert(err == nil, "decrypt: %s", err)
+			assert(bytes.Equal(pt, buf), "decrypt: plaintext mismatch")
+		}
+
+		_, err = decrypt(ct, &other.Sec)
+		assert(err != nil, "decrypt with the wrong key")
+
+		h, err := ParseHeader(bytes.NewBuffer(ct))
+		assert(err == nil, "parse header: %s", err)
+		assert(h.Version == 3 && len(h.Recipients) == nrecip+1, "header: version %d, %d recipients", h.Version, len(h.Recipients))
+		sz, err := h.DecryptedSize(int64(len(ct)))
+		assert(err == nil && sz == int64(len(buf)), "header: decrypted size %d: %v", sz, err)
+
+		// a change in the recipient section is caught
+		bad := append([]byte{}, ct...)
+		bad[h.Size-sha256.Size-100] ^= 1
+		_, err = decrypt(bad, &added.Sec)
+		assert(err != nil, "decrypt: corrupted recipient accepted")
+
+		// as is a truncated one
+		_, err = decrypt(ct[:h.Size-sha256.Size-10], &added.Sec)
+		assert(err != nil, "decrypt: truncated recipients accepted")
+	}
+
+	// a failing iterator fails the encryption
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.StreamRecipients(func() (*PublicKey, error) {
+		return nil, fmt.Errorf("no more keys")
+	})
+	assert(err == nil, "stream recipients: %s", err)
+	err = ee.Encrypt(bytes.NewBuffer(buf), &Buffer{})
+	assert(err != nil, "encrypt with a failing iterator")
+}
+
+func TestRecipientHints(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 1024
+	buf := make([]byte, 3*blkSize+5)
+	randRead(buf)
+
+	const nrecip = 50
+	keys := make([]*Keypair, nrecip)
+	var err error
+	for i := range keys {
+		keys[i], err = NewKeypair()
+		assert(err == nil, "keypair gen failed: %s", err)
+	}
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	assert(ee.EnableRecipientHints() == nil, "can't enable hints")
+	for _, kp := range keys {
+		err = ee.AddRecipient(&kp.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+	err = ee.EnableRecipientHints()
+	assert(err != nil, "hints enabled after adding recipients")
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	ct := wr.Bytes()
+
+	exp := ee.EncryptedSize(int64(len(buf)), nrecip)
+	assert(int64(len(ct)) == exp, "encrypted size: exp %d, saw %d", exp, len(ct))
+
+	h, err := ParseHeader(bytes.NewBuffer(ct))
+	assert(err == nil, "parse header: %s", err)
+	seen := make(map[string]bool)
+	for i, w := range h.Recipients {
+		assert(len(w.Args) == _RecipientHintLen, "slot %d: no hint", i)
+		seen[string(w.Args)] = true
+	}
+	assert(len(seen) == nrecip, "hints aren't distinct")
+
+	for _, i := range []int{0, nrecip / 2, nrecip - 1} {
+		d, err := NewDecryptor(bytes.NewBuffer(ct))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		// the hint finds the slot
+		key, skip, err := d.unwrapHinted(&keys[i].Sec)
+		assert(err == nil && skip && key != nil, "recipient %d: not found by hint: %v", i, err)
+
+		err = d.SetPrivateKey(&keys[i].Sec, nil)
+		assert(err == nil, "recipient %d: %s", i, err)
+
+		out := Buffer{}
+		err = d.Decrypt(&out)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(bytes.Equal(out.Bytes(), buf), "decrypt: plaintext mismatch")
+	}
+
+	d, err := NewDecryptor(bytes.NewBuffer(ct))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&other.Sec, nil)
+	assert(err != nil, "decrypt with the wrong key")
+
+	// files of a session and streamed recipients carry hints too
+	ee, err = NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	assert(ee.EnableRecipientHints() == nil, "can't enable hints")
+	assert(ee.AddRecipient(&keys[0].Pub) == nil, "can't add recipient")
+	assert(ee.EnableSession() == nil, "can't enable session")
+
+	for j := 0; j < 2; j++ {
+		wr = Buffer{}
+		err = ee.EncryptTo(bytes.NewBuffer(buf), &wr)
+		assert(err == nil, "encrypt to: %s", err)
+
+		d, err = NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+		assert(err == nil, "decryptor create fail: %s", err)
+		key, _, err := d.unwrapHinted(&keys[0].Sec)
+		assert(err == nil && key != nil, "session file %d: not found by hint: %v", j, err)
+	}
+
+	ee, err = NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	assert(ee.EnableRecipientHints() == nil, "can't enable hints")
+	n := 0
+	err = ee.StreamRecipients(func() (*PublicKey, error) {
+		if n == nrecip {
+			return nil, io.EOF
+		}
+		n++
+		return &keys[n-1].Pub, nil
+	})
+	assert(err == nil, "stream recipients: %s", err)
+
+	wr = Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	exp = ee.EncryptedSize(int64(len(buf)), nrecip)
+	assert(int64(wr.Len()) == exp, "encrypted size: exp %d, saw %d", exp, wr.Len())
+
+	d, err = NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&keys[nrecip-1].Sec, nil)
+	assert(err == nil, "streamed: %s", err)
+}
+
+func TestParallelUnwrap(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 1024
+	buf := make([]byte, 2*blkSize+3)
+	randRead(buf)
+
+	const nrecip = 2 * _ParallelUnwrapMin
+	keys := make([]*Keypair, nrecip)
+	var err error
+	for i := range keys {
+		keys[i], err = NewKeypair()
+		assert(err == nil, "keypair gen failed: %s", err)
+	}
+	other, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	for _, kp := range keys {
+		err = ee.AddRecipient(&kp.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+	}
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	ct := wr.Bytes()
+
+	for _, i := range []int{0, 1, nrecip / 3, nrecip - 1} {
+		d, err := NewDecryptor(bytes.NewBuffer(ct))
+		assert(err == nil, "decryptor create fail: %s", err)
+
+		if runtime.NumCPU() > 1 {
+			key, tried, err := d.unwrapParallel(&keys[i].Sec, false)
+			assert(err == nil && tried && key != nil, "recipient %d: not found: %v", i, err)
+		}
+
+		err = d.SetPrivateKey(&keys[i].Sec, nil)
+		assert(err == nil, "recipient %d: %s", i, err)
+
+		out := Buffer{}
+		err = d.Decrypt(&out)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(bytes.Equal(out.Bytes(), buf), "decrypt: plaintext mismatch")
+	}
+
+	d, err := NewDecryptor(bytes.NewBuffer(ct))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&other.Sec, nil)
+	assert(err != nil, "decrypt with the wrong key")
+}
+
+func TestCheckpoint(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 1024
+	buf := make([]byte, 9*blkSize+17)
+	randRead(buf)
+
+	kp, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&kp.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	// the "crash" happens after the 5th chunk; the last checkpoint is
+	// after the 4th
+	var saved []byte
+	err = ee.SetCheckpoint(2, func(c *EncryptCheckpoint) error {
+		if c.Chunks > 4 {
+			return fmt.Errorf("crash")
+		}
+		saved, err = c.Marshal()
+		return err
+	})
+	assert(err == nil, "set checkpoint: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err != nil, "encrypt didn't fail")
+	assert(saved != nil, "no checkpoint")
+
+	cp, err := ParseEncryptCheckpoint(saved)
+	assert(err == nil, "parse checkpoint: %s", err)
+	assert(cp.Chunks == 4, "checkpoint: chunks %d", cp.Chunks)
+	assert(cp.Input == int64(4*blkSize), "checkpoint: input %d", cp.Input)
+
+	out := wr.Bytes()
+	assert(int64(len(out)) > cp.Output, "checkpoint: output %d of %d", cp.Output, len(out))
+	err = cp.Verify(bytes.NewBuffer(out))
+	assert(err == nil, "verify checkpoint: %s", err)
+
+	resume := func(stream bool) []byte {
+		e, err := ResumeEncryptor(cp)
+		assert(err == nil, "resume: %s", err)
+
+		wr := Buffer{}
+		wr.Write(out[:cp.Output])
+		if !stream {
+			err = e.Encrypt(bytes.NewBuffer(buf[cp.Input:]), &wr)
+			assert(err == nil, "resumed encrypt fail: %s", err)
+			return wr.Bytes()
+		}
+
+		w, err := e.NewStreamWriter(&wr)
+		assert(err == nil, "resumed stream fail: %s", err)
+		for rest := buf[cp.Input:]; len(rest) > 0; {
+			n := 300
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err = w.Write(rest[:n])
+			assert(err == nil, "resumed write fail: %s", err)
+			rest = rest[n:]
+		}
+		err = w.Close()
+		assert(err == nil, "resumed close fail: %s", err)
+		return wr.Bytes()
+	}
+
+	for _, stream := range []bool{false, true} {
+		ct := resume(stream)
+
+		d, err := NewDecryptor(bytes.NewBuffer(ct))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = d.SetPrivateKey(&kp.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		pt := Buffer{}
+		err = d.Decrypt(&pt)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(bytes.Equal(pt.Bytes(), buf), "decrypt: plaintext mismatch (stream %v)", stream)
+	}
+
+	// a checkpoint doesn't match another file
+	ee, err = NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(&kp.Pub)
+	assert(err == nil, "can't add recipient: %s", err)
+	wr = Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+	err = cp.Verify(bytes.NewBuffer(wr.Bytes()))
+	assert(err != nil, "verify: other file matched")
+
+	_, err = ParseEncryptCheckpoint([]byte(`{"version": 2}`))
+	assert(err != nil, "parse: bad checkpoint accepted")
+}
+
+func TestCheckpointSkip(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 1024
+	buf := make([]byte, 9*blkSize+17)
+	randRead(buf)
+
+	kp, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	// encrypt until the checkpoint after 'crash' chunks fails; return
+	// the output and the last checkpoint saved
+	encrypt := func(crash uint64) ([]byte, *EncryptCheckpoint) {
+		ee, err := NewEncryptor(nil, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.AddRecipient(&kp.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+
+		var cp *EncryptCheckpoint
+		err = ee.SetCheckpoint(2, func(c *EncryptCheckpoint) error {
+			if c.Chunks >= crash {
+				return fmt.Errorf("crash")
+			}
+			cp = c
+			return nil
+		})
+		assert(err == nil, "set checkpoint: %s", err)
+
+		wr := Buffer{}
+		ee.Encrypt(bytes.NewBuffer(buf), &wr)
+		assert(cp != nil, "no checkpoint")
+		return wr.Bytes(), cp
+	}
+
+	decrypt := func(ct []byte) {
+		d, err := NewDecryptor(bytes.NewBuffer(ct))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = d.SetPrivateKey(&kp.Sec, nil)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		pt := Buffer{}
+		err = d.Decrypt(&pt)
+		assert(err == nil, "decrypt fail: %s", err)
+		assert(bytes.Equal(pt.Bytes(), buf), "decrypt: plaintext mismatch")
+	}
+
+	// the chunks after the checkpoint are kept; a partial one is
+	// sealed again
+	out, cp := encrypt(6)
+	assert(cp.Chunks == 4, "checkpoint: chunks %d", cp.Chunks)
+	chunk := (int64(len(out)) - cp.Output) / 2
+	for _, cut := range []int64{0, chunk / 2, chunk, chunk + 3, 2 * chunk} {
+		old := out[cp.Output : cp.Output+cut]
+
+		e, err := ResumeEncryptor(cp)
+		assert(err == nil, "resume: %s", err)
+		in, n, done, err := e.SkipWritten(bytes.NewBuffer(buf[cp.Input:]), bytes.NewBuffer(old))
+		assert(err == nil, "skip %d: %s", cut, err)
+		assert(!done, "skip %d: done", cut)
+		assert(n == cut/chunk*chunk, "skip %d: kept %d bytes", cut, n)
+		assert(in == n/chunk*int64(blkSize), "skip %d: input %d", cut, in)
+
+		wr := Buffer{}
+		wr.Write(out[:cp.Output+n])
+		err = e.Encrypt(bytes.NewBuffer(buf[cp.Input+in:]), &wr)
+		assert(err == nil, "resumed encrypt fail: %s", err)
+		decrypt(wr.Bytes())
+	}
+
+	// a changed input isn't sealed again
+	chg := append([]byte{}, buf...)
+	chg[cp.Input+int64(blkSize)+7] ^= 1
+	for _, cut := range []int64{2 * chunk, chunk + 20} {
+		e, err := ResumeEncryptor(cp)
+		assert(err == nil, "resume: %s", err)
+		_, _, _, err = e.SkipWritten(bytes.NewBuffer(chg[cp.Input:]), bytes.NewBuffer(out[cp.Output:cp.Output+cut]))
+		assert(err != nil, "skip %d: changed input accepted", cut)
+	}
+
+	// a finished encryption has nothing left to write
+	out, cp = encrypt(100)
+	assert(cp.Chunks == 8, "checkpoint: chunks %d", cp.Chunks)
+	e, err := ResumeEncryptor(cp)
+	assert(err == nil, "resume: %s", err)
+	in, n, done, err := e.SkipWritten(bytes.NewBuffer(buf[cp.Input:]), bytes.NewBuffer(out[cp.Output:]))
+	assert(err == nil, "skip: %s", err)
+	assert(done, "skip: not done")
+	assert(cp.Input+in == int64(len(buf)), "skip: input %d", in)
+	assert(cp.Output+n == int64(len(out)), "skip: output %d", n)
+	decrypt(out)
+}
+
+func TestCDC(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 16384
+	buf := make([]byte, 200000)
+	randRead(buf)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	kp, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	newEnc := func(name string) *Encryptor {
+		ee, err := NewEncryptor(&sender.Sec, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.SetCipher(CipherAESGCM)
+		assert(err == nil, "set cipher: %s", err)
+		err = ee.EnableCDC(name)
+		assert(err == nil, "enable cdc: %s", err)
+		err = ee.AddRecipient(&kp.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+		return ee
+	}
+
+	encrypt := func(name string, pt []byte) []byte {
+		wr := Buffer{}
+		err := newEnc(name).Encrypt(bytes.NewBuffer(pt), &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+		return wr.Bytes()
+	}
+
+	decrypt := func(ct []byte) ([]byte, error) {
+		d, err := NewDecryptor(bytes.NewBuffer(ct))
+		assert(err == nil, "decryptor create fail: %s", err)
+		err = d.SetPrivateKey(&kp.Sec, &sender.Pub)
+		assert(err == nil, "decryptor can't add SK: %s", err)
+
+		out := Buffer{}
+		err = d.Decrypt(&out)
+		return out.Bytes(), err
+	}
+
+	// the data chunks of 'ct'
+	chunks := func(ct []byte) [][]byte {
+		h, err := ParseHeader(bytes.NewBuffer(ct))
+		assert(err == nil, "parse header: %s", err)
+		assert(h.Chunking == "cdc", "chunking %s", h.Chunking)
+
+		var v [][]byte
+		for b := ct[h.Size:]; ; {
+			m := binary.BigEndian.Uint32(b)
+			if m&_EOF != 0 {
+				assert(len(b) == 4+_AEADTagLen, "trailing %d bytes", len(b))
+				return v
+			}
+			n := 4 + _AEADNonceLen + int(m) + _AEADTagLen
+			v = append(v, b[:n])
+			b = b[n:]
+
+			// only the last one can be short
+			last := binary.BigEndian.Uint32(b)&_EOF != 0
+			assert(m <= uint32(blkSize) && (last || m > uint32(blkSize/16)), "chunk of %d bytes", m)
+		}
+	}
+
+	shared := func(a, b [][]byte) int {
+		seen := make(map[string]bool)
+		for _, c := range a {
+			seen[string(c)] = true
+		}
+		var n int
+		for _, c := range b {
+			if seen[string(c)] {
+				n++
+			}
+		}
+		return n
+	}
+
+	ct := encrypt("backup/disk.img", buf)
+	pt, err := decrypt(ct)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(bytes.Equal(pt, buf), "decrypt: plaintext mismatch")
+	ca := chunks(ct)
+	assert(len(ca) > 4, "only %d chunks", len(ca))
+
+	// an insert only changes the chunks around it
+	mod := append(append(append([]byte{}, buf[:50000]...), make([]byte, 100)...), buf[50000:]...)
+	ct2 := encrypt("backup/disk.img", mod)
+	pt, err = decrypt(ct2)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(bytes.Equal(pt, mod), "decrypt: plaintext mismatch")
+	cb := chunks(ct2)
+	n := shared(ca, cb)
+	assert(n >= len(ca)-3, "only %d of %d chunks shared", n, len(ca))
+
+	// the stream writer cuts the same chunks
+	wr := Buffer{}
+	w, err := newEnc("backup/disk.img").NewStreamWriter(&wr)
+	assert(err == nil, "stream writer: %s", err)
+	for b := buf; len(b) > 0; {
+		k := 7001
+		if k > len(b) {
+			k = len(b)
+		}
+		_, err = w.Write(b[:k])
+		assert(err == nil, "write fail: %s", err)
+		b = b[k:]
+	}
+	err = w.Close()
+	assert(err == nil, "close fail: %s", err)
+	n = shared(ca, chunks(wr.Bytes()))
+	assert(n == len(ca), "stream: %d of %d chunks shared", n, len(ca))
+
+	// another name is another key
+	n = shared(ca, chunks(encrypt("backup/other.img", buf)))
+	assert(n == 0, "other name: %d chunks shared", n)
+
+	// reordered or dropped chunks are detected
+	hdr, err := ParseHeader(bytes.NewBuffer(ct))
+	assert(err == nil, "parse header: %s", err)
+	trailer := ct[len(ct)-4-_AEADTagLen:]
+
+	join := func(v ...[]byte) []byte {
+		b := append([]byte{}, ct[:hdr.Size]...)
+		for _, c := range v {
+			b = append(b, c...)
+		}
+		return append(b, trailer...)
+	}
+
+	swapped := append([][]byte{ca[1], ca[0]}, ca[2:]...)
+	_, err = decrypt(join(swapped...))
+	assert(err != nil, "reordered chunks decrypted")
+	_, err = decrypt(join(ca[1:]...))
+	assert(err != nil, "dropped chunk decrypted")
+	_, err = decrypt(join(ca...))
+	assert(err == nil, "rejoined chunks: %s", err)
+
+	ee, err := NewEncryptor(nil, uint64(blkSize))
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.EnableCDC("x")
+	assert(err != nil, "cdc without a sender key")
+}
+
+func TestEncryptDelta(t *testing.T) {
+	assert := newAsserter(t)
+
+	var blkSize int = 16384
+	buf := make([]byte, 300000)
+	randRead(buf)
+
+	sender, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+	kp, err := NewKeypair()
+	assert(err == nil, "keypair gen failed: %s", err)
+
+	newEnc := func(name string) *Encryptor {
+		ee, err := NewEncryptor(&sender.Sec, uint64(blkSize))
+		assert(err == nil, "encryptor create fail: %s", err)
+		err = ee.EnableCDC(name)
+		assert(err == nil, "enable cdc: %s", err)
+		err = ee.AddRecipient(&kp.Pub)
+		assert(err == nil, "can't add recipient: %s", err)
+		return ee
+	}
+
+	encrypt := func(name string, pt []byte) []byte {
+		wr := Buffer{}
+		err := newEnc(name).Encrypt(bytes.NewBuffer(pt), &wr)
+		assert(err == nil, "encrypt fail: %s", err)
+		return wr.Bytes()
+	}
+
+	// the chunks of 'ct' without the header and last chunk
+	body := func(ct []byte) []byte {
+		h, err := ParseHeader(bytes.NewBuffer(ct))
+		assert(err == nil, "parse header: %s", err)
+		return ct[h.Size : len(ct)-4-_AEADTagLen]
+	}
+
+	old := encrypt("vm.img", buf)
+
+	mod := append([]byte{}, buf[:100000]...)
+	mod = append(mod, []byte("a few new bytes")...)
+	mod = append(mod, buf[100000:]...)
+	copy(mod[250000:], make([]byte, 300))
+
+	wr := Buffer{}
+	reused, err := newEnc("vm.img").EncryptDelta(bytes.NewBuffer(mod), bytes.NewReader(old), &wr)
+	assert(err == nil, "delta fail: %s", err)
+	ct := wr.Bytes()
+	assert(reused > int64(len(old))*3/4, "only %d of %d bytes reused", reused, len(old))
+	assert(reused < int64(len(old)), "all %d bytes reused", reused)
+
+	// the same chunks as encrypting the new plaintext
+	fresh := encrypt("vm.img", mod)
+	assert(bytes.Equal(body(ct), body(fresh)), "delta: chunks differ from a fresh encryption")
+
+	d, err := NewDecryptor(bytes.NewBuffer(ct))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = d.SetPrivateKey(&kp.Sec, &sender.Pub)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+	out := Buffer{}
+	err = d.Decrypt(&out)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(bytes.Equal(out.Bytes(), mod), "decrypt: plaintext mismatch")
+
+	// the previous file must be ours and intact
+	wr = Buffer{}
+	_, err = newEnc("other.img").EncryptDelta(bytes.NewBuffer(mod), bytes.NewReader(old), &wr)
+	assert(err != nil, "delta: previous file of another key used")
+
+	bad := append([]byte{}, old...)
+	bad[len(bad)/2] ^= 1
+	wr = Buffer{}
+	_, err = newEnc("vm.img").EncryptDelta(bytes.NewBuffer(mod), bytes.NewReader(bad), &wr)
+	assert(err != nil, "delta: corrupt previous file used")
+}
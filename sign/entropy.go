@@ -0,0 +1,168 @@
+// entropy.go -- passphrase strength estimate
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The estimate is that of a guesser who knows the usual patterns: each
+// character adds the bits of the character classes used in the passphrase
+// unless it repeats the previous character, continues a sequence ("abc",
+// "321") or a keyboard row ("qwerty", "asdf"), or starts a common password
+// or word; those add only a few bits. It is an upper bound of the
+// strength of the passphrase and not a guarantee.
+
+package sign
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// WeakPassphraseBits is the estimated entropy below which a passphrase is
+// weak
+const WeakPassphraseBits = 50
+
+// common passwords and words, in order of popularity
+var commonWords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin",
+	"iloveyou", "monkey", "dragon", "master", "sunshine", "princess",
+	"football", "baseball", "shadow", "superman", "trustno1", "secret",
+	"login", "hello", "abc123", "changeme", "default", "starwars",
+	"whatever", "freedom", "summer", "winter", "spring", "autumn",
+	"passw0rd", "p@ssword", "sigtool", "private", "mypass", "test",
+}
+
+// keyboard rows; neighbours in a row are a sequence
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// PassphraseEntropy estimates the entropy of the passphrase 'pw' in bits
+func PassphraseEntropy(pw []byte) float64 {
+	s := string(pw)
+	if len(s) == 0 {
+		return 0
+	}
+
+	// only ASCII is folded so that 'lower' and 's' have the same offsets
+	lb := []byte(s)
+	for i, c := range lb {
+		if c >= 'A' && c <= 'Z' {
+			lb[i] = c + 'a' - 'A'
+		}
+	}
+
+	lower := string(lb)
+	for i, w := range commonWords {
+		if lower == w {
+			return math.Log2(float64(i + 2))
+		}
+	}
+
+	cbits := math.Log2(float64(charPool(s)))
+	wbits := math.Log2(float64(len(commonWords)))
+
+	var bits float64
+	var prev rune
+	for i := 0; i < len(s); {
+		if n := commonPrefix(lower[i:]); n > 0 {
+			bits += wbits
+			if lower[i:i+n] != s[i:i+n] {
+				bits++
+			}
+			prev, _ = utf8.DecodeLastRuneInString(lower[:i+n])
+			i += n
+			continue
+		}
+
+		r, n := utf8.DecodeRuneInString(lower[i:])
+		switch {
+		case i > 0 && r == prev:
+			bits++
+		case i > 0 && isSequence(prev, r):
+			bits += 2
+		default:
+			bits += cbits
+		}
+		prev = r
+		i += n
+	}
+	return bits
+}
+
+// number of characters in the classes used by 's'
+func charPool(s string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	var n int
+	if lower {
+		n += 26
+	}
+	if upper {
+		n += 26
+	}
+	if digit {
+		n += 10
+	}
+	if symbol {
+		n += 33
+	}
+	if other {
+		n += 100
+	}
+	return n
+}
+
+// length of the longest common word at the start of 's'
+func commonPrefix(s string) int {
+	var n int
+	for _, w := range commonWords {
+		if len(w) > n && len(w) >= 4 && strings.HasPrefix(s, w) {
+			n = len(w)
+		}
+	}
+	return n
+}
+
+// true if 'b' follows 'a' in the alphabet, digits or a keyboard row (in
+// either direction)
+func isSequence(a, b rune) bool {
+	if d := a - b; (d == 1 || d == -1) && unicode.IsLetter(a) == unicode.IsLetter(b) {
+		return true
+	}
+
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// expiry.go -- public key expiration
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ExpiryPolicy decides what happens when an expired public key is used
+// to verify a signature or as the recipient of an encrypted file.
+type ExpiryPolicy int32
+
+const (
+	// Using an expired key is an error; this is the default
+	ExpiryFail ExpiryPolicy = iota
+
+	// Using an expired key logs a warning via the package logger
+	ExpiryWarn
+
+	// Key expiration is ignored
+	ExpiryIgnore
+)
+
+var expiryPolicy int32
+
+// SetExpiryPolicy sets the package wide policy for expired keys
+func SetExpiryPolicy(p ExpiryPolicy) {
+	atomic.StoreInt32(&expiryPolicy, int32(p))
+}
+
+// ParseExpiryPolicy parses the policy names "fail", "warn" and "ignore"
+func ParseExpiryPolicy(s string) (ExpiryPolicy, error) {
+	switch s {
+	case "fail":
+		return ExpiryFail, nil
+	case "warn":
+		return ExpiryWarn, nil
+	case "ignore":
+		return ExpiryIgnore, nil
+	}
+	return ExpiryFail, fmt.Errorf("unknown key expiry policy %q", s)
+}
+
+// ParseExpiry parses the expiration time 's' given as a date
+// ("2027-01-01", midnight UTC) or in RFC 3339 format.
+func ParseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration time %q (want YYYY-MM-DD or RFC 3339)", s)
+	}
+	return t, nil
+}
+
+// SetExpiry makes the public key of the keypair expire at 't'; a zero
+// time means the key doesn't expire.
+func (kp *Keypair) SetExpiry(t time.Time) {
+	kp.Pub.Expires = t
+}
+
+// Expired returns true if the public key has an expiration time and it
+// is not after 't'.
+func (pk *PublicKey) Expired(t time.Time) bool {
+	return !pk.Expires.IsZero() && !t.Before(pk.Expires)
+}
+
+// check if the key has expired; return an error if the policy forbids
+// its use for operation 'op'.
+func (pk *PublicKey) checkExpiry(op string) error {
+	if !pk.Expired(time.Now()) {
+		return nil
+	}
+
+	switch ExpiryPolicy(atomic.LoadInt32(&expiryPolicy)) {
+	case ExpiryIgnore:
+		return nil
+	case ExpiryWarn:
+		warn(nil, op+": using expired key", "pkhash", fmt.Sprintf("%x", pk.hash),
+			"comment", pk.Comment, "expired", pk.Expires.Format(time.RFC3339))
+		return nil
+	}
+
+	return fmt.Errorf("%s: key %x (%s) expired on %s", op, pk.hash, pk.Comment,
+		pk.Expires.Format(time.RFC3339))
+}
@@ -0,0 +1,238 @@
+// fingerprint.go -- fingerprints of keys for humans
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+// FingerprintHex returns the SHA256 fingerprint of the public key as
+// colon separated hex bytes.
+func (pk *PublicKey) FingerprintHex() string {
+	d := pk.fingerprintDigest()
+	s := make([]string, len(d))
+	for i, b := range d {
+		s[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(s, ":")
+}
+
+// FingerprintWords returns the SHA256 fingerprint of the public key in
+// the PGP word list: bytes at even positions are two syllable words and
+// those at odd positions three syllable words. It is meant to be read
+// aloud.
+func (pk *PublicKey) FingerprintWords() string {
+	d := pk.fingerprintDigest()
+	s := make([]string, len(d))
+	for i, b := range d {
+		if i%2 == 0 {
+			s[i] = pgpEvenWords[b]
+		} else {
+			s[i] = pgpOddWords[b]
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+// Randomart returns the "drunken bishop" picture of the SHA256
+// fingerprint of the public key; it is identical to the one shown by
+// 'ssh-keygen -lv'.
+func (pk *PublicKey) Randomart() string {
+	return randomart(pk.fingerprintDigest(), "ED25519 256", "SHA256")
+}
+
+// SAS returns a short authentication string for the keys 'a' and 'b': 20
+// digits in groups of five. Both parties to a key exchange get the same
+// string regardless of the order of the keys; reading it to each other
+// shows that no one swapped the keys in transit. It is long enough that
+// making a key with the same string is infeasible.
+func SAS(a, b *PublicKey) string {
+	x, y := a.fingerprintDigest(), b.fingerprintDigest()
+	if bytes.Compare(x, y) > 0 {
+		x, y = y, x
+	}
+
+	h := sha512.New()
+	h.Write([]byte("sigtool sas v1"))
+	h.Write(x)
+	h.Write(y)
+	d := h.Sum(nil)
+
+	s := make([]string, 4)
+	for i := range s {
+		var v uint64
+		for _, c := range d[i*5 : i*5+5] {
+			v = v<<8 | uint64(c)
+		}
+		s[i] = fmt.Sprintf("%05d", v%100000)
+	}
+	return strings.Join(s, " ")
+}
+
+// SHA256 of the OpenSSH wire form of the key; its base64 is Fingerprint()
+func (pk *PublicKey) fingerprintDigest() []byte {
+	h := sha256.Sum256(pk.sshWire())
+	return h[:]
+}
+
+const (
+	_ArtWidth  = 17
+	_ArtHeight = 9
+
+	// symbols for the number of visits; the last two mark the start and
+	// the end of the walk.
+	_ArtSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// walk a bishop from the center of the field with each pair of bits of
+// 'd' and draw the number of visits to each square.
+func randomart(d []byte, title, hash string) string {
+	var field [_ArtWidth][_ArtHeight]int
+
+	max := len(_ArtSymbols) - 1
+	x, y := _ArtWidth/2, _ArtHeight/2
+	for _, b := range d {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+
+			x = artClamp(x, _ArtWidth-1)
+			y = artClamp(y, _ArtHeight-1)
+			if field[x][y] < max-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[_ArtWidth/2][_ArtHeight/2] = max - 1
+	field[x][y] = max
+
+	var s strings.Builder
+	s.WriteString(artBorder(title))
+	for j := 0; j < _ArtHeight; j++ {
+		s.WriteByte('|')
+		for i := 0; i < _ArtWidth; i++ {
+			s.WriteByte(_ArtSymbols[field[i][j]])
+		}
+		s.WriteString("|\n")
+	}
+	s.WriteString(artBorder(hash))
+	return s.String()
+}
+
+// top or bottom border of randomart with 'label' in its middle
+func artBorder(label string) string {
+	label = "[" + label + "]"
+	if len(label) > _ArtWidth {
+		label = label[:_ArtWidth-1] + "]"
+	}
+
+	n := (_ArtWidth - len(label)) / 2
+	return "+" + strings.Repeat("-", n) + label + strings.Repeat("-", _ArtWidth-n-len(label)) + "+\n"
+}
+
+// clamp v to [0, hi]
+func artClamp(v, hi int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// The PGP word list: two syllable words for bytes at even positions
+var pgpEvenWords = [256]string{
+	"aardvark", "absurd", "accrue", "acme", "adrift", "adult", "afflict", "ahead",
+	"aimless", "Algol", "allow", "alone", "ammo", "ancient", "apple", "artist",
+	"assume", "Athens", "atlas", "Aztec", "baboon", "backfield", "backward", "banjo",
+	"beaming", "bedlamp", "beehive", "beeswax", "befriend", "Belfast", "berserk", "billiard",
+	"bison", "blackjack", "blockade", "blowtorch", "bluebird", "bombast", "bookshelf", "brackish",
+	"breadline", "breakup", "brickyard", "briefcase", "Burbank", "button", "buzzard", "cement",
+	"chairlift", "chatter", "checkup", "chisel", "choking", "chopper", "Christmas", "clamshell",
+	"classic", "classroom", "cleanup", "clockwork", "cobra", "commence", "concert", "cowbell",
+	"crackdown", "cranky", "crowfoot", "crucial", "crumpled", "crusade", "cubic", "dashboard",
+	"deadbolt", "deckhand", "dogsled", "dragnet", "drainage", "dreadful", "drifter", "dropper",
+	"drumbeat", "drunken", "Dupont", "dwelling", "eating", "edict", "egghead", "eightball",
+	"endorse", "endow", "enlist", "erase", "escape", "exceed", "eyeglass", "eyetooth",
+	"facial", "fallout", "flagpole", "flatfoot", "flytrap", "fracture", "framework", "freedom",
+	"frighten", "gazelle", "Geiger", "glitter", "glucose", "goggles", "goldfish", "gremlin",
+	"guidance", "hamlet", "highchair", "hockey", "indoors", "indulge", "inverse", "involve",
+	"island", "jawbone", "keyboard", "kickoff", "kiwi", "klaxon", "locale", "lockup",
+	"merit", "minnow", "miser", "Mohawk", "mural", "music", "necklace", "Neptune",
+	"newborn", "nightbird", "Oakland", "obtuse", "offload", "optic", "orca", "payday",
+	"peachy", "pheasant", "physique", "playhouse", "Pluto", "preclude", "prefer", "preshrunk",
+	"printer", "prowler", "pupil", "puppy", "python", "quadrant", "quiver", "quota",
+	"ragtime", "ratchet", "rebirth", "reform", "regain", "reindeer", "rematch", "repay",
+	"retouch", "revenge", "reward", "rhythm", "ribcage", "ringbolt", "robust", "rocker",
+	"ruffled", "sailboat", "sawdust", "scallion", "scenic", "scorecard", "Scotland", "seabird",
+	"select", "sentence", "shadow", "shamrock", "showgirl", "skullcap", "skydive", "slingshot",
+	"slowdown", "snapline", "snapshot", "snowcap", "snowslide", "solo", "southward", "soybean",
+	"spaniel", "spearhead", "spellbind", "spheroid", "spigot", "spindle", "spyglass", "stagehand",
+	"stagnate", "stairway", "standard", "stapler", "steamship", "sterling", "stockman", "stopwatch",
+	"stormy", "sugar", "surmount", "suspense", "sweatband", "swelter", "tactics", "talon",
+	"tapeworm", "tempest", "tiger", "tissue", "tonic", "topmost", "tracker", "transit",
+	"trauma", "treadmill", "Trojan", "trouble", "tumor", "tunnel", "tycoon", "uncut",
+	"unearth", "unwind", "uproot", "upset", "upshot", "vapor", "village", "virus",
+	"Vulcan", "waffle", "wallet", "watchword", "wayside", "willow", "woodlark", "Zulu",
+}
+
+// and three syllable words for bytes at odd positions
+var pgpOddWords = [256]string{
+	"adroitness", "adviser", "aftermath", "aggregate", "alkali", "almighty", "amulet", "amusement",
+	"antenna", "applicant", "Apollo", "armistice", "article", "asteroid", "Atlantic", "atmosphere",
+	"autopsy", "Babylon", "backwater", "barbecue", "belowground", "bifocals", "bodyguard", "bookseller",
+	"borderline", "bottomless", "Bradbury", "bravado", "Brazilian", "breakaway", "Burlington", "businessman",
+	"butterfat", "Camelot", "candidate", "cannonball", "Capricorn", "caravan", "caretaker", "celebrate",
+	"cellulose", "certify", "chambermaid", "Cherokee", "Chicago", "clergyman", "coherence", "combustion",
+	"commando", "company", "component", "concurrent", "confidence", "conformist", "congregate", "consensus",
+	"consulting", "corporate", "corrosion", "councilman", "crossover", "crucifix", "cumbersome", "customer",
+	"Dakota", "decadence", "December", "decimal", "designing", "detector", "detergent", "determine",
+	"dictator", "dinosaur", "direction", "disable", "disbelief", "disruptive", "distortion", "document",
+	"embezzle", "enchanting", "enrollment", "enterprise", "equation", "equipment", "escapade", "Eskimo",
+	"everyday", "examine", "existence", "exodus", "fascinate", "filament", "finicky", "forever",
+	"fortitude", "frequency", "gadgetry", "Galveston", "getaway", "glossary", "gossamer", "graduate",
+	"gravity", "guitarist", "hamburger", "Hamilton", "handiwork", "hazardous", "headwaters", "hemisphere",
+	"hesitate", "hideaway", "holiness", "hurricane", "hydraulic", "impartial", "impetus", "inception",
+	"indigo", "inertia", "infancy", "inferno", "informant", "insincere", "insurgent", "integrate",
+	"intention", "inventive", "Istanbul", "Jamaica", "Jupiter", "leprosy", "letterhead", "liberty",
+	"maritime", "matchmaker", "maverick", "Medusa", "megaton", "microscope", "microwave", "midsummer",
+	"millionaire", "miracle", "misnomer", "molasses", "molecule", "Montana", "monument", "mosquito",
+	"narrative", "nebula", "newsletter", "Norwegian", "October", "Ohio", "onlooker", "opulent",
+	"Orlando", "outfielder", "Pacific", "pandemic", "Pandora", "paperweight", "paragon", "paragraph",
+	"paramount", "passenger", "pedigree", "Pegasus", "penetrate", "perceptive", "performance", "pharmacy",
+	"phonetic", "photograph", "pioneer", "pocketful", "politeness", "positive", "potato", "processor",
+	"provincial", "proximity", "puberty", "publisher", "pyramid", "quantity", "racketeer", "rebellion",
+	"recipe", "recover", "repellent", "replica", "reproduce", "resistor", "responsive", "retraction",
+	"retrieval", "retrospect", "revenue", "revival", "revolver", "sandalwood", "sardonic", "Saturday",
+	"savagery", "scavenger", "sensation", "sociable", "souvenir", "specialist", "speculate", "stethoscope",
+	"stupendous", "supportive", "surrender", "suspicious", "sympathy", "tambourine", "telephone", "therapist",
+	"tobacco", "tolerance", "tomorrow", "torpedo", "tradition", "travesty", "trombonist", "truncated",
+	"typewriter", "ultimate", "undaunted", "underfoot", "unicorn", "unify", "universe", "unravel",
+	"upcoming", "vacancy", "vagabond", "vertigo", "Virginia", "visitor", "vocalist", "voyager",
+	"warranty", "Waterloo", "whimsical", "Wichita", "Wilmington", "Wyoming", "yesteryear", "Yucatan",
+}
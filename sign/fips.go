@@ -0,0 +1,79 @@
+// fips.go -- FIPS mode: restrict the algorithms to the approved set
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// In FIPS mode only the approved algorithms are used: Ed25519 signatures,
+// SHA-2 checksums, AES-GCM and PBKDF2-HMAC-SHA256 for the passphrase of
+// new private keys. The X25519 key agreement used by encrypt and decrypt,
+// scrypt protected private keys and bcrypt protected OpenSSH keys are
+// refused.
+//
+// The mode can only be enabled if the primitives are provided by a
+// validated module: a binary built with GOEXPERIMENT=boringcrypto or the
+// Go FIPS 140 module (GODEBUG=fips140=on). It is on by default when such
+// a module is active.
+
+package sign
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+var fipsMode int32
+
+func init() {
+	if len(FIPSModule()) > 0 {
+		fipsMode = 1
+	}
+}
+
+// FIPSModule returns the name of the active FIPS validated crypto module
+// or the empty string if there is none.
+func FIPSModule() string {
+	switch {
+	case boringEnabled():
+		return "boringcrypto"
+	case fips140Enabled():
+		return "go-fips140"
+	}
+	return ""
+}
+
+// SetFIPSMode enables or disables FIPS mode. It is an error to enable it
+// without a validated crypto module.
+func SetFIPSMode(on bool) error {
+	if !on {
+		atomic.StoreInt32(&fipsMode, 0)
+		return nil
+	}
+
+	if len(FIPSModule()) == 0 {
+		return fmt.Errorf("fips: no validated crypto module; build with GOEXPERIMENT=boringcrypto or run with GODEBUG=fips140=on")
+	}
+	atomic.StoreInt32(&fipsMode, 1)
+	return nil
+}
+
+// FIPSMode returns true if the algorithms are restricted to the FIPS
+// approved set.
+func FIPSMode() bool {
+	return atomic.LoadInt32(&fipsMode) == 1
+}
+
+// return an error if 'alg' can't be used in FIPS mode
+func fipsRefuse(alg string) error {
+	if FIPSMode() {
+		return fmt.Errorf("fips: %s is not an approved algorithm", alg)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// fips140.go -- Go FIPS 140 module detection
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build go1.24
+// +build go1.24
+
+package sign
+
+import "crypto/fips140"
+
+func fips140Enabled() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,22 @@
+// fips140_old.go -- Go FIPS 140 module detection for older toolchains
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !go1.24
+// +build !go1.24
+
+package sign
+
+// the Go FIPS 140 module needs go1.24 or later
+func fips140Enabled() bool {
+	return false
+}
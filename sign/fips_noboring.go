@@ -0,0 +1,22 @@
+// fips_noboring.go -- FIPS module detection without boringcrypto
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package sign
+
+// the binary is not built with GOEXPERIMENT=boringcrypto
+func boringEnabled() bool {
+	return false
+}
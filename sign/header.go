@@ -0,0 +1,130 @@
+// header.go -- parse the header of encrypted files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"io"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// Header describes the header of an encrypted file
+type Header struct {
+	// Format version
+	Version int
+
+	// Encryption block size
+	ChunkSize uint32
+
+	// Cipher of the encrypted blocks (see aead.go)
+	Cipher string
+
+	// Chunk boundaries: "fixed" or "cdc" (see cdc.go)
+	Chunking string
+
+	// Per-file salt; nonces are derived from it
+	Salt []byte
+
+	// Ephemeral X25519 public key of the sender
+	EphemeralPK []byte
+
+	// Wrapped file keys; one per recipient
+	Recipients []WrappedKey
+
+	// X25519 keys of the recipients added by rewrap tokens
+	Rewrapped [][]byte
+
+	// Length of the header in bytes (including its checksum)
+	Size int
+
+	// SHA256 checksum of the header
+	Checksum []byte
+}
+
+// WrappedKey is the file key wrapped for one recipient
+type WrappedKey struct {
+	// Recipient scheme; empty for X25519 recipients
+	Type string
+
+	// Scheme specific data (e.g., a key id)
+	Args []byte
+
+	// Encrypted file key
+	Key []byte
+
+	// Fingerprint of an escrow key added by policy; empty otherwise
+	Escrow string
+}
+
+// ParseHeader reads and validates the header of an encrypted file from
+// 'rd'. Nothing is decrypted; 'rd' is left at the first encrypted chunk.
+func ParseHeader(rd io.Reader) (*Header, error) {
+	d, err := NewDecryptor(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	// the recipient section of a version 3 file follows the header
+	if d.hdrHash != nil {
+		err = d.readRecipients(func(i int, w *pb.WrappedKey) error {
+			d.Keys = append(d.Keys, w)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d.header(), nil
+}
+
+// DecryptedSize returns the size of the plaintext contained in an
+// encrypted file of 'size' bytes with this header
+func (h *Header) DecryptedSize(size int64) (int64, error) {
+	return decryptedSize(h.Size, h.ChunkSize, h.Chunking, size)
+}
+
+func (d *Decryptor) header() *Header {
+	h := &Header{
+		Version:     int(d.version),
+		ChunkSize:   d.ChunkSize,
+		Cipher:      d.Cipher,
+		Chunking:    d.Chunking,
+		Salt:        d.Salt,
+		EphemeralPK: d.Pk,
+		Recipients:  make([]WrappedKey, 0, len(d.Keys)),
+		Size:        d.hdrlen,
+		Checksum:    d.hdrsum,
+	}
+
+	if len(h.Cipher) == 0 {
+		h.Cipher = CipherAESGCM
+	}
+	if len(h.Chunking) == 0 {
+		h.Chunking = "fixed"
+	}
+
+	for _, r := range d.rewraps {
+		h.Rewrapped = append(h.Rewrapped, r.to)
+	}
+
+	for _, w := range d.Keys {
+		h.Recipients = append(h.Recipients, WrappedKey{
+			Type:   w.Type,
+			Args:   w.Args,
+			Key:    w.DKey,
+			Escrow: w.Escrow,
+		})
+	}
+	return h
+}
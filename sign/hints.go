@@ -0,0 +1,123 @@
+// hints.go -- recipient hints in wrapped keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A recipient finds its wrapped key by trying to unwrap each of them in
+// turn. With hints, the 'args' of an X25519 wrapped key hold
+//
+//    HKDF-SHA256(KEK, salt, "sigtool v2 recipient hint" || 0x00)[:8]
+//
+// where KEK is the key-wrapping key of the recipient, derived from
+// X25519(e, R) (see kdf.go); 'e' is the ephemeral key of the file, 'R'
+// the recipient's key and 'salt' the salt of the wrapped-key nonces. The
+// recipient computes its hint with one X25519 and unwraps only the slots
+// that carry it. Only the recipient can compute the hint and it differs
+// in every file; it doesn't tell anyone else who the recipients are.
+// Older versions ignore it.
+
+package sign
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+const (
+	_KdfRecipientHint = "sigtool v2 recipient hint"
+
+	_RecipientHintLen = 8
+
+	// the hint and its protobuf tag and length in a wrapped key
+	_RecipientHintOverhead = 2 + _RecipientHintLen
+)
+
+// EnableRecipientHints adds a hint to the keys wrapped for X25519
+// recipients so that each recipient can find its key without trying to
+// unwrap all of them. Each hint adds 10 bytes to the header.
+func (e *Encryptor) EnableRecipientHints() error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't enable hints after encryption has started")
+	}
+	if len(e.Keys) > 0 {
+		return fmt.Errorf("encrypt: hints must be enabled before adding recipients")
+	}
+
+	e.hints = true
+	return nil
+}
+
+// the hint of the recipient with the key-wrapping key 'kek'
+func recipientHint(kek, salt []byte) ([]byte, error) {
+	return hkdfKey(make([]byte, _RecipientHintLen), kek, salt, _KdfRecipientHint, "")
+}
+
+// true if the X25519 wrapped key 'w' has a hint
+func hasHint(w *pb.WrappedKey) bool {
+	return len(w.Type) == 0 && len(w.Args) > 0
+}
+
+// unwrap our key from the wrapped keys with hints: only the slots with
+// one of our hints are tried. The second return value is true if the
+// other slots with hints can be skipped.
+func (d *Decryptor) unwrapHinted(sk *PrivateKey) ([]byte, bool, error) {
+	if sk.ext != nil || sk.agent != nil {
+		return nil, false, nil
+	}
+
+	var hinted bool
+	for _, w := range d.Keys {
+		if hasHint(w) {
+			hinted = true
+			break
+		}
+	}
+	if !hinted {
+		return nil, false, nil
+	}
+
+	pk := sk.PublicKey()
+	salt := d.wrapSalt()
+	for _, ourSK := range sk.encryptionKeys() {
+		dkek, err := x25519(ourSK, d.Pk)
+		if err != nil {
+			return nil, false, fmt.Errorf("unwrap: %s", err)
+		}
+
+		kek, err := d.wrapKEK(dkek)
+		if err != nil {
+			return nil, false, err
+		}
+
+		hint, err := recipientHint(kek, salt)
+		if err != nil {
+			return nil, false, fmt.Errorf("unwrap: %s", err)
+		}
+
+		for i, w := range d.Keys {
+			if !hasHint(w) || !bytes.Equal(w.Args, hint) {
+				continue
+			}
+
+			key, err := d.unwrapShared(w, kek, pk)
+			if err != nil {
+				return nil, false, fmt.Errorf("can't unwrap key %d: %s", i, err)
+			}
+			if key != nil {
+				info(d.log, "decrypt: recipient matched by hint", "slot", i, "pkhash", fmt.Sprintf("%x", sk.pk.hash))
+				return key, true, nil
+			}
+		}
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,304 @@
+// http.go -- net/http middleware that encrypts and decrypts bodies
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// An HTTPConfig wraps an http.Handler (on the server) or an
+// http.RoundTripper (on the client) so that the bodies exchanged are
+// sigtool encrypted files; they are marked with
+//
+//    Content-Encoding: sigtool
+//
+// Bodies are encrypted and decrypted a chunk at a time as they are
+// written and read; neither end buffers the whole body.
+
+package sign
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPContentEncoding is the Content-Encoding of encrypted bodies
+const HTTPContentEncoding = "sigtool"
+
+// HTTPConfig holds the keys of one end of an HTTP exchange
+type HTTPConfig struct {
+	// Identity decrypts the bodies received; if set, it also
+	// authenticates the bodies sent.
+	Identity *PrivateKey
+
+	// Sender, if set, must have sent the bodies received; bodies that
+	// aren't encrypted are then refused.
+	Sender *PublicKey
+
+	// Recipients of the bodies sent; they are sent in the clear if
+	// there are none.
+	Recipients []*PublicKey
+
+	// ChunkSize of the bodies sent; the default if 0.
+	ChunkSize uint64
+}
+
+// Handler returns a handler that decrypts the bodies of requests for 'h'
+// and encrypts the bodies of its responses.
+func (c *HTTPConfig) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := c.decryptBody(r.Header, r.Body, r.ContentLength != 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if body != nil {
+			r.Body = body
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		}
+
+		if len(c.Recipients) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		en, err := c.encryptor()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		ew := &encResponseWriter{
+			ResponseWriter: w,
+			en:             en,
+			head:           r.Method == http.MethodHead,
+		}
+		h.ServeHTTP(ew, r)
+		if err := ew.finish(); err != nil {
+			// the status is already sent; drop the connection so that
+			// the client doesn't see a truncated body as complete
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// RoundTripper returns a round tripper that encrypts the bodies of
+// requests sent with 'rt' and decrypts the bodies of their responses.
+// 'rt' is http.DefaultTransport if nil. Encrypted requests can't be
+// retried or redirected with their body.
+func (c *HTTPConfig) RoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &encTransport{c, rt}
+}
+
+type encTransport struct {
+	c  *HTTPConfig
+	rt http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *encTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.c
+	if len(c.Recipients) > 0 && req.Body != nil && req.Body != http.NoBody {
+		en, err := c.encryptor()
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+
+		body := req.Body
+		pr, pw := io.Pipe()
+		go func() {
+			defer body.Close()
+
+			wr, err := en.NewStreamWriter(pw)
+			if err == nil {
+				if _, err = io.Copy(wr, body); err == nil {
+					err = wr.Close()
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+
+		req = req.Clone(req.Context())
+		req.Body = pr
+		req.GetBody = nil
+		req.ContentLength = -1
+		req.Header.Set("Content-Encoding", HTTPContentEncoding)
+		req.Header.Del("Content-Length")
+	}
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hasBody := req.Method != http.MethodHead && resp.ContentLength != 0
+	body, err := c.decryptBody(resp.Header, resp.Body, hasBody)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if body != nil {
+		resp.Body = body
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+	return resp, nil
+}
+
+// return a reader of the decrypted body 'rd' if it is encrypted; nil if
+// it isn't. 'hasBody' is false if there's no body to decrypt.
+func (c *HTTPConfig) decryptBody(hdr http.Header, rd io.ReadCloser, hasBody bool) (io.ReadCloser, error) {
+	if !httpEncrypted(hdr) {
+		if c.Sender != nil && hasBody {
+			return nil, fmt.Errorf("http: body isn't encrypted")
+		}
+		return nil, nil
+	}
+
+	if c.Identity == nil {
+		return nil, fmt.Errorf("http: no private key to decrypt the body")
+	}
+
+	d, err := NewDecryptor(rd)
+	if err != nil {
+		return nil, fmt.Errorf("http: %s", err)
+	}
+
+	if err = d.SetPrivateKey(c.Identity, c.Sender); err != nil {
+		return nil, fmt.Errorf("http: %s", err)
+	}
+
+	if c.Sender != nil && !d.AuthenticatedSender() {
+		return nil, fmt.Errorf("http: body isn't from the sender")
+	}
+
+	dr, err := d.NewStreamReader()
+	if err != nil {
+		return nil, fmt.Errorf("http: %s", err)
+	}
+
+	return &decBody{dr, rd}, nil
+}
+
+// return a new Encryptor to the recipients
+func (c *HTTPConfig) encryptor() (*Encryptor, error) {
+	en, err := NewEncryptor(c.Identity, c.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("http: %s", err)
+	}
+
+	for _, pk := range c.Recipients {
+		if err = en.AddRecipient(pk); err != nil {
+			return nil, fmt.Errorf("http: %s", err)
+		}
+	}
+	return en, nil
+}
+
+// true if the body with the headers 'hdr' is encrypted
+func httpEncrypted(hdr http.Header) bool {
+	for _, v := range hdr["Content-Encoding"] {
+		for _, e := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(e), HTTPContentEncoding) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the decrypted body; closing it closes the encrypted body
+type decBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decBody) Close() error {
+	return b.body.Close()
+}
+
+// encResponseWriter encrypts the body of a response as it is written
+type encResponseWriter struct {
+	http.ResponseWriter
+
+	en   *Encryptor
+	head bool
+
+	wroteHeader bool
+	wr          io.WriteCloser
+	err         error
+}
+
+// WriteHeader starts the encrypted body of responses that have one
+func (w *encResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	// informational responses precede the real one
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.wroteHeader = true
+	if w.head || code == http.StatusNoContent || code == http.StatusNotModified {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Encoding", HTTPContentEncoding)
+	w.ResponseWriter.WriteHeader(code)
+
+	w.wr, w.err = w.en.NewStreamWriter(NopWriteCloser(w.ResponseWriter))
+}
+
+// Write encrypts 'b' to the body
+func (w *encResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	switch {
+	case w.err != nil:
+		return 0, w.err
+	case w.wr == nil:
+		return w.ResponseWriter.Write(b)
+	}
+
+	n, err := w.wr.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// finish the encrypted body
+func (w *encResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.err != nil || w.wr == nil {
+		return w.err
+	}
+	return w.wr.Close()
+}
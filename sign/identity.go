@@ -0,0 +1,139 @@
+// identity.go -- pluggable identity schemes
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// This is the decrypt side of the recipient schemes in recipient.go. A
+// package that can unwrap file keys (a key agent, an HSM, a plugin ..)
+// registers an identity scheme with RegisterIdentityScheme();
+// ParseIdentity() then returns a PrivateKey for a URI "scheme://.." that
+// can be given to Decryptor.SetPrivateKey(). Such an identity is offered
+// every wrapped key of its scheme along with the scheme specific data
+// stored with it (e.g., a key id) as a hint. An identity that also
+// implements Signer (e.g., an Ed25519 key in an HSM) signs files.
+
+package sign
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Identity unwraps file keys wrapped for recipients of a registered scheme
+type Identity interface {
+	// Unwrap decrypts the wrapped key 'wrapped'; 'args' is the scheme
+	// specific data stored with it. It returns a nil key if 'wrapped'
+	// isn't meant for this identity.
+	Unwrap(wrapped []byte, args []byte) ([]byte, error)
+}
+
+// Signer is an Identity that makes Ed25519 signatures
+type Signer interface {
+	// SigningKey returns the Ed25519 public key of the identity; it is
+	// nil if the identity can't sign.
+	SigningKey() ([]byte, error)
+
+	// Sign returns the Ed25519 signature of the message 'm'
+	Sign(m []byte) ([]byte, error)
+}
+
+// IdentityScheme makes an Identity from the URI 'uri'
+type IdentityScheme func(uri string) (Identity, error)
+
+var identitySchemes = struct {
+	sync.Mutex
+	m map[string]IdentityScheme
+}{m: make(map[string]IdentityScheme)}
+
+// RegisterIdentityScheme registers the identity scheme 'scheme' (e.g.,
+// "kms"). It panics if the scheme is already registered.
+func RegisterIdentityScheme(scheme string, f IdentityScheme) {
+	if len(scheme) == 0 || strings.Contains(scheme, ":") || f == nil {
+		panic("sign: invalid identity scheme")
+	}
+
+	r := &identitySchemes
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.m[scheme]; ok {
+		panic(fmt.Sprintf("sign: identity scheme %q already registered", scheme))
+	}
+	r.m[scheme] = f
+}
+
+// IdentitySchemes returns the names of the registered identity schemes
+func IdentitySchemes() []string {
+	r := &identitySchemes
+	r.Lock()
+	defer r.Unlock()
+
+	v := make([]string, 0, len(r.m))
+	for k := range r.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// make a private key for the identity URI 'uri'
+func parseIdentityURI(uri string) (*PrivateKey, error) {
+	scheme, _ := uriScheme(uri)
+
+	r := &identitySchemes
+	r.Lock()
+	f, ok := r.m[scheme]
+	r.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("parse identity: unknown identity scheme %q", scheme)
+	}
+
+	ext, err := f(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parse identity: %s: %s", uri, err)
+	}
+
+	sk := &PrivateKey{
+		Usage:  UsageEncrypt,
+		scheme: scheme,
+		ext:    ext,
+		pk: &PublicKey{
+			Comment: uri,
+			Usage:   UsageEncrypt,
+			scheme:  scheme,
+			hash:    pkhash([]byte(uri)),
+		},
+	}
+
+	if s, ok := ext.(Signer); ok {
+		b, err := s.SigningKey()
+		if err != nil {
+			return nil, fmt.Errorf("parse identity: %s: %s", uri, err)
+		}
+
+		if b != nil {
+			pk, err := PublicKeyFromBytes(b)
+			if err != nil {
+				return nil, fmt.Errorf("parse identity: %s: %s", uri, err)
+			}
+
+			pk.Comment = uri
+			pk.Usage = UsageSign
+			sk.pk = pk
+			sk.Usage = UsageSign
+			sk.signer = s
+		}
+	}
+	return sk, nil
+}
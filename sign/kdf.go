@@ -0,0 +1,118 @@
+// kdf.go -- labels and contexts of derived keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Every key derived from the file key has its own label and the labels
+// carry the format version; a new format version gets new labels. In
+// version 2, the keys are derived with:
+//
+//    K = HKDF-SHA256(secret, salt, label || 0x00 || context)
+//
+// The key that wraps the file key for an X25519 recipient is derived from
+// the shared secret with the salt of the wrapped-key nonces; in version 1
+// it is the shared secret itself.
+//
+// The context is an optional string of the application (SetContext()); it
+// isn't stored in the file. Files encrypted with one context don't
+// decrypt with another, so two applications using this library can't
+// decrypt each other's files even with the same keys.
+
+package sign
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// labels of the keys derived in format version 2
+const (
+	_KdfDataKey    = "sigtool v2 data key"
+	_KdfSessionKey = "sigtool v2 session file key"
+	_KdfWrapKey    = "sigtool v2 wrap key"
+	_KdfLogKey     = "sigtool v2 log key"
+)
+
+// SetContext sets the application context mixed into the derivation of
+// the data encryption key. The decryptor must use the same context.
+func (e *Encryptor) SetContext(ctx string) error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't set the context after encryption has started")
+	}
+
+	e.context = ctx
+	e.session = nil
+
+	// the keys of the recipients added so far are wrapped with it
+	return e.rewrapKeys()
+}
+
+// SetContext sets the application context of the file; it must be the
+// context of the encryptor and it must be set before SetPrivateKey().
+func (d *Decryptor) SetContext(ctx string) error {
+	if d.ae != nil {
+		return fmt.Errorf("decrypt: can't set the context after SetPrivateKey()")
+	}
+
+	d.context = ctx
+	return nil
+}
+
+// derive the key of 'len(out)' bytes from 'secret' and 'salt' for
+// 'label' and 'ctx'
+func hkdfKey(out, secret, salt []byte, label, ctx string) ([]byte, error) {
+	info := make([]byte, 0, len(label)+1+len(ctx))
+	info = append(append(append(info, label...), 0), ctx...)
+
+	h := hkdf.New(sha256.New, secret, salt, info)
+	if _, err := io.ReadFull(h, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// the data encryption key of a file of format 'version' with the file key
+// 'key' and header checksum 'hdrsum'
+func dataKey(version uint8, key, hdrsum []byte, ctx string) ([]byte, error) {
+	if version == _Version1 {
+		// we mix the header checksum into the key
+		h := sha256.New()
+		h.Write([]byte(_EncryptNonce))
+		h.Write(key)
+		h.Write(hdrsum)
+		h.Write([]byte(ctx))
+		return h.Sum(nil), nil
+	}
+
+	return hkdfKey(make([]byte, 32), key, hdrsum, _KdfDataKey, ctx)
+}
+
+// the key-wrapping key of a file of format 'version' from the X25519
+// shared secret 'dkek' and the salt of the wrapped-key nonces
+func wrapKEK(version uint8, dkek, salt []byte, ctx string) ([]byte, error) {
+	if version == _Version1 {
+		return dkek, nil
+	}
+
+	return hkdfKey(make([]byte, 32), dkek, salt, _KdfWrapKey, ctx)
+}
+
+// the key-wrapping key of this file from the X25519 shared secret 'dkek'
+func (d *Decryptor) wrapKEK(dkek []byte) ([]byte, error) {
+	kek, err := wrapKEK(d.version, dkek, d.wrapSalt(), d.context)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap: %s", err)
+	}
+	return kek, nil
+}
@@ -0,0 +1,261 @@
+// keyring.go -- signed bundles of public keys and their aliases
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A keyring bundle carries the public keys of a team, each with a short
+// alias (e.g., "alice"), in one file signed by the key of whoever exported
+// it. The signature is over:
+//
+//    SHA512("sigtool keyring v1" || uint64_be(time) || entry...)
+//
+// where each entry is the alias and the fields of the serialized public
+// key (comment, pk, expires, usage, xpk, xsig, cert), each prefixed with
+// its uint16_be length.
+
+package sign
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const _KeyringPrefix = "sigtool keyring v1"
+
+// KeyringEntry is a public key and its alias
+type KeyringEntry struct {
+	Alias string
+	Key   *PublicKey
+}
+
+// Keyring is a bundle of public keys with unique aliases
+type Keyring struct {
+	Entries []*KeyringEntry
+
+	// Time the keyring was signed
+	Time time.Time
+
+	// Signature of the exporter; nil until Sign() is called
+	Signature *Signature
+}
+
+// serialized keyring entry
+type serializedKeyringEntry struct {
+	Alias string            `yaml:"alias"`
+	Key   *serializedPubKey `yaml:"key"`
+}
+
+// serialized keyring
+type serializedKeyring struct {
+	Comment   string                    `yaml:"comment,omitempty"`
+	Time      string                    `yaml:"time"`
+	Keys      []*serializedKeyringEntry `yaml:"keys"`
+	Signature *signature                `yaml:"signature"`
+}
+
+// aliases are used as file names; keep them simple
+var aliasRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@+-]{0,63}$`)
+
+// NewKeyring makes an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// Add the public key 'pk' with the alias 'alias' to the keyring
+func (k *Keyring) Add(alias string, pk *PublicKey) error {
+	if !aliasRe.MatchString(alias) {
+		return fmt.Errorf("keyring: invalid alias %q", alias)
+	}
+
+	if pk.Pk == nil {
+		return fmt.Errorf("keyring: %s: only Ed25519 keys can be added", alias)
+	}
+
+	if k.Lookup(alias) != nil {
+		return fmt.Errorf("keyring: duplicate alias %q", alias)
+	}
+
+	k.Entries = append(k.Entries, &KeyringEntry{alias, pk})
+	k.Signature = nil
+	return nil
+}
+
+// Lookup returns the public key with alias 'alias'; it is nil if there is
+// no such key
+func (k *Keyring) Lookup(alias string) *PublicKey {
+	for _, e := range k.Entries {
+		if e.Alias == alias {
+			return e.Key
+		}
+	}
+	return nil
+}
+
+// Sign the keyring with the exporter's private key
+func (k *Keyring) Sign(sk *PrivateKey) error {
+	if len(k.Entries) == 0 {
+		return fmt.Errorf("keyring: no keys")
+	}
+
+	k.Time = time.Now().UTC().Truncate(time.Second)
+	sig, err := sk.SignMessage(k.checksum(), "")
+	if err != nil {
+		return fmt.Errorf("keyring: %s", err)
+	}
+
+	k.Signature = sig
+	return nil
+}
+
+// Verify the signature of the keyring with the exporter's public key
+// 'pk'; a signature by a subkey of 'pk' is accepted.
+func (k *Keyring) Verify(pk *PublicKey) error {
+	if k.Signature == nil {
+		return fmt.Errorf("keyring: not signed")
+	}
+
+	sk := k.Signature.signingKey(pk)
+	if sk == nil {
+		return fmt.Errorf("keyring: not signed by %s", pk.Fingerprint())
+	}
+
+	if !sk.VerifyMessage(k.checksum(), k.Signature) {
+		return fmt.Errorf("keyring: signature verification failed")
+	}
+	return nil
+}
+
+// the message that is signed
+func (k *Keyring) checksum() []byte {
+	var t [8]byte
+
+	binary.BigEndian.PutUint64(t[:], uint64(k.Time.Unix()))
+
+	h := sha512.New()
+	h.Write([]byte(_KeyringPrefix))
+	h.Write(t[:])
+	for _, e := range k.Entries {
+		spk := e.Key.encode(e.Key.Comment)
+		for _, s := range []string{e.Alias, spk.Comment, spk.Pk, spk.Expires,
+			spk.Usage, spk.Xpk, spk.Xsig, spk.Cert} {
+			writeString(h, s)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// write the length prefixed string 's' to 'h'
+func writeString(h hash.Hash, s string) {
+	var n [2]byte
+
+	binary.BigEndian.PutUint16(n[:], uint16(len(s)))
+	h.Write(n[:])
+	h.Write([]byte(s))
+}
+
+// Serialize the keyring as YAML
+func (k *Keyring) Serialize(comment string) ([]byte, error) {
+	if k.Signature == nil {
+		return nil, fmt.Errorf("keyring: not signed")
+	}
+
+	sk := &serializedKeyring{
+		Comment:   comment,
+		Time:      k.Time.Format(time.RFC3339),
+		Keys:      make([]*serializedKeyringEntry, len(k.Entries)),
+		Signature: k.Signature.serialize(""),
+	}
+
+	for i, e := range k.Entries {
+		sk.Keys[i] = &serializedKeyringEntry{
+			Alias: e.Alias,
+			Key:   e.Key.encode(e.Key.Comment),
+		}
+	}
+
+	out, err := yaml.Marshal(sk)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: can't marshal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// SerializeFile writes the keyring to file 'fn'
+func (k *Keyring) SerializeFile(fn, comment string) error {
+	b, err := k.Serialize(comment)
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b, 0644)
+}
+
+// ReadKeyring reads a keyring bundle from file 'fn'; the caller must
+// Verify() it with the exporter's public key before using its keys.
+func ReadKeyring(fn string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return MakeKeyring(b)
+}
+
+// MakeKeyring parses a serialized keyring bundle
+func MakeKeyring(b []byte) (*Keyring, error) {
+	var sk serializedKeyring
+
+	if err := yaml.Unmarshal(b, &sk); err != nil {
+		return nil, fmt.Errorf("keyring: can't parse YAML: %s", err)
+	}
+
+	if sk.Signature == nil {
+		return nil, fmt.Errorf("keyring: not signed")
+	}
+
+	t, err := time.Parse(time.RFC3339, sk.Time)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: invalid time %q", sk.Time)
+	}
+
+	k := &Keyring{
+		Time: t,
+	}
+
+	for _, e := range sk.Keys {
+		if e == nil || e.Key == nil {
+			return nil, fmt.Errorf("keyring: malformed entry")
+		}
+
+		pk, err := e.Key.decode()
+		if err != nil {
+			return nil, fmt.Errorf("keyring: %s: %s", e.Alias, err)
+		}
+
+		if err = k.Add(e.Alias, pk); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(k.Entries) == 0 {
+		return nil, fmt.Errorf("keyring: no keys")
+	}
+
+	if k.Signature, err = sk.Signature.decode(); err != nil {
+		return nil, fmt.Errorf("keyring: %s", err)
+	}
+	return k, nil
+}
@@ -19,6 +19,7 @@ package sign
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -30,23 +31,38 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"os"
+	"time"
 
 	Ed "crypto/ed25519"
+	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/scrypt"
 	"gopkg.in/yaml.v2"
-
-	"github.com/opencoff/go-utils"
 )
 
 // Private Ed25519 key
 type PrivateKey struct {
 	Sk []byte
 
+	// Operations this key may be used for
+	Usage KeyUsage
+
 	// Encryption key: Curve25519 point corresponding to this Ed25519 key
 	ck []byte
 
+	// Native X25519 encryption key; nil for older keys
+	xsk []byte
+
+	// Identity of a registered scheme; nil for X25519 keys
+	scheme string
+	ext    Identity
+
+	// Agent holding the private key; nil for local keys
+	agent *AgentClient
+
+	// Identity of a registered scheme that signs; nil otherwise
+	signer Signer
+
 	// Cached copy of the public key
 	pk *PublicKey
 }
@@ -58,9 +74,27 @@ type PublicKey struct {
 	// Comment string
 	Comment string
 
+	// Expiration time of the key; zero if the key doesn't expire
+	Expires time.Time
+
+	// Operations this key may be used for
+	Usage KeyUsage
+
 	// Curve25519 point corresponding to this Ed25519 key
 	ck []byte
 
+	// Native X25519 encryption key and its certification by the
+	// Ed25519 key; nil for older keys
+	xpk  []byte
+	xsig []byte
+
+	// Recipient of a registered scheme; nil for X25519 recipients
+	scheme string
+	ext    Recipient
+
+	// Certificate by the master key; nil unless this is a subkey
+	cert *SubkeyCert
+
 	hash []byte
 }
 
@@ -79,9 +113,13 @@ const (
 	_r int = 8
 	_p int = 1
 
+	// PBKDF2 iterations for private keys written in FIPS mode
+	_PBKDF2Iter int = 600000
+
 	// Algorithm used in the encrypted private key
-	sk_algo  = "scrypt-sha256"
-	sig_algo = "sha512-ed25519"
+	sk_algo        = "scrypt-sha256"
+	sk_algo_pbkdf2 = "pbkdf2-sha256"
+	sig_algo       = "sha512-ed25519"
 )
 
 // Encrypted Private key
@@ -89,19 +127,29 @@ type serializedPrivKey struct {
 	Comment string `yaml:"comment,omitempty"`
 
 	// Encrypted Sk
-	Esk  string `yaml:"esk"`
+	Esk string `yaml:"esk"`
+
+	// Encrypted native X25519 key
+	Exsk string `yaml:"exsk,omitempty"`
+
 	Salt string `yaml:"salt,omitempty"`
 
 	// Algorithm used for checksum and KDF
 	Algo string `yaml:"algo,omitempty"`
 
 	// These are params for scrypt.Key()
-	// CPU Cost parameter; must be a power of 2
+	// CPU Cost parameter; must be a power of 2.
+	// For pbkdf2-sha256, this is the iteration count.
 	N int `yaml:"Z,flow,omitempty"`
 
 	// r * p should be less than 2^30
 	R int `yaml:"r,flow,omitempty"`
 	P int `yaml:"p,flow,omitempty"`
+
+	Usage string `yaml:"usage,omitempty"`
+
+	// Subkey certificate
+	Cert string `yaml:"cert,omitempty"`
 }
 
 // serialized representation of public key
@@ -109,13 +157,29 @@ type serializedPubKey struct {
 	Comment string `yaml:"comment,omitempty"`
 	Pk      string `yaml:"pk"`
 	Hash    string `yaml:"hash"`
+	Expires string `yaml:"expires,omitempty"`
+	Usage   string `yaml:"usage,omitempty"`
+	Xpk     string `yaml:"xpk,omitempty"`
+	Xsig    string `yaml:"xsig,omitempty"`
+	Cert    string `yaml:"cert,omitempty"`
 }
 
 // Serialized signature
 type signature struct {
-	Comment   string `yaml:"comment,omitempty"`
-	Pkhash    string `yaml:"pkhash,omitempty"`
-	Signature string `yaml:"signature"`
+	Comment   string           `yaml:"comment,omitempty" json:"comment,omitempty"`
+	Pkhash    string           `yaml:"pkhash,omitempty" json:"pkhash"`
+	Pk        string           `yaml:"pk,omitempty" json:"pk,omitempty"`
+	Cert      string           `yaml:"cert,omitempty" json:"cert,omitempty"`
+	Signature string           `yaml:"signature" json:"signature"`
+	Attrs     *serializedAttrs `yaml:"attrs,omitempty" json:"attrs,omitempty"`
+
+	Roughtime *serializedRoughtime `yaml:"roughtime,omitempty" json:"roughtime,omitempty"`
+}
+
+// Serialized set of signatures made by different keys
+type signatureSet struct {
+	Comment    string      `yaml:"comment,omitempty"`
+	Signatures []signature `yaml:"signatures"`
 }
 
 func pkhash(pk []byte) []byte {
@@ -140,6 +204,14 @@ func NewKeypair() (*Keypair, error) {
 	sk.Sk = []byte(s)
 	pk.hash = pkhash(pk.Pk)
 
+	// X25519 is not FIPS approved; such keys use the Ed25519 derived
+	// encryption key and can't be used for encryption in FIPS mode.
+	if !FIPSMode() {
+		if err := sk.newEncryptionKey(); err != nil {
+			return nil, err
+		}
+	}
+
 	return kp, nil
 }
 
@@ -147,8 +219,12 @@ func NewKeypair() (*Keypair, error) {
 // file is 'bn'; the public key goes in $bn.pub and the private key
 // goes in $bn.key.
 // If password is non-empty, then the private key is encrypted
-// before writing to disk.
+// before writing to disk. If getpw is nil, the default prompter is asked
+// for the password.
 func (kp *Keypair) Serialize(bn, comment string, getpw func() ([]byte, error)) error {
+	if getpw == nil {
+		getpw = promptFunc(nil, bn+".key", true)
+	}
 
 	sk := &kp.Sec
 	pk := &kp.Pub
@@ -170,21 +246,51 @@ func (kp *Keypair) Serialize(bn, comment string, getpw func() ([]byte, error)) e
 }
 
 // Read the private key in 'fn', optionally decrypting it using
-// password 'pw' and create new instance of PrivateKey
+// password 'pw' and create new instance of PrivateKey. If getpw is nil,
+// the default prompter is asked for the password.
 func ReadPrivateKey(fn string, getpw func() ([]byte, error)) (*PrivateKey, error) {
+	if getpw == nil {
+		getpw = promptFunc(nil, fn, false)
+	}
+
+	if err := checkKeyPerms(fn); err != nil {
+		return nil, err
+	}
+
 	yml, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return nil, err
 	}
 
 	if bytes.Index(yml, []byte("OPENSSH PRIVATE KEY-")) > 0 {
-		return parseSSHPrivateKey(yml, getpw)
+		sk, err := parseSSHPrivateKey(yml, getpw)
+		if err == nil {
+			info(nil, "keys: loaded private key", "file", fn, "format", "openssh", "pkhash", fmt.Sprintf("%x", sk.pk.hash))
+		}
+		return sk, err
+	}
+
+	// don't ask for a passphrase of something that isn't a private key
+	format := "sigtool"
+	if isPEMKey(yml) {
+		format = "pem"
+		if err := checkPEMPrivateKey(yml); err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+	} else if err := validatePrivateKey(yml); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
 	}
 
-	if pw, err := getpw(); err == nil {
-		return MakePrivateKey(yml, pw)
+	pw, err := getpw()
+	if err != nil {
+		return nil, err
+	}
+
+	sk, err := MakePrivateKey(yml, pw)
+	if err == nil {
+		info(nil, "keys: loaded private key", "file", fn, "format", format, "pkhash", fmt.Sprintf("%x", sk.pk.hash))
 	}
-	return nil, err
+	return sk, err
 }
 
 // Make a private key from bytes 'yml' and password 'pw'. The bytes
@@ -192,15 +298,23 @@ func ReadPrivateKey(fn string, getpw func() ([]byte, error)) (*PrivateKey, error
 func MakePrivateKey(yml []byte, pw []byte) (*PrivateKey, error) {
 	var ssk serializedPrivKey
 
+	if isPEMKey(yml) {
+		return makePEMPrivateKey(yml, pw)
+	}
+
+	if err := validatePrivateKey(yml); err != nil {
+		return nil, fmt.Errorf("make priv key: %s", err)
+	}
+
 	err := yaml.Unmarshal(yml, &ssk)
 	if err != nil {
 		return nil, fmt.Errorf("make priv key: can't parse YAML: %s", err)
 	}
+	return ssk.decode(pw)
+}
 
-	if len(ssk.Salt) == 0 || len(ssk.Esk) == 0 {
-		return nil, fmt.Errorf("sign: not YAML private key")
-	}
-
+// decrypt a serialized private key with the passphrase 'pw'
+func (ssk *serializedPrivKey) decode(pw []byte) (*PrivateKey, error) {
 	b64 := base64.StdEncoding.DecodeString
 
 	salt, err := b64(ssk.Salt)
@@ -213,11 +327,7 @@ func MakePrivateKey(yml []byte, pw []byte) (*PrivateKey, error) {
 		return nil, fmt.Errorf("make priv key: can't decode key: %s", err)
 	}
 
-	// We take short passwords and extend them
-	pwb := sha512.Sum512(pw)
-
-	// "32" == Length of AES-256 key
-	key, err := scrypt.Key(pwb[:], salt, ssk.N, ssk.R, ssk.P, 32)
+	key, err := deriveKey(ssk.Algo, pw, salt, ssk.N, ssk.R, ssk.P)
 	if err != nil {
 		return nil, fmt.Errorf("make priv key: can't derive key: %s", err)
 	}
@@ -232,12 +342,51 @@ func MakePrivateKey(yml []byte, pw []byte) (*PrivateKey, error) {
 		return nil, fmt.Errorf("make priv key: aes failure: %s", err)
 	}
 
+	usage, err := ParseKeyUsage(ssk.Usage)
+	if err != nil {
+		return nil, fmt.Errorf("make priv key: %s", err)
+	}
+
 	skb, err := ae.Open(nil, salt[:ae.NonceSize()], esk, nil)
 	if err != nil {
 		return nil, fmt.Errorf("make priv key: wrong password")
 	}
 
-	return PrivateKeyFromBytes(skb)
+	sk, err := PrivateKeyFromBytes(skb)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ssk.Exsk) > 0 {
+		exsk, err := b64(ssk.Exsk)
+		if err != nil {
+			return nil, fmt.Errorf("make priv key: can't decode X25519 key: %s", err)
+		}
+
+		xsk, err := ae.Open(nil, xkeyNonce(salt, ae.NonceSize()), exsk, nil)
+		if err != nil {
+			return nil, fmt.Errorf("make priv key: wrong password")
+		}
+
+		if err = sk.setEncryptionKey(xsk, nil); err != nil {
+			return nil, fmt.Errorf("make priv key: %s", err)
+		}
+	}
+
+	if len(ssk.Cert) > 0 {
+		cert, err := b64(ssk.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("make priv key: can't decode subkey certificate: %s", err)
+		}
+
+		if err = sk.pk.decodeCert(cert); err != nil {
+			return nil, fmt.Errorf("make priv key: %s", err)
+		}
+	}
+
+	sk.Usage = usage
+	sk.pk.Usage = usage
+	return sk, nil
 }
 
 // Make a private key from 64-bytes of extended Ed25519 key
@@ -269,6 +418,40 @@ func (sk *PrivateKey) PublicKey() *PublicKey {
 	return sk.pk
 }
 
+// true if 'sk' can make Ed25519 signatures (itself, through an agent or
+// a registered scheme)
+func (sk *PrivateKey) canSign() bool {
+	return sk.Sk != nil || sk.signer != nil || (sk.agent != nil && sk.pk.Pk != nil)
+}
+
+// sign the message 'm' with the Ed25519 key of 'sk'
+func (sk *PrivateKey) ed25519Sign(m []byte) ([]byte, error) {
+	if sk.agent != nil {
+		return sk.agent.sign(sk.pk, m)
+	}
+
+	if sk.signer != nil {
+		sig, err := sk.signer.Sign(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", sk.scheme, err)
+		}
+		return sig, nil
+	}
+
+	if sk.Sk == nil {
+		return nil, fmt.Errorf("private key %x has no Ed25519 signing key", sk.pk.hash)
+	}
+
+	x := Ed.PrivateKey(sk.Sk)
+	return x.Sign(nil, m, crypto.Hash(0))
+}
+
+// nonce for encrypting the native X25519 key in the private key file;
+// it is distinct from the nonce used for the Ed25519 key.
+func xkeyNonce(salt []byte, n int) []byte {
+	return salt[len(salt)-n:]
+}
+
 // Convert an Ed25519 Private Key to Curve25519 Private key
 func (sk *PrivateKey) toCurve25519SK() []byte {
 	if sk.ck == nil {
@@ -284,44 +467,20 @@ func (sk *PrivateKey) toCurve25519SK() []byte {
 	return sk.ck
 }
 
-// from github.com/FiloSottile/age
-var curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
-
 // Convert an Ed25519 Public Key to Curve25519 public key
-// from github.com/FiloSottile/age
-func (pk *PublicKey) toCurve25519PK() []byte {
-	if pk.ck != nil {
-		return pk.ck
-	}
-
-	// ed25519.PublicKey is a little endian representation of the y-coordinate,
-	// with the most significant bit set based on the sign of the x-ccordinate.
-	bigEndianY := make([]byte, Ed.PublicKeySize)
-	for i, b := range pk.Pk {
-		bigEndianY[Ed.PublicKeySize-i-1] = b
+func (pk *PublicKey) toCurve25519PK() ([]byte, error) {
+	if pk.xpk != nil {
+		return pk.xpk, nil
 	}
-	bigEndianY[0] &= 0b0111_1111
 
-	// The Montgomery u-coordinate is derived through the bilinear map
-	//
-	//     u = (1 + y) / (1 - y)
-	//
-	// See https://blog.filippo.io/using-ed25519-keys-for-encryption.
-	y := new(big.Int).SetBytes(bigEndianY)
-	denom := big.NewInt(1)
-	denom.ModInverse(denom.Sub(denom, y), curve25519P) // 1 / (1 - y)
-	u := y.Mul(y.Add(y, big.NewInt(1)), denom)
-	u.Mod(u, curve25519P)
-
-	out := make([]byte, 32)
-	uBytes := u.Bytes()
-	n := len(uBytes)
-	for i, b := range uBytes {
-		out[n-i-1] = b
+	if pk.ck == nil {
+		ck, err := edToX25519(pk.Pk)
+		if err != nil {
+			return nil, err
+		}
+		pk.ck = ck
 	}
-
-	pk.ck = out
-	return out
+	return pk.ck, nil
 }
 
 // Public Key Hash
@@ -329,36 +488,93 @@ func (pk *PublicKey) Hash() []byte {
 	return pk.hash
 }
 
+// derive the AES-256 key protecting a private key from the passphrase 'pw'
+// with the KDF 'algo'; keys without an algo use scrypt.
+func deriveKey(algo string, pw, salt []byte, n, r, p int) ([]byte, error) {
+	// We take short passwords and extend them
+	pass := sha512.Sum512(pw)
+
+	// "32" == Length of AES-256 key
+	switch algo {
+	case "", sk_algo:
+		if err := fipsRefuse("scrypt"); err != nil {
+			return nil, err
+		}
+		return scrypt.Key(pass[:], salt, n, r, p, 32)
+
+	case sk_algo_pbkdf2:
+		if n < 1 {
+			return nil, fmt.Errorf("invalid pbkdf2 iterations %d", n)
+		}
+		return pbkdf2.Key(pass[:], salt, n, 32, sha256.New), nil
+	}
+	return nil, fmt.Errorf("unknown KDF %q", algo)
+}
+
 // Serialize the private key to a file
-// AEAD encryption for protecting the private key
-// Format: YAML
-// All []byte are in base64 (RawEncoding)
 func (sk *PrivateKey) serialize(fn, comment string, getpw func() ([]byte, error)) error {
 	pw, err := getpw()
 	if err != nil {
 		return err
 	}
 
-	// expand the password into 64 bytes
-	pass := sha512.Sum512(pw)
+	out, err := sk.Marshal(comment, pw)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(fn, out, 0600)
+}
+
+// Marshal returns the private key in the YAML format of private key
+// files; it is encrypted with a key derived from the passphrase 'pw'.
+// All []byte are in base64 (StdEncoding).
+func (sk *PrivateKey) Marshal(comment string, pw []byte) ([]byte, error) {
+	ssk, err := sk.encode(comment, pw)
+	if err != nil {
+		return nil, err
+	}
+
+	// We won't protect the Scrypt parameters with the hash above
+	// because it is not needed. If the parameters are wrong, the
+	// derived key will be wrong and thus, the hash will not match.
+
+	out, err := yaml.Marshal(ssk)
+	if err != nil {
+		return nil, fmt.Errorf("can't marahal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// encrypt the private key for serialization
+func (sk *PrivateKey) encode(comment string, pw []byte) (*serializedPrivKey, error) {
+	if sk.Sk == nil {
+		return nil, fmt.Errorf("marshal: private key %x can't be marshaled", sk.pk.hash)
+	}
+
 	salt := make([]byte, 32)
 
 	randRead(salt)
 
-	// "32" == Length of AES-256 key
-	key, err := scrypt.Key(pass[:], salt, _N, _r, _p, 32)
+	// FIPS mode uses the approved PBKDF2 instead of scrypt
+	algo, n, r, p := sk_algo, _N, _r, _p
+	if FIPSMode() {
+		algo, n, r, p = sk_algo_pbkdf2, _PBKDF2Iter, 0, 0
+	}
+
+	key, err := deriveKey(algo, pw, salt, n, r, p)
 	if err != nil {
-		return fmt.Errorf("marshal: can't derive scrypt key: %s", err)
+		return nil, fmt.Errorf("marshal: can't derive key: %s", err)
 	}
 
 	aes, err := aes.NewCipher(key)
 	if err != nil {
-		return fmt.Errorf("marshal: %s", err)
+		return nil, fmt.Errorf("marshal: %s", err)
 	}
 
 	ae, err := cipher.NewGCM(aes)
 	if err != nil {
-		return fmt.Errorf("marshal: %s", err)
+		return nil, fmt.Errorf("marshal: %s", err)
 	}
 
 	tl := ae.Overhead()
@@ -367,26 +583,27 @@ func (sk *PrivateKey) serialize(fn, comment string, getpw func() ([]byte, error)
 
 	enc := base64.StdEncoding.EncodeToString
 
-	ssk := serializedPrivKey{
+	var exsk string
+	if sk.xsk != nil {
+		exsk = enc(ae.Seal(nil, xkeyNonce(salt, ae.NonceSize()), sk.xsk, nil))
+	}
+
+	ssk := &serializedPrivKey{
 		Comment: comment,
 		Esk:     enc(esk),
+		Exsk:    exsk,
 		Salt:    enc(salt),
-		Algo:    sk_algo,
-		N:       _N,
-		R:       _r,
-		P:       _p,
+		Algo:    algo,
+		N:       n,
+		R:       r,
+		P:       p,
+		Usage:   sk.Usage.String(),
 	}
 
-	// We won't protect the Scrypt parameters with the hash above
-	// because it is not needed. If the parameters are wrong, the
-	// derived key will be wrong and thus, the hash will not match.
-
-	out, err := yaml.Marshal(&ssk)
-	if err != nil {
-		return fmt.Errorf("can't marahal to YAML: %s", err)
+	if sk.pk.cert != nil {
+		ssk.Cert = enc(sk.pk.cert.marshal(true))
 	}
-
-	return writeFile(fn, out, 0600)
+	return ssk, nil
 }
 
 //  --- Public Key Methods ---
@@ -401,23 +618,50 @@ func ReadPublicKey(fn string) (*PublicKey, error) {
 		return nil, err
 	}
 
-	// first try to parse as a ssh key
-	pk, err := parseSSHPublicKey(yml)
-	if err != nil {
+	// first try to parse as a signify or ssh key
+	var pk *PublicKey
+	format := "openssh"
+	if IsSignify(yml) {
+		format = "signify"
+		pk, err = parseSignifyPublicKey(yml)
+	} else if pk, err = parseSSHPublicKey(yml); err != nil {
+		format = "sigtool"
+		if isPEMKey(yml) {
+			format = "pem"
+		}
 		pk, err = MakePublicKey(yml)
 	}
-	return pk, err
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+
+	info(nil, "keys: loaded public key", "file", fn, "format", format, "pkhash", fmt.Sprintf("%x", pk.hash))
+	return pk, nil
 }
 
 // Parse a serialized public in 'yml' and return the resulting
 // public key instance
 func MakePublicKey(yml []byte) (*PublicKey, error) {
 	var spk serializedPubKey
-	var err error
 
-	if err = yaml.Unmarshal(yml, &spk); err != nil {
+	if isPEMKey(yml) {
+		return makePEMPublicKey(yml)
+	}
+
+	if err := validatePublicKey(yml); err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(yml, &spk); err != nil {
 		return nil, fmt.Errorf("can't parse YAML: %s", err)
 	}
+	return spk.decode()
+}
+
+// decode a serialized public key
+func (spk *serializedPubKey) decode() (*PublicKey, error) {
+	var err error
 
 	if len(spk.Pk) == 0 {
 		return nil, fmt.Errorf("sign: not a YAML public key")
@@ -430,11 +674,50 @@ func MakePublicKey(yml []byte) (*PublicKey, error) {
 		return nil, fmt.Errorf("can't decode YAML:Pk: %s", err)
 	}
 
-	if pk, err := PublicKeyFromBytes(pkb); err == nil {
-		pk.Comment = spk.Comment
-		return pk, nil
+	pk, err := PublicKeyFromBytes(pkb)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(spk.Expires) > 0 {
+		if pk.Expires, err = time.Parse(time.RFC3339, spk.Expires); err != nil {
+			return nil, fmt.Errorf("can't parse YAML:Expires <%s>: %s", spk.Expires, err)
+		}
+	}
+
+	if pk.Usage, err = ParseKeyUsage(spk.Usage); err != nil {
+		return nil, err
+	}
+
+	if len(spk.Xpk) > 0 {
+		xpk, err := b64(spk.Xpk)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode YAML:Xpk: %s", err)
+		}
+
+		xsig, err := b64(spk.Xsig)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode YAML:Xsig: %s", err)
+		}
+
+		if err = pk.setEncryptionKey(xpk, xsig); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(spk.Cert) > 0 {
+		cert, err := b64(spk.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode YAML:Cert: %s", err)
+		}
+
+		if err = pk.decodeCert(cert); err != nil {
+			return nil, err
+		}
 	}
-	return nil, err
+
+	pk.Comment = spk.Comment
+	return pk, nil
 }
 
 // Make a public key from a byte string
@@ -452,21 +735,53 @@ func PublicKeyFromBytes(b []byte) (*PublicKey, error) {
 	return pk, nil
 }
 
+// Serialize the public key to file 'fn'
+func (pk *PublicKey) Serialize(fn, comment string) error {
+	return pk.serialize(fn, comment)
+}
+
 // Serialize Public Keys
 func (pk *PublicKey) serialize(fn, comment string) error {
+	out, err := pk.Marshal(comment)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(fn, out, 0644)
+}
+
+// Marshal returns the public key in the YAML format of public key files
+func (pk *PublicKey) Marshal(comment string) ([]byte, error) {
+	out, err := yaml.Marshal(pk.encode(comment))
+	if err != nil {
+		return nil, fmt.Errorf("can't marahal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// encode the public key for serialization
+func (pk *PublicKey) encode(comment string) *serializedPubKey {
 	b64 := base64.StdEncoding.EncodeToString
 	spk := &serializedPubKey{
 		Comment: comment,
 		Pk:      b64(pk.Pk),
 		Hash:    b64(pk.hash),
+		Usage:   pk.Usage.String(),
 	}
 
-	out, err := yaml.Marshal(spk)
-	if err != nil {
-		return fmt.Errorf("can't marahal to YAML: %s", err)
+	if pk.xpk != nil {
+		spk.Xpk = b64(pk.xpk)
+		spk.Xsig = b64(pk.xsig)
 	}
 
-	return writeFile(fn, out, 0644)
+	if pk.cert != nil {
+		spk.Cert = b64(pk.cert.marshal(true))
+	}
+
+	if !pk.Expires.IsZero() {
+		spk.Expires = pk.Expires.UTC().Format(time.RFC3339)
+	}
+	return spk
 }
 
 // -- Internal Utility Functions --
@@ -509,26 +824,48 @@ func writeFile(fn string, b []byte, mode uint32) error {
 	return nil
 }
 
-// Generate file checksum out of hash function h
-func fileCksum(fn string, h hash.Hash) ([]byte, error) {
+// Generate file checksum out of hash function h; return the checksum
+// and the file size
+func fileCksum(fn string, h hash.Hash) ([]byte, int64, error) {
 
 	fd, err := os.Open(fn)
 	if err != nil {
-		return nil, fmt.Errorf("can't open %s: %s", fn, err)
+		return nil, 0, fmt.Errorf("can't open %s: %s", fn, err)
 	}
 
 	defer fd.Close()
 
-	sz, err := utils.MmapReader(fd, 0, 0, h)
+	sz, err := mmapReader(fd, 0, 0, h)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	var b [8]byte
 	binary.BigEndian.PutUint64(b[:], uint64(sz))
 	h.Write(b[:])
 
-	return h.Sum(nil), nil
+	return h.Sum(nil), sz, nil
+}
+
+// write 'sz' bytes of the stream 'rd' after the first 'off' bytes (all of
+// it if 'sz' is 0) to 'wr'; it returns the number of bytes written
+func streamReader(rd io.Reader, off, sz int64, wr io.Writer) (int64, error) {
+	if off > 0 {
+		if _, err := io.CopyN(ioutil.Discard, rd, off); err != nil {
+			return 0, fmt.Errorf("can't read offset %v: %s", off, err)
+		}
+	}
+
+	if sz == 0 {
+		return io.Copy(wr, rd)
+	}
+
+	// like mmapReader(), a short stream isn't an error
+	n, err := io.CopyN(wr, rd, sz)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
 }
 
 func clamp(k []byte) []byte {
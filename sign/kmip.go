@@ -0,0 +1,502 @@
+// kmip.go -- keys held by a KMIP server
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The "kmip" recipient and identity schemes use keys held by a KMIP server
+// (often in front of HSMs); the keys never leave the server:
+//
+//    kmip://host[:port]/UID           AES key that wraps and unwraps file
+//                                     keys (Encrypt and Decrypt with
+//                                     AES-GCM)
+//    kmip://host[:port]/UID?pub=PUB   Ed25519 private key that signs (Sign);
+//                                     PUB is the UID of its public key
+//
+// The client authenticates with the TLS certificate and key in the files
+// $SIGTOOL_KMIP_CERT and $SIGTOOL_KMIP_KEY; the server certificate is
+// verified with the CA certificates in $SIGTOOL_KMIP_CA (or the system
+// roots). Requests use KMIP 1.4 TTLV encoding.
+
+package sign
+
+import (
+	"bytes"
+	Ed "crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// default KMIP port
+const _KMIPPort = "5696"
+
+// timeout of a KMIP request
+const _KMIPTimeout = 60 * time.Second
+
+// largest KMIP message accepted
+const _KMIPMaxMessage = 1048576
+
+// KMIP tags
+const (
+	kmipAuthTag          uint32 = 0x4200FF
+	kmipBatchCount       uint32 = 0x42000D
+	kmipBatchItem        uint32 = 0x42000F
+	kmipBlockCipherMode  uint32 = 0x420011
+	kmipCryptoParams     uint32 = 0x42002B
+	kmipData             uint32 = 0x4200C2
+	kmipIVCounterNonce   uint32 = 0x42003D
+	kmipKeyFormatType    uint32 = 0x420042
+	kmipKeyMaterial      uint32 = 0x420043
+	kmipOperation        uint32 = 0x42005C
+	kmipProtocolVersion  uint32 = 0x420069
+	kmipProtocolMajor    uint32 = 0x42006A
+	kmipProtocolMinor    uint32 = 0x42006B
+	kmipRandomIV         uint32 = 0x4200C5
+	kmipRequestHeader    uint32 = 0x420077
+	kmipRequestMessage   uint32 = 0x420078
+	kmipRequestPayload   uint32 = 0x420079
+	kmipResponseMessage  uint32 = 0x42007B
+	kmipResponsePayload  uint32 = 0x42007C
+	kmipResultMessage    uint32 = 0x420080
+	kmipResultReason     uint32 = 0x42007E
+	kmipResultStatus     uint32 = 0x42007F
+	kmipSignatureData    uint32 = 0x4200C3
+	kmipTagLength        uint32 = 0x4200C7
+	kmipUniqueIdentifier uint32 = 0x420094
+)
+
+// KMIP operations
+const (
+	kmipOpGet     uint32 = 0x0A
+	kmipOpEncrypt uint32 = 0x1F
+	kmipOpDecrypt uint32 = 0x20
+	kmipOpSign    uint32 = 0x21
+)
+
+// KMIP item types
+const (
+	kmipTypeStructure   byte = 0x01
+	kmipTypeInteger     byte = 0x02
+	kmipTypeEnumeration byte = 0x05
+	kmipTypeBoolean     byte = 0x06
+	kmipTypeTextString  byte = 0x07
+	kmipTypeByteString  byte = 0x08
+)
+
+// KMIP enumerations and parameters
+const (
+	kmipKeyFormatRaw  uint32 = 0x01
+	kmipModeGCM       uint32 = 0x09
+	kmipStatusSuccess uint32 = 0x00
+	kmipGCMTagSize    uint32 = 16
+	kmipVersionMajor  uint32 = 1
+	kmipVersionMinor  uint32 = 4
+)
+
+func init() {
+	RegisterRecipientScheme("kmip", func(uri string) (Recipient, error) {
+		return parseKMIPKey(uri)
+	})
+	RegisterIdentityScheme("kmip", func(uri string) (Identity, error) {
+		return parseKMIPKey(uri)
+	})
+}
+
+// a decoded KMIP item
+type ttlv struct {
+	tag   uint32
+	typ   byte
+	val   []byte
+	items []*ttlv
+}
+
+// encode an item of type 'typ' with the value 'v'
+func kmipItem(tag uint32, typ byte, v []byte) []byte {
+	n := (len(v) + 7) &^ 7
+	b := make([]byte, 8+n)
+	binary.BigEndian.PutUint32(b, tag<<8|uint32(typ))
+	binary.BigEndian.PutUint32(b[4:], uint32(len(v)))
+	copy(b[8:], v)
+	return b
+}
+
+func kmipStruct(tag uint32, items ...[]byte) []byte {
+	return kmipItem(tag, kmipTypeStructure, bytes.Join(items, nil))
+}
+
+func kmipInt(tag uint32, typ byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return kmipItem(tag, typ, b[:])
+}
+
+func kmipBool(tag uint32, v bool) []byte {
+	var b [8]byte
+	if v {
+		b[7] = 1
+	}
+	return kmipItem(tag, kmipTypeBoolean, b[:])
+}
+
+// decode the item at the start of 'b'; it returns the rest of 'b'
+func parseTTLV(b []byte) (*ttlv, []byte, error) {
+	if len(b) < 8 {
+		return nil, nil, fmt.Errorf("kmip: truncated item")
+	}
+
+	t := &ttlv{
+		tag: binary.BigEndian.Uint32(b) >> 8,
+		typ: b[3],
+	}
+
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	pad := (n + 7) &^ 7
+	if n < 0 || pad > len(b)-8 {
+		return nil, nil, fmt.Errorf("kmip: truncated item %06x", t.tag)
+	}
+
+	t.val = b[8 : 8+n]
+	if t.typ == kmipTypeStructure {
+		v := t.val
+		for len(v) > 0 {
+			c, rest, err := parseTTLV(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			t.items = append(t.items, c)
+			v = rest
+		}
+	}
+	return t, b[8+pad:], nil
+}
+
+// return the first child of 't' with the tag 'tag'
+func (t *ttlv) find(tag uint32) *ttlv {
+	if t == nil {
+		return nil
+	}
+
+	for _, c := range t.items {
+		if c.tag == tag {
+			return c
+		}
+	}
+	return nil
+}
+
+// return the first item with the tag 'tag' anywhere below 't'
+func (t *ttlv) search(tag uint32) *ttlv {
+	for _, c := range t.items {
+		if c.tag == tag {
+			return c
+		}
+		if d := c.search(tag); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// value of an integer or enumeration
+func (t *ttlv) uint() (uint32, bool) {
+	if t == nil || len(t.val) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(t.val), true
+}
+
+// value of a text or byte string; nil if 't' is missing
+func (t *ttlv) bytes() []byte {
+	if t == nil || (t.typ != kmipTypeTextString && t.typ != kmipTypeByteString) {
+		return nil
+	}
+	return t.val
+}
+
+// client of a KMIP server
+type kmipClient struct {
+	addr string
+	tls  *tls.Config
+}
+
+// make a client of the server at 'host' and 'port' with the TLS
+// credentials in $SIGTOOL_KMIP_CERT, $SIGTOOL_KMIP_KEY and $SIGTOOL_KMIP_CA
+func newKMIPClient(host, port string) (*kmipClient, error) {
+	certfile := os.Getenv("SIGTOOL_KMIP_CERT")
+	keyfile := os.Getenv("SIGTOOL_KMIP_KEY")
+	if len(certfile) == 0 || len(keyfile) == 0 {
+		return nil, fmt.Errorf("kmip: need a client certificate and key ($SIGTOOL_KMIP_CERT, $SIGTOOL_KMIP_KEY)")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("kmip: %s", err)
+	}
+
+	if len(port) == 0 {
+		port = _KMIPPort
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if fn := os.Getenv("SIGTOOL_KMIP_CA"); len(fn) > 0 {
+		pem, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("kmip: %s", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kmip: %s: no certificates", fn)
+		}
+	}
+
+	c := &kmipClient{
+		addr: net.JoinHostPort(host, port),
+		tls:  cfg,
+	}
+	return c, nil
+}
+
+// run the operation 'op' with the request payload 'payload' and return the
+// response payload
+func (c *kmipClient) do(op uint32, payload ...[]byte) (*ttlv, error) {
+	req := kmipStruct(kmipRequestMessage,
+		kmipStruct(kmipRequestHeader,
+			kmipStruct(kmipProtocolVersion,
+				kmipInt(kmipProtocolMajor, kmipTypeInteger, kmipVersionMajor),
+				kmipInt(kmipProtocolMinor, kmipTypeInteger, kmipVersionMinor)),
+			kmipInt(kmipBatchCount, kmipTypeInteger, 1)),
+		kmipStruct(kmipBatchItem,
+			kmipInt(kmipOperation, kmipTypeEnumeration, op),
+			kmipStruct(kmipRequestPayload, payload...)))
+
+	d := &net.Dialer{Timeout: _KMIPTimeout}
+	conn, err := tls.DialWithDialer(d, "tcp", c.addr, c.tls)
+	if err != nil {
+		return nil, fmt.Errorf("kmip: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(_KMIPTimeout))
+	if _, err = conn.Write(req); err != nil {
+		return nil, fmt.Errorf("kmip: %s", err)
+	}
+
+	b, err := readKMIPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := parseTTLV(b)
+	if err != nil {
+		return nil, err
+	}
+
+	item := resp.find(kmipBatchItem)
+	if resp.tag != kmipResponseMessage || item == nil {
+		return nil, fmt.Errorf("kmip: malformed response")
+	}
+
+	status, ok := item.find(kmipResultStatus).uint()
+	if !ok {
+		return nil, fmt.Errorf("kmip: malformed response")
+	}
+
+	if status != kmipStatusSuccess {
+		reason, _ := item.find(kmipResultReason).uint()
+		msg := item.find(kmipResultMessage).bytes()
+		return nil, fmt.Errorf("kmip: operation failed (status %d, reason %d): %s", status, reason, msg)
+	}
+	return item.find(kmipResponsePayload), nil
+}
+
+// read one TTLV message from 'rd'
+func readKMIPMessage(rd io.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, fmt.Errorf("kmip: %s", err)
+	}
+
+	n := int(binary.BigEndian.Uint32(hdr[4:]))
+	if n < 0 || n > _KMIPMaxMessage {
+		return nil, fmt.Errorf("kmip: message too large (%d bytes)", n)
+	}
+
+	b := make([]byte, 8+((n+7)&^7))
+	copy(b, hdr[:])
+	if _, err := io.ReadFull(rd, b[8:]); err != nil {
+		return nil, fmt.Errorf("kmip: %s", err)
+	}
+	return b, nil
+}
+
+// a key held by a KMIP server
+type kmipKey struct {
+	c   *kmipClient
+	uid string
+
+	// UID of the public key of a signing key and the key
+	pub string
+	pk  []byte
+}
+
+// parse a KMIP key URI "kmip://host[:port]/UID[?pub=UID]"
+func parseKMIPKey(uri string) (*kmipKey, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("kmip: %s", err)
+	}
+
+	uid := u.Path
+	if len(uid) > 0 {
+		uid = uid[1:]
+	}
+
+	if len(u.Hostname()) == 0 || len(uid) == 0 {
+		return nil, fmt.Errorf("kmip: need kmip://host[:port]/UID")
+	}
+
+	c, err := newKMIPClient(u.Hostname(), u.Port())
+	if err != nil {
+		return nil, err
+	}
+
+	k := &kmipKey{
+		c:   c,
+		uid: uid,
+		pub: u.Query().Get("pub"),
+	}
+	return k, nil
+}
+
+// GCM parameters of the Encrypt and Decrypt operations
+func kmipGCMParams(randomIV bool) []byte {
+	p := [][]byte{
+		kmipInt(kmipBlockCipherMode, kmipTypeEnumeration, kmipModeGCM),
+		kmipInt(kmipTagLength, kmipTypeInteger, kmipGCMTagSize),
+	}
+	if randomIV {
+		p = append(p, kmipBool(kmipRandomIV, true))
+	}
+	return kmipStruct(kmipCryptoParams, p...)
+}
+
+// Wrap the file key with the server's AES key; the wrapped key is
+// len(IV) || IV || tag || ciphertext and 'args' is the key's UID.
+func (k *kmipKey) Wrap(key []byte) ([]byte, []byte, error) {
+	r, err := k.c.do(kmipOpEncrypt,
+		kmipItem(kmipUniqueIdentifier, kmipTypeTextString, []byte(k.uid)),
+		kmipGCMParams(true),
+		kmipItem(kmipData, kmipTypeByteString, key))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := r.find(kmipIVCounterNonce).bytes()
+	tag := r.find(kmipAuthTag).bytes()
+	ct := r.find(kmipData).bytes()
+	if len(iv) == 0 || len(iv) > 255 || len(tag) != int(kmipGCMTagSize) || len(ct) == 0 {
+		return nil, nil, fmt.Errorf("kmip: malformed encrypt response")
+	}
+
+	w := make([]byte, 0, 1+len(iv)+len(tag)+len(ct))
+	w = append(w, byte(len(iv)))
+	w = append(w, iv...)
+	w = append(w, tag...)
+	w = append(w, ct...)
+	return w, []byte(k.uid), nil
+}
+
+// Unwrap a file key wrapped with our AES key
+func (k *kmipKey) Unwrap(wrapped []byte, args []byte) ([]byte, error) {
+	if string(args) != k.uid {
+		return nil, nil
+	}
+
+	n := 0
+	if len(wrapped) > 0 {
+		n = int(wrapped[0])
+	}
+	if n == 0 || len(wrapped) <= 1+n+int(kmipGCMTagSize) {
+		return nil, fmt.Errorf("kmip: malformed wrapped key")
+	}
+
+	iv := wrapped[1 : 1+n]
+	tag := wrapped[1+n : 1+n+int(kmipGCMTagSize)]
+	ct := wrapped[1+n+int(kmipGCMTagSize):]
+
+	r, err := k.c.do(kmipOpDecrypt,
+		kmipItem(kmipUniqueIdentifier, kmipTypeTextString, []byte(k.uid)),
+		kmipGCMParams(false),
+		kmipItem(kmipData, kmipTypeByteString, ct),
+		kmipItem(kmipIVCounterNonce, kmipTypeByteString, iv),
+		kmipItem(kmipAuthTag, kmipTypeByteString, tag))
+	if err != nil {
+		return nil, err
+	}
+
+	key := r.find(kmipData).bytes()
+	if key == nil {
+		return nil, fmt.Errorf("kmip: malformed decrypt response")
+	}
+	return key, nil
+}
+
+// SigningKey returns the raw Ed25519 public key 'pub' of a signing key
+func (k *kmipKey) SigningKey() ([]byte, error) {
+	if len(k.pub) == 0 {
+		return nil, nil
+	}
+
+	r, err := k.c.do(kmipOpGet,
+		kmipItem(kmipUniqueIdentifier, kmipTypeTextString, []byte(k.pub)),
+		kmipInt(kmipKeyFormatType, kmipTypeEnumeration, kmipKeyFormatRaw))
+	if err != nil {
+		return nil, err
+	}
+
+	pk := r.search(kmipKeyMaterial).bytes()
+	if len(pk) != Ed.PublicKeySize {
+		return nil, fmt.Errorf("kmip: %s isn't an Ed25519 public key", k.pub)
+	}
+
+	k.pk = pk
+	return pk, nil
+}
+
+// Sign the message 'm' with the server's Ed25519 key
+func (k *kmipKey) Sign(m []byte) ([]byte, error) {
+	r, err := k.c.do(kmipOpSign,
+		kmipItem(kmipUniqueIdentifier, kmipTypeTextString, []byte(k.uid)),
+		kmipItem(kmipData, kmipTypeByteString, m))
+	if err != nil {
+		return nil, err
+	}
+
+	// a wrong 'pub' (or algorithm) makes signatures that don't verify
+	sig := r.find(kmipSignatureData).bytes()
+	if len(sig) != Ed.SignatureSize || (k.pk != nil && !Ed.Verify(k.pk, m, sig)) {
+		return nil, fmt.Errorf("kmip: %s made an invalid Ed25519 signature", k.uid)
+	}
+	return sig, nil
+}
@@ -0,0 +1,289 @@
+// kmip_test.go -- Test harness for the KMIP schemes
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	Ed "crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// write a self-signed certificate for 127.0.0.1 and its key to 'dn'
+func kmipTestCert(dn, name string) (tls.Certificate, string, string, error) {
+	var c tls.Certificate
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return c, "", "", err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return c, "", "", err
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return c, "", "", err
+	}
+
+	cpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	kpem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+
+	certfile := path.Join(dn, name+".crt")
+	keyfile := path.Join(dn, name+".key")
+	if err = writeFile(certfile, cpem, 0600); err != nil {
+		return c, "", "", err
+	}
+	if err = writeFile(keyfile, kpem, 0600); err != nil {
+		return c, "", "", err
+	}
+
+	c, err = tls.X509KeyPair(cpem, kpem)
+	return c, certfile, keyfile, err
+}
+
+// minimal KMIP server holding the AES key "aes" and the Ed25519 keypair
+// "ed" (private) and "ed-pub" (public)
+type kmipTestServer struct {
+	aead cipher.AEAD
+	kp   *Keypair
+}
+
+func (s *kmipTestServer) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(c net.Conn) {
+			defer c.Close()
+
+			b, err := readKMIPMessage(c)
+			if err != nil {
+				return
+			}
+			c.Write(s.handle(b))
+		}(c)
+	}
+}
+
+// the response to the request 'b'
+func (s *kmipTestServer) handle(b []byte) []byte {
+	req, _, err := parseTTLV(b)
+	if err != nil {
+		return nil
+	}
+
+	item := req.find(kmipBatchItem)
+	op, _ := item.find(kmipOperation).uint()
+	p := item.find(kmipRequestPayload)
+	uid := string(p.find(kmipUniqueIdentifier).bytes())
+
+	var out [][]byte
+	switch {
+	case op == kmipOpEncrypt && uid == "aes":
+		iv := randbuf(12)
+		ct := s.aead.Seal(nil, iv, p.find(kmipData).bytes(), nil)
+		n := len(ct) - 16
+		out = [][]byte{
+			kmipItem(kmipData, kmipTypeByteString, ct[:n]),
+			kmipItem(kmipIVCounterNonce, kmipTypeByteString, iv),
+			kmipItem(kmipAuthTag, kmipTypeByteString, ct[n:]),
+		}
+
+	case op == kmipOpDecrypt && uid == "aes":
+		ct := append(append([]byte{}, p.find(kmipData).bytes()...), p.find(kmipAuthTag).bytes()...)
+		pt, err := s.aead.Open(nil, p.find(kmipIVCounterNonce).bytes(), ct, nil)
+		if err != nil {
+			return kmipTestResponse(op, 1, nil)
+		}
+		out = [][]byte{kmipItem(kmipData, kmipTypeByteString, pt)}
+
+	case op == kmipOpGet && uid == "ed-pub":
+		out = [][]byte{
+			kmipStruct(0x42006D,
+				kmipStruct(0x420040,
+					kmipInt(kmipKeyFormatType, kmipTypeEnumeration, kmipKeyFormatRaw),
+					kmipStruct(0x420045,
+						kmipItem(kmipKeyMaterial, kmipTypeByteString, s.kp.Pub.Pk)))),
+		}
+
+	case op == kmipOpSign && uid == "ed":
+		sig := Ed.Sign(Ed.PrivateKey(s.kp.Sec.Sk), p.find(kmipData).bytes())
+		out = [][]byte{kmipItem(kmipSignatureData, kmipTypeByteString, sig)}
+
+	default:
+		return kmipTestResponse(op, 1, nil)
+	}
+
+	out = append([][]byte{kmipItem(kmipUniqueIdentifier, kmipTypeTextString, []byte(uid))}, out...)
+	return kmipTestResponse(op, kmipStatusSuccess, out)
+}
+
+func kmipTestResponse(op, status uint32, payload [][]byte) []byte {
+	item := [][]byte{
+		kmipInt(kmipOperation, kmipTypeEnumeration, op),
+		kmipInt(kmipResultStatus, kmipTypeEnumeration, status),
+	}
+
+	if status == kmipStatusSuccess {
+		item = append(item, kmipStruct(kmipResponsePayload, payload...))
+	} else {
+		item = append(item,
+			kmipInt(kmipResultReason, kmipTypeEnumeration, 1),
+			kmipItem(kmipResultMessage, kmipTypeTextString, []byte("item not found")))
+	}
+
+	return kmipStruct(kmipResponseMessage,
+		kmipStruct(0x42007A,
+			kmipInt(kmipBatchCount, kmipTypeInteger, 1)),
+		kmipStruct(kmipBatchItem, item...))
+}
+
+func TestKMIP(t *testing.T) {
+	assert := newAsserter(t)
+
+	dn := tempdir(t)
+	defer os.RemoveAll(dn)
+
+	scert, sfile, _, err := kmipTestCert(dn, "server")
+	assert(err == nil, "server cert fail: %s", err)
+	ccert, cfile, kfile, err := kmipTestCert(dn, "client")
+	assert(err == nil, "client cert fail: %s", err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParseCert(ccert))
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{scert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	assert(err == nil, "listen fail: %s", err)
+	defer ln.Close()
+
+	blk, err := aes.NewCipher(randbuf(32))
+	assert(err == nil, "aes fail: %s", err)
+	aead, err := cipher.NewGCM(blk)
+	assert(err == nil, "gcm fail: %s", err)
+	kp, err := NewKeypair()
+	assert(err == nil, "keygen fail: %s", err)
+
+	srv := &kmipTestServer{aead: aead, kp: kp}
+	go srv.serve(ln)
+
+	for _, e := range []string{"SIGTOOL_KMIP_CERT", "SIGTOOL_KMIP_KEY", "SIGTOOL_KMIP_CA"} {
+		defer os.Setenv(e, os.Getenv(e))
+	}
+
+	base := fmt.Sprintf("kmip://%s", ln.Addr())
+
+	os.Setenv("SIGTOOL_KMIP_CERT", "")
+	_, err = ParseRecipient(base + "/aes")
+	assert(err != nil, "kmip without client cert")
+
+	os.Setenv("SIGTOOL_KMIP_CERT", cfile)
+	os.Setenv("SIGTOOL_KMIP_KEY", kfile)
+	os.Setenv("SIGTOOL_KMIP_CA", sfile)
+
+	// wrap and unwrap file keys with the server's AES key
+	pk, err := ParseRecipient(base + "/aes")
+	assert(err == nil, "parse recipient fail: %s", err)
+
+	buf := randbuf(3000)
+	ee, err := NewEncryptor(nil, 1024)
+	assert(err == nil, "encryptor create fail: %s", err)
+	err = ee.AddRecipient(pk)
+	assert(err == nil, "can't add recipient: %s", err)
+
+	wr := Buffer{}
+	err = ee.Encrypt(bytes.NewBuffer(buf), &wr)
+	assert(err == nil, "encrypt fail: %s", err)
+
+	sk, err := ParseIdentity(base+"/aes", nil)
+	assert(err == nil, "parse identity fail: %s", err)
+
+	dd, err := NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = dd.SetPrivateKey(sk, nil)
+	assert(err == nil, "kmip unwrap fail: %s", err)
+
+	out := Buffer{}
+	err = dd.Decrypt(&out)
+	assert(err == nil, "decrypt fail: %s", err)
+	assert(byteEq(out.Bytes(), buf), "decrypt content mismatch")
+
+	// another key doesn't unwrap the file key
+	sk, err = ParseIdentity(base+"/other", nil)
+	assert(err == nil, "parse identity fail: %s", err)
+	dd, err = NewDecryptor(bytes.NewBuffer(wr.Bytes()))
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = dd.SetPrivateKey(sk, nil)
+	assert(err != nil, "unwrapped with the wrong key")
+
+	// sign with the server's Ed25519 key
+	sk, err = ParseIdentity(base+"/ed?pub=ed-pub", nil)
+	assert(err == nil, "parse signing identity fail: %s", err)
+	assert(byteEq(sk.PublicKey().Pk, kp.Pub.Pk), "wrong public key")
+
+	ck := randbuf(64)
+	sig, err := sk.SignMessage(ck, "")
+	assert(err == nil, "kmip sign fail: %s", err)
+	assert(kp.Pub.VerifyMessage(ck, sig), "kmip signature doesn't verify")
+
+	_, err = ParseIdentity(base+"/ed?pub=missing", nil)
+	assert(err != nil, "parsed a missing public key")
+
+	// the server's certificate must be trusted
+	os.Setenv("SIGTOOL_KMIP_CA", cfile)
+	sk, err = ParseIdentity(base+"/ed?pub=ed-pub", nil)
+	assert(err != nil, "trusted the wrong server")
+}
+
+func mustParseCert(c tls.Certificate) *x509.Certificate {
+	x, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		panic(err)
+	}
+	return x
+}
@@ -0,0 +1,230 @@
+// known.go -- pinned keys of named recipients
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The known recipients file is to encryption what known_hosts is to ssh:
+// the first time a recipient is named (a key file, a user@host, a URI),
+// the fingerprint of its key is recorded; later, a different key under
+// the same name is refused. A public key substituted in shared storage is
+// then caught before anything is encrypted to it.
+
+package sign
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// KnownRecipient is the pinned key of a named recipient
+type KnownRecipient struct {
+	Name        string
+	Fingerprint string
+
+	// Time the key was pinned
+	Added time.Time
+}
+
+// KnownRecipients is the set of pinned recipients
+type KnownRecipients struct {
+	Recipients []*KnownRecipient
+}
+
+// serialized known recipient
+type serializedKnownRecipient struct {
+	Name        string `yaml:"name"`
+	Fingerprint string `yaml:"fingerprint"`
+	Added       string `yaml:"added,omitempty"`
+}
+
+// serialized known recipients
+type serializedKnownRecipients struct {
+	Recipients []*serializedKnownRecipient `yaml:"recipients"`
+}
+
+// ReadKnownRecipients reads the known recipients in file 'fn'; a missing
+// file has no recipients.
+func ReadKnownRecipients(fn string) (*KnownRecipients, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &KnownRecipients{}, nil
+		}
+		return nil, err
+	}
+
+	k, err := MakeKnownRecipients(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return k, nil
+}
+
+// MakeKnownRecipients parses serialized known recipients
+func MakeKnownRecipients(b []byte) (*KnownRecipients, error) {
+	var sk serializedKnownRecipients
+
+	if err := yaml.Unmarshal(b, &sk); err != nil {
+		return nil, fmt.Errorf("known recipients: can't parse YAML: %s", err)
+	}
+
+	k := &KnownRecipients{}
+	for _, s := range sk.Recipients {
+		if s == nil || len(s.Name) == 0 || len(s.Fingerprint) == 0 {
+			return nil, fmt.Errorf("known recipients: malformed entry")
+		}
+
+		if k.Lookup(s.Name) != nil {
+			return nil, fmt.Errorf("known recipients: duplicate name %q", s.Name)
+		}
+
+		r := &KnownRecipient{
+			Name:        s.Name,
+			Fingerprint: s.Fingerprint,
+		}
+
+		if len(s.Added) > 0 {
+			t, err := time.Parse(time.RFC3339, s.Added)
+			if err != nil {
+				return nil, fmt.Errorf("known recipients: %s: invalid time %q", s.Name, s.Added)
+			}
+			r.Added = t
+		}
+		k.Recipients = append(k.Recipients, r)
+	}
+	return k, nil
+}
+
+// Lookup returns the recipient named 'name'; it is nil if there is no
+// such recipient
+func (k *KnownRecipients) Lookup(name string) *KnownRecipient {
+	for _, r := range k.Recipients {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Check pins the key 'pk' of the recipient 'name' if it isn't known and
+// returns true; it is an error if the key of a known recipient has
+// changed. Keys without a fingerprint (e.g., those of a recipient scheme
+// that wrap the file key themselves) aren't pinned.
+func (k *KnownRecipients) Check(name string, pk *PublicKey) (bool, error) {
+	fp := recipientFingerprint(pk)
+	if len(fp) == 0 {
+		return false, nil
+	}
+
+	if r := k.Lookup(name); r != nil {
+		if r.Fingerprint != fp {
+			warn(nil, "known recipients: key changed", "name", name, "pinned", r.Fingerprint, "key", fp)
+			return false, fmt.Errorf("known recipients: the key of %s has changed! pinned %s, now %s",
+				name, r.Fingerprint, fp)
+		}
+		return false, nil
+	}
+
+	return k.Pin(name, pk), nil
+}
+
+// Pin records 'pk' as the key of the recipient 'name' and replaces its
+// earlier key if any; it returns true if the pinned key changed.
+func (k *KnownRecipients) Pin(name string, pk *PublicKey) bool {
+	fp := recipientFingerprint(pk)
+	if len(fp) == 0 {
+		return false
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	if r := k.Lookup(name); r != nil {
+		if r.Fingerprint == fp {
+			return false
+		}
+
+		info(nil, "known recipients: replaced key", "name", name, "pinned", r.Fingerprint, "key", fp)
+		r.Fingerprint, r.Added = fp, now
+		return true
+	}
+
+	k.Recipients = append(k.Recipients, &KnownRecipient{
+		Name:        name,
+		Fingerprint: fp,
+		Added:       now,
+	})
+	info(nil, "known recipients: pinned key", "name", name, "fingerprint", fp)
+	return true
+}
+
+// Remove the recipient 'name'
+func (k *KnownRecipients) Remove(name string) error {
+	for i, r := range k.Recipients {
+		if r.Name == name {
+			k.Recipients = append(k.Recipients[:i], k.Recipients[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("known recipients: no recipient %q", name)
+}
+
+// Serialize the known recipients as YAML
+func (k *KnownRecipients) Serialize() ([]byte, error) {
+	sk := &serializedKnownRecipients{
+		Recipients: make([]*serializedKnownRecipient, len(k.Recipients)),
+	}
+
+	for i, r := range k.Recipients {
+		s := &serializedKnownRecipient{
+			Name:        r.Name,
+			Fingerprint: r.Fingerprint,
+		}
+		if !r.Added.IsZero() {
+			s.Added = r.Added.Format(time.RFC3339)
+		}
+		sk.Recipients[i] = s
+	}
+
+	out, err := yaml.Marshal(sk)
+	if err != nil {
+		return nil, fmt.Errorf("known recipients: can't marshal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// SerializeFile writes the known recipients to file 'fn'
+func (k *KnownRecipients) SerializeFile(fn string) error {
+	b, err := k.Serialize()
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b, 0644)
+}
+
+// the fingerprint of the Ed25519 key of 'pk' or, for keys that only
+// encrypt (e.g., age recipients), of its X25519 key
+func recipientFingerprint(pk *PublicKey) string {
+	if pk.Pk != nil {
+		return pk.Fingerprint()
+	}
+
+	if pk.xpk != nil {
+		h := sha256.Sum256(pk.xpk)
+		return "X25519:" + base64.RawStdEncoding.EncodeToString(h[:])
+	}
+	return ""
+}
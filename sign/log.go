@@ -0,0 +1,84 @@
+// log.go -- optional debug logging for the sign package
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// package wide default logger; holds a *slog.Logger
+var defaultLogger atomic.Value
+
+// SetLogger sets the package wide logger used for diagnostic events. Key
+// loading and newly created Encryptors and Decryptors log to 'l' unless
+// they are given their own logger via their SetLogger() method. A nil
+// logger disables logging; this is the default.
+//
+// Summaries (headers, recipient matching, chunk counts, loaded keys) are
+// logged at slog.LevelInfo and details at slog.LevelDebug.
+//
+// No secret material (keys, passphrases, plaintext) is ever logged.
+func SetLogger(l *slog.Logger) {
+	defaultLogger.Store(&l)
+}
+
+// return the package wide logger or nil
+func pkgLogger() *slog.Logger {
+	if p, ok := defaultLogger.Load().(**slog.Logger); ok {
+		return *p
+	}
+	return nil
+}
+
+// debug logs a debug event to 'l' or to the package logger if 'l' is nil
+func debug(l *slog.Logger, msg string, args ...interface{}) {
+	if l == nil {
+		if l = pkgLogger(); l == nil {
+			return
+		}
+	}
+	l.Debug(msg, args...)
+}
+
+// info logs a summary event to 'l' or to the package logger if 'l' is nil
+func info(l *slog.Logger, msg string, args ...interface{}) {
+	if l == nil {
+		if l = pkgLogger(); l == nil {
+			return
+		}
+	}
+	l.Info(msg, args...)
+}
+
+// warn logs a warning to 'l' or to the package logger if 'l' is nil
+func warn(l *slog.Logger, msg string, args ...interface{}) {
+	if l == nil {
+		if l = pkgLogger(); l == nil {
+			return
+		}
+	}
+	l.Warn(msg, args...)
+}
+
+// SetLogger sets the logger for this encryption context.
+func (e *Encryptor) SetLogger(l *slog.Logger) {
+	e.log = l
+}
+
+// SetLogger sets the logger for this decryption context. Events generated
+// while parsing the header in NewDecryptor() go to the package logger.
+func (d *Decryptor) SetLogger(l *slog.Logger) {
+	d.log = l
+}
@@ -0,0 +1,398 @@
+// manifest.go -- signed manifest of per-chunk ciphertext hashes
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A chunk manifest lists the SHA256 of the header and of every chunk of
+// an encrypted file as written to disk. It is signed by the sender; a
+// downloader that has the sender's public key can check each chunk as it
+// arrives (e.g., from an untrusted mirror) before it is given to the
+// Decryptor. Every chunk except the last has the same size; so the
+// position of chunk i is known in advance:
+//
+//    offset(i) = HeaderSize + i * (ChunkSize + 4 + 16)
+//
+// The signature covers:
+//
+//    SHA512("sigtool chunk manifest v1" || uint32_be(ChunkSize) ||
+//           uint64_be(HeaderSize) || uint64_be(Size) || Header || Chunks..)
+
+package sign
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+const _ManifestPrefix = "sigtool chunk manifest v1"
+
+// ChunkManifest is the manifest of the chunk hashes of an encrypted file
+type ChunkManifest struct {
+	// Size of the header and of the whole encrypted file
+	HeaderSize int64
+	Size       int64
+
+	// Encryption chunk size
+	ChunkSize uint32
+
+	// SHA256 of the header and of each encrypted chunk
+	Header []byte
+	Chunks [][]byte
+
+	// Signature of the sender; nil until Sign() is called
+	Signature *Signature
+}
+
+// serialized manifest
+type serializedManifest struct {
+	Comment    string     `yaml:"comment,omitempty"`
+	Hash       string     `yaml:"hash"`
+	ChunkSize  uint32     `yaml:"chunksize"`
+	HeaderSize int64      `yaml:"hdrsize"`
+	Size       int64      `yaml:"size"`
+	Header     string     `yaml:"header"`
+	Chunks     []string   `yaml:"chunks,flow"`
+	Signature  *signature `yaml:"signature"`
+}
+
+// EnableChunkManifest makes the Encryptor record the hash of each chunk it
+// writes; the manifest is available from ChunkManifest() once the
+// encryption is done.
+func (e *Encryptor) EnableChunkManifest() error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't enable chunk manifest after encryption has started")
+	}
+
+	if e.sparse {
+		return fmt.Errorf("encrypt: a chunk manifest can't be used with sparse files")
+	}
+
+	if e.ckptFn != nil || e.cdc != nil {
+		return fmt.Errorf("encrypt: a chunk manifest can't be used with checkpoints or content defined chunks")
+	}
+
+	e.manifest = &ChunkManifest{
+		ChunkSize: e.ChunkSize,
+	}
+	return nil
+}
+
+// ChunkManifest returns the unsigned chunk manifest of the encrypted
+// output or nil if EnableChunkManifest() wasn't called.
+func (e *Encryptor) ChunkManifest() *ChunkManifest {
+	return e.manifest
+}
+
+func (m *ChunkManifest) addHeader(b []byte) {
+	h := sha256.Sum256(b)
+	m.Header = h[:]
+	m.HeaderSize = int64(len(b))
+	m.Size = m.HeaderSize
+}
+
+// record the header of 'size' bytes with the SHA256 'sum'
+func (m *ChunkManifest) setHeader(sum []byte, size int) {
+	m.Header = sum
+	m.HeaderSize = int64(size)
+	m.Size = m.HeaderSize
+}
+
+func (m *ChunkManifest) addChunk(b []byte) {
+	h := sha256.Sum256(b)
+	m.Chunks = append(m.Chunks, h[:])
+	m.Size += int64(len(b))
+}
+
+// Sign the manifest with the sender's private key
+func (m *ChunkManifest) Sign(sk *PrivateKey) error {
+	sig, err := sk.SignMessage(m.checksum(), "")
+	if err != nil {
+		return fmt.Errorf("manifest: %s", err)
+	}
+
+	m.Signature = sig
+	return nil
+}
+
+// Verify the signature of the manifest with the sender's public key
+func (m *ChunkManifest) Verify(pk *PublicKey) error {
+	if m.Signature == nil {
+		return fmt.Errorf("manifest: not signed")
+	}
+
+	if !pk.VerifyMessage(m.checksum(), m.Signature) {
+		return fmt.Errorf("manifest: signature verification failed")
+	}
+	return nil
+}
+
+// the message that is signed
+func (m *ChunkManifest) checksum() []byte {
+	var b [20]byte
+
+	binary.BigEndian.PutUint32(b[:4], m.ChunkSize)
+	binary.BigEndian.PutUint64(b[4:12], uint64(m.HeaderSize))
+	binary.BigEndian.PutUint64(b[12:], uint64(m.Size))
+
+	h := sha512.New()
+	h.Write([]byte(_ManifestPrefix))
+	h.Write(b[:])
+	h.Write(m.Header)
+	for _, c := range m.Chunks {
+		h.Write(c)
+	}
+	return h.Sum(nil)
+}
+
+// ChunkRange returns the offset and size of chunk 'i' in the encrypted file
+func (m *ChunkManifest) ChunkRange(i int) (int64, int64, error) {
+	if i < 0 || i >= len(m.Chunks) {
+		return 0, 0, fmt.Errorf("manifest: no chunk %d", i)
+	}
+
+	full := int64(m.ChunkSize) + _ChunkOverhead
+	off := m.HeaderSize + int64(i)*full
+
+	n := full
+	if i == len(m.Chunks)-1 {
+		n = m.Size - off
+	}
+
+	if n < _ChunkOverhead || n > full {
+		return 0, 0, fmt.Errorf("manifest: chunk %d: inconsistent size %d", i, n)
+	}
+	return off, n, nil
+}
+
+// VerifyHeader checks the header of the encrypted file against the manifest
+func (m *ChunkManifest) VerifyHeader(b []byte) error {
+	h := sha256.Sum256(b)
+	if int64(len(b)) != m.HeaderSize || subtle.ConstantTimeCompare(h[:], m.Header) != 1 {
+		return fmt.Errorf("manifest: header doesn't match")
+	}
+	return nil
+}
+
+// VerifyChunk checks chunk 'i' of the encrypted file against the manifest
+func (m *ChunkManifest) VerifyChunk(i int, b []byte) error {
+	_, n, err := m.ChunkRange(i)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.Sum256(b)
+	if int64(len(b)) != n || subtle.ConstantTimeCompare(h[:], m.Chunks[i]) != 1 {
+		return fmt.Errorf("manifest: chunk %d doesn't match", i)
+	}
+	return nil
+}
+
+// NewReader returns a reader that passes the encrypted stream 'rd' through
+// after checking each chunk against the manifest; a chunk that doesn't
+// match is never returned. The manifest's signature must be verified
+// separately.
+func (m *ChunkManifest) NewReader(rd io.Reader) io.Reader {
+	return &manifestReader{
+		m:   m,
+		rd:  rd,
+		blk: -1,
+	}
+}
+
+// manifestReader reads and verifies one chunk at a time
+type manifestReader struct {
+	m      *ChunkManifest
+	rd     io.Reader
+	buf    []byte
+	unread []byte
+	blk    int
+	err    error
+}
+
+func (r *manifestReader) Read(b []byte) (int, error) {
+	if len(r.unread) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.err = r.next(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	n := copy(b, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// read and verify the next chunk (or the header)
+func (r *manifestReader) next() error {
+	m := r.m
+	if r.blk == len(m.Chunks) {
+		// the stream must end here
+		var x [1]byte
+		if n, _ := io.ReadFull(r.rd, x[:]); n > 0 {
+			return fmt.Errorf("manifest: trailing data after chunk %d", r.blk-1)
+		}
+		return io.EOF
+	}
+
+	var n int64
+	if r.blk < 0 {
+		n = m.HeaderSize
+	} else {
+		var err error
+		if _, n, err = m.ChunkRange(r.blk); err != nil {
+			return err
+		}
+	}
+
+	if int64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+
+	buf := r.buf[:n]
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		if r.blk < 0 {
+			return fmt.Errorf("manifest: header: %s", err)
+		}
+		return fmt.Errorf("manifest: chunk %d: %s", r.blk, err)
+	}
+
+	var err error
+	if r.blk < 0 {
+		err = m.VerifyHeader(buf)
+	} else {
+		err = m.VerifyChunk(r.blk, buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.blk++
+	r.unread = buf
+	return nil
+}
+
+// Serialize the manifest as YAML
+func (m *ChunkManifest) Serialize(comment string) ([]byte, error) {
+	if m.Signature == nil {
+		return nil, fmt.Errorf("manifest: not signed")
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+
+	sm := &serializedManifest{
+		Comment:    comment,
+		Hash:       "sha256",
+		ChunkSize:  m.ChunkSize,
+		HeaderSize: m.HeaderSize,
+		Size:       m.Size,
+		Header:     b64(m.Header),
+		Chunks:     make([]string, len(m.Chunks)),
+		Signature:  m.Signature.serialize(""),
+	}
+
+	for i, c := range m.Chunks {
+		sm.Chunks[i] = b64(c)
+	}
+
+	out, err := yaml.Marshal(sm)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: can't marshal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// SerializeFile writes the manifest to file 'fn'
+func (m *ChunkManifest) SerializeFile(fn, comment string) error {
+	b, err := m.Serialize(comment)
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b, 0644)
+}
+
+// ReadChunkManifest reads a chunk manifest from file 'fn'
+func ReadChunkManifest(fn string) (*ChunkManifest, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return MakeChunkManifest(b)
+}
+
+// MakeChunkManifest parses a serialized chunk manifest
+func MakeChunkManifest(b []byte) (*ChunkManifest, error) {
+	var sm serializedManifest
+
+	if err := yaml.Unmarshal(b, &sm); err != nil {
+		return nil, fmt.Errorf("manifest: can't parse YAML: %s", err)
+	}
+
+	if sm.Hash != "sha256" {
+		return nil, fmt.Errorf("manifest: unsupported hash %q", sm.Hash)
+	}
+
+	if sm.Signature == nil {
+		return nil, fmt.Errorf("manifest: not signed")
+	}
+
+	if sm.ChunkSize == 0 || sm.ChunkSize > maxChunkSize || sm.HeaderSize <= 0 || sm.Size < sm.HeaderSize {
+		return nil, fmt.Errorf("manifest: invalid sizes")
+	}
+
+	b64 := base64.StdEncoding.DecodeString
+
+	hdr, err := b64(sm.Header)
+	if err != nil || len(hdr) != sha256.Size {
+		return nil, fmt.Errorf("manifest: invalid header hash")
+	}
+
+	m := &ChunkManifest{
+		HeaderSize: sm.HeaderSize,
+		Size:       sm.Size,
+		ChunkSize:  sm.ChunkSize,
+		Header:     hdr,
+		Chunks:     make([][]byte, len(sm.Chunks)),
+	}
+
+	for i, s := range sm.Chunks {
+		c, err := b64(s)
+		if err != nil || len(c) != sha256.Size {
+			return nil, fmt.Errorf("manifest: invalid hash of chunk %d", i)
+		}
+		m.Chunks[i] = c
+	}
+
+	if m.Signature, err = sm.Signature.decode(); err != nil {
+		return nil, fmt.Errorf("manifest: %s", err)
+	}
+
+	// the sizes must be consistent with the number of chunks
+	if len(m.Chunks) == 0 {
+		return nil, fmt.Errorf("manifest: no chunks")
+	}
+	if _, _, err = m.ChunkRange(len(m.Chunks) - 1); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _ io.Reader = &manifestReader{}
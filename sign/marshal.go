@@ -0,0 +1,199 @@
+// marshal.go -- JSON and CBOR encoding of signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The JSON encoding of a signature uses the same fields as the YAML
+// signature file:
+//
+//    {
+//      "comment": "untrusted comment",
+//      "pkhash": "base64",
+//      "pk": "base64",
+//      "cert": "base64",
+//      "signature": "base64",
+//      "attrs": {
+//        "filename": "..", "size": N, "hash": "sha512",
+//        "time": "RFC3339", "comment": "trusted comment"
+//      },
+//      "roughtime": {"server": "..", "pk": "base64", "response": "base64"}
+//    }
+//
+// The CBOR encoding is a map with small integer keys and byte strings:
+//
+//    1: comment, 2: pkhash, 3: pk, 4: signature,
+//    5: attrs {1: filename, 2: size, 3: hash, 4: time (unix seconds), 5: comment},
+//    6: subkey certificate,
+//    7: roughtime {1: server, 2: pk, 3: response}
+//
+// Optional fields are omitted when empty. New fields will only be added
+// with new keys.
+
+package sign
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type cborSignature struct {
+	Comment   string     `cbor:"1,keyasint,omitempty"`
+	Pkhash    []byte     `cbor:"2,keyasint"`
+	Pk        []byte     `cbor:"3,keyasint,omitempty"`
+	Signature []byte     `cbor:"4,keyasint"`
+	Attrs     *cborAttrs `cbor:"5,keyasint,omitempty"`
+	Cert      []byte     `cbor:"6,keyasint,omitempty"`
+
+	Roughtime *cborRoughtime `cbor:"7,keyasint,omitempty"`
+}
+
+type cborAttrs struct {
+	Filename string `cbor:"1,keyasint,omitempty"`
+	Size     int64  `cbor:"2,keyasint"`
+	HashAlgo string `cbor:"3,keyasint"`
+	Time     int64  `cbor:"4,keyasint"`
+	Comment  string `cbor:"5,keyasint,omitempty"`
+}
+
+type cborRoughtime struct {
+	Server   string `cbor:"1,keyasint,omitempty"`
+	Pk       []byte `cbor:"2,keyasint"`
+	Response []byte `cbor:"3,keyasint"`
+}
+
+// MarshalJSON encodes the signature as JSON
+func (sig *Signature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sig.serialize(sig.Comment))
+}
+
+// UnmarshalJSON decodes a JSON encoded signature
+func (sig *Signature) UnmarshalJSON(b []byte) error {
+	var ss signature
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("can't parse JSON signature: %s", err)
+	}
+
+	if len(ss.Signature) == 0 {
+		return fmt.Errorf("not a JSON signature")
+	}
+
+	s, err := ss.decode()
+	if err != nil {
+		return err
+	}
+
+	*sig = *s
+	return nil
+}
+
+// MarshalCBOR encodes the signature as CBOR
+func (sig *Signature) MarshalCBOR() ([]byte, error) {
+	cs := &cborSignature{
+		Comment:   sig.Comment,
+		Pkhash:    sig.pkhash,
+		Signature: sig.Sig,
+	}
+
+	if sig.PublicKey != nil {
+		cs.Pk = sig.PublicKey.Pk
+		if c := sig.PublicKey.cert; c != nil {
+			cs.Cert = c.marshal(true)
+		}
+	}
+
+	if a := sig.Attrs; a != nil {
+		cs.Attrs = &cborAttrs{
+			Filename: a.Filename,
+			Size:     a.Size,
+			HashAlgo: a.HashAlgo,
+			Time:     a.Time.Unix(),
+			Comment:  a.Comment,
+		}
+	}
+
+	if p := sig.Roughtime; p != nil {
+		cs.Roughtime = &cborRoughtime{
+			Server:   p.Server,
+			Pk:       p.PublicKey,
+			Response: p.Response,
+		}
+	}
+
+	em, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	return em.Marshal(cs)
+}
+
+// UnmarshalCBOR decodes a CBOR encoded signature
+func (sig *Signature) UnmarshalCBOR(b []byte) error {
+	var cs cborSignature
+	if err := cbor.Unmarshal(b, &cs); err != nil {
+		return fmt.Errorf("can't parse CBOR signature: %s", err)
+	}
+
+	if len(cs.Signature) == 0 || len(cs.Pkhash) == 0 {
+		return fmt.Errorf("not a CBOR signature")
+	}
+
+	s := &Signature{
+		Sig:     cs.Signature,
+		pkhash:  cs.Pkhash,
+		Comment: cs.Comment,
+	}
+
+	if len(cs.Pk) > 0 {
+		pk, err := PublicKeyFromBytes(cs.Pk)
+		if err != nil {
+			return err
+		}
+
+		if !s.IsPKMatch(pk) {
+			return fmt.Errorf("signature public key doesn't match its hash")
+		}
+
+		if len(cs.Cert) > 0 {
+			if err := pk.decodeCert(cs.Cert); err != nil {
+				return err
+			}
+		}
+		s.PublicKey = pk
+	}
+
+	if a := cs.Attrs; a != nil {
+		if _, err := contentHash(a.HashAlgo); err != nil {
+			return err
+		}
+
+		s.Attrs = &Attributes{
+			Filename: a.Filename,
+			Size:     a.Size,
+			HashAlgo: a.HashAlgo,
+			Time:     time.Unix(a.Time, 0).UTC(),
+			Comment:  a.Comment,
+		}
+	}
+
+	if p := cs.Roughtime; p != nil {
+		s.Roughtime = &RoughtimeProof{
+			Server:    p.Server,
+			PublicKey: p.Pk,
+			Response:  p.Response,
+		}
+	}
+
+	*sig = *s
+	return nil
+}
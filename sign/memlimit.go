@@ -0,0 +1,73 @@
+// memlimit.go -- limit the memory used for decryption
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync/atomic"
+)
+
+// package wide memory limit for new Decryptors; 0 means no limit
+var decryptMemLimit uint64
+
+// SetDecryptMemoryLimit sets the package wide limit (in bytes) on the
+// memory a Decryptor allocates for the header and the chunk buffers. It
+// applies to Decryptors created after the call; a limit of 0 (the
+// default) only enforces the built-in maximum header and chunk sizes.
+func SetDecryptMemoryLimit(n uint64) {
+	atomic.StoreUint64(&decryptMemLimit, n)
+}
+
+// SetMemoryLimit sets the limit (in bytes) on the memory this Decryptor
+// allocates for the header and the chunk buffers. It must be called before
+// SetPrivateKey(); it returns an error if the header already read from
+// the input and the chunk buffer exceed the limit.
+func (d *Decryptor) SetMemoryLimit(n uint64) error {
+	if d.ae != nil {
+		return fmt.Errorf("decrypt: can't set memory limit after SetPrivateKey()")
+	}
+
+	d.memLimit = n
+	return d.checkMem("header and chunk buffer", d.memNeeded(false))
+}
+
+// memory needed for the header and chunk buffers; a stream reader needs
+// an additional chunk sized buffer.
+func (d *Decryptor) memNeeded(stream bool) uint64 {
+	// 16 == AES-GCM tag size
+	n := uint64(d.hdrlen) + uint64(d.ChunkSize) + 16
+	if stream {
+		n += uint64(d.ChunkSize)
+	}
+	return n
+}
+
+// return an error if 'need' bytes exceed the memory limit
+func (d *Decryptor) checkMem(what string, need uint64) error {
+	if d.memLimit > 0 && need > d.memLimit {
+		return fmt.Errorf("decrypt: %s need %d bytes of memory; exceeds the limit of %d bytes (chunk size %d)",
+			what, need, d.memLimit, d.ChunkSize)
+	}
+	return nil
+}
+
+// check the size of the variable header before allocating it
+func checkHeaderMem(limit uint64, varSize uint32) error {
+	need := uint64(_FixedHdrLen) + uint64(varSize) + sha256.Size
+	if limit > 0 && need > limit {
+		return fmt.Errorf("decrypt: header needs %d bytes of memory; exceeds the limit of %d bytes", need, limit)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// mmap.go -- read files with mmap(2)
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !js && !wasip1 && !windows
+// +build !js,!wasip1,!windows
+
+package sign
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencoff/go-utils"
+)
+
+// write 'sz' bytes of 'fd' at offset 'off' (all of it if 'sz' is 0) to
+// 'wr'; it returns the number of bytes written
+func mmapReader(fd *os.File, off, sz int64, wr io.Writer) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("mmap: can't stat: %s", err)
+	}
+
+	// pipes and devices can't be mapped and have no size
+	if !st.Mode().IsRegular() {
+		return streamReader(fd, off, sz, wr)
+	}
+	return utils.MmapReader(fd, off, sz, wr)
+}
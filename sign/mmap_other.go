@@ -0,0 +1,46 @@
+// mmap_other.go -- read files on platforms without mmap(2)
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build js || wasip1 || windows
+// +build js wasip1 windows
+
+package sign
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// write 'sz' bytes of 'fd' at offset 'off' (all of it if 'sz' is 0) to
+// 'wr'; it returns the number of bytes written
+func mmapReader(fd *os.File, off, sz int64, wr io.Writer) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("read: can't stat: %s", err)
+	}
+
+	if !st.Mode().IsRegular() {
+		return streamReader(fd, off, sz, wr)
+	}
+
+	fsz := st.Size()
+	if off > fsz {
+		return 0, fmt.Errorf("can't read offset %v outside filesize %v", off, fsz)
+	}
+
+	if sz == 0 || sz+off > fsz {
+		sz = fsz - off
+	}
+	return io.Copy(wr, io.NewSectionReader(fd, off, sz))
+}
@@ -0,0 +1,552 @@
+// noise.go -- Noise protocol handshakes with sigtool keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// This file implements the XX and IK handshakes of the Noise protocol
+// framework (revision 34) with X25519, ChaCha20-Poly1305 and SHA256:
+//
+//    Noise_XX_25519_ChaChaPoly_SHA256     Noise_IK_25519_ChaChaPoly_SHA256
+//      -> e                                 <- s
+//      <- e, ee, s, es                      ...
+//      -> s, se                             -> e, es, s, ss
+//                                           <- e, ee, se
+//
+// The static key of a sigtool identity is its X25519 key: the native
+// one if the key has it, else the one derived from the Ed25519 key (as
+// for encryption). Other Noise implementations interoperate with it as
+// long as both ends agree on the prologue and on how messages are framed;
+// NoiseConn() sends each message after its length as a uint16_be.
+
+package sign
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// NoiseXX is the Noise handshake where the parties send their static
+	// keys to each other
+	NoiseXX = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+	// NoiseIK is the Noise handshake where the initiator knows the static
+	// key of the responder
+	NoiseIK = "Noise_IK_25519_ChaChaPoly_SHA256"
+
+	// largest Noise message
+	_NoiseMaxMsg = 65535
+	_NoiseTagLen = 16
+)
+
+// the message patterns of the handshakes; the initiator sends the even
+// numbered messages.
+var noisePatterns = map[string][][]string{
+	NoiseXX: {{"e"}, {"e", "ee", "s", "es"}, {"s", "se"}},
+	NoiseIK: {{"e", "es", "s", "ss"}, {"e", "ee", "se"}},
+}
+
+// ErrNoiseDone is returned after the last message of a handshake
+var ErrNoiseDone = errors.New("noise: handshake is complete")
+
+// NoiseHandshake is the state of one end of a Noise handshake
+type NoiseHandshake struct {
+	msgs      [][]string
+	initiator bool
+
+	ck, h []byte
+	c     NoiseCipher
+
+	s, spub []byte
+	e, epub []byte
+	rs, re  []byte
+
+	// the expected static key of the peer; nil if any
+	peer []byte
+
+	next int
+}
+
+// NoiseCipher encrypts the messages of one direction of a Noise
+// session
+type NoiseCipher struct {
+	ae cipher.AEAD
+	n  uint64
+}
+
+// NewNoiseHandshake starts the handshake 'protocol' (NoiseXX or NoiseIK)
+// with the private key 'sk'. If 'peer' isn't nil, the peer's static key
+// must be its X25519 key; it is required for the initiator of NoiseIK.
+// Both ends must use the same 'prologue'.
+func NewNoiseHandshake(protocol string, initiator bool, sk *PrivateKey, peer *PublicKey, prologue []byte) (*NoiseHandshake, error) {
+	msgs, ok := noisePatterns[protocol]
+	if !ok {
+		return nil, fmt.Errorf("noise: unsupported protocol %s", protocol)
+	}
+
+	if err := fipsRefuse("X25519"); err != nil {
+		return nil, fmt.Errorf("noise: %s", err)
+	}
+
+	if err := sk.checkUsage(UsageEncrypt); err != nil {
+		return nil, fmt.Errorf("noise: %s", err)
+	}
+
+	s := sk.encryptionKeys()[0]
+	if s == nil {
+		return nil, fmt.Errorf("noise: private key %x has no X25519 key", sk.pk.hash)
+	}
+
+	spub, err := x25519Public(s)
+	if err != nil {
+		return nil, fmt.Errorf("noise: %s", err)
+	}
+
+	hs := &NoiseHandshake{
+		msgs:      msgs,
+		initiator: initiator,
+		s:         s,
+		spub:      spub,
+	}
+
+	if peer != nil {
+		if hs.peer, err = peer.toCurve25519PK(); err != nil {
+			return nil, fmt.Errorf("noise: %s", err)
+		}
+	}
+
+	// the protocol names are exactly 32 bytes long
+	hs.h = []byte(protocol)
+	hs.ck = append([]byte{}, hs.h...)
+	hs.mixHash(prologue)
+
+	if protocol == NoiseIK {
+		if initiator {
+			if hs.peer == nil {
+				return nil, fmt.Errorf("noise: IK initiator needs the static key of the responder")
+			}
+			hs.rs = hs.peer
+			hs.mixHash(hs.rs)
+		} else {
+			hs.mixHash(hs.spub)
+		}
+	}
+	return hs, nil
+}
+
+// Complete returns true after the last message of the handshake
+func (hs *NoiseHandshake) Complete() bool {
+	return hs.next == len(hs.msgs)
+}
+
+// PeerStatic returns the static X25519 key of the peer; it is known
+// once the message that carries it has been read.
+func (hs *NoiseHandshake) PeerStatic() []byte {
+	return hs.rs
+}
+
+// HandshakeHash returns the hash of the whole handshake; both ends have
+// the same one and it can bind the session to a higher level protocol.
+func (hs *NoiseHandshake) HandshakeHash() []byte {
+	return hs.h
+}
+
+// WriteMessage returns the next handshake message with 'payload'
+func (hs *NoiseHandshake) WriteMessage(payload []byte) ([]byte, error) {
+	if hs.Complete() {
+		return nil, ErrNoiseDone
+	}
+	if !hs.ourTurn() {
+		return nil, fmt.Errorf("noise: it is the peer's turn to send")
+	}
+
+	var msg []byte
+	var err error
+	for _, tok := range hs.msgs[hs.next] {
+		switch tok {
+		case "e":
+			if hs.e, hs.epub, err = newSender(); err != nil {
+				return nil, fmt.Errorf("noise: %s", err)
+			}
+			msg = append(msg, hs.epub...)
+			hs.mixHash(hs.epub)
+
+		case "s":
+			msg = hs.encryptAndHash(msg, hs.spub)
+
+		default:
+			if err = hs.mixDH(tok); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	msg = hs.encryptAndHash(msg, payload)
+	if len(msg) > _NoiseMaxMsg {
+		return nil, fmt.Errorf("noise: message too long (%d bytes)", len(msg))
+	}
+	hs.next++
+	return msg, nil
+}
+
+// ReadMessage reads the next handshake message and returns its payload
+func (hs *NoiseHandshake) ReadMessage(msg []byte) ([]byte, error) {
+	if hs.Complete() {
+		return nil, ErrNoiseDone
+	}
+	if hs.ourTurn() {
+		return nil, fmt.Errorf("noise: it is our turn to send")
+	}
+	if len(msg) > _NoiseMaxMsg {
+		return nil, fmt.Errorf("noise: message too long (%d bytes)", len(msg))
+	}
+
+	errShort := fmt.Errorf("noise: message %d is too short", hs.next)
+	for _, tok := range hs.msgs[hs.next] {
+		switch tok {
+		case "e":
+			if len(msg) < 32 {
+				return nil, errShort
+			}
+			hs.re = append([]byte{}, msg[:32]...)
+			msg = msg[32:]
+			hs.mixHash(hs.re)
+
+		case "s":
+			n := 32
+			if hs.c.ae != nil {
+				n += _NoiseTagLen
+			}
+			if len(msg) < n {
+				return nil, errShort
+			}
+
+			rs, err := hs.decryptAndHash(msg[:n])
+			if err != nil {
+				return nil, err
+			}
+			if hs.peer != nil && subtle.ConstantTimeCompare(rs, hs.peer) != 1 {
+				return nil, fmt.Errorf("noise: peer's static key isn't the expected key")
+			}
+			hs.rs = rs
+			msg = msg[n:]
+
+		default:
+			if err := hs.mixDH(tok); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := hs.decryptAndHash(msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.next++
+	return payload, nil
+}
+
+// Split returns the ciphers of the messages sent and received after
+// the handshake
+func (hs *NoiseHandshake) Split() (send, recv *NoiseCipher, err error) {
+	if !hs.Complete() {
+		return nil, nil, fmt.Errorf("noise: handshake isn't complete")
+	}
+
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	c1, err := newNoiseCipher(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newNoiseCipher(k2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hs.initiator {
+		return c1, c2, nil
+	}
+	return c2, c1, nil
+}
+
+// true if the initiator sends the next message
+func (hs *NoiseHandshake) ourTurn() bool {
+	return (hs.next%2 == 0) == hs.initiator
+}
+
+// mix the DH of the token 'tok' into the chaining key
+func (hs *NoiseHandshake) mixDH(tok string) error {
+	var sk, pk []byte
+	switch tok {
+	case "ee":
+		sk, pk = hs.e, hs.re
+	case "ss":
+		sk, pk = hs.s, hs.rs
+	case "es":
+		if hs.initiator {
+			sk, pk = hs.e, hs.rs
+		} else {
+			sk, pk = hs.s, hs.re
+		}
+	case "se":
+		if hs.initiator {
+			sk, pk = hs.s, hs.re
+		} else {
+			sk, pk = hs.e, hs.rs
+		}
+	default:
+		return fmt.Errorf("noise: unknown token %s", tok)
+	}
+
+	dh, err := x25519(sk, pk)
+	if err != nil {
+		return fmt.Errorf("noise: %s: %s", tok, err)
+	}
+
+	ck, k := noiseHKDF(hs.ck, dh)
+	hs.ck = ck
+	ae, err := newNoiseCipher(k)
+	if err != nil {
+		return err
+	}
+	hs.c = *ae
+	return nil
+}
+
+func (hs *NoiseHandshake) mixHash(b []byte) {
+	h := sha256.New()
+	h.Write(hs.h)
+	h.Write(b)
+	hs.h = h.Sum(nil)
+}
+
+// append the encrypted 'p' to 'msg' and mix it into the hash
+func (hs *NoiseHandshake) encryptAndHash(msg, p []byte) []byte {
+	n := len(msg)
+	if hs.c.ae == nil {
+		msg = append(msg, p...)
+	} else {
+		msg, _ = hs.c.Encrypt(msg, hs.h, p)
+	}
+	hs.mixHash(msg[n:])
+	return msg
+}
+
+func (hs *NoiseHandshake) decryptAndHash(c []byte) ([]byte, error) {
+	p := c
+	if hs.c.ae != nil {
+		var err error
+		if p, err = hs.c.Decrypt(nil, hs.h, c); err != nil {
+			return nil, err
+		}
+	}
+	hs.mixHash(c)
+	return append([]byte{}, p...), nil
+}
+
+// the HKDF of the Noise spec with two outputs
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	var out [64]byte
+
+	io.ReadFull(hkdf.New(sha256.New, ikm, ck, nil), out[:])
+	return out[:32], out[32:]
+}
+
+func newNoiseCipher(k []byte) (*NoiseCipher, error) {
+	ae, err := chacha20poly1305.New(k)
+	if err != nil {
+		return nil, fmt.Errorf("noise: %s", err)
+	}
+	return &NoiseCipher{ae: ae}, nil
+}
+
+// Encrypt appends the encryption of 'p' with the additional data 'ad'
+// to 'out'
+func (c *NoiseCipher) Encrypt(out, ad, p []byte) ([]byte, error) {
+	if c.n == math.MaxUint64 {
+		return nil, fmt.Errorf("noise: nonces exhausted")
+	}
+
+	out = c.ae.Seal(out, c.nonce(), p, ad)
+	c.n++
+	return out, nil
+}
+
+// Decrypt appends the decryption of 'ct' with the additional data 'ad'
+// to 'out'
+func (c *NoiseCipher) Decrypt(out, ad, ct []byte) ([]byte, error) {
+	if c.n == math.MaxUint64 {
+		return nil, fmt.Errorf("noise: nonces exhausted")
+	}
+
+	out, err := c.ae.Open(out, c.nonce(), ct, ad)
+	if err != nil {
+		return nil, fmt.Errorf("noise: message %d: %s", c.n, err)
+	}
+	c.n++
+	return out, nil
+}
+
+// 32 bits of zeros and the little endian count of messages
+func (c *NoiseCipher) nonce() []byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(n[4:], c.n)
+	return n[:]
+}
+
+// noiseConn is a net.Conn of Noise transport messages
+type noiseConn struct {
+	net.Conn
+
+	rmu    sync.Mutex
+	rd     *NoiseCipher
+	rbuf   []byte
+	unread []byte
+	rerr   error
+
+	wmu  sync.Mutex
+	wr   *NoiseCipher
+	wbuf []byte
+	werr error
+}
+
+// NoiseConn runs the handshake 'protocol' (see NewNoiseHandshake) over
+// 'conn' and returns a connection that sends Noise transport messages.
+// Every message is preceded by its length as a uint16_be. The handshake
+// messages carry no payload. Noise has no end of stream message: the
+// application must tell a complete stream from a truncated one. 'conn'
+// isn't closed if the handshake fails.
+func NoiseConn(conn net.Conn, protocol string, initiator bool, sk *PrivateKey, peer *PublicKey) (net.Conn, error) {
+	hs, err := NewNoiseHandshake(protocol, initiator, sk, peer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2+_NoiseMaxMsg)
+	for !hs.Complete() {
+		if hs.ourTurn() {
+			msg, err := hs.WriteMessage(nil)
+			if err != nil {
+				return nil, err
+			}
+
+			binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+			copy(buf[2:], msg)
+			if _, err = conn.Write(buf[:2+len(msg)]); err != nil {
+				return nil, fmt.Errorf("noise: %s", err)
+			}
+			continue
+		}
+
+		msg, err := noiseRead(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = hs.ReadMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &noiseConn{
+		Conn: conn,
+		rbuf: make([]byte, 2+_NoiseMaxMsg),
+		wbuf: buf,
+	}
+	if c.wr, c.rd, err = hs.Split(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// read the next message into 'buf'
+func noiseRead(rd io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(rd, buf[:2]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(buf))
+	msg := buf[2 : 2+n]
+	if _, err := io.ReadFull(rd, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Read implements the io.Reader interface
+func (c *noiseConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.unread) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+
+		msg, err := noiseRead(c.Conn, c.rbuf)
+		if err == nil {
+			c.unread, err = c.rd.Decrypt(msg[:0], nil, msg)
+		}
+		if err != nil {
+			c.rerr = err
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// Write implements the io.Writer interface
+func (c *noiseConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+	for len(b) > 0 {
+		if c.werr != nil {
+			return n, c.werr
+		}
+
+		p := b
+		if len(p) > _NoiseMaxMsg-_NoiseTagLen {
+			p = p[:_NoiseMaxMsg-_NoiseTagLen]
+		}
+
+		msg, err := c.wr.Encrypt(c.wbuf[:2], nil, p)
+		if err == nil {
+			binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+			_, err = c.Conn.Write(msg)
+		}
+		if err != nil {
+			c.werr = err
+			return n, err
+		}
+
+		n += len(p)
+		b = b[len(p):]
+	}
+	return n, nil
+}
@@ -0,0 +1,198 @@
+// offline.go -- signing requests for air-gapped signers
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A signing request carries the checksum of the content to be signed and
+// the attributes of the signature; it is all an air-gapped signer needs:
+//
+//    request: sigtool signing request v1
+//    comment: input=release.tar.gz
+//    checksum: base64
+//    filename: release.tar.gz
+//    size: 4294967296
+//    hash: sha512
+//    attrs: true
+//    trusted-comment: release 1.0
+//
+// The signature made from a request is an ordinary signature of the
+// content.
+
+package sign
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SigningRequest describes content to be signed elsewhere
+type SigningRequest struct {
+	// Checksum of the content
+	Checksum []byte
+
+	// Name (without its directory) and size of the content
+	Filename string
+	Size     int64
+
+	// Embed signed attributes in the signature; the signing time is the
+	// time at which the request is signed.
+	Attrs bool
+
+	// Trusted comment of the signature; it implies Attrs
+	TrustedComment string
+
+	// Untrusted comment of the signature
+	Comment string
+}
+
+const _RequestMagic = "sigtool signing request v1"
+
+// serialized signing request
+type serializedRequest struct {
+	Request        string `yaml:"request"`
+	Comment        string `yaml:"comment,omitempty"`
+	Checksum       string `yaml:"checksum"`
+	Filename       string `yaml:"filename,omitempty"`
+	Size           int64  `yaml:"size"`
+	HashAlgo       string `yaml:"hash"`
+	Attrs          bool   `yaml:"attrs"`
+	TrustedComment string `yaml:"trusted-comment,omitempty"`
+}
+
+// NewSigningRequest makes a request to sign the file 'fn'
+func NewSigningRequest(fn string) (*SigningRequest, error) {
+	ck, sz, err := fileCksum(fn, sha512.New())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SigningRequest{
+		Checksum: ck,
+		Filename: filepath.Base(fn),
+		Size:     sz,
+	}
+	return r, nil
+}
+
+// ReadSigningRequest reads the signing request in file 'fn'
+func ReadSigningRequest(fn string) (*SigningRequest, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := MakeSigningRequest(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return r, nil
+}
+
+// MakeSigningRequest parses a serialized signing request
+func MakeSigningRequest(b []byte) (*SigningRequest, error) {
+	var sr serializedRequest
+
+	if err := yaml.UnmarshalStrict(b, &sr); err != nil {
+		return nil, fmt.Errorf("can't parse signing request: %s", err)
+	}
+
+	if sr.Request != _RequestMagic {
+		return nil, fmt.Errorf("not a signing request")
+	}
+
+	if sr.HashAlgo != hashSHA512 {
+		return nil, fmt.Errorf("signing request: unsupported hash algorithm %q", sr.HashAlgo)
+	}
+
+	ck, err := base64.StdEncoding.DecodeString(sr.Checksum)
+	if err != nil || len(ck) != 64 {
+		return nil, fmt.Errorf("signing request: invalid checksum <%s>", sr.Checksum)
+	}
+
+	r := &SigningRequest{
+		Checksum:       ck,
+		Filename:       sr.Filename,
+		Size:           sr.Size,
+		Attrs:          sr.Attrs || len(sr.TrustedComment) > 0,
+		TrustedComment: sr.TrustedComment,
+		Comment:        sr.Comment,
+	}
+	return r, nil
+}
+
+// Serialize the signing request
+func (r *SigningRequest) Serialize() ([]byte, error) {
+	sr := &serializedRequest{
+		Request:        _RequestMagic,
+		Comment:        r.Comment,
+		Checksum:       base64.StdEncoding.EncodeToString(r.Checksum),
+		Filename:       r.Filename,
+		Size:           r.Size,
+		HashAlgo:       hashSHA512,
+		Attrs:          r.Attrs || len(r.TrustedComment) > 0,
+		TrustedComment: r.TrustedComment,
+	}
+
+	out, err := yaml.Marshal(sr)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal signing request: %s", err)
+	}
+	return out, nil
+}
+
+// SignRequest signs the content described by the request 'r'
+func (sk *PrivateKey) SignRequest(r *SigningRequest) (*Signature, error) {
+	var sig *Signature
+	var err error
+
+	if r.Attrs || len(r.TrustedComment) > 0 {
+		a := &Attributes{
+			Filename: r.Filename,
+			Size:     r.Size,
+			Time:     time.Now(),
+			Comment:  r.TrustedComment,
+		}
+		sig, err = sk.SignMessageWithAttrs(r.Checksum, a)
+	} else {
+		sig, err = sk.SignMessage(r.Checksum, r.Filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sig.Comment = r.Comment
+	return sig, nil
+}
+
+// VerifyResponse verifies the signatures 'sigs' made from a signing
+// request for the file 'fn' with the keys they carry; the signatures must
+// still be verified with trusted keys.
+func VerifyResponse(fn string, sigs []*Signature) error {
+	var pks []*PublicKey
+	for i, sig := range sigs {
+		if sig.PublicKey == nil {
+			return fmt.Errorf("signature %d doesn't carry its public key", i)
+		}
+		pks = append(pks, sig.PublicKey)
+	}
+
+	_, err := VerifyFileResult(fn, sigs, pks, len(sigs))
+	if err == ErrTooFewSignatures {
+		return fmt.Errorf("%s: signature doesn't match the file", fn)
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+// parse.go -- parse recipients and identities from strings
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Keys are given to sigtool in many forms: file names, OpenSSH public key
+// lines, raw keys in hex or base64 and age keys. ParseRecipient and
+// ParseIdentity accept all of these so that callers don't have to guess.
+//
+// age keys are X25519-only; they have no Ed25519 key and can only be
+// used for encryption.
+
+package sign
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	Ed "crypto/ed25519"
+)
+
+const (
+	_AgeRecipientHRP = "age"
+	_AgeIdentityHRP  = "age-secret-key-"
+)
+
+// ParseRecipient parses a public key 's' given as one of:
+//   - the name of a sigtool (YAML or PEM), OpenSSH or signify public key file
+//   - a URI of a registered recipient scheme ("kms://..")
+//   - a sigtool PEM key
+//   - an OpenSSH public key line ("ssh-ed25519 AAAA.. [comment]")
+//   - an age recipient ("age1..")
+//   - a raw Ed25519 public key in hex or base64
+func ParseRecipient(s string) (*PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return nil, fmt.Errorf("parse recipient: empty key")
+	}
+
+	if _, ok := uriScheme(s); ok {
+		return parseRecipientURI(s)
+	}
+
+	if isFile(s) {
+		return ReadPublicKey(s)
+	}
+
+	switch {
+	case isPEMKey([]byte(s)):
+		pk, err := MakePublicKey([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("parse recipient: %s", err)
+		}
+		return pk, nil
+
+	case strings.HasPrefix(s, _AgeRecipientHRP+"1"):
+		return parseAgeRecipient(s)
+
+	case isKeyType(s):
+		pk, err := parseSSHPublicKey([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("parse recipient: %s", err)
+		}
+		return pk, nil
+	}
+
+	b, ok := decodeRawKey(s)
+	if !ok || len(b) != Ed.PublicKeySize {
+		return nil, fmt.Errorf("parse recipient: unrecognized public key %q", s)
+	}
+	return PublicKeyFromBytes(b)
+}
+
+// ParseIdentity parses a private key 's' given as one of:
+//   - the name of a sigtool (YAML or PEM) or OpenSSH private key file
+//   - a URI of a registered identity scheme ("kms://..")
+//   - a sigtool PEM key
+//   - an OpenSSH private key (PEM)
+//   - an age identity ("AGE-SECRET-KEY-1..")
+//   - a raw Ed25519 private key or seed in hex or base64
+//   - a derived identity "passphrase:SALT" (see DeriveKeypair())
+//   - a key held by the agent "agent:FP" (see Agent)
+//   - a key held by the agent of another host "ssh://host/FP"
+//
+// getpw is called to get the passphrase of encrypted keys (and of derived
+// identities); if nil, the default prompter is asked (see
+// SetPassphrasePrompter()).
+func ParseIdentity(s string, getpw func() ([]byte, error)) (*PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return nil, fmt.Errorf("parse identity: empty key")
+	}
+
+	if getpw == nil {
+		getpw = promptFunc(nil, identityName(s), false)
+	}
+
+	if strings.HasPrefix(s, RemoteIdentityPrefix) {
+		return parseRemoteIdentity(s)
+	}
+
+	if _, ok := uriScheme(s); ok {
+		return parseIdentityURI(s)
+	}
+
+	if isFile(s) {
+		return ReadPrivateKey(s, getpw)
+	}
+
+	switch {
+	case strings.HasPrefix(s, DerivedIdentityPrefix):
+		return parseDerivedIdentity(s, getpw)
+
+	case strings.HasPrefix(s, AgentIdentityPrefix):
+		return parseAgentIdentity(s)
+
+	case strings.HasPrefix(strings.ToLower(s), _AgeIdentityHRP+"1"):
+		return parseAgeIdentity(s)
+
+	case isPEMKey([]byte(s)):
+		if err := checkPEMPrivateKey([]byte(s)); err != nil {
+			return nil, fmt.Errorf("parse identity: %s", err)
+		}
+
+		pw, err := getpw()
+		if err != nil {
+			return nil, err
+		}
+
+		sk, err := MakePrivateKey([]byte(s), pw)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity: %s", err)
+		}
+		return sk, nil
+
+	case strings.Contains(s, "OPENSSH PRIVATE KEY-"):
+		sk, err := parseSSHPrivateKey([]byte(s), getpw)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity: %s", err)
+		}
+		return sk, nil
+	}
+
+	b, ok := decodeRawKey(s)
+	if ok {
+		switch len(b) {
+		case Ed.PrivateKeySize:
+			return PrivateKeyFromBytes(b)
+		case Ed.SeedSize:
+			return PrivateKeyFromBytes(Ed.NewKeyFromSeed(b))
+		}
+	}
+	return nil, fmt.Errorf("parse identity: unrecognized private key")
+}
+
+// parse an age X25519 recipient
+func parseAgeRecipient(s string) (*PublicKey, error) {
+	hrp, xpk, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse recipient: %s", err)
+	}
+
+	if hrp != _AgeRecipientHRP || len(xpk) != 32 {
+		return nil, fmt.Errorf("parse recipient: malformed age recipient")
+	}
+
+	pk := &PublicKey{
+		Usage: UsageEncrypt,
+		xpk:   xpk,
+		hash:  pkhash(xpk),
+	}
+	return pk, nil
+}
+
+// parse an age X25519 identity
+func parseAgeIdentity(s string) (*PrivateKey, error) {
+	hrp, xsk, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse identity: %s", err)
+	}
+
+	if hrp != _AgeIdentityHRP || len(xsk) != 32 {
+		return nil, fmt.Errorf("parse identity: malformed age identity")
+	}
+
+	xpk, err := x25519Public(xsk)
+	if err != nil {
+		return nil, fmt.Errorf("parse identity: %s", err)
+	}
+
+	sk := &PrivateKey{
+		Usage: UsageEncrypt,
+		xsk:   xsk,
+		pk: &PublicKey{
+			Usage: UsageEncrypt,
+			xpk:   xpk,
+			hash:  pkhash(xpk),
+		},
+	}
+	return sk, nil
+}
+
+// decode a raw key in hex or base64
+func decodeRawKey(s string) ([]byte, bool) {
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, true
+	}
+
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// true if 's' names a file; named pipes (and process substitution) are
+// files too
+func isFile(s string) bool {
+	st, err := os.Stat(s)
+	return err == nil && !st.IsDir()
+}
@@ -0,0 +1,48 @@
+// perms.go -- permissions of private key files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+var insecureKeyPerms int32
+
+// SetInsecureKeyPerms allows private key files that the group or others
+// can access. By default, like OpenSSH, such files are refused.
+func SetInsecureKeyPerms(ok bool) {
+	var v int32
+	if ok {
+		v = 1
+	}
+	atomic.StoreInt32(&insecureKeyPerms, v)
+}
+
+// refuse the private key file 'fn' if it is accessible by others; pipes
+// and other special files aren't checked.
+func checkKeyPerms(fn string) error {
+	if atomic.LoadInt32(&insecureKeyPerms) != 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil || !fi.Mode().IsRegular() || !keyPermsOpen(fi) {
+		return nil
+	}
+
+	return fmt.Errorf("%s: permissions %04o are too open; a private key file must not be accessible by others (chmod 600 %s)",
+		fn, fi.Mode().Perm(), fn)
+}
@@ -0,0 +1,36 @@
+// perms_other.go -- permissions of private key files and sockets elsewhere
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows || plan9 || js || wasip1
+// +build windows plan9 js wasip1
+
+package sign
+
+import (
+	"net"
+	"os"
+)
+
+// the permission bits don't describe who can read a file (Windows uses
+// ACLs); nothing is checked
+func keyPermsOpen(fi os.FileInfo) bool {
+	return false
+}
+
+func checkPrivate(fn string, typ os.FileMode) error {
+	return nil
+}
+
+func listenPrivate(fn string) (net.Listener, error) {
+	return net.Listen("unix", fn)
+}
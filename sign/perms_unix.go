@@ -0,0 +1,62 @@
+// perms_unix.go -- permissions of private key files and sockets on POSIX systems
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !windows && !plan9 && !js && !wasip1
+// +build !windows,!plan9,!js,!wasip1
+
+package sign
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// true if the group or others can access our file 'fi'; as with OpenSSH,
+// files of other users (e.g., read by root) aren't checked.
+func keyPermsOpen(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && int(st.Uid) != os.Getuid() {
+		return false
+	}
+	return fi.Mode().Perm()&0077 != 0
+}
+
+// error unless 'fn' (not a symlink) is of type 'typ', is ours and only
+// we can access it
+func checkPrivate(fn string, typ os.FileMode) error {
+	fi, err := os.Lstat(fn)
+	if err != nil {
+		return err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	switch {
+	case fi.Mode()&os.ModeType != typ:
+		return fmt.Errorf("%s: wrong file type", fn)
+	case !ok || int(st.Uid) != os.Getuid():
+		return fmt.Errorf("%s: owned by another user", fn)
+	case fi.Mode().Perm()&0077 != 0:
+		return fmt.Errorf("%s: open to other users (mode %04o)", fn, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// listen on the unix socket 'fn' created with mode 0600
+func listenPrivate(fn string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", fn)
+}
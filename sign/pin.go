@@ -0,0 +1,71 @@
+// pin.go -- verification against pinned key fingerprints
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint returns the fingerprint of the public key in the same form
+// as OpenSSH (e.g., "SHA256:wpfEA3..."). Fingerprints of OpenSSH keys
+// match those shown by 'ssh-keygen -l'.
+func (pk *PublicKey) Fingerprint() string {
+	return pk.SSHFingerprint()
+}
+
+// MatchPin returns true if the fingerprint of 'pk' is 'pin'
+func (pk *PublicKey) MatchPin(pin string) bool {
+	fp := pk.Fingerprint()
+	pin = strings.TrimSpace(pin)
+	return len(fp) == len(pin) && subtle.ConstantTimeCompare([]byte(fp), []byte(pin)) == 1
+}
+
+// PinnedKeys returns the public keys carried by the signatures 'sigs'
+// whose fingerprint matches one of the pins. Use the result as the set of
+// trusted keys for VerifyFileThreshold() and friends.
+func PinnedKeys(sigs []*Signature, pins []string) []*PublicKey {
+	var pks []*PublicKey
+	for _, sig := range sigs {
+		pk := sig.PublicKey
+		if pk == nil {
+			continue
+		}
+
+		for _, pin := range pins {
+			if pk.MatchPin(pin) {
+				pks = append(pks, pk)
+				break
+			}
+		}
+	}
+	return pks
+}
+
+// VerifyFilePinned verifies the signatures 'sigs' of file 'fn' and
+// succeeds only if one of them is made by the key with fingerprint 'pin'.
+// It returns the signer's public key.
+func VerifyFilePinned(fn string, sigs []*Signature, pin string) (*PublicKey, error) {
+	pks := PinnedKeys(sigs, []string{pin})
+	if len(pks) == 0 {
+		return nil, fmt.Errorf("verify: no signature by a key with fingerprint %s", pin)
+	}
+
+	good, err := VerifyFileThreshold(fn, sigs, pks, 1)
+	if err != nil {
+		return nil, err
+	}
+	return good[0], nil
+}
@@ -0,0 +1,175 @@
+// policy.go -- encryption policy: mandatory escrow recipients
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A policy file lists the escrow (recovery) keys that must be a recipient
+// of every encrypted file:
+//
+//    escrow:
+//      - name: corporate recovery
+//        key: /etc/sigtool/recovery.pub
+//
+// A key is anything ParseRecipient() accepts; relative paths are relative
+// to the policy file. The wrapped key of an escrow recipient records the
+// key's fingerprint in the header; since the header checksum is bound to
+// every chunk, the record can't be removed without the file key.
+
+package sign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Policy is the encryption policy
+type Policy struct {
+	Escrow []*EscrowKey
+}
+
+// EscrowKey is a recipient added to every encryption
+type EscrowKey struct {
+	Name string
+	Key  *PublicKey
+}
+
+// serialized policy
+type serializedPolicy struct {
+	Escrow []*serializedEscrowKey `yaml:"escrow"`
+}
+
+// serialized escrow key
+type serializedEscrowKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+// ReadPolicy reads the policy in file 'fn'; a missing file is an empty
+// policy. Every escrow key must be usable.
+func ReadPolicy(fn string) (*Policy, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Policy{}, nil
+		}
+		return nil, err
+	}
+
+	p, err := makePolicy(b, filepath.Dir(fn))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return p, nil
+}
+
+// MakePolicy parses a serialized policy; relative key paths are relative
+// to the current directory.
+func MakePolicy(b []byte) (*Policy, error) {
+	return makePolicy(b, "")
+}
+
+func makePolicy(b []byte, dir string) (*Policy, error) {
+	var sp serializedPolicy
+
+	if err := yaml.UnmarshalStrict(b, &sp); err != nil {
+		return nil, fmt.Errorf("policy: can't parse YAML: %s", err)
+	}
+
+	p := &Policy{}
+	for i, s := range sp.Escrow {
+		if s == nil || len(s.Key) == 0 {
+			return nil, fmt.Errorf("policy: escrow key %d: no key", i)
+		}
+
+		name := s.Name
+		if len(name) == 0 {
+			name = s.Key
+		}
+
+		pk, err := ParseRecipient(policyFile(dir, s.Key))
+		if err != nil {
+			return nil, fmt.Errorf("policy: escrow key %s: %s", name, err)
+		}
+		if err = pk.checkUsage(UsageEncrypt); err != nil {
+			return nil, fmt.Errorf("policy: escrow key %s: %s", name, err)
+		}
+
+		p.Escrow = append(p.Escrow, &EscrowKey{Name: name, Key: pk})
+	}
+	return p, nil
+}
+
+// Apply the policy to the Encryptor 'e': the escrow keys are added as
+// recipients and 'e' refuses to encrypt without them.
+func (p *Policy) Apply(e *Encryptor) error {
+	for _, k := range p.Escrow {
+		if err := e.AddEscrowRecipient(k.Key); err != nil {
+			return fmt.Errorf("policy: escrow key %s: %s", k.Name, err)
+		}
+		info(e.log, "encrypt: escrow recipient added", "name", k.Name, "key", escrowID(k.Key))
+	}
+
+	if len(p.Escrow) > 0 {
+		e.RequireEscrow()
+	}
+	return nil
+}
+
+// AddEscrowRecipient adds the escrow key 'pk' as a recipient; the header
+// records the fingerprint of the key as an escrow key.
+func (e *Encryptor) AddEscrowRecipient(pk *PublicKey) error {
+	return e.addRecipient(&recipient{pk: pk, escrow: escrowID(pk)})
+}
+
+// RequireEscrow makes the Encryptor refuse to encrypt unless an escrow
+// recipient is added.
+func (e *Encryptor) RequireEscrow() {
+	e.needEscrow = true
+}
+
+// fail if an escrow recipient is required and missing
+func (e *Encryptor) checkEscrow() error {
+	if !e.needEscrow {
+		return nil
+	}
+
+	for _, w := range e.Keys {
+		if len(w.Escrow) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("encrypt: the policy requires an escrow recipient")
+}
+
+// the file 'fn' of a policy in directory 'dir'; relative names that
+// aren't files there (e.g., inline keys) are used as is.
+func policyFile(dir, fn string) string {
+	if len(dir) == 0 || filepath.IsAbs(fn) {
+		return fn
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, fn)); err == nil {
+		return filepath.Join(dir, fn)
+	}
+	return fn
+}
+
+// the id of the escrow key 'pk' recorded in the header
+func escrowID(pk *PublicKey) string {
+	if fp := recipientFingerprint(pk); len(fp) > 0 {
+		return fp
+	}
+	return pk.scheme
+}
@@ -0,0 +1,103 @@
+// prompt.go -- pluggable passphrase prompt
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PassphrasePrompter asks the user for the passphrase of a private key;
+// e.g., a GUI application shows its own dialog.
+type PassphrasePrompter interface {
+	// Passphrase returns the passphrase of the key 'key' (a file name or a
+	// description of the key); 'confirm' is true for the passphrase of a
+	// new key that should be entered twice.
+	Passphrase(key string, confirm bool) ([]byte, error)
+}
+
+// PassphraseFunc is a function used as a PassphrasePrompter
+type PassphraseFunc func(key string, confirm bool) ([]byte, error)
+
+// Passphrase calls f(key, confirm)
+func (f PassphraseFunc) Passphrase(key string, confirm bool) ([]byte, error) {
+	return f(key, confirm)
+}
+
+// default prompter
+var defaultPrompter struct {
+	sync.Mutex
+	p PassphrasePrompter
+}
+
+// SetPassphrasePrompter sets the prompter used when no passphrase function
+// is given to ParseIdentity(), ReadPrivateKey(), Keypair.Serialize() and
+// GenerateKeypairs(). Without one, a key that needs a passphrase is an
+// error.
+func SetPassphrasePrompter(p PassphrasePrompter) {
+	r := &defaultPrompter
+	r.Lock()
+	r.p = p
+	r.Unlock()
+}
+
+// ParseIdentityPrompt is ParseIdentity() with the passphrase from the
+// prompter 'p' (the default prompter if nil)
+func ParseIdentityPrompt(s string, p PassphrasePrompter) (*PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	return ParseIdentity(s, promptFunc(p, identityName(s), false))
+}
+
+// ReadPrivateKeyPrompt is ReadPrivateKey() with the passphrase from the
+// prompter 'p' (the default prompter if nil)
+func ReadPrivateKeyPrompt(fn string, p PassphrasePrompter) (*PrivateKey, error) {
+	return ReadPrivateKey(fn, promptFunc(p, fn, false))
+}
+
+// SerializePrompt is Serialize() with the passphrase from the prompter 'p'
+// (the default prompter if nil)
+func (kp *Keypair) SerializePrompt(bn, comment string, p PassphrasePrompter) error {
+	return kp.Serialize(bn, comment, promptFunc(p, bn+".key", true))
+}
+
+// return a passphrase function that asks 'p' (or the default prompter)
+// for the passphrase of 'key'
+func promptFunc(p PassphrasePrompter, key string, confirm bool) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		q := p
+		if q == nil {
+			r := &defaultPrompter
+			r.Lock()
+			q = r.p
+			r.Unlock()
+		}
+
+		if q == nil {
+			return nil, fmt.Errorf("%s: no passphrase prompter", key)
+		}
+		return q.Passphrase(key, confirm)
+	}
+}
+
+// name of the identity 's' shown by prompters; inline keys aren't shown
+func identityName(s string) string {
+	switch {
+	case isFile(s), strings.HasPrefix(s, DerivedIdentityPrefix):
+		return s
+	case strings.Contains(s, "OPENSSH PRIVATE KEY-"):
+		return "OpenSSH private key"
+	}
+	return "private key"
+}
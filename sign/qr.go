@@ -0,0 +1,1202 @@
+// qr.go -- QR codes of keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A minimal QR code (ISO/IEC 18004) encoder and decoder for exchanging
+// keys and fingerprints between devices.
+//
+// The encoder uses the byte mode and error correction level M in
+// versions 1 to 15 (up to 412 bytes). The decoder reads codes of levels L
+// and M in the same versions from images of screens or rendered codes;
+// the code can be scaled or rotated but not skewed by perspective.
+
+package sign
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // decode GIF images
+	_ "image/jpeg" // decode JPEG images
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// QRCode is a QR code: a square of dark and light modules
+type QRCode struct {
+	// Number of modules on each side
+	Size int
+
+	modules []bool
+}
+
+// error correction of a version and level: each block has 'ec' error
+// correction codewords; 'n1' blocks have 'k1' data codewords and 'n2'
+// blocks have 'k2' data codewords.
+type qrBlocks struct {
+	ec, n1, k1, n2, k2 int
+}
+
+// error correction levels
+const (
+	qrLevelL = 1
+	qrLevelM = 0
+)
+
+// blocks of error correction level M for versions 1 to 15
+var qrTableM = []qrBlocks{
+	{},
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+	{30, 1, 50, 4, 51},
+	{22, 6, 36, 2, 37},
+	{22, 8, 37, 1, 38},
+	{24, 4, 40, 5, 41},
+	{24, 5, 41, 5, 42},
+}
+
+// blocks of error correction level L for versions 1 to 15
+var qrTableL = []qrBlocks{
+	{},
+	{7, 1, 19, 0, 0},
+	{10, 1, 34, 0, 0},
+	{15, 1, 55, 0, 0},
+	{20, 1, 80, 0, 0},
+	{26, 1, 108, 0, 0},
+	{18, 2, 68, 0, 0},
+	{20, 2, 78, 0, 0},
+	{24, 2, 97, 0, 0},
+	{30, 2, 116, 0, 0},
+	{18, 2, 68, 2, 69},
+	{20, 4, 81, 0, 0},
+	{24, 2, 92, 2, 93},
+	{26, 4, 107, 0, 0},
+	{30, 3, 115, 1, 116},
+	{22, 5, 87, 1, 88},
+}
+
+const (
+	// modules of light border around a rendered code
+	_QRQuietZone = 4
+
+	_QRModeByte = 4
+)
+
+// EncodeQR encodes 'b' as a QR code
+func EncodeQR(b []byte) (*QRCode, error) {
+	for v := 1; v < len(qrTableM); v++ {
+		if 4+qrCountBits(v)+8*len(b) <= 8*qrTableM[v].data() {
+			return qrEncode(b, v), nil
+		}
+	}
+	return nil, fmt.Errorf("qr: %d bytes don't fit in a QR code", len(b))
+}
+
+// Dark returns true if the module at column 'x' and row 'y' is dark
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y*q.Size+x]
+}
+
+// Image renders the code with 'scale' pixels per module and a light
+// border.
+func (q *QRCode) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+
+	n := (q.Size + 2*_QRQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			mx, my := x/scale-_QRQuietZone, y/scale-_QRQuietZone
+			c := color.Gray{Y: 0xff}
+			if mx >= 0 && my >= 0 && mx < q.Size && my < q.Size && q.Dark(mx, my) {
+				c.Y = 0
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+// WritePNG writes the code as a PNG image with 'scale' pixels per module
+func (q *QRCode) WritePNG(w io.Writer, scale int) error {
+	return png.Encode(w, q.Image(scale))
+}
+
+// ANSI renders the code for a terminal: each character is two modules
+// drawn with the upper half block and ANSI colors.
+func (q *QRCode) ANSI() string {
+	var b bytes.Buffer
+
+	dark := func(x, y int) bool {
+		x, y = x-_QRQuietZone, y-_QRQuietZone
+		return x >= 0 && y >= 0 && x < q.Size && y < q.Size && q.Dark(x, y)
+	}
+
+	n := q.Size + 2*_QRQuietZone
+	for y := 0; y < n; y += 2 {
+		for x := 0; x < n; x++ {
+			fg, bg := 97, 107
+			if dark(x, y) {
+				fg = 30
+			}
+			if dark(x, y+1) {
+				bg = 40
+			}
+			fmt.Fprintf(&b, "\x1b[%d;%dm▀", fg, bg)
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String()
+}
+
+// ReadQR decodes the QR code in the image file 'fn' (PNG, JPEG or GIF)
+func ReadQR(fn string) ([]byte, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	img, _, err := image.Decode(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+
+	b, err := DecodeQR(img)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return b, nil
+}
+
+// DecodeQR decodes the QR code in the image 'img'
+func DecodeQR(img image.Image) ([]byte, error) {
+	bm := qrBinarize(img)
+
+	tl, tr, bl, err := bm.finders()
+	if err != nil {
+		return nil, err
+	}
+
+	// modules between the centers of the finder patterns
+	unit := (tl.unit + tr.unit + bl.unit) / 3
+	d := (math.Hypot(tr.x-tl.x, tr.y-tl.y) + math.Hypot(bl.x-tl.x, bl.y-tl.y)) / 2 / unit
+	ver := int(math.Round((d + 7 - 17) / 4))
+
+	// try the nearest versions if the estimate is off
+	err = fmt.Errorf("qr: no QR code found")
+	for _, v := range []int{ver, ver - 1, ver + 1} {
+		if v < 1 || v >= len(qrTableM) {
+			continue
+		}
+
+		var b []byte
+		if b, err = qrDecodeGrid(bm.sample(tl, tr, bl, v), v); err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// -- encoder --
+
+// number of data codewords
+func (bl qrBlocks) data() int {
+	return bl.n1*bl.k1 + bl.n2*bl.k2
+}
+
+// number of bits of the byte count
+func qrCountBits(ver int) int {
+	if ver < 10 {
+		return 8
+	}
+	return 16
+}
+
+// encode 'b' in version 'ver'
+func qrEncode(b []byte, ver int) *QRCode {
+	bl := qrTableM[ver]
+	capacity := 8 * bl.data()
+
+	var bits qrBits
+	bits.add(_QRModeByte, 4)
+	bits.add(len(b), qrCountBits(ver))
+	for _, c := range b {
+		bits.add(int(c), 8)
+	}
+
+	// terminator and padding
+	t := capacity - bits.n
+	if t > 4 {
+		t = 4
+	}
+	bits.add(0, t)
+	for bits.n%8 != 0 {
+		bits.add(0, 1)
+	}
+
+	data := bits.b
+	for pad := byte(0xec); len(data) < bl.data(); pad ^= 0xec ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	q, fn := qrFunctionPatterns(ver)
+	q.place(fn, qrInterleave(data, bl))
+
+	// the mask with the lowest penalty
+	best, score := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(fn, mask)
+		q.drawFormat(qrLevelM, mask)
+		if s := q.penalty(); score < 0 || s < score {
+			best, score = mask, s
+		}
+		q.applyMask(fn, mask)
+	}
+
+	q.applyMask(fn, best)
+	q.drawFormat(qrLevelM, best)
+	return q
+}
+
+// split 'data' into blocks, add their error correction codewords and
+// interleave them
+func qrInterleave(data []byte, bl qrBlocks) []byte {
+	var blocks, ecs [][]byte
+
+	off := 0
+	for i := 0; i < bl.n1+bl.n2; i++ {
+		k := bl.k1
+		if i >= bl.n1 {
+			k = bl.k2
+		}
+
+		blk := data[off : off+k]
+		off += k
+		blocks = append(blocks, blk)
+		ecs = append(ecs, rsEncode(blk, bl.ec))
+	}
+
+	out := make([]byte, 0, len(data)+len(blocks)*bl.ec)
+	for i := 0; i < bl.k1 || i < bl.k2; i++ {
+		for _, blk := range blocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+			}
+		}
+	}
+	for i := 0; i < bl.ec; i++ {
+		for _, e := range ecs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// the function patterns of version 'ver' and the map of their modules
+func qrFunctionPatterns(ver int) (*QRCode, []bool) {
+	size := 17 + 4*ver
+	q := &QRCode{Size: size, modules: make([]bool, size*size)}
+	fn := make([]bool, size*size)
+
+	set := func(x, y int, dark bool) {
+		q.modules[y*size+x] = dark
+		fn[y*size+x] = true
+	}
+
+	// timing patterns
+	for i := 0; i < size; i++ {
+		set(6, i, i%2 == 0)
+		set(i, 6, i%2 == 0)
+	}
+
+	// finder patterns and their separators
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && y >= 0 && x < size && y < size {
+					d := qrDist(dx, dy)
+					set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	// alignment patterns, except where they overlap the finders
+	pos := qrAlignment(ver)
+	n := len(pos)
+	for i, px := range pos {
+		for j, py := range pos {
+			if i == 0 && j == 0 || i == 0 && j == n-1 || i == n-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					set(px+dx, py+dy, qrDist(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format modules
+	a, b := qrFormatModules(size)
+	for i := range a {
+		set(a[i][0], a[i][1], false)
+		set(b[i][0], b[i][1], false)
+	}
+	set(8, size-8, true)
+
+	// version information
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			x, y := size-11+i%3, i/3
+			set(x, y, dark)
+			set(y, x, dark)
+		}
+	}
+	return q, fn
+}
+
+// place the codewords in the modules that aren't function modules
+func (q *QRCode) place(fn []bool, cw []byte) {
+	i := 0
+	q.walk(fn, func(idx int) {
+		if i < len(cw)*8 {
+			q.modules[idx] = (cw[i>>3]>>uint(7-(i&7)))&1 == 1
+			i++
+		}
+	})
+}
+
+// call 'f' with the index of each data module in placement order
+func (q *QRCode) walk(fn []bool, f func(idx int)) {
+	size := q.Size
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if upward {
+				y = size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				idx := y*size + right - j
+				if !fn[idx] {
+					f(idx)
+				}
+			}
+		}
+	}
+}
+
+// flip the data modules selected by the mask; applying it twice undoes it
+func (q *QRCode) applyMask(fn []bool, mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			idx := y*q.Size + x
+			if !fn[idx] && qrMasked(mask, x, y) {
+				q.modules[idx] = !q.modules[idx]
+			}
+		}
+	}
+}
+
+// true if the mask 'mask' flips the module at column 'x', row 'y'
+func qrMasked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// draw the format information of 'level' and 'mask'
+func (q *QRCode) drawFormat(level, mask int) {
+	bits := qrFormatBits(level<<3 | mask)
+	a, b := qrFormatModules(q.Size)
+	for i := range a {
+		dark := (bits>>uint(i))&1 == 1
+		q.modules[a[i][1]*q.Size+a[i][0]] = dark
+		q.modules[b[i][1]*q.Size+b[i][0]] = dark
+	}
+}
+
+// the 15 bit format information of 'data' (level and mask)
+func qrFormatBits(data int) int {
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// the modules (x, y) of the two copies of the format information; bit i
+// is at a[i] and b[i].
+func qrFormatModules(size int) (a, b [15][2]int) {
+	for i := 0; i <= 5; i++ {
+		a[i] = [2]int{8, i}
+	}
+	a[6] = [2]int{8, 7}
+	a[7] = [2]int{8, 8}
+	a[8] = [2]int{7, 8}
+	for i := 9; i < 15; i++ {
+		a[i] = [2]int{14 - i, 8}
+	}
+
+	for i := 0; i < 8; i++ {
+		b[i] = [2]int{size - 1 - i, 8}
+	}
+	for i := 8; i < 15; i++ {
+		b[i] = [2]int{8, size - 15 + i}
+	}
+	return a, b
+}
+
+// the centers of the alignment patterns on each axis
+func qrAlignment(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+
+	n := ver/7 + 2
+	step := (ver*4 + n*2 + 1) / (n*2 - 2) * 2
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, ver*4+10; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// the penalty of the modules: long runs, blocks and finder like patterns
+// of one color and an imbalance of dark and light modules are penalized.
+func (q *QRCode) penalty() int {
+	size := q.Size
+	score := 0
+	dark := 0
+
+	line := func(get func(i int) bool) {
+		run := 0
+		var hist uint
+		for i := 0; i < size; i++ {
+			c := get(i)
+			if i > 0 && c == get(i-1) {
+				run++
+			} else {
+				run = 1
+			}
+			if run == 5 {
+				score += 3
+			} else if run > 5 {
+				score++
+			}
+
+			// 1:1:3:1:1 with four light modules on either side
+			hist = hist<<1 | qrBit(c)
+			if i >= 10 {
+				if p := hist & 0x7ff; p == 0x5d0 || p == 0x05d {
+					score += 40
+				}
+			}
+		}
+	}
+
+	for y := 0; y < size; y++ {
+		line(func(i int) bool { return q.Dark(i, y) })
+	}
+	for x := 0; x < size; x++ {
+		line(func(i int) bool { return q.Dark(x, i) })
+	}
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := q.Dark(x, y)
+			if c {
+				dark++
+			}
+			if x < size-1 && y < size-1 && c == q.Dark(x+1, y) && c == q.Dark(x, y+1) && c == q.Dark(x+1, y+1) {
+				score += 3
+			}
+		}
+	}
+
+	total := size * size
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	return score + k*10
+}
+
+// -- decoder --
+
+// decode the grid of modules of version 'ver'
+func qrDecodeGrid(q *QRCode, ver int) ([]byte, error) {
+	level, mask, err := q.readFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	table := qrTableM
+	if level == qrLevelL {
+		table = qrTableL
+	}
+	bl := table[ver]
+
+	_, fn := qrFunctionPatterns(ver)
+	q.applyMask(fn, mask)
+
+	total := bl.data() + (bl.n1+bl.n2)*bl.ec
+	cw := make([]byte, 0, total)
+	var c byte
+	var i int
+	q.walk(fn, func(idx int) {
+		if len(cw) < total {
+			c = c<<1 | byte(qrBit(q.modules[idx]))
+			if i++; i%8 == 0 {
+				cw = append(cw, c)
+				c = 0
+			}
+		}
+	})
+	if len(cw) != total {
+		return nil, fmt.Errorf("qr: version %d has too few modules", ver)
+	}
+
+	// deinterleave and correct the blocks
+	nb := bl.n1 + bl.n2
+	blocks := make([][]byte, nb)
+	for j := range blocks {
+		k := bl.k1
+		if j >= bl.n1 {
+			k = bl.k2
+		}
+		blocks[j] = make([]byte, 0, k+bl.ec)
+	}
+
+	p := 0
+	for i := 0; i < bl.k1 || i < bl.k2; i++ {
+		for j := range blocks {
+			k := bl.k1
+			if j >= bl.n1 {
+				k = bl.k2
+			}
+			if i < k {
+				blocks[j] = append(blocks[j], cw[p])
+				p++
+			}
+		}
+	}
+	for i := 0; i < bl.ec; i++ {
+		for j := range blocks {
+			blocks[j] = append(blocks[j], cw[p])
+			p++
+		}
+	}
+
+	var data []byte
+	for j, blk := range blocks {
+		if err := rsCorrect(blk, bl.ec); err != nil {
+			return nil, fmt.Errorf("qr: block %d: %s", j, err)
+		}
+		data = append(data, blk[:len(blk)-bl.ec]...)
+	}
+	return qrSegments(data, ver)
+}
+
+// read the error correction level and mask from the format information
+func (q *QRCode) readFormat() (int, int, error) {
+	a, b := qrFormatModules(q.Size)
+	for _, m := range [][15][2]int{a, b} {
+		var bits int
+		for i := range m {
+			if q.Dark(m[i][0], m[i][1]) {
+				bits |= 1 << uint(i)
+			}
+		}
+
+		// the nearest valid format information
+		for data := 0; data < 32; data++ {
+			if qrOnes(bits^qrFormatBits(data)) <= 3 {
+				level, mask := data>>3, data&7
+				if level != qrLevelL && level != qrLevelM {
+					return 0, 0, fmt.Errorf("qr: unsupported error correction level")
+				}
+				return level, mask, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("qr: can't read the format information")
+}
+
+// the content of the data segments
+func qrSegments(data []byte, ver int) ([]byte, error) {
+	r := &qrReader{b: data}
+
+	var out []byte
+	for r.left() >= 4 {
+		switch mode := r.read(4); mode {
+		case 0:
+			return out, nil
+		case _QRModeByte:
+			if r.left() < qrCountBits(ver) {
+				return nil, fmt.Errorf("qr: truncated data")
+			}
+			n := r.read(qrCountBits(ver))
+			if r.left() < 8*n {
+				return nil, fmt.Errorf("qr: truncated data")
+			}
+			for i := 0; i < n; i++ {
+				out = append(out, byte(r.read(8)))
+			}
+		default:
+			return nil, fmt.Errorf("qr: unsupported data mode %d", mode)
+		}
+	}
+	return out, nil
+}
+
+// qrBitmap is a binarized image
+type qrBitmap struct {
+	w, h int
+	dark []bool
+}
+
+// qrFinder is the center of a finder pattern and its module size
+type qrFinder struct {
+	x, y, unit float64
+	n          int
+}
+
+// binarize the image 'img' at the midpoint of its darkest and lightest
+// pixels
+func qrBinarize(img image.Image) *qrBitmap {
+	r := img.Bounds()
+	bm := &qrBitmap{w: r.Dx(), h: r.Dy(), dark: make([]bool, r.Dx()*r.Dy())}
+
+	lum := make([]uint8, len(bm.dark))
+	lo, hi := uint8(0xff), uint8(0)
+	for y := 0; y < bm.h; y++ {
+		for x := 0; x < bm.w; x++ {
+			g := color.GrayModel.Convert(img.At(r.Min.X+x, r.Min.Y+y)).(color.Gray).Y
+			lum[y*bm.w+x] = g
+			if g < lo {
+				lo = g
+			}
+			if g > hi {
+				hi = g
+			}
+		}
+	}
+
+	t := (int(lo) + int(hi)) / 2
+	for i, g := range lum {
+		bm.dark[i] = int(g) <= t
+	}
+	return bm
+}
+
+func (bm *qrBitmap) at(x, y int) bool {
+	return bm.dark[y*bm.w+x]
+}
+
+// find the top left, top right and bottom left finder patterns
+func (bm *qrBitmap) finders() (tl, tr, bl *qrFinder, err error) {
+	var cands []*qrFinder
+
+	for y := 0; y < bm.h; y++ {
+		// the runs of the row; they alternate between dark and light
+		var runs, starts []int
+		for x := 0; x < bm.w; {
+			start, dark := x, bm.at(x, y)
+			for x < bm.w && bm.at(x, y) == dark {
+				x++
+			}
+			runs = append(runs, x-start)
+			starts = append(starts, start)
+		}
+
+		for i := 0; i+5 <= len(runs); i++ {
+			var w [5]int
+			copy(w[:], runs[i:i+5])
+			if bm.at(starts[i], y) && qrRatio(w) {
+				cx := float64(starts[i+2]) + float64(runs[i+2])/2
+				bm.confirm(&cands, cx, y)
+			}
+		}
+	}
+
+	var good []*qrFinder
+	for _, c := range cands {
+		if c.n >= 2 {
+			good = append(good, c)
+		}
+	}
+	sort.Slice(good, func(i, j int) bool { return good[i].n > good[j].n })
+	if len(good) > 12 {
+		good = good[:12]
+	}
+
+	// the three patterns that best form a right isosceles triangle
+	best := math.Inf(1)
+	for i := 0; i < len(good); i++ {
+		for j := i + 1; j < len(good); j++ {
+			for k := j + 1; k < len(good); k++ {
+				a, b, c := qrOrder(good[i], good[j], good[k])
+				if s := qrScore(a, b, c); s < best {
+					best = s
+					tl, tr, bl = a, b, c
+				}
+			}
+		}
+	}
+
+	if tl == nil || best > 0.5 {
+		return nil, nil, nil, fmt.Errorf("qr: no QR code found")
+	}
+	return tl, tr, bl, nil
+}
+
+// check the candidate finder pattern centered at 'cx' on row 'y'
+// vertically and horizontally; add it to 'cands'
+func (bm *qrBitmap) confirm(cands *[]*qrFinder, cx float64, y int) {
+	x := int(cx)
+	cy, vu, ok := bm.cross(x, y, 0, 1)
+	if !ok {
+		return
+	}
+
+	cx, hu, ok := bm.cross(x, int(cy), 1, 0)
+	if !ok {
+		return
+	}
+
+	unit := (vu + hu) / 2
+	for _, c := range *cands {
+		if math.Abs(c.x-cx) <= unit && math.Abs(c.y-cy) <= unit && math.Abs(c.unit-unit) <= unit {
+			n := float64(c.n)
+			c.x = (c.x*n + cx) / (n + 1)
+			c.y = (c.y*n + cy) / (n + 1)
+			c.unit = (c.unit*n + unit) / (n + 1)
+			c.n++
+			return
+		}
+	}
+	*cands = append(*cands, &qrFinder{x: cx, y: cy, unit: unit, n: 1})
+}
+
+// measure the runs through the dark pixel (x, y) along the axis (dx, dy);
+// return the center of the middle run and the module size if they are a
+// finder pattern.
+func (bm *qrBitmap) cross(x, y, dx, dy int) (float64, float64, bool) {
+	var runs [5]int
+
+	in := func(x, y int) bool {
+		return x >= 0 && y >= 0 && x < bm.w && y < bm.h
+	}
+
+	if !in(x, y) || !bm.at(x, y) {
+		return 0, 0, false
+	}
+
+	// backwards: states 2, 1, 0
+	px, py := x, y
+	for state, dark := 2, true; state >= 0; {
+		if !in(px, py) || bm.at(px, py) != dark {
+			if state--; state < 0 || !in(px, py) {
+				break
+			}
+			dark = !dark
+			continue
+		}
+		runs[state]++
+		px, py = px-dx, py-dy
+	}
+	back := runs[2]
+
+	// forwards: states 2, 3, 4
+	px, py = x+dx, y+dy
+	for state, dark := 2, true; state <= 4; {
+		if !in(px, py) || bm.at(px, py) != dark {
+			if state++; state > 4 || !in(px, py) {
+				break
+			}
+			dark = !dark
+			continue
+		}
+		runs[state]++
+		px, py = px+dx, py+dy
+	}
+
+	if !qrRatio(runs) {
+		return 0, 0, false
+	}
+
+	pos := x*dx + y*dy
+	center := float64(pos-back+1) + float64(runs[2])/2
+	total := 0
+	for _, r := range runs {
+		total += r
+	}
+	return center, float64(total) / 7, true
+}
+
+// true if the runs have the 1:1:3:1:1 ratio of a finder pattern
+func qrRatio(runs [5]int) bool {
+	total := 0
+	for _, r := range runs {
+		if r == 0 {
+			return false
+		}
+		total += r
+	}
+	if total < 7 {
+		return false
+	}
+
+	u := float64(total) / 7
+	v := u / 2
+	return math.Abs(float64(runs[0])-u) < v && math.Abs(float64(runs[1])-u) < v &&
+		math.Abs(float64(runs[2])-3*u) < 3*v &&
+		math.Abs(float64(runs[3])-u) < v && math.Abs(float64(runs[4])-u) < v
+}
+
+// order three finder patterns as top left, top right and bottom left
+func qrOrder(a, b, c *qrFinder) (*qrFinder, *qrFinder, *qrFinder) {
+	d := func(p, q *qrFinder) float64 {
+		return math.Hypot(p.x-q.x, p.y-q.y)
+	}
+
+	// the top left pattern is opposite the longest side
+	switch ab, bc, ca := d(a, b), d(b, c), d(c, a); {
+	case ab >= bc && ab >= ca:
+		a, c = c, a
+	case ca >= ab && ca >= bc:
+		a, b = b, a
+	}
+
+	// top right, then bottom left going clockwise (y grows downwards)
+	if (b.x-a.x)*(c.y-a.y)-(b.y-a.y)*(c.x-a.x) < 0 {
+		b, c = c, b
+	}
+	return a, b, c
+}
+
+// how far the patterns are from a right isosceles triangle of patterns
+// of the same size; zero is perfect.
+func qrScore(tl, tr, bl *qrFinder) float64 {
+	ux, uy := tr.x-tl.x, tr.y-tl.y
+	vx, vy := bl.x-tl.x, bl.y-tl.y
+	du, dv := math.Hypot(ux, uy), math.Hypot(vx, vy)
+	if du == 0 || dv == 0 {
+		return math.Inf(1)
+	}
+
+	unit := (tl.unit + tr.unit + bl.unit) / 3
+	s := math.Abs(du-dv) / math.Max(du, dv)
+	s += math.Abs(ux*vx+uy*vy) / (du * dv)
+	for _, f := range []*qrFinder{tl, tr, bl} {
+		s += math.Abs(f.unit-unit) / unit
+	}
+	return s
+}
+
+// sample the modules of version 'ver' located by the finder patterns
+func (bm *qrBitmap) sample(tl, tr, bl *qrFinder, ver int) *QRCode {
+	size := 17 + 4*ver
+	q := &QRCode{Size: size, modules: make([]bool, size*size)}
+
+	// the finder centers are 'size - 7' modules apart
+	n := float64(size - 7)
+	ux, uy := (tr.x-tl.x)/n, (tr.y-tl.y)/n
+	vx, vy := (bl.x-tl.x)/n, (bl.y-tl.y)/n
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			fx, fy := float64(x-3), float64(y-3)
+			px := int(math.Floor(tl.x + fx*ux + fy*vx))
+			py := int(math.Floor(tl.y + fx*uy + fy*vy))
+			if px >= 0 && py >= 0 && px < bm.w && py < bm.h {
+				q.modules[y*size+x] = bm.at(px, py)
+			}
+		}
+	}
+	return q
+}
+
+// -- Reed-Solomon codes over GF(256) --
+
+var gfExp, gfLog = gfTables()
+
+// the exponent and log tables of GF(256) with the polynomial 0x11d
+func gfTables() ([]byte, []byte) {
+	exp := make([]byte, 512)
+	log := make([]byte, 256)
+
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// α^e
+func gfPow(e int) byte {
+	return gfExp[(e%255+255)%255]
+}
+
+// evaluate the polynomial 'p' (lowest degree first) at 'x'
+func gfEval(p []byte, x byte) byte {
+	var v byte
+	for i := len(p) - 1; i >= 0; i-- {
+		v = gfMul(v, x) ^ p[i]
+	}
+	return v
+}
+
+// the 'n' error correction codewords of 'data'
+func rsEncode(data []byte, n int) []byte {
+	// the generator polynomial (highest degree first)
+	g := []byte{1}
+	for i := 0; i < n; i++ {
+		ng := make([]byte, len(g)+1)
+		for j, c := range g {
+			ng[j] ^= c
+			ng[j+1] ^= gfMul(c, gfPow(i))
+		}
+		g = ng
+	}
+
+	rem := make([]byte, n)
+	for _, d := range data {
+		f := d ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for j := 0; j < n; j++ {
+			rem[j] ^= gfMul(g[j+1], f)
+		}
+	}
+	return rem
+}
+
+// correct the errors in the codewords 'cw' with 'n' error correction
+// codewords in place
+func rsCorrect(cw []byte, n int) error {
+	size := len(cw)
+
+	// the syndromes; the first codeword is the highest power
+	synd := make([]byte, n)
+	bad := false
+	for i := 0; i < n; i++ {
+		var s byte
+		for _, c := range cw {
+			s = gfMul(s, gfPow(i)) ^ c
+		}
+		synd[i] = s
+		bad = bad || s != 0
+	}
+	if !bad {
+		return nil
+	}
+
+	// the error locator with Berlekamp-Massey (lowest degree first)
+	lc, pc := []byte{1}, []byte{1}
+	l, m, b := 0, 1, byte(1)
+	for k := 0; k < n; k++ {
+		d := synd[k]
+		for i := 1; i <= l && i < len(lc); i++ {
+			d ^= gfMul(lc[i], synd[k-i])
+		}
+		if d == 0 {
+			m++
+			continue
+		}
+
+		t := append([]byte{}, lc...)
+		if need := len(pc) + m; len(lc) < need {
+			lc = append(lc, make([]byte, need-len(lc))...)
+		}
+		coef := gfDiv(d, b)
+		for i, c := range pc {
+			lc[i+m] ^= gfMul(coef, c)
+		}
+
+		if 2*l <= k {
+			l, pc, b, m = k+1-l, t, d, 1
+		} else {
+			m++
+		}
+	}
+	if 2*l > n {
+		return fmt.Errorf("too many errors")
+	}
+
+	// the error evaluator: syndromes * locator mod x^n
+	omega := make([]byte, n)
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i && j < len(lc); j++ {
+			omega[i] ^= gfMul(lc[j], synd[i-j])
+		}
+	}
+
+	// find the error positions (Chien) and values (Forney)
+	nerr := 0
+	for j := 0; j < size; j++ {
+		p := size - 1 - j
+		xinv := gfPow(-p)
+		if gfEval(lc, xinv) != 0 {
+			continue
+		}
+
+		var den byte
+		for i := 1; i < len(lc); i += 2 {
+			den ^= gfMul(lc[i], gfPow(int(gfLog[xinv])*(i-1)))
+		}
+		if den == 0 {
+			return fmt.Errorf("uncorrectable errors")
+		}
+
+		cw[j] ^= gfMul(gfPow(p), gfDiv(gfEval(omega, xinv), den))
+		nerr++
+	}
+	if nerr != l {
+		return fmt.Errorf("uncorrectable errors")
+	}
+	return nil
+}
+
+// -- helpers --
+
+// qrBits is a bit buffer
+type qrBits struct {
+	b []byte
+	n int
+}
+
+// append the 'n' low bits of 'v'
+func (q *qrBits) add(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if q.n%8 == 0 {
+			q.b = append(q.b, 0)
+		}
+		if (v>>uint(i))&1 == 1 {
+			q.b[q.n/8] |= 0x80 >> uint(q.n%8)
+		}
+		q.n++
+	}
+}
+
+// qrReader reads bits
+type qrReader struct {
+	b []byte
+	n int
+}
+
+func (r *qrReader) left() int {
+	return 8*len(r.b) - r.n
+}
+
+func (r *qrReader) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v = v<<1 | int((r.b[r.n/8]>>uint(7-r.n%8))&1)
+		r.n++
+	}
+	return v
+}
+
+func qrBit(b bool) uint {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func qrOnes(v int) int {
+	n := 0
+	for ; v != 0; v &= v - 1 {
+		n++
+	}
+	return n
+}
+
+func qrAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// the distance of (x, y) from the origin in the max norm
+func qrDist(x, y int) int {
+	x, y = qrAbs(x), qrAbs(y)
+	if x > y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,102 @@
+// ratelimit.go -- limit the rate of I/O
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the I/O through the readers and writers it wraps to
+// a number of bytes per second; they all share the limit. Up to one
+// second's worth of bytes passes without delay after an idle period.
+type RateLimiter struct {
+	sync.Mutex
+
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter makes a limiter of 'rate' bytes per second
+func NewRateLimiter(rate uint64) *RateLimiter {
+	if rate == 0 {
+		rate = 1
+	}
+
+	l := &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+	return l
+}
+
+// Reader returns a reader of 'rd' limited by 'l'
+func (l *RateLimiter) Reader(rd io.Reader) io.Reader {
+	return &limitedReader{rd, l}
+}
+
+// WriteCloser returns a writer to 'wr' limited by 'l'
+func (l *RateLimiter) WriteCloser(wr io.WriteCloser) io.WriteCloser {
+	return &limitedWriter{wr, l}
+}
+
+// account for 'n' bytes and sleep until the rate is back under the limit
+func (l *RateLimiter) wait(n int) {
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.tokens -= float64(n)
+	l.last = now
+
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+
+	time.Sleep(d)
+}
+
+type limitedReader struct {
+	rd io.Reader
+	l  *RateLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.rd.Read(b)
+	if n > 0 {
+		r.l.wait(n)
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	wr io.WriteCloser
+	l  *RateLimiter
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	w.l.wait(len(b))
+	return w.wr.Write(b)
+}
+
+func (w *limitedWriter) Close() error {
+	return w.wr.Close()
+}
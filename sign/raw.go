@@ -0,0 +1,161 @@
+// raw.go -- raw Ed25519 signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A sigtool signature is a plain Ed25519 signature of the message:
+//
+//    M  = SHA512("sigtool signed message" || C || A)
+//    C  = H(content || uint64_be(len(content)))
+//    A  = canonical encoding of the signed attributes (empty if none)
+//
+// H is SHA512 unless the attributes name another hash (BLAKE3).
+//
+// Given M, the raw 64 byte signature and the 32 byte public key anyone can
+// verify it with crypto/ed25519 (or any other Ed25519 implementation).
+
+package sign
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	Ed "crypto/ed25519"
+)
+
+// RawSignatureDesc describes how the message of a raw signature is made
+const RawSignatureDesc = `SHA512("sigtool signed message" || SHA512(content || uint64_be(len(content))) || attrs)`
+
+// RawSignature is a sigtool signature in a form that can be verified with
+// just an Ed25519 implementation: Ed25519.Verify(PublicKey, Message, Signature)
+type RawSignature struct {
+	// 64 byte Ed25519 signature
+	Signature []byte
+
+	// 32 byte Ed25519 public key; nil if the signature doesn't carry it
+	PublicKey []byte
+
+	// The signed message; see RawSignatureDesc
+	Message []byte
+}
+
+// Raw returns the raw Ed25519 signature of the content whose checksum is
+// 'ck' (see FileChecksum() and MessageChecksum()).
+func (sig *Signature) Raw(ck []byte) *RawSignature {
+	r := &RawSignature{
+		Signature: sig.Sig,
+		Message:   sigMessage(ck, sig.Attrs),
+	}
+	if sig.PublicKey != nil {
+		r.PublicKey = sig.PublicKey.Pk
+	}
+	return r
+}
+
+// SignatureFromRaw makes a signature from the raw 64 byte Ed25519
+// signature 'raw' made by 'pk'. 'attrs' are the signed attributes (nil if
+// there are none).
+func SignatureFromRaw(raw []byte, pk *PublicKey, attrs *Attributes) (*Signature, error) {
+	if len(raw) != Ed.SignatureSize {
+		return nil, fmt.Errorf("raw signature is malformed (len %d!)", len(raw))
+	}
+
+	sig := &Signature{
+		Sig:       append([]byte{}, raw...),
+		pkhash:    append([]byte{}, pk.hash...),
+		Attrs:     attrs,
+		PublicKey: pk,
+	}
+	return sig, nil
+}
+
+// FileChecksum returns the checksum of the file 'fn' that is signed
+func FileChecksum(fn string) ([]byte, error) {
+	ck, _, err := fileCksum(fn, sha512.New())
+	return ck, err
+}
+
+// MessageChecksum returns the checksum of the content 'b' that is signed
+func MessageChecksum(b []byte) []byte {
+	return textCksum(b)
+}
+
+// ReaderChecksum returns the checksum of the content read from 'rd' that
+// is signed
+func ReaderChecksum(rd io.Reader) ([]byte, error) {
+	ck, _, err := ReaderChecksumHash(rd, hashSHA512)
+	return ck, err
+}
+
+// ReaderChecksumHash is like ReaderChecksum() but hashes the content with
+// 'algo' ("sha512" or "blake3", see Attributes) and also returns its
+// size. BLAKE3 hashes large inputs on all CPUs.
+func ReaderChecksumHash(rd io.Reader, algo string) ([]byte, int64, error) {
+	var b [8]byte
+
+	h, err := contentHash(algo)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sz, err := hashReader(h, rd)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	binary.BigEndian.PutUint64(b[:], uint64(sz))
+	h.Write(b[:])
+	return h.Sum(nil), sz, nil
+}
+
+// write all of 'rd' to the hash 'h'; a file is mapped and BLAKE3 gets
+// writes large enough to be hashed in parallel
+func hashReader(h hash.Hash, rd io.Reader) (int64, error) {
+	if fd, ok := rd.(*os.File); ok && atStart(fd) {
+		return mmapReader(fd, 0, 0, h)
+	}
+	if _, ok := h.(*blake3); ok {
+		return bigCopy(h, rd)
+	}
+	return io.Copy(h, rd)
+}
+
+// true if 'fd' is a seekable file at offset 0
+func atStart(fd *os.File) bool {
+	off, err := fd.Seek(0, io.SeekCurrent)
+	return err == nil && off == 0
+}
+
+// copy 'rd' to 'wr' in writes large enough to be hashed in parallel
+func bigCopy(wr io.Writer, rd io.Reader) (int64, error) {
+	buf := make([]byte, 16*1024*1024)
+
+	var z int64
+	for {
+		n, err := io.ReadFull(rd, buf)
+		if n > 0 {
+			wr.Write(buf[:n])
+			z += int64(n)
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return z, nil
+		default:
+			return z, err
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// readat.go -- random access to the chunks of an encrypted file
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Decrypt(), the stream reader and the archive reader share the chunk
+// buffer of the Decryptor; they serve one reader at a time. A ChunkReader
+// only uses the immutable state of the Decryptor (the AEAD, the salt and
+// the header) and the caller's buffers; it is safe for concurrent use so
+// that ranges of a seekable ciphertext can be decrypted in parallel.
+
+package sign
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ChunkReader decrypts any chunk of a seekable encrypted file; its methods
+// can be called from multiple goroutines.
+type ChunkReader struct {
+	d    *Decryptor
+	ra   io.ReaderAt
+	size int64 // plaintext size
+	last int64
+}
+
+// NewChunkReader returns a reader for the chunks of the encrypted file
+// 'ra' of 'size' bytes. The private key must have been set with
+// SetPrivateKey(). Files with holes (encrypt --sparse) can't be read this
+// way.
+func (d *Decryptor) NewChunkReader(ra io.ReaderAt, size int64) (*ChunkReader, error) {
+	if d.key == nil {
+		return nil, fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
+	}
+
+	if d.stream || d.eof {
+		return nil, fmt.Errorf("decrypt: can't read chunks after using Decrypt() or streaming I/O")
+	}
+
+	psize, err := decryptedSize(d.hdrlen, d.ChunkSize, d.Chunking, size)
+	if err != nil {
+		return nil, err
+	}
+
+	d.stream = true
+	c := &ChunkReader{
+		d:    d,
+		ra:   ra,
+		size: psize,
+		last: (psize - 1) / int64(d.ChunkSize),
+	}
+	return c, nil
+}
+
+// Size returns the size of the plaintext
+func (c *ChunkReader) Size() int64 {
+	return c.size
+}
+
+// Chunks returns the number of chunks; chunk 'i' holds the plaintext at
+// offset i * ChunkSize.
+func (c *ChunkReader) Chunks() int64 {
+	return c.last + 1
+}
+
+// ChunkAt decrypts chunk 'i' into 'buf' and returns the plaintext; 'buf'
+// is allocated if it is smaller than ChunkSize + 16 bytes.
+func (c *ChunkReader) ChunkAt(i int64, buf []byte) ([]byte, error) {
+	d := c.d
+	if n := int(d.ChunkSize) + d.ae.Overhead(); len(buf) < n {
+		buf = make([]byte, n)
+	}
+	return d.chunkAt(c.ra, i, c.last, buf)
+}
+
+// ReadAt implements the io.ReaderAt interface for the plaintext
+func (c *ChunkReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("decrypt: negative offset %d", off)
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if int64(len(b)) > c.size-off {
+		b = b[:c.size-off]
+		err = io.EOF
+	}
+
+	var buf []byte
+	var n int
+
+	sz := int64(c.d.ChunkSize)
+	for n < len(b) {
+		i := off / sz
+		p, e := c.ChunkAt(i, buf)
+		if e != nil {
+			return n, e
+		}
+		buf = p[:cap(p)]
+
+		z := copy(b[n:], p[off-i*sz:])
+		n += z
+		off += int64(z)
+	}
+	return n, err
+}
+
+// decrypt chunk 'i' of the encrypted file 'ra' whose last chunk is 'last'
+// into 'buf' (of at least ChunkSize + tag bytes); every chunk but the last
+// must be full.
+func (d *Decryptor) chunkAt(ra io.ReaderAt, i, last int64, buf []byte) ([]byte, error) {
+	if i < 0 || i > last {
+		return nil, fmt.Errorf("decrypt: no chunk %d", i)
+	}
+	if uint64(i) > maxChunk(d.version) {
+		return nil, ErrTooManyChunks
+	}
+
+	var b [_ChunkADLen]byte
+
+	off := int64(d.hdrlen) + i*(int64(d.ChunkSize)+_ChunkOverhead)
+	if _, err := ra.ReadAt(b[:4], off); err != nil {
+		return nil, fmt.Errorf("decrypt: can't read header block %d: %s", i, err)
+	}
+
+	z := binary.BigEndian.Uint32(b[:4])
+	eof := (z & _EOF) > 0
+	m := z &^ _EOF
+
+	// every chunk but the last is full; only the last has the EOF flag
+	if eof != (i == last) || m > d.ChunkSize || (!eof && m != d.ChunkSize) {
+		return nil, fmt.Errorf("decrypt: chunk %d: invalid length", i)
+	}
+
+	c := buf[:int(m)+d.ae.Overhead()]
+	if _, err := ra.ReadAt(c, off+4); err != nil {
+		return nil, fmt.Errorf("decrypt: premature EOF while reading block %d: %s", i, err)
+	}
+
+	ad := chunkAD(b[:], d.version, z, uint64(i), d.hdrsum)
+	nonce := makeNonce(d.Salt, ad)[:d.ae.NonceSize()]
+
+	p, err := d.ae.Open(c[:0], nonce, c, ad)
+	if err != nil {
+		debug(d.log, "decrypt: chunk authentication failed", "chunk", i)
+		return nil, fmt.Errorf("decrypt: can't decrypt chunk %d: %s", i, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,113 @@
+// recipient.go -- pluggable recipient schemes
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Recipients that aren't X25519 keys (cloud KMS, PIV tokens, FIDO2
+// authenticators ..) are named by a URI "scheme://..". Packages that
+// implement such a scheme register it with RegisterRecipientScheme();
+// ParseRecipient() then returns a PublicKey for the URI that can be given
+// to Encryptor.AddRecipient(). The wrapped file key is stored in the
+// header along with the scheme name and any scheme specific data.
+
+package sign
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Recipient wraps the file encryption key for one recipient of a
+// registered scheme
+type Recipient interface {
+	// Wrap encrypts the file key 'key'. It returns the wrapped key and
+	// optional scheme specific data (e.g., a key id) that is stored in
+	// the clear in the header.
+	Wrap(key []byte) (wrapped []byte, args []byte, err error)
+}
+
+// RecipientScheme makes a Recipient from the URI 'uri'
+type RecipientScheme func(uri string) (Recipient, error)
+
+var recipientSchemes = struct {
+	sync.Mutex
+	m map[string]RecipientScheme
+}{m: make(map[string]RecipientScheme)}
+
+// RegisterRecipientScheme registers the recipient scheme 'scheme' (e.g.,
+// "kms"). It panics if the scheme is already registered.
+func RegisterRecipientScheme(scheme string, f RecipientScheme) {
+	if len(scheme) == 0 || strings.Contains(scheme, ":") || f == nil {
+		panic("sign: invalid recipient scheme")
+	}
+
+	r := &recipientSchemes
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.m[scheme]; ok {
+		panic(fmt.Sprintf("sign: recipient scheme %q already registered", scheme))
+	}
+	r.m[scheme] = f
+}
+
+// RecipientSchemes returns the names of the registered recipient schemes
+func RecipientSchemes() []string {
+	r := &recipientSchemes
+	r.Lock()
+	defer r.Unlock()
+
+	v := make([]string, 0, len(r.m))
+	for k := range r.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// return the scheme of 's' if it is a URI
+func uriScheme(s string) (string, bool) {
+	i := strings.Index(s, "://")
+	if i <= 0 {
+		return "", false
+	}
+	return s[:i], true
+}
+
+// make a public key for the recipient URI 'uri'
+func parseRecipientURI(uri string) (*PublicKey, error) {
+	scheme, _ := uriScheme(uri)
+
+	r := &recipientSchemes
+	r.Lock()
+	f, ok := r.m[scheme]
+	r.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("parse recipient: unknown recipient scheme %q", scheme)
+	}
+
+	ext, err := f(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parse recipient: %s: %s", uri, err)
+	}
+
+	pk := &PublicKey{
+		Comment: uri,
+		Usage:   UsageEncrypt,
+		scheme:  scheme,
+		ext:     ext,
+		hash:    pkhash([]byte(uri)),
+	}
+	return pk, nil
+}
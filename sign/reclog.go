@@ -0,0 +1,408 @@
+// reclog.go -- append-only encrypted record log
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A record log starts with the same header as an encrypted file; it is
+// followed by individually encrypted records instead of chunks. Each
+// record is written as soon as it is appended:
+//
+//    uint32_be(len | flags) || AES-GCM(K, nonce, record, ad)
+//
+//    K     = HKDF-SHA256(file key, SHA256(header), "sigtool v2 log key")
+//    nonce = SHA256(salt || uint64_be(seq))[:16]
+//    ad    = uint32_be(len | flags) || uint64_be(seq) || tag of record seq-1
+//
+// The header is of format version 2 (see kdf.go for the context mixed
+// into K). Records are numbered from 0; chaining the previous tag into
+// the additional data makes records that are removed, reordered or
+// copied from another log fail authentication. Close() appends an empty
+// record with the EOF flag; a log that ends without it was truncated (or
+// is still being written).
+//
+// A closed log can be reopened with NewLogAppender(): more records are
+// written after its end marker, numbered and chained as if the marker
+// were a record, and are followed by a new end marker. No record or
+// nonce is ever written twice. A reader continues past an end marker
+// that is followed by more records; a log cut at an earlier end marker
+// looks like the log as it was when that marker was written.
+
+package sign
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// ErrLogTruncated is returned by LogReader.Next() when the log ends
+// without the record written by LogWriter.Close().
+var ErrLogTruncated = errors.New("decrypt: log truncated (or not closed)")
+
+// LogWriter appends encrypted records to a log
+type LogWriter struct {
+	e    *Encryptor
+	wr   io.WriteCloser
+	ae   cipher.AEAD
+	seq  uint64
+	prev []byte
+	buf  []byte
+	err  error
+}
+
+// NewLogWriter starts an encrypted record log on 'wr' for the recipients
+// of the Encryptor. Records can be at most ChunkSize bytes long.
+func (e *Encryptor) NewLogWriter(wr io.WriteCloser) (*LogWriter, error) {
+	if e.started {
+		return nil, fmt.Errorf("encrypt: can't start a log after encryption has started")
+	}
+	if e.cdc != nil {
+		return nil, fmt.Errorf("encrypt: a log can't use content defined chunks")
+	}
+
+	// records have their own 64-bit sequence numbers and are always
+	// sealed with AES-GCM
+	e.version = _Version
+	e.cipher = CipherAESGCM
+	if err := e.start(wr); err != nil {
+		return nil, err
+	}
+
+	ae, err := logCipher(e.key, e.hdrsum, e.context)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+
+	e.stream = true
+	w := &LogWriter{
+		e:  e,
+		wr: wr,
+		ae: ae,
+	}
+	return w, nil
+}
+
+// Append encrypts and writes one record
+func (w *LogWriter) Append(rec []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(rec) > int(w.e.ChunkSize) {
+		return fmt.Errorf("encrypt: log record too large (%d bytes; max %d)", len(rec), w.e.ChunkSize)
+	}
+
+	if w.err = w.write(rec, false); w.err != nil {
+		return w.err
+	}
+	return nil
+}
+
+// Write implements io.Writer; each call appends one record.
+func (w *LogWriter) Write(b []byte) (int, error) {
+	if err := w.Append(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close marks the end of the log and closes the underlying writer
+func (w *LogWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.err = w.write(nil, true); w.err != nil {
+		return w.err
+	}
+
+	w.err = errClosed
+	info(w.e.log, "encrypt: log closed", "records", w.seq-1)
+	return w.wr.Close()
+}
+
+func (w *LogWriter) write(rec []byte, eof bool) error {
+	z := uint32(len(rec))
+	if eof {
+		z |= _EOF
+	}
+
+	ad := logAD(z, w.seq, w.prev)
+
+	w.buf = append(w.buf[:0], ad[:4]...)
+	w.buf = w.ae.Seal(w.buf, logNonce(w.e.Salt, w.seq), rec, ad)
+
+	if err := fullwrite(w.buf, w.wr); err != nil {
+		return fmt.Errorf("encrypt: %s", err)
+	}
+
+	w.prev = append(w.prev[:0], w.buf[len(w.buf)-_AEADTagLen:]...)
+	w.seq++
+	return nil
+}
+
+// NewLogAppender reopens the closed log of this Decryptor to append
+// records to it; they are written to 'wr', which must add them to the
+// end of the log (e.g., the log file that the Decryptor reads, opened for
+// reading and writing). The private key must have been set with
+// SetPrivateKey(). The records of the log are skipped; only its end
+// markers are authenticated.
+func (d *Decryptor) NewLogAppender(wr io.WriteCloser) (*LogWriter, error) {
+	if d.key == nil {
+		return nil, fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
+	}
+
+	if d.stream || d.eof {
+		return nil, fmt.Errorf("decrypt: can't append to a log after using Decrypt() or streaming I/O")
+	}
+
+	ae, err := logCipher(d.key, d.hdrsum, d.context)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %s", err)
+	}
+
+	seq, prev, err := d.skipLog(ae)
+	if err != nil {
+		return nil, err
+	}
+
+	d.stream = true
+	d.eof = true
+
+	e := &Encryptor{
+		Header: pb.Header{
+			ChunkSize: d.ChunkSize,
+			Salt:      d.Salt,
+		},
+		started: true,
+		stream:  true,
+		log:     d.log,
+	}
+
+	info(d.log, "encrypt: log reopened", "records", seq)
+	w := &LogWriter{
+		e:    e,
+		wr:   wr,
+		ae:   ae,
+		seq:  seq,
+		prev: prev,
+	}
+	return w, nil
+}
+
+// skip to the end of a closed log; return the number of its records
+// (including end markers) and the tag of the last one.
+func (d *Decryptor) skipLog(ae cipher.AEAD) (uint64, []byte, error) {
+	sk, _ := d.rd.(io.Seeker)
+
+	var b [4]byte
+	var seq uint64
+	var prev []byte
+	var closed bool
+	tag := make([]byte, _AEADTagLen)
+	for ; ; seq++ {
+		n, err := io.ReadFull(d.rd, b[:])
+		switch {
+		case n == 0 && err == io.EOF:
+			if !closed {
+				return 0, nil, ErrLogTruncated
+			}
+			return seq, prev, nil
+		case err == io.ErrUnexpectedEOF:
+			return 0, nil, ErrLogTruncated
+		case err != nil:
+			return 0, nil, fmt.Errorf("decrypt: log record %d: %s", seq, err)
+		}
+
+		z := binary.BigEndian.Uint32(b[:])
+		m := int64(z &^ _EOF)
+		if m > int64(d.ChunkSize) {
+			return 0, nil, fmt.Errorf("decrypt: log record %d: too large (%d)", seq, m)
+		}
+
+		if sk != nil {
+			_, err = sk.Seek(m, io.SeekCurrent)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, d.rd, m)
+		}
+		if err == nil {
+			_, err = io.ReadFull(d.rd, tag)
+		}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, nil, ErrLogTruncated
+			}
+			return 0, nil, fmt.Errorf("decrypt: log record %d: %s", seq, err)
+		}
+
+		closed = (z & _EOF) > 0
+		if closed {
+			if m != 0 {
+				return 0, nil, fmt.Errorf("decrypt: log record %d: malformed end of log", seq)
+			}
+			if _, err = ae.Open(nil, logNonce(d.Salt, seq), tag, logAD(z, seq, prev)); err != nil {
+				return 0, nil, fmt.Errorf("decrypt: log record %d: authentication failed (modified, removed or reordered)", seq)
+			}
+		}
+		prev = append(prev[:0], tag...)
+	}
+}
+
+// LogReader reads the records of an encrypted log
+type LogReader struct {
+	d    *Decryptor
+	ae   cipher.AEAD
+	seq  uint64
+	prev []byte
+	buf  []byte
+
+	// length of the record after an end marker
+	next    [4]byte
+	hasNext bool
+}
+
+// NewLogReader returns a reader for the records of an encrypted log. The
+// private key must have been set with SetPrivateKey().
+func (d *Decryptor) NewLogReader() (*LogReader, error) {
+	if d.key == nil {
+		return nil, fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
+	}
+
+	if d.stream || d.eof {
+		return nil, fmt.Errorf("decrypt: can't read a log after using Decrypt() or streaming I/O")
+	}
+
+	ae, err := logCipher(d.key, d.hdrsum, d.context)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %s", err)
+	}
+
+	d.stream = true
+	r := &LogReader{
+		d:   d,
+		ae:  ae,
+		buf: make([]byte, int(d.ChunkSize)+_AEADTagLen),
+	}
+	return r, nil
+}
+
+// Next returns the next record. It returns io.EOF at the end of a log
+// that was closed and ErrLogTruncated if the log ends without being
+// closed. The returned slice is only valid until the next call.
+func (r *LogReader) Next() ([]byte, error) {
+	if r.d.eof {
+		return nil, io.EOF
+	}
+
+	for {
+		var b [4]byte
+
+		if r.hasNext {
+			b = r.next
+			r.hasNext = false
+		} else {
+			n, err := io.ReadFull(r.d.rd, b[:])
+			switch {
+			case err == io.EOF || err == io.ErrUnexpectedEOF:
+				return nil, ErrLogTruncated
+			case err != nil || n != 4:
+				return nil, fmt.Errorf("decrypt: log record %d: %s", r.seq, err)
+			}
+		}
+
+		z := binary.BigEndian.Uint32(b[:])
+		eof := (z & _EOF) > 0
+		m := z &^ _EOF
+		if m > r.d.ChunkSize {
+			return nil, fmt.Errorf("decrypt: log record %d: too large (%d)", r.seq, m)
+		}
+
+		c := r.buf[:m+_AEADTagLen]
+		if _, err := io.ReadFull(r.d.rd, c); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, ErrLogTruncated
+			}
+			return nil, fmt.Errorf("decrypt: log record %d: %s", r.seq, err)
+		}
+
+		ad := logAD(z, r.seq, r.prev)
+		r.prev = append(r.prev[:0], c[m:]...)
+
+		p, err := r.ae.Open(c[:0], logNonce(r.d.Salt, r.seq), c, ad)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: log record %d: authentication failed (modified, removed or reordered)", r.seq)
+		}
+
+		r.seq++
+
+		if eof {
+			if m != 0 {
+				return nil, fmt.Errorf("decrypt: log record %d: malformed end of log", r.seq-1)
+			}
+
+			// records appended after the end marker
+			n, err := io.ReadFull(r.d.rd, r.next[:])
+			switch {
+			case n == 4:
+				r.hasNext = true
+				continue
+			case n > 0:
+				return nil, ErrLogTruncated
+			case err != io.EOF:
+				return nil, fmt.Errorf("decrypt: log record %d: %s", r.seq, err)
+			}
+
+			r.d.eof = true
+			info(r.d.log, "decrypt: log done", "records", r.seq-1)
+			return nil, io.EOF
+		}
+		return p, nil
+	}
+}
+
+// derive the record cipher from the file key, the header checksum and the
+// application context
+func logCipher(key, hdrsum []byte, ctx string) (cipher.AEAD, error) {
+	k, err := hkdfKey(make([]byte, 32), key, hdrsum, _KdfLogKey, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	aes, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(aes, _AEADNonceLen)
+}
+
+func logNonce(salt []byte, seq uint64) []byte {
+	var b [8]byte
+
+	binary.BigEndian.PutUint64(b[:], seq)
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(b[:])
+	return h.Sum(nil)[:_AEADNonceLen]
+}
+
+func logAD(z uint32, seq uint64, prev []byte) []byte {
+	ad := make([]byte, 12, 12+len(prev))
+	binary.BigEndian.PutUint32(ad[:4], z)
+	binary.BigEndian.PutUint64(ad[4:], seq)
+	return append(ad, prev...)
+}
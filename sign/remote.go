@@ -0,0 +1,238 @@
+// remote.go -- use the key agent of another host over ssh
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A key held by the agent of a signing server is used as the identity
+// "ssh://[user@]host[:port][/FP]". The client runs
+//
+//    ssh host sigtool agent proxy
+//
+// and speaks the agent protocol over the stdin and stdout of ssh(1); the
+// proxy on the server passes the requests to its agent (see ProxyAgent()).
+// Only the messages to sign and the public keys to compute shared secrets
+// with are sent to the server; the private key never leaves it.
+//
+// $SIGTOOL_SSH replaces the ssh command (e.g., "ssh -i ~/.ssh/signer") and
+// $SIGTOOL_REMOTE the command run on the server.
+
+package sign
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseIdentity() prefix of a key held by the agent of another host
+const RemoteIdentityPrefix = "ssh://"
+
+// default command run on the signing server
+const _RemoteCommand = "sigtool agent proxy"
+
+// requests a proxy passes to its agent; keys can't be added or removed
+// remotely
+var proxyOps = map[string]bool{
+	"list":   true,
+	"sign":   true,
+	"x25519": true,
+}
+
+// connection to an agent over a pair of pipes; it is started on first use
+// and used for all requests
+type agentPipe struct {
+	sync.Mutex
+	start func() (io.WriteCloser, io.ReadCloser, error)
+
+	wr  io.WriteCloser
+	rd  io.ReadCloser
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+// send a request over the pipe and return its reply
+func (p *agentPipe) call(req *agentRequest, timeout time.Duration) (*agentReply, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.enc == nil {
+		wr, rd, err := p.start()
+		if err != nil {
+			return nil, fmt.Errorf("agent: %s", err)
+		}
+
+		p.wr, p.rd = wr, rd
+		p.enc = json.NewEncoder(wr)
+		p.dec = json.NewDecoder(rd)
+	}
+
+	// pipes have no deadlines; closing them ends a stuck request
+	if timeout > 0 {
+		wr, rd := p.wr, p.rd
+		t := time.AfterFunc(timeout, func() {
+			wr.Close()
+			rd.Close()
+		})
+		defer t.Stop()
+	}
+
+	var r agentReply
+	err := p.enc.Encode(req)
+	if err == nil {
+		err = p.dec.Decode(&r)
+	}
+
+	if err != nil {
+		p.shutdown()
+		if err == io.EOF {
+			return nil, fmt.Errorf("agent: remote agent closed the connection")
+		}
+		return nil, fmt.Errorf("agent: %s", err)
+	}
+	return &r, nil
+}
+
+// close the pipe
+func (p *agentPipe) close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.shutdown()
+}
+
+// close the pipe; the caller holds the lock
+func (p *agentPipe) shutdown() error {
+	if p.enc == nil {
+		return nil
+	}
+
+	err := p.wr.Close()
+	p.rd.Close()
+	p.wr, p.rd, p.enc, p.dec = nil, nil, nil, nil
+	return err
+}
+
+// NewRemoteAgentClient makes a client of the agent on the host 'dest'
+// ("[user@]host[:port]") reached with ssh(1). The connection is made on
+// the first request.
+func NewRemoteAgentClient(dest string) (*AgentClient, error) {
+	u, err := url.Parse(RemoteIdentityPrefix + dest)
+	if err != nil || len(u.Hostname()) == 0 || strings.HasPrefix(u.Host, "-") {
+		return nil, fmt.Errorf("agent: invalid host %q", dest)
+	}
+
+	if _, ok := u.User.Password(); ok || len(u.Path) > 0 || len(u.RawQuery) > 0 {
+		return nil, fmt.Errorf("agent: invalid host %q", dest)
+	}
+
+	args := strings.Fields(os.Getenv("SIGTOOL_SSH"))
+	if len(args) == 0 {
+		args = []string{"ssh"}
+	}
+
+	args = append(args, "-T")
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if p := u.Port(); len(p) > 0 {
+		args = append(args, "-p", p)
+	}
+
+	remote := os.Getenv("SIGTOOL_REMOTE")
+	if len(remote) == 0 {
+		remote = _RemoteCommand
+	}
+	args = append(args, "--", u.Hostname(), remote)
+
+	start := func() (io.WriteCloser, io.ReadCloser, error) {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+
+		wr, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		rd, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err = cmd.Start(); err != nil {
+			return nil, nil, err
+		}
+
+		// reap ssh when it exits
+		go cmd.Wait()
+		return wr, rd, nil
+	}
+
+	return &AgentClient{pipe: &agentPipe{start: start}}, nil
+}
+
+// ProxyAgent passes the list, sign and x25519 requests read from 'rd' to
+// the agent of 'c' and writes the replies to 'wr' until 'rd' is closed.
+// Other requests are refused.
+func ProxyAgent(rd io.Reader, wr io.Writer, c *AgentClient) error {
+	dec := json.NewDecoder(rd)
+	enc := json.NewEncoder(wr)
+	for {
+		var req agentRequest
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("agent proxy: %s", err)
+		}
+
+		r := &agentReply{}
+		if proxyOps[req.Op] {
+			var err error
+			if r, err = c.call(&req); err != nil {
+				r = &agentReply{Error: err.Error()}
+			}
+		} else {
+			r.Error = fmt.Sprintf("agent: %q isn't allowed remotely", req.Op)
+		}
+
+		debug(nil, "agent proxy: request", "op", req.Op, "key", req.Key, "err", r.Error)
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("agent proxy: %s", err)
+		}
+	}
+}
+
+// parse a remote identity "ssh://[user@]host[:port][/FP]"
+func parseRemoteIdentity(s string) (*PrivateKey, error) {
+	dest := strings.TrimPrefix(s, RemoteIdentityPrefix)
+
+	var fp string
+	if i := strings.IndexByte(dest, '/'); i >= 0 {
+		dest, fp = dest[:i], dest[i+1:]
+	}
+
+	c, err := NewRemoteAgentClient(dest)
+	if err != nil {
+		return nil, fmt.Errorf("parse identity: %s", err)
+	}
+
+	sk, err := c.PrivateKey(fp)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("parse identity: %s: %s", dest, err)
+	}
+	return sk, nil
+}
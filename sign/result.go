@@ -0,0 +1,215 @@
+// result.go -- details of verified signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"time"
+)
+
+// tolerated clock skew between the signer and the verifier
+const _MaxClockSkew = 5 * time.Minute
+
+// VerifyResult describes a signature that verified
+type VerifyResult struct {
+	// Trusted public key that made the signature (or certified the
+	// subkey that made it)
+	Signer *PublicKey
+
+	// Subkey that made the signature; nil if Signer made it
+	Subkey *PublicKey
+
+	// Fingerprint of the signer's key
+	Fingerprint string
+
+	// Hash algorithm used to calculate the content checksum
+	HashAlgo string
+
+	// Signed attributes; nil if the signature has none
+	Attrs *Attributes
+
+	// Time at which the signature was made; zero if it isn't known
+	Time time.Time
+
+	// Issues that didn't fail the verification (e.g., an expired key
+	// allowed by the expiry policy)
+	Warnings []string
+
+	// The signature that verified
+	Signature *Signature
+}
+
+// VerifyFileResult is like VerifyFileThreshold() but returns the details
+// of each signature that verified.
+func VerifyFileResult(fn string, sigs []*Signature, pks []*PublicKey, k int) ([]*VerifyResult, error) {
+	// the file is hashed once with each hash used by the signatures
+	cks := make(map[string][]byte)
+	var sz int64 = -1
+
+	for _, sig := range sigs {
+		algo := sigHashAlgo(sig)
+		if _, ok := cks[algo]; ok {
+			continue
+		}
+
+		h, err := contentHash(algo)
+		if err != nil {
+			return nil, err
+		}
+
+		ck, n, err := fileCksum(fn, h)
+		if err != nil {
+			return nil, err
+		}
+		cks[algo], sz = ck, n
+	}
+
+	cksum := func(sig *Signature) []byte {
+		return cks[sigHashAlgo(sig)]
+	}
+	return verifyResult(cksum, sizeMatch(sigs, sz), pks, k)
+}
+
+// VerifyMessageResult is like VerifyMessageThreshold() but returns the
+// details of each signature that verified.
+func VerifyMessageResult(ck []byte, sigs []*Signature, pks []*PublicKey, k int) ([]*VerifyResult, error) {
+	cksum := func(_ *Signature) []byte {
+		return ck
+	}
+	return verifyResult(cksum, sigs, pks, k)
+}
+
+// verify the signatures 'sigs' of the checksums returned by 'cksum'
+func verifyResult(cksum func(sig *Signature) []byte, sigs []*Signature, pks []*PublicKey, k int) ([]*VerifyResult, error) {
+	if k < 1 || k > len(pks) {
+		return nil, fmt.Errorf("verify: invalid threshold %d of %d keys", k, len(pks))
+	}
+
+	// a trusted key is counted at most once
+	seen := make(map[string]bool)
+	var good []*VerifyResult
+	var experr error
+
+	for _, pk := range pks {
+		if seen[string(pk.hash)] {
+			continue
+		}
+
+		for _, sig := range sigs {
+			sk := sig.signingKey(pk)
+			if sk != nil && sk.VerifyMessage(cksum(sig), sig) {
+				seen[string(pk.hash)] = true
+
+				// signatures by expired or encrypt-only keys don't count
+				if err := checkSigner(pk, sk); err != nil {
+					experr = err
+					break
+				}
+				good = append(good, newVerifyResult(sig, pk, sk))
+				break
+			}
+		}
+	}
+
+	if len(good) < k {
+		if experr != nil {
+			return good, experr
+		}
+		return good, ErrTooFewSignatures
+	}
+	return good, nil
+}
+
+// Signers returns the public keys of the verified signatures in 'r'
+func Signers(r []*VerifyResult) []*PublicKey {
+	pks := make([]*PublicKey, 0, len(r))
+	for _, v := range r {
+		pks = append(pks, v.Signer)
+	}
+	return pks
+}
+
+// check the usage and expiry of the trusted key 'pk' and of its subkey
+// 'sk' that made a signature
+func checkSigner(pk, sk *PublicKey) error {
+	keys := []*PublicKey{pk}
+	if sk != pk {
+		keys = append(keys, sk)
+	}
+
+	for _, k := range keys {
+		if err := k.checkUsage(UsageSign); err != nil {
+			return err
+		}
+		if err := k.checkExpiry("verify"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newVerifyResult(sig *Signature, pk, sk *PublicKey) *VerifyResult {
+	r := &VerifyResult{
+		Signer:      pk,
+		Fingerprint: pk.Fingerprint(),
+		HashAlgo:    hashSHA512,
+		Attrs:       sig.Attrs,
+		Signature:   sig,
+	}
+
+	if sk != pk {
+		r.Subkey = sk
+		if sk.Expired(time.Now()) {
+			r.warn("subkey %s expired on %s", sk.cert.Name, sk.Expires.Format(time.RFC3339))
+		}
+	}
+
+	now := time.Now()
+	if pk.Expired(now) {
+		r.warn("key expired on %s", pk.Expires.Format(time.RFC3339))
+	}
+
+	a := sig.Attrs
+	if a == nil {
+		return r
+	}
+
+	r.Time = a.Time
+	if len(a.HashAlgo) > 0 {
+		r.HashAlgo = a.HashAlgo
+	}
+
+	if !pk.Expires.IsZero() && a.Time.After(pk.Expires) {
+		r.warn("signed on %s after the key expired", a.Time.Format(time.RFC3339))
+	}
+	if a.Time.After(now.Add(_MaxClockSkew)) {
+		r.warn("signing time %s is in the future", a.Time.Format(time.RFC3339))
+	}
+	return r
+}
+
+func (r *VerifyResult) warn(f string, v ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(f, v...))
+}
+
+// signatures whose attributes don't match the content size can't count
+func sizeMatch(sigs []*Signature, sz int64) []*Signature {
+	good := make([]*Signature, 0, len(sigs))
+	for _, sig := range sigs {
+		if sig.Attrs == nil || sig.Attrs.Size == sz {
+			good = append(good, sig)
+		}
+	}
+	return good
+}
@@ -0,0 +1,496 @@
+// rewrap.go -- move encrypted files to a new recipient key
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A rewrap token lets a storage service move encrypted files from an old
+// recipient key to a new one without seeing the file keys or the
+// plaintext. The file key of an X25519 recipient with private key 'a' is
+// wrapped with a·R where R is the ephemeral key in the header. The token
+// is the scalar t = a/b (mod the order of the group) for the new private
+// key 'b'; the service computes R' = t·R and the new recipient finds
+// b·R' = a·R, the key that wrapped the file key.
+//
+// The header checksum covers the wrapped keys and is mixed into the data
+// key; so the header can't change. Instead, a rewrapped file starts with
+// a block of rewrap records followed by the original file:
+//
+//    "SigTool" || 0x80 || uint32_be(len) || records
+//
+// Each record is 97 bytes:
+//
+//    len(PK) (0 or 32) || PK (zero padded) || X25519 PK of the recipient || R'
+//
+// where PK is the Ed25519 key of the original recipient (the additional
+// data of its wrapped key). Rewrapping a rewrapped file moves the records
+// of the old key to the new key. The records aren't authenticated; a
+// modified record just doesn't unwrap.
+//
+// The token is a secret: with it, the holder of either private key can
+// unwrap with the other. The old key still unwraps the key in the header;
+// retire it once its files are rewrapped.
+
+package sign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// format version byte of the rewrap block
+	_Rewrapped uint8 = 0x80
+
+	_RewrapRecordLen = 1 + 32 + 32 + 32
+)
+
+// order of the prime order subgroup of Curve25519
+var curve25519L, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// RewrapToken moves wrapped keys from the X25519 key From to the key To
+type RewrapToken struct {
+	From []byte
+	To   []byte
+
+	// Ed25519 key of the old recipient; nil for X25519 keys
+	pk []byte
+
+	t *big.Int
+}
+
+// serialized rewrap token
+type serializedRewrapToken struct {
+	Comment string `yaml:"comment,omitempty"`
+	From    string `yaml:"from"`
+	To      string `yaml:"to"`
+	Pk      string `yaml:"pk,omitempty"`
+	Scalar  string `yaml:"scalar"`
+}
+
+// a rewrap record of a file
+type rewrapRecord struct {
+	pk  []byte // Ed25519 key of the original recipient
+	to  []byte // X25519 key of the recipient
+	epk []byte // R'
+}
+
+// NewRewrapToken makes a token that moves the files of 'oldSK' to 'newSK'
+func NewRewrapToken(oldSK, newSK *PrivateKey) (*RewrapToken, error) {
+	var xsk, xpk [2][]byte
+
+	for i, sk := range []*PrivateKey{oldSK, newSK} {
+		if sk.ext != nil || sk.agent != nil {
+			return nil, fmt.Errorf("rewrap: keys must be X25519 or Ed25519 keys")
+		}
+		if err := sk.checkUsage(UsageEncrypt); err != nil {
+			return nil, fmt.Errorf("rewrap: %s", err)
+		}
+
+		x, p, err := sk.wrapKeys()
+		if err != nil {
+			return nil, fmt.Errorf("rewrap: %s", err)
+		}
+		xsk[i], xpk[i] = x, p
+	}
+
+	if bytes.Equal(xpk[0], xpk[1]) {
+		return nil, fmt.Errorf("rewrap: old and new keys are the same")
+	}
+
+	// X25519 clamps the private keys; age keys are stored unclamped
+	a := scalarModL(clampScalar(xsk[0]))
+	b := scalarModL(clampScalar(xsk[1]))
+	if b.ModInverse(b, curve25519L) == nil {
+		return nil, fmt.Errorf("rewrap: invalid new key")
+	}
+
+	a.Mul(a, b).Mod(a, curve25519L)
+	return &RewrapToken{
+		From: xpk[0],
+		To:   xpk[1],
+		pk:   oldSK.PublicKey().Pk,
+		t:    a,
+	}, nil
+}
+
+// the X25519 keys of 'sk' that its files are wrapped for
+func (sk *PrivateKey) wrapKeys() (xsk, xpk []byte, err error) {
+	xpk, err = sk.PublicKey().toCurve25519PK()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, x := range sk.encryptionKeys() {
+		if p, err := x25519Public(x); err == nil && bytes.Equal(p, xpk) {
+			return x, xpk, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("private key doesn't match its X25519 public key")
+}
+
+// Rewrap reads an encrypted file from 'rd' and writes it to 'wr' with the
+// keys of the old recipient moved to the new one. Files that aren't
+// encrypted to the old recipient can't be told apart; they get a record
+// that no key unwraps.
+func (t *RewrapToken) Rewrap(rd io.Reader, wr io.Writer) error {
+	var hdr bytes.Buffer
+
+	d, err := NewDecryptor(io.TeeReader(rd, &hdr))
+	if err != nil {
+		return err
+	}
+
+	if d.hdrHash != nil {
+		return fmt.Errorf("rewrap: files with streamed recipients can't be rewrapped")
+	}
+
+	x25519Keys := 0
+	for _, w := range d.Keys {
+		if len(w.Type) == 0 {
+			x25519Keys++
+		}
+	}
+	if x25519Keys == 0 {
+		return fmt.Errorf("rewrap: file has no X25519 recipients")
+	}
+
+	recs, err := t.rewrap(d.Pk, d.rewraps)
+	if err != nil {
+		return err
+	}
+
+	// the original file follows the rewrap block
+	b := hdr.Bytes()[rewrapsLen(d.rewraps):]
+
+	if err = fullwrite(marshalRewraps(recs), wr); err != nil {
+		return fmt.Errorf("rewrap: %s", err)
+	}
+	if err = fullwrite(b, wr); err != nil {
+		return fmt.Errorf("rewrap: %s", err)
+	}
+	if _, err = io.Copy(wr, rd); err != nil {
+		return fmt.Errorf("rewrap: %s", err)
+	}
+
+	info(nil, "rewrap: file rewrapped", "records", len(recs))
+	return nil
+}
+
+// move the records 'old' of the file with ephemeral key 'epk' to the new
+// key; if none are for the old key, the key in the header is moved.
+func (t *RewrapToken) rewrap(epk []byte, old []*rewrapRecord) ([]*rewrapRecord, error) {
+	var recs []*rewrapRecord
+
+	add := func(r *rewrapRecord) {
+		for _, x := range recs {
+			if bytes.Equal(x.to, r.to) && bytes.Equal(x.epk, r.epk) {
+				return
+			}
+		}
+		recs = append(recs, r)
+	}
+
+	moved := false
+	for _, r := range old {
+		if bytes.Equal(r.to, t.From) {
+			k, err := scalarMult(t.t, r.epk)
+			if err != nil {
+				return nil, fmt.Errorf("rewrap: %s", err)
+			}
+
+			r = &rewrapRecord{pk: r.pk, to: t.To, epk: k}
+			moved = true
+		}
+		add(r)
+	}
+
+	if !moved {
+		k, err := scalarMult(t.t, epk)
+		if err != nil {
+			return nil, fmt.Errorf("rewrap: %s", err)
+		}
+		add(&rewrapRecord{pk: t.pk, to: t.To, epk: k})
+	}
+	return recs, nil
+}
+
+// Serialize the rewrap token as YAML
+func (t *RewrapToken) Serialize(comment string) ([]byte, error) {
+	b64 := base64.StdEncoding.EncodeToString
+	st := &serializedRewrapToken{
+		Comment: comment,
+		From:    b64(t.From),
+		To:      b64(t.To),
+		Scalar:  b64(t.t.FillBytes(make([]byte, 32))),
+	}
+	if t.pk != nil {
+		st.Pk = b64(t.pk)
+	}
+
+	out, err := yaml.Marshal(st)
+	if err != nil {
+		return nil, fmt.Errorf("rewrap: can't marshal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// SerializeFile writes the rewrap token to file 'fn'
+func (t *RewrapToken) SerializeFile(fn, comment string) error {
+	b, err := t.Serialize(comment)
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b, 0600)
+}
+
+// ReadRewrapToken reads a rewrap token from file 'fn'
+func ReadRewrapToken(fn string) (*RewrapToken, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := MakeRewrapToken(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return t, nil
+}
+
+// MakeRewrapToken parses a serialized rewrap token
+func MakeRewrapToken(b []byte) (*RewrapToken, error) {
+	var st serializedRewrapToken
+
+	if err := yaml.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("rewrap: can't parse YAML: %s", err)
+	}
+
+	b64 := base64.StdEncoding.DecodeString
+	var v [4][]byte
+	for i, s := range []string{st.From, st.To, st.Scalar, st.Pk} {
+		x, err := b64(s)
+		if err != nil || (i < 3 && len(x) != 32) || (i == 3 && len(x) != 0 && len(x) != 32) {
+			return nil, fmt.Errorf("rewrap: not a rewrap token")
+		}
+		v[i] = x
+	}
+
+	t := &RewrapToken{
+		From: v[0],
+		To:   v[1],
+		t:    new(big.Int).SetBytes(v[2]),
+	}
+	if len(v[3]) > 0 {
+		t.pk = v[3]
+	}
+
+	if t.t.Sign() == 0 || t.t.Cmp(curve25519L) >= 0 {
+		return nil, fmt.Errorf("rewrap: invalid scalar")
+	}
+	return t, nil
+}
+
+// unwrap the file key with the rewrap records; nil if none are ours
+func (d *Decryptor) unwrapRewrapped(sk *PrivateKey) ([]byte, error) {
+	if sk.ext != nil || sk.agent != nil {
+		return nil, nil
+	}
+
+	for _, r := range d.rewraps {
+		pk := &PublicKey{Pk: r.pk}
+		for _, ourSK := range sk.encryptionKeys() {
+			// records aren't authenticated; a bad R' isn't ours
+			dkek, err := x25519(ourSK, r.epk)
+			if err != nil {
+				continue
+			}
+
+			kek, err := d.wrapKEK(dkek)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, w := range d.Keys {
+				if len(w.Type) > 0 {
+					continue
+				}
+
+				dkey, err := d.unwrapShared(w, kek, pk)
+				if dkey != nil || err != nil {
+					return dkey, err
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// read the rewrap records if the fixed header 'b' starts a rewrap block
+// and replace 'b' with the fixed header of the file that follows it.
+func readRewraps(rd io.Reader, b []byte) ([]*rewrapRecord, error) {
+	if !bytes.Equal(b[:_MagicLen], []byte(_Magic)) || b[_MagicLen] != _Rewrapped {
+		return nil, nil
+	}
+
+	n := binary.BigEndian.Uint32(b[_MagicLen+1:])
+	if n == 0 || n%_RewrapRecordLen != 0 || n > 1048576 {
+		return nil, fmt.Errorf("decrypt: invalid rewrap block length %d", n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, fmt.Errorf("decrypt: err while reading rewrap block: %s", err)
+	}
+
+	var recs []*rewrapRecord
+	for ; len(buf) > 0; buf = buf[_RewrapRecordLen:] {
+		r := &rewrapRecord{
+			to:  buf[33:65],
+			epk: buf[65:97],
+		}
+
+		switch buf[0] {
+		case 0:
+		case 32:
+			r.pk = buf[1:33]
+		default:
+			return nil, fmt.Errorf("decrypt: invalid rewrap record")
+		}
+		recs = append(recs, r)
+	}
+
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return nil, fmt.Errorf("decrypt: err while reading header: %s", err)
+	}
+	return recs, nil
+}
+
+// length of the rewrap block of the records 'recs'
+func rewrapsLen(recs []*rewrapRecord) int {
+	if len(recs) == 0 {
+		return 0
+	}
+	return _FixedHdrLen + len(recs)*_RewrapRecordLen
+}
+
+// marshal the rewrap block of the records 'recs'
+func marshalRewraps(recs []*rewrapRecord) []byte {
+	b := make([]byte, _FixedHdrLen+len(recs)*_RewrapRecordLen)
+
+	copy(b, []byte(_Magic))
+	b[_MagicLen] = _Rewrapped
+	binary.BigEndian.PutUint32(b[_MagicLen+1:], uint32(len(recs)*_RewrapRecordLen))
+
+	p := b[_FixedHdrLen:]
+	for _, r := range recs {
+		p[0] = byte(len(r.pk))
+		copy(p[1:33], r.pk)
+		copy(p[33:65], r.to)
+		copy(p[65:97], r.epk)
+		p = p[_RewrapRecordLen:]
+	}
+	return b
+}
+
+// a copy of the X25519 private key 'k' clamped as X25519 does
+func clampScalar(k []byte) []byte {
+	c := append([]byte{}, k...)
+	c[0] &= 248
+	c[31] &= 127
+	c[31] |= 64
+	return c
+}
+
+// the little endian scalar 'k' reduced mod the group order
+func scalarModL(k []byte) *big.Int {
+	be := make([]byte, len(k))
+	for i, c := range k {
+		be[len(k)-i-1] = c
+	}
+	n := new(big.Int).SetBytes(be)
+	return n.Mod(n, curve25519L)
+}
+
+// The u-coordinate of k·P for the u-coordinate 'u' of P (RFC 7748 ladder).
+// Unlike X25519, 'k' isn't clamped. This isn't constant time; it only
+// runs on the token (the storage service) and not on private keys.
+func scalarMult(k *big.Int, u []byte) ([]byte, error) {
+	if len(u) != 32 {
+		return nil, fmt.Errorf("invalid X25519 key (len %d)", len(u))
+	}
+
+	p := curve25519P
+	be := make([]byte, 32)
+	for i, c := range u {
+		be[31-i] = c
+	}
+	be[0] &= 0x7f
+
+	x1 := new(big.Int).SetBytes(be)
+	x1.Mod(x1, p)
+
+	x2, z2 := big.NewInt(1), big.NewInt(0)
+	x3, z3 := new(big.Int).Set(x1), big.NewInt(1)
+	a24 := big.NewInt(121665)
+
+	mod := func(v *big.Int) *big.Int { return v.Mod(v, p) }
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		if k.Bit(i) == 1 {
+			x2, x3 = x3, x2
+			z2, z3 = z3, z2
+		}
+
+		a := mod(new(big.Int).Add(x2, z2))
+		aa := mod(new(big.Int).Mul(a, a))
+		b := mod(new(big.Int).Sub(x2, z2))
+		bb := mod(new(big.Int).Mul(b, b))
+		e := mod(new(big.Int).Sub(aa, bb))
+		c := new(big.Int).Add(x3, z3)
+		da := mod(new(big.Int).Mul(new(big.Int).Sub(x3, z3), a))
+		cb := mod(new(big.Int).Mul(c, b))
+
+		x3 = new(big.Int).Add(da, cb)
+		x3 = mod(x3.Mul(x3, x3))
+		z3 = new(big.Int).Sub(da, cb)
+		z3 = mod(z3.Mul(z3, z3).Mul(z3, x1))
+		x2 = mod(new(big.Int).Mul(aa, bb))
+		z2 = new(big.Int).Mul(a24, e)
+		z2 = mod(z2.Add(z2, aa).Mul(z2, e))
+
+		if k.Bit(i) == 1 {
+			x2, x3 = x3, x2
+			z2, z3 = z3, z2
+		}
+	}
+
+	if z2.Sign() == 0 {
+		return nil, fmt.Errorf("invalid X25519 key")
+	}
+
+	z2.ModInverse(z2, p)
+	x2 = mod(x2.Mul(x2, z2))
+	if x2.Sign() == 0 {
+		return nil, fmt.Errorf("invalid X25519 key")
+	}
+
+	out := x2.FillBytes(make([]byte, 32))
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
@@ -0,0 +1,226 @@
+// rotate.go -- key rotation statements
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A rotation statement binds an old key to its replacement. Both keys sign:
+//
+//    "sigtool key rotation v1" || old PK || new PK || uint64_be(time)
+//
+// A verifier that only knows (or has pinned) the old key can then accept
+// signatures made by the new key. Rotations can be chained: old -> mid ->
+// new.
+
+package sign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	Ed "crypto/ed25519"
+	"gopkg.in/yaml.v2"
+)
+
+const _RotationPrefix = "sigtool key rotation v1"
+
+// Rotation is a statement that key Old is replaced by key New
+type Rotation struct {
+	Old *PublicKey
+	New *PublicKey
+
+	// Time of the rotation
+	Time time.Time
+
+	oldSig []byte
+	newSig []byte
+}
+
+// serialized rotation statement
+type serializedRotation struct {
+	Comment string `yaml:"comment,omitempty"`
+	Old     string `yaml:"old"`
+	New     string `yaml:"new"`
+	Time    string `yaml:"time"`
+	OldSig  string `yaml:"oldsig"`
+	NewSig  string `yaml:"newsig"`
+}
+
+// NewRotation makes a statement that 'oldSK' is replaced by 'newSK'
+// signed by both keys.
+func NewRotation(oldSK, newSK *PrivateKey) (*Rotation, error) {
+	for _, sk := range []*PrivateKey{oldSK, newSK} {
+		if !sk.canSign() {
+			return nil, fmt.Errorf("rotate: keys must be Ed25519 signing keys")
+		}
+		if err := sk.checkUsage(UsageSign); err != nil {
+			return nil, fmt.Errorf("rotate: %s", err)
+		}
+	}
+
+	if bytes.Equal(oldSK.pk.Pk, newSK.pk.Pk) {
+		return nil, fmt.Errorf("rotate: old and new keys are the same")
+	}
+
+	r := &Rotation{
+		Old:  oldSK.pk,
+		New:  newSK.pk,
+		Time: time.Now().UTC().Truncate(time.Second),
+	}
+
+	var err error
+
+	m := r.message()
+	if r.oldSig, err = oldSK.ed25519Sign(m); err != nil {
+		return nil, fmt.Errorf("rotate: can't sign: %s", err)
+	}
+	if r.newSig, err = newSK.ed25519Sign(m); err != nil {
+		return nil, fmt.Errorf("rotate: can't sign: %s", err)
+	}
+	return r, nil
+}
+
+// the message signed by both keys
+func (r *Rotation) message() []byte {
+	var t [8]byte
+	var b bytes.Buffer
+
+	binary.BigEndian.PutUint64(t[:], uint64(r.Time.Unix()))
+	b.WriteString(_RotationPrefix)
+	b.Write(r.Old.Pk)
+	b.Write(r.New.Pk)
+	b.Write(t[:])
+	return b.Bytes()
+}
+
+// Verify the signatures of both keys on the statement
+func (r *Rotation) Verify() error {
+	m := r.message()
+	if !Ed.Verify(Ed.PublicKey(r.Old.Pk), m, r.oldSig) {
+		return fmt.Errorf("rotate: signature of the old key doesn't verify")
+	}
+	if !Ed.Verify(Ed.PublicKey(r.New.Pk), m, r.newSig) {
+		return fmt.Errorf("rotate: signature of the new key doesn't verify")
+	}
+	return nil
+}
+
+// Serialize the rotation statement as YAML
+func (r *Rotation) Serialize(comment string) ([]byte, error) {
+	b64 := base64.StdEncoding.EncodeToString
+	sr := &serializedRotation{
+		Comment: comment,
+		Old:     b64(r.Old.Pk),
+		New:     b64(r.New.Pk),
+		Time:    r.Time.Format(time.RFC3339),
+		OldSig:  b64(r.oldSig),
+		NewSig:  b64(r.newSig),
+	}
+
+	out, err := yaml.Marshal(sr)
+	if err != nil {
+		return nil, fmt.Errorf("rotate: can't marshal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// SerializeFile writes the rotation statement to file 'fn'
+func (r *Rotation) SerializeFile(fn, comment string) error {
+	b, err := r.Serialize(comment)
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b, 0644)
+}
+
+// ReadRotation reads and verifies a rotation statement from file 'fn'
+func ReadRotation(fn string) (*Rotation, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return MakeRotation(b)
+}
+
+// MakeRotation parses and verifies a serialized rotation statement
+func MakeRotation(b []byte) (*Rotation, error) {
+	var sr serializedRotation
+
+	if err := yaml.Unmarshal(b, &sr); err != nil {
+		return nil, fmt.Errorf("rotate: can't parse YAML: %s", err)
+	}
+
+	b64 := base64.StdEncoding.DecodeString
+	var v [4][]byte
+	for i, s := range []string{sr.Old, sr.New, sr.OldSig, sr.NewSig} {
+		x, err := b64(s)
+		if err != nil || len(x) == 0 {
+			return nil, fmt.Errorf("rotate: not a rotation statement")
+		}
+		v[i] = x
+	}
+
+	t, err := time.Parse(time.RFC3339, sr.Time)
+	if err != nil {
+		return nil, fmt.Errorf("rotate: invalid time %q", sr.Time)
+	}
+
+	r := &Rotation{
+		Time:   t,
+		oldSig: v[2],
+		newSig: v[3],
+	}
+
+	if r.Old, err = PublicKeyFromBytes(v[0]); err != nil {
+		return nil, fmt.Errorf("rotate: old key: %s", err)
+	}
+	if r.New, err = PublicKeyFromBytes(v[1]); err != nil {
+		return nil, fmt.Errorf("rotate: new key: %s", err)
+	}
+
+	if err = r.Verify(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RotatedKeys returns the keys that the keys with fingerprints 'pins'
+// were rotated to by the statements 'rots', following chains of
+// rotations. The statements must have been verified (as done by
+// ReadRotation() and MakeRotation()).
+func RotatedKeys(pins []string, rots []*Rotation) []*PublicKey {
+	var pks []*PublicKey
+
+	seen := make(map[string]bool)
+	for _, pin := range pins {
+		seen[strings.TrimSpace(pin)] = true
+	}
+
+	// each pass adds the successors of the keys found so far
+	for more := true; more; {
+		more = false
+		for _, r := range rots {
+			nfp := r.New.Fingerprint()
+			if seen[nfp] || !seen[r.Old.Fingerprint()] {
+				continue
+			}
+
+			seen[nfp] = true
+			pks = append(pks, r.New)
+			more = true
+		}
+	}
+	return pks
+}
@@ -0,0 +1,473 @@
+// roughtime.go -- Roughtime timestamps of signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A Roughtime server signs the current time along with a nonce chosen by
+// the client. The nonce of a signature's timestamp is a hash of the
+// signature; the signed response of the server proves that the signature
+// existed at the time given by the server (within its radius) without
+// trusting the clock of the signer.
+//
+// The response is kept with the signature as is and verified against the
+// long term key of the server. The servers are listed in a JSON file in
+// the format of the Roughtime ecosystem:
+//
+//    {
+//      "servers": [
+//        {
+//          "name": "example",
+//          "publicKeyType": "ed25519",
+//          "publicKey": "base64",
+//          "addresses": [{"protocol": "udp", "address": "host:2002"}]
+//        }
+//      ]
+//    }
+
+package sign
+
+import (
+	"bytes"
+	Ed "crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RoughtimeServer is a Roughtime server and its long term key
+type RoughtimeServer struct {
+	Name      string
+	Addresses []string
+	PublicKey []byte
+}
+
+// RoughtimeProof is the signed response of a Roughtime server to a nonce
+// derived from a signature
+type RoughtimeProof struct {
+	// Name of the server
+	Server string
+
+	// Long term public key of the server
+	PublicKey []byte
+
+	// The response of the server
+	Response []byte
+}
+
+// RoughtimeStamp is a verified Roughtime timestamp: the signature existed
+// at Midpoint (+/- Radius).
+type RoughtimeStamp struct {
+	Server   string
+	Midpoint time.Time
+	Radius   time.Duration
+}
+
+// ErrRoughtimeUntrusted is returned when the timestamp of a signature is
+// made by a server that isn't trusted.
+var ErrRoughtimeUntrusted = errors.New("roughtime: timestamp by an untrusted server")
+
+const (
+	_RoughtimeNonce    = "sigtool roughtime nonce"
+	_RoughtimeDeleCtx  = "RoughTime v1 delegation signature--\x00"
+	_RoughtimeRespCtx  = "RoughTime v1 response signature\x00"
+	_RoughtimeReqSize  = 1024
+	_RoughtimeTimeout  = 2 * time.Second
+	_RoughtimeAttempts = 3
+	_RoughtimeMaxTags  = 64
+	_RoughtimeHashSize = 64
+)
+
+// serialized server list
+type serializedRoughtimeServers struct {
+	Servers []struct {
+		Name          string `json:"name"`
+		PublicKeyType string `json:"publicKeyType"`
+		PublicKey     string `json:"publicKey"`
+		Addresses     []struct {
+			Protocol string `json:"protocol"`
+			Address  string `json:"address"`
+		} `json:"addresses"`
+	} `json:"servers"`
+}
+
+// serialized timestamp of a signature
+type serializedRoughtime struct {
+	Server   string `yaml:"server,omitempty" json:"server,omitempty"`
+	Pk       string `yaml:"pk" json:"pk"`
+	Response string `yaml:"response" json:"response"`
+}
+
+// ReadRoughtimeServers reads the list of Roughtime servers in file 'fn'
+func ReadRoughtimeServers(fn string) ([]*RoughtimeServer, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	srvs, err := MakeRoughtimeServers(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return srvs, nil
+}
+
+// MakeRoughtimeServers parses a JSON list of Roughtime servers
+func MakeRoughtimeServers(b []byte) ([]*RoughtimeServer, error) {
+	var ss serializedRoughtimeServers
+
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return nil, fmt.Errorf("roughtime: can't parse server list: %s", err)
+	}
+
+	var srvs []*RoughtimeServer
+	for _, s := range ss.Servers {
+		if s.PublicKeyType != "ed25519" {
+			return nil, fmt.Errorf("roughtime: %s: unsupported key type %q", s.Name, s.PublicKeyType)
+		}
+
+		pk, err := base64.StdEncoding.DecodeString(s.PublicKey)
+		if err != nil || len(pk) != Ed.PublicKeySize {
+			return nil, fmt.Errorf("roughtime: %s: invalid public key", s.Name)
+		}
+
+		srv := &RoughtimeServer{Name: s.Name, PublicKey: pk}
+		for _, a := range s.Addresses {
+			if a.Protocol == "udp" {
+				srv.Addresses = append(srv.Addresses, a.Address)
+			}
+		}
+		if len(srv.Addresses) == 0 {
+			return nil, fmt.Errorf("roughtime: %s: no udp address", s.Name)
+		}
+		srvs = append(srvs, srv)
+	}
+
+	if len(srvs) == 0 {
+		return nil, fmt.Errorf("roughtime: no servers")
+	}
+	return srvs, nil
+}
+
+// Timestamp gets a Roughtime timestamp of the signature from the first
+// of the servers 'srvs' that answers and keeps it with the signature.
+func (sig *Signature) Timestamp(srvs []*RoughtimeServer) (*RoughtimeStamp, error) {
+	nonce := sig.roughtimeNonce()
+
+	var errs []string
+	for _, srv := range srvs {
+		resp, err := srv.query(nonce)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", srv.Name, err))
+			continue
+		}
+
+		mid, rad, err := verifyRoughtime(srv.PublicKey, nonce, resp)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", srv.Name, err))
+			continue
+		}
+
+		sig.Roughtime = &RoughtimeProof{
+			Server:    srv.Name,
+			PublicKey: srv.PublicKey,
+			Response:  resp,
+		}
+		return &RoughtimeStamp{Server: srv.Name, Midpoint: mid, Radius: rad}, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("roughtime: no servers")
+	}
+	return nil, fmt.Errorf("roughtime: no timestamp: %s", strings.Join(errs, "; "))
+}
+
+// VerifyRoughtime verifies the Roughtime timestamp of the signature with
+// the trusted servers 'srvs'; it is an error if the signature has no
+// timestamp or if its signed time is after the timestamp.
+func (sig *Signature) VerifyRoughtime(srvs []*RoughtimeServer) (*RoughtimeStamp, error) {
+	p := sig.Roughtime
+	if p == nil {
+		return nil, fmt.Errorf("roughtime: signature has no timestamp")
+	}
+
+	var srv *RoughtimeServer
+	for _, s := range srvs {
+		if bytes.Equal(s.PublicKey, p.PublicKey) {
+			srv = s
+			break
+		}
+	}
+	if srv == nil {
+		return nil, ErrRoughtimeUntrusted
+	}
+
+	mid, rad, err := verifyRoughtime(srv.PublicKey, sig.roughtimeNonce(), p.Response)
+	if err != nil {
+		return nil, err
+	}
+
+	if a := sig.Attrs; a != nil && a.Time.After(mid.Add(rad+_MaxClockSkew)) {
+		return nil, fmt.Errorf("roughtime: signature time %s is after its timestamp %s",
+			a.Time.Format(time.RFC3339), mid.Format(time.RFC3339))
+	}
+	return &RoughtimeStamp{Server: srv.Name, Midpoint: mid, Radius: rad}, nil
+}
+
+// the nonce of the timestamp of the signature
+func (sig *Signature) roughtimeNonce() []byte {
+	h := sha512.New()
+	h.Write([]byte(_RoughtimeNonce))
+	h.Write(sig.Sig)
+	return h.Sum(nil)
+}
+
+// send the nonce to the server and return its response
+func (srv *RoughtimeServer) query(nonce []byte) ([]byte, error) {
+	req := rtMessage{
+		rtTag("NONC"):    nonce,
+		rtTag("PAD\xff"): nil,
+	}
+
+	// pad the request to the minimum size
+	pad := _RoughtimeReqSize - len(req.marshal())
+	req[rtTag("PAD\xff")] = make([]byte, pad)
+	b := req.marshal()
+
+	var err error
+	for _, addr := range srv.Addresses {
+		var conn net.Conn
+
+		conn, err = net.DialTimeout("udp", addr, _RoughtimeTimeout)
+		if err != nil {
+			continue
+		}
+
+		buf := make([]byte, 65536)
+		for i := 0; i < _RoughtimeAttempts; i++ {
+			var n int
+
+			conn.SetDeadline(time.Now().Add(_RoughtimeTimeout))
+			if _, err = conn.Write(b); err != nil {
+				break
+			}
+			if n, err = conn.Read(buf); err == nil {
+				conn.Close()
+				return buf[:n], nil
+			}
+		}
+		conn.Close()
+	}
+	return nil, err
+}
+
+// verify the response 'resp' of the server with key 'pk' to 'nonce';
+// return the midpoint and radius.
+func verifyRoughtime(pk, nonce, resp []byte) (time.Time, time.Duration, error) {
+	var t time.Time
+
+	fail := func(f string, v ...interface{}) (time.Time, time.Duration, error) {
+		return t, 0, fmt.Errorf("roughtime: %s", fmt.Sprintf(f, v...))
+	}
+
+	m, err := parseRtMessage(resp)
+	if err != nil {
+		return fail("invalid response: %s", err)
+	}
+
+	cert, err := parseRtMessage(m[rtTag("CERT")])
+	if err != nil {
+		return fail("invalid certificate: %s", err)
+	}
+
+	dele := cert[rtTag("DELE")]
+	if !Ed.Verify(Ed.PublicKey(pk), rtSigned(_RoughtimeDeleCtx, dele), cert[rtTag("SIG\x00")]) {
+		return fail("bad delegation signature")
+	}
+
+	d, err := parseRtMessage(dele)
+	if err != nil {
+		return fail("invalid delegation: %s", err)
+	}
+
+	dpk, mint, maxt := d[rtTag("PUBK")], d[rtTag("MINT")], d[rtTag("MAXT")]
+	if len(dpk) != Ed.PublicKeySize || len(mint) != 8 || len(maxt) != 8 {
+		return fail("invalid delegation")
+	}
+
+	srep := m[rtTag("SREP")]
+	if !Ed.Verify(Ed.PublicKey(dpk), rtSigned(_RoughtimeRespCtx, srep), m[rtTag("SIG\x00")]) {
+		return fail("bad response signature")
+	}
+
+	s, err := parseRtMessage(srep)
+	if err != nil {
+		return fail("invalid signed response: %s", err)
+	}
+
+	root, midp, radi := s[rtTag("ROOT")], s[rtTag("MIDP")], s[rtTag("RADI")]
+	indx, path := m[rtTag("INDX")], m[rtTag("PATH")]
+	if len(root) != _RoughtimeHashSize || len(midp) != 8 || len(radi) != 4 ||
+		len(indx) != 4 || len(path)%_RoughtimeHashSize != 0 {
+		return fail("invalid signed response")
+	}
+
+	if !bytes.Equal(rtMerkleRoot(nonce, binary.LittleEndian.Uint32(indx), path), root) {
+		return fail("response isn't for this signature")
+	}
+
+	mid := binary.LittleEndian.Uint64(midp)
+	if mid < binary.LittleEndian.Uint64(mint) || mid > binary.LittleEndian.Uint64(maxt) {
+		return fail("delegated key isn't valid at the response time")
+	}
+
+	t = time.Unix(int64(mid/1e6), int64(mid%1e6)*1000).UTC()
+	rad := time.Duration(binary.LittleEndian.Uint32(radi)) * time.Microsecond
+	return t, rad, nil
+}
+
+// the root of the Merkle tree with the leaf 'nonce' at 'idx'; nil if
+// 'idx' is outside the tree.
+func rtMerkleRoot(nonce []byte, idx uint32, path []byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{0})
+	h.Write(nonce)
+	x := h.Sum(nil)
+
+	for ; len(path) > 0; path = path[_RoughtimeHashSize:] {
+		h.Reset()
+		h.Write([]byte{1})
+		if idx&1 == 0 {
+			h.Write(x)
+			h.Write(path[:_RoughtimeHashSize])
+		} else {
+			h.Write(path[:_RoughtimeHashSize])
+			h.Write(x)
+		}
+		x = h.Sum(nil)
+		idx >>= 1
+	}
+
+	// the index must be within the tree
+	if idx != 0 {
+		return nil
+	}
+	return x
+}
+
+// the message signed in context 'ctx'
+func rtSigned(ctx string, b []byte) []byte {
+	m := make([]byte, 0, len(ctx)+len(b))
+	m = append(m, ctx...)
+	return append(m, b...)
+}
+
+// rtMessage is a Roughtime message: a map of tags to values
+type rtMessage map[uint32][]byte
+
+// the tag 's' as a number; tags are sorted by it
+func rtTag(s string) uint32 {
+	var b [4]byte
+	copy(b[:], s)
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// marshal the message; the length of every value must be a multiple of 4
+func (m rtMessage) marshal() []byte {
+	tags := make([]uint32, 0, len(m))
+	for t := range m {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	n := len(tags)
+	b := make([]byte, 8*n)
+	binary.LittleEndian.PutUint32(b, uint32(n))
+
+	off := 0
+	for i, t := range tags {
+		if i > 0 {
+			binary.LittleEndian.PutUint32(b[4*i:], uint32(off))
+		}
+		binary.LittleEndian.PutUint32(b[4*n+4*i:], t)
+		off += len(m[t])
+	}
+
+	for _, t := range tags {
+		b = append(b, m[t]...)
+	}
+	return b
+}
+
+// parse a Roughtime message
+func parseRtMessage(b []byte) (rtMessage, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("message too short")
+	}
+
+	n := int(binary.LittleEndian.Uint32(b))
+	if n > _RoughtimeMaxTags || len(b) < 8*n || n == 0 && len(b) != 4 {
+		return nil, fmt.Errorf("invalid message header")
+	}
+
+	m := make(rtMessage)
+	data := b[8*n:]
+	for i := 0; i < n; i++ {
+		t := binary.LittleEndian.Uint32(b[4*n+4*i:])
+		if i > 0 && t <= binary.LittleEndian.Uint32(b[4*n+4*i-4:]) {
+			return nil, fmt.Errorf("tags aren't sorted")
+		}
+
+		start, end := 0, len(data)
+		if i > 0 {
+			start = int(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+		if i < n-1 {
+			end = int(binary.LittleEndian.Uint32(b[4*i+4:]))
+		}
+		if start%4 != 0 || start > end || end > len(data) {
+			return nil, fmt.Errorf("invalid offset of tag %08x", t)
+		}
+		m[t] = data[start:end]
+	}
+	return m, nil
+}
+
+func (p *RoughtimeProof) serialize() *serializedRoughtime {
+	b64 := base64.StdEncoding.EncodeToString
+	return &serializedRoughtime{
+		Server:   p.Server,
+		Pk:       b64(p.PublicKey),
+		Response: b64(p.Response),
+	}
+}
+
+func (sr *serializedRoughtime) decode() (*RoughtimeProof, error) {
+	b64 := base64.StdEncoding.DecodeString
+
+	pk, err := b64(sr.Pk)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode Base64:Roughtime key <%s>: %s", sr.Pk, err)
+	}
+
+	resp, err := b64(sr.Response)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode Base64:Roughtime response: %s", err)
+	}
+	return &RoughtimeProof{Server: sr.Server, PublicKey: pk, Response: resp}, nil
+}
@@ -0,0 +1,250 @@
+// schema.go -- validation of sigtool key files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// a field of a key file, the expected format of its value and the check
+// of the value
+type keyField struct {
+	name     string
+	required bool
+	format   string
+	check    func(v interface{}) bool
+}
+
+// fields of a private key file
+var privKeySchema = []keyField{
+	{"comment", false, "a string", isScalar},
+	{"esk", true, "base64 of 80 bytes", isBase64(80, 80)},
+	{"exsk", false, "base64 of 48 bytes", isBase64(48, 48)},
+	{"salt", true, "base64 of at least 12 bytes", isBase64(12, 0)},
+	{"algo", false, fmt.Sprintf("%s or %s", sk_algo, sk_algo_pbkdf2), isOneOf(sk_algo, sk_algo_pbkdf2)},
+	{"Z", false, "a positive integer", isCount},
+	{"r", false, "a positive integer", isCount},
+	{"p", false, "a positive integer", isCount},
+	{"usage", false, "sign, encrypt or any", isUsage},
+	{"cert", false, "base64", isBase64(1, 0)},
+}
+
+// fields of a public key file
+var pubKeySchema = []keyField{
+	{"comment", false, "a string", isScalar},
+	{"pk", true, "base64 of 32 bytes", isBase64(32, 32)},
+	{"hash", false, fmt.Sprintf("base64 of %d bytes", PKHashLength), isBase64(PKHashLength, PKHashLength)},
+	{"expires", false, "an RFC 3339 time (e.g., 2030-01-02T15:04:05Z)", isTime},
+	{"usage", false, "sign, encrypt or any", isUsage},
+	{"xpk", false, "base64 of 32 bytes", isBase64(32, 32)},
+	{"xsig", false, "base64 of 64 bytes", isBase64(64, 64)},
+	{"cert", false, "base64", isBase64(1, 0)},
+}
+
+// validate the private key file 'yml'
+func validatePrivateKey(yml []byte) error {
+	return validateKeyFile(yml, privKeySchema, true)
+}
+
+// validate the public key file 'yml'
+func validatePublicKey(yml []byte) error {
+	return validateKeyFile(yml, pubKeySchema, false)
+}
+
+// validate the key file 'yml' against 'schema'; errors name the field,
+// its line and the expected format. Keys of the wrong kind and signatures
+// are reported as such.
+func validateKeyFile(yml []byte, schema []keyField, private bool) error {
+	if err := wrongKeyFormat(yml, private); err != nil {
+		return err
+	}
+
+	var m yaml.MapSlice
+	if err := yaml.Unmarshal(yml, &m); err != nil || len(m) == 0 {
+		return fmt.Errorf("not a sigtool %s (expected YAML with the fields %s)", keyKind(private), fieldNames(schema))
+	}
+
+	return checkFields(m, schema, private, func(name string, nth int) string {
+		return fieldLine(yml, name, nth)
+	})
+}
+
+// check the fields 'm' of a key against 'schema'; 'where' returns the
+// location of the 'nth' occurrence of a field for errors.
+func checkFields(m yaml.MapSlice, schema []keyField, private bool, where func(name string, nth int) string) error {
+	seen := make(map[string]int)
+	for _, it := range m {
+		seen[fmt.Sprint(it.Key)]++
+	}
+
+	switch {
+	case seen["signature"] > 0 || seen["signatures"] > 0:
+		return fmt.Errorf("this is a signature, not a %s", keyKind(private))
+	case private && seen["pk"] > 0 && seen["esk"] == 0:
+		return fmt.Errorf("this is a public key; a private key is needed here")
+	case !private && seen["esk"] > 0:
+		return fmt.Errorf("this is a private key; use its public key (the .pub file) here")
+	}
+
+	nth := make(map[string]int)
+	for _, it := range m {
+		name := fmt.Sprint(it.Key)
+		at := where(name, nth[name])
+		nth[name]++
+
+		if nth[name] > 1 {
+			return fmt.Errorf("%sduplicate field %q", at, name)
+		}
+
+		f := findField(schema, name)
+		if f == nil {
+			return fmt.Errorf("%sunknown field %q (expected one of %s)", at, name, fieldNames(schema))
+		}
+
+		if !f.check(it.Value) {
+			return fmt.Errorf("%sfield %q: expected %s", at, name, f.format)
+		}
+	}
+
+	for i := range schema {
+		f := &schema[i]
+		if f.required && seen[f.name] == 0 {
+			return fmt.Errorf("missing field %q (%s)", f.name, f.format)
+		}
+	}
+	return nil
+}
+
+// keys in other formats given in place of a sigtool key
+func wrongKeyFormat(yml []byte, private bool) error {
+	s := bytes.TrimSpace(yml)
+	switch {
+	case !private && bytes.Contains(s, []byte("PRIVATE KEY-----")):
+		return fmt.Errorf("this is a PEM/OpenSSH private key; a public key is needed here")
+	case !private && bytes.HasPrefix(s, []byte("AGE-SECRET-KEY-1")):
+		return fmt.Errorf("this is an age private key; a public key is needed here")
+	case private && (bytes.HasPrefix(s, []byte("ssh-")) || bytes.HasPrefix(s, []byte("sk-ssh-"))):
+		return fmt.Errorf("this is an OpenSSH public key; a private key is needed here")
+	case private && bytes.HasPrefix(s, []byte(_AgeRecipientHRP+"1")):
+		return fmt.Errorf("this is an age recipient; a private key is needed here")
+	}
+	return nil
+}
+
+func keyKind(private bool) string {
+	if private {
+		return "private key"
+	}
+	return "public key"
+}
+
+func findField(schema []keyField, name string) *keyField {
+	for i := range schema {
+		if schema[i].name == name {
+			return &schema[i]
+		}
+	}
+	return nil
+}
+
+func fieldNames(schema []keyField) string {
+	v := make([]string, 0, len(schema))
+	for i := range schema {
+		v = append(v, schema[i].name)
+	}
+	return strings.Join(v, ", ")
+}
+
+// return "line N: " for the 'nth' top level occurrence of 'name' in 'yml'
+func fieldLine(yml []byte, name string, nth int) string {
+	keys := []string{name, `"` + name + `"`, "'" + name + "'"}
+	for i, ln := range strings.Split(string(yml), "\n") {
+		for _, k := range keys {
+			if strings.HasPrefix(ln, k) && strings.HasPrefix(strings.TrimLeft(ln[len(k):], " \t"), ":") {
+				if nth == 0 {
+					return fmt.Sprintf("line %d: ", i+1)
+				}
+				nth--
+			}
+		}
+	}
+	return ""
+}
+
+// comments can be any scalar; YAML turns some words into numbers or bools
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case yaml.MapSlice, []interface{}, map[interface{}]interface{}:
+		return false
+	}
+	return true
+}
+
+// base64 of 'min' to 'max' bytes; a 'max' of 0 has no upper bound
+func isBase64(min, max int) func(v interface{}) bool {
+	return func(v interface{}) bool {
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+
+		b, err := base64.StdEncoding.DecodeString(s)
+		return err == nil && len(b) >= min && (max == 0 || len(b) <= max)
+	}
+}
+
+func isOneOf(vals ...string) func(v interface{}) bool {
+	return func(v interface{}) bool {
+		s, ok := v.(string)
+		if ok {
+			for _, x := range vals {
+				if s == x {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func isCount(v interface{}) bool {
+	n, ok := v.(int)
+	return ok && n > 0
+}
+
+func isUsage(v interface{}) bool {
+	s, ok := v.(string)
+	if ok {
+		_, err := ParseKeyUsage(s)
+		return err == nil
+	}
+	return false
+}
+
+func isTime(v interface{}) bool {
+	switch t := v.(type) {
+	case time.Time:
+		return true
+	case string:
+		_, err := time.Parse(time.RFC3339, t)
+		return err == nil
+	}
+	return false
+}
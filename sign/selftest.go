@@ -0,0 +1,346 @@
+// selftest.go -- known answer tests for the crypto primitives
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	Ed "crypto/ed25519"
+	"github.com/opencoff/sigtool/internal/pb"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SelfTestResult is the outcome of one known answer test
+type SelfTestResult struct {
+	Name string
+	Err  error
+
+	// The test was not run because its algorithm is not FIPS approved
+	Skipped bool
+}
+
+// SelfTest runs the built-in known answer tests for the KDFs, key wrap,
+// chunk cipher and signatures. In FIPS mode the tests of algorithms that
+// are not approved are skipped. It returns the result of every test and
+// an error if any of them failed.
+func SelfTest() ([]SelfTestResult, error) {
+	kats := []struct {
+		name     string
+		fn       func() error
+		approved bool
+	}{
+		{"pbkdf2", katPBKDF2, true},
+		{"scrypt", katScrypt, false},
+		{"key wrap", katKeyWrap, false},
+		{"chunk cipher", katChunkCipher, false},
+		{"signature", katSignature, true},
+	}
+
+	var failed []string
+	res := make([]SelfTestResult, 0, len(kats))
+	for _, k := range kats {
+		if !k.approved && FIPSMode() {
+			res = append(res, SelfTestResult{Name: k.name, Skipped: true})
+			continue
+		}
+
+		err := k.fn()
+		if err != nil {
+			failed = append(failed, k.name)
+		}
+		res = append(res, SelfTestResult{Name: k.name, Err: err})
+	}
+
+	if len(failed) > 0 {
+		return res, fmt.Errorf("selftest: %d of %d tests failed: %s", len(failed), len(kats), failed)
+	}
+	return res, nil
+}
+
+// RFC 7914, section 11
+const (
+	_KatPBKDF2Out = "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+
+	// deriveKey(pbkdf2-sha256, "sigtool", 00..1f, 1000)
+	_KatPBKDF2KDFOut = "ed73b609a93c6c0c96b3e5c7b86cf5d2ab485162e24fd2b0181147b5c57ce4a3"
+)
+
+// RFC 7914, section 12 (second vector)
+const (
+	_KatScryptOut = "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"
+
+	// deriveKey(scrypt-sha256, "sigtool", 00..1f, 1024, 8, 1)
+	_KatScryptKDFOut = "32674f9cf372dca61a374210b48db67ef7074aeff3c13e065e185351edfae894"
+)
+
+// RFC 7748, section 6.1
+const (
+	_KatX25519AliceSK = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	_KatX25519AlicePK = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	_KatX25519BobPK   = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	_KatX25519Shared  = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+
+	// wrapped data encryption key for the KAT recipient
+	_KatWrappedKey = "62db8279df646c865553e09cec06f6983f3abbb43ecf8e6fe438fc27e1ccbcc1565bbc1478c431cd404ccfa26f26bd22"
+
+	// SHA256 of the KAT encrypted file in format version 2 and 1
+	_KatCiphertextSum  = "7b04831094b328e402942a0d38882c4db08b43cf90c2d399e8f5c19cc534463b"
+	_KatCiphertextSum1 = "954a89664d40f0404290c008f3dfe20263d21b913fd61361b6cde70e9eecb01c"
+)
+
+// RFC 8032, section 7.1 (TEST 1)
+const (
+	_KatEd25519Seed = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	_KatEd25519PK   = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	_KatEd25519Sig  = "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+
+	// sigtool signature of MessageChecksum("abc") with the KAT key
+	_KatSignature = "5c67834baf5dbdf696b06cc6ed90dad98ddf222f33c2ff5f0f68631b945a101f440ad7ec6f6391af521efe3930baf345fb5758daeb8e45d2c78ea65d680fdf06"
+)
+
+func katPBKDF2() error {
+	out := pbkdf2.Key([]byte("passwd"), []byte("salt"), 1, 64, sha256.New)
+	if err := katMatch("pbkdf2", out, _KatPBKDF2Out); err != nil {
+		return err
+	}
+
+	out, err := deriveKey(sk_algo_pbkdf2, []byte("sigtool"), katBytes(32), 1000, 0, 0)
+	if err != nil {
+		return err
+	}
+	return katMatch("private key kdf", out, _KatPBKDF2KDFOut)
+}
+
+func katScrypt() error {
+	out, err := scrypt.Key([]byte("password"), []byte("NaCl"), 1024, 8, 16, 64)
+	if err != nil {
+		return err
+	}
+	if err = katMatch("scrypt", out, _KatScryptOut); err != nil {
+		return err
+	}
+
+	out, err = deriveKey(sk_algo, []byte("sigtool"), katBytes(32), 1024, 8, 1)
+	if err != nil {
+		return err
+	}
+	return katMatch("private key kdf", out, _KatScryptKDFOut)
+}
+
+func katKeyWrap() error {
+	ask := unhex(_KatX25519AliceSK)
+	apk, err := x25519Public(ask)
+	if err != nil {
+		return err
+	}
+	if err = katMatch("x25519 public key", apk, _KatX25519AlicePK); err != nil {
+		return err
+	}
+
+	shared, err := x25519(ask, unhex(_KatX25519BobPK))
+	if err != nil {
+		return err
+	}
+	if err = katMatch("x25519 shared key", shared, _KatX25519Shared); err != nil {
+		return err
+	}
+
+	sk, err := katPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	e, err := katEncryptor()
+	if err != nil {
+		return err
+	}
+
+	w, err := e.wrapKey(&recipient{pk: sk.pk})
+	if err != nil {
+		return err
+	}
+	if err = katMatch("wrapped key", w.DKey, _KatWrappedKey); err != nil {
+		return err
+	}
+
+	d := &Decryptor{
+		Header: e.Header,
+	}
+	key, err := d.unwrapWith(w, sk.toCurve25519SK(), sk.pk)
+	if err != nil {
+		return err
+	}
+	if key == nil || subtle.ConstantTimeCompare(key, e.key) != 1 {
+		return fmt.Errorf("unwrapped key mismatch")
+	}
+	return nil
+}
+
+func katChunkCipher() error {
+	if err := katChunkVersion(_Version, _KatCiphertextSum); err != nil {
+		return err
+	}
+	return katChunkVersion(_Version1, _KatCiphertextSum1)
+}
+
+// encrypt and decrypt the KAT file in format 'version'
+func katChunkVersion(version uint8, want string) error {
+	sk, err := katPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	e, err := katEncryptor()
+	if err != nil {
+		return err
+	}
+	if err = e.AddRecipient(sk.pk); err != nil {
+		return err
+	}
+	e.version = version
+
+	// 2.5 chunks of plaintext
+	msg := katBytes(int(e.ChunkSize)*2 + int(e.ChunkSize)/2)
+
+	var wr katBuffer
+	if err = e.Encrypt(bytes.NewReader(msg), &wr); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(wr.Bytes())
+	if err = katMatch(fmt.Sprintf("v%d ciphertext", version), sum[:], want); err != nil {
+		return err
+	}
+
+	d, err := NewDecryptor(bytes.NewReader(wr.Bytes()))
+	if err != nil {
+		return err
+	}
+	if err = d.SetPrivateKey(sk, nil); err != nil {
+		return err
+	}
+
+	var pt katBuffer
+	if err = d.Decrypt(&pt); err != nil {
+		return err
+	}
+	if !bytes.Equal(pt.Bytes(), msg) {
+		return fmt.Errorf("decrypted text mismatch")
+	}
+	return nil
+}
+
+func katSignature() error {
+	edsk := Ed.NewKeyFromSeed(unhex(_KatEd25519Seed))
+	if err := katMatch("ed25519 public key", edsk[32:], _KatEd25519PK); err != nil {
+		return err
+	}
+	if err := katMatch("ed25519 signature", Ed.Sign(edsk, nil), _KatEd25519Sig); err != nil {
+		return err
+	}
+
+	sk, err := katPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	ck := MessageChecksum([]byte("abc"))
+	sig, err := sk.SignMessage(ck, "")
+	if err != nil {
+		return err
+	}
+	if err = katMatch("sigtool signature", sig.Sig, _KatSignature); err != nil {
+		return err
+	}
+
+	if !sk.pk.VerifyMessage(ck, sig) {
+		return fmt.Errorf("can't verify signature")
+	}
+
+	ck[0] ^= 1
+	if sk.pk.VerifyMessage(ck, sig) {
+		return fmt.Errorf("verified signature of wrong message")
+	}
+	return nil
+}
+
+// the RFC 8032 test key as a sigtool private key
+func katPrivateKey() (*PrivateKey, error) {
+	return PrivateKeyFromBytes(Ed.NewKeyFromSeed(unhex(_KatEd25519Seed)))
+}
+
+// an encryptor with fixed keys, salt and chunk size
+func katEncryptor() (*Encryptor, error) {
+	var zero [Ed.SignatureSize]byte
+
+	key := katBytes(32)
+	salt := katBytes(_AEADNonceLen)
+	esk := unhex(_KatX25519AliceSK)
+
+	wSig, err := wrapSenderSig(zero[:], key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encryptor{
+		Header: pb.Header{
+			ChunkSize:  64,
+			Salt:       salt,
+			Pk:         unhex(_KatX25519AlicePK),
+			SenderSign: wSig,
+		},
+
+		key:   key,
+		encSK: esk,
+	}
+	return e, nil
+}
+
+func katMatch(what string, got []byte, want string) error {
+	if hex.EncodeToString(got) != want {
+		return fmt.Errorf("%s mismatch: want %s, saw %x", what, want, got)
+	}
+	return nil
+}
+
+// n bytes of 0, 1, 2, ..
+func katBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(fmt.Sprintf("selftest: bad hex constant %q", s))
+	}
+	return b
+}
+
+// bytes.Buffer as an io.WriteCloser
+type katBuffer struct {
+	bytes.Buffer
+}
+
+func (b *katBuffer) Close() error {
+	return nil
+}
@@ -0,0 +1,135 @@
+// session.go -- one wrapped session key for a batch of encrypted files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// In session mode EncryptTo() wraps a random session key for the
+// recipients once per batch instead of wrapping a new key for every file.
+// The key of each file is derived from the session key and the file's own
+// random salt:
+//
+//    K_file = HKDF-SHA256(session key, salt, "sigtool v2 session file key" || 0x00)
+//
+// (files of format version 1 use the label "sigtool session file key").
+// The header of such a file carries the session salt (the wrapped keys
+// use nonces derived from it) and the same wrapped keys as every other
+// file of the batch; the chunk nonces and the header checksum are still
+// unique to each file. The sender signs the session key once and the
+// signature is wrapped with each file key as usual.
+
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/opencoff/sigtool/internal/pb"
+	"golang.org/x/crypto/hkdf"
+)
+
+// label of the session file key in format version 1 (see kdf.go)
+const _SessionKey = "sigtool session file key"
+
+// session key and its wrapped copies for the recipients of an Encryptor
+type session struct {
+	key  []byte
+	salt []byte
+	sig  []byte
+	keys []*pb.WrappedKey
+}
+
+// EnableSession makes EncryptTo() wrap a session key for the recipients
+// once and derive the key of each file from it; the X25519 operations (and
+// the Wrap() of recipient schemes) then happen once per batch. Files made
+// this way can only be decrypted by versions of sigtool that support
+// sessions.
+func (e *Encryptor) EnableSession() error {
+	if e.manifest != nil {
+		return fmt.Errorf("encrypt: sessions can't be used with a chunk manifest")
+	}
+	if e.cdc != nil {
+		return fmt.Errorf("encrypt: sessions can't be used with content defined chunks")
+	}
+
+	e.useSession = true
+	return nil
+}
+
+// make a new session key and wrap it for every recipient
+func (e *Encryptor) newSession() (*session, error) {
+	s := &session{
+		key:  randRead(make([]byte, 32)),
+		salt: randRead(make([]byte, _AEADNonceLen)),
+	}
+
+	if e.sk != nil {
+		sig, err := e.sk.SignMessage(s.key, "")
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: can't sign: %s", err)
+		}
+		s.sig = sig.Sig
+	} else {
+		var zero [ed25519.SignatureSize]byte
+		s.sig = zero[:]
+	}
+
+	w := &Encryptor{
+		Header: pb.Header{
+			Salt: s.salt,
+		},
+		key:     s.key,
+		encSK:   e.encSK,
+		hints:   e.hints,
+		context: e.context,
+	}
+
+	for _, r := range e.recips {
+		k, err := w.wrapKey(r)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %s", err)
+		}
+		s.keys = append(s.keys, k)
+	}
+
+	debug(e.log, "encrypt: new session", "recipients", len(s.keys))
+	return s, nil
+}
+
+// make the key, salt and wrapped sender signature of a new file
+func (s *session) fileKey() (key, salt, wSig []byte, err error) {
+	salt = randRead(make([]byte, _AEADNonceLen))
+	if key, err = sessionFileKey(_Version, s.key, salt); err != nil {
+		return nil, nil, nil, fmt.Errorf("encrypt: %s", err)
+	}
+
+	wSig, err = wrapSenderSig(s.sig, key, salt)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("encrypt: %s", err)
+	}
+	return key, salt, wSig, nil
+}
+
+// derive the key of the file of format 'version' with 'salt' from the
+// session key
+func sessionFileKey(version uint8, skey, salt []byte) ([]byte, error) {
+	if version != _Version1 {
+		return hkdfKey(make([]byte, 32), skey, salt, _KdfSessionKey, "")
+	}
+
+	key := make([]byte, 32)
+	h := hkdf.New(sha256.New, skey, salt, []byte(_SessionKey))
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
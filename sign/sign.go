@@ -18,11 +18,11 @@
 package sign
 
 import (
-	"crypto"
-	"crypto/rand"
+	"bytes"
 	"crypto/sha512"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 
@@ -34,6 +34,20 @@ import (
 type Signature struct {
 	Sig    []byte // Ed25519 sig bytes
 	pkhash []byte // [0:16] SHA256 hash of public key needed for verification
+
+	// Authenticated attributes; nil if the signature has none
+	Attrs *Attributes
+
+	// Untrusted comment read from the serialized signature; it is
+	// *not* covered by the signature and can be freely edited.
+	Comment string
+
+	// Public key of the signer if the signature carries it; it must be
+	// verified by other means (e.g., a pinned fingerprint).
+	PublicKey *PublicKey
+
+	// Roughtime timestamp of the signature; nil if it has none
+	Roughtime *RoughtimeProof
 }
 
 // Sign a prehashed Message; return the signature as opaque bytes
@@ -41,26 +55,45 @@ type Signature struct {
 //    Comment: source file path
 //    Signature: Ed25519 signature
 func (sk *PrivateKey) SignMessage(ck []byte, comment string) (*Signature, error) {
-	h := sha512.New()
-	h.Write([]byte("sigtool signed message"))
-	h.Write(ck)
-	ck = h.Sum(nil)[:]
+	return sk.signMessage(ck, nil)
+}
+
+// sign a prehashed message and optional attributes
+func (sk *PrivateKey) signMessage(ck []byte, attrs *Attributes) (*Signature, error) {
+	if err := sk.checkUsage(UsageSign); err != nil {
+		return nil, err
+	}
+
+	ck = sigMessage(ck, attrs)
 
-	x := Ed.PrivateKey(sk.Sk)
-	sig, err := x.Sign(rand.Reader, ck, crypto.Hash(0))
+	sig, err := sk.ed25519Sign(ck)
 	if err != nil {
 		return nil, fmt.Errorf("can't sign %x: %s", ck, err)
 	}
 
 	ss := &Signature{
-		Sig:    sig,
-		pkhash: make([]byte, len(sk.pk.hash)),
+		Sig:       sig,
+		pkhash:    make([]byte, len(sk.pk.hash)),
+		Attrs:     attrs,
+		PublicKey: sk.pk,
 	}
 
 	copy(ss.pkhash, sk.pk.hash)
 	return ss, nil
 }
 
+// return the message that is actually signed: the checksum 'ck' and the
+// attributes (if any) are hashed together.
+func sigMessage(ck []byte, attrs *Attributes) []byte {
+	h := sha512.New()
+	h.Write([]byte("sigtool signed message"))
+	h.Write(ck)
+	if attrs != nil {
+		h.Write(attrs.marshal())
+	}
+	return h.Sum(nil)[:]
+}
+
 // Read and sign a file
 //
 // We calculate the signature differently here: We first calculate
@@ -68,7 +101,7 @@ func (sk *PrivateKey) SignMessage(ck []byte, comment string) (*Signature, error)
 // checksum.
 func (sk *PrivateKey) SignFile(fn string) (*Signature, error) {
 
-	ck, err := fileCksum(fn, sha512.New())
+	ck, _, err := fileCksum(fn, sha512.New())
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +122,18 @@ func ReadSignature(fn string) (*Signature, error) {
 	return MakeSignature(yml)
 }
 
+// Read one or more serialized signatures from file 'fn'. The file
+// can either hold a single signature or a set of signatures written
+// by SerializeSignatures().
+func ReadSignatures(fn string) ([]*Signature, error) {
+	yml, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return MakeSignatures(yml)
+}
+
 // Parse serialized signature from bytes 'b' and construct a
 // Signature object
 func MakeSignature(b []byte) (*Signature, error) {
@@ -98,6 +143,94 @@ func MakeSignature(b []byte) (*Signature, error) {
 		return nil, fmt.Errorf("can't parse YAML signature: %s", err)
 	}
 
+	if len(ss.Signature) == 0 {
+		return nil, fmt.Errorf("not a YAML signature (multiple signatures?)")
+	}
+
+	return ss.decode()
+}
+
+// Parse one or more serialized signatures from bytes 'b'.
+func MakeSignatures(b []byte) ([]*Signature, error) {
+	var set signatureSet
+	err := yaml.Unmarshal(b, &set)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse YAML signature: %s", err)
+	}
+
+	if len(set.Signatures) == 0 {
+		sig, err := MakeSignature(b)
+		if err != nil {
+			return nil, err
+		}
+		return []*Signature{sig}, nil
+	}
+
+	sigs := make([]*Signature, 0, len(set.Signatures))
+	for i := range set.Signatures {
+		sig, err := set.Signatures[i].decode()
+		if err != nil {
+			return nil, fmt.Errorf("signature %d: %s", i, err)
+		}
+		if len(sig.Comment) == 0 {
+			sig.Comment = set.Comment
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// ParseSignature parses the signatures in 'b'; it may be a serialized
+// signature or set of signatures, a JSON or CBOR encoded signature, a
+// clear signed text or content with embedded signatures.
+func ParseSignature(b []byte) ([]*Signature, error) {
+	if _, blob, ok := splitEmbedded(b); ok {
+		return MakeSignatures(blob)
+	}
+
+	// a CBOR map or a JSON object
+	var sig Signature
+	switch {
+	case len(b) > 0 && b[0]&0xe0 == 0xa0:
+		if err := sig.UnmarshalCBOR(b); err != nil {
+			return nil, err
+		}
+		return []*Signature{&sig}, nil
+
+	case bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")):
+		if err := sig.UnmarshalJSON(b); err != nil {
+			return nil, err
+		}
+		return []*Signature{&sig}, nil
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(_ClearBegin)) {
+		c, err := ParseClearSigned(b)
+		if err != nil {
+			return nil, err
+		}
+		return c.Sigs, nil
+	}
+
+	return MakeSignatures(b)
+}
+
+// PKHash returns the hash of the public key that made the signature
+func (sig *Signature) PKHash() []byte {
+	return sig.pkhash
+}
+
+// TrustedComment returns the signer supplied comment that is covered by
+// the signature; it is empty if the signature has no attributes.
+func (sig *Signature) TrustedComment() string {
+	if sig.Attrs == nil {
+		return ""
+	}
+	return sig.Attrs.Comment
+}
+
+// decode a serialized signature
+func (ss *signature) decode() (*Signature, error) {
 	b64 := base64.StdEncoding.DecodeString
 
 	s, err := b64(ss.Signature)
@@ -110,17 +243,57 @@ func MakeSignature(b []byte) (*Signature, error) {
 		return nil, fmt.Errorf("can't decode Base64:Pkhash <%s>: %s", ss.Pkhash, err)
 	}
 
-	return &Signature{Sig: s, pkhash: p}, nil
+	sig := &Signature{Sig: s, pkhash: p, Comment: ss.Comment}
+	if len(ss.Pk) > 0 {
+		pkb, err := b64(ss.Pk)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode Base64:Pk <%s>: %s", ss.Pk, err)
+		}
+
+		pk, err := PublicKeyFromBytes(pkb)
+		if err != nil {
+			return nil, err
+		}
+
+		if !sig.IsPKMatch(pk) {
+			return nil, fmt.Errorf("signature public key doesn't match its hash")
+		}
+
+		if len(ss.Cert) > 0 {
+			cert, err := b64(ss.Cert)
+			if err != nil {
+				return nil, fmt.Errorf("can't decode Base64:Cert <%s>: %s", ss.Cert, err)
+			}
+			if err = pk.decodeCert(cert); err != nil {
+				return nil, err
+			}
+		}
+		sig.PublicKey = pk
+	}
+
+	if ss.Attrs != nil {
+		if sig.Attrs, err = ss.Attrs.decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if ss.Roughtime != nil {
+		if sig.Roughtime, err = ss.Roughtime.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return sig, nil
 }
 
-// Serialize a signature suitable for storing in durable media
+// Serialize a signature suitable for storing in durable media. The
+// 'comment' is an untrusted comment: it is not covered by the signature.
+// If it is empty, the comment the signature was read with is retained.
 func (sig *Signature) Serialize(comment string) ([]byte, error) {
+	if len(comment) == 0 {
+		comment = sig.Comment
+	}
 
-	sigs := base64.StdEncoding.EncodeToString(sig.Sig)
-	pks := base64.StdEncoding.EncodeToString(sig.pkhash)
-	ss := &signature{Comment: comment, Pkhash: pks, Signature: sigs}
-
-	out, err := yaml.Marshal(ss)
+	out, err := yaml.Marshal(sig.serialize(comment))
 	if err != nil {
 		return nil, fmt.Errorf("can't marshal signature of %x to YAML: %s", sig.Sig, err)
 	}
@@ -128,6 +301,49 @@ func (sig *Signature) Serialize(comment string) ([]byte, error) {
 	return out, nil
 }
 
+// serialized form of the signature
+func (sig *Signature) serialize(comment string) *signature {
+	b64 := base64.StdEncoding.EncodeToString
+	ss := &signature{
+		Comment:   comment,
+		Pkhash:    b64(sig.pkhash),
+		Signature: b64(sig.Sig),
+	}
+	if sig.PublicKey != nil {
+		ss.Pk = b64(sig.PublicKey.Pk)
+		if c := sig.PublicKey.cert; c != nil {
+			ss.Cert = b64(c.marshal(true))
+		}
+	}
+	if sig.Attrs != nil {
+		ss.Attrs = sig.Attrs.serialize()
+	}
+	if sig.Roughtime != nil {
+		ss.Roughtime = sig.Roughtime.serialize()
+	}
+	return ss
+}
+
+// SerializeSignatures serializes several signatures of the same
+// content - each made by a different key - into a single blob.
+func SerializeSignatures(sigs []*Signature, comment string) ([]byte, error) {
+	set := &signatureSet{
+		Comment:    comment,
+		Signatures: make([]signature, len(sigs)),
+	}
+
+	for i, sig := range sigs {
+		set.Signatures[i] = *sig.serialize("")
+	}
+
+	out, err := yaml.Marshal(set)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal signatures to YAML: %s", err)
+	}
+
+	return out, nil
+}
+
 // SerializeFile serializes the signature to an output file 'f'
 func (sig *Signature) SerializeFile(fn, comment string) error {
 	b, err := sig.Serialize(comment)
@@ -148,21 +364,70 @@ func (sig *Signature) IsPKMatch(pk *PublicKey) bool {
 // Return True if signature matches, False otherwise
 func (pk *PublicKey) VerifyFile(fn string, sig *Signature) (bool, error) {
 
-	ck, err := fileCksum(fn, sha512.New())
+	if err := pk.checkExpiry("verify"); err != nil {
+		return false, err
+	}
+
+	if err := pk.checkUsage(UsageSign); err != nil {
+		return false, err
+	}
+
+	// a signature by a subkey of 'pk'
+	if sub := sig.signingKey(pk); sub != nil && sub != pk {
+		if err := sub.checkExpiry("verify"); err != nil {
+			return false, err
+		}
+		if err := sub.checkUsage(UsageSign); err != nil {
+			return false, err
+		}
+		pk = sub
+	}
+
+	h, err := contentHash(sigHashAlgo(sig))
+	if err != nil {
+		return false, err
+	}
+
+	ck, sz, err := fileCksum(fn, h)
 	if err != nil {
 		return false, err
 	}
 
+	if sig.Attrs != nil && sig.Attrs.Size != sz {
+		return false, nil
+	}
+
 	return pk.VerifyMessage(ck, sig), nil
 }
 
+// VerifyFileThreshold verifies the signatures 'sigs' of file 'fn' against a
+// set of trusted public keys 'pks'. It succeeds if at least 'k' distinct
+// trusted keys have a valid signature in 'sigs' and returns the keys whose
+// signatures verified.
+func VerifyFileThreshold(fn string, sigs []*Signature, pks []*PublicKey, k int) ([]*PublicKey, error) {
+	r, err := VerifyFileResult(fn, sigs, pks, k)
+	return Signers(r), err
+}
+
+// VerifyMessageThreshold is like VerifyFileThreshold() but verifies a
+// pre-calculated checksum 'ck'.
+func VerifyMessageThreshold(ck []byte, sigs []*Signature, pks []*PublicKey, k int) ([]*PublicKey, error) {
+	r, err := VerifyMessageResult(ck, sigs, pks, k)
+	return Signers(r), err
+}
+
+// ErrTooFewSignatures is returned when fewer than the required number of
+// trusted keys have signed.
+var ErrTooFewSignatures = errors.New("verify: too few valid signatures from trusted keys")
+
 // Verify a signature 'sig' for a pre-calculated checksum 'ck' against public key 'pk'
 // Return True if signature matches, False otherwise
 func (pk *PublicKey) VerifyMessage(ck []byte, sig *Signature) bool {
-	h := sha512.New()
-	h.Write([]byte("sigtool signed message"))
-	h.Write(ck)
-	ck = h.Sum(nil)[:]
+	if len(pk.Pk) != Ed.PublicKeySize {
+		return false
+	}
+
+	ck = sigMessage(ck, sig.Attrs)
 
 	x := Ed.PublicKey(pk.Pk)
 	return Ed.Verify(x, ck, sig.Sig)
@@ -0,0 +1,156 @@
+// signify.go -- OpenBSD signify keys and signatures
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// This file reads the public keys and signatures of OpenBSD's signify(1)
+// so that its releases can be verified. Both are two lines:
+//
+//    untrusted comment: <text>
+//    base64(blob)
+//
+// where the blob of a public key is:
+//
+//    byte[2]   "Ed"
+//    byte[8]   key number
+//    byte[32]  Ed25519 public key
+//
+// and the blob of a signature is:
+//
+//    byte[2]   "Ed"
+//    byte[8]   key number of the signing key
+//    byte[64]  Ed25519 signature of the message
+//
+// A signature made with 'signify -e' (e.g., OpenBSD's SHA256.sig) is
+// followed by the signed message.
+
+package sign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	Ed "crypto/ed25519"
+)
+
+const (
+	_SignifyComment = "untrusted comment: "
+	_SignifyAlgo    = "Ed"
+	_SignifyKeyNum  = 8
+
+	// signify refuses longer comments
+	_SignifyMaxComment = 1024
+)
+
+// SignifySignature is a parsed signify signature
+type SignifySignature struct {
+	// Untrusted comment of the signature
+	Comment string
+
+	// Signed message of an embedded signature; nil for a detached one
+	Message []byte
+
+	sig []byte
+}
+
+// IsSignify returns true if 'b' looks like a signify key or signature
+func IsSignify(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(_SignifyComment))
+}
+
+// ParseSignifySignature parses a signify signature and the message that
+// follows it, if any.
+func ParseSignifySignature(b []byte) (*SignifySignature, error) {
+	comm, blob, msg, err := parseSignify(b, Ed.SignatureSize)
+	if err != nil {
+		return nil, fmt.Errorf("signify: signature: %s", err)
+	}
+
+	s := &SignifySignature{
+		Comment: comm,
+		sig:     blob[_SignifyKeyNum:],
+	}
+	if len(msg) > 0 {
+		s.Message = msg
+	}
+	return s, nil
+}
+
+// Verify the signature of 'msg' (s.Message for an embedded signature) with
+// the trusted keys 'pks' and return the key that made it.
+func (s *SignifySignature) Verify(msg []byte, pks []*PublicKey) (*PublicKey, error) {
+	for _, pk := range pks {
+		if Ed.Verify(Ed.PublicKey(pk.Pk), msg, s.sig) {
+			return pk, nil
+		}
+	}
+	return nil, fmt.Errorf("signify: signature verification failed")
+}
+
+// parse a signify public key file
+func parseSignifyPublicKey(b []byte) (*PublicKey, error) {
+	comm, blob, rest, err := parseSignify(b, Ed.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("signify: public key: %s", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("signify: public key: %s", ErrBadTrailers)
+	}
+
+	pk, err := PublicKeyFromBytes(blob[_SignifyKeyNum:])
+	if err != nil {
+		return nil, fmt.Errorf("signify: %s", err)
+	}
+
+	pk.Comment = strings.TrimSuffix(comm, " public key")
+	return pk, nil
+}
+
+// split a signify file into its comment, the blob (sans algorithm) and
+// the rest; the blob holds the key number and 'n' bytes of key or
+// signature.
+func parseSignify(b []byte, n int) (string, []byte, []byte, error) {
+	if !IsSignify(b) {
+		return "", nil, nil, fmt.Errorf("missing '%s'", strings.TrimSpace(_SignifyComment))
+	}
+
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return "", nil, nil, fmt.Errorf("missing key or signature")
+	}
+
+	comm := string(b[len(_SignifyComment):i])
+	if len(comm) > _SignifyMaxComment {
+		return "", nil, nil, fmt.Errorf("comment too long")
+	}
+
+	b = b[i+1:]
+	j := bytes.IndexByte(b, '\n')
+	if j < 0 {
+		return "", nil, nil, fmt.Errorf("missing newline after key or signature")
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(string(b[:j]))
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if len(blob) != len(_SignifyAlgo)+_SignifyKeyNum+n {
+		return "", nil, nil, fmt.Errorf("wrong length %d", len(blob))
+	}
+	if string(blob[:len(_SignifyAlgo)]) != _SignifyAlgo {
+		return "", nil, nil, fmt.Errorf("unsupported algorithm %q", blob[:len(_SignifyAlgo)])
+	}
+
+	return comm, blob[len(_SignifyAlgo):], b[j+1:], nil
+}
@@ -0,0 +1,165 @@
+// sparse.go -- sparse file support for encryption and decryption
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A chunk that lies entirely in a hole of the input file is written as a
+// "hole chunk": its length has the _Hole flag set and it carries only the
+// AEAD tag of an empty plaintext (the length and chunk number are still
+// authenticated). The decryptor expands it to zeros or, when the output
+// is a seekable file, seeks over it and leaves a hole in the output.
+//
+// Hole chunks reveal which chunks of the input are holes and can't be
+// decrypted by older versions of sigtool; so they are only written when
+// enabled with EnableSparse().
+
+package sign
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// EnableSparse makes Encrypt() detect holes in an input file (with
+// SEEK_DATA/SEEK_HOLE) and record the chunks that lie in them instead of
+// encrypting their zeros.
+func (e *Encryptor) EnableSparse() error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't enable sparse files after encryption has started")
+	}
+
+	if e.manifest != nil {
+		return fmt.Errorf("encrypt: sparse files can't be used with a chunk manifest")
+	}
+
+	if e.ckptFn != nil || e.cdc != nil {
+		return fmt.Errorf("encrypt: sparse files can't be used with checkpoints or content defined chunks")
+	}
+
+	e.sparse = true
+	return nil
+}
+
+// holes in the input as [start, end) offsets from the current position
+type holeMap [][2]int64
+
+// return true if [off, off+n) lies in a hole
+func (h holeMap) covers(off, n int64) bool {
+	for _, x := range h {
+		if off >= x[0] && off+n <= x[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// find the holes in 'fd' after its current offset; the offset is restored
+// before returning.
+func fileHoles(fd *os.File) holeMap {
+	if _SeekData < 0 {
+		return nil
+	}
+
+	st, err := fd.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return nil
+	}
+
+	start, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	defer fd.Seek(start, io.SeekStart)
+
+	var h holeMap
+
+	size := st.Size()
+	for off := start; off < size; {
+		data, err := fd.Seek(off, _SeekData)
+		if err != nil {
+			if noMoreData(err) {
+				h = append(h, [2]int64{off - start, size - start})
+			}
+			break
+		}
+
+		if data > off {
+			h = append(h, [2]int64{off - start, data - start})
+		}
+
+		if off, err = fd.Seek(data, _SeekHole); err != nil {
+			break
+		}
+	}
+	return h
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseWriter is an output that can be extended with holes
+type sparseWriter interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// sparseOutput skips over hole chunks when the output is seekable and
+// writes zeros otherwise.
+type sparseOutput struct {
+	wr     io.Writer
+	sw     sparseWriter
+	seeked bool
+}
+
+func newSparseOutput(wr io.Writer) *sparseOutput {
+	s := &sparseOutput{wr: wr}
+	if sw, ok := wr.(sparseWriter); ok {
+		// only a seekable output can have holes
+		if _, err := sw.Seek(0, io.SeekCurrent); err == nil {
+			s.sw = sw
+		}
+	}
+	return s
+}
+
+func (s *sparseOutput) write(p []byte, hole bool) error {
+	if hole && s.sw != nil {
+		if _, err := s.sw.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+			return err
+		}
+		s.seeked = true
+		return nil
+	}
+
+	s.seeked = false
+	return fullwrite(p, s.wr)
+}
+
+// extend the output to its full size if it ends in a hole
+func (s *sparseOutput) finish() error {
+	if !s.seeked {
+		return nil
+	}
+
+	off, err := s.sw.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return s.sw.Truncate(off)
+}
@@ -0,0 +1,33 @@
+// sparse_darwin.go -- SEEK_DATA/SEEK_HOLE on macOS
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin
+// +build darwin
+
+package sign
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	_SeekHole = 3
+	_SeekData = 4
+)
+
+// true if lseek(SEEK_DATA) found no data after the offset
+func noMoreData(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == syscall.ENXIO
+}
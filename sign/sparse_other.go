@@ -0,0 +1,27 @@
+// sparse_other.go -- platforms that can't report holes in files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux && !freebsd && !darwin
+// +build !linux,!freebsd,!darwin
+
+package sign
+
+// holes are not detected on these platforms
+const (
+	_SeekData = -1
+	_SeekHole = -1
+)
+
+func noMoreData(err error) bool {
+	return false
+}
@@ -0,0 +1,198 @@
+// spool.go -- strict decryption: release plaintext only after the
+// whole file is authenticated
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpoolOptions controls where DecryptStrict() holds the plaintext until
+// the whole file is authenticated.
+type SpoolOptions struct {
+	// Plaintext up to this many bytes is held in memory; the rest goes
+	// to an encrypted temporary file.
+	MaxMemory int64
+
+	// Directory for the temporary file; the default is os.TempDir()
+	TempDir string
+
+	// Don't use a temporary file; plaintext larger than MaxMemory is
+	// an error.
+	MemoryOnly bool
+}
+
+// DecryptStrict decrypts the input like Decrypt() but writes nothing to
+// 'wr' until the last chunk is authenticated. A truncated or tampered file
+// thus produces no output at all. Until then the plaintext is buffered as
+// described by 'opt'; the temporary file is encrypted with an ephemeral
+// key and removed before returning. A nil 'opt' spools everything to a
+// temporary file in os.TempDir().
+func (d *Decryptor) DecryptStrict(wr io.Writer, opt *SpoolOptions) error {
+	if opt == nil {
+		opt = &SpoolOptions{}
+	}
+
+	s := &spool{opt: opt}
+	defer s.close()
+
+	if err := d.Decrypt(s); err != nil {
+		return err
+	}
+
+	debug(d.log, "decrypt: authenticated; releasing output", "bytes", s.size, "spooled", s.fd != nil)
+	if err := s.release(wr); err != nil {
+		return fmt.Errorf("decrypt: %s", err)
+	}
+	return nil
+}
+
+// spool buffers plaintext in memory and then in an encrypted temporary
+// file. Each write to the file is a record:
+//
+//	uint32_be(len) || AES-GCM(key, nonce = uint64_be(record#), data, ad = uint32_be(len))
+type spool struct {
+	opt  *SpoolOptions
+	mem  bytes.Buffer
+	fd   *os.File
+	ae   cipher.AEAD
+	recs uint64
+	size int64
+	buf  []byte
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.fd == nil {
+		if int64(s.mem.Len()+len(b)) <= s.opt.MaxMemory {
+			s.size += int64(len(b))
+			return s.mem.Write(b)
+		}
+
+		if s.opt.MemoryOnly {
+			return 0, fmt.Errorf("plaintext exceeds the memory limit of %d bytes", s.opt.MaxMemory)
+		}
+
+		if err := s.create(); err != nil {
+			return 0, err
+		}
+	}
+
+	var hdr [4]byte
+
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+	s.buf = append(s.buf[:0], hdr[:]...)
+	s.buf = s.ae.Seal(s.buf, s.nonce(s.recs), b, hdr[:])
+
+	if err := fullwrite(s.buf, s.fd); err != nil {
+		return 0, fmt.Errorf("spool: %s", err)
+	}
+
+	s.recs++
+	s.size += int64(len(b))
+	return len(b), nil
+}
+
+// create the temporary file and its ephemeral key
+func (s *spool) create() error {
+	fd, err := ioutil.TempFile(s.opt.TempDir, "sigtool-spool-")
+	if err != nil {
+		return fmt.Errorf("spool: %s", err)
+	}
+
+	key := randRead(make([]byte, 32))
+	aes, err := aes.NewCipher(key)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return fmt.Errorf("spool: %s", err)
+	}
+
+	ae, err := cipher.NewGCM(aes)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return fmt.Errorf("spool: %s", err)
+	}
+
+	s.fd = fd
+	s.ae = ae
+	return nil
+}
+
+// write the buffered plaintext to 'wr'
+func (s *spool) release(wr io.Writer) error {
+	if err := fullwrite(s.mem.Bytes(), wr); err != nil {
+		return err
+	}
+
+	if s.fd == nil {
+		return nil
+	}
+
+	if _, err := s.fd.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("spool: %s", err)
+	}
+
+	var hdr [4]byte
+	var i uint64
+
+	ovh := s.ae.Overhead()
+	for i = 0; i < s.recs; i++ {
+		if _, err := io.ReadFull(s.fd, hdr[:]); err != nil {
+			return fmt.Errorf("spool: record %d: %s", i, err)
+		}
+
+		n := int(binary.BigEndian.Uint32(hdr[:])) + ovh
+		if cap(s.buf) < n {
+			s.buf = make([]byte, n)
+		}
+
+		c := s.buf[:n]
+		if _, err := io.ReadFull(s.fd, c); err != nil {
+			return fmt.Errorf("spool: record %d: %s", i, err)
+		}
+
+		p, err := s.ae.Open(c[:0], s.nonce(i), c, hdr[:])
+		if err != nil {
+			return fmt.Errorf("spool: record %d: temporary file modified", i)
+		}
+
+		if err := fullwrite(p, wr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spool) nonce(i uint64) []byte {
+	n := make([]byte, s.ae.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], i)
+	return n
+}
+
+// remove the temporary file
+func (s *spool) close() {
+	if s.fd != nil {
+		s.fd.Close()
+		os.Remove(s.fd.Name())
+		s.fd = nil
+	}
+}
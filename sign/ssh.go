@@ -67,22 +67,37 @@ func parseSSHPrivateKey(data []byte, getpw func() ([]byte, error)) (*PrivateKey,
 	}
 }
 
+// parse a public key line: "keytype base64-key [comment]"
 func parseSSHPublicKey(in []byte) (*PublicKey, error) {
-	v := bytes.Split(in, []byte(" \t"))
-	if len(v) != 3 {
+	in = bytes.TrimSpace(in)
+	i := bytes.IndexAny(in, " \t")
+	if i == -1 {
 		return nil, ErrBadPublicKey
 	}
 
-	return parseEncPubKey(v[1], string(v[2]))
+	pk, err := parseAuthorizedKey(in[i:])
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, fmt.Errorf("ssh: only ed25519 keys are supported")
+	}
+	return pk, nil
 }
 
-// parse a wire encoded public key
+// parse a base64 encoded public key
 func parseEncPubKey(in []byte, comm string) (*PublicKey, error) {
 	in, err := base64.StdEncoding.DecodeString(string(in))
 	if err != nil {
 		return nil, err
 	}
 
+	return parseWirePubKey(in, comm)
+}
+
+// parse a wire encoded public key; returns nil if the key is not an
+// ed25519 key.
+func parseWirePubKey(in []byte, comm string) (*PublicKey, error) {
 	algo, in, ok := parseString(in)
 	if !ok {
 		return nil, ErrKeyTooShort
@@ -279,6 +294,12 @@ func parseOpenSSHPrivateKey(data []byte, getpw func() ([]byte, error)) (*Private
 	var privateKeyBytes []byte
 	var encrypted bool
 
+	if w.KdfName == "bcrypt" {
+		if err := fipsRefuse("bcrypt"); err != nil {
+			return nil, fmt.Errorf("ssh: %s", err)
+		}
+	}
+
 	switch {
 	// OpenSSH supports bcrypt KDF w/ AES256-CBC or AES256-CTR mode
 	case w.KdfName == "bcrypt" && w.CipherName == "aes256-cbc":
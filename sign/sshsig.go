@@ -0,0 +1,272 @@
+// sshsig.go -- OpenSSH compatible signatures (SSHSIG)
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// This file implements the signature format of 'ssh-keygen -Y sign'
+// (PROTOCOL.sshsig in the OpenSSH sources). These are the signatures
+// git uses when 'gpg.format' is 'ssh'. The armored signature is:
+//
+//    byte[6]   "SSHSIG"
+//    uint32    version (1)
+//    string    public key
+//    string    namespace
+//    string    reserved
+//    string    hash algorithm
+//    string    signature
+//
+// and the signed message is:
+//
+//    byte[6]   "SSHSIG"
+//    string    namespace
+//    string    reserved
+//    string    hash algorithm
+//    string    H(message)
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	Ed "crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	_SSHSigMagic   = "SSHSIG"
+	_SSHSigVersion = 1
+	_SSHSigBegin   = "-----BEGIN SSH SIGNATURE-----"
+	_SSHSigEnd     = "-----END SSH SIGNATURE-----"
+)
+
+// SSHSignature is a parsed OpenSSH signature
+type SSHSignature struct {
+	// Public key that made the signature
+	PublicKey *PublicKey
+
+	// Namespace of the signature (e.g., "git" or "file")
+	Namespace string
+
+	// Hash algorithm used to hash the message: "sha256" or "sha512"
+	HashAlgo string
+
+	sig []byte
+}
+
+// wire format of the signature (sans magic)
+type sshSigBlob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	HashAlgo  string
+	Signature []byte
+}
+
+// wire format of the signed message (sans magic)
+type sshSigMsg struct {
+	Namespace string
+	Reserved  string
+	HashAlgo  string
+	Hash      []byte
+}
+
+// SSHSign signs the message read from 'rd' in the namespace 'ns' and
+// returns an armored signature identical to 'ssh-keygen -Y sign'.
+func (sk *PrivateKey) SSHSign(rd io.Reader, ns string) ([]byte, error) {
+	if len(ns) == 0 {
+		return nil, fmt.Errorf("sshsig: empty namespace")
+	}
+
+	if err := sk.checkUsage(UsageSign); err != nil {
+		return nil, fmt.Errorf("sshsig: %s", err)
+	}
+
+	h := sha512.New()
+	if _, err := io.Copy(h, rd); err != nil {
+		return nil, fmt.Errorf("sshsig: %s", err)
+	}
+
+	m := sshSigMessage(ns, hashSHA512, h.Sum(nil))
+
+	sig, err := sk.ed25519Sign(m)
+	if err != nil {
+		return nil, fmt.Errorf("sshsig: can't sign: %s", err)
+	}
+
+	sb := &sshSigBlob{
+		Version:   _SSHSigVersion,
+		PublicKey: sk.pk.sshWire(),
+		Namespace: ns,
+		HashAlgo:  hashSHA512,
+		Signature: ssh.Marshal(&ssh.Signature{Format: ssh.KeyAlgoED25519, Blob: sig}),
+	}
+
+	blob := append([]byte(_SSHSigMagic), ssh.Marshal(sb)...)
+	return armor(_SSHSigBegin, _SSHSigEnd, blob), nil
+}
+
+// ParseSSHSignature parses an armored OpenSSH signature. Only Ed25519
+// signatures are supported.
+func ParseSSHSignature(b []byte) (*SSHSignature, error) {
+	blob, err := dearmor(_SSHSigBegin, _SSHSigEnd, b)
+	if err != nil {
+		return nil, fmt.Errorf("sshsig: %s", err)
+	}
+
+	if !bytes.HasPrefix(blob, []byte(_SSHSigMagic)) {
+		return nil, fmt.Errorf("sshsig: bad magic")
+	}
+
+	var sb sshSigBlob
+	if err := ssh.Unmarshal(blob[len(_SSHSigMagic):], &sb); err != nil {
+		return nil, fmt.Errorf("sshsig: %s", err)
+	}
+
+	if sb.Version != _SSHSigVersion {
+		return nil, fmt.Errorf("sshsig: unsupported version %d", sb.Version)
+	}
+
+	switch sb.HashAlgo {
+	case "sha256", hashSHA512:
+	default:
+		return nil, fmt.Errorf("sshsig: unsupported hash algorithm %q", sb.HashAlgo)
+	}
+
+	pk, err := parseWirePubKey(sb.PublicKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("sshsig: %s", err)
+	}
+	if pk == nil {
+		return nil, fmt.Errorf("sshsig: only ed25519 keys are supported")
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(sb.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("sshsig: %s", err)
+	}
+
+	if sig.Format != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("sshsig: unsupported signature type %q", sig.Format)
+	}
+
+	s := &SSHSignature{
+		PublicKey: pk,
+		Namespace: sb.Namespace,
+		HashAlgo:  sb.HashAlgo,
+		sig:       sig.Blob,
+	}
+	return s, nil
+}
+
+// Verify the signature of the message read from 'rd' in the namespace 'ns'.
+// The caller must separately decide if s.PublicKey is trusted.
+func (s *SSHSignature) Verify(rd io.Reader, ns string) error {
+	if s.Namespace != ns {
+		return fmt.Errorf("sshsig: namespace mismatch; exp %q, saw %q", ns, s.Namespace)
+	}
+
+	var h hash.Hash
+	switch s.HashAlgo {
+	case "sha256":
+		h = sha256.New()
+	default:
+		h = sha512.New()
+	}
+
+	if _, err := io.Copy(h, rd); err != nil {
+		return fmt.Errorf("sshsig: %s", err)
+	}
+
+	m := sshSigMessage(s.Namespace, s.HashAlgo, h.Sum(nil))
+	if !Ed.Verify(Ed.PublicKey(s.PublicKey.Pk), m, s.sig) {
+		return fmt.Errorf("sshsig: signature verification failed")
+	}
+	return nil
+}
+
+// SSHFingerprint returns the OpenSSH fingerprint of the public key
+// (e.g., "SHA256:...").
+func (pk *PublicKey) SSHFingerprint() string {
+	spk, err := ssh.ParsePublicKey(pk.sshWire())
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(spk)
+}
+
+// SSHAuthorizedKey returns the public key in OpenSSH authorized_keys format
+func (pk *PublicKey) SSHAuthorizedKey() string {
+	s := fmt.Sprintf("%s %s", ssh.KeyAlgoED25519, base64.StdEncoding.EncodeToString(pk.sshWire()))
+	if len(pk.Comment) > 0 {
+		s += " " + pk.Comment
+	}
+	return s
+}
+
+// wire encoding of the public key
+func (pk *PublicKey) sshWire() []byte {
+	w := struct {
+		Algo string
+		Key  []byte
+	}{ssh.KeyAlgoED25519, pk.Pk}
+	return ssh.Marshal(&w)
+}
+
+func sshSigMessage(ns, halgo string, h []byte) []byte {
+	m := &sshSigMsg{
+		Namespace: ns,
+		HashAlgo:  halgo,
+		Hash:      h,
+	}
+	return append([]byte(_SSHSigMagic), ssh.Marshal(m)...)
+}
+
+// armor 'b' in base64 lines between 'begin' and 'end'
+func armor(begin, end string, b []byte) []byte {
+	const linelen = 70
+
+	var out bytes.Buffer
+
+	s := base64.StdEncoding.EncodeToString(b)
+	out.WriteString(begin + "\n")
+	for len(s) > linelen {
+		out.WriteString(s[:linelen] + "\n")
+		s = s[linelen:]
+	}
+	if len(s) > 0 {
+		out.WriteString(s + "\n")
+	}
+	out.WriteString(end + "\n")
+	return out.Bytes()
+}
+
+// undo armor()
+func dearmor(begin, end string, b []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(s, begin) {
+		return nil, fmt.Errorf("missing '%s'", begin)
+	}
+	if !strings.HasSuffix(s, end) {
+		return nil, fmt.Errorf("missing '%s'", end)
+	}
+
+	s = s[len(begin) : len(s)-len(end)]
+	s = strings.Join(strings.Fields(s), "")
+	return base64.StdEncoding.DecodeString(s)
+}
@@ -20,6 +20,20 @@ import (
 	"io"
 )
 
+// NopWriteCloser returns a WriteCloser whose Close() doesn't close 'w';
+// e.g., to Encrypt() to a buffer or a connection that stays open.
+func NopWriteCloser(w io.Writer) io.WriteCloser {
+	return nopWriteCloser{w}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
 // encWriter buffers partial writes until a full chunk is accumulated.
 // It's methods implement the io.WriteCloser interface.
 type encWriter struct {
@@ -27,7 +41,7 @@ type encWriter struct {
 	n   int // # of bytes written
 	wr  io.WriteCloser
 	e   *Encryptor
-	blk uint32
+	blk uint64
 	err error
 }
 
@@ -45,6 +59,7 @@ func (e *Encryptor) NewStreamWriter(wr io.WriteCloser) (io.WriteCloser, error) {
 		buf: make([]byte, e.ChunkSize),
 		wr:  wr,
 		e:   e,
+		blk: e.nextChunk,
 	}
 
 	e.stream = true
@@ -72,7 +87,14 @@ func (w *encWriter) Write(b []byte) (int, error) {
 		// We only flush if we have more data remaining in the input buffer.
 		// This way, we don't flush a potentially last block here; that happens
 		// when the caller eventually closes the stream.
-		if w.n == max && len(b) > 0 {
+		if w.n == max && len(b) > 0 && w.e.cdc != nil {
+			k, err := w.e.writeCDC(w.buf, w.wr, false)
+			if err != nil {
+				w.err = err
+				return 0, err
+			}
+			w.n = copy(w.buf, w.buf[k:])
+		} else if w.n == max && len(b) > 0 {
 			w.err = w.e.encrypt(w.buf, w.wr, w.blk, false)
 			if w.err != nil {
 				return 0, w.err
@@ -91,7 +113,12 @@ func (w *encWriter) Close() error {
 		return w.err
 	}
 
-	err := w.e.encrypt(w.buf[:w.n], w.wr, w.blk, true)
+	var err error
+	if w.e.cdc != nil {
+		_, err = w.e.writeCDC(w.buf[:w.n], w.wr, true)
+	} else {
+		err = w.e.encrypt(w.buf[:w.n], w.wr, w.blk, true)
+	}
 	if err != nil {
 		w.err = err
 		return err
@@ -107,10 +134,12 @@ type encReader struct {
 	buf    []byte
 	unread []byte
 	d      *Decryptor
-	blk    uint32
+	blk    uint64
 }
 
-// NewStreamReader returns an io.Reader to read from the decrypted stream
+// NewStreamReader returns an io.Reader to read from the decrypted stream.
+// The reader isn't safe for concurrent use; see NewChunkReader() for
+// parallel decryption.
 func (d *Decryptor) NewStreamReader() (io.Reader, error) {
 	if d.key == nil {
 		return nil, fmt.Errorf("streamReader: wrapped-key not decrypted (missing SetPrivateKey()?")
@@ -120,6 +149,10 @@ func (d *Decryptor) NewStreamReader() (io.Reader, error) {
 		return nil, io.EOF
 	}
 
+	if err := d.checkMem("stream buffers", d.memNeeded(true)); err != nil {
+		return nil, err
+	}
+
 	d.stream = true
 	return &encReader{
 		buf: make([]byte, d.ChunkSize),
@@ -159,6 +192,38 @@ func (r *encReader) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// ReadChunk decrypts the next chunk of the file and returns its plaintext;
+// 'last' is true for the last chunk. It returns io.EOF after the last
+// chunk. The returned slice is only valid until the next call. ReadChunk
+// can't be mixed with Decrypt() or the other readers.
+func (d *Decryptor) ReadChunk() (p []byte, last bool, err error) {
+	if d.key == nil {
+		return nil, false, fmt.Errorf("decrypt: wrapped-key not decrypted (missing SetPrivateKey()?")
+	}
+
+	if d.stream && !d.chunked {
+		return nil, false, fmt.Errorf("decrypt: can't use ReadChunk() after using Decrypt() or streaming I/O")
+	}
+
+	if d.eof {
+		return nil, false, io.EOF
+	}
+
+	d.stream = true
+	d.chunked = true
+
+	p, last, err = d.decrypt(d.next)
+	if err != nil {
+		return nil, false, err
+	}
+
+	d.next++
+	if last {
+		d.eof = true
+	}
+	return p, last, nil
+}
+
 var (
 	errClosed = errors.New("encrypt: stream already closed")
 )
@@ -0,0 +1,329 @@
+// streamhdr.go -- headers with a streamed recipient section
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The header of a version 3 file keeps its wrapped keys out of the
+// protobuf header so that neither end holds all of them at once:
+//
+//    - Fixed sized header (version 3; VLen is the protobuf header)
+//    - Protobuf encoded header without any wrapped keys
+//    - Recipient section: one record per wrapped key
+//        uint32_be  length of the protobuf encoded WrappedKey
+//        byte[]     the WrappedKey
+//      ended by a record of length 0
+//    - Shasum: 32 bytes (SHA256 of everything above)
+//
+// The encryptor wraps and writes one key at a time as it gets the
+// recipients; the decryptor reads the records in SetPrivateKey() and
+// keeps only the key it unwraps. The chunks are as in version 2.
+
+package sign
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/opencoff/sigtool/internal/pb"
+)
+
+// largest recipient record
+const _MaxRecipientRecord = 65536
+
+// StreamRecipients makes the Encryptor ask 'next' for recipients when
+// it writes the header; it returns io.EOF after the last one. Each key is
+// wrapped and written as it's returned, after those added with
+// AddRecipient(), so any number of recipients can be encrypted to in
+// constant memory. The file is written in format version 3; it can't be
+// used with EncryptTo(), EncryptEach(), sessions or logs.
+func (e *Encryptor) StreamRecipients(next func() (*PublicKey, error)) error {
+	if e.started {
+		return fmt.Errorf("encrypt: can't add new recipient after encryption has started")
+	}
+
+	e.nextRecipient = next
+	return nil
+}
+
+// write the header with the recipient section; return its checksum
+func (e *Encryptor) writeStreamedHeader(wr io.Writer) ([]byte, error) {
+	if e.version == _Version1 {
+		return nil, fmt.Errorf("encrypt: streamed recipients need format version %d", _Version3)
+	}
+	e.version = _Version3
+
+	// the wrapped keys of AddRecipient() are the first records
+	keys := e.Keys
+	e.Keys = nil
+	defer func() {
+		e.Keys = keys
+	}()
+
+	varSize := e.Size()
+	hdr := make([]byte, _FixedHdrLen+varSize)
+	copy(hdr, _Magic)
+	hdr[_MagicLen] = e.version
+	binary.BigEndian.PutUint32(hdr[_MagicLen+1:], uint32(varSize))
+
+	if _, err := e.MarshalTo(hdr[_FixedHdrLen:]); err != nil {
+		return nil, fmt.Errorf("encrypt: can't marshal header: %s", err)
+	}
+
+	bw := bufio.NewWriterSize(wr, 65536)
+	h := sha256.New()
+	ws := []io.Writer{bw, h}
+
+	// the manifest hashes the header with its checksum
+	var mh hash.Hash
+	if e.manifest != nil {
+		mh = sha256.New()
+		ws = append(ws, mh)
+	}
+
+	out := io.MultiWriter(ws...)
+	if _, err := out.Write(hdr); err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+
+	size := len(hdr)
+	buf := make([]byte, 4, 256)
+	put := func(w *pb.WrappedKey) error {
+		n := w.Size()
+		if n == 0 || n > _MaxRecipientRecord {
+			return fmt.Errorf("encrypt: wrapped key of %d bytes", n)
+		}
+
+		if cap(buf) < 4+n {
+			buf = make([]byte, 4, 4+n)
+		}
+		b := buf[:4+n]
+		binary.BigEndian.PutUint32(b, uint32(n))
+		if _, err := w.MarshalTo(b[4:]); err != nil {
+			return fmt.Errorf("encrypt: can't marshal wrapped key: %s", err)
+		}
+
+		if _, err := out.Write(b); err != nil {
+			return fmt.Errorf("encrypt: %s", err)
+		}
+		size += len(b)
+		return nil
+	}
+
+	for _, w := range keys {
+		if err := put(w); err != nil {
+			return nil, err
+		}
+	}
+
+	nrecip := len(keys)
+	for {
+		pk, err := e.nextRecipient()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: recipient %d: %s", nrecip+1, err)
+		}
+
+		if err = pk.checkUsage(UsageEncrypt); err != nil {
+			return nil, fmt.Errorf("encrypt: %s", err)
+		}
+		if err = pk.checkExpiry("encrypt"); err != nil {
+			return nil, err
+		}
+
+		w, err := e.wrapKey(&recipient{pk: pk})
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %s", err)
+		}
+		if err = put(w); err != nil {
+			return nil, err
+		}
+		nrecip++
+	}
+
+	if nrecip == 0 {
+		return nil, fmt.Errorf("encrypt: no recipients")
+	}
+
+	var end [4]byte
+	if _, err := out.Write(end[:]); err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+
+	sum := h.Sum(nil)
+	if _, err := bw.Write(sum); err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+	size += len(end) + len(sum)
+	e.written = int64(size)
+
+	if mh != nil {
+		mh.Write(sum)
+		e.manifest.setHeader(mh.Sum(nil), size)
+	}
+
+	info(e.log, "encrypt: header written", "recipients", nrecip,
+		"chunksize", e.ChunkSize, "hdrlen", size)
+	return sum, nil
+}
+
+// read the recipient section of a version 3 file and call 'fn' with each
+// wrapped key; the header checksum is verified at the end.
+func (d *Decryptor) readRecipients(fn func(i int, w *pb.WrappedKey) error) error {
+	if d.hdrHash == nil {
+		return fmt.Errorf("decrypt: recipients already read")
+	}
+
+	h := d.hdrHash
+	d.hdrHash = nil
+
+	var b [4]byte
+	var buf []byte
+	var i int
+	for ; ; i++ {
+		if _, err := io.ReadFull(d.rd, b[:]); err != nil {
+			return fmt.Errorf("decrypt: err while reading recipients: %s", err)
+		}
+		h.Write(b[:])
+		d.hdrlen += len(b)
+
+		n := binary.BigEndian.Uint32(b[:])
+		if n == 0 {
+			break
+		}
+		if n > _MaxRecipientRecord {
+			return fmt.Errorf("decrypt: wrapped key %d: record too large (%d bytes)", i, n)
+		}
+
+		if uint32(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		rec := buf[:n]
+		if _, err := io.ReadFull(d.rd, rec); err != nil {
+			return fmt.Errorf("decrypt: err while reading recipients: %s", err)
+		}
+		h.Write(rec)
+		d.hdrlen += len(rec)
+
+		w := &pb.WrappedKey{}
+		if err := w.Unmarshal(rec); err != nil {
+			return fmt.Errorf("decrypt: wrapped key %d: decode error: %s", i, err)
+		}
+		if err := checkWrappedKey(i, w); err != nil {
+			return err
+		}
+
+		if err := fn(i, w); err != nil {
+			return err
+		}
+	}
+
+	if i == 0 {
+		return fmt.Errorf("decrypt: no wrapped keys")
+	}
+
+	verify := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(d.rd, verify); err != nil {
+		return fmt.Errorf("decrypt: err while reading header: %s", err)
+	}
+	d.hdrlen += len(verify)
+
+	cksum := h.Sum(nil)
+	if subtle.ConstantTimeCompare(verify, cksum) == 0 {
+		return fmt.Errorf("decrypt: header corrupted")
+	}
+
+	d.hdrsum = cksum
+	d.nrecip = i
+	return nil
+}
+
+// unwrap our key from the recipient section; the X25519 shared secret is
+// computed once for all records. Returns nil if none are ours.
+func (d *Decryptor) unwrapStreamed(sk *PrivateKey) ([]byte, error) {
+	var keks, hints [][]byte
+	if sk.ext == nil && sk.agent == nil {
+		for _, ourSK := range sk.encryptionKeys() {
+			dkek, err := x25519(ourSK, d.Pk)
+			if err != nil {
+				return nil, fmt.Errorf("decrypt: can't unwrap key: %s", err)
+			}
+
+			kek, err := d.wrapKEK(dkek)
+			if err != nil {
+				return nil, fmt.Errorf("decrypt: can't unwrap key: %s", err)
+			}
+
+			hint, err := recipientHint(kek, d.wrapSalt())
+			if err != nil {
+				return nil, fmt.Errorf("decrypt: can't unwrap key: %s", err)
+			}
+			keks = append(keks, kek)
+			hints = append(hints, hint)
+		}
+	}
+
+	pk := sk.PublicKey()
+
+	var key []byte
+	err := d.readRecipients(func(i int, w *pb.WrappedKey) error {
+		if key != nil {
+			return nil
+		}
+
+		var err error
+		if keks == nil || len(w.Type) > 0 {
+			key, err = d.unwrapKey(w, sk)
+		} else {
+			for j, kek := range keks {
+				// a slot with a hint that isn't ours is skipped
+				if hasHint(w) && !bytes.Equal(w.Args, hints[j]) {
+					continue
+				}
+				if key, err = d.unwrapShared(w, kek, pk); key != nil || err != nil {
+					break
+				}
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("decrypt: can't unwrap key %d: %s", i, err)
+		}
+		if key != nil {
+			info(d.log, "decrypt: recipient matched", "slot", i, "pkhash", fmt.Sprintf("%x", sk.pk.hash))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// the size of the header of a version 3 file with 'nrecip' X25519
+// recipients
+func streamedHeaderSize(nrecip int, blksz uint32, name string) int {
+	var zero [32 + _AEADTagLen]byte
+
+	w := &pb.WrappedKey{DKey: zero[:]}
+	fixed := headerSize(0, blksz, name)
+	return fixed + nrecip*(4+w.Size()) + 4
+}
@@ -0,0 +1,204 @@
+// subkey.go -- subkeys certified by a master key
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A master key certifies a subkey (e.g., one for each device: laptop, CI,
+// phone) by signing:
+//
+//    "sigtool subkey v1" || subkey PK || cert
+//
+// where cert is:
+//
+//    master PK (32 bytes) || uint8 usage || uint64_be expires (unix
+//    seconds; 0 if the subkey doesn't expire) || uint16_be len(name) || name
+//
+// The certificate (cert || signature) is stored in the public and private
+// key files of the subkey and in every signature made by it. A verifier
+// that trusts the master key accepts a signature by any subkey whose
+// certificate verifies and that hasn't expired; the usage and expiration
+// of a subkey are those in its certificate.
+
+package sign
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	Ed "crypto/ed25519"
+)
+
+const _SubkeyPrefix = "sigtool subkey v1"
+
+// SubkeyCert is the certification of a subkey by its master key
+type SubkeyCert struct {
+	// Ed25519 public key of the master key
+	Master []byte
+
+	// Name of the subkey (e.g., "laptop")
+	Name string
+
+	// Usage and expiration of the subkey
+	Usage   KeyUsage
+	Expires time.Time
+
+	sig []byte
+}
+
+// CertifySubkey makes 'pk' a subkey of 'sk' named 'name'; the usage and
+// expiration of 'pk' are covered by the certificate and can't be changed
+// afterwards.
+func (sk *PrivateKey) CertifySubkey(pk *PublicKey, name string) error {
+	if err := sk.checkUsage(UsageSign); err != nil {
+		return fmt.Errorf("certify: %s", err)
+	}
+
+	if !sk.canSign() || pk.Pk == nil {
+		return fmt.Errorf("certify: subkeys need Ed25519 keys")
+	}
+
+	if bytes.Equal(sk.pk.Pk, pk.Pk) {
+		return fmt.Errorf("certify: a key can't be its own subkey")
+	}
+
+	if len(name) > 65535 {
+		return fmt.Errorf("certify: subkey name too long")
+	}
+
+	c := &SubkeyCert{
+		Master:  sk.pk.Pk,
+		Name:    name,
+		Usage:   pk.Usage,
+		Expires: pk.Expires,
+	}
+
+	sig, err := sk.ed25519Sign(c.message(pk.Pk))
+	if err != nil {
+		return fmt.Errorf("certify: %s", err)
+	}
+
+	c.sig = sig
+	pk.cert = c
+	return nil
+}
+
+// Subkey returns the certificate of a subkey; it is nil if 'pk' isn't a
+// subkey.
+func (pk *PublicKey) Subkey() *SubkeyCert {
+	return pk.cert
+}
+
+// IsSubkeyOf returns true if 'pk' is a subkey certified by 'master'
+func (pk *PublicKey) IsSubkeyOf(master *PublicKey) bool {
+	c := pk.cert
+	return c != nil && bytes.Equal(c.Master, master.Pk)
+}
+
+// the message signed by the master key
+func (c *SubkeyCert) message(pk []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(_SubkeyPrefix)
+	b.Write(pk)
+	b.Write(c.marshal(false))
+	return b.Bytes()
+}
+
+// encode the certificate, optionally with its signature
+func (c *SubkeyCert) marshal(sig bool) []byte {
+	var b [11]byte
+	var exp int64
+
+	if !c.Expires.IsZero() {
+		exp = c.Expires.Unix()
+	}
+
+	b[0] = byte(c.Usage)
+	binary.BigEndian.PutUint64(b[1:9], uint64(exp))
+	binary.BigEndian.PutUint16(b[9:], uint16(len(c.Name)))
+
+	v := append([]byte{}, c.Master...)
+	v = append(v, b[:]...)
+	v = append(v, c.Name...)
+	if sig {
+		v = append(v, c.sig...)
+	}
+	return v
+}
+
+// decode a certificate with its signature
+func parseSubkeyCert(b []byte) (*SubkeyCert, error) {
+	if len(b) < Ed.PublicKeySize+11+Ed.SignatureSize {
+		return nil, fmt.Errorf("subkey certificate too short")
+	}
+
+	c := &SubkeyCert{
+		Master: b[:Ed.PublicKeySize],
+		Usage:  KeyUsage(b[Ed.PublicKeySize]),
+	}
+
+	b = b[Ed.PublicKeySize+1:]
+	if exp := int64(binary.BigEndian.Uint64(b[:8])); exp != 0 {
+		c.Expires = time.Unix(exp, 0).UTC()
+	}
+
+	n := int(binary.BigEndian.Uint16(b[8:10]))
+	b = b[10:]
+	if len(b) != n+Ed.SignatureSize {
+		return nil, fmt.Errorf("subkey certificate is malformed")
+	}
+
+	c.Name = string(b[:n])
+	c.sig = b[n:]
+	return c, nil
+}
+
+// verify the certificate 'c' of 'pk' and make 'pk' a subkey
+func (pk *PublicKey) setCert(c *SubkeyCert) error {
+	if !Ed.Verify(Ed.PublicKey(c.Master), c.message(pk.Pk), c.sig) {
+		return fmt.Errorf("subkey certificate of %x doesn't verify", pk.hash)
+	}
+
+	pk.cert = c
+	pk.Usage = c.Usage
+	pk.Expires = c.Expires
+	return nil
+}
+
+// decode the serialized certificate 'b' and make 'pk' a subkey
+func (pk *PublicKey) decodeCert(b []byte) error {
+	c, err := parseSubkeyCert(b)
+	if err != nil {
+		return err
+	}
+	return pk.setCert(c)
+}
+
+// signingKey returns the key that made 'sig' if it is 'pk' or a subkey
+// certified by 'pk'; it returns nil otherwise.
+func (sig *Signature) signingKey(pk *PublicKey) *PublicKey {
+	if sig.IsPKMatch(pk) {
+		return pk
+	}
+
+	sub := sig.PublicKey
+	if sub != nil && sub.IsSubkeyOf(pk) && sig.IsPKMatch(sub) {
+		return sub
+	}
+	return nil
+}
+
+// IsKeyMatch returns true if 'pk' made the signature or certified the
+// subkey that made it; like IsPKMatch(), it doesn't verify the signature.
+func (sig *Signature) IsKeyMatch(pk *PublicKey) bool {
+	return sig.signingKey(pk) != nil
+}
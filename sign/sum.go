@@ -0,0 +1,257 @@
+// sum.go -- checksum manifests of files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A checksum manifest lists the hash of each file in the layout of
+// sha256sum (and b3sum):
+//
+//    # sigtool sum: sha256
+//    hex-checksum  file-name
+//
+// A name with a backslash or a newline is escaped and its line starts
+// with a backslash, as GNU coreutils does. The first line names the hash
+// algorithm; sha256sum and b3sum skip it as a comment. A manifest without
+// it is taken to be SHA256. Signed manifests are clear signed text (see
+// clearsign.go); 'sha256sum -c' still checks the files of such a
+// manifest and warns about the lines of the signature.
+//
+// The BSD layout of 'sha256sum --tag' and of OpenBSD's SHA256 files is
+// also read:
+//
+//    SHA256 (file-name) = hex-checksum
+
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+const (
+	// SumSHA256 is the SHA256 hash
+	SumSHA256 = "sha256"
+
+	// SumBLAKE3 is the BLAKE3 hash with a 256-bit output
+	SumBLAKE3 = "blake3"
+
+	_SumHeader = "# sigtool sum: "
+)
+
+// ErrSumMismatch is returned when a file doesn't match its checksum
+var ErrSumMismatch = errors.New("checksum mismatch")
+
+// SumManifest is a list of files and their checksums
+type SumManifest struct {
+	// Hash algorithm: SumSHA256 or SumBLAKE3
+	Algo string
+
+	Files []SumFile
+}
+
+// SumFile is the checksum of one file
+type SumFile struct {
+	Name string
+	Sum  []byte
+}
+
+// NewSumManifest makes an empty manifest of checksums with hash 'algo'
+func NewSumManifest(algo string) (*SumManifest, error) {
+	if _, err := newSumHash(algo); err != nil {
+		return nil, err
+	}
+	return &SumManifest{Algo: algo}, nil
+}
+
+func newSumHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case SumSHA256:
+		return sha256.New(), nil
+	case SumBLAKE3:
+		return NewBlake3(), nil
+	}
+	return nil, fmt.Errorf("sum: unknown hash algorithm %s", algo)
+}
+
+// Hash returns the checksum of the contents of 'rd'; BLAKE3 hashes large
+// files on all CPUs.
+func (m *SumManifest) Hash(rd io.Reader) ([]byte, error) {
+	h, err := newSumHash(m.Algo)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = hashReader(h, rd); err != nil {
+		return nil, fmt.Errorf("sum: %s", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// Add the file 'name' with contents 'rd' to the manifest
+func (m *SumManifest) Add(name string, rd io.Reader) error {
+	// a clear signed text drops the trailing white space of every line
+	if len(name) == 0 || strings.TrimRight(name, " \t") != name {
+		return fmt.Errorf("sum: can't record file name '%s'", name)
+	}
+
+	sum, err := m.Hash(rd)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	m.Files = append(m.Files, SumFile{name, sum})
+	return nil
+}
+
+// Check returns nil if the contents of 'rd' match the checksum of 'f'
+// and ErrSumMismatch if they don't.
+func (m *SumManifest) Check(f *SumFile, rd io.Reader) error {
+	sum, err := m.Hash(rd)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(sum, f.Sum) != 1 {
+		return ErrSumMismatch
+	}
+	return nil
+}
+
+// Bytes returns the manifest in the layout of sha256sum
+func (m *SumManifest) Bytes() []byte {
+	var b bytes.Buffer
+
+	b.WriteString(_SumHeader + m.Algo + "\n")
+	for _, f := range m.Files {
+		name := f.Name
+		if strings.ContainsAny(name, "\\\n\r") {
+			b.WriteByte('\\')
+			name = sumEscape.Replace(name)
+		}
+		fmt.Fprintf(&b, "%x  %s\n", f.Sum, name)
+	}
+	return b.Bytes()
+}
+
+var sumEscape = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+// ParseSumManifest parses a manifest of checksums made by sha256sum,
+// b3sum, OpenBSD or SumManifest.Bytes(). Blank lines and comments are
+// skipped.
+func ParseSumManifest(b []byte) (*SumManifest, error) {
+	m := &SumManifest{Algo: SumSHA256}
+
+	for i, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if len(l) == 0 {
+			continue
+		}
+
+		if l[0] == '#' {
+			if strings.HasPrefix(l, _SumHeader) && len(m.Files) == 0 {
+				m.Algo = strings.TrimSpace(l[len(_SumHeader):])
+				if _, err := newSumHash(m.Algo); err != nil {
+					return nil, fmt.Errorf("%s (line %d)", err, i+1)
+				}
+			}
+			continue
+		}
+
+		f, err := parseSumLine(l, m.Algo)
+		if err != nil {
+			return nil, fmt.Errorf("sum: line %d: %s", i+1, err)
+		}
+		m.Files = append(m.Files, *f)
+	}
+
+	if len(m.Files) == 0 {
+		return nil, fmt.Errorf("sum: no checksums")
+	}
+	return m, nil
+}
+
+// parse 'hex  name', 'hex *name' (binary mode) or 'ALGO (name) = hex'
+func parseSumLine(l, algo string) (*SumFile, error) {
+	esc := l[0] == '\\'
+	if esc {
+		l = l[1:]
+	}
+
+	i := strings.IndexByte(l, ' ')
+	if i < 0 || i+2 > len(l) {
+		return nil, fmt.Errorf("bad checksum line")
+	}
+
+	var hexsum, name string
+	switch l[i+1] {
+	case ' ', '*':
+		hexsum, name = l[:i], l[i+2:]
+	case '(':
+		j := strings.LastIndex(l, ") = ")
+		if j < i {
+			return nil, fmt.Errorf("bad checksum line")
+		}
+		if strings.ToLower(l[:i]) != algo {
+			return nil, fmt.Errorf("%s checksum in a %s manifest", l[:i], algo)
+		}
+		name, hexsum = l[i+2:j], l[j+4:]
+	default:
+		return nil, fmt.Errorf("bad checksum line")
+	}
+
+	sum, err := hex.DecodeString(hexsum)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("bad checksum '%s'", hexsum)
+	}
+
+	if esc {
+		if name, err = sumUnescape(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(name) == 0 {
+		return nil, fmt.Errorf("missing file name")
+	}
+	return &SumFile{name, sum}, nil
+}
+
+func sumUnescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' {
+			if i++; i == len(s) {
+				return "", fmt.Errorf("bad escape in file name")
+			}
+
+			switch s[i] {
+			case '\\':
+				c = '\\'
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				return "", fmt.Errorf("bad escape in file name")
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
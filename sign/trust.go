@@ -0,0 +1,247 @@
+// trust.go -- database of trusted signers
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// The trust database is a YAML file listing the keys trusted to sign
+// files; each signer has a unique name and optional scopes. A scope is a
+// path.Match() pattern (e.g., "releases/*") matched against the path of
+// the signed file and every trailing part of it: "releases/*" matches
+// both "releases/v1.tar.gz" and "/srv/www/releases/v1.tar.gz". A signer
+// without scopes is trusted for every file.
+
+package sign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TrustedSigner is one entry of the trust database
+type TrustedSigner struct {
+	Name string
+	Key  *PublicKey
+
+	// Patterns of the files the key is trusted to sign; empty means all
+	Scopes []string
+
+	// Time the signer was added
+	Added time.Time
+}
+
+// TrustDB is the database of trusted signers
+type TrustDB struct {
+	Signers []*TrustedSigner
+}
+
+// serialized trusted signer
+type serializedTrustedSigner struct {
+	Name   string            `yaml:"name"`
+	Key    *serializedPubKey `yaml:"key"`
+	Scopes []string          `yaml:"scopes,flow,omitempty"`
+	Added  string            `yaml:"added,omitempty"`
+}
+
+// serialized trust database
+type serializedTrustDB struct {
+	Signers []*serializedTrustedSigner `yaml:"signers"`
+}
+
+// ReadTrustDB reads the trust database in file 'fn'; a missing file is an
+// empty database.
+func ReadTrustDB(fn string) (*TrustDB, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &TrustDB{}, nil
+		}
+		return nil, err
+	}
+
+	db, err := MakeTrustDB(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return db, nil
+}
+
+// MakeTrustDB parses a serialized trust database
+func MakeTrustDB(b []byte) (*TrustDB, error) {
+	var sdb serializedTrustDB
+
+	if err := yaml.Unmarshal(b, &sdb); err != nil {
+		return nil, fmt.Errorf("trust: can't parse YAML: %s", err)
+	}
+
+	db := &TrustDB{}
+	for _, s := range sdb.Signers {
+		if s == nil || s.Key == nil {
+			return nil, fmt.Errorf("trust: malformed entry")
+		}
+
+		pk, err := s.Key.decode()
+		if err != nil {
+			return nil, fmt.Errorf("trust: %s: %s", s.Name, err)
+		}
+
+		var t time.Time
+		if len(s.Added) > 0 {
+			if t, err = time.Parse(time.RFC3339, s.Added); err != nil {
+				return nil, fmt.Errorf("trust: %s: invalid time %q", s.Name, s.Added)
+			}
+		}
+
+		if err = db.Add(s.Name, pk, s.Scopes); err != nil {
+			return nil, err
+		}
+		db.Signers[len(db.Signers)-1].Added = t
+	}
+	return db, nil
+}
+
+// Add the key 'pk' named 'name' that is trusted to sign the files
+// matching 'scopes'
+func (db *TrustDB) Add(name string, pk *PublicKey, scopes []string) error {
+	if !aliasRe.MatchString(name) {
+		return fmt.Errorf("trust: invalid name %q", name)
+	}
+
+	if pk.Pk == nil {
+		return fmt.Errorf("trust: %s: only Ed25519 keys can be trusted", name)
+	}
+
+	for _, s := range scopes {
+		if _, err := path.Match(s, ""); err != nil || len(s) == 0 {
+			return fmt.Errorf("trust: %s: invalid scope %q", name, s)
+		}
+	}
+
+	if db.Lookup(name) != nil {
+		return fmt.Errorf("trust: duplicate name %q", name)
+	}
+
+	for _, t := range db.Signers {
+		if t.Key.MatchPin(pk.Fingerprint()) {
+			return fmt.Errorf("trust: %s: key is already trusted as %q", name, t.Name)
+		}
+	}
+
+	db.Signers = append(db.Signers, &TrustedSigner{
+		Name:   name,
+		Key:    pk,
+		Scopes: scopes,
+		Added:  time.Now().UTC().Truncate(time.Second),
+	})
+	return nil
+}
+
+// Remove the signer named 'name' or whose key has the fingerprint 'name'
+func (db *TrustDB) Remove(name string) error {
+	for i, t := range db.Signers {
+		if t.Name == name || t.Key.MatchPin(name) {
+			db.Signers = append(db.Signers[:i], db.Signers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("trust: no signer %q", name)
+}
+
+// Lookup returns the signer named 'name'; it is nil if there is no such
+// signer
+func (db *TrustDB) Lookup(name string) *TrustedSigner {
+	for _, t := range db.Signers {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// InScope returns true if 't' is trusted to sign the file 'fn'
+func (t *TrustedSigner) InScope(fn string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+
+	fn = path.Clean(filepath.ToSlash(fn))
+	for {
+		for _, s := range t.Scopes {
+			if ok, _ := path.Match(s, fn); ok {
+				return true
+			}
+		}
+
+		i := strings.IndexByte(fn, '/')
+		if i < 0 {
+			return false
+		}
+		fn = fn[i+1:]
+	}
+}
+
+// TrustedKeys returns the keys trusted to sign the file 'fn'. Keys
+// without a comment are labeled with the name of their signer.
+func (db *TrustDB) TrustedKeys(fn string) []*PublicKey {
+	var pks []*PublicKey
+	for _, t := range db.Signers {
+		if !t.InScope(fn) {
+			continue
+		}
+
+		pk := *t.Key
+		if len(pk.Comment) == 0 {
+			pk.Comment = t.Name
+		}
+		pks = append(pks, &pk)
+	}
+	return pks
+}
+
+// Serialize the trust database as YAML
+func (db *TrustDB) Serialize() ([]byte, error) {
+	sdb := &serializedTrustDB{
+		Signers: make([]*serializedTrustedSigner, len(db.Signers)),
+	}
+
+	for i, t := range db.Signers {
+		s := &serializedTrustedSigner{
+			Name:   t.Name,
+			Key:    t.Key.encode(t.Key.Comment),
+			Scopes: t.Scopes,
+		}
+		if !t.Added.IsZero() {
+			s.Added = t.Added.Format(time.RFC3339)
+		}
+		sdb.Signers[i] = s
+	}
+
+	out, err := yaml.Marshal(sdb)
+	if err != nil {
+		return nil, fmt.Errorf("trust: can't marshal to YAML: %s", err)
+	}
+	return out, nil
+}
+
+// SerializeFile writes the trust database to file 'fn'
+func (db *TrustDB) SerializeFile(fn string) error {
+	b, err := db.Serialize()
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, b, 0644)
+}
@@ -0,0 +1,114 @@
+// unwrap.go -- find our wrapped key among many
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// files with at least this many X25519 wrapped keys are searched in
+// parallel
+const _ParallelUnwrapMin = 64
+
+// try the X25519 wrapped keys of a file without hints on all CPUs. The
+// shared secret of each of our keys is the same for every slot; it is
+// computed once and the workers only open the wrapped keys. The second
+// return value is false if the keys weren't tried (a key held elsewhere
+// or too few slots); with 'skipHinted', slots with hints aren't tried.
+func (d *Decryptor) unwrapParallel(sk *PrivateKey, skipHinted bool) ([]byte, bool, error) {
+	if sk.ext != nil || sk.agent != nil {
+		return nil, false, nil
+	}
+
+	var slots []int
+	for i, w := range d.Keys {
+		if len(w.Type) == 0 && !(skipHinted && hasHint(w)) {
+			slots = append(slots, i)
+		}
+	}
+
+	ncpu := runtime.NumCPU()
+	if len(slots) < _ParallelUnwrapMin || ncpu < 2 {
+		return nil, false, nil
+	}
+
+	var keks [][]byte
+	for _, ourSK := range sk.encryptionKeys() {
+		dkek, err := x25519(ourSK, d.Pk)
+		if err != nil {
+			return nil, true, fmt.Errorf("unwrap: %s", err)
+		}
+
+		kek, err := d.wrapKEK(dkek)
+		if err != nil {
+			return nil, true, err
+		}
+		keks = append(keks, kek)
+	}
+
+	if ncpu > len(slots)/(_ParallelUnwrapMin/4) {
+		ncpu = len(slots) / (_ParallelUnwrapMin / 4)
+	}
+
+	pk := sk.PublicKey()
+	keys := make([][]byte, len(slots))
+	errs := make([]error, len(slots))
+
+	var wg sync.WaitGroup
+	var next int64 = -1
+	var found int32
+
+	wg.Add(ncpu)
+	for i := 0; i < ncpu; i++ {
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&found) == 0 {
+				j := int(atomic.AddInt64(&next, 1))
+				if j >= len(slots) {
+					return
+				}
+
+				w := d.Keys[slots[j]]
+				for _, kek := range keks {
+					keys[j], errs[j] = d.unwrapShared(w, kek, pk)
+					if keys[j] != nil || errs[j] != nil {
+						break
+					}
+				}
+				if keys[j] != nil {
+					atomic.StoreInt32(&found, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j, key := range keys {
+		if key != nil {
+			info(d.log, "decrypt: recipient matched", "slot", slots[j], "workers", ncpu,
+				"pkhash", fmt.Sprintf("%x", sk.pk.hash))
+			return key, true, nil
+		}
+	}
+
+	for j, err := range errs {
+		if err != nil {
+			return nil, true, fmt.Errorf("can't unwrap key %d: %s", slots[j], err)
+		}
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,105 @@
+// usage.go -- key usage restrictions
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyUsage restricts the operations a key can be used for. The zero
+// value places no restriction on the key; this is the case for keys
+// generated before usage flags existed and for OpenSSH keys.
+type KeyUsage uint8
+
+const (
+	// The key signs (and verifies) files and messages
+	UsageSign KeyUsage = 1 << iota
+
+	// The key encrypts to (and decrypts for) a recipient
+	UsageEncrypt
+
+	// The key can be used for any operation
+	UsageAny KeyUsage = 0
+)
+
+// ParseKeyUsage parses a comma separated list of usages: "sign",
+// "encrypt" or "any".
+func ParseKeyUsage(s string) (KeyUsage, error) {
+	var u KeyUsage
+
+	for _, w := range strings.Split(s, ",") {
+		switch strings.TrimSpace(strings.ToLower(w)) {
+		case "sign":
+			u |= UsageSign
+		case "encrypt":
+			u |= UsageEncrypt
+		case "any", "":
+		default:
+			return 0, fmt.Errorf("unknown key usage %q", w)
+		}
+	}
+
+	// a key that can do everything is unrestricted
+	if u == UsageSign|UsageEncrypt {
+		u = UsageAny
+	}
+	return u, nil
+}
+
+// String returns the canonical name of the usage; it is empty for
+// unrestricted keys.
+func (u KeyUsage) String() string {
+	switch u {
+	case UsageSign:
+		return "sign"
+	case UsageEncrypt:
+		return "encrypt"
+	}
+	return ""
+}
+
+// Allows returns true if the usage permits the operation 'op'
+func (u KeyUsage) Allows(op KeyUsage) bool {
+	return u == UsageAny || u&op == op
+}
+
+// SetUsage restricts both keys of the keypair to the usage 'u'
+func (kp *Keypair) SetUsage(u KeyUsage) {
+	kp.Sec.Usage = u
+	kp.Pub.Usage = u
+
+	// sign-only keys don't need an encryption key
+	if u == UsageSign {
+		kp.Sec.xsk = nil
+		kp.Pub.xpk = nil
+		kp.Pub.xsig = nil
+	}
+}
+
+// return an error if the private key can't be used for 'op'
+func (sk *PrivateKey) checkUsage(op KeyUsage) error {
+	if sk.Usage.Allows(op) {
+		return nil
+	}
+	return fmt.Errorf("private key %x is %s-only; can't use it to %s", sk.pk.hash, sk.Usage, op)
+}
+
+// return an error if the public key can't be used for 'op'
+func (pk *PublicKey) checkUsage(op KeyUsage) error {
+	if pk.Usage.Allows(op) {
+		return nil
+	}
+	return fmt.Errorf("public key %x (%s) is %s-only; can't use it to %s", pk.hash, pk.Comment, pk.Usage, op)
+}
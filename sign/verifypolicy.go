@@ -0,0 +1,379 @@
+// verifypolicy.go -- verification policy files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// A verification policy names the trusted signers and the rules their
+// signatures must meet:
+//
+//    signers:
+//      - name: alice
+//        key: alice.pub
+//      - name: bob
+//        fingerprint: SHA256:...
+//    require: [alice]          # these signers must sign
+//    threshold: 2              # at least this many signers (default 1)
+//    hash: [sha512]            # allowed content hash algorithms
+//    max-age: 90d              # maximum age of a signature
+//    revoked:                  # fingerprints of revoked keys
+//      - SHA256:...
+//    revocation-lists:         # files with one revoked fingerprint per line
+//      - /etc/sigtool/revoked.txt
+//
+// Keys are anything ParseRecipient() accepts; relative paths are relative
+// to the policy file. A signature by a revoked key (or subkey), with a
+// hash algorithm that isn't allowed or older than max-age doesn't count;
+// a signature without a signing time fails max-age.
+
+package sign
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// VerifyPolicy is a verification policy
+type VerifyPolicy struct {
+	Signers []*PolicySigner
+
+	// Names of the signers that must sign
+	Required []string
+
+	// Minimum number of signers
+	Threshold int
+
+	// Allowed hash algorithms; any if empty
+	HashAlgos []string
+
+	// Maximum age of a signature; no limit if zero
+	MaxAge time.Duration
+
+	// Fingerprints of revoked keys
+	Revoked []string
+}
+
+// PolicySigner is a signer trusted by a policy; signers named by their
+// fingerprint have no Key.
+type PolicySigner struct {
+	Name        string
+	Key         *PublicKey
+	Fingerprint string
+}
+
+// serialized verification policy
+type serializedVerifyPolicy struct {
+	Signers   []*serializedPolicySigner `yaml:"signers"`
+	Require   []string                  `yaml:"require,omitempty"`
+	Threshold int                       `yaml:"threshold,omitempty"`
+	Hash      []string                  `yaml:"hash,omitempty"`
+	MaxAge    string                    `yaml:"max-age,omitempty"`
+	Revoked   []string                  `yaml:"revoked,omitempty"`
+	RevLists  []string                  `yaml:"revocation-lists,omitempty"`
+}
+
+// serialized policy signer
+type serializedPolicySigner struct {
+	Name        string `yaml:"name"`
+	Key         string `yaml:"key,omitempty"`
+	Fingerprint string `yaml:"fingerprint,omitempty"`
+}
+
+// ReadVerifyPolicy reads the verification policy in file 'fn'
+func ReadVerifyPolicy(fn string) (*VerifyPolicy, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := makeVerifyPolicy(b, filepath.Dir(fn))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return p, nil
+}
+
+// MakeVerifyPolicy parses a serialized verification policy; relative
+// paths are relative to the current directory.
+func MakeVerifyPolicy(b []byte) (*VerifyPolicy, error) {
+	return makeVerifyPolicy(b, "")
+}
+
+func makeVerifyPolicy(b []byte, dir string) (*VerifyPolicy, error) {
+	var sp serializedVerifyPolicy
+
+	if err := yaml.UnmarshalStrict(b, &sp); err != nil {
+		return nil, fmt.Errorf("policy: can't parse YAML: %s", err)
+	}
+
+	p := &VerifyPolicy{
+		Required:  sp.Require,
+		Threshold: sp.Threshold,
+	}
+
+	if len(sp.Signers) == 0 {
+		return nil, fmt.Errorf("policy: no signers")
+	}
+
+	for i, s := range sp.Signers {
+		if s == nil || len(s.Name) == 0 {
+			return nil, fmt.Errorf("policy: signer %d: no name", i)
+		}
+		if p.signer(s.Name) != nil {
+			return nil, fmt.Errorf("policy: duplicate signer %s", s.Name)
+		}
+
+		ps := &PolicySigner{Name: s.Name}
+		switch {
+		case len(s.Key) > 0 && len(s.Fingerprint) > 0:
+			return nil, fmt.Errorf("policy: signer %s: has both a key and a fingerprint", s.Name)
+		case len(s.Key) > 0:
+			pk, err := ParseRecipient(policyFile(dir, s.Key))
+			if err != nil {
+				return nil, fmt.Errorf("policy: signer %s: %s", s.Name, err)
+			}
+			ps.Key, ps.Fingerprint = pk, pk.Fingerprint()
+		case strings.HasPrefix(s.Fingerprint, "SHA256:"):
+			ps.Fingerprint = s.Fingerprint
+		default:
+			return nil, fmt.Errorf("policy: signer %s: needs a key or a SHA256: fingerprint", s.Name)
+		}
+		p.Signers = append(p.Signers, ps)
+	}
+
+	for _, name := range p.Required {
+		if p.signer(name) == nil {
+			return nil, fmt.Errorf("policy: required signer %s isn't a signer", name)
+		}
+	}
+
+	if p.Threshold == 0 {
+		p.Threshold = 1
+	}
+	if p.Threshold < 1 || p.Threshold > len(p.Signers) {
+		return nil, fmt.Errorf("policy: invalid threshold %d; must be between 1 and %d", p.Threshold, len(p.Signers))
+	}
+
+	for _, h := range sp.Hash {
+		if _, err := contentHash(h); err != nil {
+			return nil, fmt.Errorf("policy: unknown hash algorithm %q (known: %s, %s)", h, hashSHA512, hashBLAKE3)
+		}
+		p.HashAlgos = append(p.HashAlgos, h)
+	}
+
+	if len(sp.MaxAge) > 0 {
+		d, err := parseAge(sp.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("policy: max-age: %s", err)
+		}
+		p.MaxAge = d
+	}
+
+	p.Revoked = append(p.Revoked, sp.Revoked...)
+	for _, fn := range sp.RevLists {
+		fps, err := readRevocationList(policyFile(dir, fn))
+		if err != nil {
+			return nil, fmt.Errorf("policy: %s", err)
+		}
+		p.Revoked = append(p.Revoked, fps...)
+	}
+	return p, nil
+}
+
+// TrustedKeys returns the keys of the signers; signers named by their
+// fingerprint are found among the keys carried by the signatures 'sigs'.
+func (p *VerifyPolicy) TrustedKeys(sigs []*Signature) []*PublicKey {
+	var pins []string
+	var keys []*PublicKey
+
+	for _, s := range p.Signers {
+		if s.Key != nil {
+			keys = append(keys, s.Key)
+		} else {
+			pins = append(pins, s.Fingerprint)
+		}
+	}
+
+	if len(pins) > 0 {
+		keys = append(keys, PinnedKeys(sigs, pins)...)
+	}
+	return keys
+}
+
+// Check returns the verified signatures 'res' that meet the policy; it is
+// an error if they don't satisfy it. The error lists the unmet rules and
+// the signatures that didn't count.
+func (p *VerifyPolicy) Check(res []*VerifyResult) ([]*VerifyResult, error) {
+	var good []*VerifyResult
+	var why, rejected []string
+
+	now := time.Now()
+	signed := make(map[string]bool)
+	for _, r := range res {
+		s := p.signerOf(r)
+		if s == nil {
+			rejected = append(rejected, fmt.Sprintf("%s isn't a signer", r.Fingerprint))
+			continue
+		}
+
+		if err := p.checkResult(r, now); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", s.Name, err))
+			continue
+		}
+
+		if !signed[s.Name] {
+			signed[s.Name] = true
+			good = append(good, r)
+		}
+	}
+
+	for _, name := range p.Required {
+		if !signed[name] {
+			why = append(why, fmt.Sprintf("required signer %s didn't sign", name))
+		}
+	}
+
+	if len(good) < p.Threshold {
+		why = append(why, fmt.Sprintf("%d of %d required signers signed", len(good), p.Threshold))
+	}
+
+	if len(why) > 0 {
+		why = append(why, rejected...)
+		return good, fmt.Errorf("policy: %s", strings.Join(why, "; "))
+	}
+	return good, nil
+}
+
+// VerifyFilePolicy verifies the signatures 'sigs' of file 'fn' by the
+// signers of the policy 'p' and checks them against it.
+func VerifyFilePolicy(fn string, sigs []*Signature, p *VerifyPolicy) ([]*VerifyResult, error) {
+	pks := p.TrustedKeys(sigs)
+	if len(pks) == 0 {
+		return nil, fmt.Errorf("policy: no signature by a signer")
+	}
+
+	res, err := VerifyFileResult(fn, sigs, pks, 1)
+	if err != nil && err != ErrTooFewSignatures {
+		return nil, err
+	}
+	return p.Check(res)
+}
+
+// check a verified signature against the rules of the policy
+func (p *VerifyPolicy) checkResult(r *VerifyResult, now time.Time) error {
+	if p.revoked(r.Signer) {
+		return fmt.Errorf("key %s is revoked", r.Fingerprint)
+	}
+	if r.Subkey != nil && p.revoked(r.Subkey) {
+		return fmt.Errorf("subkey %s is revoked", r.Subkey.Fingerprint())
+	}
+
+	if len(p.HashAlgos) > 0 && !hasString(p.HashAlgos, r.HashAlgo) {
+		return fmt.Errorf("hash algorithm %s isn't allowed", r.HashAlgo)
+	}
+
+	if p.MaxAge > 0 {
+		if r.Time.IsZero() {
+			return fmt.Errorf("signature has no signing time (max-age is %s)", p.MaxAge)
+		}
+		if age := now.Sub(r.Time); age > p.MaxAge {
+			return fmt.Errorf("signature is too old (signed %s; max-age is %s)", r.Time.Format(time.RFC3339), p.MaxAge)
+		}
+	}
+	return nil
+}
+
+// true if the key 'pk' is revoked
+func (p *VerifyPolicy) revoked(pk *PublicKey) bool {
+	for _, fp := range p.Revoked {
+		if pk.MatchPin(fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// the signer named 'name'
+func (p *VerifyPolicy) signer(name string) *PolicySigner {
+	for _, s := range p.Signers {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// the signer that made the signature 'r'
+func (p *VerifyPolicy) signerOf(r *VerifyResult) *PolicySigner {
+	for _, s := range p.Signers {
+		if r.Signer.MatchPin(s.Fingerprint) {
+			return s
+		}
+	}
+	return nil
+}
+
+// read the fingerprints in the revocation list 'fn'; blank lines and
+// comments (starting with '#') are ignored.
+func readRevocationList(fn string) ([]string, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var fps []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		if !strings.HasPrefix(s, "SHA256:") {
+			return nil, fmt.Errorf("%s: line %d: not a SHA256: fingerprint", fn, n)
+		}
+		fps = append(fps, s)
+	}
+	return fps, sc.Err()
+}
+
+// parse a duration; a 'd' suffix counts days
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func hasString(v []string, s string) bool {
+	for _, x := range v {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// x25519.go -- X25519 operations with crypto/ecdh
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package sign
+
+import (
+	"crypto/ecdh"
+	Ed "crypto/ed25519"
+	"fmt"
+	"math/big"
+)
+
+// the shared secret of the X25519 private key 'sk' and public key 'pk';
+// a low-order 'pk' (all-zero secret) is an error.
+func x25519(sk, pk []byte) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ecdh.X25519().NewPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	return k.ECDH(p)
+}
+
+// the X25519 public key of the private key 'sk'
+func x25519Public(sk []byte) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	return k.PublicKey().Bytes(), nil
+}
+
+// field prime and the Edwards curve constant d = -121665/121666
+var (
+	curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+	edwardsD = new(big.Int).Mod(new(big.Int).Mul(big.NewInt(-121665),
+		new(big.Int).ModInverse(big.NewInt(121666), curve25519P)), curve25519P)
+)
+
+// Convert the Ed25519 public key 'edpk' to the X25519 public key of the
+// same point. The key must be the canonical encoding of a point on the
+// curve other than the identity and the point of order 2; other low-order
+// points are refused by x25519().
+func edToX25519(edpk []byte) ([]byte, error) {
+	if len(edpk) != Ed.PublicKeySize {
+		return nil, fmt.Errorf("ed25519 public key is malformed (len %d!)", len(edpk))
+	}
+
+	p := curve25519P
+
+	// ed25519.PublicKey is a little endian representation of the y-coordinate,
+	// with the most significant bit set based on the sign of the x-ccordinate.
+	be := make([]byte, Ed.PublicKeySize)
+	for i, b := range edpk {
+		be[Ed.PublicKeySize-i-1] = b
+	}
+	be[0] &= 0b0111_1111
+
+	y := new(big.Int).SetBytes(be)
+	if y.Cmp(p) >= 0 {
+		return nil, fmt.Errorf("ed25519 public key isn't canonical")
+	}
+
+	one := big.NewInt(1)
+	if y.Cmp(one) == 0 || y.Cmp(new(big.Int).Sub(p, one)) == 0 {
+		return nil, fmt.Errorf("ed25519 public key is a low-order point")
+	}
+
+	// the point is on the curve if x^2 = (y^2 - 1) / (d y^2 + 1) has a
+	// root; x^2 isn't 0 as y isn't 1 or -1
+	y2 := new(big.Int).Mul(y, y)
+	num := new(big.Int).Sub(y2, one)
+	den := new(big.Int).Mul(edwardsD, y2)
+	den.Add(den, one).Mod(den, p)
+	x2 := num.Mul(num, den.ModInverse(den, p)).Mod(num, p)
+
+	if big.Jacobi(x2, p) != 1 {
+		return nil, fmt.Errorf("ed25519 public key isn't on the curve")
+	}
+
+	// The Montgomery u-coordinate is derived through the bilinear map
+	//
+	//     u = (1 + y) / (1 - y)
+	//
+	// See https://blog.filippo.io/using-ed25519-keys-for-encryption.
+	denom := new(big.Int).Sub(one, y)
+	denom.ModInverse(denom.Mod(denom, p), p)
+	u := new(big.Int).Add(y, one)
+	u.Mul(u, denom).Mod(u, p)
+
+	out := u.FillBytes(make([]byte, 32))
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
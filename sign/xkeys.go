@@ -0,0 +1,110 @@
+// xkeys.go -- native X25519 encryption keys
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Newly generated keys have a separate X25519 keypair for encryption.
+// The Ed25519 signing key certifies the X25519 public key by signing:
+//
+//    "sigtool x25519 key binding v1" || X25519 public key
+//
+// and the signature is stored along with the public key. Keys without a
+// native X25519 key (older sigtool keys and OpenSSH keys) continue to use
+// the Curve25519 point derived from the Ed25519 key.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+
+	Ed "crypto/ed25519"
+)
+
+const _XKeyBinding = "sigtool x25519 key binding v1"
+
+// generate a new native X25519 keypair for 'sk'
+func (sk *PrivateKey) newEncryptionKey() error {
+	xsk, xpk, err := newSender()
+	if err != nil {
+		return fmt.Errorf("can't generate X25519 keys: %s", err)
+	}
+	return sk.setEncryptionKey(xsk, xpk)
+}
+
+// set the native X25519 key of 'sk' and certify it with the signing key
+func (sk *PrivateKey) setEncryptionKey(xsk, xpk []byte) error {
+	if xpk == nil {
+		var err error
+		if xpk, err = x25519Public(xsk); err != nil {
+			return fmt.Errorf("can't derive X25519 public key: %s", err)
+		}
+	}
+
+	x := Ed.PrivateKey(sk.Sk)
+	sig, err := x.Sign(nil, xkeyBinding(xpk), crypto.Hash(0))
+	if err != nil {
+		return fmt.Errorf("can't certify X25519 key: %s", err)
+	}
+
+	sk.xsk = xsk
+	sk.pk.xpk = xpk
+	sk.pk.xsig = sig
+	return nil
+}
+
+// set and verify the native X25519 key of 'pk'
+func (pk *PublicKey) setEncryptionKey(xpk, sig []byte) error {
+	if len(xpk) != 32 {
+		return fmt.Errorf("X25519 public key is malformed (len %d!)", len(xpk))
+	}
+
+	if !Ed.Verify(Ed.PublicKey(pk.Pk), xkeyBinding(xpk), sig) {
+		return fmt.Errorf("X25519 public key is not certified by its signing key")
+	}
+
+	pk.xpk = xpk
+	pk.xsig = sig
+	return nil
+}
+
+// HasEncryptionKey returns true if the public key has a native X25519
+// encryption key.
+func (pk *PublicKey) HasEncryptionKey() bool {
+	return pk.xpk != nil
+}
+
+// EncryptionKey returns the X25519 public key used to encrypt to 'pk'; it
+// is nil if the Ed25519 key isn't a valid point.
+func (pk *PublicKey) EncryptionKey() []byte {
+	xpk, _ := pk.toCurve25519PK()
+	return xpk
+}
+
+// candidate X25519 private keys of 'sk' for unwrapping: the native key
+// (if any) followed by the one derived from the Ed25519 key.
+func (sk *PrivateKey) encryptionKeys() [][]byte {
+	if sk.Sk == nil {
+		return [][]byte{sk.xsk}
+	}
+	if sk.xsk != nil {
+		return [][]byte{sk.xsk, sk.toCurve25519SK()}
+	}
+	return [][]byte{sk.toCurve25519SK()}
+}
+
+func xkeyBinding(xpk []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(_XKeyBinding)
+	b.Write(xpk)
+	return b.Bytes()
+}
@@ -15,11 +15,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
@@ -30,41 +33,115 @@ var Z string = path.Base(os.Args[0])
 
 func main() {
 
-	var ver, help bool
+	// git runs gpg.ssh.program without arguments
+	if Z == gitSignLink {
+		gitSign(os.Args[1:])
+		return
+	}
+
+	var ver, help, selfTest, fips, insecurePerms bool
+	var auditDest string
+	var expired string
+	var verbose verbosity
+	var logFormat string
 
 	mf := flag.NewFlagSet(Z, flag.ExitOnError)
 	mf.SetInterspersed(false)
-	mf.BoolVarP(&ver, "version", "v", false, "Show version info and exit")
+	mf.BoolVarP(&ver, "version", "", false, "Show version info and exit")
+	mf.VarP(&verbose, "verbose", "v", "Log diagnostics to stderr; -vv for more detail (without a command: show version info)")
+	mf.StringVarP(&logFormat, "log-format", "", "text", "Log the diagnostics in format `F`: text (key=value) or json")
 	mf.BoolVarP(&help, "help", "h", false, "Show help info exit")
+	mf.StringVarP(&auditDest, "audit-log", "", os.Getenv("SIGTOOL_AUDIT_LOG"), "Append audit records of key operations to `F`")
+	mf.StringVarP(&expired, "expired-keys", "", "fail", "Use of expired public keys: `P` is one of fail, warn, ignore")
+	mf.BoolVarP(&fips, "fips", "", len(os.Getenv("SIGTOOL_FIPS")) > 0, "Restrict the algorithms to the FIPS approved set")
+	mf.BoolVarP(&insecurePerms, "insecure-key-perms", "", false, "Use private key files that others can read")
+	mf.BoolVarP(&selfTest, "selftest", "", len(os.Getenv("SIGTOOL_SELFTEST")) > 0, "Run the built-in known answer tests before the command")
 	mf.Parse(os.Args[1:])
 
-	if ver {
-		fmt.Printf("%s - %s [%s; %s]\n", Z, ProductVersion, RepoVersion, Buildtime)
-		os.Exit(0)
+	if fips {
+		if err := sign.SetFIPSMode(true); err != nil {
+			die("%s", err)
+		}
 	}
 
 	if help {
 		usage(0)
 	}
 
+	// a bare -v is the old shorthand for --version
 	args := mf.Args()
+	if ver || (verbose > 0 && len(args) == 0) {
+		version(nil)
+	}
+
 	if len(args) < 1 {
 		warn("Insufficient arguments. Try '%s -h'", Z)
 		os.Exit(1)
 	}
 
+	if selfTest && !runSelfTest(false) {
+		die("selftest failed; refusing to run")
+	}
+
+	xp, err := sign.ParseExpiryPolicy(expired)
+	if err != nil {
+		die("%s", err)
+	}
+
+	sign.SetExpiryPolicy(xp)
+	sign.SetInsecureKeyPerms(insecurePerms)
+	if err = setLogger(verbose, logFormat, xp == sign.ExpiryWarn); err != nil {
+		die("%s", err)
+	}
+
+	if len(auditDest) > 0 {
+		a, err := openAudit(auditDest)
+		if err != nil {
+			die("%s", err)
+		}
+		auditor = a
+	}
+
 	cmds := map[string]func(args []string){
 		"generate": gen,
 		"sign":     signify,
 		"verify":   verify,
 		"encrypt":  encrypt,
 		"decrypt":  decrypt,
+		"inspect":  inspect,
+		"archive":  archive,
+		"rotate":   rotate,
+		"keyring":  keyring,
+		"trust":    trust,
 
 		"help": func(_ []string) {
 			usage(0)
 		},
 	}
 
+	// commands that are only matched by their full name
+	exact := map[string]func(args []string){
+		"agent":       agent,
+		"attest":      attest,
+		"export":      exportKey,
+		"fingerprint": fingerprint,
+		"import":      importKey,
+		"key":         key,
+		"mount":       mount,
+		"rewrap":      rewrap,
+		"git-sign":    gitSign,
+		"serve":       serve,
+		"selftest":    selftest,
+		"sum":         sum,
+		"version":     version,
+		"watch":       watch,
+	}
+
+	if cmd, ok := exact[args[0]]; ok {
+		cmd(args[1:])
+		return
+	}
+
 	words := make([]string, 0, len(cmds))
 	for k := range cmds {
 		words = append(words, k)
@@ -87,9 +164,14 @@ func main() {
 // Run the generate command
 func gen(args []string) {
 
-	var nopw, help, force bool
+	var nopw, help, force, pemfmt bool
 	var comment string
 	var envpw string
+	var usage string
+	var count, minbits int
+	var outdir, manifest string
+	var derive, expires string
+	var master, subname string
 
 	fs := flag.NewFlagSet("generate", flag.ExitOnError)
 	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
@@ -97,56 +179,194 @@ func gen(args []string) {
 	fs.StringVarP(&comment, "comment", "c", "", "Use `C` as the text comment for the keys")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file if it exists")
+	fs.StringVarP(&usage, "usage", "u", "any", "Restrict the keys to usage `U`: sign, encrypt or any")
+	fs.IntVarP(&count, "count", "n", 0, "Generate `N` keypairs named PREFIX-N (default prefix 'key')")
+	fs.StringVarP(&outdir, "out-dir", "d", "", "Write the keypairs to directory `D` (with --count)")
+	fs.StringVarP(&manifest, "manifest", "m", "csv", "Write a manifest of the keypairs in format `F`: csv or json (with --count)")
+	fs.StringVarP(&derive, "derive", "", "", "Derive the keys from a passphrase and salt `S`; write only the public key")
+	fs.StringVarP(&expires, "expires", "", "", "Make the public key expire at `T` (YYYY-MM-DD or RFC 3339)")
+	fs.StringVarP(&master, "master", "M", "", "Make a subkey certified by master private key `K`")
+	fs.StringVarP(&subname, "subkey-name", "", "", "Name the subkey `N` (e.g., laptop) [file-prefix]")
+	fs.IntVarP(&minbits, "min-entropy", "", 0, "Refuse passphrases with less than `N` bits of estimated entropy")
+	fs.BoolVarP(&pemfmt, "pem", "", false, "Write the keypair to the single PEM file FILE-PREFIX.pem")
 
 	fs.Parse(args)
 
 	if help {
 		fs.SetOutput(os.Stdout)
 		fmt.Printf(`%s generate|gen|g [options] file-prefix
+       %s generate --count N --out-dir D [options] [prefix]
 
 Generate a new Ed25519 public+private key pair and write public key to
-FILE-PREFIX.pub and private key to FILE-PREFIX.key.
+FILE-PREFIX.pub and private key to FILE-PREFIX.key. With --pem, both are
+written to the single file FILE-PREFIX.pem (see 'export' and 'import').
+
+A sign-only key is refused by encrypt and decrypt; an encrypt-only key is
+refused by sign and verify.
+
+With --expires, the expiration time is recorded in the public key;
+verify and encrypt refuse an expired key (see --expired-keys).
+
+With --master K, the new key is a subkey (e.g., for one device: laptop,
+CI, phone) certified by the master private key K. Its usage and expiry
+are covered by the certificate. Signatures made by the subkey carry the
+certificate and verify against the master public key.
+
+With --count N, N keypairs are written to the directory given by --out-dir
+as PREFIX-1.pub, PREFIX-1.key .. PREFIX-N.key (the numbers are zero padded
+to the same width) along with a manifest of their fingerprints
+(manifest.csv or manifest.json). All private keys use the same passphrase.
+
+With --derive SALT, the keys are derived from a passphrase and SALT (e.g.,
+your email address) with Argon2id and only FILE-PREFIX.pub is written.
+There is no private key file: give "passphrase:SALT" instead of a private
+key to sign, encrypt or decrypt and enter the same passphrase. Anyone who
+guesses the passphrase has your keys; use a strong one.
+
+The entropy of the new passphrase is estimated (common passwords,
+repeats and sequences count for little); a weak one is warned about and
+one below --min-entropy N bits is refused.
 
 Options:
-`, Z)
+`, Z, Z)
 		fs.PrintDefaults()
 		os.Exit(0)
 	}
 
+	ku, err := sign.ParseKeyUsage(usage)
+	if err != nil {
+		die("%s", err)
+	}
+
+	var exp time.Time
+	if len(expires) > 0 {
+		if exp, err = sign.ParseExpiry(expires); err != nil {
+			die("%s", err)
+		}
+		if !exp.After(time.Now()) {
+			die("expiration time %s is in the past", expires)
+		}
+	}
+
+	if nopw && minbits > 0 {
+		die("--no-password can't be used with --min-entropy")
+	}
+
 	args = fs.Args()
+	if len(master) > 0 && (len(derive) > 0 || count > 0 || len(outdir) > 0) {
+		die("--master can't be used with --derive, --count or --out-dir")
+	}
+
+	if pemfmt && (len(derive) > 0 || count > 0 || len(outdir) > 0) {
+		die("--pem can't be used with --derive, --count or --out-dir")
+	}
+
+	if len(derive) > 0 {
+		if count > 0 || len(outdir) > 0 {
+			die("--derive can't be used with --count or --out-dir")
+		}
+		if ku != sign.UsageAny {
+			die("--derive keys can't be restricted with --usage")
+		}
+		if len(args) < 1 {
+			die("Insufficient arguments to 'generate'. Try '%s generate -h' ..", Z)
+		}
+		genDerived(args[0], derive, exp, comment, force, checkpwFunc(nopw, envpw, "Enter passphrase for derived keys", minbits))
+		return
+	}
+
+	if count > 0 || len(outdir) > 0 {
+		prefix := "key"
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+		genBatch(count, outdir, prefix, manifest, ku, exp, comment, force, checkpwFunc(nopw, envpw, "Enter passphrase for private keys", minbits))
+		return
+	}
+
 	if len(args) < 1 {
 		die("Insufficient arguments to 'generate'. Try '%s generate -h' ..", Z)
 	}
 
 	bn := args[0]
 
-	if exists(bn) && !force {
+	if pemfmt {
+		if _, err := os.Stat(bn + ".pem"); err == nil && !force {
+			die("PEM key file %s.pem exists. Won't overwrite!", bn)
+		}
+	} else if exists(bn) && !force {
 		die("Public/Private key files (%s.key, %s.pub) exist. Won't overwrite!", bn, bn)
 	}
 
-	var err error
-
 	kp, err := sign.NewKeypair()
 	if err != nil {
 		die("%s", err)
 	}
 
-	err = kp.Serialize(bn, comment, func() ([]byte, error) {
-		if nopw {
-			return nil, nil
+	kp.SetUsage(ku)
+	kp.SetExpiry(exp)
+
+	if len(master) > 0 {
+		msk, err := sign.ParseIdentity(master, askpassFunc(nopw, envpw, "Enter passphrase for master key", false))
+		if err != nil {
+			audit("certify", nil, master, "", bn+".pub", err)
+			die("%s", err)
 		}
 
-		var pws string
-		if len(envpw) > 0 {
-			pws = os.Getenv(envpw)
-		} else {
-			pws, err = utils.Askpass("Enter passphrase for private key", true)
-			if err != nil {
-				die("%s", err)
-			}
+		if len(subname) == 0 {
+			subname = path.Base(bn)
+		}
+
+		err = msk.CertifySubkey(&kp.Pub, subname)
+		audit("certify", msk, master, "", bn+".pub", err)
+		if err != nil {
+			die("%s", err)
 		}
-		return []byte(pws), nil
-	})
+	}
+
+	// ask before writing anything so that a refused passphrase leaves no files
+	pw, err := checkpwFunc(nopw, envpw, "Enter passphrase for private key", minbits)()
+	if err != nil {
+		die("%s", err)
+	}
+
+	getpw := func() ([]byte, error) {
+		return pw, nil
+	}
+
+	if pemfmt {
+		err = kp.SerializePEM(bn, comment, getpw)
+		audit("generate", &kp.Sec, bn+".pem", "", bn+".pem", err)
+	} else {
+		err = kp.Serialize(bn, comment, getpw)
+		audit("generate", &kp.Sec, bn+".key", "", bn+".pub", err)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+}
+
+// write the public key derived from a passphrase and 'salt' to $bn.pub
+func genDerived(bn, salt string, exp time.Time, comment string, force bool, getpw func() ([]byte, error)) {
+	pkf := bn + ".pub"
+	if exists(bn) && !force {
+		die("Public key file %s exists. Won't overwrite!", pkf)
+	}
+
+	pw, err := getpw()
+	if err != nil {
+		die("%s", err)
+	}
+
+	kp, err := sign.DeriveKeypair(pw, []byte(salt))
+	if err != nil {
+		audit("generate", nil, "", "", pkf, err)
+		die("%s", err)
+	}
+
+	kp.SetExpiry(exp)
+	err = kp.Pub.Serialize(pkf, comment)
+	audit("generate", &kp.Sec, "", "", pkf, err)
 	if err != nil {
 		die("%s", err)
 	}
@@ -154,153 +374,837 @@ Options:
 
 // Run the 'sign' command.
 func signify(args []string) {
-	var nopw, help bool
-	var output string
-	var envpw string
+	var nopw, help, attrs, embed, clear, force, rtime bool
+	var offreq, signreq bool
+	var output, suffix, rtfile, offresp string
+	var envpw, halgo string
+	var comment, ucomment string
+	var keys stringList
 
 	fs := flag.NewFlagSet("sign", flag.ExitOnError)
 	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.StringVarP(&output, "output", "o", "", "Write signature to file `F`")
+	fs.VarP(&keys, "key", "k", "Sign with private key `K` (can be repeated)")
+	fs.BoolVarP(&attrs, "attributes", "a", false, "Embed signed attributes (file name, size, time) in the signature")
+	fs.StringVarP(&comment, "comment", "c", "", "Embed the trusted (signed) comment `C` (implies --attributes)")
+	fs.StringVarP(&ucomment, "untrusted-comment", "u", "", "Use `U` as the untrusted (unsigned) comment [input=FILE]")
+	fs.StringVarP(&halgo, "hash", "H", "sha512", "Hash the content with `A`: sha512 or blake3 (implies --attributes)")
+	fs.BoolVarP(&embed, "embed", "e", false, "Write FILE with the signature embedded to FILE.signed")
+	fs.BoolVarP(&clear, "clearsign", "", false, "Write the clear signed text of FILE to FILE.asc")
+	fs.StringVarP(&suffix, "suffix", "", "", "Write the output to FILE with suffix `S` [.sig, .signed or .asc]")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file without asking")
+	fs.BoolVarP(&rtime, "roughtime", "", false, "Timestamp the signatures with a Roughtime server")
+	fs.StringVarP(&rtfile, "roughtime-servers", "", roughtimePath(), "Use the Roughtime servers listed in file `F`")
+	fs.BoolVarP(&offreq, "offline-request", "", false, "Write a request to sign FILE to FILE.sigreq for an offline signer")
+	fs.BoolVarP(&signreq, "sign-request", "", false, "Sign the content described by the signing request FILE")
+	fs.StringVarP(&offresp, "offline-response", "", "", "Check the signature `R` made from a signing request of FILE and write it to FILE.sig")
 
 	fs.Parse(args)
 
 	if help {
 		fs.SetOutput(os.Stdout)
 		fmt.Printf(`%s sign|s [options] privkey file
+%s sign|s [options] -k privkey [-k privkey ..] file
+%s sign|s --offline-request [options] file
+%s sign|s --sign-request [options] privkey file.sigreq
+%s sign|s --offline-response file.sig [options] file
 
 Sign FILE with a Ed25519 private key PRIVKEY and write signature to FILE.sig
+If more than one private key is given via '-k', FILE is signed by each of
+them and all the signatures are written to a single signature file.
+
+A signature can carry two comments: the trusted comment is covered by the
+signature and can't be altered without invalidating it; the untrusted
+comment is informational and can be edited freely.
+
+With '--embed', the output is a single self-contained file with FILE's
+content followed by the signature; use 'verify --embedded' to verify it.
+
+With '--clearsign', FILE must be a text file; the output keeps the text
+readable and appends an armored signature block. Verify it with
+'verify --clearsigned'.
+
+With '--hash blake3', the content is hashed with BLAKE3 instead of SHA512;
+it is much faster and hashes large files on all CPUs. The hash is recorded
+in the signed attributes.
+
+With '--roughtime', each signature is timestamped by the first Roughtime
+server that answers; the signed response of the server is proof of the
+time at which the signature existed. The servers are listed in the JSON
+format of the Roughtime ecosystem in ~/.sigtool/roughtime.json (or
+$SIGTOOL_ROUGHTIME).
+
+A large FILE can be signed on an air-gapped machine without copying it:
+'--offline-request' writes its checksum and the signature attributes to
+FILE.sigreq; on the offline machine, '--sign-request' signs the request
+and writes FILE.sig; back online, '--offline-response FILE.sig' checks
+the signature against FILE (and with '--embed' or '--roughtime' finishes
+the output).
+
+An existing output file is only overwritten after asking on a terminal
+(or with --force).
 
 Options:
-`, Z)
+`, Z, Z, Z, Z, Z)
 		fs.PrintDefaults()
 		os.Exit(0)
 	}
 
 	args = fs.Args()
-	if len(args) < 2 {
+	if len(keys) == 0 && !offreq && len(offresp) == 0 {
+		if len(args) < 2 {
+			die("Insufficient arguments to 'sign'. Try '%s sign -h' ..", Z)
+		}
+		keys = append(keys, args[0])
+		args = args[1:]
+	}
+
+	if len(args) < 1 {
 		die("Insufficient arguments to 'sign'. Try '%s sign -h' ..", Z)
 	}
 
-	kn := args[0]
-	fn := args[1]
+	fn := args[0]
 	outf := fmt.Sprintf("%s.sig", fn)
+	offline := offreq || signreq || len(offresp) > 0
+	halgo = strings.ToLower(halgo)
+	switch {
+	case halgo != "sha512" && halgo != "blake3":
+		die("unknown hash algorithm %s", halgo)
+	case halgo != "sha512" && (clear || offline):
+		die("--hash can't be used with --clearsign or signing requests")
+	case embed && clear:
+		die("--embed and --clearsign are mutually exclusive")
+	case clear && len(keys) > 1:
+		die("--clearsign supports only one private key")
+	case clear && rtime:
+		die("--roughtime can't be used with --clearsign")
+	case offline && (offreq && signreq || len(offresp) > 0 && (offreq || signreq)):
+		die("--offline-request, --sign-request and --offline-response are mutually exclusive")
+	case offline && clear:
+		die("--clearsign can't be used with signing requests")
+	case (offreq || signreq) && (embed || rtime):
+		die("--embed and --roughtime can only be used with --offline-response")
+	case signreq && (attrs || len(comment) > 0):
+		die("the signing request sets the signature attributes")
+	case embed:
+		outf = fmt.Sprintf("%s.signed", fn)
+	case clear:
+		outf = fmt.Sprintf("%s.asc", fn)
+	case offreq:
+		outf = fmt.Sprintf("%s.sigreq", fn)
+	case signreq:
+		outf = fmt.Sprintf("%s.sig", strings.TrimSuffix(fn, ".sigreq"))
+	}
 
 	var err error
 
-	if len(output) > 0 {
+	switch {
+	case len(output) > 0:
 		outf = output
+	case len(suffix) > 0:
+		outf = fn + suffix
 	}
 
-	sk, err := sign.ReadPrivateKey(kn, func() ([]byte, error) {
-		if nopw {
-			return nil, nil
+	// all the signatures carry identical attributes
+	var sa *sign.Attributes
+	if attrs || len(comment) > 0 || halgo != "sha512" {
+		sa = &sign.Attributes{
+			Time:     time.Now(),
+			Comment:  comment,
+			HashAlgo: halgo,
 		}
+	}
 
-		var pws string
-		if len(envpw) > 0 {
-			pws = os.Getenv(envpw)
-		} else {
-			pws, err = utils.Askpass("Enter passphrase for private key", false)
-			if err != nil {
-				die("%s", err)
-			}
+	var req *sign.SigningRequest
+	if signreq {
+		if req, err = sign.ReadSigningRequest(fn); err != nil {
+			die("%s", err)
+		}
+		if len(ucomment) > 0 {
+			req.Comment = ucomment
 		}
+	}
 
-		return []byte(pws), nil
-	})
-	if err != nil {
-		die("%s", err)
+	if len(ucomment) == 0 {
+		ucomment = fmt.Sprintf("input=%s", fn)
 	}
 
-	sig, err := sk.SignFile(fn)
-	if err != nil {
-		die("%s", err)
+	switch {
+	case offreq:
+		offlineRequest(fn, outf, sa != nil, comment, ucomment, force)
+		return
+	case len(offresp) > 0:
+		offlineResponse(offresp, fn, outf, embed, rtime, rtfile, force)
+		return
 	}
 
-	sigo, err := sig.Serialize(fmt.Sprintf("input=%s", fn))
+	sks := make([]*sign.PrivateKey, 0, len(keys))
+	for _, kn := range keys {
+		prompt := "Enter passphrase for private key"
+		if len(keys) > 1 {
+			prompt = fmt.Sprintf("Enter passphrase for private key %s", kn)
+		}
+
+		sk, err := sign.ParseIdentity(kn, askpassFunc(nopw, envpw, prompt, false))
+		if err != nil {
+			audit("sign", nil, kn, fn, outf, err)
+			die("%s", err)
+		}
+		sks = append(sks, sk)
+	}
 
 	var fd io.Writer = os.Stdout
+	var outfd *os.File
 
 	if outf != "-" {
-		fdx, err := os.OpenFile(outf, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if ist, err := os.Stat(fn); err == nil {
+			if ost, err := os.Stat(outf); err == nil && os.SameFile(ist, ost) {
+				die("won't create output file: same as input file!")
+			}
+		}
+
+		confirmOverwrite(outf, force)
+		outfd, err = os.OpenFile(outf, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 		if err != nil {
 			die("can't create output file %s: %s", outf, err)
 		}
-		defer fdx.Close()
-		fd = fdx
+		defer outfd.Close()
+		fd = outfd
+	}
+
+	// don't leave a partial output behind
+	fail := func(f string, v ...interface{}) {
+		if outfd != nil {
+			outfd.Close()
+			os.Remove(outf)
+		}
+		die(f, v...)
+	}
+
+	if clear {
+		sigo, err := clearSign(sks[0], fn, sa, ucomment)
+		audit("sign", sks[0], keys[0], fn, outf, err)
+		if err != nil {
+			fail("%s", err)
+		}
+		if _, err = fd.Write(sigo); err != nil {
+			fail("can't write signature: %s", err)
+		}
+		return
+	}
+
+	// the input is read just once (it can be a pipe): its checksum is
+	// signed by every key and with --embed, it is copied to the output
+	// as it is read.
+	var ck []byte
+	if req == nil {
+		in, err := os.Open(fn)
+		if err != nil {
+			fail("%s", err)
+		}
+		defer in.Close()
+
+		var rd io.Reader = in
+		if embed {
+			rd = io.TeeReader(in, fd)
+		}
+
+		var n int64
+		if ck, n, err = sign.ReaderChecksumHash(rd, halgo); err != nil {
+			fail("can't read %s: %s", fn, err)
+		}
+
+		if sa != nil {
+			sa.Filename = path.Base(fn)
+			sa.Size = n
+		}
 	}
 
-	fd.Write(sigo)
+	sigs := make([]*sign.Signature, 0, len(sks))
+	for i, sk := range sks {
+		var sig *sign.Signature
+		switch {
+		case req != nil:
+			sig, err = sk.SignRequest(req)
+		case sa != nil:
+			sig, err = sk.SignMessageWithAttrs(ck, sa)
+		default:
+			sig, err = sk.SignMessage(ck, fn)
+		}
+		audit("sign", sk, keys[i], fn, outf, err)
+		if err != nil {
+			fail("%s", err)
+		}
+
+		sigs = append(sigs, sig)
+	}
+
+	if rtime {
+		if err = timestamp(sigs, rtfile); err != nil {
+			fail("%s", err)
+		}
+	}
+
+	if req != nil {
+		ucomment = req.Comment
+	}
+
+	var sigo []byte
+	if len(sigs) == 1 {
+		sigo, err = sigs[0].Serialize(ucomment)
+	} else {
+		sigo, err = sign.SerializeSignatures(sigs, ucomment)
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+
+	if embed {
+		err = sign.WriteEmbeddedSignature(fd, sigo)
+	} else {
+		_, err = fd.Write(sigo)
+	}
+	if err != nil {
+		fail("can't write signature: %s", err)
+	}
+}
+
+// clear sign the text file 'fn'
+func clearSign(sk *sign.PrivateKey, fn string, sa *sign.Attributes, ucomment string) ([]byte, error) {
+	txt, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if sa != nil {
+		a := *sa
+		a.Filename = path.Base(fn)
+		sa = &a
+	}
+	return sk.ClearSign(txt, sa, ucomment)
 }
 
 // Verify signature on a given file
 func verify(args []string) {
-	var help, quiet bool
+	var help, quiet, embedded, clear bool
+	var pubkeys, pins, rotations stringList
+	var threshold int
+	var extract string
+	var allowed, principal, ns, dbfile string
+	var policyfile, rtfile string
 
 	fs := flag.NewFlagSet("verify", flag.ExitOnError)
 	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
 	fs.BoolVarP(&quiet, "quiet", "q", false, "Don't show any output; exit with status code only")
+	fs.VarP(&pubkeys, "pubkey", "p", "Trust public key `P` (can be repeated)")
+	fs.IntVarP(&threshold, "threshold", "t", 1, "Require valid signatures from at least `N` trusted keys")
+	fs.BoolVarP(&embedded, "embedded", "e", false, "Verify a file with an embedded signature")
+	fs.BoolVarP(&clear, "clearsigned", "c", false, "Verify a clear signed text file")
+	fs.StringVarP(&extract, "extract", "x", "", "Write the original content of a verified embedded or clear signed file to `F`")
+	fs.StringVarP(&allowed, "allowed-signers", "A", "", "Trust the keys in the OpenSSH allowed_signers file `F`")
+	fs.StringVarP(&principal, "principal", "I", "", "Only trust allowed signers matching principal `P`")
+	fs.StringVarP(&ns, "namespace", "n", "file", "Only trust allowed signers for namespace `NS`")
+	fs.VarP(&pins, "pin", "P", "Trust the key with fingerprint `FP` (SHA256:...) (can be repeated)")
+	fs.VarP(&rotations, "rotation", "R", "Also trust the keys that trusted keys were rotated to by statement `F` (can be repeated)")
+	fs.StringVarP(&dbfile, "trust-db", "D", trustDBPath(), "Use the trust database in file `F` when no key is given")
+	fs.StringVarP(&policyfile, "policy", "", "", "Verify with the signers and rules of the policy in file `F`")
+	fs.StringVarP(&rtfile, "roughtime-servers", "", roughtimePath(), "Verify Roughtime timestamps with the servers listed in file `F`")
 
 	fs.Parse(args)
 
 	if help {
 		fs.SetOutput(os.Stdout)
-		fmt.Printf(`%s verify|v [options] pubkey sig file
+		fmt.Printf(`%s verify|v [options] sig file
+%s verify|v [options] pubkey sig file
+%s verify|v [options] -p pubkey [-p pubkey ..] [-t N] sig file
+%s verify|v [options] -A allowed_signers [-I principal] sig file
+%s verify|v [options] --pin SHA256:... sig file
+%s verify|v [options] --policy policy.yml sig file
+%s verify|v [options] --embedded pubkey file
+%s verify|v [options] --clearsigned pubkey file
 
 Verify an Ed25519 signature in SIG of FILE using a public key PUBKEY.
+Without PUBKEY (or any of the options below that give trusted keys), the
+keys in the trust database (see 'trust') that are trusted for FILE are
+used.
+
+If several trusted public keys are given via '-p', verification succeeds
+only if at least N of them (default 1) have a valid signature in SIG.
+
+With '--embedded', FILE holds its own signature (see 'sign --embed'); the
+original content is written to F with '--extract F' only if it verifies.
+With '--clearsigned', FILE is a clear signed text (see 'sign --clearsign').
+
+With '--allowed-signers', the trusted keys are read from an OpenSSH
+allowed_signers file (as used by 'git verify-commit'); only the entries
+valid for namespace NS and, if given, principal P are trusted. SIG can
+also be an OpenSSH signature made by 'ssh-keygen -Y sign'.
+
+SIG can also be a signify signature (as used by OpenBSD) and PUBKEY a
+signify public key; with '--embedded', FILE is a signature made with
+'signify -e' and its message is verified. SIG can also be a Sigstore
+bundle made by 'attest'; FILE must be one of its subjects.
+
+With '--pin', the signer's public key is taken from the signature and is
+trusted only if its fingerprint is FP; no public key file is needed.
+
+With '--rotation F', the new key of the rotation statement F (see
+'rotate') is trusted if its old key is trusted or pinned. Statements can
+be chained by giving several of them.
+
+With '--policy F', the trusted keys and the rules their signatures must
+meet come from the policy file F: the signers that must sign, the number
+of signers, the allowed hash algorithms, the maximum age of a signature
+and the revoked keys. Signatures that break a rule don't count.
+
+Roughtime timestamps of the signatures are verified with the servers in
+~/.sigtool/roughtime.json (or $SIGTOOL_ROUGHTIME); a timestamp that
+doesn't verify (or that predates the signing time) fails the
+verification.
 
 Options:
-`, Z)
+`, Z, Z, Z, Z, Z, Z, Z, Z)
 		fs.PrintDefaults()
 		os.Exit(0)
 	}
 
+	if embedded && clear {
+		die("--embedded and --clearsigned are mutually exclusive")
+	}
+
+	if len(extract) > 0 {
+		if !clear {
+			embedded = true
+		}
+
+		// don't mix the status messages with the extracted content
+		if extract == "-" {
+			quiet = true
+		}
+	}
+
+	nargs := 2
+	if embedded || clear {
+		nargs = 1
+	}
+
+	var useDB bool
+	var pol *sign.VerifyPolicy
+
+	if len(policyfile) > 0 {
+		if len(pubkeys) > 0 || len(allowed) > 0 || len(pins) > 0 || len(rotations) > 0 || threshold != 1 {
+			die("--policy can't be used with -p, -A, --pin, --rotation or -t")
+		}
+
+		var err error
+		if pol, err = sign.ReadVerifyPolicy(policyfile); err != nil {
+			die("%s", err)
+		}
+	}
+
 	args = fs.Args()
-	if len(args) < 3 {
+	if len(pubkeys) == 0 && len(allowed) == 0 && len(pins) == 0 && pol == nil {
+		if len(args) == nargs {
+			useDB = true
+		} else if len(args) < nargs+1 {
+			die("Insufficient arguments to 'verify'. Try '%s verify -h' ..", Z)
+		} else {
+			pubkeys = append(pubkeys, args[0])
+			args = args[1:]
+		}
+	}
+
+	if len(args) < nargs {
 		die("Insufficient arguments to 'verify'. Try '%s verify -h' ..", Z)
 	}
 
-	pn := args[0]
-	sn := args[1]
-	fn := args[2]
+	var sn, fn string
+	var sigs []*sign.Signature
+	var ssig *sign.SSHSignature
+	var fsig *sign.SignifySignature
+	var asig *sign.Attestation
+	var ef *sign.EmbeddedFile
+	var cs *sign.ClearSigned
+	var err error
 
-	sig, err := sign.ReadSignature(sn)
-	if err != nil {
-		die("Can't read signature '%s': %s", sn, err)
+	switch {
+	case embedded && isSignifyFile(args[0]):
+		fn = args[0]
+		sn = fn
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			die("%s", err)
+		}
+		if fsig, err = sign.ParseSignifySignature(b); err != nil {
+			die("%s: %s", fn, err)
+		}
+		if fsig.Message == nil {
+			die("%s: signature has no embedded message", fn)
+		}
+	case embedded:
+		fn = args[0]
+		sn = fn
+		ef, err = sign.OpenEmbedded(fn)
+		if err != nil {
+			die("%s", err)
+		}
+		sigs = ef.Sigs
+	case clear:
+		fn = args[0]
+		sn = fn
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			die("%s", err)
+		}
+		cs, err = sign.ParseClearSigned(b)
+		if err != nil {
+			die("%s: %s", fn, err)
+		}
+		sigs = cs.Sigs
+	default:
+		sn = args[0]
+		fn = args[1]
+		b, err := ioutil.ReadFile(sn)
+		if err != nil {
+			die("Can't read signature '%s': %s", sn, err)
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN SSH SIGNATURE-----")) {
+			ssig, err = sign.ParseSSHSignature(b)
+		} else if sign.IsSignify(b) {
+			fsig, err = sign.ParseSignifySignature(b)
+		} else if sign.IsAttestation(b) {
+			asig, err = sign.ParseAttestation(b)
+		} else {
+			sigs, err = sign.MakeSignatures(b)
+		}
+		if err != nil {
+			die("Can't read signature '%s': %s", sn, err)
+		}
 	}
 
-	pk, err := sign.ReadPublicKey(pn)
-	if err != nil {
-		die("%s", err)
+	rots := make([]*sign.Rotation, 0, len(rotations))
+	for _, rn := range rotations {
+		r, err := sign.ReadRotation(rn)
+		if err != nil {
+			die("%s: %s", rn, err)
+		}
+		rots = append(rots, r)
 	}
 
-	if !sig.IsPKMatch(pk) {
-		die("Wrong public key '%s' for verifying '%s'", pn, sn)
+	pks := make([]*sign.PublicKey, 0, len(pubkeys))
+	for _, pn := range pubkeys {
+		pk, err := sign.ParseRecipient(pn)
+		if err != nil {
+			die("%s", err)
+		}
+		pks = append(pks, pk)
 	}
 
-	ok, err := pk.VerifyFile(fn, sig)
-	if err != nil {
+	if pol != nil {
+		if ssig != nil || fsig != nil || asig != nil {
+			die("--policy can't be used with OpenSSH, signify or Sigstore signatures")
+		}
+
+		pks = pol.TrustedKeys(sigs)
+		if len(pks) == 0 {
+			die("%s: no signature by a signer of policy %s", sn, policyfile)
+		}
+		pubkeys = append(pubkeys, policyfile)
+	}
+
+	if useDB {
+		if len(dbfile) == 0 {
+			die("can't find the home directory; use --trust-db")
+		}
+
+		db, err := sign.ReadTrustDB(dbfile)
+		if err != nil {
+			die("%s", err)
+		}
+
+		pks = db.TrustedKeys(fn)
+		if len(pks) == 0 {
+			die("%s: no signer is trusted for %s", dbfile, fn)
+		}
+		pubkeys = append(pubkeys, dbfile)
+	}
+
+	if len(rots) > 0 {
+		fps := make([]string, 0, len(pks))
+		for _, pk := range pks {
+			fps = append(fps, pk.Fingerprint())
+		}
+		pks = append(pks, sign.RotatedKeys(fps, rots)...)
+	}
+
+	if len(allowed) > 0 {
+		as, err := sign.ReadAllowedSigners(allowed)
+		if err != nil {
+			die("%s", err)
+		}
+
+		apk := sign.TrustedKeys(as, principal, ns, time.Now())
+		if len(apk) == 0 {
+			die("%s: no signer is allowed for principal '%s' in namespace '%s'", allowed, principal, ns)
+		}
+
+		pubkeys = append(pubkeys, allowed)
+		pks = append(pks, apk...)
+	}
+
+	if len(pins) > 0 {
+		ppk := sign.PinnedKeys(sigs, pins)
+		ppk = append(ppk, sign.RotatedKeys(pins, rots)...)
+		if ssig != nil {
+			for _, pin := range pins {
+				if ssig.PublicKey.MatchPin(pin) {
+					ppk = append(ppk, ssig.PublicKey)
+					break
+				}
+			}
+		}
+
+		if len(ppk) == 0 {
+			die("%s: no signature by a key with fingerprint %s", sn, strings.Join(pins, ", "))
+		}
+
+		pubkeys = append(pubkeys, pins...)
+		pks = append(pks, ppk...)
+	}
+
+	if threshold < 1 || threshold > len(pks) {
+		die("invalid threshold %d; must be between 1 and %d", threshold, len(pks))
+	}
+
+	// a signature file may hold signatures from several keys; make sure
+	// at least one of them is for a trusted key.
+	var match bool
+	for _, s := range sigs {
+		for _, pk := range pks {
+			if s.IsKeyMatch(pk) {
+				match = true
+			}
+		}
+	}
+
+	if ssig != nil {
+		for _, pk := range pks {
+			if bytes.Equal(pk.Pk, ssig.PublicKey.Pk) {
+				match = true
+				ssig.PublicKey = pk
+			}
+		}
+	}
+
+	// signify signatures and Sigstore bundles don't carry the signer's key
+	if fsig != nil || asig != nil {
+		match = true
+	}
+
+	if !match {
+		die("Wrong public key '%s' for verifying '%s'", strings.Join(pubkeys, ", "), sn)
+	}
+
+	var good []*sign.PublicKey
+	var res []*sign.VerifyResult
+	switch {
+	case ssig != nil:
+		good, err = verifySSHSig(ssig, fn, ns, threshold)
+	case fsig != nil:
+		good, err = verifySignifySig(fsig, fn, embedded, pks, threshold)
+	case asig != nil:
+		good, err = verifyAttestation(asig, fn, pks, threshold)
+	case embedded:
+		res, err = ef.VerifyResult(pks, threshold)
+	case clear:
+		res, err = cs.VerifyResult(pks, threshold)
+	default:
+		res, err = sign.VerifyFileResult(fn, sigs, pks, threshold)
+	}
+	if ssig == nil && fsig == nil && asig == nil {
+		good = sign.Signers(res)
+	}
+	if err != nil && err != sign.ErrTooFewSignatures {
 		die("%s", err)
 	}
 
+	// the policy decides which signatures count
+	var polerr error
+	if pol != nil {
+		if res, polerr = pol.Check(res); polerr != nil {
+			err = polerr
+		}
+		good = sign.Signers(res)
+		threshold = pol.Threshold
+	}
+
+	var stamps map[*sign.Signature]string
+	var rterr error
+	if err == nil {
+		if stamps, rterr = verifyTimestamps(res, rtfile); rterr != nil {
+			err = rterr
+		}
+	}
+
 	exit := 0
-	if !ok {
+	if err != nil {
 		exit = 1
 	}
 
 	if !quiet {
-		if ok {
+		if exit == 0 {
 			fmt.Printf("%s: Signature %s verified\n", fn, sn)
+			printResults(res, stamps)
 		} else {
 			fmt.Printf("%s: Signature %s verification failure\n", fn, sn)
+			if polerr != nil {
+				fmt.Printf("  %s\n", polerr)
+			}
+			if rterr != nil {
+				fmt.Printf("  %s\n", rterr)
+			}
+		}
+
+		if len(pks) > 1 || len(allowed) > 0 || len(pins) > 0 || useDB || pol != nil {
+			for _, pk := range good {
+				fmt.Printf("  signed by %s %s\n", pk.Fingerprint(), pk.Comment)
+			}
+			fmt.Printf("  %d of %d trusted keys signed; %d required\n", len(good), len(pks), threshold)
+		}
+	}
+
+	if exit == 0 && len(extract) > 0 {
+		switch {
+		case clear:
+			extractContent(extract, func(wr io.Writer) error {
+				_, err := wr.Write(cs.Text)
+				return err
+			})
+		case fsig != nil:
+			extractContent(extract, func(wr io.Writer) error {
+				_, err := wr.Write(fsig.Message)
+				return err
+			})
+		default:
+			extractContent(extract, ef.Extract)
 		}
 	}
 
 	os.Exit(exit)
 }
 
+// verify the OpenSSH signature 'sig' of file 'fn'; the signer is already
+// known to be trusted.
+func verifySSHSig(sig *sign.SSHSignature, fn, ns string, threshold int) ([]*sign.PublicKey, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if err = sig.Verify(fd, ns); err != nil {
+		return nil, sign.ErrTooFewSignatures
+	}
+
+	good := []*sign.PublicKey{sig.PublicKey}
+	if threshold > 1 {
+		return good, sign.ErrTooFewSignatures
+	}
+	return good, nil
+}
+
+// verify the signify signature 'sig' of file 'fn' (or of its embedded
+// message) with the trusted keys 'pks'
+func verifySignifySig(sig *sign.SignifySignature, fn string, embedded bool, pks []*sign.PublicKey, threshold int) ([]*sign.PublicKey, error) {
+	msg := sig.Message
+	if !embedded {
+		var err error
+		if msg, err = ioutil.ReadFile(fn); err != nil {
+			return nil, err
+		}
+	}
+
+	pk, err := sig.Verify(msg, pks)
+	if err != nil {
+		return nil, sign.ErrTooFewSignatures
+	}
+
+	good := []*sign.PublicKey{pk}
+	if threshold > 1 {
+		return good, sign.ErrTooFewSignatures
+	}
+	return good, nil
+}
+
+// verify the attestation 'a' of file 'fn' with the trusted keys 'pks'
+func verifyAttestation(a *sign.Attestation, fn string, pks []*sign.PublicKey, threshold int) ([]*sign.PublicKey, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if err = a.CheckSubject(fd); err != nil {
+		return nil, err
+	}
+
+	pk, err := a.Verify(pks)
+	if err != nil {
+		return nil, sign.ErrTooFewSignatures
+	}
+
+	good := []*sign.PublicKey{pk}
+	if threshold > 1 {
+		return good, sign.ErrTooFewSignatures
+	}
+	return good, nil
+}
+
+// true if the file 'fn' starts like a signify signature
+func isSignifyFile(fn string) bool {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	var b [64]byte
+	n, _ := io.ReadFull(fd, b[:])
+	return sign.IsSignify(b[:n])
+}
+
+// write the original content of a verified file to 'outf'
+func extractContent(outf string, extract func(wr io.Writer) error) {
+	if outf == "-" {
+		if err := extract(os.Stdout); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", outf)
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		die("can't create output file %s: %s", tmp, err)
+	}
+
+	err = extract(fd)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err == nil {
+		err = os.Rename(tmp, outf)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		die("%s", err)
+	}
+}
+
 func usage(c int) {
 	x := fmt.Sprintf(`%s is a tool to generate, sign and verify files with Ed25519 signatures.
 
@@ -308,7 +1212,22 @@ Usage: %s [global-options] command [options] arg [args..]
 
 Global options:
   -h, --help       Show help and exit
-  -v, --version    Show version info and exit.
+  --version        Show version info and exit (also a bare -v)
+  -v, --verbose    Log headers, recipient matching, chunk counts and
+                   loaded keys to stderr; -vv logs more detail
+  --log-format=F   Log the -v diagnostics as text (key=value, default)
+                   or json
+  --audit-log=F    Append audit records of private key use to F
+                   ("syslog" logs to syslog; default $SIGTOOL_AUDIT_LOG)
+  --expired-keys=P Use of expired public keys for verify and encrypt:
+                   fail (default), warn or ignore
+  --fips           Only use FIPS approved algorithms; needs a FIPS
+                   build or GODEBUG=fips140=on (default $SIGTOOL_FIPS)
+  --insecure-key-perms
+                   Use private key files that the group or others can
+                   access; they are refused by default (as by OpenSSH)
+  --selftest       Run the known answer tests before the command
+                   (default if $SIGTOOL_SELFTEST is set)
 
 Commands:
   generate, g      Generate a new Ed25519 keypair
@@ -316,12 +1235,146 @@ Commands:
   verify, v        Verify a signature against a file and a public key
   encrypt, e       Encrypt an input file to one or more recipients
   decrypt, d       Decrypt a file with a private key
+  inspect, i       Show the metadata of encrypted files and signatures
+  archive, a       Create, list and extract encrypted archives of files
+  rotate, r        Make a statement that a new key replaces an old key
+  keyring, k       Export and import signed bundles of public keys
+  trust, t         Add, remove and list trusted signers for verify
+  serve            Sign, verify and encrypt for clients over HTTP
+  agent            Hold unlocked private keys for a session
+  export           Convert a keypair to a single PEM key file
+  import           Convert a PEM key file to a keypair
+  key              Show a public key as a QR code or compare two keys
+  fingerprint      Show key fingerprints as hex, words and randomart
+  rewrap           Move encrypted files to a new recipient key
+  git-sign         Sign and verify git commits (gpg.ssh.program helper)
+  sum              Make and check signed checksum manifests of files
+  attest           Sign in-toto attestations of files (Sigstore bundles)
+  watch            Encrypt the files dropped into a directory
+  mount            Mount an encrypted file or archive read-only (FUSE)
+  selftest         Run the built-in known answer tests
+  version          Show version info and the FIPS mode
 `, Z, Z)
 
 	os.Stdout.Write([]byte(x))
 	os.Exit(c)
 }
 
+// Show the version info and crypto mode
+func version(_ []string) {
+	fmt.Printf("%s - %s [%s; %s]\n", Z, ProductVersion, RepoVersion, Buildtime)
+
+	switch m := sign.FIPSModule(); {
+	case sign.FIPSMode():
+		fmt.Printf("FIPS mode: on (%s)\n", m)
+	case len(m) > 0:
+		fmt.Printf("FIPS mode: off (%s available)\n", m)
+	default:
+		fmt.Printf("FIPS mode: off\n")
+	}
+	os.Exit(0)
+}
+
+// print the signed attributes and warnings of the verified signatures
+func printResults(res []*sign.VerifyResult, notes map[*sign.Signature]string) {
+	for _, r := range res {
+		sig := r.Signature
+		if sub := r.Subkey; sub != nil {
+			fmt.Printf("  signed by subkey %s (%s) of %s\n", sub.Subkey().Name, sub.Fingerprint(), r.Fingerprint)
+		}
+		if a := r.Attrs; a != nil {
+			fmt.Printf("  signed by %x at %s\n", r.Signer.Hash(), a.Time.Local().Format(time.RFC1123))
+			fmt.Printf("    file %s, %d bytes, %s\n", a.Filename, a.Size, a.HashAlgo)
+			if len(a.Comment) > 0 {
+				fmt.Printf("    trusted comment: %s\n", a.Comment)
+			}
+			if len(sig.Comment) > 0 {
+				fmt.Printf("    untrusted comment: %s\n", sig.Comment)
+			}
+		}
+
+		for _, w := range r.Warnings {
+			fmt.Printf("  warning: %x: %s\n", r.Signer.Hash(), w)
+		}
+		if n, ok := notes[sig]; ok {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+}
+
+// ttyPrompter is the sign.PassphrasePrompter of the command: the
+// passphrase is empty (nopw), read from the environment variable 'envpw'
+// or asked on the terminal.
+type ttyPrompter struct {
+	nopw   bool
+	envpw  string
+	prompt string
+}
+
+func (t *ttyPrompter) Passphrase(key string, confirm bool) ([]byte, error) {
+	if t.nopw {
+		return nil, nil
+	}
+
+	if len(t.envpw) > 0 {
+		return []byte(os.Getenv(t.envpw)), nil
+	}
+
+	prompt := t.prompt
+	if len(prompt) == 0 {
+		prompt = fmt.Sprintf("Enter passphrase for %s", key)
+	}
+
+	pws, err := utils.Askpass(prompt, confirm)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(pws), nil
+}
+
+// askpassFunc returns a function that gets the passphrase for a private key:
+// either from the environment variable 'envpw' or interactively.
+func askpassFunc(nopw bool, envpw, prompt string, verify bool) func() ([]byte, error) {
+	p := &ttyPrompter{nopw: nopw, envpw: envpw, prompt: prompt}
+	return func() ([]byte, error) {
+		return p.Passphrase("private key", verify)
+	}
+}
+
+// checkpwFunc is askpassFunc() for the passphrase of new keys: one with
+// less than 'minbits' of estimated entropy is refused and a weak one is
+// warned about.
+func checkpwFunc(nopw bool, envpw, prompt string, minbits int) func() ([]byte, error) {
+	getpw := askpassFunc(nopw, envpw, prompt, true)
+	return func() ([]byte, error) {
+		pw, err := getpw()
+		if err != nil || nopw {
+			return pw, err
+		}
+
+		bits := sign.PassphraseEntropy(pw)
+		if bits < float64(minbits) {
+			return nil, fmt.Errorf("passphrase too weak: ~%.0f bits of entropy (need %d)", bits, minbits)
+		}
+		if bits < sign.WeakPassphraseBits {
+			warn("warning: weak passphrase (~%.0f bits of entropy); use a longer one", bits)
+		}
+		return pw, nil
+	}
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 // Return true if $bn.key or $bn.pub exist; false otherwise
 func exists(bn string) bool {
 	pk := bn + ".pub"
@@ -0,0 +1,25 @@
+// sock_other.go -- unix sockets on platforms without a umask
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows || plan9 || js || wasip1
+// +build windows plan9 js wasip1
+
+package main
+
+import (
+	"net"
+)
+
+func listenUnix(fn string) (net.Listener, error) {
+	return net.Listen("unix", fn)
+}
@@ -0,0 +1,31 @@
+// sock_unix.go -- unix sockets only their owner can use
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !windows && !plan9 && !js && !wasip1
+// +build !windows,!plan9,!js,!wasip1
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listen on the unix socket 'fn'; it is created with mode 0600, so it is
+// never open to others.
+func listenUnix(fn string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", fn)
+}
@@ -0,0 +1,267 @@
+// sum.go -- signed checksum manifests of files
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// Run the 'sum' command
+func sum(args []string) {
+	var help, nopw, force, check, quiet, missing bool
+	var keyfile, envpw, outfile, algo, dbfile string
+	var pubkeys, pins stringList
+	var threshold int
+
+	fs := flag.NewFlagSet("sum", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&keyfile, "sign", "s", "", "Sign the manifest with private key `K`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.StringVarP(&algo, "algo", "a", sign.SumSHA256, "Use hash algorithm `A`: sha256 or blake3")
+	fs.StringVarP(&outfile, "outfile", "o", "-", "Write the manifest to file `F`")
+	fs.BoolVarP(&force, "force", "F", false, "Overwrite the output file without asking")
+	fs.BoolVarP(&check, "check", "c", false, "Verify the signature of a manifest and the checksums of its files")
+	fs.VarP(&pubkeys, "pubkey", "p", "Trust public key `P` (can be repeated)")
+	fs.VarP(&pins, "pin", "P", "Trust the key with fingerprint `FP` (SHA256:...) (can be repeated)")
+	fs.IntVarP(&threshold, "threshold", "t", 1, "Require valid signatures from at least `N` trusted keys")
+	fs.StringVarP(&dbfile, "trust-db", "D", trustDBPath(), "Use the trust database in file `F` when no key is given")
+	fs.BoolVarP(&missing, "ignore-missing", "", false, "Don't fail or report missing files")
+	fs.BoolVarP(&quiet, "quiet", "q", false, "Don't print OK for each verified file")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s sum: Make and check signed checksum manifests.
+
+Usage: %s sum -s key [options] file [file...]
+       %s sum --check [options] [pubkey] manifest
+
+Write the checksums of the files in the layout of sha256sum (or b3sum
+with '--algo blake3') and sign the manifest with KEY. The manifest is a
+clear signed text (see 'sign --clearsign'); 'sha256sum -c' can still
+check the files of a SHA256 manifest.
+
+With --check, verify the signature of MANIFEST and then the checksum of
+each file in it; the names are relative to the current directory. The
+trusted keys are given as for 'verify': PUBKEY, -p, --pin or the trust
+database. It fails if the signature doesn't verify or if any file is
+missing or doesn't match. MANIFEST can also be a list of checksums signed
+with 'signify -e' (such as OpenBSD's SHA256.sig) and PUBKEY a signify
+public key.
+
+Options:
+`, Z, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if check {
+		if len(keyfile) > 0 {
+			die("--check can't be used with --sign")
+		}
+		sumCheck(args, pubkeys, pins, threshold, dbfile, missing, quiet)
+		return
+	}
+
+	if len(keyfile) == 0 {
+		die("sum needs a private key to sign the manifest (--sign)")
+	}
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s sum --help'", Z)
+	}
+
+	m, err := sign.NewSumManifest(strings.ToLower(algo))
+	if err != nil {
+		die("%s", err)
+	}
+
+	for _, fn := range args {
+		if outfile != "-" && samePath(fn, outfile) {
+			die("won't write the manifest over %s", fn)
+		}
+
+		fd, err := os.Open(fn)
+		if err != nil {
+			die("%s", err)
+		}
+		err = m.Add(fn, fd)
+		fd.Close()
+		if err != nil {
+			die("%s", err)
+		}
+	}
+
+	sk, err := sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+	if err != nil {
+		audit("sign", nil, keyfile, "", outfile, err)
+		die("%s", err)
+	}
+
+	b, err := sk.ClearSign(m.Bytes(), nil, fmt.Sprintf("sum=%s", m.Algo))
+	audit("sign", sk, keyfile, "", outfile, err)
+	if err != nil {
+		die("%s", err)
+	}
+
+	writeOutput(outfile, force, func(wr io.Writer) error {
+		_, err := wr.Write(b)
+		return err
+	})
+}
+
+// verify a signed manifest and the files in it
+func sumCheck(args []string, pubkeys, pins []string, threshold int, dbfile string, missing, quiet bool) {
+	if len(pubkeys) == 0 && len(pins) == 0 && len(args) > 1 {
+		pubkeys = append(pubkeys, args[0])
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		die("Insufficient args. Try '%s sum --help'", Z)
+	}
+
+	fn := args[0]
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	// OpenBSD's SHA256.sig is a manifest signed with 'signify -e'
+	var cs *sign.ClearSigned
+	var fsig *sign.SignifySignature
+	if sign.IsSignify(b) {
+		if len(pins) > 0 {
+			die("--pin can't be used with signify signatures")
+		}
+		fsig, err = sign.ParseSignifySignature(b)
+	} else {
+		cs, err = sign.ParseClearSigned(b)
+	}
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	var pks []*sign.PublicKey
+	for _, pn := range pubkeys {
+		pk, err := sign.ParseRecipient(pn)
+		if err != nil {
+			die("%s", err)
+		}
+		pks = append(pks, pk)
+	}
+
+	if len(pins) > 0 {
+		ppk := sign.PinnedKeys(cs.Sigs, pins)
+		if len(ppk) == 0 {
+			die("%s: no signature by a key with fingerprint %s", fn, strings.Join(pins, ", "))
+		}
+		pks = append(pks, ppk...)
+	}
+
+	if len(pks) == 0 {
+		if len(dbfile) == 0 {
+			die("can't find the home directory; use --trust-db")
+		}
+
+		db, err := sign.ReadTrustDB(dbfile)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if pks = db.TrustedKeys(fn); len(pks) == 0 {
+			die("%s: no signer is trusted for %s", dbfile, fn)
+		}
+	}
+
+	if threshold < 1 || threshold > len(pks) {
+		die("invalid threshold %d; must be between 1 and %d", threshold, len(pks))
+	}
+
+	var text []byte
+	if fsig != nil {
+		if threshold > 1 {
+			die("signify signatures have a single signer; can't use a threshold of %d", threshold)
+		}
+		_, err = fsig.Verify(fsig.Message, pks)
+		text = fsig.Message
+	} else {
+		_, err = cs.Verify(pks, threshold)
+		text = cs.Text
+	}
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	m, err := sign.ParseSumManifest(text)
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	var nbad, nmissing int
+	for i := range m.Files {
+		f := &m.Files[i]
+
+		fd, err := os.Open(f.Name)
+		if err != nil {
+			if os.IsNotExist(err) && missing {
+				continue
+			}
+			fmt.Printf("%s: FAILED open or read\n", f.Name)
+			nmissing++
+			continue
+		}
+
+		err = m.Check(f, fd)
+		fd.Close()
+		switch {
+		case err == sign.ErrSumMismatch:
+			fmt.Printf("%s: FAILED\n", f.Name)
+			nbad++
+		case err != nil:
+			fmt.Printf("%s: FAILED open or read\n", f.Name)
+			nmissing++
+		case !quiet:
+			fmt.Printf("%s: OK\n", f.Name)
+		}
+	}
+
+	if nmissing > 0 {
+		warn("%d listed file%s could not be read", nmissing, plural(nmissing))
+	}
+	if nbad > 0 {
+		warn("%d computed checksum%s did NOT match", nbad, plural(nbad))
+	}
+	if nbad > 0 || nmissing > 0 {
+		os.Exit(1)
+	}
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
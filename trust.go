@@ -0,0 +1,164 @@
+// trust.go -- manage the database of trusted signers
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// default trust database: $SIGTOOL_TRUST_DB or ~/.sigtool/trust.yml
+func trustDBPath() string {
+	if fn := os.Getenv("SIGTOOL_TRUST_DB"); len(fn) > 0 {
+		return fn
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sigtool", "trust.yml")
+}
+
+// sigtool trust add|remove|list ...
+func trust(args []string) {
+	if len(args) < 1 {
+		die("Insufficient args. Try '%s trust --help'", os.Args[0])
+	}
+
+	var run func(db *sign.TrustDB, args, scopes []string) bool
+
+	switch args[0] {
+	case "add", "a":
+		run = trustAdd
+	case "remove", "rm", "r":
+		run = trustRemove
+	case "list", "l":
+		run = trustList
+	case "-h", "--help", "help":
+		trustUsage()
+		os.Exit(0)
+	default:
+		die("unknown trust command %s. Try '%s trust --help'", args[0], os.Args[0])
+	}
+
+	var help bool
+	var dbfile string
+	var scopes stringList
+
+	fs := flag.NewFlagSet("trust "+args[0], flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.StringVarP(&dbfile, "trust-db", "D", trustDBPath(), "Use the trust database in file `F`")
+	fs.VarP(&scopes, "scope", "s", "Trust the key only for files matching `PAT` (can be repeated)")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		trustUsage()
+		fmt.Printf("\nOptions:\n")
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if len(dbfile) == 0 {
+		die("trust: can't find the home directory; use --trust-db")
+	}
+
+	db, err := sign.ReadTrustDB(dbfile)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if !run(db, fs.Args(), scopes) {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dbfile), 0700); err != nil {
+		die("%s", err)
+	}
+	if err = db.SerializeFile(dbfile); err != nil {
+		die("%s", err)
+	}
+}
+
+func trustUsage() {
+	fmt.Printf(`%s trust: Manage the database of trusted signers.
+
+Usage: %s trust add [options] name pubkey
+       %s trust remove [options] name|FP
+       %s trust list [options]
+
+'add' trusts the key PUBKEY (any key accepted by 'verify') under the
+unique NAME; with '--scope PAT' the key is only trusted for files whose
+path (or a trailing part of it) matches the pattern PAT, e.g.,
+'releases/*'. 'remove' deletes the signer with the name or key
+fingerprint FP.
+
+'verify' uses the keys in the database that are trusted for the signed
+file when no public key is given. The database is the file
+$SIGTOOL_TRUST_DB or ~/.sigtool/trust.yml unless '--trust-db' is used.
+`, Z, Z, Z, Z)
+}
+
+func trustAdd(db *sign.TrustDB, args, scopes []string) bool {
+	if len(args) < 2 {
+		die("Insufficient args. Try '%s trust --help'", os.Args[0])
+	}
+
+	pk, err := sign.ParseRecipient(args[1])
+	if err != nil {
+		die("%s", err)
+	}
+
+	if err = db.Add(args[0], pk, scopes); err != nil {
+		die("%s", err)
+	}
+	return true
+}
+
+func trustRemove(db *sign.TrustDB, args, scopes []string) bool {
+	if len(args) < 1 || len(scopes) > 0 {
+		die("Usage: %s trust remove [options] name|FP", Z)
+	}
+
+	if err := db.Remove(args[0]); err != nil {
+		die("%s", err)
+	}
+	return true
+}
+
+func trustList(db *sign.TrustDB, _, _ []string) bool {
+	for _, t := range db.Signers {
+		scope := "*"
+		if len(t.Scopes) > 0 {
+			scope = strings.Join(t.Scopes, ",")
+		}
+
+		added := ""
+		if !t.Added.IsZero() {
+			added = t.Added.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%-16s %s %s %s\n", t.Name, t.Key.Fingerprint(), scope, added)
+	}
+	return false
+}
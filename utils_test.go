@@ -0,0 +1,50 @@
+// utils_test.go -- Test harness utilities for sigtool
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
+
+// make a temporary directory that is removed when the test ends
+func tempdir(t *testing.T) string {
+	dn, err := ioutil.TempDir("", "sigtool-test-")
+	if err != nil {
+		t.Fatalf("can't make a temporary directory: %s", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dn) })
+	return dn
+}
@@ -0,0 +1,82 @@
+// verbose.go -- diagnostics on stderr (-v, -vv)
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+// verbosity counts the -v flags; --verbose=N sets it
+type verbosity int
+
+func (v *verbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosity) Set(s string) error {
+	if s == "true" {
+		*v++
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid verbosity %q", s)
+	}
+	*v = verbosity(n)
+	return nil
+}
+
+// a bare -v doesn't take an argument
+func (v *verbosity) IsBoolFlag() bool {
+	return true
+}
+
+// set the logger of the sign package: -v logs the summaries (headers,
+// recipient matching, chunk counts, loaded keys) and -vv the details;
+// 'warn' logs only warnings (e.g., use of expired keys).
+func setLogger(v verbosity, format string, warn bool) error {
+	var level slog.Level
+
+	switch {
+	case v >= 2:
+		level = slog.LevelDebug
+	case v == 1:
+		level = slog.LevelInfo
+	case warn:
+		level = slog.LevelWarn
+	default:
+		return nil
+	}
+
+	opt := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opt)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opt)
+	default:
+		return fmt.Errorf("unknown log format %q; use text or json", format)
+	}
+
+	sign.SetLogger(slog.New(h))
+	return nil
+}
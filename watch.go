@@ -0,0 +1,364 @@
+// watch.go -- encrypt the files dropped into a directory
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"github.com/opencoff/sigtool/sign"
+)
+
+// a dirWatcher sends the names of the files of a directory that were
+// closed after writing or moved into it; an empty name asks for a rescan
+// of the directory.
+type dirWatcher interface {
+	Files() <-chan string
+	Close() error
+}
+
+// the state of the 'watch' command
+type dropBox struct {
+	in, out, quarantine, keep string
+
+	sk      *sign.PrivateKey
+	keyfile string
+	pks     []*sign.PublicKey
+
+	retries int
+	delay   time.Duration
+	settle  time.Duration
+
+	// number of quarantined files
+	failed int
+}
+
+// Run the 'watch' command
+func watch(args []string) {
+	var help, nopw, once, repin bool
+	var keyfile, envpw, outdir, qdir, keepdir, knownfile string
+	var to stringList
+	var retries int
+	var delay, settle, poll time.Duration
+
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help and exit")
+	fs.VarP(&to, "to", "t", "Encrypt to recipient `R` (can be repeated)")
+	fs.StringVarP(&outdir, "out", "o", "", "Write the encrypted files to directory `D`")
+	fs.StringVarP(&keyfile, "sign", "s", "", "Sign using private key `S`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for passphrase to decrypt the private key")
+	fs.StringVarP(&envpw, "env-password", "", "", "Use passphrase from environment variable `E`")
+	fs.StringVarP(&qdir, "quarantine", "Q", "", "Move the files that can't be encrypted to directory `D` [INDIR/.quarantine]")
+	fs.StringVarP(&keepdir, "keep", "k", "", "Move the encrypted input files to directory `D` instead of removing them")
+	fs.IntVarP(&retries, "retries", "r", 3, "Try to encrypt a file `N` times before quarantining it")
+	fs.DurationVarP(&delay, "retry-delay", "", 5*time.Second, "Wait `T` before the first retry; doubled for each later one")
+	fs.DurationVarP(&settle, "settle", "", 2*time.Second, "Files found at startup must be unchanged for `T`")
+	fs.DurationVarP(&poll, "poll", "", 2*time.Second, "Scan the directory every `T` where it can't be watched")
+	fs.BoolVarP(&once, "once", "", false, "Encrypt the files already in the directory and exit")
+	fs.StringVarP(&knownfile, "known-recipients", "K", knownRecipientsPath(), "Pin the keys of named recipients in file `F` (empty to disable)")
+	fs.BoolVarP(&repin, "repin", "", false, "Replace the pinned keys of recipients whose key has changed")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if help {
+		fs.SetOutput(os.Stdout)
+		fmt.Printf(`%s watch: Encrypt the files dropped into a directory.
+
+Usage: %s watch --to R [--to R..] [options] indir --out outdir
+
+Watch INDIR and encrypt each file to the recipients R as soon as it is
+closed after writing (or moved into INDIR). The encrypted file is written
+to OUTDIR/NAME.enc and then the input file is removed (or moved to the
+directory given by --keep). Files whose name starts with a dot are
+ignored.
+
+A file that can't be encrypted is tried again after a delay; once all
+the retries fail, it is moved to the quarantine directory along with a
+NAME.error file that says why.
+
+On Linux the directory is watched with inotify; elsewhere it is scanned
+every --poll interval and a file is encrypted once it stops changing.
+The files already in INDIR are encrypted at startup; with --once, watch
+exits after that (with status 1 if any file was quarantined).
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	args = fs.Args()
+	if len(args) != 1 {
+		die("Insufficient args. Try '%s watch --help'", Z)
+	}
+	if len(to) == 0 {
+		die("watch needs at least one recipient (--to)")
+	}
+	if len(outdir) == 0 {
+		die("watch needs an output directory (--out)")
+	}
+	if retries < 1 {
+		die("invalid retries %d; must be at least 1", retries)
+	}
+
+	d := &dropBox{
+		in:         args[0],
+		out:        outdir,
+		quarantine: qdir,
+		keep:       keepdir,
+		keyfile:    keyfile,
+		retries:    retries,
+		delay:      delay,
+		settle:     settle,
+	}
+	if len(d.quarantine) == 0 {
+		d.quarantine = filepath.Join(d.in, ".quarantine")
+	}
+
+	for _, dn := range []string{d.in, d.out, d.quarantine, d.keep} {
+		if len(dn) == 0 {
+			continue
+		}
+		if err := os.MkdirAll(dn, 0700); err != nil {
+			die("%s", err)
+		}
+	}
+	if samePath(d.in, d.out) || samePath(d.in, d.keep) {
+		die("the output directories must differ from %s", d.in)
+	}
+
+	if len(keyfile) > 0 {
+		d.sk, err = sign.ParseIdentity(keyfile, askpassFunc(nopw, envpw, "Enter passphrase for private key", false))
+		if err != nil {
+			audit("encrypt", nil, keyfile, d.in, d.out, err)
+			die("%s", err)
+		}
+	}
+
+	known := openKnownRecipients(knownfile, repin)
+	for _, r := range to {
+		pk, err := sign.ParseRecipient(r)
+		if err != nil && isSSHUser(r) {
+			pk, err = dnsRecipient(r, known)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+		if err = known.check(r, pk); err != nil {
+			die("%s", err)
+		}
+		d.pks = append(d.pks, pk)
+	}
+	known.save()
+
+	// catch a bad policy or recipient now rather than on the first file
+	if _, err = d.encryptor(0); err != nil {
+		die("%s", err)
+	}
+
+	var w dirWatcher
+	if !once {
+		if w, err = newDirWatcher(d.in, poll); err != nil {
+			die("%s", err)
+		}
+		defer w.Close()
+	}
+
+	d.scan(true)
+	if once {
+		if d.failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	warn("watching %s; encrypting to %s", d.in, d.out)
+	for {
+		select {
+		case fn, ok := <-w.Files():
+			if !ok {
+				die("%s: watch ended", d.in)
+			}
+			if len(fn) == 0 {
+				d.scan(false)
+			} else {
+				d.process(fn)
+			}
+
+		case <-sigs:
+			return
+		}
+	}
+}
+
+// encrypt the files in the input directory; at startup they may still be
+// written to and are only taken once they are unchanged for a while.
+func (d *dropBox) scan(startup bool) {
+	fis, err := ioutil.ReadDir(d.in)
+	if err != nil {
+		warn("%s", err)
+		return
+	}
+
+	var files []os.FileInfo
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+			files = append(files, fi)
+		}
+	}
+
+	if startup && len(files) > 0 {
+		time.Sleep(d.settle)
+	}
+
+	for _, fi := range files {
+		if startup {
+			st, err := os.Stat(filepath.Join(d.in, fi.Name()))
+			if err != nil || st.Size() != fi.Size() || !st.ModTime().Equal(fi.ModTime()) {
+				continue
+			}
+		}
+		d.process(fi.Name())
+	}
+}
+
+// encrypt the file 'nm' of the input directory with retries; a file
+// that fails every try is quarantined.
+func (d *dropBox) process(nm string) {
+	if strings.HasPrefix(nm, ".") || strings.ContainsRune(nm, os.PathSeparator) {
+		return
+	}
+
+	fn := filepath.Join(d.in, nm)
+	delay := d.delay
+
+	var err error
+	for i := 0; i < d.retries; i++ {
+		if i > 0 {
+			warn("%s: %s; retrying in %s", fn, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		st, serr := os.Lstat(fn)
+		if serr != nil || !st.Mode().IsRegular() {
+			// gone or not ours to encrypt
+			return
+		}
+
+		if err = d.encrypt(nm, st.Size()); err == nil {
+			return
+		}
+	}
+
+	warn("%s: %s; moving it to %s", fn, err, d.quarantine)
+	d.quarantineFile(nm, err)
+	d.failed++
+}
+
+// encrypt 'nm' to the output directory and then remove (or keep) it
+func (d *dropBox) encrypt(nm string, size int64) error {
+	fn := filepath.Join(d.in, nm)
+	outf := filepath.Join(d.out, nm+encSuffix)
+	tmp := filepath.Join(d.out, "."+nm+encSuffix+".tmp")
+
+	in, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	en, err := d.encryptor(size)
+	if err != nil {
+		return err
+	}
+
+	wfd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("can't create output file %s: %s", tmp, err)
+	}
+
+	err = en.Encrypt(in, sign.NopWriteCloser(wfd))
+	if err == nil {
+		err = wfd.Sync()
+	}
+	wfd.Close()
+	if err == nil {
+		err = os.Rename(tmp, outf)
+	}
+	if d.sk != nil {
+		audit("encrypt", d.sk, d.keyfile, fn, outf, err)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if len(d.keep) > 0 {
+		err = os.Rename(fn, filepath.Join(d.keep, nm))
+	} else {
+		err = os.Remove(fn)
+	}
+	if err != nil {
+		// the file is encrypted; don't encrypt it again
+		warn("%s: %s", fn, err)
+	}
+	return nil
+}
+
+// make a new Encryptor for a file of 'size' bytes
+func (d *dropBox) encryptor(size int64) (*sign.Encryptor, error) {
+	en, err := sign.NewEncryptor(d.sk, sign.AutoChunkSize(size))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pk := range d.pks {
+		if err = en.AddRecipient(pk); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = applyPolicy(en); err != nil {
+		return nil, err
+	}
+	return en, nil
+}
+
+// move 'nm' to the quarantine directory with a note of the error
+func (d *dropBox) quarantineFile(nm string, qerr error) {
+	qf := filepath.Join(d.quarantine, nm)
+	if err := os.Rename(filepath.Join(d.in, nm), qf); err != nil {
+		warn("%s", err)
+		return
+	}
+
+	note := fmt.Sprintf("%s: %s\n", time.Now().UTC().Format(time.RFC3339), qerr)
+	if err := ioutil.WriteFile(qf+".error", []byte(note), 0600); err != nil {
+		warn("%s", err)
+	}
+}
@@ -0,0 +1,99 @@
+// watch_linux.go -- watch a directory with inotify
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+type inotifyWatcher struct {
+	fd    *os.File
+	files chan string
+}
+
+// watch 'dir' for files closed after writing or moved into it; 'poll' is
+// unused as inotify needs no polling.
+func newDirWatcher(dir string, poll time.Duration) (dirWatcher, error) {
+	ifd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %s", err)
+	}
+
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF)
+	if _, err = syscall.InotifyAddWatch(ifd, dir, mask); err != nil {
+		syscall.Close(ifd)
+		return nil, fmt.Errorf("inotify: %s: %s", dir, err)
+	}
+
+	// a non-blocking fd is read through the runtime poller; closing it
+	// ends a pending read.
+	w := &inotifyWatcher{
+		fd:    os.NewFile(uintptr(ifd), "inotify"),
+		files: make(chan string, 64),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Files() <-chan string {
+	return w.files
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.fd.Close()
+}
+
+// read the events until the watch ends
+func (w *inotifyWatcher) run() {
+	defer close(w.files)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.fd.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for b := buf[:n]; len(b) >= syscall.SizeofInotifyEvent; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&b[0]))
+			end := syscall.SizeofInotifyEvent + int(ev.Len)
+			if end > len(b) {
+				break
+			}
+
+			name := b[syscall.SizeofInotifyEvent:end]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			b = b[end:]
+
+			switch {
+			case ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_IGNORED) != 0:
+				return
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				w.files <- ""
+			case ev.Mask&syscall.IN_ISDIR == 0 && len(name) > 0:
+				w.files <- string(name)
+			}
+		}
+	}
+}
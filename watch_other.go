@@ -0,0 +1,107 @@
+// watch_other.go -- watch a directory by scanning it
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type pollWatcher struct {
+	dir   string
+	files chan string
+	done  chan struct{}
+}
+
+// the last seen state of a file
+type pollFile struct {
+	size int64
+	mod  time.Time
+	sent bool
+}
+
+// watch 'dir' by scanning it every 'poll'; a file is sent once it is
+// unchanged between two scans.
+func newDirWatcher(dir string, poll time.Duration) (dirWatcher, error) {
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		return nil, err
+	}
+
+	w := &pollWatcher{
+		dir:   dir,
+		files: make(chan string, 64),
+		done:  make(chan struct{}),
+	}
+	go w.run(poll)
+	return w, nil
+}
+
+func (w *pollWatcher) Files() <-chan string {
+	return w.files
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *pollWatcher) run(poll time.Duration) {
+	defer close(w.files)
+
+	seen := make(map[string]*pollFile)
+	t := time.NewTicker(poll)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+
+		fis, err := ioutil.ReadDir(w.dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return
+			}
+			continue
+		}
+
+		now := make(map[string]*pollFile, len(fis))
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+
+			nm := fi.Name()
+			f, ok := seen[nm]
+			if !ok || f.size != fi.Size() || !f.mod.Equal(fi.ModTime()) {
+				f = &pollFile{size: fi.Size(), mod: fi.ModTime()}
+			} else if !f.sent {
+				f.sent = true
+				select {
+				case w.files <- nm:
+				case <-w.done:
+					return
+				}
+			}
+			now[nm] = f
+		}
+		seen = now
+	}
+}
@@ -0,0 +1,98 @@
+// watch_test.go -- tests for the 'watch' command
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencoff/sigtool/sign"
+)
+
+func TestWatch(t *testing.T) {
+	assert := newAsserter(t)
+
+	kp, err := sign.NewKeypair()
+	assert(err == nil, "keygen fail: %s", err)
+
+	dn := tempdir(t)
+	d := &dropBox{
+		in:         filepath.Join(dn, "in"),
+		out:        filepath.Join(dn, "out"),
+		quarantine: filepath.Join(dn, "quarantine"),
+		pks:        []*sign.PublicKey{&kp.Pub},
+		retries:    1,
+	}
+	for _, dir := range []string{d.in, d.out, d.quarantine} {
+		err = os.MkdirAll(dir, 0700)
+		assert(err == nil, "mkdir: %s", err)
+	}
+
+	w, err := newDirWatcher(d.in, 50*time.Millisecond)
+	assert(err == nil, "watch: %s", err)
+	defer w.Close()
+
+	// drop a file and a dot file into the directory
+	data := []byte("dropped into the box\n")
+	err = ioutil.WriteFile(filepath.Join(d.in, ".hidden"), data, 0600)
+	assert(err == nil, "write: %s", err)
+	err = ioutil.WriteFile(filepath.Join(d.in, "a.txt"), data, 0600)
+	assert(err == nil, "write: %s", err)
+
+	outf := filepath.Join(d.out, "a.txt.enc")
+	timeout := time.After(10 * time.Second)
+	for {
+		if _, err := os.Stat(outf); err == nil {
+			break
+		}
+
+		select {
+		case fn := <-w.Files():
+			if len(fn) == 0 {
+				d.scan(false)
+			} else {
+				d.process(fn)
+			}
+		case <-timeout:
+			t.Fatalf("%s didn't appear", outf)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(d.in, "a.txt"))
+	assert(os.IsNotExist(err), "input not removed: %v", err)
+	_, err = os.Stat(filepath.Join(d.in, ".hidden"))
+	assert(err == nil, "dot file was taken: %v", err)
+	assert(d.failed == 0, "%d files quarantined", d.failed)
+
+	fd, err := os.Open(outf)
+	assert(err == nil, "open: %s", err)
+	defer fd.Close()
+
+	dd, err := sign.NewDecryptor(fd)
+	assert(err == nil, "decryptor create fail: %s", err)
+	err = dd.SetPrivateKey(&kp.Sec, nil)
+	assert(err == nil, "decryptor can't add SK: %s", err)
+
+	var out bytes.Buffer
+	err = dd.Decrypt(&out)
+	assert(err == nil, "decrypt: %s", err)
+	assert(bytes.Equal(out.Bytes(), data), "decrypt: plaintext mismatch")
+
+	ents, err := ioutil.ReadDir(d.out)
+	assert(err == nil && len(ents) == 1, "output directory has %d files", len(ents))
+}
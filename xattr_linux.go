@@ -0,0 +1,97 @@
+// xattr_linux.go -- extended attributes and POSIX ACLs on Linux
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// return the extended attributes of 'fn': the POSIX ACLs if 'acls' and
+// the others if 'xattrs'.
+func getXattrs(fn string, xattrs, acls bool) (map[string][]byte, error) {
+	sz, err := syscall.Listxattr(fn, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: can't list extended attributes: %s", fn, err)
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(fn, buf); err != nil {
+		return nil, fmt.Errorf("%s: can't list extended attributes: %s", fn, err)
+	}
+
+	attrs := make(map[string][]byte)
+	for _, nm := range bytes.Split(buf[:sz], []byte{0}) {
+		k := string(nm)
+		if len(k) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(k, _ACLPrefix) {
+			if !acls {
+				continue
+			}
+		} else if !xattrs {
+			continue
+		}
+
+		v, err := getXattr(fn, k)
+		if err != nil {
+			return nil, err
+		}
+		attrs[k] = v
+	}
+	return attrs, nil
+}
+
+func getXattr(fn, k string) ([]byte, error) {
+	for {
+		sz, err := syscall.Getxattr(fn, k, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't read extended attribute %s: %s", fn, k, err)
+		}
+
+		v := make([]byte, sz)
+		n, err := syscall.Getxattr(fn, k, v)
+		switch err {
+		case nil:
+			return v[:n], nil
+		case syscall.ERANGE:
+			// the attribute grew; try again
+		default:
+			return nil, fmt.Errorf("%s: can't read extended attribute %s: %s", fn, k, err)
+		}
+	}
+}
+
+// set the extended attributes of 'fn'
+func setXattrs(fn string, attrs map[string][]byte) error {
+	for k, v := range attrs {
+		if err := syscall.Setxattr(fn, k, v, 0); err != nil {
+			return fmt.Errorf("%s: can't set extended attribute %s: %s", fn, k, err)
+		}
+	}
+	return nil
+}
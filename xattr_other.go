@@ -0,0 +1,32 @@
+// xattr_other.go -- platforms without extended attribute support
+//
+// (c) 2016 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+func getXattrs(fn string, xattrs, acls bool) (map[string][]byte, error) {
+	return nil, fmt.Errorf("extended attributes and ACLs are not supported on this platform")
+}
+
+func setXattrs(fn string, attrs map[string][]byte) error {
+	if len(attrs) > 0 {
+		return fmt.Errorf("%s: extended attributes and ACLs are not supported on this platform", fn)
+	}
+	return nil
+}